@@ -1,6 +1,8 @@
 package app
 
 import (
+	"fmt"
+
 	"github.com/honeycombio/refinery/collect"
 	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/logger"
@@ -28,11 +30,45 @@ func (a *App) Start() error {
 
 	a.IncomingRouter.SetVersion(a.Version)
 
+	a.Metrics.Register("config_reloads", "counter")
+	a.Metrics.Register("config_reload_failures", "counter")
+	a.Metrics.Register("config_generation", "gauge")
+	a.Metrics.Gauge("config_generation", a.Config.GetGeneration())
+	a.Config.RegisterReloadCallback(func() {
+		a.Metrics.Increment("config_reloads")
+		a.Metrics.Gauge("config_generation", a.Config.GetGeneration())
+		a.logConfigChange()
+	})
+
 	// launch our main routers to listen for incoming event traffic from both peers
 	// and external sources
-	a.IncomingRouter.LnS()
+	return a.IncomingRouter.LnS()
+}
 
-	return nil
+// logConfigChange logs what changed in the latest version of the
+// configuration, so that the log has an audit trail of config changes.
+func (a *App) logConfigChange() {
+	history := a.Config.GetConfigHistory()
+	if len(history) == 0 {
+		return
+	}
+	latest := history[0]
+	changes := make([]string, 0, len(latest.Changes))
+	for _, c := range latest.Changes {
+		switch {
+		case c.Redacted:
+			changes = append(changes, fmt.Sprintf("%s %s %s (redacted)", c.Document, c.Path, c.Change))
+		default:
+			changes = append(changes, fmt.Sprintf("%s %s %s: %q -> %q", c.Document, c.Path, c.Change, c.Old, c.New))
+		}
+	}
+	a.Logger.Info().WithFields(map[string]interface{}{
+		"generation":  latest.Generation,
+		"trigger":     latest.Trigger,
+		"config_hash": latest.ConfigHash,
+		"rules_hash":  latest.RulesHash,
+		"changes":     changes,
+	}).Logf("configuration changed")
 }
 
 func (a *App) Stop() error {
@@ -33,6 +33,10 @@ import (
 	"github.com/honeycombio/refinery/collect/cache"
 	"github.com/honeycombio/refinery/collect/stressRelief"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/decisionexport"
+	"github.com/honeycombio/refinery/internal/dropaudit"
 	"github.com/honeycombio/refinery/internal/gossip"
 	"github.com/honeycombio/refinery/internal/health"
 	"github.com/honeycombio/refinery/logger"
@@ -40,6 +44,7 @@ import (
 	"github.com/honeycombio/refinery/redis"
 	"github.com/honeycombio/refinery/sample"
 	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
 )
 
 const legacyAPIKey = "c9945edf5d245834089a1bd6cc9ad01e"
@@ -185,6 +190,11 @@ func newStartedApp(
 		&inject.Object{Value: samplerFactory},
 		&inject.Object{Value: &health.Health{}},
 		&inject.Object{Value: &stressRelief.StressRelief{}, Name: "stressRelief"},
+		&inject.Object{Value: &decisionexport.NullExporter{}},
+		&inject.Object{Value: &dropaudit.NullAuditor{}},
+		&inject.Object{Value: &types.RandomIDGenerator{}},
+		&inject.Object{Value: &clustercount.LocalCounter{}},
+		&inject.Object{Value: &apikeys.LocalCache{}},
 		&inject.Object{Value: &a},
 	)
 	require.NoError(t, err)
@@ -0,0 +1,63 @@
+//go:build all || !race
+
+package centralstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/honeycombio/refinery/internal/allocbudget"
+	"github.com/honeycombio/refinery/redis"
+)
+
+// hashAllocsPerSpan is the most allocations serializing a span and its trace
+// status into Redis hash commands may take. It's high because redigo's
+// AddFlat reflects over every field of the status.
+const hashAllocsPerSpan = 75
+
+const allocTestSpans = 100
+
+func allocTestSpanList(spans int) []*CentralSpan {
+	list := make([]*CentralSpan, 0, spans)
+	for i := 0; i < spans; i++ {
+		list = append(list, &CentralSpan{
+			TraceID: fmt.Sprintf("trace%d", i/10),
+			SpanID:  fmt.Sprintf("span%d", i),
+			KeyFields: map[string]interface{}{
+				"http.status_code": 200,
+				"service.name":     "frontend",
+			},
+			AllFields: map[string]interface{}{
+				"http.status_code": 200,
+				"http.route":       "/users",
+				"service.name":     "frontend",
+				"duration_ms":      12.5,
+			},
+		})
+	}
+	return list
+}
+
+// serializeSpans builds the hash commands that are written to Redis for each
+// span: the span itself, and the initial status of its trace.
+func serializeSpans(tb testing.TB, spans []*CentralSpan) {
+	for _, span := range spans {
+		if _, err := addToSpanHash(span); err != nil {
+			tb.Fatal(err)
+		}
+		status := &centralTraceStatusInit{TraceID: span.TraceID, SamplerKey: span.samplerSelector}
+		redis.NewMultiSetHashCommand(span.TraceID+":status", redis.Args().AddFlat(status))
+	}
+}
+
+func TestHashSerializationAllocsPerSpan(t *testing.T) {
+	spans := allocTestSpanList(allocTestSpans)
+
+	allocbudget.Check(t, "serializing a span", hashAllocsPerSpan, allocTestSpans, func() { serializeSpans(t, spans) })
+}
+
+func BenchmarkHashSerialization(b *testing.B) {
+	spans := allocTestSpanList(allocTestSpans)
+
+	allocbudget.Benchmark(b, func() { serializeSpans(b, spans) })
+}
@@ -2,6 +2,7 @@ package centralstore
 
 import (
 	"context"
+	"math"
 	"time"
 
 	"github.com/honeycombio/refinery/collect/cache"
@@ -22,6 +23,11 @@ type CentralSpan struct {
 	KeyFields       map[string]interface{}
 	AllFields       map[string]interface{}
 	IsRoot          bool
+	// ChildCount is the number of child spans the span reported having, if
+	// HasChildCount is set. A span link may carry the count for the span
+	// it's attached to.
+	ChildCount    uint32
+	HasChildCount bool
 }
 
 func (s *CentralSpan) Fields() map[string]interface{} {
@@ -61,9 +67,14 @@ type CentralTraceStatus struct {
 	SamplerSelector string
 	reasonIndex     uint      // this is the cache ID for the reason
 	Timestamp       time.Time // this is the last time the trace state was changed
+	LastSpanAt      time.Time // this is the last time a span was added to the trace
 	Count           uint32    // number of spans in the trace
 	EventCount      uint32    // number of span events in the trace
 	LinkCount       uint32    // number of span links in the trace
+	HintedSpans     uint32    // number of spans that reported their child count
+	UnhintedSpans   uint32    // number of spans that didn't report their child count
+	HintedLinks     uint32    // number of span links that reported their span's child count
+	ChildHints      uint32    // sum of the child counts reported
 }
 
 // ensure that CentralTraceStatus implements KeptTrace
@@ -115,6 +126,45 @@ func (t *CentralTraceStatus) SampleRate() uint {
 	return uint(t.Rate)
 }
 
+// CompleteByChildCounts returns true if every span in the trace reported
+// its child count, either itself or through a span link, and all of the
+// spans those counts account for (plus the root) have arrived.
+func (t *CentralTraceStatus) CompleteByChildCounts() bool {
+	hinted := t.HintedSpans + t.HintedLinks
+	return t.UnhintedSpans == t.HintedLinks && hinted > 0 && hinted == t.ChildHints+1
+}
+
+// hintCounts returns how much the span adds to each of the trace status's
+// child-count counters. Both stores count hints this way, so that they agree
+// on when a trace is complete. Signaling spans, which have no span ID, aren't
+// counted.
+func (s *CentralSpan) hintCounts() (hintedSpans, unhintedSpans, hintedLinks, childHints uint32) {
+	if s.SpanID == "" {
+		return 0, 0, 0, 0
+	}
+	switch s.Type {
+	case types.SpanTypeNormal:
+		if s.HasChildCount {
+			return 1, 0, 0, s.ChildCount
+		}
+		return 0, 1, 0, 0
+	case types.SpanTypeLink:
+		if s.HasChildCount {
+			return 0, 0, 1, s.ChildCount
+		}
+	}
+	return 0, 0, 0, 0
+}
+
+// addSaturating adds two counts, stopping at the largest uint32 rather than
+// wrapping around.
+func addSaturating(a, b uint32) uint32 {
+	if a > math.MaxUint32-b {
+		return math.MaxUint32
+	}
+	return a + b
+}
+
 func (t *CentralTraceStatus) DescendantCount() uint32 {
 	return t.Count + t.EventCount + t.LinkCount
 }
@@ -0,0 +1,78 @@
+package centralstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/honeycombio/refinery/internal/otelutil"
+)
+
+// recentDecisionsKey is a sorted set of the traces that have been decided,
+// scored by the time of the decision. The state change script adds to it, and
+// the reaper removes decisions older than the trace retention time.
+const recentDecisionsKey = "refinery:recent_decisions"
+
+// warmupBatchSize is the number of trace statuses read from redis at a time
+// while warming up the decision cache.
+const warmupBatchSize = 1000
+
+// warmDecisionCache loads the most recent trace decisions from redis into the
+// decision cache, so that a refinery that was just started makes the same
+// decision as its peers for late spans of traces they already decided. It
+// stops at the configured timeout, keeping whatever was loaded by then, and
+// returns the number of decisions loaded.
+func (r *RedisBasicStore) warmDecisionCache(ctx context.Context) (int, error) {
+	cfg := r.Config.GetDecisionWarmupConfig()
+	if !cfg.Enabled || cfg.MaxDecisions <= 0 {
+		return 0, nil
+	}
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.Timeout))
+		defer cancel()
+	}
+
+	ctx, span := otelutil.StartSpanWith(ctx, r.Tracer, "warmDecisionCache", "max_decisions", cfg.MaxDecisions)
+	defer span.End()
+
+	conn := r.RedisClient.Get()
+	since := r.Clock.Now().Add(-r.states.config.maxTraceRetention).UnixMicro()
+	traceIDs, err := conn.ZRevRangeByScore(recentDecisionsKey, since, cfg.MaxDecisions)
+	conn.Close()
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+
+	var loaded int
+	for start := 0; start < len(traceIDs); start += warmupBatchSize {
+		if ctx.Err() != nil {
+			otelutil.AddSpanField(span, "timed_out", true)
+			break
+		}
+		end := min(start+warmupBatchSize, len(traceIDs))
+		statuses, err := r.traces.getTraceStatuses(ctx, r.RedisClient, traceIDs[start:end])
+		if err != nil {
+			span.RecordError(err)
+			return loaded, err
+		}
+		for _, status := range statuses {
+			// the status may have expired since the decision was listed
+			switch status.State {
+			case DecisionKeep:
+				r.DecisionCache.Record(status, true, status.KeepReason)
+			case DecisionDrop:
+				r.DecisionCache.Record(status, false, "")
+			default:
+				continue
+			}
+			loaded++
+		}
+	}
+
+	otelutil.AddSpanFields(span, map[string]interface{}{
+		"num_listed": len(traceIDs),
+		"num_loaded": loaded,
+	})
+	return loaded, nil
+}
@@ -0,0 +1,174 @@
+package centralstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/honeycombio/refinery/redis"
+)
+
+// ErrKeyCleanupUnsupported is returned by stores that don't keep their state
+// in Redis, so have nothing to clean up.
+var ErrKeyCleanupUnsupported = errors.New("key cleanup is only supported by the redis store")
+
+const defaultKeyCleanupBatchSize = 500
+
+// keyClasses maps the classes of per-trace keys that Refinery writes to Redis
+// to the patterns that match them. The per-state indexes of trace IDs are
+// deliberately not included; they are shared by every trace, and the reaper
+// already trims them.
+var keyClasses = map[string]string{
+	"spans":  "*:spans",
+	"status": "*:status",
+	"states": "*:states",
+}
+
+// KeyClasses returns the names of the classes of keys that can be cleaned up.
+func KeyClasses() []string {
+	classes := make([]string, 0, len(keyClasses))
+	for class := range keyClasses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// KeyCleanupOptions selects the keys for a cleanup.
+type KeyCleanupOptions struct {
+	Classes   []string
+	MinIdle   time.Duration
+	DryRun    bool
+	BatchSize int
+}
+
+// KeyCleanupProgress counts the keys a cleanup has looked at so far. In a dry
+// run, Matched keys are the ones that would have been deleted.
+type KeyCleanupProgress struct {
+	Class   string `json:"class"`
+	Scanned int    `json:"scanned"`
+	Matched int    `json:"matched"`
+	Deleted int    `json:"deleted"`
+	DryRun  bool   `json:"dry_run"`
+	Done    bool   `json:"done"`
+}
+
+// KeyCleaner is implemented by stores that can delete their own keys in bulk,
+// to recover from incidents that leave orphaned trace state behind.
+type KeyCleaner interface {
+	// CleanupKeys deletes the keys of the given classes that haven't been
+	// touched for at least MinIdle, in batches. It calls progress after each
+	// batch, and returns the final counts.
+	CleanupKeys(ctx context.Context, opts KeyCleanupOptions, progress func(KeyCleanupProgress)) (KeyCleanupProgress, error)
+}
+
+// CleanupKeys passes the cleanup on to the basic store, if it supports it.
+func (w *SmartWrapper) CleanupKeys(ctx context.Context, opts KeyCleanupOptions, progress func(KeyCleanupProgress)) (KeyCleanupProgress, error) {
+	cleaner, ok := w.BasicStore.(KeyCleaner)
+	if !ok {
+		return KeyCleanupProgress{}, ErrKeyCleanupUnsupported
+	}
+	return cleaner.CleanupKeys(ctx, opts, progress)
+}
+
+func (r *RedisBasicStore) CleanupKeys(ctx context.Context, opts KeyCleanupOptions, progress func(KeyCleanupProgress)) (KeyCleanupProgress, error) {
+	for _, class := range opts.Classes {
+		if _, ok := keyClasses[class]; !ok {
+			return KeyCleanupProgress{}, fmt.Errorf("unknown key class '%s'", class)
+		}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultKeyCleanupBatchSize
+	}
+
+	total := KeyCleanupProgress{DryRun: opts.DryRun}
+	for _, class := range opts.Classes {
+		counts, err := r.cleanupKeyClass(ctx, class, opts, progress)
+		total.Scanned += counts.Scanned
+		total.Matched += counts.Matched
+		total.Deleted += counts.Deleted
+		if err != nil {
+			return total, err
+		}
+	}
+	total.Done = true
+	return total, nil
+}
+
+func (r *RedisBasicStore) cleanupKeyClass(ctx context.Context, class string, opts KeyCleanupOptions, progress func(KeyCleanupProgress)) (KeyCleanupProgress, error) {
+	counts := KeyCleanupProgress{Class: class, DryRun: opts.DryRun}
+
+	// SCAN holds its connection until it's done, so the keys are checked
+	// and deleted on another one
+	scanConn := r.RedisClient.Get()
+	defer scanConn.Close()
+	conn := r.RedisClient.Get()
+	defer conn.Close()
+
+	cancel := make(chan struct{})
+	defer close(cancel)
+	keys, errs := scanConn.Scan(keyClasses[class], fmt.Sprint(opts.BatchSize), cancel)
+
+	batch := make([]string, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) > 0 && !opts.DryRun {
+			deleted, err := conn.Unlink(batch...)
+			if err != nil {
+				return err
+			}
+			counts.Deleted += int(deleted)
+			r.Metrics.Count("redisstore_keys_cleaned_up", deleted)
+		}
+		batch = batch[:0]
+		if progress != nil {
+			progress(counts)
+		}
+		return nil
+	}
+
+	for keys != nil {
+		var key string
+		var ok bool
+		select {
+		case key, ok = <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else if err != nil {
+				return counts, err
+			}
+			continue
+		case <-ctx.Done():
+			return counts, ctx.Err()
+		}
+
+		counts.Scanned++
+		idle, err := conn.IdleTime(key)
+		if errors.Is(err, redis.ErrKeyNotFound) {
+			// it expired or was deleted while we were scanning
+			continue
+		}
+		if err != nil {
+			return counts, err
+		}
+		if idle < opts.MinIdle {
+			continue
+		}
+		counts.Matched++
+		batch = append(batch, key)
+		if len(batch) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return counts, err
+			}
+		}
+	}
+
+	counts.Done = true
+	return counts, flush()
+}
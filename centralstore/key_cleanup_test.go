@@ -0,0 +1,50 @@
+package centralstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisBasicStore_CleanupKeys(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+	service := store.RedisClient.(*redis.TestService).Service
+
+	span := func(traceID string) *CentralSpan {
+		return &CentralSpan{TraceID: traceID, SpanID: "span", KeyFields: map[string]interface{}{"foo": "bar"}}
+	}
+	require.NoError(t, store.WriteSpans(ctx, []*CentralSpan{span("stale")}))
+	service.SetTime(store.clock.Now().Add(2 * time.Hour))
+	require.NoError(t, store.WriteSpans(ctx, []*CentralSpan{span("fresh")}))
+
+	opts := KeyCleanupOptions{Classes: KeyClasses(), MinIdle: time.Hour, DryRun: true, BatchSize: 1}
+	var batches int
+	dryRun, err := store.CleanupKeys(ctx, opts, func(KeyCleanupProgress) { batches++ })
+	require.NoError(t, err)
+	assert.True(t, dryRun.Done)
+	assert.NotZero(t, dryRun.Matched)
+	assert.Greater(t, dryRun.Scanned, dryRun.Matched)
+	assert.Zero(t, dryRun.Deleted)
+	assert.GreaterOrEqual(t, batches, dryRun.Matched)
+	// checking for keys directly would count as touching them
+	assert.Contains(t, service.Keys(), "stale:spans")
+
+	opts.DryRun = false
+	total, err := store.CleanupKeys(ctx, opts, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dryRun.Matched, total.Deleted)
+	keys := service.Keys()
+	assert.NotContains(t, keys, "stale:spans")
+	assert.NotContains(t, keys, "stale:status")
+	assert.Contains(t, keys, "fresh:spans")
+	assert.Contains(t, keys, "fresh:status")
+
+	_, err = store.CleanupKeys(ctx, KeyCleanupOptions{Classes: []string{"everything"}}, nil)
+	assert.Error(t, err)
+}
@@ -28,6 +28,7 @@ type LocalStore struct {
 	Metrics       metrics.Metrics      `inject:"genericMetrics"`
 	Tracer        trace.Tracer         `inject:"tracer"`
 	Clock         clockwork.Clock      `inject:""`
+	Timeouts      *TraceTimeouts       `inject:""`
 	// states holds the current state of each trace in a map of the different states
 	// indexed by trace ID.
 	states map[CentralTraceState]statusMap
@@ -236,6 +237,12 @@ spanLoop:
 		// Add the span to the trace; this works even if the trace has no spans yet
 		lrs.traces[span.TraceID].Spans = append(lrs.traces[span.TraceID].Spans, span)
 		lrs.states[state][span.TraceID].Count++
+		lrs.states[state][span.TraceID].LastSpanAt = lrs.Clock.Now()
+		hintedSpans, unhintedSpans, hintedLinks, childHints := span.hintCounts()
+		lrs.states[state][span.TraceID].HintedSpans += hintedSpans
+		lrs.states[state][span.TraceID].UnhintedSpans += unhintedSpans
+		lrs.states[state][span.TraceID].HintedLinks += hintedLinks
+		lrs.states[state][span.TraceID].ChildHints = addSaturating(lrs.states[state][span.TraceID].ChildHints, childHints)
 		if span.Type == types.SpanTypeLink {
 			lrs.states[state][span.TraceID].LinkCount++
 		} else if span.Type == types.SpanTypeEvent {
@@ -247,6 +254,12 @@ spanLoop:
 			lrs.traces[span.TraceID].Root = span
 			switch state {
 			case Collecting:
+				// the signal to decide a trace early has no span ID, and
+				// isn't the end of the trace
+				if span.SpanID != "" {
+					status := lrs.states[Collecting][span.TraceID]
+					lrs.Timeouts.Observe(status.SamplerSelector, lrs.Clock.Since(status.Timestamp))
+				}
 				lrs.changeTraceState(span.TraceID, Collecting, DecisionDelay)
 			default:
 				// for all other states, we don't need to do anything
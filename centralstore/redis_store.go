@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/honeycombio/refinery/collect/cache"
 	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/generics"
@@ -18,6 +21,7 @@ import (
 	"github.com/honeycombio/refinery/types"
 	"github.com/jonboulle/clockwork"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -46,10 +50,13 @@ type RedisBasicStore struct {
 	RedisClient   redis.Client         `inject:"redis"`
 	Tracer        trace.Tracer         `inject:"tracer"`
 	Clock         clockwork.Clock      `inject:""`
+	Timeouts      *TraceTimeouts       `inject:""`
 
 	traces              *tracesStore
 	states              *traceStateProcessor
 	lastMetricsRecorded time.Time
+	compactScript       redis.Script
+	compactionDone      chan struct{}
 }
 
 func (r *RedisBasicStore) Start() error {
@@ -108,6 +115,8 @@ func (r *RedisBasicStore) Start() error {
 	r.Metrics.Register(metricsPrefixConnection+"wait", "gauge")
 	r.Metrics.Register(metricsPrefixConnection+"wait_duration_ms", "gauge")
 
+	r.Metrics.Register("redisstore_keys_cleaned_up", "counter")
+
 	if r.Config.GetRedisMetricsCycleRate() != 0 {
 		// register metrics for memory stats
 		r.Metrics.Register(metricsPrefixMemory+"used_total", "gauge")
@@ -116,11 +125,28 @@ func (r *RedisBasicStore) Start() error {
 		r.Metrics.Register(metricsPrefixCount+"traces", "gauge")
 	}
 
+	// load recent decisions before this refinery starts accepting spans;
+	// if that fails, it starts with an empty decision cache as it would have
+	// without the warmup, so the error isn't fatal
+	r.Metrics.Register("redisstore_decisions_warmed", "gauge")
+	warmed, _ := r.warmDecisionCache(context.Background())
+	r.Metrics.Gauge("redisstore_decisions_warmed", warmed)
+
+	r.compactScript = r.RedisClient.NewScript(compactStatusesKey, compactStatusesScript)
+	if compaction := r.Config.GetStateCompactionConfig(); compaction.Enabled {
+		r.Metrics.Register("redisstore_statuses_compacted", "counter")
+		r.compactionDone = make(chan struct{})
+		go r.compactStatuses(time.Duration(compaction.Interval), r.compactionDone)
+	}
+
 	return nil
 }
 
 func (r *RedisBasicStore) Stop() error {
 	r.states.Stop()
+	if r.compactionDone != nil {
+		close(r.compactionDone)
+	}
 	return nil
 }
 
@@ -215,6 +241,9 @@ func (r *RedisBasicStore) WriteSpans(ctx context.Context, spans []*CentralSpan)
 	}
 
 	collecting := make(map[string]struct{})
+	// the selectors of traces whose root span is arriving, whose durations
+	// are recorded for adaptive timeouts
+	var completed map[string]string
 	storeSpans := make([]*CentralSpan, 0, len(spans))
 	newSpans := make([]*CentralSpan, 0, len(spans))
 	shouldIncrementCounts := make([]*CentralSpan, 0, len(spans))
@@ -237,10 +266,26 @@ func (r *RedisBasicStore) WriteSpans(ctx context.Context, spans []*CentralSpan)
 		case Collecting:
 			if span.IsRoot {
 				collecting[span.TraceID] = struct{}{}
+				// the signal to decide a trace early has no span ID, and
+				// isn't the end of the trace
+				if span.SpanID != "" && r.Timeouts.Enabled() {
+					if completed == nil {
+						completed = make(map[string]string)
+					}
+					completed[span.TraceID] = span.samplerSelector
+				}
 			}
 		case DecisionDelay, ReadyToDecide:
 		case Unknown:
 			newSpans = append(newSpans, span)
+			// a trace can start with its root span; it's created in
+			// Collecting below and can move on straight away
+			if span.IsRoot {
+				collecting[span.TraceID] = struct{}{}
+				if span.SpanID != "" {
+					r.Timeouts.Observe(span.samplerSelector, 0)
+				}
+			}
 		}
 
 		if span.SpanID != "" {
@@ -268,10 +313,29 @@ func (r *RedisBasicStore) WriteSpans(ctx context.Context, spans []*CentralSpan)
 		ids = append(ids, id)
 	}
 
-	_, err = r.states.toNextState(ctx, conn, newTraceStateChangeEvent(Collecting, DecisionDelay), ids...)
+	// a trace's timestamp is when it was first stored until it leaves
+	// Collecting, so it's read before the trace moves on
+	var firstSeen map[string]time.Time
+	if len(completed) > 0 {
+		completedIDs := make([]string, 0, len(completed))
+		for id := range completed {
+			completedIDs = append(completedIDs, id)
+		}
+		firstSeen, err = r.traces.getTraceTimestamps(ctx, conn, completedIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	moved, err := r.states.toNextState(ctx, conn, newTraceStateChangeEvent(Collecting, DecisionDelay), ids...)
 	if err != nil {
 		return err
 	}
+	for _, id := range moved {
+		if ts, ok := firstSeen[id]; ok {
+			r.Timeouts.Observe(completed[id], r.Clock.Since(ts))
+		}
+	}
 
 	err = r.traces.storeSpans(ctx, conn, storeSpans)
 	if err != nil {
@@ -328,9 +392,6 @@ func (r *RedisBasicStore) GetStatusForTraces(ctx context.Context, traceIDs []str
 	ctx, span := otelutil.StartSpanWith(ctx, r.Tracer, "GetStatusForTraces", "num_traces", len(traceIDs))
 	defer span.End()
 
-	conn := r.RedisClient.Get()
-	defer conn.Close()
-
 	statusMapFromRedis, err := r.traces.getTraceStatuses(ctx, r.RedisClient, traceIDs)
 	if err != nil {
 		return nil, err
@@ -626,17 +687,47 @@ type tracesStore struct {
 	tracer          trace.Tracer
 	keepTraceScript redis.Script
 	config          config.Config
+
+	// statusReads coalesces concurrent reads of the same trace status, which
+	// are common when a burst of late spans arrives for one trace
+	statusReads singleflight.Group
+
+	// lastSpanWrites remembers when this node last wrote each trace's
+	// LastSpanAt, so that busy traces don't write it for every span
+	lastSpanWrites *lru.Cache[string, int64]
 }
 
+const (
+	// lastSpanWritesSize is how many traces' LastSpanAt writes are
+	// remembered for throttling.
+	lastSpanWritesSize = 10_000
+	// lastSpanAtResolution is how many times per quiet period LastSpanAt is
+	// written at most. A trace can look quiet up to 1/lastSpanAtResolution of
+	// the quiet period early.
+	lastSpanAtResolution = 4
+)
+
 func newTraceStatusStore(clock clockwork.Clock, tracer trace.Tracer, keepTraceScript redis.Script, cfg config.Config) *tracesStore {
+	lastSpanWrites, _ := lru.New[string, int64](lastSpanWritesSize)
 	return &tracesStore{
 		clock:           clock,
 		tracer:          tracer,
 		keepTraceScript: keepTraceScript,
 		config:          cfg,
+		lastSpanWrites:  lastSpanWrites,
 	}
 }
 
+// shouldWriteLastSpanAt returns true if a trace's LastSpanAt needs updating
+// to now, given that writes less than interval apart are skipped.
+func (t *tracesStore) shouldWriteLastSpanAt(traceID string, now int64, interval time.Duration) bool {
+	if last, ok := t.lastSpanWrites.Get(traceID); ok && now-last <= interval.Microseconds() {
+		return false
+	}
+	t.lastSpanWrites.Add(traceID, now)
+	return true
+}
+
 type centralTraceStatusInit struct {
 	TraceID    string
 	Count      uint32 // number of spans in the trace
@@ -653,20 +744,31 @@ type centralTraceStatusReason struct {
 }
 
 type centralTraceStatusRedis struct {
-	TraceID     string
-	State       string
-	Rate        uint
-	Metadata    []byte
-	Count       uint32
-	EventCount  uint32
-	LinkCount   uint32
-	KeepReason  string
-	SamplerKey  string
-	ReasonIndex uint
-	Timestamp   int64
+	TraceID       string
+	State         string
+	Rate          uint
+	Metadata      []byte
+	Count         uint32
+	EventCount    uint32
+	LinkCount     uint32
+	KeepReason    string
+	SamplerKey    string
+	ReasonIndex   uint
+	Timestamp     int64
+	LastSpanAt    int64
+	HintedSpans   uint32
+	UnhintedSpans uint32
+	HintedLinks   uint32
+	ChildHints    uint32
+	Compact       string
 }
 
 func normalizeCentralTraceStatusRedis(status *centralTraceStatusRedis) *CentralTraceStatus {
+	status, err := status.expand()
+	if err != nil {
+		fmt.Println(err)
+	}
+
 	metadata := make(map[string]any, 0)
 	if status.Metadata != nil {
 		err := json.Unmarshal(status.Metadata, &metadata)
@@ -675,6 +777,11 @@ func normalizeCentralTraceStatusRedis(status *centralTraceStatusRedis) *CentralT
 		}
 	}
 
+	var lastSpanAt time.Time
+	if status.LastSpanAt != 0 {
+		lastSpanAt = time.UnixMicro(status.LastSpanAt)
+	}
+
 	return &CentralTraceStatus{
 		TraceID:         status.TraceID,
 		State:           CentralTraceState(status.State),
@@ -687,6 +794,11 @@ func normalizeCentralTraceStatusRedis(status *centralTraceStatusRedis) *CentralT
 		EventCount:      status.EventCount,
 		LinkCount:       status.LinkCount,
 		Timestamp:       time.UnixMicro(status.Timestamp),
+		LastSpanAt:      lastSpanAt,
+		HintedSpans:     status.HintedSpans,
+		UnhintedSpans:   status.UnhintedSpans,
+		HintedLinks:     status.HintedLinks,
+		ChildHints:      status.ChildHints,
 	}
 }
 
@@ -767,6 +879,37 @@ func (t *tracesStore) getTraceStates(ctx context.Context, conn redis.Conn, trace
 	return states, nil
 }
 
+// getTraceTimestamps returns the time each trace last changed state, for the
+// traces that exist.
+func (t *tracesStore) getTraceTimestamps(ctx context.Context, conn redis.Conn, traceIDs []string) (map[string]time.Time, error) {
+	_, span := t.tracer.Start(ctx, "getTraceTimestamps")
+	defer span.End()
+
+	for _, id := range traceIDs {
+		cmd := redis.NewGetHashCommand(t.traceStatusKey(id), "Timestamp")
+		if err := cmd.Send(conn); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	replies, err := conn.ReceiveStrings(len(traceIDs))
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	timestamps := make(map[string]time.Time, len(traceIDs))
+	for i, reply := range replies {
+		micros, err := strconv.ParseInt(reply, 10, 64)
+		if err != nil || micros == 0 {
+			continue
+		}
+		timestamps[traceIDs[i]] = time.UnixMicro(micros)
+	}
+	return timestamps, nil
+}
+
 // keepTrace stores the reason and metadata used for making a keep decision about a trace.
 // it updates the trace statuses in batch. If one of the updates fails, it ignores the error
 // and continues to update the rest of the traces.
@@ -831,30 +974,62 @@ func (t *tracesStore) getTraceStatuses(ctx context.Context, client redis.Client,
 	// Now create a worker factory that will create a worker that will get the status for a traceID.
 	// We also want telemetry so we do a little bit of prework and a cleanup function.
 	workerFactory := func(i int) (func(traceID string) *CentralTraceStatus, func(int)) {
-		conn := client.Get()
-		queries := 0
-		found := 0
+		// reads can be shared with other workers and outlive the worker that
+		// started them, so the counts are atomic
+		var queries, found atomic.Int64
 		_, span := otelutil.StartSpanWith(ctx, t.tracer, "getTraceStatusesWorker", "worker", i)
+		coalesced := 0
 		worker := func(traceID string) *CentralTraceStatus {
-			status := &centralTraceStatusRedis{}
-			err := conn.GetStructHash(t.traceStatusKey(traceID), status)
-			queries++
-			if err != nil {
-				if errors.Is(err, redis.ErrKeyNotFound) {
-					status.TraceID = traceID
-					return normalizeCentralTraceStatusRedis(status)
+			ch := t.statusReads.DoChan(traceID, func() (any, error) {
+				// the read may be shared, so it uses its own connection
+				// rather than one that its caller might close early
+				conn := client.Get()
+				defer conn.Close()
+
+				status := &centralTraceStatusRedis{}
+				err := conn.GetStructHash(t.traceStatusKey(traceID), status)
+				queries.Add(1)
+				if err != nil {
+					if errors.Is(err, redis.ErrKeyNotFound) {
+						status.TraceID = traceID
+						return normalizeCentralTraceStatusRedis(status), nil
+					}
+					// don't let later readers join a failed read
+					t.statusReads.Forget(traceID)
+					return nil, err
 				}
-				statusSpan.RecordError(err)
+				found.Add(1)
+				return normalizeCentralTraceStatusRedis(status), nil
+			})
+
+			var res singleflight.Result
+			select {
+			case res = <-ch:
+			case <-ctx.Done():
+				// the read may be stuck; later readers start a new one
+				// instead of joining it
+				t.statusReads.Forget(traceID)
+				statusSpan.RecordError(ctx.Err())
+				return nil
+			}
+			if res.Err != nil {
+				statusSpan.RecordError(res.Err)
 				return nil
 			}
-			found++
-			return normalizeCentralTraceStatusRedis(status)
+			status := res.Val.(*CentralTraceStatus)
+			if res.Shared {
+				// callers modify the statuses they get back, so each one
+				// needs its own copy
+				coalesced++
+				status = status.Clone()
+			}
+			return status
 		}
 		cleanup := func(i int) {
-			conn.Close()
 			otelutil.AddSpanFields(span, map[string]interface{}{
-				"num_queries": queries,
-				"num_found":   found,
+				"num_queries":   queries.Load(),
+				"num_found":     found.Load(),
+				"num_coalesced": coalesced,
 			})
 			span.End()
 		}
@@ -898,16 +1073,38 @@ func (t *tracesStore) storeSpans(ctx context.Context, conn redis.Conn, spans []*
 	})
 	defer spanStore.End()
 
-	commands := make([]redis.Command, 2*len(spans))
-	for i := 0; i < len(commands); i += 2 {
-		var err error
-		span := spans[i/2]
-		commands[i], err = addToSpanHash(span)
+	// LastSpanAt is only used by the quiet period trigger, and is written at
+	// most a few times per quiet period for each trace
+	opts := t.config.GetCentralStoreOptions()
+	trackLastSpan := opts.DecisionTrigger == "quiet_period"
+	lastSpanInterval := time.Duration(opts.QuietPeriod) / lastSpanAtResolution
+
+	now := t.clock.Now().UnixMicro()
+	commands := make([]redis.Command, 0, 4*len(spans))
+	for _, span := range spans {
+		cmd, err := addToSpanHash(span)
 		if err != nil {
 			return err
 		}
-
-		commands[i+1] = t.incrementSpanCountsCMD(span.TraceID, span.Type)
+		statusKey := t.traceStatusKey(span.TraceID)
+		commands = append(commands,
+			cmd,
+			t.incrementSpanCountsCMD(span.TraceID, span.Type),
+		)
+		if trackLastSpan && t.shouldWriteLastSpanAt(span.TraceID, now, lastSpanInterval) {
+			commands = append(commands, redis.NewSetHashCommand(statusKey, map[string]any{"LastSpanAt": now}))
+		}
+		hintedSpans, unhintedSpans, hintedLinks, childHints := span.hintCounts()
+		for field, n := range map[string]uint32{
+			"HintedSpans":   hintedSpans,
+			"UnhintedSpans": unhintedSpans,
+			"HintedLinks":   hintedLinks,
+			"ChildHints":    childHints,
+		} {
+			if n > 0 {
+				commands = append(commands, redis.NewIncrByHashCommand(statusKey, field, int64(n)))
+			}
+		}
 	}
 
 	err := conn.Exec(commands...)
@@ -1184,6 +1381,15 @@ func (t *traceStateProcessor) removeExpiredTraces(ctx context.Context, client re
 		otelutil.AddSpanField(span, state.String(), replies)
 	}
 
+	replies, err := t.config.removeExpiredTraces.DoInt(ctx, conn, recentDecisionsKey,
+		t.clock.Now().Add(-t.config.maxTraceRetention).UnixMicro(),
+		t.config.reaperBatchSize)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+	otelutil.AddSpanField(span, "recent_decisions", replies)
+
 }
 
 // applyStateChange runs a lua script that atomically moves traces between states and returns the trace IDs that has completed a state change.
@@ -1338,6 +1544,11 @@ const traceStateChangeScript = `
 	   local removed = redis.call('ZREM', string.format("%s:traces", currentState), traceID)
 
 	   local status = redis.call("HSET", string.format("%s:status", traceID), "State", nextState, "Timestamp", timestamp)
+
+	   -- this key should match with recentDecisionsKey
+	   if (nextState == "decision_keep") or (nextState == "decision_drop") then
+		redis.call('ZADD', "refinery:recent_decisions", timestamp, traceID)
+	   end
 `
 
 const validStateChangeEventsKey = "valid-state-change-events"
@@ -118,6 +118,56 @@ func TestRedisBasicStore_TraceStatus(t *testing.T) {
 
 }
 
+func TestRedisBasicStore_RootFirstTrace(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+
+	// like the local store, a trace whose first span is its root moves on
+	// to DecisionDelay instead of waiting out the trace timeout in Collecting
+	require.NoError(t, store.WriteSpans(ctx, []*CentralSpan{{
+		TraceID:   "traceID0",
+		SpanID:    "spanID0",
+		KeyFields: map[string]interface{}{"root": "bar"},
+		IsRoot:    true,
+	}}))
+	status, err := store.GetStatusForTraces(ctx, []string{"traceID0"}, DecisionDelay)
+	require.NoError(t, err)
+	require.Len(t, status, 1)
+	assert.Equal(t, DecisionDelay, status[0].State)
+}
+
+func TestRedisBasicStore_LastSpanAtThrottled(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+	cfg := store.Config.(*config.MockConfig)
+	cfg.StoreOptions.DecisionTrigger = "quiet_period"
+	cfg.StoreOptions.QuietPeriod = config.Duration(400 * time.Millisecond)
+
+	write := func(spanID string) time.Time {
+		require.NoError(t, store.WriteSpans(ctx, []*CentralSpan{{
+			TraceID:   "traceID0",
+			SpanID:    spanID,
+			KeyFields: map[string]interface{}{"foo": "bar"},
+		}}))
+		status, err := store.GetStatusForTraces(ctx, []string{"traceID0"}, Collecting)
+		require.NoError(t, err)
+		require.Len(t, status, 1)
+		return status[0].LastSpanAt
+	}
+
+	start := store.clock.Now()
+	assert.Equal(t, start.UnixMicro(), write("spanID0").UnixMicro())
+
+	// writes less than a quarter of the quiet period apart are skipped
+	store.clock.Advance(50 * time.Millisecond)
+	assert.Equal(t, start.UnixMicro(), write("spanID1").UnixMicro())
+
+	store.clock.Advance(100 * time.Millisecond)
+	assert.Equal(t, store.clock.Now().UnixMicro(), write("spanID2").UnixMicro())
+}
+
 func TestRedisBasicStore_GetTrace(t *testing.T) {
 	ctx := context.Background()
 	traceID := "traceID0"
@@ -178,6 +228,61 @@ func TestRedisBasicStore_GetStatusForTraces(t *testing.T) {
 	require.Len(t, status, 0)
 }
 
+func TestRedisBasicStore_GetStatusForTracesConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+
+	traceID := "traceID0"
+	store.ensureInitialState(t, ctx, store.RedisClient.Get(), traceID, Collecting)
+
+	// concurrent reads of the same trace may be coalesced, but every caller
+	// must still get its own copy of the status
+	const readers = 20
+	results := make([]*CentralTraceStatus, readers)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses, err := store.GetStatusForTraces(ctx, []string{traceID}, Collecting)
+			assert.NoError(t, err)
+			if assert.Len(t, statuses, 1) {
+				results[i] = statuses[0]
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range results {
+		require.NotNil(t, status)
+		assert.Equal(t, Collecting, status.State)
+		for _, other := range results[i+1:] {
+			assert.NotSame(t, status, other)
+		}
+	}
+}
+
+func TestRedisBasicStore_GetStatusForTracesCanceled(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+
+	traceID := "traceID0"
+	store.ensureInitialState(t, ctx, store.RedisClient.Get(), traceID, Collecting)
+
+	// a caller that gives up doesn't leave later callers waiting on its read
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := store.GetStatusForTraces(canceled, []string{traceID}, Collecting)
+	require.NoError(t, err)
+
+	statuses, err := store.GetStatusForTraces(ctx, []string{traceID}, Collecting)
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, Collecting, statuses[0].State)
+}
+
 func TestRedisBasicStore_applyStateChange_NoTraces(t *testing.T) {
 	ctx := context.Background()
 	testRedis := &redis.TestService{}
@@ -382,6 +487,62 @@ func TestRedisBasicStore_KeepTraces(t *testing.T) {
 	require.Nil(t, trace.Root)
 }
 
+func TestRedisBasicStore_WarmDecisionCache(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+
+	conn := store.RedisClient.Get()
+	defer conn.Close()
+
+	keepTraceID := "traceID0"
+	dropTraceID := "traceID1"
+	store.ensureInitialState(t, ctx, conn, keepTraceID, AwaitingDecision)
+	store.ensureInitialState(t, ctx, conn, dropTraceID, AwaitingDecision)
+	status, err := store.GetStatusForTraces(ctx, []string{keepTraceID}, AwaitingDecision)
+	require.NoError(t, err)
+	status[0].KeepReason = "kept"
+	require.NoError(t, store.KeepTraces(ctx, status))
+	require.NoError(t, store.ChangeTraceStatus(ctx, []string{dropTraceID}, AwaitingDecision, DecisionDrop))
+
+	// a restarted refinery has an empty decision cache
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	fresh := &cache.CuckooSentCache{Cfg: store.Config, Met: mockMetrics}
+	require.NoError(t, fresh.Start())
+	defer fresh.Stop()
+	store.DecisionCache = fresh
+
+	loaded, err := store.warmDecisionCache(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, loaded, "warmup is disabled")
+
+	cfg := store.Config.(*config.MockConfig)
+	cfg.Mux.Lock()
+	cfg.DecisionWarmup = config.DecisionWarmupConfig{Enabled: true, MaxDecisions: 10, Timeout: duration("5s")}
+	cfg.Mux.Unlock()
+
+	loaded, err = store.warmDecisionCache(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+
+	record, reason, found := fresh.Test(keepTraceID)
+	require.True(t, found)
+	assert.True(t, record.Kept())
+	assert.Equal(t, "kept", reason)
+	// drops are added to the filter in the background
+	assert.Eventually(t, func() bool {
+		record, _, found := fresh.Test(dropTraceID)
+		return found && !record.Kept()
+	}, time.Second, 10*time.Millisecond)
+
+	// decisions older than the retention time aren't loaded
+	store.clock.Advance(store.states.config.maxTraceRetention + time.Minute)
+	loaded, err = store.warmDecisionCache(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, loaded)
+}
+
 func TestRedisBasicStore_ConcurrentStateChange(t *testing.T) {
 	ctx := context.Background()
 
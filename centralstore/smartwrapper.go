@@ -25,6 +25,7 @@ type SmartWrapper struct {
 	BasicStore     BasicStorer     `inject:""`
 	Tracer         trace.Tracer    `inject:"tracer"`
 	Clock          clockwork.Clock `inject:""`
+	Timeouts       *TraceTimeouts  `inject:""`
 	spanChan       chan *CentralSpan
 	stopped        chan struct{}
 	done           chan struct{}
@@ -58,6 +59,12 @@ func (w *SmartWrapper) Start() error {
 	w.Metrics.Register("smartstore_span_queue_in", "counter")
 	w.Metrics.Register("smartstore_span_queue_out", "counter")
 	w.Metrics.Register("smartstore_write_span_batch_size", "gauge")
+	// these record how traces were judged ready for a decision
+	w.Metrics.Register("trace_ready_child_counts", "counter")
+	w.Metrics.Register("trace_ready_send_delay", "counter")
+	w.Metrics.Register("trace_ready_quiet_period", "counter")
+	w.Metrics.Register("trace_ready_root_arrival", "counter")
+	w.Metrics.Register("trace_timed_out_without_root", "counter")
 
 	w.Metrics.Store("SPAN_CHANNEL_CAP", float64(opts.SpanChannelSize))
 
@@ -147,11 +154,79 @@ func (w *SmartWrapper) processSpans(ctx context.Context) {
 }
 
 // helper function for manageStates
-func (w *SmartWrapper) manageTimeouts(ctx context.Context, timeout time.Duration, fromState, toState CentralTraceState) error {
+func (w *SmartWrapper) manageTimeouts(ctx context.Context, timeout time.Duration, fromState, toState CentralTraceState, metric string) error {
+	return w.changeStatesWhere(ctx, fromState, toState, func(status *CentralTraceStatus) (bool, string) {
+		return !status.Timestamp.IsZero() && w.Clock.Since(status.Timestamp) > timeout, metric
+	})
+}
+
+// traceTimeout returns the trace timeout for a sampler selector: its
+// override, if it has one, or else its adaptive timeout, which falls back to
+// the configured one.
+func (w *SmartWrapper) traceTimeout(selector string, options config.SmartWrapperOptions) time.Duration {
+	if timeout := w.Config.GetCollectionOverride(selector).TraceTimeout; timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return w.Timeouts.Timeout(selector, time.Duration(options.TraceTimeout))
+}
+
+// sendDelay returns the send delay for a sampler selector.
+func (w *SmartWrapper) sendDelay(selector string, options config.SmartWrapperOptions) time.Duration {
+	if delay := w.Config.GetCollectionOverride(selector).SendDelay; delay > 0 {
+		return time.Duration(delay)
+	}
+	return time.Duration(options.SendDelay)
+}
+
+// manageTraceTimeouts moves traces whose root span hasn't arrived from
+// Collecting to DecisionDelay, once they've waited for longer than the trace
+// timeout of their sampler selector.
+func (w *SmartWrapper) manageTraceTimeouts(ctx context.Context, options config.SmartWrapperOptions) error {
+	return w.changeStatesWhere(ctx, Collecting, DecisionDelay, func(status *CentralTraceStatus) (bool, string) {
+		timeout := w.traceTimeout(status.SamplerSelector, options)
+		return !status.Timestamp.IsZero() && w.Clock.Since(status.Timestamp) > timeout, "trace_timed_out_without_root"
+	})
+}
+
+// manageDelayedTraces moves traces whose root span has arrived from
+// DecisionDelay to ReadyToDecide. Traces whose child counts show that every
+// span has arrived move right away. Otherwise, depending on the trigger,
+// traces move after SendDelay, shortly after the root span arrived, or once
+// no new spans have arrived for the quiet period (but no later than the
+// trace timeout).
+func (w *SmartWrapper) manageDelayedTraces(ctx context.Context, options config.SmartWrapperOptions) error {
+	return w.changeStatesWhere(ctx, DecisionDelay, ReadyToDecide, func(status *CentralTraceStatus) (bool, string) {
+		if status.Timestamp.IsZero() {
+			return false, ""
+		}
+		if status.CompleteByChildCounts() {
+			return true, "trace_ready_child_counts"
+		}
+		if options.DecisionTrigger == "root_arrival" {
+			return w.Clock.Since(status.Timestamp) > time.Duration(options.RootLinger), "trace_ready_root_arrival"
+		}
+		if options.DecisionTrigger != "quiet_period" {
+			return w.Clock.Since(status.Timestamp) > w.sendDelay(status.SamplerSelector, options), "trace_ready_send_delay"
+		}
+		if w.Clock.Since(status.Timestamp) > w.traceTimeout(status.SamplerSelector, options) {
+			return true, "trace_ready_quiet_period"
+		}
+		lastActivity := status.Timestamp
+		if status.LastSpanAt.After(lastActivity) {
+			lastActivity = status.LastSpanAt
+		}
+		return w.Clock.Since(lastActivity) > time.Duration(options.QuietPeriod), "trace_ready_quiet_period"
+	})
+}
+
+// changeStatesWhere moves the traces in fromState for which ready returns
+// true to toState. ready also names the counter, if any, that records why
+// the trace was moved.
+func (w *SmartWrapper) changeStatesWhere(ctx context.Context, fromState, toState CentralTraceState, ready func(*CentralTraceStatus) (bool, string)) error {
 	if w.BasicStore == nil {
 		return fmt.Errorf("basic store is nil")
 	}
-	ctx, span := otelutil.StartSpanMulti(ctx, w.Tracer, "SmartWrapper.manageTimeouts", map[string]interface{}{
+	ctx, span := otelutil.StartSpanMulti(ctx, w.Tracer, "SmartWrapper.changeStatesWhere", map[string]interface{}{
 		"from_state": fromState,
 		"to_state":   toState,
 	})
@@ -172,12 +247,16 @@ func (w *SmartWrapper) manageTimeouts(ctx context.Context, timeout time.Duration
 		return err
 	}
 	traceIDsToChange := make([]string, 0)
+	reasons := make(map[string]int)
 	for _, status := range statuses {
-		if !status.Timestamp.IsZero() && w.Clock.Since(status.Timestamp) > timeout {
+		if ok, metric := ready(status); ok {
 			if status.TraceID == "" {
 				w.Logger.Warn().Logf("Attempted to change state from %s to %s of empty trace id", fromState, toState)
 			} else {
 				traceIDsToChange = append(traceIDsToChange, status.TraceID)
+				if metric != "" {
+					reasons[metric]++
+				}
 			}
 		}
 	}
@@ -189,6 +268,9 @@ func (w *SmartWrapper) manageTimeouts(ctx context.Context, timeout time.Duration
 			span.RecordError(err)
 			return err
 		}
+		for metric, n := range reasons {
+			w.Metrics.Count(metric, n)
+		}
 	}
 	return nil
 }
@@ -208,20 +290,21 @@ func (w *SmartWrapper) manageStates(ctx context.Context, options config.SmartWra
 			ctx, span := otelutil.StartSpan(ctx, w.Tracer, "SmartWrapper.manageStates")
 
 			// see if AwaitDecision traces have been waiting too long
-			if err := w.manageTimeouts(ctx, time.Duration(options.DecisionTimeout), AwaitingDecision, ReadyToDecide); err != nil {
+			if err := w.manageTimeouts(ctx, time.Duration(options.DecisionTimeout), AwaitingDecision, ReadyToDecide, ""); err != nil {
 				span.RecordError(err)
 				w.Logger.Error().Logf("error managing timeouts for moving traces from awaiting decision to ready to decide: %s", err)
 			}
 
-			// traces that are past SendDelay should be moved to ready for decision
+			// traces that are complete, past SendDelay, or have gone quiet
+			// (depending on the trigger) should be moved to ready for decision
 			// the only errors can be syntax errors, so won't happen at runtime
-			if err := w.manageTimeouts(ctx, time.Duration(options.SendDelay), DecisionDelay, ReadyToDecide); err != nil {
+			if err := w.manageDelayedTraces(ctx, options); err != nil {
 				span.RecordError(err)
 				w.Logger.Error().Logf("error managing timeouts for moving traces from decision delay to ready to decide: %s", err)
 			}
 
-			// trace that are past TraceTimeout should be moved to waiting to decide
-			if err := w.manageTimeouts(ctx, time.Duration(options.TraceTimeout), Collecting, DecisionDelay); err != nil {
+			// trace that are past their timeout should be moved to waiting to decide
+			if err := w.manageTraceTimeouts(ctx, options); err != nil {
 				span.RecordError(err)
 				w.Logger.Error().Logf("error managing timeouts for moving traces from collecting to decision delay: %s", err)
 			}
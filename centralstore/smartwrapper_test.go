@@ -16,6 +16,7 @@ import (
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/redis"
+	"github.com/honeycombio/refinery/types"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,7 +41,7 @@ func (d dummyLogger) Errorf(format string, v ...interface{}) {
 	fmt.Println()
 }
 
-func getAndStartSmartWrapper(storetype string, redisClient redis.Client) (*SmartWrapper, func(), error) {
+func getAndStartSmartWrapper(storetype string, redisClient redis.Client, opts ...func(*config.SmartWrapperOptions)) (*SmartWrapper, func(), error) {
 
 	cfg := config.MockConfig{
 		StoreOptions: config.SmartWrapperOptions{
@@ -57,6 +58,9 @@ func getAndStartSmartWrapper(storetype string, redisClient redis.Client) (*Smart
 		},
 		GetParallelismVal: 10,
 	}
+	for _, opt := range opts {
+		opt(&cfg.StoreOptions)
+	}
 
 	decisionCache := &cache.CuckooSentCache{}
 	sw := &SmartWrapper{}
@@ -322,6 +326,214 @@ func TestReadyForDecisionLoop(t *testing.T) {
 	}
 }
 
+func TestQuietPeriodDecisionTrigger(t *testing.T) {
+	for _, storeType := range []string{"local", "redis"} {
+		t.Run(storeType, func(t *testing.T) {
+			store, stopper, err := getAndStartSmartWrapper(storeType, nil, func(opts *config.SmartWrapperOptions) {
+				opts.DecisionTrigger = "quiet_period"
+				opts.QuietPeriod = duration("400ms")
+				opts.TraceTimeout = duration("5s")
+			})
+			require.NoError(t, err)
+			defer stopper()
+
+			ctx := context.Background()
+			err = store.WriteSpan(ctx, &CentralSpan{TraceID: "quiet", SpanID: "root", IsRoot: true})
+			require.NoError(t, err)
+
+			// keep the trace busy for well past SendDelay
+			for i := 0; i < 10; i++ {
+				time.Sleep(100 * time.Millisecond)
+				err = store.WriteSpan(ctx, &CentralSpan{TraceID: "quiet", SpanID: fmt.Sprintf("span%d", i)})
+				require.NoError(t, err)
+			}
+			states, err := store.GetStatusForTraces(ctx, []string{"quiet"}, DecisionDelay)
+			require.NoError(t, err)
+			require.Len(t, states, 1)
+			assert.Equal(t, DecisionDelay, states[0].State)
+			assert.False(t, states[0].LastSpanAt.IsZero())
+
+			// once it goes quiet it becomes ready for a decision
+			assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+				states, err := store.GetStatusForTraces(ctx, []string{"quiet"}, ReadyToDecide)
+				assert.NoError(collect, err)
+				assert.Equal(collect, 1, len(states))
+			}, 2*time.Second, 50*time.Millisecond)
+		})
+	}
+}
+
+func TestAdaptiveTraceTimeout(t *testing.T) {
+	store, stopper, err := getAndStartSmartWrapper("local", nil, func(opts *config.SmartWrapperOptions) {
+		opts.TraceTimeout = duration("10s")
+	})
+	require.NoError(t, err)
+	defer stopper()
+
+	cfg := store.Config.(*config.MockConfig)
+	cfg.Mux.Lock()
+	cfg.AdaptiveTraceTimeout = config.AdaptiveTimeoutConfig{
+		Enabled:    true,
+		Percentile: 99,
+		MinSamples: 5,
+	}
+	cfg.Mux.Unlock()
+	require.NotNil(t, store.Timeouts)
+
+	// traces whose root spans arrive are measured by the store, but not
+	// those that are only signaled to be decided early
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		traceID := fmt.Sprintf("done%d", i)
+		child := &CentralSpan{TraceID: traceID, SpanID: "child"}
+		child.SetSamplerSelector("fast")
+		require.NoError(t, store.WriteSpan(ctx, child))
+		root := &CentralSpan{TraceID: traceID, SpanID: "root", IsRoot: true}
+		root.SetSamplerSelector("fast")
+		require.NoError(t, store.WriteSpan(ctx, root))
+	}
+	ejected := &CentralSpan{TraceID: "ejected", SpanID: "span1"}
+	ejected.SetSamplerSelector("fast")
+	require.NoError(t, store.WriteSpan(ctx, ejected))
+	require.NoError(t, store.WriteSpan(ctx, &CentralSpan{TraceID: "ejected", IsRoot: true}))
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		states, err := store.GetStatusForTraces(ctx, []string{"ejected"}, Collecting)
+		assert.NoError(collect, err)
+		assert.Empty(collect, states)
+	}, 2*time.Second, 50*time.Millisecond)
+	store.Timeouts.mut.Lock()
+	assert.Equal(t, 5, store.Timeouts.durations["fast"].seen)
+	store.Timeouts.mut.Unlock()
+
+	fast := &CentralSpan{TraceID: "fast", SpanID: "span1"}
+	fast.SetSamplerSelector("fast")
+	require.NoError(t, store.WriteSpan(ctx, fast))
+	slow := &CentralSpan{TraceID: "slow", SpanID: "span1"}
+	slow.SetSamplerSelector("slow")
+	require.NoError(t, store.WriteSpan(ctx, slow))
+
+	// the trace whose selector has short traces times out long before
+	// TraceTimeout, but the other one doesn't
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		states, err := store.GetStatusForTraces(ctx, []string{"fast"}, DecisionDelay, ReadyToDecide)
+		assert.NoError(collect, err)
+		assert.Equal(collect, 1, len(states))
+	}, 2*time.Second, 50*time.Millisecond)
+	states, err := store.GetStatusForTraces(ctx, []string{"slow"}, Collecting)
+	require.NoError(t, err)
+	assert.Len(t, states, 1)
+}
+
+func TestCollectionOverrides(t *testing.T) {
+	store, stopper, err := getAndStartSmartWrapper("local", nil, func(opts *config.SmartWrapperOptions) {
+		opts.TraceTimeout = duration("10s")
+		opts.SendDelay = duration("5s")
+	})
+	require.NoError(t, err)
+	defer stopper()
+
+	cfg := store.Config.(*config.MockConfig)
+	cfg.Mux.Lock()
+	cfg.CollectionOverrides = map[string]config.CollectionOverride{
+		"web": {TraceTimeout: duration("10ms"), SendDelay: duration("10ms")},
+	}
+	cfg.Mux.Unlock()
+
+	ctx := context.Background()
+	for _, selector := range []string{"web", "batch"} {
+		sp := &CentralSpan{TraceID: selector, SpanID: "span1"}
+		sp.SetSamplerSelector(selector)
+		require.NoError(t, store.WriteSpan(ctx, sp))
+	}
+
+	// the overridden target times out and is sent after its own short
+	// timeout and delay, but the other one waits for the global ones
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		states, err := store.GetStatusForTraces(ctx, []string{"web"}, ReadyToDecide)
+		assert.NoError(collect, err)
+		assert.Equal(collect, 1, len(states))
+	}, 3*time.Second, 50*time.Millisecond)
+	states, err := store.GetStatusForTraces(ctx, []string{"batch"}, Collecting)
+	require.NoError(t, err)
+	assert.Len(t, states, 1)
+}
+
+func TestRootArrivalDecisionTrigger(t *testing.T) {
+	for _, storeType := range []string{"local", "redis"} {
+		t.Run(storeType, func(t *testing.T) {
+			store, stopper, err := getAndStartSmartWrapper(storeType, nil, func(opts *config.SmartWrapperOptions) {
+				opts.DecisionTrigger = "root_arrival"
+				opts.RootLinger = duration("10ms")
+				opts.SendDelay = duration("5s")
+			})
+			require.NoError(t, err)
+			defer stopper()
+
+			ctx := context.Background()
+			err = store.WriteSpan(ctx, &CentralSpan{TraceID: "rooted", SpanID: "span1"})
+			require.NoError(t, err)
+			err = store.WriteSpan(ctx, &CentralSpan{TraceID: "rooted", SpanID: "root", IsRoot: true})
+			require.NoError(t, err)
+
+			// the trace is ready long before SendDelay
+			assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+				states, err := store.GetStatusForTraces(ctx, []string{"rooted"}, ReadyToDecide)
+				assert.NoError(collect, err)
+				assert.Equal(collect, 1, len(states))
+			}, time.Second, 50*time.Millisecond)
+		})
+	}
+}
+
+func TestChildCountsCompleteTrace(t *testing.T) {
+	for _, storeType := range []string{"local", "redis"} {
+		t.Run(storeType, func(t *testing.T) {
+			store, stopper, err := getAndStartSmartWrapper(storeType, nil, func(opts *config.SmartWrapperOptions) {
+				opts.SendDelay = duration("5s")
+				opts.TraceTimeout = duration("10s")
+			})
+			require.NoError(t, err)
+			defer stopper()
+
+			ctx := context.Background()
+			spans := []*CentralSpan{
+				{TraceID: "counted", SpanID: "child1", ChildCount: 0, HasChildCount: true},
+				{TraceID: "counted", SpanID: "root", IsRoot: true, ChildCount: 2, HasChildCount: true},
+				{TraceID: "uncounted", SpanID: "child1", ChildCount: 0, HasChildCount: true},
+				{TraceID: "uncounted", SpanID: "root", IsRoot: true},
+				// the child reports its count through a span link
+				{TraceID: "linked", SpanID: "root", IsRoot: true, ChildCount: 1, HasChildCount: true},
+				{TraceID: "linked", SpanID: "child1"},
+				{TraceID: "linked", SpanID: "child1-link", Type: types.SpanTypeLink, ChildCount: 0, HasChildCount: true},
+				// signaling spans have no span ID and never count
+				{TraceID: "linked", IsRoot: false},
+			}
+			for _, span := range spans {
+				require.NoError(t, store.WriteSpan(ctx, span))
+			}
+
+			// one child is still missing, so the trace waits
+			time.Sleep(300 * time.Millisecond)
+			states, err := store.GetStatusForTraces(ctx, []string{"counted"}, DecisionDelay)
+			require.NoError(t, err)
+			require.Len(t, states, 1)
+			assert.False(t, states[0].CompleteByChildCounts())
+
+			require.NoError(t, store.WriteSpan(ctx, &CentralSpan{TraceID: "counted", SpanID: "child2", ChildCount: 0, HasChildCount: true}))
+			assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+				states, err := store.GetStatusForTraces(ctx, []string{"counted", "linked"}, ReadyToDecide)
+				assert.NoError(collect, err)
+				assert.Equal(collect, 2, len(states))
+			}, 2*time.Second, 50*time.Millisecond)
+
+			// a span without a hint means we can't know, so it falls back to SendDelay
+			states, err = store.GetStatusForTraces(ctx, []string{"uncounted"}, DecisionDelay)
+			require.NoError(t, err)
+			require.Len(t, states, 1)
+		})
+	}
+}
+
 func TestSetTraceStatuses(t *testing.T) {
 	for _, storeType := range []string{"local", "redis"} {
 		t.Run(storeType, func(t *testing.T) {
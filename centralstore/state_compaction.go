@@ -0,0 +1,170 @@
+package centralstore
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/honeycombio/refinery/redis"
+)
+
+const (
+	// compactionLockKey makes sure that only one refinery at a time
+	// compacts trace statuses.
+	compactionLockKey = "refinery:compaction_lock"
+	// compactionCursorKey holds the decision time that compaction has
+	// reached in recentDecisionsKey.
+	compactionCursorKey = "refinery:compaction_cursor"
+)
+
+// compactStatusesScript rewrites the status hashes of decided traces so that
+// all of their fields except State are serialized into a single Compact
+// field, leaving out the fields that are empty or zero. It goes through the
+// traces in recentDecisionsKey in the order they were decided, starting from
+// the cursor and ending with the traces decided at ARGV[1], and returns the
+// number of statuses it compacted.
+// It takes the following arguments:
+// KEYS[1] - the compaction cursor
+// KEYS[2] - the sorted set of recent decisions
+// ARGV[1] - the latest decision time to compact
+// ARGV[2] - the most traces to look at
+// ARGV[3] - the fewest fields a status must have to be compacted
+//
+// The cursor includes the decision time it names, so traces decided at that
+// time are looked at again; they were already compacted and have too few
+// fields to be compacted again. If a whole batch was decided at the time of
+// the cursor, the cursor moves past it so that compaction can't get stuck.
+const compactStatusesKey = 2
+const compactStatusesScript = `
+	local cursorKey = KEYS[1]
+	local decisionsKey = KEYS[2]
+	local maxScore = ARGV[1]
+	local batchSize = tonumber(ARGV[2])
+	local minFields = tonumber(ARGV[3])
+
+	local cursor = redis.call('GET', cursorKey)
+	if (cursor == nil or cursor == false) then
+	  cursor = "-inf"
+	end
+
+	local entries = redis.call('ZRANGE', decisionsKey, cursor, maxScore,
+	  "byscore", "limit", 0, batchSize, "withscores")
+
+	local compacted = 0
+	local last = nil
+	for i = 1, #entries, 2 do
+	  local traceID = entries[i]
+	  last = entries[i + 1]
+	  repeat
+		-- this formatting logic should match with the traceStatusKey function
+		local statusKey = string.format("%s:status", traceID)
+		local fields = redis.call('HGETALL', statusKey)
+		if #fields < 2 * minFields then
+		  do break end
+		end
+
+		local state = nil
+		local status = {}
+		for j = 1, #fields, 2 do
+		  local name = fields[j]
+		  local value = fields[j + 1]
+		  if name == "State" then
+			state = value
+		  elseif value ~= "" and value ~= "0" then
+			status[name] = value
+		  end
+		end
+		if (state ~= "decision_keep") and (state ~= "decision_drop") then
+		  do break end
+		end
+
+		local ttl = redis.call('PTTL', statusKey)
+		redis.call('DEL', statusKey)
+		redis.call('HSET', statusKey, "State", state, "Compact", cjson.encode(status))
+		if ttl > 0 then
+		  redis.call('PEXPIRE', statusKey, ttl)
+		end
+		compacted = compacted + 1
+	  until true
+	end
+
+	if last ~= nil then
+	  if (#entries / 2 == batchSize) and (last == cursor) then
+		last = "(" .. last
+	  end
+	  redis.call('SET', cursorKey, last)
+	end
+
+	return compacted
+`
+
+// compactStatuses runs the compaction of trace statuses every interval until
+// done is closed.
+func (r *RedisBasicStore) compactStatuses(interval time.Duration, done <-chan struct{}) {
+	ticker := r.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.Chan():
+			compacted, err := r.compactDecidedStatuses(context.Background(), interval)
+			if err == nil {
+				r.Metrics.Count("redisstore_statuses_compacted", compacted)
+			}
+		}
+	}
+}
+
+// compactDecidedStatuses compacts a batch of the statuses of traces that were
+// decided at least MinAge ago, if no other refinery is doing it. The lock is
+// held for at most lockTTL. It returns the number of statuses compacted.
+func (r *RedisBasicStore) compactDecidedStatuses(ctx context.Context, lockTTL time.Duration) (int, error) {
+	cfg := r.Config.GetStateCompactionConfig()
+	ctx, span := otelutil.StartSpanWith(ctx, r.Tracer, "compactDecidedStatuses", "batch_size", cfg.BatchSize)
+	defer span.End()
+
+	conn := r.RedisClient.Get()
+	defer conn.Close()
+
+	ok, unlock := conn.AcquireLock(compactionLockKey, lockTTL)
+	if !ok {
+		otelutil.AddSpanField(span, "locked", true)
+		return 0, nil
+	}
+	defer unlock()
+
+	maxScore := r.Clock.Now().Add(-time.Duration(cfg.MinAge)).UnixMicro()
+	compacted, err := r.compactScript.DoInt(ctx, conn, compactionCursorKey, recentDecisionsKey,
+		maxScore, max(cfg.BatchSize, 1), max(cfg.MinFields, 3))
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+	otelutil.AddSpanField(span, "num_compacted", compacted)
+	return compacted, nil
+}
+
+// expand returns the status with the fields that compaction serialized into
+// Compact filled in. Late spans still count themselves in the status hash
+// after it's compacted, so those counts are added to the compacted ones.
+func (s *centralTraceStatusRedis) expand() (*centralTraceStatusRedis, error) {
+	if s.Compact == "" {
+		return s, nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(s.Compact), &fields); err != nil {
+		return s, err
+	}
+	expanded := &centralTraceStatusRedis{}
+	if err := redis.ScanStructFields(fields, expanded); err != nil {
+		return s, err
+	}
+	expanded.State = s.State
+	expanded.Count += s.Count
+	expanded.EventCount += s.EventCount
+	expanded.LinkCount += s.LinkCount
+	return expanded, nil
+}
@@ -0,0 +1,101 @@
+package centralstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisBasicStore_CompactDecidedStatuses(t *testing.T) {
+	ctx := context.Background()
+	store := NewTestRedisBasicStore(ctx, t)
+	defer store.Stop()
+
+	cfg := store.Config.(*config.MockConfig)
+	cfg.Mux.Lock()
+	cfg.StateCompaction = config.StateCompactionConfig{BatchSize: 10, MinAge: duration("10s"), MinFields: 5}
+	cfg.Mux.Unlock()
+
+	conn := store.RedisClient.Get()
+	defer conn.Close()
+
+	keptTraceID := "traceID0"
+	collectingTraceID := "traceID1"
+	store.ensureInitialState(t, ctx, conn, keptTraceID, AwaitingDecision)
+	store.ensureInitialState(t, ctx, conn, collectingTraceID, Collecting)
+	status, err := store.GetStatusForTraces(ctx, []string{keptTraceID}, AwaitingDecision)
+	require.NoError(t, err)
+	status[0].KeepReason = "kept"
+	status[0].Rate = 10
+	require.NoError(t, store.KeepTraces(ctx, status))
+
+	before, err := store.GetStatusForTraces(ctx, []string{keptTraceID}, DecisionKeep)
+	require.NoError(t, err)
+	require.Len(t, before, 1)
+
+	// the decision is too recent to be compacted
+	compacted, err := store.compactDecidedStatuses(ctx, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 0, compacted)
+
+	store.clock.Advance(time.Minute)
+	compacted, err = store.compactDecidedStatuses(ctx, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 1, compacted)
+
+	fields, err := conn.GetAllStringsHash(store.traces.traceStatusKey(keptTraceID))
+	require.NoError(t, err)
+	assert.Len(t, fields, 2)
+	assert.Equal(t, string(DecisionKeep), fields["State"])
+
+	// the trace that wasn't decided is left alone
+	fields, err = conn.GetAllStringsHash(store.traces.traceStatusKey(collectingTraceID))
+	require.NoError(t, err)
+	assert.Greater(t, len(fields), 2)
+
+	after, err := store.GetStatusForTraces(ctx, []string{keptTraceID}, DecisionKeep)
+	require.NoError(t, err)
+	require.Len(t, after, 1)
+	assert.Equal(t, before[0], after[0])
+
+	// late spans are still counted
+	require.NoError(t, store.WriteSpans(ctx, []*CentralSpan{{TraceID: keptTraceID, SpanID: "late"}}))
+	after, err = store.GetStatusForTraces(ctx, []string{keptTraceID}, DecisionKeep)
+	require.NoError(t, err)
+	require.Len(t, after, 1)
+	assert.Equal(t, before[0].Count+1, after[0].Count)
+	assert.Equal(t, "kept", after[0].KeepReason)
+	assert.Equal(t, uint(10), after[0].Rate)
+
+	// it isn't compacted again
+	compacted, err = store.compactDecidedStatuses(ctx, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 0, compacted)
+}
+
+func TestCentralTraceStatusRedis_expand(t *testing.T) {
+	status := &centralTraceStatusRedis{TraceID: "trace1", State: "decision_keep", Rate: 5}
+	expanded, err := status.expand()
+	require.NoError(t, err)
+	assert.Same(t, status, expanded)
+
+	status = &centralTraceStatusRedis{
+		State:   "decision_drop",
+		Count:   2,
+		Compact: `{"TraceID":"trace1","Count":"10","LinkCount":"1","SamplerKey":"ds","Timestamp":"1700000000000000"}`,
+	}
+	expanded, err = status.expand()
+	require.NoError(t, err)
+	assert.Equal(t, &centralTraceStatusRedis{
+		TraceID:    "trace1",
+		State:      "decision_drop",
+		Count:      12,
+		LinkCount:  1,
+		SamplerKey: "ds",
+		Timestamp:  1700000000000000,
+	}, expanded)
+}
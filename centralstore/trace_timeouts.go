@@ -0,0 +1,132 @@
+package centralstore
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+// traceDurationWindow is the number of recent trace durations that are kept
+// for each sampler selector.
+const traceDurationWindow = 1000
+
+// TraceTimeouts tracks how long traces take to complete for each sampler
+// selector, and chooses the timeout for traces without a root span from
+// them. The store records durations, from the time it first stored a trace
+// to the arrival of its root span, and the SmartWrapper uses the timeouts;
+// it's shared between them by injection.
+type TraceTimeouts struct {
+	Config config.Config `inject:""`
+
+	mut       sync.Mutex
+	durations map[string]*durationWindow
+}
+
+// durationWindow holds the most recent trace durations for a selector, and
+// the timeout last chosen from them. The timeout is chosen again once a
+// tenth of the window has been replaced since it was last chosen, so that
+// sorting the window is spread over many traces.
+type durationWindow struct {
+	samples []time.Duration
+	next    int
+	seen    int
+	timeout time.Duration
+	// chosen is the value of seen when the timeout was last chosen, or 0 if
+	// it hasn't been yet; ready is set once the first one has been stored
+	chosen int
+	ready  bool
+}
+
+// due reports whether the window's timeout should be chosen again.
+func (w *durationWindow) due() bool {
+	return w.chosen == 0 || w.seen-w.chosen >= max(len(w.samples)/10, 1)
+}
+
+// Enabled reports whether adaptive timeouts are enabled, so that stores can
+// skip finding durations that wouldn't be used.
+func (t *TraceTimeouts) Enabled() bool {
+	return t != nil && t.Config.GetAdaptiveTraceTimeoutConfig().Enabled
+}
+
+// Observe records the duration of a trace whose root span arrived, from when
+// the trace was first stored to when its root span arrived.
+func (t *TraceTimeouts) Observe(selector string, d time.Duration) {
+	if !t.Enabled() {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.durations == nil {
+		t.durations = make(map[string]*durationWindow)
+	}
+	w, ok := t.durations[selector]
+	if !ok {
+		w = &durationWindow{samples: make([]time.Duration, 0, traceDurationWindow)}
+		t.durations[selector] = w
+	}
+	if len(w.samples) < traceDurationWindow {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+		w.next = (w.next + 1) % traceDurationWindow
+	}
+	w.seen++
+}
+
+// Timeout returns the timeout for traces of a selector: the configured
+// percentile of its recent durations plus the margin, within the floor and
+// ceiling. It returns fallback if adaptive timeouts aren't enabled or not
+// enough of the selector's traces have been seen.
+func (t *TraceTimeouts) Timeout(selector string, fallback time.Duration) time.Duration {
+	if t == nil {
+		return fallback
+	}
+	cfg := t.Config.GetAdaptiveTraceTimeoutConfig()
+	if !cfg.Enabled {
+		return fallback
+	}
+	t.mut.Lock()
+	w, ok := t.durations[selector]
+	if !ok || w.seen < cfg.MinSamples || len(w.samples) == 0 {
+		t.mut.Unlock()
+		return fallback
+	}
+	if !w.due() {
+		defer t.mut.Unlock()
+		if !w.ready {
+			return fallback
+		}
+		return w.timeout
+	}
+	// the window is sorted without holding the lock
+	samples := slices.Clone(w.samples)
+	w.chosen = w.seen
+	t.mut.Unlock()
+
+	timeout := adaptiveTimeout(samples, cfg)
+	t.mut.Lock()
+	w.timeout = timeout
+	w.ready = true
+	t.mut.Unlock()
+	return timeout
+}
+
+// adaptiveTimeout chooses a timeout from a set of trace durations, which it
+// sorts in place.
+func adaptiveTimeout(sorted []time.Duration, cfg config.AdaptiveTimeoutConfig) time.Duration {
+	slices.Sort(sorted)
+	pct := math.Min(math.Max(cfg.Percentile, 0), 100)
+	idx := int(math.Ceil(pct/100*float64(len(sorted)))) - 1
+	idx = max(0, min(idx, len(sorted)-1))
+	timeout := sorted[idx] + time.Duration(cfg.Margin)
+	if cfg.MinTimeout > 0 {
+		timeout = max(timeout, time.Duration(cfg.MinTimeout))
+	}
+	if cfg.MaxTimeout > 0 {
+		timeout = min(timeout, time.Duration(cfg.MaxTimeout))
+	}
+	return timeout
+}
@@ -0,0 +1,68 @@
+package centralstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceTimeouts(t *testing.T) {
+	cfg := &config.MockConfig{
+		AdaptiveTraceTimeout: config.AdaptiveTimeoutConfig{
+			Enabled:    true,
+			Percentile: 90,
+			Margin:     config.Duration(time.Second),
+			MinTimeout: config.Duration(2 * time.Second),
+			MaxTimeout: config.Duration(30 * time.Second),
+			MinSamples: 10,
+		},
+	}
+	timeouts := &TraceTimeouts{Config: cfg}
+	fallback := time.Minute
+
+	for i := 1; i <= 9; i++ {
+		timeouts.Observe("fast", time.Duration(i)*time.Second)
+	}
+	assert.Equal(t, fallback, timeouts.Timeout("fast", fallback), "too few samples")
+	timeouts.Observe("fast", 10*time.Second)
+	assert.Equal(t, 10*time.Second, timeouts.Timeout("fast", fallback), "p90 of 1s..10s is 9s, plus the margin")
+	assert.Equal(t, fallback, timeouts.Timeout("other", fallback))
+
+	for i := 0; i < 10; i++ {
+		timeouts.Observe("tiny", time.Millisecond)
+		timeouts.Observe("slow", time.Hour)
+	}
+	assert.Equal(t, 2*time.Second, timeouts.Timeout("tiny", fallback), "held to the floor")
+	assert.Equal(t, 30*time.Second, timeouts.Timeout("slow", fallback), "held to the ceiling")
+
+	// only the most recent durations count
+	for i := 0; i < traceDurationWindow; i++ {
+		timeouts.Observe("fast", 3*time.Second)
+	}
+	assert.Equal(t, 4*time.Second, timeouts.Timeout("fast", fallback))
+
+	// the timeout is only chosen again once a tenth of the window is new
+	for i := 0; i < 100; i++ {
+		d := time.Second
+		if i >= 90 {
+			d = 5 * time.Second
+		}
+		timeouts.Observe("steady", d)
+	}
+	assert.Equal(t, 2*time.Second, timeouts.Timeout("steady", fallback))
+	timeouts.Observe("steady", 5*time.Second)
+	assert.Equal(t, 2*time.Second, timeouts.Timeout("steady", fallback))
+	for i := 0; i < 10; i++ {
+		timeouts.Observe("steady", 5*time.Second)
+	}
+	assert.Equal(t, 6*time.Second, timeouts.Timeout("steady", fallback))
+
+	cfg.AdaptiveTraceTimeout.Enabled = false
+	assert.Equal(t, fallback, timeouts.Timeout("fast", fallback))
+
+	var none *TraceTimeouts
+	none.Observe("fast", time.Second)
+	assert.Equal(t, fallback, none.Timeout("fast", fallback))
+}
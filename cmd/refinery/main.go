@@ -27,15 +27,27 @@ import (
 	"github.com/honeycombio/refinery/collect/cache"
 	"github.com/honeycombio/refinery/collect/stressRelief"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/configsync"
+	"github.com/honeycombio/refinery/internal/decisionexport"
+	"github.com/honeycombio/refinery/internal/drain"
+	"github.com/honeycombio/refinery/internal/dropaudit"
+	"github.com/honeycombio/refinery/internal/featureflags"
 	"github.com/honeycombio/refinery/internal/gossip"
 	"github.com/honeycombio/refinery/internal/health"
 	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/honeycombio/refinery/internal/profiler"
+	"github.com/honeycombio/refinery/internal/supervisor"
+	"github.com/honeycombio/refinery/internal/upstreamprobe"
+	"github.com/honeycombio/refinery/internal/valuelists"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/redis"
 	"github.com/honeycombio/refinery/sample"
 	"github.com/honeycombio/refinery/service/debug"
 	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
 )
 
 // set by CI.
@@ -52,6 +64,16 @@ func (g graphLogger) Debugf(format string, v ...interface{}) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "publish-config" {
+		os.Exit(publishMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateMain(os.Args[2:]))
+	}
+
 	opts, err := config.NewCmdEnvOptions(os.Args)
 	if err != nil {
 		fmt.Printf("Command line parsing error '%s' -- call with --help for usage.\n", err)
@@ -93,6 +115,9 @@ func main() {
 		if a.Logger != nil {
 			a.Logger.Error().WithField("error", err).Logf("error loading config")
 		}
+		if a.Metrics != nil {
+			a.Metrics.Increment("config_reload_failures")
+		}
 	})
 	if err != nil {
 		fmt.Printf("%+v\n", err)
@@ -135,16 +160,38 @@ func main() {
 	genericMetricsRecorder := metrics.NewMetricsPrefixer("")
 	upstreamMetricsRecorder := metrics.NewMetricsPrefixer("libhoney_upstream")
 
+	// libhoney only knows zstd, so for snappy we turn its compression off and
+	// compress in the transport instead
+	var upstreamRoundTripper http.RoundTripper = upstreamTransport
+	upstreamCompression := cfg.GetUpstreamCompression()
+	if upstreamCompression == "snappy" {
+		upstreamRoundTripper = transmit.NewSnappyTransport(upstreamTransport)
+	}
+	// adaptive batching splits batches before they're compressed, so zstd
+	// moves into the transport too
+	adaptiveBatching := cfg.GetAdaptiveBatchingConfig()
+	maxConcurrentBatches := uint(libhoney.DefaultMaxConcurrentBatches)
+	var adaptiveTransport *transmit.AdaptiveTransport
+	if adaptiveBatching.Enabled {
+		if upstreamCompression != "snappy" && upstreamCompression != "none" {
+			upstreamRoundTripper = transmit.NewZstdTransport(upstreamTransport)
+		}
+		adaptiveTransport = transmit.NewAdaptiveTransport(upstreamRoundTripper, adaptiveBatching, int(cfg.GetMaxBatchSize()))
+		upstreamRoundTripper = adaptiveTransport
+		maxConcurrentBatches = uint(adaptiveBatching.MaxConcurrency)
+	}
+
 	userAgentAddition := "refinery/" + version
 	upstreamClient, err := libhoney.NewClient(libhoney.ClientConfig{
 		Transmission: &transmission.Honeycomb{
 			MaxBatchSize:          cfg.GetMaxBatchSize(),
 			BatchTimeout:          cfg.GetBatchTimeout(),
-			MaxConcurrentBatches:  libhoney.DefaultMaxConcurrentBatches,
+			MaxConcurrentBatches:  maxConcurrentBatches,
 			PendingWorkCapacity:   uint(cfg.GetUpstreamBufferSize()),
 			UserAgentAddition:     userAgentAddition,
-			Transport:             upstreamTransport,
+			Transport:             upstreamRoundTripper,
 			BlockOnSend:           true,
+			DisableCompression:    upstreamCompression == "snappy" || upstreamCompression == "none" || adaptiveBatching.Enabled,
 			EnableMsgpackEncoding: true,
 			Metrics:               upstreamMetricsRecorder,
 		},
@@ -157,6 +204,33 @@ func main() {
 	stressRelief := &stressRelief.StressRelief{}
 	upstreamTransmission := transmit.NewDefaultTransmission(upstreamClient, upstreamMetricsRecorder, "upstream")
 
+	// kept events go to the upstream API, as Honeycomb events or OTLP,
+	// unless a Kafka output is configured, which then sends them on to the
+	// API itself if needed
+	var apiTransmission transmit.Transmission = upstreamTransmission
+	if cfg.GetOTLPUpstreamConfig().Enabled {
+		apiTransmission = &transmit.OTLPTransmission{}
+	}
+	keptTransmission := apiTransmission
+	var kafkaTransmission *transmit.KafkaTransmission
+	switch cfg.GetKafkaOutputConfig().Mode {
+	case "none", "":
+	case "alongside", "instead":
+		kafkaTransmission = &transmit.KafkaTransmission{}
+		keptTransmission = kafkaTransmission
+	default:
+		fmt.Printf("unknown Kafka output mode: %s\n", cfg.GetKafkaOutputConfig().Mode)
+		os.Exit(1)
+	}
+	// extra destinations get copies of the kept events that match them, as
+	// well as the primary getting every one
+	primaryTransmission := keptTransmission
+	var fanoutTransmission *transmit.FanoutTransmission
+	if len(cfg.GetDestinationsConfig().Targets) > 0 {
+		fanoutTransmission = &transmit.FanoutTransmission{}
+		keptTransmission = fanoutTransmission
+	}
+
 	// we need to include all the metrics types so we can inject them in case they're needed
 	// but we only want to instantiate the ones that are enabled with non-null values
 	var legacyMetrics metrics.Metrics = &metrics.NullMetrics{}
@@ -175,19 +249,72 @@ func main() {
 
 	var basicStore centralstore.BasicStorer
 	var channels gossip.Gossiper
+	var keyCache apikeys.Cache
+	var clusterCounter clustercount.Counter
 	switch cfg.GetCentralStoreOptions().BasicStoreType {
 	case "redis":
 		basicStore = &centralstore.RedisBasicStore{}
 		channels = &gossip.GossipRedis{}
+		keyCache = &apikeys.RedisCache{}
+		clusterCounter = &clustercount.RedisCounter{}
 	case "local":
 		basicStore = &centralstore.LocalStore{}
 		channels = &gossip.InMemoryGossip{}
+		keyCache = &apikeys.LocalCache{}
+		clusterCounter = &clustercount.LocalCounter{}
 	default:
 		fmt.Printf("unknown basic store type: %s\n", cfg.GetCentralStoreOptions().BasicStoreType)
 		os.Exit(1)
 	}
 	smartStore := &centralstore.SmartWrapper{}
 
+	var decisionExporter decisionexport.Exporter = &decisionexport.NullExporter{}
+	var decisionSink decisionexport.Sink
+	switch cfg.GetDecisionExportConfig().Type {
+	case "none", "":
+	case "redis":
+		decisionSink = &decisionexport.RedisStreamSink{}
+	case "webhook":
+		decisionSink = &decisionexport.WebhookSink{}
+	case "kafka":
+		decisionSink = &decisionexport.KafkaSink{}
+	default:
+		fmt.Printf("unknown decision export type: %s\n", cfg.GetDecisionExportConfig().Type)
+		os.Exit(1)
+	}
+	if decisionSink != nil {
+		decisionExporter = &decisionexport.StreamExporter{}
+	}
+
+	var dropAuditor dropaudit.Auditor = &dropaudit.NullAuditor{}
+	var dropAuditSink dropaudit.Sink
+	switch cfg.GetDropAuditConfig().Type {
+	case "none", "":
+	case "file":
+		dropAuditSink = &dropaudit.FileSink{}
+	case "kafka":
+		dropAuditSink = &dropaudit.KafkaSink{}
+	case "honeycomb":
+		dropAuditSink = &dropaudit.HoneycombSink{}
+	default:
+		fmt.Printf("unknown drop audit type: %s\n", cfg.GetDropAuditConfig().Type)
+		os.Exit(1)
+	}
+	if dropAuditSink != nil {
+		dropAuditor = &dropaudit.StreamAuditor{}
+	}
+
+	var idGenerator types.IDGenerator
+	switch cfg.GetSyntheticSpanIDs() {
+	case "random", "":
+		idGenerator = &types.RandomIDGenerator{}
+	case "derived":
+		idGenerator = &types.DerivedIDGenerator{}
+	default:
+		fmt.Printf("unknown synthetic span ID type: %s\n", cfg.GetSyntheticSpanIDs())
+		os.Exit(1)
+	}
+
 	resourceLib := "refinery"
 	resourceVer := version
 	var tracer trace.Tracer
@@ -208,6 +335,8 @@ func main() {
 	// The "recorders" are the ones that various parts of the system will use to record metrics.
 	// The "singleton" is a wrapper that contains whichever of the specific metrics implementations
 	// are enabled. It's used to provide a consistent interface to the rest of the system.
+	drainer := &drain.Drainer{}
+
 	var g inject.Graph
 	if opts.Debug {
 		g.Logger = graphLogger{}
@@ -216,7 +345,7 @@ func main() {
 		{Value: cfg},
 		{Value: lgr},
 		{Value: upstreamTransport, Name: "upstreamTransport"},
-		{Value: upstreamTransmission, Name: "upstreamTransmission"},
+		{Value: keptTransmission, Name: "upstreamTransmission"},
 		{Value: &cache.SpanCache_basic{}},
 		{Value: centralcollector, Name: "collector"},
 		{Value: decisionCache},
@@ -234,12 +363,46 @@ func main() {
 		{Value: clockwork.NewRealClock()},
 		{Value: basicStore},
 		{Value: smartStore},
+		{Value: decisionExporter},
+		{Value: dropAuditor},
+		{Value: idGenerator},
+		{Value: keyCache},
+		{Value: clusterCounter},
+		{Value: &apikeys.Validator{}},
+		{Value: &apikeys.Quarantine{}},
+		{Value: &featureflags.Flags{}},
+		{Value: &profiler.Profiler{}},
+		{Value: drainer},
+		{Value: &supervisor.Supervisor{}},
+		{Value: &upstreamprobe.Probe{}},
 		{Value: &health.Health{}},
 		{Value: &a},
 	}
 
-	if cfg.GetCentralStoreOptions().BasicStoreType == "redis" {
-		objects = append(objects, &inject.Object{Value: &redis.DefaultClient{}, Name: "redis"})
+	valueLists := &valuelists.Loader{}
+	objects = append(objects, &inject.Object{Value: valueLists})
+	if cfg.GetCentralStoreOptions().BasicStoreType == "redis" || cfg.GetDecisionExportConfig().Type == "redis" {
+		redisClient := &redis.DefaultClient{}
+		valueLists.Redis = redisClient
+		objects = append(objects, &inject.Object{Value: redisClient, Name: "redis"})
+	}
+	if cfg.GetCentralStoreOptions().BasicStoreType == "redis" && cfg.GetConfigDistributionConfig().Enabled {
+		objects = append(objects, &inject.Object{Value: &configsync.Distributor{}})
+	}
+	if decisionSink != nil {
+		objects = append(objects, &inject.Object{Value: decisionSink, Name: "decisionSink"})
+	}
+	if dropAuditSink != nil {
+		objects = append(objects, &inject.Object{Value: dropAuditSink, Name: "dropAuditSink"})
+	}
+	if kafkaTransmission != nil {
+		objects = append(objects, &inject.Object{Value: apiTransmission, Name: "apiTransmission"})
+	}
+	if adaptiveTransport != nil {
+		objects = append(objects, &inject.Object{Value: adaptiveTransport})
+	}
+	if fanoutTransmission != nil {
+		objects = append(objects, &inject.Object{Value: primaryTransmission, Name: "primaryTransmission"})
 	}
 	err = g.Provide(objects...)
 	if err != nil {
@@ -292,14 +455,46 @@ func main() {
 
 	metricsSingleton.Store("UPSTREAM_BUFFER_SIZE", float64(cfg.GetUpstreamBufferSize()))
 
+	// reload the configuration on demand; a config that fails validation is
+	// reported by the error callback and not applied
+	sigsToReload := make(chan os.Signal, 1)
+	signal.Notify(sigsToReload, syscall.SIGHUP)
+	go func() {
+		for range sigsToReload {
+			result := cfg.Reload("SIGHUP")
+			a.Logger.Info().WithFields(map[string]interface{}{
+				"applied":    result.Applied,
+				"changed":    result.Changed,
+				"generation": result.Generation,
+			}).Logf("configuration reload requested by SIGHUP")
+		}
+	}()
+
+	// drain for maintenance on demand
+	sigsToDrain := make(chan os.Signal, 1)
+	signal.Notify(sigsToDrain, syscall.SIGUSR1)
+	go func() {
+		for range sigsToDrain {
+			if _, err := drainer.Begin("SIGUSR1", cfg.GetDrainConfig().ExitWhenDrained); err != nil {
+				a.Logger.Warn().Logf("ignoring SIGUSR1: %s", err)
+			}
+		}
+	}()
+
 	// set up signal channel to exit
 	sigsToExit := make(chan os.Signal, 1)
 	signal.Notify(sigsToExit, syscall.SIGINT, syscall.SIGTERM)
 
-	// block on our signal handler to exit
-	sig := <-sigsToExit
+	// block on our signal handler, or a drain that's done, to exit
+	var reason string
+	select {
+	case sig := <-sigsToExit:
+		reason = fmt.Sprintf("Caught signal \"%s\"", sig)
+	case <-drainer.Exit():
+		reason = "Drain complete"
+	}
 	// unregister ourselves before we go
 	close(done)
 	time.Sleep(100 * time.Millisecond)
-	a.Logger.Error().Logf("Caught signal \"%s\"", sig)
+	a.Logger.Error().Logf("%s", reason)
 }
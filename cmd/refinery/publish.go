@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/configsync"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+)
+
+type publishOptions struct {
+	ConfigLocation string `short:"c" long:"config" default:"/etc/refinery/refinery.yaml" description:"config file to publish"`
+	RulesLocation  string `short:"r" long:"rules_config" default:"/etc/refinery/rules.yaml" description:"rules file to publish"`
+}
+
+// publishMain implements "refinery publish-config", which validates a config
+// and rules file and publishes them to Redis, where every node with
+// ConfigDistribution enabled picks them up at the same epoch.
+func publishMain(args []string) int {
+	var opts publishOptions
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "publish-config [OPTIONS]"
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	// loading the config validates both files, and provides the Redis
+	// settings to publish with
+	cfg, err := config.NewConfig(&config.CmdEnv{
+		ConfigLocation: opts.ConfigLocation,
+		RulesLocation:  opts.RulesLocation,
+	}, func(error) {})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	published, err := config.LoadDocuments(opts.ConfigLocation, opts.RulesLocation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	redisConfig, ok := cfg.(config.RedisConfig)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "config doesn't provide the Redis settings")
+		return 1
+	}
+	client := &redis.DefaultClient{Config: redisConfig, Metrics: &metrics.NullMetrics{}}
+	if err := client.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Stop()
+
+	epoch, err := configsync.Publish(context.Background(), client, published)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if epoch == 0 {
+		fmt.Println("config and rules are unchanged; nothing was published")
+		return 0
+	}
+	fmt.Printf("published config and rules at epoch %d\n", epoch)
+	return 0
+}
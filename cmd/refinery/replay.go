@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/jonboulle/clockwork"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/replay"
+	"github.com/honeycombio/refinery/internal/valuelists"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
+)
+
+type replayOptions struct {
+	ConfigLocation string `short:"c" long:"config" default:"/etc/refinery/refinery.yaml" description:"config file to load"`
+	RulesLocation  string `short:"r" long:"rules_config" default:"/etc/refinery/rules.yaml" description:"candidate rules file to replay the traffic through"`
+	JSON           bool   `long:"json" description:"write the report as JSON"`
+	Args           struct {
+		Input string `positional-arg-name:"input" description:"file of recorded traffic, or - for stdin"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// replayMain implements "refinery replay", which runs a file of recorded
+// traces through a candidate rules config offline, and reports how much of
+// it would be kept.
+func replayMain(args []string) int {
+	var opts replayOptions
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "replay [OPTIONS] input"
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	cfg, err := config.NewConfig(&config.CmdEnv{
+		ConfigLocation: opts.ConfigLocation,
+		RulesLocation:  opts.RulesLocation,
+	}, func(error) {})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+
+	in := os.Stdin
+	if opts.Args.Input != "-" {
+		in, err = os.Open(opts.Args.Input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer in.Close()
+	}
+	summaries, err := replay.ReadSummaries(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	lgr := &logger.NullLogger{}
+	m := &metrics.NullMetrics{}
+	lists := &valuelists.Loader{Config: cfg, Logger: lgr, Metrics: m, Clock: clockwork.NewRealClock()}
+	lists.Start()
+	defer lists.Stop()
+	factory := &sample.SamplerFactory{Config: cfg, Logger: lgr, Metrics: m, ClusterCounter: &clustercount.LocalCounter{}}
+	factory.Start()
+	defer factory.Stop()
+
+	replayer := &replay.Replayer{Config: cfg, Factory: factory}
+	if err := replayer.Prepare(summaries); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	lists.Refresh()
+	if err := replayer.Replay(summaries); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	report := replayer.Report()
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	writeReplayReport(os.Stdout, report)
+	return 0
+}
+
+func writeReplayReport(w io.Writer, report replay.Report) {
+	fmt.Fprintf(w, "traces: %d, kept %d (%.2f%%)\n", report.Traces, report.KeptTraces, 100*report.KeepRate)
+	fmt.Fprintf(w, "events: %d, kept %d\n\n", report.Events, report.KeptEvents)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tREASON\tTRACES\tKEPT\tEVENTS\tKEPT EVENTS")
+	for _, c := range report.Reasons {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", c.Target, c.Reason, c.Traces, c.KeptTraces, c.Events, c.KeptEvents)
+	}
+	tw.Flush()
+
+	if len(report.DryRun) > 0 {
+		fmt.Fprintln(w, "\ndry run rules:")
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TARGET\tREASON\tTRACES\tKEPT\tEVENTS\tKEPT EVENTS")
+		for _, c := range report.DryRun {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", c.Target, c.Reason, c.Traces, c.KeptTraces, c.Events, c.KeptEvents)
+		}
+		tw.Flush()
+	}
+}
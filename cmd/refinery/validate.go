@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+type validateOptions struct {
+	ConfigLocation string `short:"c" long:"config" default:"/etc/refinery/refinery.yaml" description:"config file to validate"`
+	RulesLocation  string `short:"r" long:"rules_config" default:"/etc/refinery/rules.yaml" description:"rules file to validate"`
+	Schema         string `long:"schema" choice:"config" choice:"rules" description:"print the JSON schema for config or rules files instead of validating"`
+	JSON           bool   `long:"json" description:"write the report as JSON"`
+	Quiet          bool   `short:"q" long:"quiet" description:"don't print the effective config and rules"`
+}
+
+// validateMain implements "refinery validate", which checks a candidate
+// config and rules file without running Refinery, and prints them as they
+// would be used, with every default filled in. It exits nonzero if either
+// has unknown keys or values of the wrong type, so that it can gate changes
+// in CI.
+func validateMain(args []string) int {
+	var opts validateOptions
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = "validate [OPTIONS]"
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	if opts.Schema != "" {
+		return printSchema(os.Stdout, opts.Schema)
+	}
+
+	docs, err := config.LoadDocuments(opts.ConfigLocation, opts.RulesLocation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := config.ValidateDocuments(docs)
+	if opts.Quiet {
+		report.EffectiveConfig = ""
+		report.EffectiveRules = ""
+	}
+	writeValidationReport(os.Stdout, os.Stderr, report, opts)
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+func printSchema(w io.Writer, kind string) int {
+	var schema map[string]any
+	var err error
+	if kind == "rules" {
+		schema, err = config.RulesSchema()
+	} else {
+		schema, err = config.ConfigSchema()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(schema); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// writeValidationReport writes the effective config and rules to out, and
+// any failures to errOut.
+func writeValidationReport(out, errOut io.Writer, report config.ValidationReport, opts validateOptions) {
+	if opts.JSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+	if !report.Valid {
+		if len(report.ConfigFailures) == 0 && len(report.RulesFailures) == 0 {
+			fmt.Fprintln(errOut, report.Error)
+		}
+		if len(report.ConfigFailures) > 0 {
+			fmt.Fprintf(errOut, "Validation failed for config file %s:\n", opts.ConfigLocation)
+			for _, failure := range report.ConfigFailures {
+				fmt.Fprintf(errOut, "  %s\n", failure)
+			}
+		}
+		if len(report.RulesFailures) > 0 {
+			fmt.Fprintf(errOut, "Validation failed for rules file %s:\n", opts.RulesLocation)
+			for _, failure := range report.RulesFailures {
+				fmt.Fprintf(errOut, "  %s\n", failure)
+			}
+		}
+		return
+	}
+	if report.EffectiveConfig != "" {
+		fmt.Fprintf(out, "# effective config from %s\n%s", opts.ConfigLocation, report.EffectiveConfig)
+	}
+	if report.EffectiveRules != "" {
+		fmt.Fprintf(out, "---\n# effective rules from %s\n%s", opts.RulesLocation, report.EffectiveRules)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/honeycombio/refinery/redis"
 	"github.com/jessevdk/go-flags"
 	"github.com/jonboulle/clockwork"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // This is a test program for the CentralStore. It is designed to generate load
@@ -181,13 +183,17 @@ func main() {
 		close(stopch)
 	}()
 
-	// let's set up some OTel tracing
-	tracer, shutdown := otelutil.SetupTracing(config.OTelTracingConfig{
-		APIHost: opts.APIHost,
-		APIKey:  opts.APIKey,
-		Dataset: opts.Dataset,
-	}, ResourceLibrary, ResourceVersion)
-	defer shutdown()
+	// let's set up some OTel tracing, if there's somewhere to send it
+	var tracer trace.Tracer = noop.NewTracerProvider().Tracer(ResourceLibrary)
+	if opts.APIKey != "" {
+		var shutdown func()
+		tracer, shutdown = otelutil.SetupTracing(config.OTelTracingConfig{
+			APIHost: opts.APIHost,
+			APIKey:  opts.APIKey,
+			Dataset: opts.Dataset,
+		}, ResourceLibrary, ResourceVersion)
+		defer shutdown()
+	}
 
 	sw := &centralstore.SmartWrapper{}
 	store := makeRemoteStore(opts.StoreType)
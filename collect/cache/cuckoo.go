@@ -28,12 +28,16 @@ const (
 // You must call Maintain() periodically, most likely from a goroutine. The call is cheap,
 // and the timing isn't very critical. The effect of going above "capacity" is an increased
 // false positive rate and slightly reduced performance, but the filter continues to function.
+// If a TTL is set, the filters are also cycled each time it passes, and the future filter
+// is started along with the current one, so that items are kept for between one and two TTLs.
 type CuckooTraceChecker struct {
 	Met      metrics.Metrics `inject:"genericMetrics"`
 	current  *cuckoo.Filter
 	future   *cuckoo.Filter
 	mut      sync.RWMutex
 	capacity uint
+	ttl      time.Duration
+	cycled   time.Time
 	addch    chan string
 }
 
@@ -49,6 +53,7 @@ func NewCuckooTraceChecker(capacity uint, m metrics.Metrics) *CuckooTraceChecker
 		capacity: capacity,
 		current:  cuckoo.NewFilter(capacity),
 		future:   nil,
+		cycled:   time.Now(),
 		Met:      m,
 		addch:    make(chan string, AddQueueDepth),
 	}
@@ -139,20 +144,37 @@ func (c *CuckooTraceChecker) Maintain() {
 	c.Met.Gauge(CurrentCapacity, c.capacity)
 	c.mut.RUnlock()
 
-	// once the current one is half loaded, we can start using the future one too
-	if c.future == nil && currentLoadFactor > 0.5 {
-		c.mut.Lock()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	// if the current one is full or has outlived the TTL, cycle the filters
+	if currentLoadFactor > 0.99 || (c.ttl > 0 && time.Since(c.cycled) >= c.ttl) {
+		if c.future == nil {
+			c.future = cuckoo.NewFilter(c.capacity)
+		}
+		c.current = c.future
 		c.future = cuckoo.NewFilter(c.capacity)
-		c.mut.Unlock()
+		c.cycled = time.Now()
+		return
 	}
 
-	// if the current one is full, cycle the filters
-	if currentLoadFactor > 0.99 {
-		c.mut.Lock()
-		defer c.mut.Unlock()
-		c.current = c.future
+	// once the current one is half loaded, we can start using the future one too;
+	// with a TTL, the future one is needed from the start
+	if c.future == nil && (currentLoadFactor > 0.5 || c.ttl > 0) {
+		c.future = cuckoo.NewFilter(c.capacity)
+	}
+}
+
+// SetTTL sets how long items are kept before the filters are cycled, or 0 to
+// cycle them only when the current one is full.
+func (c *CuckooTraceChecker) SetTTL(ttl time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if ttl > 0 && c.future == nil {
 		c.future = cuckoo.NewFilter(c.capacity)
+		c.cycled = time.Now()
 	}
+	c.ttl = ttl
 }
 
 // SetNextCapacity adjusts the capacity that will be set for the future filter on the next replacement.
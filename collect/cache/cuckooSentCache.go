@@ -5,8 +5,9 @@ import (
 	"time"
 
 	"github.com/facebookgo/startstop"
-	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/membudget"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/types"
 )
@@ -17,6 +18,8 @@ import (
 // are retained in the cache of sentRecords.
 // The size of the sent cache is still set based on the size of the live trace cache,
 // and the size of the dropped cache is an independent value.
+// Kept and dropped records can also be given separate TTLs, since dropped
+// traces are far more numerous and usually need remembering for less time.
 
 // keptTraceCacheEntry is an internal record we leave behind when keeping a trace to remember
 // our decision for the future. We only store them if the record was kept.
@@ -139,11 +142,26 @@ func (t *cuckooDroppedRecord) Reason() uint {
 // Make sure it implements TraceSentRecord
 var _ TraceSentRecord = (*cuckooDroppedRecord)(nil)
 
+// These are estimates of the memory used by each record in the sent cache,
+// for the memory budget. A kept record includes its trace ID and the LRU's
+// bookkeeping; the dropped filters use a byte per slot, and there are two.
+const (
+	keptRecordBytes    = 160
+	droppedRecordBytes = 2
+)
+
+// minKeptRecords is the fewest kept records that the memory budget can
+// shrink the sent cache to.
+const minKeptRecords = 1000
+
 type CuckooSentCache struct {
-	Cfg     config.Config   `inject:""`
-	Met     metrics.Metrics `inject:"genericMetrics"`
-	kept    *lru.Cache[string, *keptTraceCacheEntry]
-	dropped *CuckooTraceChecker
+	Cfg      config.Config     `inject:""`
+	Met      metrics.Metrics   `inject:"genericMetrics"`
+	Budget   *membudget.Budget `inject:""`
+	kept     *expirable.LRU[string, *keptTraceCacheEntry]
+	keptTTL  time.Duration
+	keptSize int
+	dropped  *CuckooTraceChecker
 
 	// The done channel is used to decide when to terminate the monitor
 	// goroutine. When resizing the cache, we write to the channel, but
@@ -168,14 +186,14 @@ var _ startstop.Starter = (*CuckooSentCache)(nil)
 
 func (c *CuckooSentCache) Start() error {
 	cfg := c.Cfg.GetSampleCacheConfig()
-	kept, err := lru.New[string, *keptTraceCacheEntry](int(cfg.KeptSize))
-	if err != nil {
-		return err
-	}
-	c.kept = kept
+	c.keptTTL = time.Duration(cfg.KeptTTL)
+	c.keptSize = int(cfg.KeptSize)
+	c.kept = expirable.NewLRU[string, *keptTraceCacheEntry](c.keptSize, nil, c.keptTTL)
 	c.dropped = NewCuckooTraceChecker(cfg.DroppedSize, c.Met)
+	c.dropped.SetTTL(time.Duration(cfg.DroppedTTL))
 	c.sentReasons = NewSentReasonsCache(c.Met)
 	c.done = make(chan struct{})
+	c.Budget.Register(membudget.DecisionCache, c.size)
 
 	go c.monitor()
 	return nil
@@ -188,6 +206,7 @@ func (c *CuckooSentCache) monitor() {
 		select {
 		case <-ticker.C:
 			c.dropped.Maintain()
+			c.fitBudget()
 		case <-c.done:
 			ticker.Stop()
 			return
@@ -195,6 +214,34 @@ func (c *CuckooSentCache) monitor() {
 	}
 }
 
+// size estimates the memory used by the cache.
+func (c *CuckooSentCache) size() int64 {
+	c.keptMut.Lock()
+	kept := c.kept.Len()
+	c.keptMut.Unlock()
+	return int64(kept)*keptRecordBytes + int64(c.Cfg.GetSampleCacheConfig().DroppedSize)*droppedRecordBytes
+}
+
+// fitBudget resizes the kept records to fit the cache's allowance from the
+// memory budget, never taking it over the configured size. The dropped
+// filters have a fixed size, so only the kept records can be shrunk.
+func (c *CuckooSentCache) fitBudget() {
+	maxKept := int(c.Cfg.GetSampleCacheConfig().KeptSize)
+	target := maxKept
+	if allocation, ok := c.Budget.Allocation(membudget.DecisionCache); ok {
+		dropped := int64(c.Cfg.GetSampleCacheConfig().DroppedSize) * droppedRecordBytes
+		target = int((allocation.Allowance - dropped) / keptRecordBytes)
+		target = max(min(target, maxKept), min(minKeptRecords, maxKept))
+	}
+
+	c.keptMut.Lock()
+	defer c.keptMut.Unlock()
+	if target != c.keptSize {
+		c.kept.Resize(target)
+		c.keptSize = target
+	}
+}
+
 // Stop halts the monitor goroutine
 func (c *CuckooSentCache) Stop() error {
 	close(c.done)
@@ -261,31 +308,35 @@ func (c *CuckooSentCache) Test(traceID string) (TraceSentRecord, string, bool) {
 }
 
 func (c *CuckooSentCache) Resize(cfg config.SampleCacheConfig) error {
-	stc, err := lru.New[string, *keptTraceCacheEntry](int(cfg.KeptSize))
-	if err != nil {
-		return err
-	}
-
-	// grab all the items in the current cache; if it's larger than
-	// what will fit in the new one, discard the oldest ones
-	// (we don't have to do anything with the ones we discard, this is
-	// the trace decisions cache).
 	c.keptMut.Lock()
 	defer c.keptMut.Unlock()
-	keys := c.kept.Keys()
-	if len(keys) > int(cfg.KeptSize) {
-		keys = keys[len(keys)-int(cfg.KeptSize):]
-	}
-	// copy all the keys to the new cache in order
-	for _, k := range keys {
-		if v, found := c.kept.Get(k); found {
-			stc.Add(k, v)
+	if ttl := time.Duration(cfg.KeptTTL); ttl != c.keptTTL {
+		// the TTL can only be set when the cache is created, so copy all the
+		// records to a new one in order; they keep their place, but get the
+		// new TTL from now
+		stc := expirable.NewLRU[string, *keptTraceCacheEntry](int(cfg.KeptSize), nil, ttl)
+		keys := c.kept.Keys()
+		if len(keys) > int(cfg.KeptSize) {
+			keys = keys[len(keys)-int(cfg.KeptSize):]
+		}
+		for _, k := range keys {
+			if v, found := c.kept.Peek(k); found {
+				stc.Add(k, v)
+			}
 		}
+		c.kept = stc
+		c.keptTTL = ttl
+	} else {
+		// if it's larger than the new size, the oldest ones are discarded
+		// (we don't have to do anything with the ones we discard, this is
+		// the trace decisions cache).
+		c.kept.Resize(int(cfg.KeptSize))
 	}
-	c.kept = stc
+	c.keptSize = int(cfg.KeptSize)
 
 	// also set up the drop cache size to change eventually
 	c.dropped.SetNextCapacity(cfg.DroppedSize)
+	c.dropped.SetTTL(time.Duration(cfg.DroppedTTL))
 
 	// shut down the old monitor and create a new one
 	c.done <- struct{}{}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/membudget"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -91,3 +92,94 @@ func Test_cuckooSentCache_Record(t *testing.T) {
 	_, _, found = c.Test("traceXX")
 	assert.False(t, found)
 }
+
+func Test_cuckooSentCache_TTL(t *testing.T) {
+	cfg := &config.MockConfig{
+		SampleCache: config.SampleCacheConfig{
+			KeptSize:          1000,
+			DroppedSize:       1000,
+			SizeCheckInterval: config.Duration(time.Hour),
+			KeptTTL:           config.Duration(50 * time.Millisecond),
+			DroppedTTL:        config.Duration(50 * time.Millisecond),
+		},
+	}
+	c := &CuckooSentCache{Cfg: cfg, Met: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+	defer c.Stop()
+
+	c.Record(&testTrace{TraceID: "kept"}, true, "because")
+	c.Record(&testTrace{TraceID: "dropped"}, false, "")
+	c.dropped.drain()
+
+	// within the TTL, both decisions are remembered
+	c.dropped.Maintain()
+	_, _, found := c.Test("kept")
+	assert.True(t, found)
+	assert.True(t, c.Dropped("dropped"))
+
+	// a dropped trace survives the first cycle of the filters, but not the second
+	time.Sleep(60 * time.Millisecond)
+	c.dropped.Maintain()
+	assert.True(t, c.Dropped("dropped"))
+	_, _, found = c.Test("kept")
+	assert.False(t, found)
+
+	time.Sleep(60 * time.Millisecond)
+	c.dropped.Maintain()
+	assert.False(t, c.Dropped("dropped"))
+
+	// a new TTL applies to the records that are kept
+	cfg.Mux.Lock()
+	cfg.SampleCache.KeptTTL = 0
+	cfg.Mux.Unlock()
+	require.NoError(t, c.Resize(cfg.GetSampleCacheConfig()))
+	c.Record(&testTrace{TraceID: "kept"}, true, "because")
+	time.Sleep(60 * time.Millisecond)
+	_, _, found = c.Test("kept")
+	assert.True(t, found)
+}
+
+func Test_cuckooSentCache_FitBudget(t *testing.T) {
+	cfg := &config.MockConfig{
+		SampleCache: config.SampleCacheConfig{
+			KeptSize:          5000,
+			DroppedSize:       1000,
+			SizeCheckInterval: config.Duration(time.Hour),
+		},
+		MemoryBudget: config.MemoryBudgetConfig{
+			Enabled:            true,
+			Total:              2_000_000,
+			TraceCacheShare:    90,
+			DecisionCacheShare: 10,
+		},
+	}
+	budget := &membudget.Budget{Config: cfg, Metrics: &metrics.NullMetrics{}}
+	traces := int64(0)
+	budget.Register(membudget.TraceCache, func() int64 { return traces })
+	c := &CuckooSentCache{Cfg: cfg, Met: &metrics.NullMetrics{}, Budget: budget}
+	require.NoError(t, c.Start())
+	defer c.Stop()
+
+	for i := 0; i < 5000; i++ {
+		c.Record(&testTrace{TraceID: fmt.Sprintf("trace%04d", i)}, true, "because")
+	}
+
+	// with the trace cache using its whole share, the kept records are
+	// shrunk to fit the decision cache's own share
+	traces = 1_800_000
+	c.fitBudget()
+	assert.Equal(t, (200_000-1000*droppedRecordBytes)/keptRecordBytes, c.kept.Len())
+
+	// and they can grow back when the trace cache isn't using its share
+	traces = 0
+	c.fitBudget()
+	assert.Equal(t, (200_000+1_800_000/10-1000*droppedRecordBytes)/keptRecordBytes, c.keptSize)
+
+	// without a budget, the configured size is used
+	traces = 1_800_000
+	cfg.Mux.Lock()
+	cfg.MemoryBudget.Enabled = false
+	cfg.Mux.Unlock()
+	c.fitBudget()
+	assert.Equal(t, 5000, c.keptSize)
+}
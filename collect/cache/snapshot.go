@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// ErrStaleSnapshot is returned when a snapshot is too old to be restored.
+var ErrStaleSnapshot = errors.New("trace snapshot is too old to restore")
+
+// snapshot is the contents of a snapshot file.
+type snapshot struct {
+	TakenAt time.Time
+	Spans   []spilledSpan
+}
+
+// WriteSnapshot writes the spans of traces to a file, so that they can be
+// restored by the next process to run, and returns the number of spans
+// written. The file is replaced only once it's completely written.
+func WriteSnapshot(path string, traces []*types.Trace, takenAt time.Time) (int, error) {
+	snap := snapshot{TakenAt: takenAt}
+	for _, trace := range traces {
+		for _, sp := range trace.GetSpans() {
+			snap.Spans = append(snap.Spans, newSpilledSpan(sp))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(snap)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+	return len(snap.Spans), nil
+}
+
+// ReadSnapshot reads back the spans written by WriteSnapshot and removes the
+// file, so that they're only restored once. If there's no snapshot, it
+// returns no spans. If the snapshot was taken more than maxAge before now,
+// it returns ErrStaleSnapshot; a maxAge of 0 is no limit.
+func ReadSnapshot(path string, now time.Time, maxAge time.Duration) ([]*types.Span, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	var snap snapshot
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if maxAge > 0 && now.Sub(snap.TakenAt) > maxAge {
+		return nil, ErrStaleSnapshot
+	}
+
+	spans := make([]*types.Span, 0, len(snap.Spans))
+	for _, ss := range snap.Spans {
+		sp := ss.span()
+		// the body of a summary that couldn't be read back belonged to the
+		// process that wrote the snapshot
+		sp.BodyID = 0
+		spans = append(spans, sp)
+	}
+	return spans, nil
+}
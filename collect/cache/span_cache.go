@@ -17,6 +17,22 @@ type SpanCache interface {
 	// be treated as a read-only trace. This is because the cache may modify the
 	// trace after it is returned. If you need to modify the trace, make a copy.
 	Get(traceID string) *types.Trace
+	// Load retrieves a trace like Get, first reading back any of its spans
+	// that were spilled to disk, so that the trace has all of its spans.
+	Load(traceID string) *types.Trace
+	// Spill writes the spans of the given traces to disk to free memory, and
+	// returns the IDs of the traces that couldn't be spilled, which is all of
+	// them if spilling isn't enabled. Spilled traces stay in the cache.
+	Spill(traceIDs []string) []string
+	// HoldBody writes the full body of a span that was added to the cache to
+	// disk, leaving only the given fields of its data in memory until its
+	// trace is loaded, and reports whether it did. Nothing is written if
+	// there is no room on disk, or no spill store.
+	HoldBody(sp *types.Span, fields []string) bool
+	// Trim removes the oldest spans of a trace, other than its root span,
+	// until the trace is within the given span count and size, and returns
+	// them. A limit of 0 is no limit.
+	Trim(traceID string, maxSpans, maxBytes int) []*types.Span
 	// Returns the desired fraction of the highest-impact trace IDs in the cache.
 	// (e.g. if fract is 0.1, returns the heaviest 10% of trace IDs)
 	// Impact is defined as the product of memory use and duration.
@@ -1,12 +1,16 @@
 package cache
 
 import (
+	"errors"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dgryski/go-wyhash"
 	"github.com/facebookgo/startstop"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/membudget"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/types"
 	"github.com/jonboulle/clockwork"
@@ -15,11 +19,24 @@ import (
 // this is a naive implementation that uses a map
 // and doesn't try to be clever about memory usage or allocations
 type SpanCache_basic struct {
-	Cfg     config.Config   `inject:""`
-	Clock   clockwork.Clock `inject:""`
-	Metrics metrics.Metrics `inject:"genericMetrics"`
-	cache   map[string]*types.Trace
-	mut     sync.RWMutex
+	Cfg     config.Config     `inject:""`
+	Clock   clockwork.Clock   `inject:""`
+	Metrics metrics.Metrics   `inject:"genericMetrics"`
+	Budget  *membudget.Budget `inject:""`
+
+	// partitions divide the traces between the collector's workers, so that
+	// each worker has its own map and lock
+	partitions []*spanCachePartition
+
+	// dataBytes is the sum of the DataSize of the traces in the cache, kept
+	// up to date as they change so that the memory budget doesn't have to
+	// add them up
+	dataBytes atomic.Int64
+
+	// the spill store is shared by the partitions; when both locks are
+	// needed, the partition's is taken first
+	spill    *spillStore
+	spillMut sync.Mutex
 
 	// current and nextix are used only by the GetTraceIDs method and are not protected
 	// by the mutex; they are only accessed by the goroutine that calls GetTraceIDs.
@@ -27,6 +44,29 @@ type SpanCache_basic struct {
 	nextix  int
 }
 
+// spanCachePartition holds the traces whose IDs belong to one partition.
+type spanCachePartition struct {
+	mut   sync.RWMutex
+	cache map[string]*types.Trace
+}
+
+// partitionSeed is the seed for hashing trace IDs into partitions.
+const partitionSeed = 0x5eed7ace
+
+// Partition returns which of n partitions a trace belongs to. The collector
+// and the span cache use it to agree on which worker owns each trace.
+func Partition(traceID string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return int(wyhash.Hash([]byte(traceID), partitionSeed) % uint64(n))
+}
+
+// partition returns the partition that holds a trace.
+func (sc *SpanCache_basic) partition(traceID string) *spanCachePartition {
+	return sc.partitions[Partition(traceID, len(sc.partitions))]
+}
+
 // ensure that spanCache implements SpanCache
 var _ SpanCache = &SpanCache_basic{}
 
@@ -36,19 +76,49 @@ var _ startstop.Starter = &SpanCache_basic{}
 func (sc *SpanCache_basic) Start() error {
 	sc.Metrics.Register("spancache_spans", "updown")
 	sc.Metrics.Register("spancache_traces", "updown")
-	sc.cache = make(map[string]*types.Trace)
+	sc.Metrics.Register("spancache_spilled_traces", "gauge")
+	sc.Metrics.Register("spancache_spill_bytes", "gauge")
+	sc.Metrics.Register("spancache_spill_errors", "counter")
+	sc.partitions = make([]*spanCachePartition, sc.Cfg.GetCollectionConfig().GetWorkers())
+	for i := range sc.partitions {
+		sc.partitions[i] = &spanCachePartition{cache: make(map[string]*types.Trace)}
+	}
+	sc.Budget.Register(membudget.TraceCache, sc.dataSize)
+
+	// summarized spans keep their bodies in the spill store, even if traces
+	// aren't spilled
+	if cfg := sc.Cfg.GetTraceSpillConfig(); cfg.Enabled || len(sc.Cfg.GetSpanSummaryConfig().Targets) > 0 {
+		spill, err := newSpillStore(cfg.Directory, int64(cfg.MaxDiskSize))
+		if err != nil {
+			return err
+		}
+		sc.spill = spill
+		sc.Metrics.Store("SPILL_MAX_BYTES", float64(cfg.MaxDiskSize))
+	}
 	return nil
 }
 
+// dataSize returns the size of the spans held in memory.
+func (sc *SpanCache_basic) dataSize() int64 {
+	return sc.dataBytes.Load()
+}
+
+// resized records the change in a trace's DataSize from before, after the
+// trace has been changed.
+func (sc *SpanCache_basic) resized(trace *types.Trace, before int) {
+	sc.dataBytes.Add(int64(trace.DataSize - before))
+}
+
 func (sc *SpanCache_basic) GetClock() clockwork.Clock {
 	return sc.Clock
 }
 
 func (sc *SpanCache_basic) Set(sp *types.Span) error {
-	sc.mut.Lock()
-	defer sc.mut.Unlock()
 	traceID := sp.TraceID
-	trace, ok := sc.cache[traceID]
+	p := sc.partition(traceID)
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	trace, ok := p.cache[traceID]
 	if !ok {
 		trace = &types.Trace{
 			APIHost:     sp.APIHost,
@@ -57,27 +127,233 @@ func (sc *SpanCache_basic) Set(sp *types.Span) error {
 			TraceID:     traceID,
 			ArrivalTime: sc.Clock.Now(),
 		}
-		sc.cache[traceID] = trace
+		p.cache[traceID] = trace
 		sc.Metrics.Up("spancache_traces")
 	}
 	if sp.IsRoot {
 		trace.RootSpan = sp
 	}
+	before := trace.DataSize
 	trace.AddSpan(sp)
+	sc.resized(trace, before)
 	sc.Metrics.Up("spancache_spans")
 	return nil
 }
 
 func (sc *SpanCache_basic) Get(traceID string) *types.Trace {
-	sc.mut.RLock()
-	defer sc.mut.RUnlock()
-	trace, ok := sc.cache[traceID]
+	p := sc.partition(traceID)
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	trace, ok := p.cache[traceID]
 	if !ok {
 		return nil
 	}
 	return trace
 }
 
+// Load returns a trace with any of its spans that were spilled to disk read
+// back into memory. If they can't be read, the trace is returned with the
+// spans that are still in memory. The files are read without holding the
+// trace's lock.
+func (sc *SpanCache_basic) Load(traceID string) *types.Trace {
+	p := sc.partition(traceID)
+	p.mut.Lock()
+	trace, ok := p.cache[traceID]
+	if !ok || sc.spill == nil {
+		p.mut.Unlock()
+		return trace
+	}
+	sc.spillMut.Lock()
+	segs := sc.spill.take(traceID)
+	if len(segs) > 0 {
+		sc.reportSpill()
+	}
+	sc.spillMut.Unlock()
+	p.mut.Unlock()
+	if len(segs) == 0 {
+		return trace
+	}
+
+	spans, bodies, err := readSegments(segs)
+	if err != nil {
+		sc.Metrics.Increment("spancache_spill_errors")
+	}
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if p.cache[traceID] != trace {
+		// the trace was removed while its spans were being read
+		return trace
+	}
+	before := trace.DataSize
+	trace.RestoreSpans(spans)
+	trace.RestoreBodies(bodies)
+	sc.resized(trace, before)
+	sc.Metrics.Count("spancache_spans", int64(len(spans)))
+	return trace
+}
+
+// Spill writes the spans of traces to disk, leaving the traces in the cache
+// without them, as long as they fit in the disk space allowed.
+func (sc *SpanCache_basic) Spill(traceIDs []string) []string {
+	if sc.spill == nil {
+		return traceIDs
+	}
+
+	var notSpilled []string
+	for _, traceID := range traceIDs {
+		if !sc.spillTrace(traceID) {
+			notSpilled = append(notSpilled, traceID)
+		}
+	}
+	sc.spillMut.Lock()
+	sc.reportSpill()
+	sc.spillMut.Unlock()
+	return notSpilled
+}
+
+// spillTrace writes the spans of one trace to disk, and reports whether it
+// doesn't need to be decided early, either because it was spilled or because
+// it has no spans in memory. The spans are taken out of the trace first, so
+// that they're encoded and written without holding any lock; if the trace is
+// loaded meanwhile, loading waits for the write.
+func (sc *SpanCache_basic) spillTrace(traceID string) bool {
+	p := sc.partition(traceID)
+	p.mut.Lock()
+	trace, ok := p.cache[traceID]
+	if !ok || trace.DescendantCount() == 0 {
+		p.mut.Unlock()
+		return true
+	}
+	sc.dataBytes.Add(-int64(trace.DataSize))
+	spans := trace.TakeSpans()
+	sc.spillMut.Lock()
+	seg := sc.spill.pending(traceID, spans)
+	sc.spillMut.Unlock()
+	p.mut.Unlock()
+	sc.Metrics.Count("spancache_spans", -int64(len(spans)))
+
+	path, size, err := sc.writeSpans(spans)
+	if err == nil {
+		sc.spillMut.Lock()
+		sc.spill.finish(traceID, seg, path, size)
+		sc.spillMut.Unlock()
+		return true
+	}
+	if !errors.Is(err, errSpillFull) {
+		sc.Metrics.Increment("spancache_spill_errors")
+	}
+
+	// put the spans back, unless the trace was loaded or removed meanwhile
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	sc.spillMut.Lock()
+	restore := sc.spill.finish(traceID, seg, "", 0)
+	sc.spillMut.Unlock()
+	if trace, ok := p.cache[traceID]; ok && restore {
+		before := trace.DataSize
+		trace.RestoreSpans(spans)
+		sc.resized(trace, before)
+		sc.Metrics.Count("spancache_spans", int64(len(spans)))
+	}
+	return false
+}
+
+// writeSpans encodes spans and writes them to a new file, if there's space
+// for it, returning its path and size.
+func (sc *SpanCache_basic) writeSpans(spans []*types.Span) (string, int64, error) {
+	data, err := encodeSpans(spans)
+	if err != nil {
+		return "", 0, err
+	}
+	return sc.writeSpill(data)
+}
+
+// writeSpill writes encoded spans to a new file, if there's space for it.
+func (sc *SpanCache_basic) writeSpill(data []byte) (string, int64, error) {
+	size := int64(len(data))
+	sc.spillMut.Lock()
+	path, err := sc.spill.reserve(size)
+	sc.spillMut.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := writeSpillFile(path, data); err != nil {
+		sc.spillMut.Lock()
+		sc.spill.release(path, size)
+		sc.spillMut.Unlock()
+		return "", 0, err
+	}
+	return path, size, nil
+}
+
+// HoldBody writes the full body of a span in the cache to disk, and leaves
+// only the given fields of its data in memory. The body is written before
+// the trace's lock is taken, and thrown away if the span has left memory
+// meanwhile.
+func (sc *SpanCache_basic) HoldBody(sp *types.Span, fields []string) bool {
+	if sc.spill == nil || sp.BodyID != 0 {
+		return false
+	}
+	sc.spillMut.Lock()
+	bodyID := sc.spill.nextBodyID()
+	sc.spillMut.Unlock()
+	body := newSpilledSpan(sp)
+	body.BodyID = bodyID
+	data, err := encodeSpilled([]spilledSpan{body})
+	var path string
+	var size int64
+	if err == nil {
+		path, size, err = sc.writeSpill(data)
+	}
+	if err != nil {
+		if !errors.Is(err, errSpillFull) {
+			sc.Metrics.Increment("spancache_spill_errors")
+		}
+		return false
+	}
+
+	p := sc.partition(sp.TraceID)
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	sc.spillMut.Lock()
+	defer sc.spillMut.Unlock()
+	trace, ok := p.cache[sp.TraceID]
+	if !ok || !trace.HasSpan(sp) {
+		sc.spill.release(path, size)
+		return false
+	}
+	sc.spill.addBody(sp.TraceID, path, size)
+	sc.reportSpill()
+	sp.BodyID = bodyID
+	before := trace.DataSize
+	trace.SummarizeSpan(sp, fields)
+	sc.resized(trace, before)
+	return true
+}
+
+func (sc *SpanCache_basic) Trim(traceID string, maxSpans, maxBytes int) []*types.Span {
+	p := sc.partition(traceID)
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	trace, ok := p.cache[traceID]
+	if !ok {
+		return nil
+	}
+	before := trace.DataSize
+	trimmed := trace.TrimSpans(maxSpans, maxBytes)
+	sc.resized(trace, before)
+	sc.Metrics.Count("spancache_spans", -int64(len(trimmed)))
+	return trimmed
+}
+
+// reportSpill records the size of the spill store. Only call this while
+// holding the spill lock.
+func (sc *SpanCache_basic) reportSpill() {
+	sc.Metrics.Gauge("spancache_spilled_traces", sc.spill.len())
+	sc.Metrics.Gauge("spancache_spill_bytes", sc.spill.used)
+}
+
 // Returns the desired fraction of the highest-impact trace IDs in the cache.
 // (e.g. if fract is 0.1, returns the heaviest 10% of trace IDs)
 // Impact is defined as the product of memory use and duration.
@@ -90,9 +366,7 @@ func (sc *SpanCache_basic) GetHighImpactTraceIDs(fract float64) []string {
 		id     string
 		impact int
 	}
-	sc.mut.RLock()
-	count := len(sc.cache)
-	sc.mut.RUnlock()
+	count := sc.Len()
 	n := int(float64(count) * fract)
 	ids := make([]tidWithImpact, 0, n)
 
@@ -101,14 +375,16 @@ func (sc *SpanCache_basic) GetHighImpactTraceIDs(fract float64) []string {
 		timeout = 60 * time.Second
 	}
 
-	sc.mut.RLock()
-	for traceID := range sc.cache {
-		ids = append(ids, tidWithImpact{
-			id:     traceID,
-			impact: sc.cache[traceID].CacheImpact(timeout),
-		})
+	for _, p := range sc.partitions {
+		p.mut.RLock()
+		for traceID, trace := range p.cache {
+			ids = append(ids, tidWithImpact{
+				id:     traceID,
+				impact: trace.CacheImpact(timeout),
+			})
+		}
+		p.mut.RUnlock()
 	}
-	sc.mut.RUnlock()
 	// Sort traces by CacheImpact, heaviest first
 	sort.Slice(ids, func(i, j int) bool {
 		return ids[i].impact > ids[j].impact
@@ -134,12 +410,14 @@ func (sc *SpanCache_basic) GetTraceIDs(n int) []string {
 	// this is the only function that looks at current or nextix so it
 	// doesn't need to lock those fields
 	if sc.current == nil || sc.nextix >= len(sc.current) {
-		sc.mut.RLock()
-		sc.current = make([]string, 0, len(sc.cache))
-		for traceID := range sc.cache {
-			sc.current = append(sc.current, traceID)
+		sc.current = make([]string, 0, sc.Len())
+		for _, p := range sc.partitions {
+			p.mut.RLock()
+			for traceID := range p.cache {
+				sc.current = append(sc.current, traceID)
+			}
+			p.mut.RUnlock()
 		}
-		sc.mut.RUnlock()
 		sc.nextix = 0
 	}
 	if sc.nextix+n > len(sc.current) {
@@ -164,31 +442,47 @@ func (sc *SpanCache_basic) GetOldTraceIDs() []string {
 	cutoffTime := sc.Clock.Now().Add(-cutoffDuration)
 	ids := make([]string, 0)
 
-	sc.mut.RLock()
-	defer sc.mut.RUnlock()
-
-	for traceID := range sc.cache {
-		if sc.cache[traceID].ArrivalTime.Before(cutoffTime) {
-			ids = append(ids, traceID)
+	for _, p := range sc.partitions {
+		p.mut.RLock()
+		for traceID, trace := range p.cache {
+			if trace.ArrivalTime.Before(cutoffTime) {
+				ids = append(ids, traceID)
+			}
 		}
+		p.mut.RUnlock()
 	}
 	return ids
 }
 
 func (sc *SpanCache_basic) Remove(traceID string) {
-	sc.mut.Lock()
-	defer sc.mut.Unlock()
-	trace, ok := sc.cache[traceID]
+	p := sc.partition(traceID)
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	trace, ok := p.cache[traceID]
 	if !ok {
 		return
 	}
 	sc.Metrics.Down("spancache_traces")
 	sc.Metrics.Count("spancache_spans", -int64(trace.DescendantCount()))
-	delete(sc.cache, traceID)
+	sc.dataBytes.Add(-int64(trace.DataSize))
+	delete(p.cache, traceID)
+	if sc.spill == nil {
+		return
+	}
+	sc.spillMut.Lock()
+	defer sc.spillMut.Unlock()
+	if sc.spill.has(traceID) {
+		sc.spill.remove(traceID)
+		sc.reportSpill()
+	}
 }
 
 func (sc *SpanCache_basic) Len() int {
-	sc.mut.RLock()
-	defer sc.mut.RUnlock()
-	return len(sc.cache)
+	var n int
+	for _, p := range sc.partitions {
+		p.mut.RLock()
+		n += len(p.cache)
+		p.mut.RUnlock()
+	}
+	return n
 }
@@ -3,6 +3,8 @@ package cache
 import (
 	"fmt"
 	"math/rand"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -146,6 +148,46 @@ func TestGetTraceIDs(t *testing.T) {
 	}
 }
 
+func TestSpanCachePartitions(t *testing.T) {
+	cfg := &config.MockConfig{
+		GetCollectionConfigVal: config.CollectionConfig{Workers: 4},
+		GetTraceTimeoutVal:     10 * time.Second,
+	}
+	c := &SpanCache_basic{Cfg: cfg, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+	require.Len(t, c.partitions, 4)
+
+	const numIDs = 100
+	for i := 0; i < numIDs; i++ {
+		traceID := fmt.Sprintf("trace%d", i)
+		require.NoError(t, c.Set(&types.Span{TraceID: traceID, ID: fmt.Sprintf("span%d", i)}))
+		// each trace is held by the partition its ID hashes to
+		p := Partition(traceID, 4)
+		assert.Equal(t, p, Partition(traceID, 4))
+		assert.Contains(t, c.partitions[p].cache, traceID)
+	}
+	for _, p := range c.partitions {
+		assert.NotEmpty(t, p.cache, "traces should be spread over every partition")
+	}
+	assert.Equal(t, numIDs, c.Len())
+	assert.Len(t, c.GetTraceIDs(numIDs), numIDs)
+	assert.Len(t, c.GetHighImpactTraceIDs(1), numIDs)
+
+	for i := 0; i < numIDs; i++ {
+		c.Remove(fmt.Sprintf("trace%d", i))
+	}
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestPartition(t *testing.T) {
+	assert.Equal(t, 0, Partition("trace", 0))
+	assert.Equal(t, 0, Partition("trace", 1))
+	for i := 0; i < 100; i++ {
+		p := Partition(fmt.Sprintf("trace%d", i), 7)
+		assert.True(t, p >= 0 && p < 7)
+	}
+}
+
 func TestGetOldest(t *testing.T) {
 	for _, typ := range []string{"basic"} {
 		fakeClock := clockwork.NewFakeClock()
@@ -339,3 +381,199 @@ func BenchmarkSpanCacheMixed(b *testing.B) {
 		})
 	}
 }
+
+func TestSpanCacheSpill(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.MockConfig{
+		GetTraceTimeoutVal: 10 * time.Second,
+		TraceSpill: config.TraceSpillConfig{
+			Enabled:     true,
+			Directory:   dir,
+			MaxDiskSize: 2000,
+		},
+	}
+	c := &SpanCache_basic{Cfg: cfg, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+
+	span := func(traceID string, id string, data map[string]interface{}) *types.Span {
+		return &types.Span{TraceID: traceID, ID: id, Event: types.Event{Dataset: "ds", SampleRate: 3, Data: data}}
+	}
+	require.NoError(t, c.Set(span("trace1", "a", map[string]interface{}{
+		"count": int64(1), "ratio": 0.5, "error": true, "nested": map[string]interface{}{"list": []interface{}{"x"}},
+	})))
+	root := span("trace1", "b", map[string]interface{}{"name": "root"})
+	root.IsRoot = true
+	require.NoError(t, c.Set(root))
+	require.NoError(t, c.Set(span("trace2", "c", map[string]interface{}{"big": strings.Repeat("x", 5000)})))
+
+	// the trace that doesn't fit stays in memory
+	assert.Equal(t, []string{"trace2"}, c.Spill([]string{"trace1", "trace2", "missing"}))
+	assert.Empty(t, c.Get("trace1").GetSpans())
+	assert.Nil(t, c.Get("trace1").RootSpan)
+	assert.Len(t, c.Get("trace2").GetSpans(), 1)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	assert.Len(t, files, 1)
+
+	// spans that arrive after the trace is spilled are kept in memory, and
+	// follow the spilled ones when it's loaded
+	require.NoError(t, c.Set(span("trace1", "d", nil)))
+	trace := c.Load("trace1")
+	require.Len(t, trace.GetSpans(), 3)
+	assert.Equal(t, []string{"a", "b", "d"}, []string{trace.GetSpans()[0].ID, trace.GetSpans()[1].ID, trace.GetSpans()[2].ID})
+	assert.Equal(t, map[string]interface{}{
+		"count": int64(1), "ratio": 0.5, "error": true, "nested": map[string]interface{}{"list": []interface{}{"x"}},
+	}, trace.GetSpans()[0].Data)
+	assert.Equal(t, uint(3), trace.GetSpans()[0].SampleRate)
+	assert.NotNil(t, trace.GetSpans()[0].Context)
+	assert.Equal(t, "b", trace.RootSpan.ID)
+	files, _ = filepath.Glob(filepath.Join(dir, "*.spill"))
+	assert.Empty(t, files)
+
+	// removing a spilled trace removes its file
+	assert.Empty(t, c.Spill([]string{"trace1"}))
+	c.Remove("trace1")
+	files, _ = filepath.Glob(filepath.Join(dir, "*.spill"))
+	assert.Empty(t, files)
+	assert.Equal(t, int64(0), c.spill.used)
+
+	// a trace loaded while its spans are being written waits for them, and a
+	// file finished after its trace was removed is removed too
+	require.NoError(t, c.Set(span("trace3", "e", nil)))
+	spans := c.Get("trace3").TakeSpans()
+	c.spillMut.Lock()
+	seg := c.spill.pending("trace3", spans)
+	c.spillMut.Unlock()
+	assert.Equal(t, 1, c.Get("trace3").SpilledSpans)
+	go func() {
+		path, size, err := c.writeSpans(spans)
+		assert.NoError(t, err)
+		c.spillMut.Lock()
+		c.spill.finish("trace3", seg, path, size)
+		c.spillMut.Unlock()
+	}()
+	trace = c.Load("trace3")
+	require.Len(t, trace.GetSpans(), 1)
+	assert.Equal(t, "e", trace.GetSpans()[0].ID)
+	assert.Zero(t, trace.SpilledSpans)
+	c.spillMut.Lock()
+	seg = c.spill.pending("trace3", trace.TakeSpans())
+	c.spillMut.Unlock()
+	c.Remove("trace3")
+	path, size, err := c.writeSpans(seg.spans)
+	require.NoError(t, err)
+	c.spillMut.Lock()
+	c.spill.finish("trace3", seg, path, size)
+	c.spillMut.Unlock()
+	files, _ = filepath.Glob(filepath.Join(dir, "*.spill"))
+	assert.Empty(t, files)
+	assert.Equal(t, int64(0), c.spill.used)
+
+	// without spilling, no traces are spilled
+	c = &SpanCache_basic{Cfg: &config.MockConfig{}, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+	require.NoError(t, c.Set(span("trace1", "a", nil)))
+	assert.Equal(t, []string{"trace1"}, c.Spill([]string{"trace1"}))
+}
+
+func TestSpanCacheHoldBody(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.MockConfig{
+		GetTraceTimeoutVal: 10 * time.Second,
+		TraceSpill: config.TraceSpillConfig{
+			Directory:   dir,
+			MaxDiskSize: 2000,
+		},
+		SpanSummaries: config.SpanSummaryConfig{Targets: []string{"ds"}},
+	}
+	c := &SpanCache_basic{Cfg: cfg, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+
+	span := func(id string, data map[string]interface{}) *types.Span {
+		return &types.Span{TraceID: "trace1", ID: id, Event: types.Event{Dataset: "ds", Data: data}}
+	}
+	root := span("a", map[string]interface{}{"name": "root", "body": strings.Repeat("x", 100)})
+	root.IsRoot = true
+	require.NoError(t, c.Set(root))
+	trimmed := span("b", map[string]interface{}{"name": "child", "body": strings.Repeat("y", 100)})
+	require.NoError(t, c.Set(trimmed))
+
+	// only the summaries are kept in memory
+	assert.True(t, c.HoldBody(root, []string{"name"}))
+	assert.True(t, c.HoldBody(trimmed, []string{"name"}))
+	assert.False(t, c.HoldBody(root, []string{"name"}), "a summary's body is already held")
+	assert.Equal(t, map[string]interface{}{"name": "root"}, root.Data)
+	assert.Less(t, c.Get("trace1").DataSize, 100)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	assert.Len(t, files, 2)
+
+	// a summary can be spilled, and its body still takes its place; the body
+	// of a span that was trimmed isn't brought back
+	assert.Len(t, c.Trim("trace1", 1, 0), 1)
+	assert.Empty(t, c.Spill([]string{"trace1"}))
+	require.NoError(t, c.Set(span("c", map[string]interface{}{"name": "late"})))
+	trace := c.Load("trace1")
+	require.Len(t, trace.GetSpans(), 2)
+	assert.Equal(t, strings.Repeat("x", 100), trace.GetSpans()[0].Data["body"])
+	assert.Equal(t, uint64(0), trace.GetSpans()[0].BodyID)
+	assert.Same(t, trace.GetSpans()[0], trace.RootSpan)
+	assert.Equal(t, "c", trace.GetSpans()[1].ID)
+	files, _ = filepath.Glob(filepath.Join(dir, "*.spill"))
+	assert.Empty(t, files)
+
+	// a span whose body doesn't fit on disk is kept in full
+	big := span("d", map[string]interface{}{"body": strings.Repeat("z", 5000)})
+	require.NoError(t, c.Set(big))
+	assert.False(t, c.HoldBody(big, nil))
+	assert.Len(t, big.Data, 1)
+
+	// without a spill store, nothing is held
+	c = &SpanCache_basic{Cfg: &config.MockConfig{}, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+	sp := span("a", map[string]interface{}{"name": "root"})
+	require.NoError(t, c.Set(sp))
+	assert.False(t, c.HoldBody(sp, nil))
+}
+
+func TestSpanCacheDataSize(t *testing.T) {
+	cfg := &config.MockConfig{
+		GetTraceTimeoutVal: 10 * time.Second,
+		TraceSpill: config.TraceSpillConfig{
+			Enabled:     true,
+			Directory:   t.TempDir(),
+			MaxDiskSize: 10000,
+		},
+	}
+	c := &SpanCache_basic{Cfg: cfg, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, c.Start())
+
+	// the size is kept as traces change, and matches adding them up
+	total := func() int64 {
+		var size int64
+		for _, p := range c.partitions {
+			for _, trace := range p.cache {
+				size += int64(trace.DataSize)
+			}
+		}
+		return size
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.Set(&types.Span{
+			TraceID: fmt.Sprintf("trace%d", i%3),
+			Event:   types.Event{Data: map[string]interface{}{"body": strings.Repeat("x", 10*i)}},
+		}))
+	}
+	assert.Equal(t, total(), c.dataSize())
+	assert.Positive(t, c.dataSize())
+
+	c.Trim("trace0", 1, 0)
+	assert.Equal(t, total(), c.dataSize())
+	assert.Empty(t, c.Spill([]string{"trace1"}))
+	assert.Equal(t, total(), c.dataSize())
+	c.Load("trace1")
+	assert.Equal(t, total(), c.dataSize())
+	c.Remove("trace2")
+	assert.Equal(t, total(), c.dataSize())
+	c.Remove("trace0")
+	c.Remove("trace1")
+	assert.Equal(t, int64(0), c.dataSize())
+}
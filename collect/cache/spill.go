@@ -0,0 +1,330 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// errSpillFull is returned when writing a trace would take the disk space
+// used by the spill store over its limit.
+var errSpillFull = errors.New("trace spill directory is full")
+
+// spilledSpan is the part of a span that's written to disk. The span's
+// context isn't kept.
+type spilledSpan struct {
+	APIHost     string
+	APIKey      string
+	Dataset     string
+	Environment string
+	SampleRate  uint
+	Timestamp   time.Time
+	Data        map[string]interface{}
+	TraceID     string
+	ID          string
+	DataSize    int
+	ArrivalTime time.Time
+	IsRoot      bool
+	BodyID      uint64
+}
+
+// newSpilledSpan returns the part of a span that's written to disk.
+func newSpilledSpan(sp *types.Span) spilledSpan {
+	return spilledSpan{
+		APIHost:     sp.APIHost,
+		APIKey:      sp.APIKey,
+		Dataset:     sp.Dataset,
+		Environment: sp.Environment,
+		SampleRate:  sp.SampleRate,
+		Timestamp:   sp.Timestamp,
+		Data:        sp.Data,
+		TraceID:     sp.TraceID,
+		ID:          sp.ID,
+		DataSize:    sp.DataSize,
+		ArrivalTime: sp.ArrivalTime,
+		IsRoot:      sp.IsRoot,
+		BodyID:      sp.BodyID,
+	}
+}
+
+// span returns the span that was written to disk, with a new context.
+func (ss spilledSpan) span() *types.Span {
+	return &types.Span{
+		Event: types.Event{
+			Context:     context.Background(),
+			APIHost:     ss.APIHost,
+			APIKey:      ss.APIKey,
+			Dataset:     ss.Dataset,
+			Environment: ss.Environment,
+			SampleRate:  ss.SampleRate,
+			Timestamp:   ss.Timestamp,
+			Data:        ss.Data,
+		},
+		TraceID:     ss.TraceID,
+		ID:          ss.ID,
+		DataSize:    ss.DataSize,
+		ArrivalTime: ss.ArrivalTime,
+		IsRoot:      ss.IsRoot,
+		BodyID:      ss.BodyID,
+	}
+}
+
+func init() {
+	// nested values in span data are decoded from JSON or msgpack as these
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// spillSegment is a file holding some of a trace's spans. A trace can be
+// spilled more than once, if more of its spans arrive after it's spilled.
+type spillSegment struct {
+	path string
+	size int64
+	// bodies is set for a segment holding the full bodies of summarized
+	// spans, rather than spans taken out of memory
+	bodies bool
+
+	// A segment whose file is still being written has its spans, and done,
+	// which is closed once the write has finished. If the write failed, path
+	// is left empty and the spans are used instead of the file.
+	spans []*types.Span
+	done  chan struct{}
+	// taken is set if the segment is taken from the store while its file is
+	// being written, and discard if its file won't be read.
+	taken   bool
+	discard bool
+}
+
+// spillStore keeps track of the files that the spans of traces are written
+// to in a directory, keeping the disk space they use under a limit. It isn't
+// safe for concurrent use, but spans are encoded and files are written and
+// read by functions that don't use it, so that callers don't need to hold
+// the lock that guards it while they do.
+type spillStore struct {
+	dir      string
+	maxBytes int64
+	used     int64
+	seq      uint64
+	bodySeq  uint64
+	segments map[string][]*spillSegment
+}
+
+// newSpillStore creates a spill store in a directory, removing any trace
+// files left in it by an earlier process.
+func newSpillStore(dir string, maxBytes int64) (*spillStore, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "refinery-spill")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	return &spillStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		segments: make(map[string][]*spillSegment),
+	}, nil
+}
+
+// encodeSpans encodes spans as they're written to a file.
+func encodeSpans(spans []*types.Span) ([]byte, error) {
+	spilled := make([]spilledSpan, 0, len(spans))
+	for _, sp := range spans {
+		spilled = append(spilled, newSpilledSpan(sp))
+	}
+	return encodeSpilled(spilled)
+}
+
+func encodeSpilled(spilled []spilledSpan) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(spilled); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSpillFile writes an encoded segment to a path returned by reserve.
+func writeSpillFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// pending adds a segment for spans that have been taken out of memory and
+// are about to be written, so that a trace that's loaded meanwhile waits
+// for them.
+func (s *spillStore) pending(traceID string, spans []*types.Span) *spillSegment {
+	seg := &spillSegment{spans: spans, done: make(chan struct{})}
+	s.segments[traceID] = append(s.segments[traceID], seg)
+	return seg
+}
+
+// nextBodyID returns the BodyID for the next span whose body is held.
+func (s *spillStore) nextBodyID() uint64 {
+	s.bodySeq++
+	return s.bodySeq
+}
+
+// reserve takes the disk space for a file of size bytes, and returns the
+// path to write it to.
+func (s *spillStore) reserve(size int64) (string, error) {
+	if s.used+size > s.maxBytes {
+		return "", errSpillFull
+	}
+	s.used += size
+	s.seq++
+	return filepath.Join(s.dir, fmt.Sprintf("%d.spill", s.seq)), nil
+}
+
+// release gives back the space reserved for a file that isn't kept, and
+// removes the file.
+func (s *spillStore) release(path string, size int64) {
+	os.Remove(path)
+	s.used -= size
+}
+
+// finish records the end of a pending segment's write, which failed if path
+// is empty. It returns true if the write failed and the segment had not been
+// taken, in which case it's removed from the store, and its spans should be
+// put back in memory.
+func (s *spillStore) finish(traceID string, seg *spillSegment, path string, size int64) bool {
+	defer close(seg.done)
+	switch {
+	case seg.discard:
+		if path != "" {
+			s.release(path, size)
+		}
+		return false
+	case seg.taken:
+		// the file is read and removed by the caller that took it
+		seg.path = path
+		if path != "" {
+			s.used -= size
+		}
+		return false
+	case path != "":
+		seg.path = path
+		seg.size = size
+		seg.spans = nil
+		seg.done = nil
+		return false
+	}
+	segs := s.segments[traceID]
+	for i, other := range segs {
+		if other == seg {
+			segs = append(segs[:i:i], segs[i+1:]...)
+			break
+		}
+	}
+	if len(segs) == 0 {
+		delete(s.segments, traceID)
+	} else {
+		s.segments[traceID] = segs
+	}
+	return true
+}
+
+// addBody records a file that has been written with the full body of one of
+// a trace's spans.
+func (s *spillStore) addBody(traceID string, path string, size int64) {
+	s.segments[traceID] = append(s.segments[traceID], &spillSegment{path: path, size: size, bodies: true})
+}
+
+// has reports whether any of a trace's spans are on disk, or being written.
+func (s *spillStore) has(traceID string) bool {
+	return len(s.segments[traceID]) > 0
+}
+
+// take removes a trace's segments from the store, to be read back by
+// readSegments, which removes their files. The disk space they use is given
+// back now, or once they've been written.
+func (s *spillStore) take(traceID string) []*spillSegment {
+	segs := s.segments[traceID]
+	for _, seg := range segs {
+		if seg.done != nil {
+			seg.taken = true
+		} else {
+			s.used -= seg.size
+		}
+	}
+	delete(s.segments, traceID)
+	return segs
+}
+
+// readSegments reads back the spans of segments taken from the store, in the
+// order they were written, and removes their files, waiting for any that are
+// still being written. The full bodies of summarized spans are returned
+// separately, by BodyID.
+func readSegments(segs []*spillSegment) ([]*types.Span, map[uint64]*types.Span, error) {
+	var spans []*types.Span
+	var bodies map[uint64]*types.Span
+	var errs []error
+	for _, seg := range segs {
+		var segSpans []*types.Span
+		if seg.done != nil {
+			<-seg.done
+			if seg.path == "" {
+				segSpans = seg.spans
+			}
+		}
+		if segSpans == nil {
+			data, err := os.ReadFile(seg.path)
+			os.Remove(seg.path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			var spilled []spilledSpan
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&spilled); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for _, ss := range spilled {
+				segSpans = append(segSpans, ss.span())
+			}
+		}
+		for _, sp := range segSpans {
+			if !seg.bodies {
+				spans = append(spans, sp)
+				continue
+			}
+			if bodies == nil {
+				bodies = make(map[uint64]*types.Span)
+			}
+			bodies[sp.BodyID] = sp
+		}
+	}
+	return spans, bodies, errors.Join(errs...)
+}
+
+// remove removes the files of a trace's spans. Files still being written are
+// removed once they have been.
+func (s *spillStore) remove(traceID string) {
+	for _, seg := range s.take(traceID) {
+		if seg.done != nil {
+			seg.discard = true
+			continue
+		}
+		os.Remove(seg.path)
+	}
+}
+
+// len returns the number of traces with spans on disk.
+func (s *spillStore) len() int {
+	return len(s.segments)
+}
@@ -4,20 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/honeycombio/refinery/centralstore"
 	"github.com/honeycombio/refinery/collect/cache"
 	"github.com/honeycombio/refinery/collect/stressRelief"
 	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/generics"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/decisionexport"
+	"github.com/honeycombio/refinery/internal/dropaudit"
 	"github.com/honeycombio/refinery/internal/gossip"
 	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/membudget"
 	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/honeycombio/refinery/internal/supervisor"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/sample"
@@ -36,6 +45,24 @@ type Collector interface {
 	AddSpan(*types.Span) error
 	Stressed() bool
 	ProcessSpanImmediately(*types.Span) (bool, error)
+	// Saturation reports how full the incoming queue and memory are, each as
+	// a fraction of its limit. Memory is reported as 0 if there is no limit.
+	Saturation() (queue float64, memory float64)
+	// PreviewSample returns the decision the sampler for a trace would make
+	// about it, without acting on it.
+	PreviewSample(trace *types.Trace, selector string) (SamplePreview, error)
+	// LateSpanReports returns the counts of spans that arrived after their
+	// trace was decided, for each dataset and service.
+	LateSpanReports(top int) []LateSpanReport
+	// Evictions returns up to n of the most recent evictions from the trace
+	// cache, newest first.
+	Evictions(n int) []EvictionEvent
+	// InFlight returns the number of traces held by this node that are
+	// waiting to be decided and sent.
+	InFlight() int
+	// ForwardInFlight hands the traces held by this node to the rest of the
+	// cluster, returning the number of spans forwarded.
+	ForwardInFlight(ctx context.Context) (int, error)
 }
 
 func GetCollectorImplementation(c config.Config) Collector {
@@ -75,14 +102,22 @@ type CentralCollector struct {
 	SamplerFactory *sample.SamplerFactory      `inject:""`
 	Health         health.Recorder             `inject:""`
 	SpanCache      cache.SpanCache             `inject:""`
+	Supervisor     *supervisor.Supervisor      `inject:""`
 	Gossip         gossip.Gossiper             `inject:"gossip"`
+	DecisionExport decisionexport.Exporter     `inject:""`
+	DropAudit      dropaudit.Auditor           `inject:""`
+	IDGenerator    types.IDGenerator           `inject:""`
+	Budget         *membudget.Budget           `inject:""`
+	KeyValidator   *apikeys.Validator          `inject:""`
 
 	// whenever samplersByDestination is accessed, it should be protected by
 	// the mut mutex
 	mut                   sync.RWMutex
 	samplersByDestination map[string]sample.Sampler
 
-	incoming chan *types.Span
+	// incoming holds a queue for each worker; spans are queued for the
+	// worker that owns their trace's partition of the span cache
+	incoming []chan *types.Span
 	reload   chan struct{}
 
 	done         chan struct{}
@@ -99,25 +134,61 @@ type CentralCollector struct {
 
 	hostname string
 
+	// droppedTraces remembers recently dropped traces for late error
+	// recovery
+	droppedTraces droppedTraces
+
+	// lateSpans counts the spans that arrived after their trace was decided
+	lateSpans lateSpanAccounting
+
+	// evictions holds the most recent evictions from the trace cache
+	evictions evictionLog
+
+	// stressDecisions remembers the traces recently decided by stress
+	// relief, so that each decision is only exported once
+	stressDecisions *lru.Cache[string, struct{}]
+
+	// heapAlloc is the heap size last read, at heapReadAt (in Unix
+	// nanoseconds); see heapInUse
+	heapAlloc  atomic.Uint64
+	heapReadAt atomic.Int64
+
+	// lastOrphanCheck is when a kept trace was last checked for orphans (in
+	// Unix nanoseconds), if they're only being counted
+	lastOrphanCheck atomic.Int64
+
+	// readHeapStats reads the heap statistics used to pace sends; it's
+	// replaced in tests
+	readHeapStats func() heapStats
+
 	// test hooks
 	blockOnCollect bool
 	isTest         bool
 }
 
+// stressDecisionCacheSize is how many traces decided by stress relief are
+// remembered, so that their decisions are only exported once.
+const stressDecisionCacheSize = 10_000
+
 const (
 	receiverHealth = "receiver"
 	deciderHealth  = "decider"
 	senderHealth   = "sender"
+	queueHealth    = "collector_queue"
 	gossip_keep    = "keep"
 	gossip_drop    = "drop"
 )
 
 func (c *CentralCollector) Start() error {
+	c.Logger = logger.ForSubsystem(c.Logger, "collector")
+	c.stressDecisions, _ = lru.New[string, struct{}](stressDecisionCacheSize)
+
 	// call reload config and then get the updated unique fields
 	collectorCfg := c.Config.GetCollectionConfig()
 
 	// we're a health check reporter so register ourselves for each of our major routines
 	c.Health.Register(receiverHealth, time.Duration(5*collectorCfg.MemoryCycleDuration))
+	c.Health.Register(queueHealth, time.Duration(5*collectorCfg.MemoryCycleDuration))
 	c.Health.Register(deciderHealth, 5*collectorCfg.GetDeciderCycleDuration())
 
 	// the sender health check should only be run if we're using it
@@ -131,7 +202,12 @@ func (c *CentralCollector) Start() error {
 	c.Config.RegisterReloadCallback(c.sendReloadSignal)
 	c.StressRelief.UpdateFromConfig(c.Config.GetStressReliefConfig())
 
-	c.incoming = make(chan *types.Span, collectorCfg.GetIncomingQueueSize())
+	workers := collectorCfg.GetWorkers()
+	queueSize := (collectorCfg.GetIncomingQueueSize() + workers - 1) / workers
+	c.incoming = make([]chan *types.Span, workers)
+	for i := range c.incoming {
+		c.incoming[i] = make(chan *types.Span, queueSize)
+	}
 	c.reload = make(chan struct{}, 1)
 	c.samplersByDestination = make(map[string]sample.Sampler)
 
@@ -147,24 +223,57 @@ func (c *CentralCollector) Start() error {
 	c.Metrics.Register("collector_sender_batch_count", "histogram")
 	c.Metrics.Register("collector_decider_batch_count", "histogram")
 	c.Metrics.Register("trace_send_kept", "counter")
+	metrics.RegisterLabeled(c.Metrics, "trace_send_kept_by_dataset", "counter", []string{metrics.DimensionDataset})
 	c.Metrics.Register("trace_send_kept_sample_rate", "histogram")
 	c.Metrics.Register("trace_duration_ms", "histogram")
 	c.Metrics.Register("trace_span_count", "histogram")
+	c.Metrics.Register("trace_spans_reduced", "counter")
+	c.Metrics.Register("trace_orphan_checks", "counter")
+	c.Metrics.Register("trace_orphan_spans", "counter")
+	c.Metrics.Register("trace_reparented_spans", "counter")
+	c.Metrics.Register("trace_missing_root", "counter")
+	c.Metrics.Register("trace_synthetic_roots", "counter")
+	c.Metrics.Register("trace_late_errors_recovered", "counter")
+	c.Metrics.Register("trace_late_error_siblings_sent", "counter")
+	c.Metrics.Register("late_error_dropped_traces", "gauge")
+	c.Metrics.Register("trace_late_spans_kept", "counter")
+	c.Metrics.Register("trace_late_spans_dropped", "counter")
+	c.Metrics.Register("trace_late_span_lateness_ms", "histogram")
 	c.Metrics.Register("trace_decision_kept", "counter")
 	c.Metrics.Register("trace_decision_dropped", "counter")
+	c.Metrics.Register("trace_decision_coarsened", "counter")
+	c.Metrics.Register("trace_decision_dry_run", "counter")
 	c.Metrics.Register("trace_decision_has_root", "counter")
 	c.Metrics.Register("trace_decision_no_root", "counter")
 	c.Metrics.Register("collector_incoming_queue", "histogram")
 	c.Metrics.Register("collector_incoming_queue_length", "gauge")
+	for i := range c.incoming {
+		c.Metrics.Register(workerQueueMetric(i), "gauge")
+	}
 	c.Metrics.Register("collector_cache_size", "gauge")
+	c.Metrics.Register("collector_traces_spilled", "counter")
+	for _, reason := range evictionReasons {
+		c.Metrics.Register("collector_evictions_"+reason, "counter")
+	}
+	c.Metrics.Register("collector_eviction_trace_age_ms", "histogram")
+	c.Metrics.Register("collector_eviction_span_count", "histogram")
+	c.Metrics.Register("trace_limit_reached", "counter")
+	c.Metrics.Register("trace_limit_decided", "counter")
+	c.Metrics.Register("trace_limit_spans_truncated", "counter")
+	c.Metrics.Register("trace_limit_spans_summarized", "counter")
 	c.Metrics.Register("memory_heap_allocation", "gauge")
 	c.Metrics.Register("span_received", "counter")
 	c.Metrics.Register("span_processed", "counter")
+	c.Metrics.Register("span_duplicates_dropped", "counter")
+	c.Metrics.Register("span_summarized", "counter")
 	c.Metrics.Register("spans_waiting", "updown")
 	c.Metrics.Register("dropped_from_stress", "counter")
 	c.Metrics.Register("kept_from_stress", "counter")
 	c.Metrics.Register("collector_keep_trace", "counter")
 	c.Metrics.Register("collector_drop_trace", "counter")
+	c.Metrics.Register("collector_send_pacing_ms", "histogram")
+	c.Metrics.Register("collector_send_pacing_gc_waits", "counter")
+	c.Metrics.Register("collector_send_pacing_gc_timeouts", "counter")
 	c.Metrics.Register("collector_decide_trace", "counter")
 	c.Metrics.Register("decider_decided_per_second", "histogram")
 	c.Metrics.Register("decider_considered_per_second", "histogram")
@@ -173,24 +282,43 @@ func (c *CentralCollector) Start() error {
 	c.Metrics.Register("collector_sender_runs", "counter")
 	c.Metrics.Register("collector_decider_runs", "counter")
 	c.Metrics.Register("collector_cleanup_runs", "counter")
+	c.Metrics.Register("collector_snapshot_restored_spans", "gauge")
 
-	if c.Config.GetAddHostMetadataToTrace() {
+	if c.Config.GetAddHostMetadataToTrace() || c.Config.GetAddDecisionToSpans() {
 		if hostname, err := os.Hostname(); err == nil && hostname != "" {
 			c.hostname = hostname
 		}
 	}
-	c.Metrics.Store("INCOMING_CAP", float64(cap(c.incoming)))
+	// the queue length that's reported is the longest worker's, so the
+	// capacity is a worker's
+	c.Metrics.Store("INCOMING_CAP", float64(queueSize))
+
+	// pick up the traces that were being collected before the last shutdown
+	if c.Config.GetStateSnapshotConfig().Enabled {
+		restored, err := c.restoreSnapshot()
+		if err != nil {
+			c.Logger.Warn().Logf("unable to restore trace snapshot: %s", err)
+		}
+		c.Metrics.Gauge("collector_snapshot_restored_spans", restored)
+		if restored > 0 {
+			c.Logger.Info().Logf("restored %d spans from trace snapshot", restored)
+		}
+	}
 
-	// spin up one collector because this is a single threaded collector
+	// spin up a worker for each partition of the span cache
 	c.eg = &errgroup.Group{}
-	c.eg.Go(c.receive)
-	c.eg.Go(c.decide)
+	c.eg.Go(c.Supervisor.Wrap("collector_receive", c.receive))
+	for i := range c.incoming {
+		i := i
+		c.eg.Go(c.Supervisor.Wrap("collector_worker", func() error { return c.work(i) }))
+	}
+	c.eg.Go(c.Supervisor.Wrap("collector_decide", c.decide))
 	if collectorCfg.UseDecisionGossip {
-		c.eg.Go(c.cleanup)
+		c.eg.Go(c.Supervisor.Wrap("collector_cleanup", c.cleanup))
 	} else {
-		c.eg.Go(c.send)
+		c.eg.Go(c.Supervisor.Wrap("collector_send", c.send))
 	}
-	c.eg.Go(func() error {
+	c.eg.Go(c.Supervisor.Wrap("collector_metrics", func() error {
 		return c.metricsCycle.Run(context.Background(), func(ctx context.Context) error {
 			if err := c.Store.RecordMetrics(ctx); err != nil {
 				c.Logger.Error().Logf("error recording metrics: %s", err)
@@ -198,7 +326,7 @@ func (c *CentralCollector) Start() error {
 
 			return nil
 		})
-	})
+	}))
 
 	// do we need these to be configurable?
 	maxTime := time.Duration(collectorCfg.AggregationInterval)
@@ -220,8 +348,8 @@ func (c *CentralCollector) Start() error {
 	c.keepChan = c.Gossip.Subscribe(gossip_keep, maxCount)
 	c.dropChan = c.Gossip.Subscribe(gossip_drop, maxCount)
 
-	go c.aggregateTraceIDChannel(c.keepChan, c.keepTraces, maxTime, maxCount)
-	go c.aggregateTraceIDChannel(c.dropChan, c.dropTraces, maxTime, maxCount)
+	c.Supervisor.Go("collector_keep_aggregator", func() { c.aggregateTraceIDChannel(c.keepChan, c.keepTraces, maxTime, maxCount) })
+	c.Supervisor.Go("collector_drop_aggregator", func() { c.aggregateTraceIDChannel(c.dropChan, c.dropTraces, maxTime, maxCount) })
 
 	return nil
 }
@@ -229,11 +357,18 @@ func (c *CentralCollector) Start() error {
 // Stop will be called when the refinery is shutting down.
 func (c *CentralCollector) Stop() error {
 	close(c.done)
-	close(c.incoming)
+	for _, ch := range c.incoming {
+		close(ch)
+	}
 	close(c.reload)
 	if err := c.eg.Wait(); err != nil {
 		c.Logger.Error().Logf("error waiting for goroutines to finish: %s", err)
 	}
+	c.mut.RLock()
+	for _, sampler := range c.samplersByDestination {
+		sample.StopSampler(sampler)
+	}
+	c.mut.RUnlock()
 
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, c.Config.GetCollectionConfig().GetShutdownDelay())
@@ -241,6 +376,7 @@ func (c *CentralCollector) Stop() error {
 
 	// we have to make sure the health check says we're alive but not accepting data during shutdown
 	c.Health.Unregister(receiverHealth)
+	c.Health.Unregister(queueHealth)
 	c.Health.Unregister(deciderHealth)
 	// reregister the sender health check to a much longer time so we can finish sending traces
 	c.Health.Register(senderHealth, 5*time.Second)
@@ -257,7 +393,8 @@ func (c *CentralCollector) Stop() error {
 // trace decisions made for the remaining traces in the cache.
 //
 // After the sender cycle is finished, it also uploads all the
-// remaining traces in the cache to the central store.
+// remaining traces in the cache to the central store, unless they can be
+// written to a snapshot to be restored when refinery starts again.
 //
 // The shutdown process is expected to finish within the shutdown delay.
 // Half of the shutdown delay is used for the sender cycle and the
@@ -299,53 +436,19 @@ func (c *CentralCollector) shutdown(ctx context.Context) error {
 	}
 	defer close(done)
 
-	ctxForward, spanForward := otelutil.StartSpanWith(ctx, c.Tracer, "CentralCollector.shutdown.forward", "span_cache_len", c.SpanCache.Len())
-	defer spanForward.End()
-
-	// send the remaining traces to the central store
-	ids := c.SpanCache.GetTraceIDs(c.SpanCache.Len())
-	var sentCount int
-	defer func() {
-		c.Logger.Info().Logf("sent %d traces to central store during shutdown", sentCount)
-		otelutil.AddSpanField(spanForward, "sent_count", sentCount)
-	}()
-
-	for _, id := range ids {
-		trace := c.SpanCache.Get(id)
-
-		for _, sp := range trace.GetSpans() {
-			// send the spans to the central store
-			cs := &centralstore.CentralSpan{
-				TraceID:   id,
-				SpanID:    sp.ID,
-				Type:      sp.Type(),
-				AllFields: sp.Data,
-				IsRoot:    sp.IsRoot,
-			}
-
-			cs.SetSamplerSelector(trace.GetSamplerSelector(c.Config.GetDatasetPrefix()))
-			err := c.Store.WriteSpan(ctxForward, cs)
-			if err != nil {
-				logField := logrus.Fields{
-					"span_id":  sp.ID,
-					"trace_id": id,
-				}
-				spanForward.RecordError(err)
-				c.Logger.Error().WithFields(logField).Logf("error sending span during shutdown: %s", err)
-			}
-			sentCount++
-			// if the context deadline is exceeded, that means we are
-			// about to exceed the shutdown delay, so we should stop
-			// sending traces to the central store. Unfortunately, the
-			// remaining traces will be lost.
-			if errors.Is(err, context.DeadlineExceeded) {
-				spanForward.RecordError(err)
-				return err
-			}
+	if c.Config.GetStateSnapshotConfig().Enabled {
+		numTraces, err := c.writeSnapshot(ctx)
+		if err == nil {
+			c.Logger.Info().Logf("wrote %d traces to snapshot during shutdown", numTraces)
+			return nil
 		}
+		c.Logger.Error().Logf("error writing trace snapshot during shutdown, forwarding remaining spans: %s", err)
 	}
 
-	return nil
+	// send the remaining traces to the central store
+	sentCount, err := c.forwardTraces(ctx, "shutdown")
+	c.Logger.Info().Logf("sent %d traces to central store during shutdown", sentCount)
+	return err
 }
 
 // ProcessSpanImmediately determines if this trace should be part of the deterministic sample.
@@ -384,19 +487,51 @@ func (c *CentralCollector) ProcessSpanImmediately(sp *types.Span) (bool, error)
 		return true, err
 	}
 
+	selector := sp.Environment
+	if types.IsLegacyAPIKey(sp.APIKey) {
+		selector = sp.Dataset
+		if prefix := c.Config.GetDatasetPrefix(); prefix != "" {
+			selector = prefix + "." + sp.Dataset
+		}
+	}
+	// every span of the trace gets the same decision, but it's only
+	// published the first time this node makes it
+	alreadyDecided, _ := c.stressDecisions.ContainsOrAdd(sp.TraceID, struct{}{})
+	if !alreadyDecided {
+		c.DecisionExport.Export(decisionexport.Decision{
+			TraceID:   sp.TraceID,
+			Dataset:   selector,
+			Kept:      keep,
+			Rate:      rate,
+			Rule:      reason,
+			Timestamp: c.Clock.Now(),
+		})
+	}
+
 	if !keep {
 		c.Metrics.Increment("dropped_from_stress")
+		if !alreadyDecided {
+			c.DropAudit.RecordDrop(selector, reason, sp.TraceID)
+		}
 		return true, nil
 	}
 	c.Metrics.Increment("kept_from_stress")
 
 	sp.Event.Data["meta.stressed"] = true
-	if c.Config.GetAddRuleReasonToTrace() {
+	addDecision := c.Config.GetAddDecisionToSpans()
+	if c.Config.GetAddRuleReasonToTrace() || addDecision {
 		sp.Event.Data["meta.refinery.reason"] = reason
 	}
-	if c.hostname != "" {
+	if c.hostname != "" && c.Config.GetAddHostMetadataToTrace() {
 		sp.Data["meta.refinery.host.name"] = c.hostname
 	}
+	if addDecision {
+		sp.Data["meta.refinery.sample_rate"] = rate
+		if c.hostname != "" {
+			sp.Data["meta.refinery.decider.host.name"] = c.hostname
+		}
+	}
+	config.StripScopedAttributes(sp.Data)
 	c.addAdditionalAttributes(sp)
 	mergeTraceAndSpanSampleRates(sp, rate)
 	c.Transmission.EnqueueSpan(sp)
@@ -407,7 +542,7 @@ func (c *CentralCollector) ProcessSpanImmediately(sp *types.Span) (bool, error)
 // implement the Collector interface
 func (c *CentralCollector) AddSpan(span *types.Span) error {
 	select {
-	case c.incoming <- span:
+	case c.incoming[cache.Partition(span.TraceID, len(c.incoming))] <- span:
 		c.Metrics.Increment("span_received")
 		c.Metrics.Up("spans_waiting")
 		return nil
@@ -416,6 +551,8 @@ func (c *CentralCollector) AddSpan(span *types.Span) error {
 	}
 }
 
+// receive handles the collector's memory checks and config reloads; the
+// workers process the incoming spans.
 func (c *CentralCollector) receive() error {
 	tickerDuration := time.Duration(c.Config.GetCollectionConfig().MemoryCycleDuration)
 	if tickerDuration <= 0 {
@@ -429,11 +566,9 @@ func (c *CentralCollector) receive() error {
 	}
 
 	for {
-		// record channel lengths as histogram but also as gauges
-		c.Metrics.Histogram("collector_incoming_queue", float64(len(c.incoming)))
-		c.Metrics.Gauge("collector_incoming_queue_length", float64(len(c.incoming)))
 		c.Metrics.Increment("collector_receiver_runs")
 		c.Health.Ready(receiverHealth, true)
+		c.reportQueueHealth()
 
 		select {
 		case <-c.done:
@@ -441,19 +576,51 @@ func (c *CentralCollector) receive() error {
 		case <-memTicker.Chan():
 			_, span := otelutil.StartSpanMulti(context.Background(), c.Tracer, "CentralCollector.receive",
 				map[string]interface{}{
-					"incoming_queue_length": len(c.incoming),
+					"incoming_queue_length": c.incomingQueueLength(),
 					"select":                "checkAlloc",
 				})
 			c.checkAlloc()
 			span.End()
-		case sp, ok := <-c.incoming:
+		case <-c.reload:
+			_, span := otelutil.StartSpanMulti(context.Background(), c.Tracer, "CentralCollector.receive",
+				map[string]interface{}{
+					"incoming_queue_length": c.incomingQueueLength(),
+					"select":                "reload",
+				})
+			c.reloadConfig()
+			span.End()
+		}
+	}
+
+}
+
+// work processes the spans queued for one worker until the collector stops.
+// Every span of a trace is queued for the same worker, so the spans of a
+// trace are processed in order.
+func (c *CentralCollector) work(worker int) error {
+	if c.blockOnCollect {
+		return nil
+	}
+
+	incoming := c.incoming[worker]
+	for {
+		// record channel lengths as histogram but also as gauges
+		c.Metrics.Histogram("collector_incoming_queue", float64(len(incoming)))
+		c.Metrics.Gauge(workerQueueMetric(worker), float64(len(incoming)))
+		c.Metrics.Gauge("collector_incoming_queue_length", float64(c.incomingQueueLength()))
+		c.Health.Ready(receiverHealth, true)
+
+		select {
+		case <-c.done:
+			return nil
+		case sp, ok := <-incoming:
 			if !ok {
 				return nil
 			}
-			_, span := otelutil.StartSpanMulti(context.Background(), c.Tracer, "CentralCollector.receive",
+			_, span := otelutil.StartSpanMulti(context.Background(), c.Tracer, "CentralCollector.work",
 				map[string]interface{}{
-					"incoming_queue_length": len(c.incoming),
-					"select":                "incoming",
+					"incoming_queue_length": len(incoming),
+					"worker":                worker,
 				})
 			err := c.processSpan(sp)
 			if err != nil {
@@ -461,17 +628,47 @@ func (c *CentralCollector) receive() error {
 				c.Logger.Error().Logf("error processing span: %s", err)
 			}
 			span.End()
-		case <-c.reload:
-			_, span := otelutil.StartSpanMulti(context.Background(), c.Tracer, "CentralCollector.receive",
-				map[string]interface{}{
-					"incoming_queue_length": len(c.incoming),
-					"select":                "reload",
-				})
-			c.reloadConfig()
-			span.End()
 		}
 	}
+}
+
+// workerQueueMetric names the metric for the length of a worker's queue.
+func workerQueueMetric(worker int) string {
+	return "collector_worker_" + strconv.Itoa(worker) + "_queue_length"
+}
+
+// incomingQueueLength returns the length of the longest worker's queue; when
+// it's full, spans for that worker's traces are refused.
+func (c *CentralCollector) incomingQueueLength() int {
+	var longest int
+	for _, ch := range c.incoming {
+		longest = max(longest, len(ch))
+	}
+	return longest
+}
+
+// queueDegradedFraction is how full the fullest incoming queue can get before
+// the queue is reported as degraded.
+const queueDegradedFraction = 0.8
 
+// reportQueueHealth reports the incoming queues as degraded once the fullest
+// of them is nearly full, and as failed once it's full, since spans sent to
+// it are then refused.
+func (c *CentralCollector) reportQueueHealth() {
+	if len(c.incoming) == 0 || cap(c.incoming[0]) == 0 {
+		c.Health.Ready(queueHealth, true)
+		return
+	}
+	length, capacity := c.incomingQueueLength(), cap(c.incoming[0])
+	detail := fmt.Sprintf("fullest worker queue has %d of %d spans", length, capacity)
+	switch {
+	case length >= capacity:
+		c.Health.Report(queueHealth, health.StatusFailed, detail)
+	case float64(length) >= queueDegradedFraction*float64(capacity):
+		c.Health.Report(queueHealth, health.StatusDegraded, detail)
+	default:
+		c.Health.Ready(queueHealth, true)
+	}
 }
 
 func (c *CentralCollector) send() error {
@@ -513,15 +710,15 @@ func (c *CentralCollector) sendTraces(ctx context.Context) error {
 		return err
 	}
 
+	kept := make([]*centralstore.CentralTraceStatus, 0, len(statuses))
 	for _, status := range statuses {
 		switch status.State {
 		case centralstore.DecisionKeep:
-			c.sendSpans(status)
-			c.SpanCache.Remove(status.TraceID)
-			tracesConsidered++
-			c.Metrics.Increment("collector_keep_trace")
+			kept = append(kept, status)
 
 		case centralstore.DecisionDrop:
+			c.countDroppedLateSpans(status.TraceID, status.Timestamp)
+			c.recoverLateErrors(status.TraceID, status.Timestamp)
 			c.SpanCache.Remove(status.TraceID)
 			tracesConsidered++
 			c.Metrics.Increment("collector_drop_trace")
@@ -537,6 +734,16 @@ func (c *CentralCollector) sendTraces(ctx context.Context) error {
 		}
 	}
 
+	// kept traces are spread over half of the cycle, leaving the rest of it
+	// for the next batch of IDs to be fetched
+	window := c.Config.GetCollectionConfig().GetSenderCycleDuration() / 2
+	c.paceSends(ctx, len(kept), window, func(i int) {
+		c.sendSpans(ctx, kept[i])
+		c.SpanCache.Remove(kept[i].TraceID)
+		tracesConsidered++
+		c.Metrics.Increment("collector_keep_trace")
+	})
+
 	return nil
 }
 
@@ -623,7 +830,7 @@ func (c *CentralCollector) keepTraces(ids []string) []string {
 
 	idset := generics.NewSet(ids...)
 	for _, status := range statuses {
-		c.sendSpans(status)
+		c.sendSpans(ctx, status)
 		c.SpanCache.Remove(status.TraceID)
 		idset.Remove(status.TraceID)
 		c.Metrics.Increment("collector_keep_trace")
@@ -637,6 +844,7 @@ func (c *CentralCollector) dropTraces(ids []string) []string {
 	_, span := otelutil.StartSpanWith(context.Background(), c.Tracer, "CentralCollector.dropTraces", "num_ids", len(ids))
 	defer span.End()
 	for _, traceID := range ids {
+		c.recoverLateErrors(traceID, c.Clock.Now())
 		c.SpanCache.Remove(traceID)
 		c.Metrics.Increment("collector_drop_trace")
 	}
@@ -684,12 +892,14 @@ func (c *CentralCollector) cleanupTraces(ctx context.Context) {
 	for _, status := range statuses {
 		switch status.State {
 		case centralstore.DecisionKeep:
-			c.sendSpans(status)
+			c.sendSpans(ctx, status)
 			c.SpanCache.Remove(status.TraceID)
 			tracesConsidered++
 			c.Metrics.Increment("collector_keep_trace")
 
 		case centralstore.DecisionDrop:
+			c.countDroppedLateSpans(status.TraceID, status.Timestamp)
+			c.recoverLateErrors(status.TraceID, status.Timestamp)
 			c.SpanCache.Remove(status.TraceID)
 			tracesConsidered++
 			c.Metrics.Increment("collector_drop_trace")
@@ -786,13 +996,14 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 
 	ctxTraces, spanTraces := otelutil.StartSpanWith(ctx, c.Tracer, "CentralCollector.makeDecision.traceLoop", "num_traces", len(traces))
 	defer spanTraces.End()
+	decisions := make([]decisionexport.Decision, 0, len(traces))
 	for _, trace := range traces {
 		if trace == nil {
 			continue
 		}
 		tracesConsidered++
 
-		_, span := otelutil.StartSpan(ctxTraces, c.Tracer, "CentralCollector.makeDecision.trace")
+		ctxTrace, span := otelutil.StartSpan(ctxTraces, c.Tracer, "CentralCollector.makeDecision.trace")
 
 		if trace.Root != nil {
 			c.Metrics.Increment("trace_decision_has_root")
@@ -800,9 +1011,6 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 			c.Metrics.Increment("trace_decision_no_root")
 		}
 
-		var sampler sample.Sampler
-		var found bool
-
 		// get sampler key (dataset for legacy keys, environment for new keys)
 		selector := stateMap[trace.TraceID].SamplerSelector
 		logFields := logrus.Fields{
@@ -811,15 +1019,7 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 		}
 
 		// use sampler key to find sampler; create and cache if not found
-		c.mut.RLock()
-		sampler, found = c.samplersByDestination[selector]
-		c.mut.RUnlock()
-		if !found {
-			sampler = c.SamplerFactory.GetSamplerImplementationForKey(selector)
-			c.mut.Lock()
-			c.samplersByDestination[selector] = sampler
-			c.mut.Unlock()
-		}
+		sampler := c.getSampler(selector)
 
 		status, ok := stateMap[trace.TraceID]
 		if !ok {
@@ -827,13 +1027,22 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 			continue
 		}
 
-		tr := &traceForDecision{
+		tr := c.wrapForDecision(&traceForDecision{
 			CentralTrace:    trace,
 			descendantCount: status.DescendantCount(),
-		}
+		})
 
 		// make sampling decision and update the trace
+		_, spanSample := otelutil.StartSpanWith(ctxTrace, c.Tracer, "Sampler.GetSampleRate", "sampler_selector", selector)
 		rate, shouldSend, reason, key := sampler.GetSampleRate(tr)
+		spanSample.End()
+		// under stress, graduated degradation may keep fewer of the traces
+		// the rules would keep
+		if newRate, newKeep, coarsened := c.StressRelief.CoarsenDecision(trace.TraceID, rate, shouldSend); coarsened {
+			rate, shouldSend = newRate, newKeep
+			reason = "stress_relief/graduated/" + reason
+			c.Metrics.Increment("trace_decision_coarsened")
+		}
 		otelutil.AddSpanFields(span, map[string]interface{}{
 			"trace_id": trace.TraceID,
 			"rate":     rate,
@@ -848,6 +1057,7 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 		// This will observe sample rate attempts even if the trace is dropped
 		c.Metrics.Histogram("trace_aggregate_sample_rate", float64(rate))
 		tracesDecided++
+		c.SamplerFactory.RecordDecision(selector, shouldSend)
 
 		if !shouldSend {
 			c.Metrics.Increment("trace_decision_dropped")
@@ -873,6 +1083,15 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 			status.Metadata["meta.refinery.decider.host.name"] = c.hostname
 		}
 
+		// a dry run rule doesn't change the decision, but what it would
+		// have decided is added to the trace so the rule can be evaluated
+		if tr.Matched {
+			c.Metrics.Increment("trace_decision_dry_run")
+			status.Metadata["meta.refinery.dryrun.kept"] = tr.Keep
+			status.Metadata["meta.refinery.dryrun.sample_rate"] = tr.Rate
+			status.Metadata["meta.refinery.dryrun.reason"] = tr.Reason
+		}
+
 		var state centralstore.CentralTraceState
 		if shouldSend {
 			state = centralstore.DecisionKeep
@@ -881,10 +1100,19 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 		} else {
 			state = centralstore.DecisionDrop
 			c.Gossip.Publish(gossip_drop, []byte(trace.TraceID))
+			c.DropAudit.RecordDrop(selector, reason, trace.TraceID)
 		}
 		status.State = state
 		status.Rate = rate
 		stateMap[status.TraceID] = status
+		decisions = append(decisions, decisionexport.Decision{
+			TraceID:   trace.TraceID,
+			Dataset:   selector,
+			Kept:      shouldSend,
+			Rate:      rate,
+			Rule:      reason,
+			Timestamp: c.Clock.Now(),
+		})
 		c.Metrics.Increment("collector_decide_trace")
 		span.End()
 	}
@@ -897,7 +1125,55 @@ func (c *CentralCollector) makeDecisions(ctx context.Context) error {
 		updatedStatuses = append(updatedStatuses, status)
 	}
 
-	return c.Store.SetTraceStatuses(ctx, updatedStatuses)
+	if err := c.Store.SetTraceStatuses(ctx, updatedStatuses); err != nil {
+		return err
+	}
+
+	// only publish decisions once they've been recorded in the central store
+	for _, d := range decisions {
+		c.DecisionExport.Export(d)
+	}
+	return nil
+}
+
+// samplerSelector returns the selector of the sampler for a trace: its
+// dataset for legacy keys or environment for new ones, qualified by tenant if
+// its API key belongs to one.
+func (c *CentralCollector) samplerSelector(trace *types.Trace) string {
+	selector := trace.GetSamplerSelector(c.Config.GetDatasetPrefix())
+	if tenant := c.tenantForAPIKey(trace.APIKey); tenant != "" {
+		selector = config.TenantSelector(tenant, selector)
+	}
+	return selector
+}
+
+// tenantForAPIKey returns the tenant that an API key belongs to, either by
+// itself or through its team. A key's team is only known once the router has
+// looked the key up, which it does for keys it validates and for new keys
+// whose environment it needs.
+func (c *CentralCollector) tenantForAPIKey(apiKey string) string {
+	if tenant := c.Config.GetTenantForAPIKey(apiKey); tenant != "" || apiKey == "" {
+		return tenant
+	}
+	if c.KeyValidator == nil {
+		return ""
+	}
+	return c.Config.GetTenantForTeam(c.KeyValidator.Team(context.Background(), apiKey))
+}
+
+// getSampler returns the sampler for a selector, creating it if it's the
+// first time the selector has been seen since the config was loaded.
+func (c *CentralCollector) getSampler(selector string) sample.Sampler {
+	c.mut.RLock()
+	sampler, found := c.samplersByDestination[selector]
+	c.mut.RUnlock()
+	if !found {
+		sampler = c.SamplerFactory.GetSamplerImplementationForKey(selector)
+		c.mut.Lock()
+		c.samplersByDestination[selector] = sampler
+		c.mut.Unlock()
+	}
+	return sampler
 }
 
 func (c *CentralCollector) processSpan(sp *types.Span) error {
@@ -906,6 +1182,20 @@ func (c *CentralCollector) processSpan(sp *types.Span) error {
 		c.Metrics.Down("spans_waiting")
 	}()
 
+	// only this worker adds spans to the trace, so it can't be created
+	// between looking for duplicates and adding the span
+	dedup := c.Config.GetSpanDedupConfig()
+	var spanHash uint64
+	var newTrace bool
+	if dedup.Enabled {
+		spanHash = spanDedupHash(sp, dedup.IgnoredFields, c.Config.GetSpanIdFieldNames())
+		existing := c.SpanCache.Get(sp.TraceID)
+		if c.isDuplicateSpan(existing, spanHash) {
+			return nil
+		}
+		newTrace = existing == nil
+	}
+
 	err := c.SpanCache.Set(sp)
 	if err != nil {
 		c.Logger.Error().WithField("trace_id", sp.TraceID).Logf("error adding span to cache: %s", err)
@@ -913,6 +1203,9 @@ func (c *CentralCollector) processSpan(sp *types.Span) error {
 	}
 
 	trace := c.SpanCache.Get(sp.TraceID)
+	if newTrace {
+		trace.SeenSpan(spanHash, dedup.FilterBits)
+	}
 
 	// construct a central store span
 	cs := &centralstore.CentralSpan{
@@ -923,21 +1216,13 @@ func (c *CentralCollector) processSpan(sp *types.Span) error {
 	}
 	cs.Type = sp.Type()
 
-	selector := trace.GetSamplerSelector(c.Config.GetDatasetPrefix())
+	selector := c.samplerSelector(trace)
 	cs.SetSamplerSelector(selector)
 	if selector == "" {
 		c.Logger.Error().WithField("trace_id", trace.ID()).Logf("error getting sampler selection key for trace")
 	}
 
-	c.mut.RLock()
-	sampler, found := c.samplersByDestination[selector]
-	c.mut.RUnlock()
-	if !found {
-		sampler = c.SamplerFactory.GetSamplerImplementationForKey(selector)
-		c.mut.Lock()
-		c.samplersByDestination[selector] = sampler
-		c.mut.Unlock()
-	}
+	sampler := c.getSampler(selector)
 
 	// extract all key fields from the span
 	keyFields := sampler.GetKeyFields()
@@ -946,10 +1231,84 @@ func (c *CentralCollector) processSpan(sp *types.Span) error {
 			cs.KeyFields[keyField] = val
 		}
 	}
+	if slices.Contains(keyFields, config.ParentIDField) {
+		c.recordSpanIDs(cs.KeyFields, sp)
+	}
+	// the randomness of consistent sampling is needed to make the decision
+	if c.Config.GetConsistentSamplingConfig().Enabled {
+		if val, ok := sp.Data[sample.OTelRandomnessField]; ok {
+			cs.KeyFields[sample.OTelRandomnessField] = val
+		}
+	}
+
+	cs.ChildCount, cs.HasChildCount = childCountHint(sp.Data, c.Config.GetChildCountFieldNames())
 
 	// send the span to the central store
 	ctx := context.Background()
-	return c.Store.WriteSpan(ctx, cs)
+	if err := c.Store.WriteSpan(ctx, cs); err != nil {
+		return err
+	}
+	c.summarizeSpan(sp, selector, keyFields)
+	return c.enforceTraceLimits(ctx, trace, selector)
+}
+
+// idFieldNames returns the fields that hold the trace, span, and parent IDs
+// of the spans in a dataset, taking its DatasetRules into account. By the
+// time spans reach the collector, the router has applied any ID transforms,
+// so only the field names matter here.
+func (c *CentralCollector) idFieldNames(dataset string) (traceIDFields, spanIDFields, parentIDFields []string) {
+	rules := c.Config.GetIDFieldRules(dataset)
+	return rules.TraceNames, c.Config.GetSpanIdFieldNames(), rules.ParentNames
+}
+
+// recordSpanIDs records a span's ID and parent ID in its key fields under
+// config.SpanIDField and config.ParentIDField, which is where the computed
+// fields that follow the shape of a trace read them, wherever the span's
+// dataset keeps them.
+func (c *CentralCollector) recordSpanIDs(keyFields map[string]interface{}, sp *types.Span) {
+	_, spanIDFields, parentIDFields := c.idFieldNames(sp.Dataset)
+	if id, _ := firstStringField(sp.Data, spanIDFields); id != "" {
+		keyFields[config.SpanIDField] = id
+	}
+	if parent, _ := firstStringField(sp.Data, parentIDFields); parent != "" {
+		keyFields[config.ParentIDField] = parent
+	}
+}
+
+// childCountHint returns the number of direct children the span says it
+// has, from the first of the given fields that holds a non-negative number.
+// Counts too large for a uint32 are capped at its maximum. Span links use the
+// same fields to carry the count for the span they're attached to.
+func childCountHint(data map[string]interface{}, fields []string) (uint32, bool) {
+	for _, field := range fields {
+		switch v := data[field].(type) {
+		case int:
+			if v >= 0 {
+				return saturateUint32(uint64(v)), true
+			}
+		case int64:
+			if v >= 0 {
+				return saturateUint32(uint64(v)), true
+			}
+		case uint64:
+			return saturateUint32(v), true
+		case float64:
+			if v >= math.MaxUint32 {
+				return math.MaxUint32, true
+			}
+			if v >= 0 {
+				return uint32(v), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func saturateUint32(v uint64) uint32 {
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
 }
 
 func (c *CentralCollector) checkAlloc() {
@@ -962,21 +1321,61 @@ func (c *CentralCollector) checkAlloc() {
 	// Manually GC here - so we can get a more accurate picture of memory usage
 	runtime.GC()
 	runtime.ReadMemStats(&mem)
+	c.heapAlloc.Store(mem.Alloc)
+	c.heapReadAt.Store(c.Clock.Now().UnixNano())
 	c.Metrics.Gauge("memory_heap_allocation", int64(mem.Alloc))
-	if maxAlloc == 0 || mem.Alloc < uint64(maxAlloc) {
+
+	var totalToRemove uint64
+	reason := EvictionMemory
+	if maxAlloc > 0 && mem.Alloc >= uint64(maxAlloc) {
+		// Figure out what fraction of the total cache we should remove. We'd like it to be
+		// enough to get us below the max capacity, but not TOO much below.
+		// Because our impact numbers are only the data size, reducing by enough to reach
+		// max alloc will actually do more than that.
+		totalToRemove = mem.Alloc - uint64(maxAlloc)
+	}
+	// with a memory budget, the trace cache also has to fit its own
+	// allowance, which is measured rather than guessed from the heap; the
+	// heap check stays as a backstop for memory the budget doesn't meter
+	if allocation, ok := c.Budget.Allocation(membudget.TraceCache); ok && uint64(allocation.Over()) > totalToRemove {
+		totalToRemove = uint64(allocation.Over())
+		reason = EvictionBudget
+	}
+	if totalToRemove == 0 {
 		return
 	}
-
-	// Figure out what fraction of the total cache we should remove. We'd like it to be
-	// enough to get us below the max capacity, but not TOO much below.
-	// Because our impact numbers are only the data size, reducing by enough to reach
-	// max alloc will actually do more than that.
-	totalToRemove := mem.Alloc - uint64(maxAlloc)
 	totalTraces := c.SpanCache.Len()
 	c.Metrics.Gauge("collector_cache_size", totalTraces)
 
 	percentage := float64(totalToRemove) / float64(totalTraces)
 	traceIDs := c.SpanCache.GetHighImpactTraceIDs(percentage)
+	victims := make([]EvictionEvent, 0, len(traceIDs))
+	for _, id := range traceIDs {
+		if trace := c.SpanCache.Get(id); trace != nil {
+			victims = append(victims, c.evictionProfile(trace, reason))
+		}
+	}
+
+	// traces that can be written to disk don't need to be decided early
+	numToRemove := len(traceIDs)
+	traceIDs = c.SpanCache.Spill(traceIDs)
+	notSpilled := generics.NewSet(traceIDs...)
+	for _, ev := range victims {
+		if !notSpilled.Contains(ev.TraceID) {
+			ev.Reason = EvictionSpilled
+		}
+		c.recordEviction(ev)
+	}
+	if numSpilled := numToRemove - len(traceIDs); numSpilled > 0 {
+		c.Metrics.Count("collector_traces_spilled", numSpilled)
+		c.Logger.Warn().
+			WithField("alloc", mem.Alloc).
+			WithField("num_traces_spilled", numSpilled).
+			Logf("writing large traces to disk due to memory overage")
+		if len(traceIDs) == 0 {
+			return
+		}
+	}
 
 	ctx := context.Background()
 	totalDataSizeSent := 0
@@ -1019,8 +1418,11 @@ func (c *CentralCollector) sendReloadSignal() {
 	}
 }
 
-func (c *CentralCollector) sendSpans(status *centralstore.CentralTraceStatus) {
-	trace := c.SpanCache.Get(status.TraceID)
+func (c *CentralCollector) sendSpans(ctx context.Context, status *centralstore.CentralTraceStatus) {
+	_, span := otelutil.StartSpanWith(ctx, c.Tracer, "CentralCollector.sendSpans", "trace_id", status.TraceID)
+	defer span.End()
+
+	trace := c.SpanCache.Load(status.TraceID)
 	if trace == nil {
 		c.Logger.Error().WithField("trace_id", status.TraceID).Logf("trace not found in cache")
 		return
@@ -1031,13 +1433,14 @@ func (c *CentralCollector) sendSpans(status *centralstore.CentralTraceStatus) {
 	}
 
 	traceDur := time.Since(trace.ArrivalTime)
-	c.Metrics.Histogram("trace_duration_ms", float64(traceDur.Milliseconds()))
+	metrics.HistogramWithExemplar(c.Metrics, "trace_duration_ms", float64(traceDur.Milliseconds()), trace.TraceID)
 	c.Metrics.Histogram("trace_span_count", float64(status.DescendantCount()))
 
 	c.Metrics.Increment(status.KeepReason)
 
-	// get sampler selector (dataset for legacy keys, environment for new keys)
-	selector := trace.GetSamplerSelector(c.Config.GetDatasetPrefix())
+	// get sampler selector (dataset for legacy keys, environment for new keys,
+	// qualified by tenant)
+	selector := c.samplerSelector(trace)
 	logFields := logrus.Fields{
 		"trace_id": trace.TraceID,
 	}
@@ -1046,17 +1449,54 @@ func (c *CentralCollector) sendSpans(status *centralstore.CentralTraceStatus) {
 	logFields["reason"] = status.KeepReason
 
 	c.Metrics.Increment("trace_send_kept")
+	metrics.IncrementLabeled(c.Metrics, "trace_send_kept_by_dataset", metrics.Labels{metrics.DimensionDataset: trace.Dataset})
 	// This will observe sample rate decisions only if the trace is kept
 	c.Metrics.Histogram("trace_send_kept_sample_rate", float64(status.Rate))
 
 	c.Logger.Info().WithFields(logFields).Logf("Sending trace")
 
-	for _, sp := range trace.GetSpans() {
+	spans := trace.GetSpans()
+	c.countLateSpans(spans, status.Timestamp, true)
+	annotateLate := c.Config.GetLateSpansConfig().Annotate
+	if trace.LimitSummary != nil {
+		spans = append(spans[:len(spans):len(spans)], trace.LimitSummary)
+	}
+	traceIDFields, spanIDFields, parentIDFields := c.idFieldNames(trace.Dataset)
+	root := trace.RootSpan
+	missingRoot := c.Config.GetMissingRootConfig()
+	if root == nil {
+		c.Metrics.Increment("trace_missing_root")
+		if missingRoot.Synthesize && needsSyntheticRoot(spans, status.Timestamp) {
+			root = synthesizeRoot(spans, c.IDGenerator, traceIDFields, spanIDFields, missingRoot.ServiceField)
+			if root != nil {
+				spans = append(spans[:len(spans):len(spans)], root)
+				c.Metrics.Increment("trace_synthetic_roots")
+			}
+		}
+	}
+	annotateMissingRoot := trace.RootSpan == nil && missingRoot.Annotate
+	if reparent := c.Config.GetReparentOrphanSpans(); reparent || c.shouldCheckOrphans() {
+		c.Metrics.Increment("trace_orphan_checks")
+		if orphans := findOrphans(spans, spanIDFields, parentIDFields); len(orphans) > 0 {
+			c.Metrics.Count("trace_orphan_spans", len(orphans))
+			if reparent && reparentOrphans(root, orphans, spanIDFields, parentIDFields) {
+				c.Metrics.Count("trace_reparented_spans", len(orphans))
+			}
+		}
+	}
+	if reduction := c.Config.GetSpanReductionConfig(); reduction.Enabled {
+		var reduced int
+		spans, reduced = reduceSpans(spans, reduction, c.IDGenerator, spanIDFields, parentIDFields)
+		c.Metrics.Count("trace_spans_reduced", reduced)
+	}
+
+	addDecision := c.Config.GetAddDecisionToSpans()
+	for _, sp := range spans {
 		if sp.Data == nil {
 			sp.Data = make(map[string]interface{})
 		}
 
-		if c.Config.GetAddRuleReasonToTrace() {
+		if c.Config.GetAddRuleReasonToTrace() || addDecision {
 			reason, ok := status.Metadata["meta.refinery.reason"]
 			if !ok {
 				reason = status.KeepReason
@@ -1086,8 +1526,17 @@ func (c *CentralCollector) sendSpans(status *centralstore.CentralTraceStatus) {
 		sp.Data["meta.span_link_count"] = int(status.SpanLinkCount())
 		sp.Data["meta.span_count"] = int(status.SpanCount())
 		sp.Data["meta.event_count"] = int(status.DescendantCount())
+		if trace.LimitedSpans > 0 {
+			sp.Data["meta.refinery.limited_spans"] = trace.LimitedSpans
+		}
+		if annotateLate && sp.ArrivalTime.After(status.Timestamp) {
+			sp.Data["meta.refinery.late_span"] = true
+		}
+		if annotateMissingRoot {
+			sp.Data["meta.refinery.missing_root"] = true
+		}
 		for k, v := range status.Metadata {
-			if k == "meta.refinery.decider.host.name" && !c.Config.GetAddHostMetadataToTrace() {
+			if k == "meta.refinery.decider.host.name" && !c.Config.GetAddHostMetadataToTrace() && !addDecision {
 				continue
 			}
 			if k == "meta.refinery.send_reason" || k == "meta.refinery.reason" {
@@ -1105,11 +1554,30 @@ func (c *CentralCollector) sendSpans(status *centralstore.CentralTraceStatus) {
 		if traceSampleRate == 0 {
 			traceSampleRate = uint(c.Config.GetStressReliefConfig().SamplingRate)
 		}
+		if addDecision {
+			sp.Data["meta.refinery.sample_rate"] = traceSampleRate
+		}
 
-		mergeTraceAndSpanSampleRates(sp, traceSampleRate)
+		if c.Config.GetConsistentSamplingConfig().Enabled {
+			mergeConsistentSampleRates(sp, traceSampleRate)
+		} else {
+			mergeTraceAndSpanSampleRates(sp, traceSampleRate)
+		}
+		config.StripScopedAttributes(sp.Data)
 		c.addAdditionalAttributes(sp)
 		c.Transmission.EnqueueSpan(sp)
 	}
+	otelutil.AddSpanField(span, "num_spans", len(spans))
+}
+
+// wrapForDecision wraps a trace before it's given to a sampler, so that the
+// sampler can record dry run decisions and, if it's enabled, sample
+// consistently.
+func (c *CentralCollector) wrapForDecision(trace sample.FieldsExtractor) *sample.DryRunTrace {
+	if c.Config.GetConsistentSamplingConfig().Enabled {
+		trace = sample.NewConsistentTrace(trace)
+	}
+	return sample.NewDryRunTrace(trace)
 }
 
 func (c *CentralCollector) addAdditionalAttributes(sp *types.Span) {
@@ -1128,14 +1596,63 @@ func (c *CentralCollector) reloadConfig() {
 	// clear out any samplers that we have previously created
 	// so that the new configuration will be propagated
 	c.mut.Lock()
+	old := c.samplersByDestination
 	c.samplersByDestination = make(map[string]sample.Sampler)
 	c.mut.Unlock()
+	for _, sampler := range old {
+		sample.StopSampler(sampler)
+	}
 }
 
 func (c *CentralCollector) Stressed() bool {
 	return c.StressRelief.Stressed()
 }
 
+func (c *CentralCollector) Saturation() (queue float64, memory float64) {
+	if len(c.incoming) > 0 && cap(c.incoming[0]) > 0 {
+		queue = float64(c.incomingQueueLength()) / float64(cap(c.incoming[0]))
+	}
+	if maxAlloc := c.Config.GetCollectionConfig().GetMaxAlloc(); maxAlloc > 0 {
+		memory = float64(c.heapInUse()) / float64(maxAlloc)
+	}
+	return queue, memory
+}
+
+// heapSampleInterval is how long a reading of the heap size is reused.
+const heapSampleInterval = 100 * time.Millisecond
+
+// heapInUse returns the size of the heap. The memory check only reads it once
+// per MemoryCycleDuration, which is too stale for saturation, so between
+// checks it's read from the runtime at most every heapSampleInterval, which
+// is cheap since it doesn't stop the world.
+func (c *CentralCollector) heapInUse() uint64 {
+	now := c.Clock.Now().UnixNano()
+	readAt := c.heapReadAt.Load()
+	if now-readAt < int64(heapSampleInterval) || !c.heapReadAt.CompareAndSwap(readAt, now) {
+		return c.heapAlloc.Load()
+	}
+	readHeap := c.readHeapStats
+	if readHeap == nil {
+		readHeap = readHeapStats
+	}
+	used := readHeap().used
+	c.heapAlloc.Store(used)
+	return used
+}
+
+// orphanCheckInterval is how often a kept trace is checked for orphan spans
+// when they're only being counted, not reparented.
+const orphanCheckInterval = time.Second
+
+// shouldCheckOrphans returns true at most once per orphanCheckInterval. Unless
+// they're being reparented, orphans are only counted, and a sample of the
+// traces is enough for that.
+func (c *CentralCollector) shouldCheckOrphans() bool {
+	now := c.Clock.Now().UnixNano()
+	last := c.lastOrphanCheck.Load()
+	return now-last >= int64(orphanCheckInterval) && c.lastOrphanCheck.CompareAndSwap(last, now)
+}
+
 func mergeTraceAndSpanSampleRates(sp *types.Span, traceSampleRate uint) {
 	tempSampleRate := sp.SampleRate
 	if sp.SampleRate != 0 {
@@ -1155,3 +1672,25 @@ func mergeTraceAndSpanSampleRates(sp *types.Span, traceSampleRate uint) {
 
 	sp.SampleRate = tempSampleRate * traceSampleRate
 }
+
+// mergeConsistentSampleRates combines the sample rate of a span that a head
+// sampler may have sampled consistently with the rate of the trace. Since
+// both decisions compare the same randomness against a threshold, the span
+// was kept by both with the probability of the higher threshold, not the
+// product of the two. The combined threshold is written to the span so that
+// later samplers can do the same.
+func mergeConsistentSampleRates(sp *types.Span, traceSampleRate uint) {
+	th, _ := sp.Data[sample.OTelThresholdField].(string)
+	headThreshold, ok := sample.ParseThreshold(th)
+	if !ok {
+		mergeTraceAndSpanSampleRates(sp, traceSampleRate)
+		sp.Data[sample.OTelThresholdField] = sample.FormatThreshold(sample.RateThreshold(sp.SampleRate))
+		return
+	}
+	if sp.SampleRate != 0 {
+		sp.Data["meta.refinery.original_sample_rate"] = sp.SampleRate
+	}
+	threshold := max(headThreshold, sample.RateThreshold(traceSampleRate))
+	sp.SampleRate = sample.ThresholdRate(threshold)
+	sp.Data[sample.OTelThresholdField] = sample.FormatThreshold(threshold)
+}
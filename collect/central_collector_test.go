@@ -3,7 +3,10 @@ package collect
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
+	"net/http"
+	"os"
 	"runtime"
 	"slices"
 	"strconv"
@@ -19,6 +22,10 @@ import (
 	"github.com/honeycombio/refinery/collect/stressRelief"
 	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/generics"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/decisionexport"
+	"github.com/honeycombio/refinery/internal/dropaudit"
 	"github.com/honeycombio/refinery/internal/gossip"
 	"github.com/honeycombio/refinery/internal/health"
 	"github.com/honeycombio/refinery/internal/peer"
@@ -266,6 +273,51 @@ func TestCentralCollector_Decider(t *testing.T) {
 	}
 }
 
+func TestCentralCollector_DryRunRule(t *testing.T) {
+	for _, storeType := range storeTypes {
+		t.Run(storeType, func(t *testing.T) {
+			conf := &config.MockConfig{
+				GetSamplerTypeVal: &config.RulesBasedSamplerConfig{
+					Rules: []*config.RulesBasedSamplerRule{
+						{Name: "drop everything", Drop: true, DryRun: true},
+						{Name: "keep everything", SampleRate: 1},
+					},
+				},
+				SendTickerVal:      2 * time.Millisecond,
+				ParentIdFieldNames: []string{"trace.parent_id", "parentId"},
+				GetParallelismVal:  10,
+				GetCollectionConfigVal: config.CollectionConfig{
+					IncomingQueueSize:    100,
+					SenderCycleDuration:  config.Duration(1 * time.Second),
+					DeciderCycleDuration: config.Duration(1 * time.Second),
+				},
+			}
+			collector := &CentralCollector{
+				Transmission: &transmit.MockTransmission{},
+			}
+			stop := startCollector(t, conf, collector, storeType)
+			defer stop()
+			collector.deciderCycle.Pause()
+
+			require.NoError(t, collector.AddSpan(&types.Span{
+				TraceID: "trace01",
+				ID:      "span0",
+				IsRoot:  true,
+				Event:   types.Event{Dataset: "aoeu", Environment: "test"},
+			}))
+			waitUntilReadyToDecide(t, collector, []string{"trace01"})
+
+			collector.deciderCycle.RunOnce()
+			traces, err := collector.Store.GetStatusForTraces(context.Background(), []string{"trace01"}, centralstore.DecisionKeep)
+			require.NoError(t, err)
+			require.Len(t, traces, 1)
+			assert.Equal(t, false, traces[0].Metadata["meta.refinery.dryrun.kept"])
+			assert.Equal(t, "rules/trace/drop everything", traces[0].Metadata["meta.refinery.dryrun.reason"])
+			assert.EqualValues(t, 0, traces[0].Metadata["meta.refinery.dryrun.sample_rate"])
+		})
+	}
+}
+
 func TestCentralCollector_OriginalSampleRateIsNotedInMetaField(t *testing.T) {
 	for _, storeType := range storeTypes {
 		t.Run(storeType, func(t *testing.T) {
@@ -666,6 +718,34 @@ func TestCentralCollector_AddSpanNoBlock(t *testing.T) {
 	}
 }
 
+func TestCentralCollector_AddSpanToWorker(t *testing.T) {
+	coll := &CentralCollector{Metrics: &metrics.NullMetrics{}, Config: &config.MockConfig{}}
+	coll.incoming = make([]chan *types.Span, 3)
+	for i := range coll.incoming {
+		coll.incoming[i] = make(chan *types.Span, 2)
+	}
+
+	// the spans of a trace are all queued for the worker that owns it
+	worker := cache.Partition("1", 3)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, coll.AddSpan(&types.Span{TraceID: "1"}))
+	}
+	assert.Len(t, coll.incoming[worker], 2)
+	assert.Equal(t, 2, coll.incomingQueueLength())
+	queue, _ := coll.Saturation()
+	assert.Equal(t, 1.0, queue)
+
+	// a full queue refuses spans for its own traces, but not other workers'
+	assert.ErrorIs(t, coll.AddSpan(&types.Span{TraceID: "1"}), ErrWouldBlock)
+	for i := 0; ; i++ {
+		traceID := strconv.Itoa(i)
+		if cache.Partition(traceID, 3) != worker {
+			require.NoError(t, coll.AddSpan(&types.Span{TraceID: traceID}))
+			break
+		}
+	}
+}
+
 // TestAddCountsToRoot tests that adding a root span winds up with a trace object in
 // the cache and that that trace gets span count, span event count, span link count, and event count added to it
 // This test also makes sure that AddCountsToRoot overrides the AddSpanCountToRoot config.
@@ -1034,6 +1114,79 @@ func TestCentralCollector_AddAdditionalAttributes(t *testing.T) {
 	}
 }
 
+func TestCentralCollector_AddDecisionToSpans(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	for _, storeType := range storeTypes {
+		t.Run(storeType, func(t *testing.T) {
+			conf := &config.MockConfig{
+				GetSendDelayVal:    0,
+				GetTraceTimeoutVal: 60 * time.Second,
+				GetSamplerTypeVal:  &config.DeterministicSamplerConfig{SampleRate: 1},
+				SendTickerVal:      2 * time.Millisecond,
+				GetParallelismVal:  10,
+				AddDecisionToSpans: true,
+				SampleCache: config.SampleCacheConfig{
+					KeptSize:          100,
+					DroppedSize:       100,
+					SizeCheckInterval: config.Duration(1 * time.Second),
+				},
+				GetCollectionConfigVal: config.CollectionConfig{
+					IncomingQueueSize:    5,
+					SenderCycleDuration:  config.Duration(1 * time.Second),
+					DeciderCycleDuration: config.Duration(1 * time.Second),
+				},
+			}
+			transmission := &transmit.MockTransmission{}
+			coll := &CentralCollector{
+				Transmission: transmission,
+			}
+			stop := startCollector(t, conf, coll, storeType)
+			defer stop()
+
+			coll.deciderCycle.Pause()
+			coll.senderCycle.Pause()
+
+			var traceID = "trace123"
+			require.NoError(t, coll.AddSpan(&types.Span{
+				TraceID: traceID,
+				ID:      "span1",
+				Event: types.Event{
+					Dataset: "aoeu",
+					Data:    map[string]interface{}{"trace.parent_id": "root"},
+					APIKey:  legacyAPIKey,
+				},
+			}))
+			require.NoError(t, coll.AddSpan(&types.Span{
+				TraceID: traceID,
+				ID:      "root",
+				Event: types.Event{
+					Dataset: "aoeu",
+					Data:    map[string]interface{}{},
+					APIKey:  legacyAPIKey,
+				},
+				IsRoot: true,
+			}))
+			waitUntilReadyToDecide(t, coll, []string{traceID})
+			coll.deciderCycle.RunOnce()
+			waitForTraceDecision(t, coll, []string{traceID})
+			coll.senderCycle.RunOnce()
+
+			transmission.Mux.RLock()
+			defer transmission.Mux.RUnlock()
+			require.Equal(t, 2, len(transmission.Events))
+			for _, ev := range transmission.Events {
+				assert.Equal(t, uint(1), ev.Data["meta.refinery.sample_rate"])
+				assert.Equal(t, "deterministic/always", ev.Data["meta.refinery.reason"])
+				// the decider is added even without the rest of the host metadata
+				assert.Equal(t, hostname, ev.Data["meta.refinery.decider.host.name"])
+				assert.Nil(t, ev.Data["meta.refinery.sender.host.name"])
+			}
+		})
+	}
+}
+
 func TestCentralCollector_SpanWithRuleReasons(t *testing.T) {
 	for _, storeType := range storeTypes {
 		t.Run(storeType, func(t *testing.T) {
@@ -1337,6 +1490,57 @@ func TestCentralCollector_ProcessSpanImmediately(t *testing.T) {
 	}
 }
 
+// recordingExporter remembers the decisions exported to it.
+type recordingExporter struct {
+	decisionexport.NullExporter
+	mut       sync.Mutex
+	decisions []decisionexport.Decision
+}
+
+func (r *recordingExporter) Export(d decisionexport.Decision) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.decisions = append(r.decisions, d)
+}
+
+func TestCentralCollector_ProcessSpanImmediatelyExportsOnce(t *testing.T) {
+	exporter := &recordingExporter{}
+	collector := &CentralCollector{
+		Transmission: &transmit.MockTransmission{},
+		StressRelief: &stressRelief.MockStressReliever{
+			SampleDeterministically: true,
+			SampleRate:              1,
+		},
+		DecisionExport: exporter,
+	}
+	stop := startCollector(t, &config.MockConfig{
+		GetCollectionConfigVal: config.CollectionConfig{
+			IncomingQueueSize:    100,
+			SenderCycleDuration:  config.Duration(1 * time.Second),
+			DeciderCycleDuration: config.Duration(1 * time.Second),
+		},
+	}, collector, "local")
+	defer stop()
+
+	// every span of a trace gets the stress relief decision, but it's only
+	// exported once
+	for _, id := range []string{"span1", "span2", "span3"} {
+		processed, err := collector.ProcessSpanImmediately(&types.Span{
+			TraceID: "trace1",
+			ID:      id,
+			Event:   types.Event{Dataset: "aoeu", Data: make(map[string]interface{})},
+		})
+		require.NoError(t, err)
+		require.True(t, processed)
+	}
+
+	exporter.mut.Lock()
+	defer exporter.mut.Unlock()
+	require.Len(t, exporter.decisions, 1)
+	assert.Equal(t, "trace1", exporter.decisions[0].TraceID)
+	assert.False(t, exporter.decisions[0].Kept)
+}
+
 func startCollector(t *testing.T, cfg *config.MockConfig, collector *CentralCollector,
 	storeType string) func() {
 	if cfg == nil {
@@ -1446,6 +1650,12 @@ func startCollector(t *testing.T, cfg *config.MockConfig, collector *CentralColl
 		{Value: collector},
 		{Value: &health.Health{}},
 		{Value: &gossip.InMemoryGossip{}, Name: "gossip"},
+		{Value: &decisionexport.NullExporter{}},
+		{Value: &dropaudit.NullAuditor{}},
+		{Value: &types.RandomIDGenerator{}},
+		{Value: &clustercount.LocalCounter{}},
+		{Value: &apikeys.LocalCache{}},
+		{Value: http.DefaultTransport, Name: "upstreamTransport"},
 	}
 	g := inject.Graph{}
 	require.NoError(t, g.Provide(objects...))
@@ -1567,3 +1777,135 @@ func Test_aggregate(t *testing.T) {
 
 	require.True(t, true)
 }
+
+func TestSaturationRereadsHeap(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	heap := heapStats{used: 50}
+	coll := &CentralCollector{
+		Config:        &config.MockConfig{GetCollectionConfigVal: config.CollectionConfig{MaxAlloc: 100}},
+		Clock:         clock,
+		readHeapStats: func() heapStats { return heap },
+	}
+
+	_, memory := coll.Saturation()
+	assert.Equal(t, 0.5, memory)
+
+	// a reading is reused for a while, then read again
+	heap.used = 90
+	_, memory = coll.Saturation()
+	assert.Equal(t, 0.5, memory)
+	clock.Advance(heapSampleInterval)
+	_, memory = coll.Saturation()
+	assert.Equal(t, 0.9, memory)
+}
+
+func TestShouldCheckOrphans(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	coll := &CentralCollector{Clock: clock}
+
+	assert.True(t, coll.shouldCheckOrphans())
+	assert.False(t, coll.shouldCheckOrphans())
+	clock.Advance(orphanCheckInterval)
+	assert.True(t, coll.shouldCheckOrphans())
+	assert.False(t, coll.shouldCheckOrphans())
+}
+
+func TestChildCountHint(t *testing.T) {
+	fields := []string{"meta.child_count", "child_count"}
+
+	count, ok := childCountHint(map[string]interface{}{"meta.child_count": int64(3)}, fields)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3), count)
+
+	count, ok = childCountHint(map[string]interface{}{"child_count": float64(2)}, fields)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), count)
+
+	_, ok = childCountHint(map[string]interface{}{"meta.child_count": int64(-1)}, fields)
+	assert.False(t, ok)
+
+	_, ok = childCountHint(map[string]interface{}{"meta.child_count": "3"}, fields)
+	assert.False(t, ok)
+
+	// counts too big for a uint32 saturate rather than wrapping
+	count, ok = childCountHint(map[string]interface{}{"meta.child_count": int64(1) << 33}, fields)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(math.MaxUint32), count)
+
+	count, ok = childCountHint(map[string]interface{}{"meta.child_count": float64(1e12)}, fields)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(math.MaxUint32), count)
+}
+
+func TestRecordSpanIDs(t *testing.T) {
+	coll := &CentralCollector{Config: &config.MockConfig{
+		SpanIdFieldNames: []string{"span.id"},
+		IDFieldRules: map[string]config.IDFieldRules{
+			"legacy": {ParentNames: []string{"parentSpanId"}},
+		},
+	}}
+
+	keyFields := map[string]interface{}{}
+	coll.recordSpanIDs(keyFields, &types.Span{Event: types.Event{
+		Dataset: "legacy",
+		Data:    map[string]interface{}{"span.id": "b", "parentSpanId": "a"},
+	}})
+	assert.Equal(t, map[string]interface{}{config.SpanIDField: "b", config.ParentIDField: "a"}, keyFields)
+
+	// a root span has no parent ID to record
+	keyFields = map[string]interface{}{}
+	coll.recordSpanIDs(keyFields, &types.Span{Event: types.Event{Data: map[string]interface{}{"span.id": "a"}}})
+	assert.Equal(t, map[string]interface{}{config.SpanIDField: "a"}, keyFields)
+}
+
+func TestMergeConsistentSampleRates(t *testing.T) {
+	// the head sampler kept 1 in 4, and the trace was kept at 2: both
+	// compared the same randomness, so the span stands for 4 spans, not 8
+	sp := &types.Span{Event: types.Event{SampleRate: 4, Data: map[string]interface{}{
+		sample.OTelThresholdField: "c",
+	}}}
+	mergeConsistentSampleRates(sp, 2)
+	assert.Equal(t, uint(4), sp.SampleRate)
+	assert.Equal(t, "c", sp.Data[sample.OTelThresholdField])
+	assert.Equal(t, uint(4), sp.Data["meta.refinery.original_sample_rate"])
+
+	sp = &types.Span{Event: types.Event{Data: map[string]interface{}{
+		sample.OTelThresholdField: "8",
+	}}}
+	mergeConsistentSampleRates(sp, 16)
+	assert.Equal(t, uint(16), sp.SampleRate)
+	assert.Equal(t, "f", sp.Data[sample.OTelThresholdField])
+
+	// without a threshold, the rates multiply as usual
+	sp = &types.Span{Event: types.Event{SampleRate: 2, Data: map[string]interface{}{}}}
+	mergeConsistentSampleRates(sp, 2)
+	assert.Equal(t, uint(4), sp.SampleRate)
+	assert.Equal(t, "c", sp.Data[sample.OTelThresholdField])
+}
+
+func TestSamplerSelector(t *testing.T) {
+	conf := &config.MockConfig{
+		DatasetPrefix: "classic",
+		TenantAPIKeys: map[string]string{legacyAPIKey: "acme", "abcdefghijklmnopqrst": "globex"},
+	}
+	coll := &CentralCollector{Config: conf}
+
+	legacy := &types.Trace{APIKey: legacyAPIKey, Dataset: "ds"}
+	assert.Equal(t, config.TenantSelector("acme", "classic.ds"), coll.samplerSelector(legacy))
+
+	trace := &types.Trace{APIKey: "abcdefghijklmnopqrst"}
+	trace.AddSpan(&types.Span{Event: types.Event{Environment: "production"}})
+	assert.Equal(t, config.TenantSelector("globex", "production"), coll.samplerSelector(trace))
+
+	trace.APIKey = "zyxwvutsrqponmlkjihg"
+	assert.Equal(t, "production", coll.samplerSelector(trace))
+
+	// a key that isn't listed belongs to its team's tenant, once the router
+	// has looked it up
+	conf.TenantTeams = map[string]string{"initech-corp": "initech"}
+	keyCache := &apikeys.LocalCache{Clock: clockwork.NewFakeClock()}
+	coll.KeyValidator = &apikeys.Validator{Cache: keyCache}
+	assert.Equal(t, "production", coll.samplerSelector(trace))
+	keyCache.Set(context.Background(), trace.APIKey, apikeys.KeyInfo{Valid: true, Team: "initech-corp"}, time.Minute)
+	assert.Equal(t, config.TenantSelector("initech", "production"), coll.samplerSelector(trace))
+}
@@ -0,0 +1,90 @@
+package collect
+
+import (
+	"context"
+	"errors"
+
+	"github.com/honeycombio/refinery/centralstore"
+	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/sirupsen/logrus"
+)
+
+// InFlight returns the number of traces this node holds that haven't been
+// decided and sent yet, counting the spans waiting in the incoming queues as
+// well as the traces in the cache.
+func (c *CentralCollector) InFlight() int {
+	var queued int
+	for _, ch := range c.incoming {
+		queued += len(ch)
+	}
+	return c.SpanCache.Len() + queued
+}
+
+// ForwardInFlight writes every trace still in the cache to the central store,
+// so that the rest of the cluster can decide and send it, and removes it from
+// the cache. It returns the number of spans forwarded.
+func (c *CentralCollector) ForwardInFlight(ctx context.Context) (int, error) {
+	sentCount, err := c.forwardTraces(ctx, "drain")
+	c.Logger.Info().Logf("sent %d spans to central store during drain", sentCount)
+	return sentCount, err
+}
+
+// forwardTraces writes all the fields of the spans of every trace in the
+// cache to the central store, and removes each trace once all of its spans
+// are written. It stops when ctx is done, and returns the number of spans
+// it wrote.
+func (c *CentralCollector) forwardTraces(ctx context.Context, phase string) (int, error) {
+	ctx, span := otelutil.StartSpanWith(ctx, c.Tracer, "CentralCollector."+phase+".forward", "span_cache_len", c.SpanCache.Len())
+	defer span.End()
+
+	ids := c.SpanCache.GetTraceIDs(c.SpanCache.Len())
+	var sentCount int
+	defer func() {
+		otelutil.AddSpanField(span, "sent_count", sentCount)
+	}()
+
+	for _, id := range ids {
+		trace := c.SpanCache.Load(id)
+		if trace == nil {
+			// it was decided since the IDs were read
+			continue
+		}
+
+		var failed bool
+		for _, sp := range trace.GetSpans() {
+			// send the spans to the central store
+			cs := &centralstore.CentralSpan{
+				TraceID:   id,
+				SpanID:    sp.ID,
+				Type:      sp.Type(),
+				AllFields: sp.Data,
+				IsRoot:    sp.IsRoot,
+			}
+
+			cs.SetSamplerSelector(c.samplerSelector(trace))
+			err := c.Store.WriteSpan(ctx, cs)
+			if err != nil {
+				failed = true
+				logField := logrus.Fields{
+					"span_id":  sp.ID,
+					"trace_id": id,
+				}
+				span.RecordError(err)
+				c.Logger.Error().WithFields(logField).Logf("error sending span during %s: %s", phase, err)
+			}
+			sentCount++
+			// if the context deadline is exceeded, that means we are
+			// about to run out of time, so we should stop sending traces
+			// to the central store. Unfortunately, the remaining traces
+			// will be lost.
+			if errors.Is(err, context.DeadlineExceeded) {
+				return sentCount, err
+			}
+		}
+		if !failed {
+			c.SpanCache.Remove(id)
+		}
+	}
+
+	return sentCount, nil
+}
@@ -0,0 +1,109 @@
+package collect
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+// These are the reasons that a trace is evicted from the trace cache before
+// it would otherwise have been decided.
+const (
+	// EvictionMemory is an eviction because the heap reached MaxAlloc.
+	EvictionMemory = "memory"
+	// EvictionBudget is an eviction because the trace cache was over its
+	// part of the memory budget.
+	EvictionBudget = "memory_budget"
+	// EvictionSpilled is a trace chosen for eviction whose spans were
+	// written to disk instead; it stays in the cache.
+	EvictionSpilled = "spilled"
+	// EvictionTraceLimit is an eviction because the trace reached its span
+	// count or size limit.
+	EvictionTraceLimit = "trace_limit"
+)
+
+var evictionReasons = []string{EvictionMemory, EvictionBudget, EvictionSpilled, EvictionTraceLimit}
+
+// maxEvictionEvents is the number of recent evictions that are kept for the
+// admin API.
+const maxEvictionEvents = 1000
+
+// EvictionEvent describes a trace that was evicted from the trace cache, so
+// that the traces that put the cache under pressure can be seen.
+type EvictionEvent struct {
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	TraceID   string    `json:"trace_id"`
+	Dataset   string    `json:"dataset"`
+	AgeMs     int64     `json:"age_ms"`
+	SpanCount uint32    `json:"span_count"`
+	DataSize  int       `json:"data_size"`
+	HasRoot   bool      `json:"has_root"`
+}
+
+// evictionLog is a ring buffer of the most recent evictions.
+type evictionLog struct {
+	lock   sync.Mutex
+	events []EvictionEvent
+	next   int
+}
+
+func (l *evictionLog) add(ev EvictionEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.events) < maxEvictionEvents {
+		l.events = append(l.events, ev)
+		return
+	}
+	l.events[l.next] = ev
+	l.next = (l.next + 1) % maxEvictionEvents
+}
+
+// recent returns up to n of the most recent evictions, newest first; n <= 0
+// returns all of them.
+func (l *evictionLog) recent(n int) []EvictionEvent {
+	l.lock.Lock()
+	events := make([]EvictionEvent, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	events = append(events, l.events[:l.next]...)
+	l.lock.Unlock()
+
+	slices.Reverse(events)
+	if n > 0 && len(events) > n {
+		events = events[:n]
+	}
+	return events
+}
+
+// Evictions returns up to n of the most recent evictions from the trace
+// cache, newest first; n <= 0 returns all that are kept.
+func (c *CentralCollector) Evictions(n int) []EvictionEvent {
+	return c.evictions.recent(n)
+}
+
+// evictionProfile describes a trace that's about to be evicted. It must be
+// taken before the trace's spans are spilled or removed.
+func (c *CentralCollector) evictionProfile(trace *types.Trace, reason string) EvictionEvent {
+	now := c.Clock.Now()
+	return EvictionEvent{
+		Time:      now,
+		Reason:    reason,
+		TraceID:   trace.TraceID,
+		Dataset:   trace.Dataset,
+		AgeMs:     now.Sub(trace.ArrivalTime).Milliseconds(),
+		SpanCount: trace.DescendantCount(),
+		DataSize:  trace.DataSize,
+		HasRoot:   trace.RootSpan != nil,
+	}
+}
+
+// recordEviction adds an eviction to the log and its metrics.
+func (c *CentralCollector) recordEviction(ev EvictionEvent) {
+	c.evictions.add(ev)
+	c.Metrics.Increment("collector_evictions_" + ev.Reason)
+	metrics.HistogramWithExemplar(c.Metrics, "collector_eviction_trace_age_ms", float64(ev.AgeMs), ev.TraceID)
+	c.Metrics.Histogram("collector_eviction_span_count", float64(ev.SpanCount))
+}
@@ -0,0 +1,59 @@
+package collect
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvictionLog(t *testing.T) {
+	var l evictionLog
+	assert.Empty(t, l.recent(0))
+
+	for i := 0; i < maxEvictionEvents+10; i++ {
+		l.add(EvictionEvent{TraceID: strconv.Itoa(i)})
+	}
+
+	// the oldest are overwritten, and the newest come first
+	all := l.recent(0)
+	require.Len(t, all, maxEvictionEvents)
+	assert.Equal(t, strconv.Itoa(maxEvictionEvents+9), all[0].TraceID)
+	assert.Equal(t, "10", all[len(all)-1].TraceID)
+
+	top := l.recent(3)
+	require.Len(t, top, 3)
+	assert.Equal(t, strconv.Itoa(maxEvictionEvents+7), top[2].TraceID)
+}
+
+func TestRecordEviction(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	coll := &CentralCollector{Clock: clock, Metrics: mockMetrics}
+
+	trace := &types.Trace{TraceID: "t1", Dataset: "ds", ArrivalTime: clock.Now()}
+	trace.AddSpan(&types.Span{TraceID: "t1", Event: types.Event{Data: map[string]interface{}{}}})
+	trace.AddSpan(&types.Span{TraceID: "t1", Event: types.Event{Data: map[string]interface{}{}}})
+	clock.Advance(3 * time.Second)
+
+	coll.recordEviction(coll.evictionProfile(trace, EvictionMemory))
+
+	events := coll.Evictions(0)
+	require.Len(t, events, 1)
+	assert.Equal(t, EvictionEvent{
+		Time:      clock.Now(),
+		Reason:    EvictionMemory,
+		TraceID:   "t1",
+		Dataset:   "ds",
+		AgeMs:     3000,
+		SpanCount: 2,
+		DataSize:  trace.DataSize,
+	}, events[0])
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["collector_evictions_memory"])
+}
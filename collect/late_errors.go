@@ -0,0 +1,145 @@
+package collect
+
+import (
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+)
+
+// TraceSendLateError is the send reason of error spans that were sent after
+// their trace was dropped, and of the spans sent with them.
+const TraceSendLateError = "trace_send_late_error"
+
+// droppedTrace is what is remembered of a recently dropped trace, in case an
+// error span for it arrives late.
+type droppedTrace struct {
+	traceID   string
+	droppedAt time.Time
+	// decidedAt is when the trace was dropped; spans that arrived after it
+	// are late
+	decidedAt time.Time
+	// siblings are the trace's dropped spans, kept only if they are to be
+	// sent along with a late error
+	siblings  []*types.Span
+	recovered bool
+}
+
+// droppedTraces remembers recently dropped traces, oldest first.
+type droppedTraces struct {
+	mut    sync.Mutex
+	traces map[string]*droppedTrace
+	order  []*droppedTrace
+}
+
+func (d *droppedTraces) get(traceID string) *droppedTrace {
+	return d.traces[traceID]
+}
+
+// add remembers a dropped trace, forgetting the oldest if there are more
+// than max.
+func (d *droppedTraces) add(dt *droppedTrace, max int) {
+	if d.traces == nil {
+		d.traces = make(map[string]*droppedTrace)
+	}
+	d.traces[dt.traceID] = dt
+	d.order = append(d.order, dt)
+	for len(d.order) > max {
+		d.forgetOldest()
+	}
+}
+
+// expire forgets the traces dropped before the given time.
+func (d *droppedTraces) expire(before time.Time) {
+	for len(d.order) > 0 && d.order[0].droppedAt.Before(before) {
+		d.forgetOldest()
+	}
+}
+
+func (d *droppedTraces) forgetOldest() {
+	delete(d.traces, d.order[0].traceID)
+	d.order[0] = nil
+	d.order = d.order[1:]
+}
+
+func (d *droppedTraces) len() int {
+	return len(d.order)
+}
+
+// recoverLateErrors is called with the spans of a dropped trace before they
+// are removed from the cache. It sends the error spans that arrived after
+// the trace was dropped at decidedAt, and, if configured, the trace's other
+// dropped spans along with the first of them. Errors that arrived in time
+// were seen by the sampler, so they stay dropped.
+func (c *CentralCollector) recoverLateErrors(traceID string, decidedAt time.Time) {
+	cfg := c.Config.GetLateErrorRecoveryConfig()
+	if !cfg.Enabled {
+		return
+	}
+	trace := c.SpanCache.Load(traceID)
+	if trace == nil {
+		return
+	}
+
+	c.droppedTraces.mut.Lock()
+	defer c.droppedTraces.mut.Unlock()
+
+	now := c.Clock.Now()
+	c.droppedTraces.expire(now.Add(-time.Duration(cfg.BufferTime)))
+	defer func() { c.Metrics.Gauge("late_error_dropped_traces", c.droppedTraces.len()) }()
+
+	// the first report of the drop says when it was decided
+	dt := c.droppedTraces.get(traceID)
+	if dt == nil {
+		dt = &droppedTrace{traceID: traceID, droppedAt: now, decidedAt: decidedAt}
+		c.droppedTraces.add(dt, cfg.MaxTraces)
+	}
+
+	var lateErrors []*types.Span
+	for _, sp := range trace.GetSpans() {
+		if sp.ArrivalTime.After(dt.decidedAt) && config.TryConvertToBool(sp.Data["error"]) {
+			lateErrors = append(lateErrors, sp)
+			continue
+		}
+		if cfg.IncludeSiblings && !dt.recovered && len(dt.siblings) < cfg.MaxSiblings {
+			dt.siblings = append(dt.siblings, sp)
+		}
+	}
+	if len(lateErrors) == 0 {
+		return
+	}
+
+	c.Metrics.Count("trace_late_errors_recovered", len(lateErrors))
+	spans := lateErrors
+	if !dt.recovered {
+		spans = append(spans, dt.siblings...)
+		c.Metrics.Count("trace_late_error_siblings_sent", len(dt.siblings))
+		dt.siblings = nil
+		dt.recovered = true
+	}
+	c.Logger.Info().WithField("trace_id", traceID).Logf("Sending late error spans of dropped trace")
+
+	for _, sp := range spans {
+		if sp.Data == nil {
+			sp.Data = make(map[string]interface{})
+		}
+		sp.Data["meta.refinery.partial_trace"] = true
+		if c.Config.GetLateSpansConfig().Annotate && sp.ArrivalTime.After(dt.decidedAt) {
+			sp.Data["meta.refinery.late_span"] = true
+		}
+		if c.Config.GetAddRuleReasonToTrace() {
+			sp.Data["meta.refinery.reason"] = "late error recovery"
+			sp.Data["meta.refinery.send_reason"] = TraceSendLateError
+		}
+		if c.hostname != "" && c.Config.GetAddHostMetadataToTrace() {
+			sp.Data["meta.refinery.sender.host.name"] = c.hostname
+		}
+		// the rest of the trace was dropped, so each span only stands for
+		// itself
+		mergeTraceAndSpanSampleRates(sp, 1)
+		config.StripScopedAttributes(sp.Data)
+		c.addAdditionalAttributes(sp)
+		c.Transmission.EnqueueSpan(sp)
+	}
+}
@@ -0,0 +1,130 @@
+package collect
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDroppedTraces(t *testing.T) {
+	start := time.Now()
+	d := droppedTraces{}
+	for i := 0; i < 5; i++ {
+		d.add(&droppedTrace{traceID: fmt.Sprint(i), droppedAt: start.Add(time.Duration(i) * time.Second)}, 4)
+	}
+	// the oldest is forgotten to stay under the limit
+	assert.Equal(t, 4, d.len())
+	assert.Nil(t, d.get("0"))
+	assert.NotNil(t, d.get("1"))
+
+	d.expire(start.Add(3 * time.Second))
+	assert.Equal(t, 2, d.len())
+	assert.Nil(t, d.get("2"))
+	assert.NotNil(t, d.get("3"))
+	assert.NotNil(t, d.get("4"))
+}
+
+func TestCentralCollector_LateErrorRecovery(t *testing.T) {
+	for _, includeSiblings := range []bool{false, true} {
+		t.Run(fmt.Sprintf("siblings=%v", includeSiblings), func(t *testing.T) {
+			conf := &config.MockConfig{
+				GetSendDelayVal:    0,
+				GetTraceTimeoutVal: 5 * time.Minute,
+				GetSamplerTypeVal: &config.RulesBasedSamplerConfig{
+					Rules: []*config.RulesBasedSamplerRule{{Name: "drop everything", Drop: true}},
+				},
+				SendTickerVal:        2 * time.Millisecond,
+				ParentIdFieldNames:   []string{"trace.parent_id", "parentId"},
+				GetParallelismVal:    10,
+				AddRuleReasonToTrace: true,
+				SampleCache: config.SampleCacheConfig{
+					KeptSize:          100,
+					DroppedSize:       100,
+					SizeCheckInterval: config.Duration(1 * time.Second),
+				},
+				GetCollectionConfigVal: config.CollectionConfig{
+					IncomingQueueSize:    10,
+					SenderCycleDuration:  config.Duration(1 * time.Second),
+					DeciderCycleDuration: config.Duration(1 * time.Second),
+				},
+				LateErrorRecovery: config.LateErrorRecoveryConfig{
+					Enabled:         true,
+					BufferTime:      config.Duration(time.Minute),
+					MaxTraces:       100,
+					IncludeSiblings: includeSiblings,
+					MaxSiblings:     10,
+				},
+			}
+
+			transmission := &transmit.MockTransmission{}
+			coll := &CentralCollector{
+				Transmission: transmission,
+			}
+			stop := startCollector(t, conf, coll, storeTypes[0])
+			defer stop()
+
+			coll.deciderCycle.Pause()
+			coll.senderCycle.Pause()
+
+			const traceID = "traceLateError"
+			newSpan := func(id string, data map[string]interface{}) *types.Span {
+				data["trace.parent_id"] = "root"
+				return &types.Span{
+					TraceID: traceID,
+					ID:      id,
+					Event: types.Event{
+						Dataset: "aoeu",
+						Data:    data,
+						APIKey:  legacyAPIKey,
+					},
+				}
+			}
+
+			// an error that arrives in time is dropped with its trace
+			require.NoError(t, coll.AddSpan(newSpan("early", map[string]interface{}{"error": true})))
+			require.NoError(t, coll.AddSpan(newSpan("ok", map[string]interface{}{})))
+			waitUntilReadyToDecide(t, coll, []string{traceID})
+			coll.deciderCycle.RunOnce()
+			waitForTraceDecision(t, coll, []string{traceID})
+			coll.senderCycle.RunOnce()
+			require.Nil(t, coll.SpanCache.Get(traceID))
+			transmission.Mux.RLock()
+			require.Empty(t, transmission.Events)
+			transmission.Mux.RUnlock()
+
+			// a late span without an error stays dropped
+			require.NoError(t, coll.AddSpan(newSpan("late ok", map[string]interface{}{})))
+			require.Eventually(t, func() bool { return coll.SpanCache.Get(traceID) != nil }, time.Second, 5*time.Millisecond)
+			coll.senderCycle.RunOnce()
+			transmission.Mux.RLock()
+			require.Empty(t, transmission.Events)
+			transmission.Mux.RUnlock()
+
+			// a late error is sent
+			require.NoError(t, coll.AddSpan(newSpan("late error", map[string]interface{}{"error": true})))
+			require.Eventually(t, func() bool { return coll.SpanCache.Get(traceID) != nil }, time.Second, 5*time.Millisecond)
+			coll.senderCycle.RunOnce()
+
+			transmission.Mux.RLock()
+			defer transmission.Mux.RUnlock()
+			if !includeSiblings {
+				require.Len(t, transmission.Events, 1)
+			} else {
+				require.Len(t, transmission.Events, 4)
+			}
+			assert.Equal(t, true, transmission.Events[0].Data["meta.refinery.partial_trace"])
+			assert.Equal(t, true, transmission.Events[0].Data["error"])
+			assert.Equal(t, TraceSendLateError, transmission.Events[0].Data["meta.refinery.send_reason"])
+			assert.Equal(t, uint(1), transmission.Events[0].SampleRate)
+			for _, ev := range transmission.Events {
+				assert.Equal(t, true, ev.Data["meta.refinery.partial_trace"])
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package collect
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+// maxLateSpanEntries bounds the number of rows in the late span table; once
+// it is reached, late spans from new senders are recorded under
+// lateSpanOverflowKey.
+const maxLateSpanEntries = 10000
+
+const lateSpanOverflowKey = "_other"
+
+// lateSpanKey identifies a row in the late span table.
+type lateSpanKey struct {
+	Dataset string `json:"dataset"`
+	Service string `json:"service"`
+}
+
+// LateSpanReport counts the spans from one dataset and service that arrived
+// after their trace was decided, and how late they were.
+type LateSpanReport struct {
+	lateSpanKey
+	Kept            int64 `json:"kept"`
+	Dropped         int64 `json:"dropped"`
+	TotalLatenessMs int64 `json:"total_lateness_ms"`
+	MaxLatenessMs   int64 `json:"max_lateness_ms"`
+}
+
+// lateSpanAccounting keeps running totals of late spans, so that the
+// instrumentation responsible for them can be found.
+type lateSpanAccounting struct {
+	lock sync.Mutex
+	rows map[lateSpanKey]*LateSpanReport
+}
+
+func (a *lateSpanAccounting) record(dataset string, service string, lateness time.Duration, kept bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.rows == nil {
+		a.rows = make(map[lateSpanKey]*LateSpanReport)
+	}
+
+	key := lateSpanKey{Dataset: dataset, Service: service}
+	row, ok := a.rows[key]
+	if !ok {
+		if len(a.rows) >= maxLateSpanEntries {
+			key = lateSpanKey{Dataset: lateSpanOverflowKey, Service: lateSpanOverflowKey}
+			row, ok = a.rows[key]
+		}
+		if !ok {
+			row = &LateSpanReport{lateSpanKey: key}
+			a.rows[key] = row
+		}
+	}
+	if kept {
+		row.Kept++
+	} else {
+		row.Dropped++
+	}
+	ms := lateness.Milliseconds()
+	row.TotalLatenessMs += ms
+	row.MaxLatenessMs = max(row.MaxLatenessMs, ms)
+}
+
+// snapshot returns copies of the top rows with the most late spans; top <= 0
+// returns everything.
+func (a *lateSpanAccounting) snapshot(top int) []LateSpanReport {
+	a.lock.Lock()
+	reports := make([]LateSpanReport, 0, len(a.rows))
+	for _, row := range a.rows {
+		reports = append(reports, *row)
+	}
+	a.lock.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		ni, nj := reports[i].Kept+reports[i].Dropped, reports[j].Kept+reports[j].Dropped
+		if ni != nj {
+			return ni > nj
+		}
+		return reports[i].Dataset+reports[i].Service < reports[j].Dataset+reports[j].Service
+	})
+	if top > 0 && len(reports) > top {
+		reports = reports[:top]
+	}
+	return reports
+}
+
+// LateSpanReports returns the counts of late spans for each dataset and
+// service, those with the most late spans first; top limits the number
+// returned, if it's more than 0.
+func (c *CentralCollector) LateSpanReports(top int) []LateSpanReport {
+	return c.lateSpans.snapshot(top)
+}
+
+// countLateSpans records the spans of a trace that arrived after it was
+// decided at decidedAt.
+func (c *CentralCollector) countLateSpans(spans []*types.Span, decidedAt time.Time, kept bool) {
+	if decidedAt.IsZero() {
+		return
+	}
+	serviceField := c.Config.GetLateSpansConfig().ServiceField
+	var late int
+	for _, sp := range spans {
+		if !sp.ArrivalTime.After(decidedAt) {
+			continue
+		}
+		late++
+		lateness := sp.ArrivalTime.Sub(decidedAt)
+		service, _ := sp.Data[serviceField].(string)
+		c.lateSpans.record(sp.Dataset, service, lateness, kept)
+		metrics.HistogramWithExemplar(c.Metrics, "trace_late_span_lateness_ms", float64(lateness.Milliseconds()), sp.TraceID)
+	}
+	if kept {
+		c.Metrics.Count("trace_late_spans_kept", late)
+	} else {
+		c.Metrics.Count("trace_late_spans_dropped", late)
+	}
+}
+
+// countDroppedLateSpans records the late spans of a dropped trace before
+// it's removed from the cache.
+func (c *CentralCollector) countDroppedLateSpans(traceID string, decidedAt time.Time) {
+	if trace := c.SpanCache.Load(traceID); trace != nil {
+		c.countLateSpans(trace.GetSpans(), decidedAt, false)
+	}
+}
@@ -0,0 +1,76 @@
+package collect
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountLateSpans(t *testing.T) {
+	coll := &CentralCollector{
+		Config:  &config.MockConfig{LateSpans: config.LateSpansConfig{ServiceField: "service.name"}},
+		Metrics: &metrics.NullMetrics{},
+	}
+	decidedAt := time.Unix(1700000000, 0)
+	span := func(dataset string, service string, arrival time.Duration) *types.Span {
+		return &types.Span{
+			ArrivalTime: decidedAt.Add(arrival),
+			Event: types.Event{
+				Dataset: dataset,
+				Data:    map[string]interface{}{"service.name": service},
+			},
+		}
+	}
+
+	coll.countLateSpans([]*types.Span{
+		span("ds1", "api", -time.Second),
+		span("ds1", "api", 200*time.Millisecond),
+		span("ds1", "api", 3*time.Second),
+		span("ds2", "worker", time.Second),
+	}, decidedAt, true)
+	coll.countLateSpans([]*types.Span{
+		span("ds2", "worker", 500*time.Millisecond),
+		span("ds2", "worker", 100*time.Millisecond),
+	}, decidedAt, false)
+	// traces whose decision time isn't known aren't counted
+	coll.countLateSpans([]*types.Span{span("ds3", "db", time.Second)}, time.Time{}, false)
+
+	reports := coll.LateSpanReports(0)
+	require.Len(t, reports, 2)
+	assert.Equal(t, LateSpanReport{
+		lateSpanKey:     lateSpanKey{Dataset: "ds2", Service: "worker"},
+		Kept:            1,
+		Dropped:         2,
+		TotalLatenessMs: 1600,
+		MaxLatenessMs:   1000,
+	}, reports[0])
+	assert.Equal(t, LateSpanReport{
+		lateSpanKey:     lateSpanKey{Dataset: "ds1", Service: "api"},
+		Kept:            2,
+		TotalLatenessMs: 3200,
+		MaxLatenessMs:   3000,
+	}, reports[1])
+
+	assert.Len(t, coll.LateSpanReports(1), 1)
+}
+
+func TestLateSpanAccountingOverflow(t *testing.T) {
+	var a lateSpanAccounting
+	for i := 0; i < maxLateSpanEntries+5; i++ {
+		a.record("ds", "service"+strconv.Itoa(i), time.Millisecond, true)
+	}
+	reports := a.snapshot(0)
+	assert.Len(t, reports, maxLateSpanEntries+1)
+	assert.Equal(t, LateSpanReport{
+		lateSpanKey:     lateSpanKey{Dataset: lateSpanOverflowKey, Service: lateSpanOverflowKey},
+		Kept:            5,
+		TotalLatenessMs: 5,
+		MaxLatenessMs:   1,
+	}, reports[0])
+}
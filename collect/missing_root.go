@@ -0,0 +1,111 @@
+package collect
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// syntheticRootName is the name given to a span that stands in for a
+// missing root span.
+const syntheticRootName = "refinery.synthetic_root"
+
+// needsSyntheticRoot reports whether spans being sent for a trace without a
+// root span should have one made for them. Spans that all arrived after the
+// trace was decided are the rest of a trace whose first spans were already
+// sent, with their own stand-in.
+func needsSyntheticRoot(spans []*types.Span, decidedAt time.Time) bool {
+	for _, sp := range spans {
+		if decidedAt.IsZero() || !sp.ArrivalTime.After(decidedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesizeRoot makes a span to stand in for the missing root of a trace,
+// from a copy of the first of its spans that isn't a span event or link. The
+// root covers the time from the start of the earliest span to the end of the
+// latest, and records how many spans the trace has and the services they
+// came from.
+func synthesizeRoot(spans []*types.Span, ids types.IDGenerator, traceIDFields []string, spanIDFields []string, serviceField string) *types.Span {
+	if len(spans) == 0 {
+		return nil
+	}
+	first := spans[0]
+	for _, sp := range spans {
+		if sp.Data["meta.annotation_type"] == nil {
+			first = sp
+			break
+		}
+	}
+
+	var start, end time.Time
+	services := make(map[string]struct{})
+	for _, sp := range spans {
+		if service, ok := sp.Data[serviceField].(string); ok && service != "" {
+			services[service] = struct{}{}
+		}
+		if sp.Timestamp.IsZero() {
+			continue
+		}
+		spanEnd := sp.Timestamp
+		if d, ok := numericField(sp.Data["duration_ms"]); ok {
+			spanEnd = spanEnd.Add(time.Duration(d * float64(time.Millisecond)))
+		}
+		if start.IsZero() || sp.Timestamp.Before(start) {
+			start = sp.Timestamp
+		}
+		if spanEnd.After(end) {
+			end = spanEnd
+		}
+	}
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+
+	id := ids.NewSpanID(first.TraceID, "", syntheticRootName)
+	data := map[string]interface{}{
+		"name":                                  syntheticRootName,
+		"meta.refinery.synthetic_root":          true,
+		"meta.refinery.synthetic_root_spans":    len(spans),
+		"meta.refinery.synthetic_root_services": strings.Join(names, ","),
+	}
+	if traceID, field := firstStringField(first.Data, traceIDFields); field != "" {
+		data[field] = traceID
+	}
+	if _, field := firstStringField(first.Data, spanIDFields); field != "" {
+		data[field] = id
+	} else if len(spanIDFields) > 0 {
+		data[spanIDFields[0]] = id
+	}
+	if !start.IsZero() {
+		data["duration_ms"] = float64(end.Sub(start)) / float64(time.Millisecond)
+	}
+	if service, ok := first.Data[serviceField]; ok {
+		data[serviceField] = service
+	}
+
+	root := &types.Span{
+		Event: types.Event{
+			APIHost:     first.APIHost,
+			APIKey:      first.APIKey,
+			Dataset:     first.Dataset,
+			Environment: first.Environment,
+			SampleRate:  first.SampleRate,
+			Timestamp:   start,
+			Data:        data,
+		},
+		TraceID: first.TraceID,
+		ID:      id,
+		IsRoot:  true,
+	}
+	if root.Timestamp.IsZero() {
+		root.Timestamp = first.Timestamp
+	}
+	return root
+}
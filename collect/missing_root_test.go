@@ -0,0 +1,63 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSynthesizeRoot(t *testing.T) {
+	spans := []*types.Span{
+		reductionTestSpan("a", "missing", "GET /orders", 10*time.Millisecond, 100),
+		reductionTestSpan("b", "a", "query", 20*time.Millisecond, 200),
+		reductionTestSpan("c", "missing", "publish", 0, 5),
+	}
+	spans[0].Data["service.name"] = "api"
+	spans[1].Data["service.name"] = "db"
+	spans[2].Data["service.name"] = "api"
+	for _, sp := range spans {
+		sp.Dataset = "ds"
+		sp.Data["trace.trace_id"] = "trace"
+	}
+	// a span event isn't used as the template for the root
+	event := reductionTestSpan("e", "a", "exception", 0, 0)
+	event.Data["meta.annotation_type"] = "span_event"
+	spans = append([]*types.Span{event}, spans...)
+
+	root := synthesizeRoot(spans, types.DerivedIDGenerator{}, []string{"trace.trace_id"}, []string{"trace.span_id"}, "service.name")
+	require.NotNil(t, root)
+	assert.True(t, root.IsRoot)
+	assert.Equal(t, "trace", root.TraceID)
+	assert.Equal(t, "ds", root.Dataset)
+	assert.Equal(t, root.ID, root.Data["trace.span_id"])
+	assert.Equal(t, "trace", root.Data["trace.trace_id"])
+	assert.Nil(t, root.Data["trace.parent_id"])
+	assert.Equal(t, syntheticRootName, root.Data["name"])
+	assert.Equal(t, true, root.Data["meta.refinery.synthetic_root"])
+	assert.Equal(t, 4, root.Data["meta.refinery.synthetic_root_spans"])
+	assert.Equal(t, "api,db", root.Data["meta.refinery.synthetic_root_services"])
+	// from the start of the earliest span to the end of the latest
+	assert.Equal(t, spans[0].Timestamp, root.Timestamp)
+	assert.Equal(t, 220.0, root.Data["duration_ms"])
+
+	// the spans whose parent is missing can be attached to it
+	orphans := findOrphans(append(spans, root), []string{"trace.span_id"}, []string{"trace.parent_id"})
+	require.Len(t, orphans, 2)
+	assert.True(t, reparentOrphans(root, orphans, []string{"trace.span_id"}, []string{"trace.parent_id"}))
+	assert.Equal(t, root.ID, spans[1].Data["trace.parent_id"])
+
+	assert.Nil(t, synthesizeRoot(nil, types.DerivedIDGenerator{}, nil, nil, "service.name"))
+}
+
+func TestNeedsSyntheticRoot(t *testing.T) {
+	decidedAt := time.Unix(1700000000, 0)
+	early := &types.Span{ArrivalTime: decidedAt.Add(-time.Second)}
+	late := &types.Span{ArrivalTime: decidedAt.Add(time.Second)}
+
+	assert.True(t, needsSyntheticRoot([]*types.Span{early, late}, decidedAt))
+	assert.False(t, needsSyntheticRoot([]*types.Span{late}, decidedAt), "the rest of a trace that was already sent")
+	assert.True(t, needsSyntheticRoot([]*types.Span{late}, time.Time{}))
+}
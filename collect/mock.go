@@ -0,0 +1,49 @@
+package collect
+
+import (
+	"context"
+	"sync"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+var _ Collector = (*MockCollector)(nil)
+
+// MockCollector is a Collector for tests that remembers the spans it's given
+// and does nothing else.
+type MockCollector struct {
+	mut   sync.Mutex
+	Spans []*types.Span
+}
+
+func (m *MockCollector) AddSpan(sp *types.Span) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.Spans = append(m.Spans, sp)
+	return nil
+}
+
+// GetSpans returns a copy of the spans added so far.
+func (m *MockCollector) GetSpans() []*types.Span {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return append([]*types.Span(nil), m.Spans...)
+}
+
+func (m *MockCollector) Stressed() bool { return false }
+
+func (m *MockCollector) ProcessSpanImmediately(*types.Span) (bool, error) { return false, nil }
+
+func (m *MockCollector) Saturation() (float64, float64) { return 0, 0 }
+
+func (m *MockCollector) PreviewSample(*types.Trace, string) (SamplePreview, error) {
+	return SamplePreview{}, nil
+}
+
+func (m *MockCollector) LateSpanReports(int) []LateSpanReport { return nil }
+
+func (m *MockCollector) Evictions(int) []EvictionEvent { return nil }
+
+func (m *MockCollector) InFlight() int { return 0 }
+
+func (m *MockCollector) ForwardInFlight(context.Context) (int, error) { return 0, nil }
@@ -0,0 +1,52 @@
+package collect
+
+import (
+	"github.com/honeycombio/refinery/types"
+)
+
+// findOrphans returns the spans in a trace whose parent span isn't part of
+// the trace. Span events and links are not included, since they belong to a
+// particular span and can't be moved.
+func findOrphans(spans []*types.Span, spanIDFields []string, parentIDFields []string) []*types.Span {
+	spanIDs := make(map[string]struct{}, len(spans))
+	for _, sp := range spans {
+		if spanID, _ := firstStringField(sp.Data, spanIDFields); spanID != "" {
+			spanIDs[spanID] = struct{}{}
+		}
+	}
+
+	var orphans []*types.Span
+	for _, sp := range spans {
+		if sp.IsRoot || sp.Data["meta.annotation_type"] != nil {
+			continue
+		}
+		parentID, _ := firstStringField(sp.Data, parentIDFields)
+		if parentID == "" {
+			continue
+		}
+		if _, ok := spanIDs[parentID]; !ok {
+			orphans = append(orphans, sp)
+		}
+	}
+	return orphans
+}
+
+// reparentOrphans makes each orphan a child of the root span, and records
+// the parent it used to have. It returns false if the root span has no ID to
+// attach them to.
+func reparentOrphans(root *types.Span, orphans []*types.Span, spanIDFields []string, parentIDFields []string) bool {
+	if root == nil {
+		return false
+	}
+	rootID, _ := firstStringField(root.Data, spanIDFields)
+	if rootID == "" {
+		return false
+	}
+	for _, sp := range orphans {
+		parentID, field := firstStringField(sp.Data, parentIDFields)
+		sp.Data[field] = rootID
+		sp.Data["meta.refinery.reparented"] = true
+		sp.Data["meta.refinery.original_parent_id"] = parentID
+	}
+	return true
+}
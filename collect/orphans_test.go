@@ -0,0 +1,34 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReparentOrphans(t *testing.T) {
+	root := reductionTestSpan("root", "", "GET /", 0, 10)
+	child := reductionTestSpan("child", "root", "handler", 0, 5)
+	orphan := reductionTestSpan("orphan", "missing", "query", 0, 1)
+	orphanChild := reductionTestSpan("orphan-child", "orphan", "fetch", 0, 1)
+	event := reductionTestSpan("", "missing", "exception", 0, 0)
+	event.Data["meta.annotation_type"] = "span_event"
+	spans := []*types.Span{root, child, orphan, orphanChild, event}
+
+	orphans := findOrphans(spans, []string{"trace.span_id"}, []string{"trace.parent_id"})
+	require.Equal(t, []*types.Span{orphan}, orphans)
+
+	require.True(t, reparentOrphans(root, orphans, []string{"trace.span_id"}, []string{"trace.parent_id"}))
+	assert.Equal(t, "root", orphan.Data["trace.parent_id"])
+	assert.Equal(t, true, orphan.Data["meta.refinery.reparented"])
+	assert.Equal(t, "missing", orphan.Data["meta.refinery.original_parent_id"])
+	assert.Equal(t, "orphan", orphanChild.Data["trace.parent_id"])
+	assert.Equal(t, "missing", event.Data["trace.parent_id"])
+
+	assert.Empty(t, findOrphans(spans, []string{"trace.span_id"}, []string{"trace.parent_id"}))
+
+	// without a root, there's nowhere to put them
+	assert.False(t, reparentOrphans(nil, orphans, []string{"trace.span_id"}, []string{"trace.parent_id"}))
+}
@@ -0,0 +1,58 @@
+package collect
+
+import (
+	"fmt"
+
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+)
+
+// SamplePreview is the decision that a sampler would make about a trace.
+type SamplePreview struct {
+	// Sampler is the selector of the sampler that made the decision.
+	Sampler string `json:"sampler"`
+	Keep    bool   `json:"keep"`
+	Rate    uint   `json:"rate"`
+	Reason  string `json:"reason"`
+	Key     string `json:"key,omitempty"`
+	// DryRun is what the first dry run rule that matched the trace would
+	// have decided, if one did.
+	DryRun *DryRunPreview `json:"dry_run,omitempty"`
+}
+
+type DryRunPreview struct {
+	Keep   bool   `json:"keep"`
+	Rate   uint   `json:"rate"`
+	Reason string `json:"reason"`
+}
+
+// PreviewSample returns the decision that the current rules for a trace
+// would make about it, without recording or sending anything. The selector
+// chooses the sampler, and must name a target in the rules; if it's empty,
+// the sampler is chosen as for a live trace. The decision is made by a new
+// sampler that is thrown away afterwards, so previews don't change what
+// live samplers have learned, but samplers that adjust their rates to
+// traffic decide as they would when they've seen none.
+func (c *CentralCollector) PreviewSample(trace *types.Trace, selector string) (SamplePreview, error) {
+	if selector == "" {
+		selector = c.samplerSelector(trace)
+	} else if !c.Config.GetAllSamplerRules().HasTarget(selector) {
+		return SamplePreview{}, fmt.Errorf("no sampler named '%s' in the rules", selector)
+	}
+	preview := SamplePreview{Sampler: selector}
+
+	sampler := c.SamplerFactory.NewDetachedSampler(selector)
+	if sampler == nil {
+		preview.Reason = "no sampler"
+		return preview, nil
+	}
+	defer sample.StopSampler(sampler)
+
+	_, spanIDFields, parentIDFields := c.idFieldNames(trace.Dataset)
+	tr := c.wrapForDecision(sample.NewIDFieldsTrace(trace, spanIDFields, parentIDFields))
+	preview.Rate, preview.Keep, preview.Reason, preview.Key = sampler.GetSampleRate(tr)
+	if tr.Matched {
+		preview.DryRun = &DryRunPreview{Keep: tr.Keep, Rate: tr.Rate, Reason: tr.Reason}
+	}
+	return preview, nil
+}
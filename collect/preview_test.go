@@ -0,0 +1,66 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewSample(t *testing.T) {
+	conf := &config.MockConfig{
+		GetSamplerTypeVal: &config.RulesBasedSamplerConfig{
+			Rules: []*config.RulesBasedSamplerRule{
+				{
+					Name:   "drop health checks",
+					Drop:   true,
+					DryRun: true,
+					Conditions: []*config.RulesBasedSamplerCondition{
+						{Field: "http.route", Operator: config.EQ, Value: "/health"},
+					},
+				},
+				{Name: "keep everything", SampleRate: 1},
+			},
+		},
+	}
+	coll := &CentralCollector{
+		Config: conf,
+		SamplerFactory: &sample.SamplerFactory{
+			Config:  conf,
+			Logger:  &logger.NullLogger{},
+			Metrics: &metrics.NullMetrics{},
+		},
+		samplersByDestination: make(map[string]sample.Sampler),
+	}
+
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{Event: types.Event{
+		Environment: "production",
+		Data:        map[string]interface{}{"http.route": "/health"},
+	}})
+
+	preview, err := coll.PreviewSample(trace, "")
+	require.NoError(t, err)
+	assert.Equal(t, SamplePreview{
+		Sampler: "production",
+		Keep:    true,
+		Rate:    1,
+		Reason:  "rules/trace/keep everything",
+		DryRun:  &DryRunPreview{Keep: false, Rate: 0, Reason: "rules/trace/drop health checks"},
+	}, preview)
+
+	// the sampler can be chosen explicitly, if it's in the rules
+	preview, err = coll.PreviewSample(trace, "dataset1")
+	require.NoError(t, err)
+	assert.Equal(t, "dataset1", preview.Sampler)
+	_, err = coll.PreviewSample(trace, "staging")
+	assert.Error(t, err)
+
+	// previews don't make or change the live samplers
+	assert.Empty(t, coll.samplersByDestination)
+}
@@ -0,0 +1,114 @@
+package collect
+
+import (
+	"context"
+	"runtime/metrics"
+	"time"
+)
+
+// gcPollInterval is how often the heap is checked while waiting for a
+// garbage collection to finish.
+const gcPollInterval = time.Millisecond
+
+// heapStats is what send pacing needs to know about the heap.
+type heapStats struct {
+	// used is the size of the live and not yet swept heap objects
+	used uint64
+	// goal is the heap size at which the next garbage collection finishes
+	goal uint64
+	// cycles is the number of garbage collections completed
+	cycles uint64
+}
+
+// readHeapStats reads the heap statistics from the runtime, without stopping
+// the world the way runtime.ReadMemStats does.
+func readHeapStats() heapStats {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/gc/heap/goal:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+	}
+	metrics.Read(samples)
+
+	var stats heapStats
+	for i, dest := range []*uint64{&stats.used, &stats.goal, &stats.cycles} {
+		if samples[i].Value.Kind() == metrics.KindUint64 {
+			*dest = samples[i].Value.Uint64()
+		}
+	}
+	return stats
+}
+
+// paceSends calls send for each of n kept traces, a batch at a time, with the
+// batches spread over window. Before each batch, if the heap is close to the
+// point where the next garbage collection is due, it waits for that
+// collection to finish, so that the allocations made by sending don't pile
+// onto it. The traces are all sent even if ctx is done; it only stops the
+// pauses.
+func (c *CentralCollector) paceSends(ctx context.Context, n int, window time.Duration, send func(i int)) {
+	cfg := c.Config.GetSendPacingConfig()
+	batchSize := max(cfg.BatchSize, 1)
+	if !cfg.Enabled || n <= batchSize {
+		for i := 0; i < n; i++ {
+			send(i)
+		}
+		return
+	}
+
+	readHeap := c.readHeapStats
+	if readHeap == nil {
+		readHeap = readHeapStats
+	}
+	numBatches := (n + batchSize - 1) / batchSize
+	interval := window / time.Duration(numBatches)
+	start := c.Clock.Now()
+
+	for batch := 0; batch < numBatches; batch++ {
+		if batch > 0 && ctx.Err() == nil {
+			// each batch has its own slot in the window, so that the time
+			// spent sending is part of the pause rather than added to it
+			if wait := start.Add(time.Duration(batch) * interval).Sub(c.Clock.Now()); wait > 0 {
+				c.sleep(ctx, wait)
+			}
+			c.waitForGC(ctx, readHeap, cfg.HeapWatermark, time.Duration(cfg.MaxGCWait))
+		}
+		end := min((batch+1)*batchSize, n)
+		for i := batch * batchSize; i < end; i++ {
+			send(i)
+		}
+	}
+	c.Metrics.Histogram("collector_send_pacing_ms", float64(c.Clock.Since(start).Milliseconds()))
+}
+
+// waitForGC waits, for up to maxWait, for a garbage collection to finish if
+// the heap has reached watermark percent of the size at which one is due.
+func (c *CentralCollector) waitForGC(ctx context.Context, readHeap func() heapStats, watermark int, maxWait time.Duration) {
+	stats := readHeap()
+	if watermark <= 0 || maxWait <= 0 || !overWatermark(stats, watermark) {
+		return
+	}
+	c.Metrics.Increment("collector_send_pacing_gc_waits")
+	deadline := c.Clock.Now().Add(maxWait)
+	for c.Clock.Now().Before(deadline) && ctx.Err() == nil {
+		c.sleep(ctx, min(gcPollInterval, deadline.Sub(c.Clock.Now())))
+		current := readHeap()
+		if current.cycles != stats.cycles || !overWatermark(current, watermark) {
+			return
+		}
+	}
+	c.Metrics.Increment("collector_send_pacing_gc_timeouts")
+}
+
+// overWatermark reports whether the heap is at least watermark percent of its
+// goal.
+func overWatermark(stats heapStats, watermark int) bool {
+	return stats.goal > 0 && stats.used*100 >= stats.goal*uint64(watermark)
+}
+
+// sleep waits for d, or until ctx is done.
+func (c *CentralCollector) sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-c.Clock.After(d):
+	}
+}
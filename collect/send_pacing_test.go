@@ -0,0 +1,94 @@
+package collect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaceSends(t *testing.T) {
+	cfg := &config.MockConfig{}
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	heap := heapStats{used: 10, goal: 100}
+	coll := &CentralCollector{
+		Config:        cfg,
+		Clock:         clockwork.NewRealClock(),
+		Metrics:       mockMetrics,
+		readHeapStats: func() heapStats { return heap },
+	}
+
+	var sent []int
+	send := func(i int) { sent = append(sent, i) }
+
+	// without pacing, everything is sent at once
+	start := time.Now()
+	coll.paceSends(context.Background(), 10, time.Second, send)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, sent)
+
+	// with pacing, the batches are spread over the window
+	cfg.SendPacing = config.SendPacingConfig{Enabled: true, BatchSize: 3, HeapWatermark: 90, MaxGCWait: config.Duration(20 * time.Millisecond)}
+	sent = nil
+	start = time.Now()
+	coll.paceSends(context.Background(), 10, 80*time.Millisecond, send)
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, sent)
+	assert.Equal(t, 0, mockMetrics.CounterIncrements["collector_send_pacing_gc_waits"])
+
+	// a cancelled context stops the pauses, but not the sends
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sent = nil
+	start = time.Now()
+	coll.paceSends(ctx, 10, time.Second, send)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Len(t, sent, 10)
+}
+
+func TestWaitForGC(t *testing.T) {
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	coll := &CentralCollector{Clock: clockwork.NewRealClock(), Metrics: mockMetrics}
+	ctx := context.Background()
+
+	// below the watermark there's no wait
+	below := func() heapStats { return heapStats{used: 50, goal: 100, cycles: 1} }
+	coll.waitForGC(ctx, below, 90, time.Second)
+	assert.Equal(t, 0, mockMetrics.CounterIncrements["collector_send_pacing_gc_waits"])
+
+	// above it, the wait ends when a collection finishes
+	stats := heapStats{used: 95, goal: 100, cycles: 1}
+	reads := 0
+	collecting := func() heapStats {
+		reads++
+		if reads > 3 {
+			stats.cycles = 2
+		}
+		return stats
+	}
+	start := time.Now()
+	coll.waitForGC(ctx, collecting, 90, time.Second)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["collector_send_pacing_gc_waits"])
+	assert.Equal(t, 0, mockMetrics.CounterIncrements["collector_send_pacing_gc_timeouts"])
+
+	// or when it has waited long enough
+	above := func() heapStats { return heapStats{used: 95, goal: 100, cycles: 1} }
+	start = time.Now()
+	coll.waitForGC(ctx, above, 90, 20*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, 2, mockMetrics.CounterIncrements["collector_send_pacing_gc_waits"])
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["collector_send_pacing_gc_timeouts"])
+}
+
+func TestReadHeapStats(t *testing.T) {
+	stats := readHeapStats()
+	assert.NotZero(t, stats.used)
+	assert.NotZero(t, stats.goal)
+}
@@ -0,0 +1,75 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/honeycombio/refinery/collect/cache"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/honeycombio/refinery/types"
+)
+
+// defaultSnapshotFile is the name of the snapshot file in the temporary
+// directory, if no path is configured.
+const defaultSnapshotFile = "refinery-traces.snapshot"
+
+// snapshotPath returns the file that in-flight traces are written to.
+func snapshotPath(cfg config.StateSnapshotConfig) string {
+	if cfg.Path != "" {
+		return cfg.Path
+	}
+	return filepath.Join(os.TempDir(), defaultSnapshotFile)
+}
+
+// writeSnapshot writes the spans of every trace in the cache to the snapshot
+// file, so that they can be restored when refinery starts again, and returns
+// the number of traces written.
+func (c *CentralCollector) writeSnapshot(ctx context.Context) (int, error) {
+	cfg := c.Config.GetStateSnapshotConfig()
+	_, span := otelutil.StartSpanWith(ctx, c.Tracer, "CentralCollector.writeSnapshot", "span_cache_len", c.SpanCache.Len())
+	defer span.End()
+
+	ids := c.SpanCache.GetTraceIDs(c.SpanCache.Len())
+	traces := make([]*types.Trace, 0, len(ids))
+	for _, id := range ids {
+		if trace := c.SpanCache.Load(id); trace != nil {
+			traces = append(traces, trace)
+		}
+	}
+	numSpans, err := cache.WriteSnapshot(snapshotPath(cfg), traces, c.Clock.Now())
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+	otelutil.AddSpanFields(span, map[string]interface{}{
+		"num_traces": len(traces),
+		"num_spans":  numSpans,
+	})
+	return len(traces), nil
+}
+
+// restoreSnapshot adds the spans of the traces that were in flight when
+// refinery last shut down back into the cache, and returns the number of
+// spans restored. Their statuses are still in the central store, so they
+// aren't written to it again.
+func (c *CentralCollector) restoreSnapshot() (int, error) {
+	cfg := c.Config.GetStateSnapshotConfig()
+	spans, err := cache.ReadSnapshot(snapshotPath(cfg), c.Clock.Now(), time.Duration(cfg.MaxAge))
+	if err != nil {
+		return 0, err
+	}
+	var restored int
+	var errs []error
+	for _, sp := range spans {
+		if err := c.SpanCache.Set(sp); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		restored++
+	}
+	return restored, errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package collect
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect/cache"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.snapshot")
+	cfg := &config.MockConfig{
+		GetTraceTimeoutVal: 10 * time.Second,
+		StateSnapshot:      config.StateSnapshotConfig{Enabled: true, Path: path, MaxAge: config.Duration(time.Minute)},
+	}
+	clock := clockwork.NewFakeClock()
+	newCollector := func() *CentralCollector {
+		spanCache := &cache.SpanCache_basic{Cfg: cfg, Clock: clock, Metrics: &metrics.NullMetrics{}}
+		require.NoError(t, spanCache.Start())
+		return &CentralCollector{Config: cfg, Clock: clock, Tracer: noop.Tracer{}, SpanCache: spanCache}
+	}
+
+	before := newCollector()
+	root := &types.Span{TraceID: "t1", ID: "root", IsRoot: true, Event: types.Event{Dataset: "ds", Data: map[string]interface{}{"name": "root"}}}
+	child := &types.Span{TraceID: "t1", ID: "child", Event: types.Event{Dataset: "ds", Data: map[string]interface{}{"trace.parent_id": "root"}}}
+	other := &types.Span{TraceID: "t2", ID: "other", Event: types.Event{Dataset: "ds", Data: map[string]interface{}{"count": int64(3)}}}
+	for _, sp := range []*types.Span{root, child, other} {
+		require.NoError(t, before.SpanCache.Set(sp))
+	}
+	numTraces, err := before.writeSnapshot(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, numTraces)
+
+	after := newCollector()
+	clock.Advance(10 * time.Second)
+	restored, err := after.restoreSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, 3, restored)
+	assert.Equal(t, 2, after.SpanCache.Len())
+	trace := after.SpanCache.Get("t1")
+	require.NotNil(t, trace)
+	assert.Len(t, trace.GetSpans(), 2)
+	require.NotNil(t, trace.RootSpan)
+	assert.Equal(t, "root", trace.RootSpan.ID)
+	assert.Equal(t, int64(3), after.SpanCache.Get("t2").GetSpans()[0].Data["count"])
+
+	// the snapshot is only restored once
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	restored, err = newCollector().restoreSnapshot()
+	require.NoError(t, err)
+	assert.Zero(t, restored)
+
+	// a snapshot that's too old isn't restored
+	_, err = before.writeSnapshot(context.Background())
+	require.NoError(t, err)
+	clock.Advance(2 * time.Minute)
+	stale := newCollector()
+	restored, err = stale.restoreSnapshot()
+	assert.ErrorIs(t, err, cache.ErrStaleSnapshot)
+	assert.Zero(t, restored)
+	assert.Zero(t, stale.SpanCache.Len())
+}
@@ -0,0 +1,65 @@
+package collect
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/dgryski/go-wyhash"
+	"github.com/honeycombio/refinery/types"
+)
+
+// spanDedupSeed is the seed for hashing spans to find duplicates.
+const spanDedupSeed = 0xd0b1e5
+
+// isDuplicateSpan reports whether a span is an exact duplicate of one that
+// was already added to its trace, and otherwise records it in the trace's
+// filter. The first span of a trace is recorded once its trace is made.
+// Every span the filter drops is counted, including those it mistakes for
+// duplicates, since the two can't be told apart.
+func (c *CentralCollector) isDuplicateSpan(trace *types.Trace, spanHash uint64) bool {
+	if trace == nil {
+		return false
+	}
+	if !trace.SeenSpan(spanHash, c.Config.GetSpanDedupConfig().FilterBits) {
+		return false
+	}
+	c.Metrics.Increment("span_duplicates_dropped")
+	return true
+}
+
+// spanDedupHash hashes a span's ID, from the first of spanIDFields in its
+// data, together with a checksum of its fields, leaving out the ignored
+// fields. The checksum doesn't depend on the order of the fields. The ID
+// that Refinery gives each span when it arrives is different for a retried
+// copy, so it isn't used.
+func spanDedupHash(sp *types.Span, ignored []string, spanIDFields []string) uint64 {
+	var checksum uint64
+	for k, v := range sp.Data {
+		if slices.Contains(ignored, k) {
+			continue
+		}
+		checksum += wyhash.Hash([]byte(k+"\x00"+fieldString(v)), spanDedupSeed)
+	}
+	id, _ := firstStringField(sp.Data, spanIDFields)
+	return wyhash.Hash([]byte(id), checksum)
+}
+
+// fieldString formats a field value for hashing, avoiding fmt for the
+// common types.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
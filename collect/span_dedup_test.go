@@ -0,0 +1,49 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanDedupHash(t *testing.T) {
+	span := func(id string, data map[string]interface{}) *types.Span {
+		data["trace.span_id"] = id
+		// the ID Refinery gives a span when it arrives is different for each
+		// copy
+		return &types.Span{ID: types.GenerateSpanID(), Event: types.Event{Data: data}}
+	}
+	spanIDFields := []string{"span_id", "trace.span_id"}
+	base := spanDedupHash(span("s1", map[string]interface{}{"name": "get", "duration_ms": 12.5, "status": 200}), nil, spanIDFields)
+
+	// the same span is recognized whatever order its fields are in
+	assert.Equal(t, base, spanDedupHash(span("s1", map[string]interface{}{"status": 200, "duration_ms": 12.5, "name": "get"}), nil, spanIDFields))
+	// a different ID or field value isn't a duplicate
+	assert.NotEqual(t, base, spanDedupHash(span("s2", map[string]interface{}{"name": "get", "duration_ms": 12.5, "status": 200}), nil, spanIDFields))
+	assert.NotEqual(t, base, spanDedupHash(span("s1", map[string]interface{}{"name": "get", "duration_ms": 12.6, "status": 200}), nil, spanIDFields))
+	// values are hashed with their field names
+	assert.NotEqual(t,
+		spanDedupHash(span("s1", map[string]interface{}{"a": "x", "b": "y"}), nil, spanIDFields),
+		spanDedupHash(span("s1", map[string]interface{}{"a": "y", "b": "x"}), nil, spanIDFields))
+	// ignored fields can differ
+	assert.Equal(t, base, spanDedupHash(span("s1", map[string]interface{}{"name": "get", "duration_ms": 12.5, "status": 200, "retry_at": 3}), []string{"retry_at"}, spanIDFields))
+}
+
+func TestIsDuplicateSpan(t *testing.T) {
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	coll := &CentralCollector{
+		Config:  &config.MockConfig{SpanDedup: config.SpanDedupConfig{Enabled: true, FilterBits: 8192}},
+		Metrics: mockMetrics,
+	}
+
+	assert.False(t, coll.isDuplicateSpan(nil, 1), "a span of a new trace isn't a duplicate")
+	trace := &types.Trace{}
+	assert.False(t, coll.isDuplicateSpan(trace, 1))
+	assert.False(t, coll.isDuplicateSpan(trace, 2))
+	assert.True(t, coll.isDuplicateSpan(trace, 1))
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["span_duplicates_dropped"])
+}
@@ -0,0 +1,151 @@
+package collect
+
+import (
+	"math"
+	"sort"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+)
+
+// spanGroupKey identifies spans that are siblings with the same name.
+type spanGroupKey struct {
+	parentID string
+	name     string
+}
+
+// reduceSpans thins out repetitive spans in a kept trace. Spans that share a
+// parent and a name are limited to the cap for that name, keeping the
+// earliest. Root spans, spans with children, and spans whose IDs can't be
+// found are never dropped, so the structure of the trace is preserved. If
+// the config asks for it, each group of dropped spans is replaced with a
+// single summary span, whose ID comes from ids. It returns the spans to send
+// and the number dropped.
+func reduceSpans(spans []*types.Span, cfg config.SpanReductionConfig, ids types.IDGenerator, spanIDFields []string, parentIDFields []string) ([]*types.Span, int) {
+	// any span that is some other span's parent must be kept
+	parents := make(map[string]struct{})
+	for _, sp := range spans {
+		if parentID, _ := firstStringField(sp.Data, parentIDFields); parentID != "" {
+			parents[parentID] = struct{}{}
+		}
+	}
+
+	groups := make(map[spanGroupKey][]*types.Span)
+	for _, sp := range spans {
+		if sp.IsRoot || sp.Data["meta.annotation_type"] != nil {
+			continue
+		}
+		spanID, _ := firstStringField(sp.Data, spanIDFields)
+		if spanID == "" {
+			continue
+		}
+		if _, hasChildren := parents[spanID]; hasChildren {
+			continue
+		}
+		parentID, _ := firstStringField(sp.Data, parentIDFields)
+		name, _ := sp.Data[cfg.NameField].(string)
+		if parentID == "" || name == "" || cfg.CapFor(name) <= 0 {
+			continue
+		}
+		key := spanGroupKey{parentID: parentID, name: name}
+		groups[key] = append(groups[key], sp)
+	}
+
+	dropped := make(map[*types.Span]struct{})
+	var summaries []*types.Span
+	for key, group := range groups {
+		limit := cfg.CapFor(key.name)
+		if len(group) <= limit {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Timestamp.Before(group[j].Timestamp)
+		})
+		for _, sp := range group[limit:] {
+			dropped[sp] = struct{}{}
+		}
+		if cfg.GetAddSummarySpan() {
+			summaries = append(summaries, summarizeSpans(group[limit:], key, ids, spanIDFields))
+		}
+	}
+	if len(dropped) == 0 {
+		return spans, 0
+	}
+
+	kept := make([]*types.Span, 0, len(spans)-len(dropped)+len(summaries))
+	for _, sp := range spans {
+		if _, ok := dropped[sp]; !ok {
+			kept = append(kept, sp)
+		}
+	}
+	// map iteration order is random, so sort the summaries to keep the
+	// order that spans are sent in stable
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Timestamp.Before(summaries[j].Timestamp)
+	})
+	return append(kept, summaries...), len(dropped)
+}
+
+// summarizeSpans makes a span that stands in for the given spans. It is a
+// copy of the first of them, with a new span ID and fields describing the
+// whole group.
+func summarizeSpans(group []*types.Span, key spanGroupKey, ids types.IDGenerator, spanIDFields []string) *types.Span {
+	first := group[0]
+	data := make(map[string]interface{}, len(first.Data)+4)
+	for k, v := range first.Data {
+		data[k] = v
+	}
+	id := ids.NewSpanID(first.TraceID, key.parentID, key.name)
+	if _, field := firstStringField(first.Data, spanIDFields); field != "" {
+		data[field] = id
+	}
+	data["meta.refinery.reduced_span_count"] = len(group)
+
+	total, shortest, longest := 0.0, math.Inf(1), math.Inf(-1)
+	var haveDurations bool
+	for _, sp := range group {
+		d, ok := numericField(sp.Data["duration_ms"])
+		if !ok {
+			continue
+		}
+		haveDurations = true
+		total += d
+		shortest = math.Min(shortest, d)
+		longest = math.Max(longest, d)
+	}
+	if haveDurations {
+		data["meta.refinery.reduced_duration_ms_total"] = total
+		data["meta.refinery.reduced_duration_ms_min"] = shortest
+		data["meta.refinery.reduced_duration_ms_max"] = longest
+	}
+
+	summary := *first
+	summary.Data = data
+	summary.ID = id
+	return &summary
+}
+
+// firstStringField returns the first non-empty string found in the named
+// fields, and the name of the field it was found in.
+func firstStringField(data map[string]interface{}, fields []string) (string, string) {
+	for _, field := range fields {
+		if s, ok := data[field].(string); ok && s != "" {
+			return s, field
+		}
+	}
+	return "", ""
+}
+
+func numericField(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
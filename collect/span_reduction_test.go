@@ -0,0 +1,91 @@
+package collect
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reductionTestSpan(id string, parentID string, name string, offset time.Duration, duration float64) *types.Span {
+	data := map[string]interface{}{
+		"trace.span_id": id,
+		"name":          name,
+		"duration_ms":   duration,
+	}
+	if parentID != "" {
+		data["trace.parent_id"] = parentID
+	}
+	return &types.Span{
+		TraceID: "trace",
+		ID:      id,
+		IsRoot:  parentID == "",
+		Event: types.Event{
+			Timestamp: time.Unix(1700000000, 0).Add(offset),
+			Data:      data,
+		},
+	}
+}
+
+func TestReduceSpans(t *testing.T) {
+	spans := []*types.Span{
+		reductionTestSpan("root", "", "GET /orders", 0, 500),
+		reductionTestSpan("handler", "root", "handler", time.Millisecond, 400),
+	}
+	// the queries arrive out of order; the earliest ones should be kept
+	for i := 9; i >= 0; i-- {
+		spans = append(spans, reductionTestSpan(fmt.Sprintf("q%d", i), "handler", "SELECT", time.Duration(i+2)*time.Millisecond, float64(i+1)))
+	}
+	// a span with a child is never dropped, even if it's over the cap
+	spans = append(spans, reductionTestSpan("q-parent", "handler", "SELECT", time.Second, 1))
+	spans = append(spans, reductionTestSpan("q-child", "q-parent", "fetch", time.Second, 1))
+	// siblings under another parent are counted separately
+	spans = append(spans, reductionTestSpan("other", "root", "SELECT", 0, 1))
+
+	cfg := config.SpanReductionConfig{
+		NameField: "name",
+		Caps:      map[string]int{"SELECT": 3, "handler": 0},
+	}
+	reduced, dropped := reduceSpans(spans, cfg, types.RandomIDGenerator{}, []string{"trace.span_id"}, []string{"trace.parent_id"})
+	assert.Equal(t, 7, dropped)
+	require.Len(t, reduced, len(spans)-7+1)
+
+	ids := make([]string, 0, len(reduced))
+	for _, sp := range reduced[:len(reduced)-1] {
+		ids = append(ids, sp.Data["trace.span_id"].(string))
+	}
+	assert.ElementsMatch(t, []string{"root", "handler", "q2", "q1", "q0", "q-parent", "q-child", "other"}, ids)
+
+	summary := reduced[len(reduced)-1]
+	assert.Equal(t, "handler", summary.Data["trace.parent_id"])
+	assert.Equal(t, "SELECT", summary.Data["name"])
+	assert.Equal(t, summary.ID, summary.Data["trace.span_id"])
+	assert.NotEqual(t, "q3", summary.ID)
+	assert.Equal(t, 7, summary.Data["meta.refinery.reduced_span_count"])
+	assert.Equal(t, 4.0+5+6+7+8+9+10, summary.Data["meta.refinery.reduced_duration_ms_total"])
+	assert.Equal(t, 4.0, summary.Data["meta.refinery.reduced_duration_ms_min"])
+	assert.Equal(t, 10.0, summary.Data["meta.refinery.reduced_duration_ms_max"])
+	// the original span is untouched
+	assert.Equal(t, "q3", spans[8].Data["trace.span_id"])
+
+	// derived IDs are the same each time the spans are reduced
+	reduced, _ = reduceSpans(spans, cfg, types.DerivedIDGenerator{}, []string{"trace.span_id"}, []string{"trace.parent_id"})
+	again, _ := reduceSpans(spans, cfg, types.DerivedIDGenerator{}, []string{"trace.span_id"}, []string{"trace.parent_id"})
+	assert.Equal(t, reduced[len(reduced)-1].ID, again[len(again)-1].ID)
+
+	// without summaries, the spans are just dropped
+	noSummary := false
+	cfg.AddSummarySpan = (*config.DefaultTrue)(&noSummary)
+	reduced, dropped = reduceSpans(spans, cfg, types.RandomIDGenerator{}, []string{"trace.span_id"}, []string{"trace.parent_id"})
+	assert.Equal(t, 7, dropped)
+	assert.Len(t, reduced, len(spans)-7)
+
+	// nothing is dropped when no caps apply
+	reduced, dropped = reduceSpans(spans, config.SpanReductionConfig{NameField: "name", DefaultCap: 100}, types.RandomIDGenerator{}, []string{"trace.span_id"}, []string{"trace.parent_id"})
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, spans, reduced)
+}
@@ -0,0 +1,37 @@
+package collect
+
+import (
+	"slices"
+
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+)
+
+// summarizeSpan keeps only a summary of a span in memory, if its target is
+// one whose spans are summarized, holding its full body on disk until its
+// trace is sent. It must be done after everything that needs the span's
+// full data when it arrives.
+func (c *CentralCollector) summarizeSpan(sp *types.Span, selector string, keyFields []string) {
+	cfg := c.Config.GetSpanSummaryConfig()
+	if !slices.Contains(cfg.Targets, selector) {
+		return
+	}
+	if c.SpanCache.HoldBody(sp, c.summaryFields(sp.Dataset, keyFields, cfg.Fields)) {
+		c.Metrics.Increment("span_summarized")
+	}
+}
+
+// summaryFields returns the fields that a span's summary keeps: those used by
+// its sampler, those configured, and those the collector looks at before a
+// trace is sent. The ID fields are those of the span's dataset.
+func (c *CentralCollector) summaryFields(dataset string, keyFields []string, extra []string) []string {
+	traceIDFields, spanIDFields, parentIDFields := c.idFieldNames(dataset)
+	fields := make([]string, 0, len(keyFields)+len(extra)+8)
+	fields = append(fields, keyFields...)
+	fields = append(fields, extra...)
+	fields = append(fields, traceIDFields...)
+	fields = append(fields, spanIDFields...)
+	fields = append(fields, parentIDFields...)
+	fields = append(fields, c.Config.GetChildCountFieldNames()...)
+	return append(fields, "meta.annotation_type", sample.OTelRandomnessField)
+}
@@ -0,0 +1,75 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect/cache"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeSpan(t *testing.T) {
+	cfg := &config.MockConfig{
+		GetTraceTimeoutVal: 10 * time.Second,
+		TraceIdFieldNames:  []string{"trace.trace_id"},
+		ParentIdFieldNames: []string{"trace.parent_id"},
+		TraceSpill:         config.TraceSpillConfig{Directory: t.TempDir(), MaxDiskSize: 100_000},
+		SpanSummaries:      config.SpanSummaryConfig{Targets: []string{"busy"}, Fields: []string{"service.name"}},
+	}
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	spanCache := &cache.SpanCache_basic{Cfg: cfg, Clock: clockwork.NewFakeClock(), Metrics: mockMetrics}
+	require.NoError(t, spanCache.Start())
+	coll := &CentralCollector{Config: cfg, Metrics: mockMetrics, SpanCache: spanCache}
+
+	data := func() map[string]interface{} {
+		return map[string]interface{}{
+			"trace.trace_id":       "t1",
+			"trace.parent_id":      "p1",
+			"meta.annotation_type": "span_event",
+			"service.name":         "api",
+			"http.status_code":     500,
+			"body":                 "a long request body",
+		}
+	}
+	quiet := &types.Span{TraceID: "t1", ID: "s1", Event: types.Event{Data: data()}}
+	require.NoError(t, spanCache.Set(quiet))
+	coll.summarizeSpan(quiet, "quiet", []string{"http.status_code"})
+	assert.Equal(t, data(), quiet.Data, "other targets aren't summarized")
+
+	busy := &types.Span{TraceID: "t1", ID: "s2", Event: types.Event{Data: data()}}
+	require.NoError(t, spanCache.Set(busy))
+	coll.summarizeSpan(busy, "busy", []string{"http.status_code"})
+	expected := data()
+	delete(expected, "body")
+	assert.Equal(t, expected, busy.Data)
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["span_summarized"])
+
+	trace := spanCache.Load("t1")
+	require.Len(t, trace.GetSpans(), 2)
+	assert.Equal(t, data(), trace.GetSpans()[1].Data)
+
+	// a dataset with its own ID fields keeps those
+	cfg.IDFieldRules = map[string]config.IDFieldRules{
+		"legacy": {TraceNames: []string{"request_id"}, ParentNames: []string{"caller_id"}},
+	}
+	legacyData := map[string]interface{}{
+		"request_id":   "t2",
+		"caller_id":    "p2",
+		"service.name": "api",
+		"body":         "a long request body",
+	}
+	legacy := &types.Span{TraceID: "t2", ID: "s3", Event: types.Event{Dataset: "legacy", Data: legacyData}}
+	require.NoError(t, spanCache.Set(legacy))
+	coll.summarizeSpan(legacy, "busy", nil)
+	assert.Equal(t, map[string]interface{}{
+		"request_id":   "t2",
+		"caller_id":    "p2",
+		"service.name": "api",
+	}, legacy.Data)
+}
@@ -0,0 +1,48 @@
+package stressRelief
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	// gcPauseLimit is the fraction of time spent in GC pauses at which the
+	// gc_pause contributor reports full stress.
+	gcPauseLimit = 0.05
+	// gcSampleInterval is the shortest time the pause fraction is measured
+	// over, so that a single pause doesn't look like constant stress.
+	gcSampleInterval = time.Second
+)
+
+// gcPauseContributor reports the fraction of time the process spent in
+// garbage collection pauses since it last measured it.
+type gcPauseContributor struct {
+	clock clockwork.Clock
+
+	mut        sync.Mutex
+	lastSample time.Time
+	lastPause  time.Duration
+	stress     float64
+}
+
+func (g *gcPauseContributor) Stress() float64 {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	now := g.clock.Now()
+	if !g.lastSample.IsZero() && now.Sub(g.lastSample) < gcSampleInterval {
+		return g.stress
+	}
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+	if !g.lastSample.IsZero() {
+		fraction := float64(stats.PauseTotal-g.lastPause) / float64(now.Sub(g.lastSample))
+		g.stress = clamp(fraction/gcPauseLimit, 0, 1)
+	}
+	g.lastSample = now
+	g.lastPause = stats.PauseTotal
+	return g.stress
+}
@@ -1,6 +1,7 @@
 package stressRelief
 
 import (
+	"errors"
 	"math"
 
 	"github.com/honeycombio/refinery/config"
@@ -13,29 +14,98 @@ type StressReliever interface {
 	UpdateFromConfig(cfg config.StressReliefConfig)
 	Recalc() uint
 	Stressed() bool
+	// StressLevel returns the cluster's stress level as of the last Recalc,
+	// from 0 to 100 or more.
+	StressLevel() uint
 	GetSampleRate(traceID string) (rate uint, keep bool, reason string)
 	ShouldSampleDeterministically(traceID string) bool
+	// CoarsenDecision adjusts a sampling decision made while stressed; it
+	// returns whether it changed the decision.
+	CoarsenDecision(traceID string, rate uint, keep bool) (newRate uint, newKeep bool, coarsened bool)
+	// RegisterContributor adds a signal to the stress level calculation,
+	// replacing any contributor already registered with the same name.
+	RegisterContributor(name string, c Contributor)
+	// Contributors returns each contributor's score as of the last Recalc.
+	Contributors() map[string]ContributorScore
+	// Override forces stress relief on, with Always, or off, with Never, on
+	// every node in the cluster regardless of the stress level, until the
+	// override is cleared or the node restarts.
+	Override(mode StressReliefMode) error
+	// ClearOverride removes the override on every node in the cluster, so
+	// that the configured Mode applies again.
+	ClearOverride() error
+	// Overridden returns the current override, if there is one.
+	Overridden() (mode StressReliefMode, ok bool)
+}
+
+// Contributor is one of the signals that the stress level is calculated
+// from.
+type Contributor interface {
+	// Stress returns the current stress from this signal, from 0 to 1. A
+	// signal that can't be measured, e.g. because the feature it measures is
+	// turned off, returns 0.
+	Stress() float64
+}
+
+// ContributorFunc adapts a function to the Contributor interface.
+type ContributorFunc func() float64
+
+func (f ContributorFunc) Stress() float64 { return f() }
+
+// ContributorScore is how much one contributor added to the stress level.
+type ContributorScore struct {
+	// Stress is what the contributor reported, from 0 to 1.
+	Stress float64 `json:"stress"`
+	// Weight is from StressRelief.ContributorWeights.
+	Weight float64 `json:"weight"`
+	// Score is Stress times Weight, from 0 to 100; the stress level is the
+	// highest score.
+	Score float64 `json:"score"`
 }
 
 var _ StressReliever = &MockStressReliever{}
 
 type MockStressReliever struct {
 	IsStressed              bool
+	Level                   uint
 	SampleDeterministically bool
 	SampleRate              uint
 	ShouldKeep              bool
+	Scores                  map[string]ContributorScore
+	OverrideMode            StressReliefMode
+	IsOverridden            bool
 }
 
 func (m *MockStressReliever) Start() error                                   { return nil }
 func (m *MockStressReliever) UpdateFromConfig(cfg config.StressReliefConfig) {}
 func (m *MockStressReliever) Recalc() uint                                   { return 0 }
 func (m *MockStressReliever) Stressed() bool                                 { return m.IsStressed }
+func (m *MockStressReliever) StressLevel() uint                              { return m.Level }
 func (m *MockStressReliever) GetSampleRate(traceID string) (rate uint, keep bool, reason string) {
 	return m.SampleRate, m.ShouldKeep, "mock"
 }
 func (m *MockStressReliever) ShouldSampleDeterministically(traceID string) bool {
 	return m.SampleDeterministically
 }
+func (m *MockStressReliever) CoarsenDecision(traceID string, rate uint, keep bool) (uint, bool, bool) {
+	return rate, keep, false
+}
+func (m *MockStressReliever) RegisterContributor(name string, c Contributor) {}
+func (m *MockStressReliever) Contributors() map[string]ContributorScore      { return m.Scores }
+func (m *MockStressReliever) Override(mode StressReliefMode) error {
+	if mode == Monitor {
+		return ErrInvalidOverride
+	}
+	m.OverrideMode, m.IsOverridden = mode, true
+	return nil
+}
+func (m *MockStressReliever) ClearOverride() error {
+	m.IsOverridden = false
+	return nil
+}
+func (m *MockStressReliever) Overridden() (StressReliefMode, bool) {
+	return m.OverrideMode, m.IsOverridden
+}
 
 // hashSeed is a random value to seed the hash generator for the sampler.
 // We want it to be a constant that's the same across all nodes so that they
@@ -50,6 +120,20 @@ const (
 	Always
 )
 
+// ErrInvalidOverride is returned for an override other than Always or Never.
+var ErrInvalidOverride = errors.New("stress relief can only be overridden to always or never")
+
+func (m StressReliefMode) String() string {
+	switch m {
+	case Monitor:
+		return "monitor"
+	case Always:
+		return "always"
+	default:
+		return "never"
+	}
+}
+
 type stressReliefAlgorithm struct {
 	data   metrics.Metrics
 	logger logger.Logger
@@ -66,7 +150,11 @@ func (s *stressReliefAlgorithm) ratio(num, denom string) float64 {
 		s.logger.Debug().Logf("stress recalc: missing numerator %s", num)
 		return 0
 	}
-	denominator, ok := s.data.Get(denom)
+	// fractions are already in the range, and have no denominator
+	denominator, ok := 1.0, true
+	if denom != "" {
+		denominator, ok = s.data.Get(denom)
+	}
 	if !ok {
 		s.logger.Debug().Logf("stress recalc: missing denominator %s", denom)
 		return 0
@@ -137,6 +225,8 @@ func (s *stressReliefAlgorithm) sigmoid(num, denom string) float64 {
 }
 
 type StressReliefCalculation struct {
+	// Name is the contributor's name, which its weight is configured by
+	Name        string
 	Numerator   string
 	Denominator string
 	Algorithm   string
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -24,6 +26,13 @@ var _ StressReliever = &StressRelief{}
 
 const stressReliefHealthSource = "stress_relief"
 
+// overrideChannel is the gossip channel that overrides are published on. Each
+// message is the name of the mode to force, or clearOverride.
+const (
+	overrideChannel = "stress_relief_override"
+	clearOverride   = "clear"
+)
+
 var calculationInterval = 100 * time.Millisecond
 
 type StressRelief struct {
@@ -40,6 +49,13 @@ type StressRelief struct {
 	overallStressLevel uint
 	sampleRate         uint64
 	upperBound         uint64
+	graduated          bool
+	steps              int
+	maxSampleRate      uint64
+	clusterPolicy      string
+	clusterPercentile  int
+	override           StressReliefMode
+	overridden         bool
 	reason             string
 	formula            string
 	stressed           bool
@@ -47,6 +63,7 @@ type StressRelief struct {
 	minDuration        time.Duration
 	identification     string
 	stressGossipCh     chan []byte
+	overrideGossipCh   chan []byte
 
 	eg *errgroup.Group
 
@@ -55,6 +72,17 @@ type StressRelief struct {
 
 	lock         sync.RWMutex
 	stressLevels map[string]stressReport
+	contributors map[string]registeredContributor
+	weights      map[string]float64
+	scores       map[string]ContributorScore
+}
+
+// registeredContributor is a contributor along with what's logged about it
+// when it raises the stress level.
+type registeredContributor struct {
+	Contributor
+	reason  string
+	formula string
 }
 
 func (s *StressRelief) Start() error {
@@ -78,17 +106,31 @@ func (s *StressRelief) Start() error {
 		"sigmoid": algorithms.sigmoid, // don't worry about small stuff, but if we cross the midline, start worrying quickly
 	}
 
-	// All of the numerator metrics are gauges. The denominator metrics are constants.
+	// All of the numerator metrics are gauges. The denominator metrics are
+	// constants; a calculation without one has a numerator that is already a
+	// fraction.
 	s.calcs = []StressReliefCalculation{
-		{Numerator: "collector_incoming_queue_length", Denominator: "INCOMING_CAP", Algorithm: "sqrt", Reason: "CacheCapacity (incoming)"},
-		{Numerator: "libhoney_upstream_queue_length", Denominator: "UPSTREAM_BUFFER_SIZE", Algorithm: "sqrt", Reason: "UpstreamBufferSize"},
-		{Numerator: "memory_heap_allocation", Denominator: "MEMORY_MAX_ALLOC", Algorithm: "sigmoid", Reason: "MaxAlloc"},
-		{Numerator: "smartstore_span_queue_length", Denominator: "SPAN_CHANNEL_CAP", Algorithm: "sqrt", Reason: "SpanChannelCapacity"},
-		// TODO: add metrics for stress relief calculation
+		{Name: "incoming_queue", Numerator: "collector_incoming_queue_length", Denominator: "INCOMING_CAP", Algorithm: "sqrt", Reason: "CacheCapacity (incoming)"},
+		{Name: "upstream_queue", Numerator: "libhoney_upstream_queue_length", Denominator: "UPSTREAM_BUFFER_SIZE", Algorithm: "sqrt", Reason: "UpstreamBufferSize"},
+		{Name: "memory", Numerator: "memory_heap_allocation", Denominator: "MEMORY_MAX_ALLOC", Algorithm: "sigmoid", Reason: "MaxAlloc"},
+		{Name: "span_queue", Numerator: "smartstore_span_queue_length", Denominator: "SPAN_CHANNEL_CAP", Algorithm: "sqrt", Reason: "SpanChannelCapacity"},
+		// only present when UpstreamProbe is enabled
+		{Name: "upstream_probe", Numerator: "upstream_probe_failure_seconds", Denominator: "UPSTREAM_PROBE_FAILURE_LIMIT", Algorithm: "linear", Reason: "UpstreamProbe"},
+		{Name: "upstream_errors", Numerator: "libhoney_upstream_response_error_fraction", Algorithm: "sqrt", Reason: "UpstreamErrors"},
+		// only present when Redis is used
+		{Name: "redis_latency", Numerator: "redis_ping_latency_ms", Denominator: "REDIS_PING_LIMIT_MS", Algorithm: "linear", Reason: "RedisLatency"},
+		// only present when TraceSpill is enabled
+		{Name: "spill_disk", Numerator: "spancache_spill_bytes", Denominator: "SPILL_MAX_BYTES", Algorithm: "square", Reason: "TraceSpill.MaxDiskSize"},
 
 		// users need to tell us what's their redis memory limit
 		//{Numerator: "redisstore_memory_used_total", }
 	}
+	for _, c := range s.calcs {
+		algorithm, num, denom := s.algorithms[c.Algorithm], c.Numerator, c.Denominator
+		s.registerContributor(c.Name, ContributorFunc(func() float64 { return algorithm(num, denom) }), c.Reason,
+			fmt.Sprintf("%s(%v/%v)", c.Algorithm, c.Numerator, c.Denominator))
+	}
+	s.registerContributor("gc_pause", &gcPauseContributor{clock: s.Clock}, "GCPauses", "gc_pause")
 
 	// We need to identify ourselves to the cluster. We'll use the hostname if we can, but if we can't, we'll use a UUID.
 	if hostname, err := os.Hostname(); err == nil && hostname != "" {
@@ -103,6 +145,7 @@ func (s *StressRelief) Start() error {
 		s.identification = id.String()
 	}
 	s.stressLevels = make(map[string]stressReport)
+	s.scores = make(map[string]ContributorScore)
 	s.done = make(chan struct{})
 
 	s.Health.Register(stressReliefHealthSource, 5*calculationInterval)
@@ -110,8 +153,11 @@ func (s *StressRelief) Start() error {
 	s.RefineryMetrics.Register("cluster_stress_level", "gauge")
 	s.RefineryMetrics.Register("individual_stress_level", "gauge")
 	s.RefineryMetrics.Register("stress_relief_activated", "gauge")
+	s.RefineryMetrics.Register("stress_relief_step", "gauge")
+	s.RefineryMetrics.Register("stress_relief_overridden", "gauge")
 
 	s.stressGossipCh = s.Gossip.Subscribe("stress_level", 20)
+	s.overrideGossipCh = s.Gossip.Subscribe(overrideChannel, 20)
 	s.eg = &errgroup.Group{}
 	s.eg.Go(s.monitor)
 
@@ -152,6 +198,20 @@ func (s *StressRelief) monitor() error {
 			}
 			s.lock.Unlock()
 
+		case data := <-s.overrideGossipCh:
+			// a node also receives its own overrides, which it has already
+			// applied
+			switch string(data) {
+			case clearOverride:
+				s.applyOverride(Monitor, false)
+			case Always.String():
+				s.applyOverride(Always, true)
+			case Never.String():
+				s.applyOverride(Never, true)
+			default:
+				s.Logger.Error().WithString("message", string(data)).Logf("ignoring invalid stress relief override")
+			}
+
 		case <-s.done:
 			s.Logger.Debug().Logf("Stopping StressRelief system")
 			return nil
@@ -190,6 +250,15 @@ func (s *StressRelief) UpdateFromConfig(cfg config.StressReliefConfig) {
 		s.sampleRate = 1
 	}
 	s.minDuration = time.Duration(cfg.MinimumActivationDuration)
+	s.graduated = cfg.Degradation == "graduated"
+	s.steps = max(cfg.GraduatedSteps, 1)
+	s.maxSampleRate = max(cfg.MaxSamplingRate, s.sampleRate)
+	s.clusterPolicy = cfg.ClusterPolicy
+	s.clusterPercentile = cfg.ClusterPercentile
+	s.weights = make(map[string]float64, len(cfg.ContributorWeights))
+	for name, weight := range cfg.ContributorWeights {
+		s.weights[name] = weight
+	}
 
 	s.Logger.Debug().
 		WithField("activation_level", s.activateLevel).
@@ -214,15 +283,35 @@ func (s *StressRelief) Recalc() uint {
 	// 100 * the fraction of its capacity in use. Our overall stress level is the max of those values.
 	// We track the config value that is under stress as "reason".
 
+	// Each contributor's stress is scaled by its weight, and the highest
+	// result is the stress level.
+	s.lock.RLock()
+	names := make([]string, 0, len(s.contributors))
+	for name := range s.contributors {
+		names = append(names, name)
+	}
+	contributors := s.contributors
+	weights := s.weights
+	s.lock.RUnlock()
+	sort.Strings(names)
+
 	var maximumLevel float64
 	var reason string
 	var formula string
-	for _, c := range s.calcs {
-		stress := 100 * s.algorithms[c.Algorithm](c.Numerator, c.Denominator)
-		if stress > maximumLevel {
-			maximumLevel = stress
-			reason = c.Reason
-			formula = fmt.Sprintf("%s(%v/%v)=%v", c.Algorithm, c.Numerator, c.Denominator, stress)
+	scores := make(map[string]ContributorScore, len(names))
+	for _, name := range names {
+		c := contributors[name]
+		weight, ok := weights[name]
+		if !ok {
+			weight = 1
+		}
+		stress := clamp(c.Stress(), 0, 1)
+		score := 100 * clamp(stress*weight, 0, 1)
+		scores[name] = ContributorScore{Stress: stress, Weight: weight, Score: score}
+		if score > maximumLevel {
+			maximumLevel = score
+			reason = c.reason
+			formula = fmt.Sprintf("%s=%v", c.formula, score)
 		}
 	}
 	level := uint(maximumLevel)
@@ -239,8 +328,13 @@ func (s *StressRelief) Recalc() uint {
 	s.overallStressLevel = clusterStressLevel
 	s.reason = reason
 	s.formula = formula
+	s.scores = scores
 
-	switch s.mode {
+	mode := s.mode
+	if s.overridden {
+		mode = s.override
+	}
+	switch mode {
 	case Never:
 		s.stressed = false
 	case Always:
@@ -278,6 +372,9 @@ func (s *StressRelief) Recalc() uint {
 	} else {
 		s.RefineryMetrics.Gauge("stress_relief_activated", 0)
 	}
+	if s.graduated {
+		s.RefineryMetrics.Gauge("stress_relief_step", s.graduatedStep())
+	}
 
 	return uint(level)
 }
@@ -289,9 +386,85 @@ func (s *StressRelief) Stressed() bool {
 	return s.stressed
 }
 
+func (s *StressRelief) StressLevel() uint {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.overallStressLevel
+}
+
+// RegisterContributor adds a contributor to the stress level calculation. Its
+// name is used as the reason when it raises the stress level.
+func (s *StressRelief) RegisterContributor(name string, c Contributor) {
+	s.registerContributor(name, c, name, name)
+}
+
+func (s *StressRelief) registerContributor(name string, c Contributor, reason string, formula string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.contributors == nil {
+		s.contributors = make(map[string]registeredContributor)
+	}
+	s.contributors[name] = registeredContributor{Contributor: c, reason: reason, formula: formula}
+}
+
+func (s *StressRelief) Contributors() map[string]ContributorScore {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	scores := make(map[string]ContributorScore, len(s.scores))
+	for name, score := range s.scores {
+		scores[name] = score
+	}
+	return scores
+}
+
+func (s *StressRelief) Override(mode StressReliefMode) error {
+	if mode != Always && mode != Never {
+		return ErrInvalidOverride
+	}
+	s.applyOverride(mode, true)
+	return s.Gossip.Publish(overrideChannel, []byte(mode.String()))
+}
+
+func (s *StressRelief) ClearOverride() error {
+	s.applyOverride(Monitor, false)
+	return s.Gossip.Publish(overrideChannel, []byte(clearOverride))
+}
+
+func (s *StressRelief) Overridden() (StressReliefMode, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.override, s.overridden
+}
+
+// applyOverride sets or clears the override on this node. A forced mode takes
+// effect immediately; when the override is cleared, the next Recalc decides
+// whether stress relief stays active.
+func (s *StressRelief) applyOverride(mode StressReliefMode, set bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.overridden == set && (!set || s.override == mode) {
+		return
+	}
+	s.override, s.overridden = mode, set
+	if set {
+		s.stressed = mode == Always
+		s.RefineryMetrics.Gauge("stress_relief_overridden", 1)
+		s.Logger.Warn().WithString("mode", mode.String()).Logf("StressRelief has been overridden")
+	} else {
+		s.RefineryMetrics.Gauge("stress_relief_overridden", 0)
+		s.Logger.Warn().Logf("StressRelief override has been cleared")
+	}
+}
+
 func (s *StressRelief) GetSampleRate(traceID string) (rate uint, keep bool, reason string) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
+	if s.graduated {
+		rate := s.graduatedRate(s.graduatedStep())
+		hash := wyhash.Hash([]byte(traceID), hashSeed)
+		return uint(rate), hash <= math.MaxUint64/rate, "stress_relief/graduated/" + s.reason
+	}
 	if s.sampleRate <= 1 {
 		return 1, true, "stress_relief/always"
 	}
@@ -299,10 +472,74 @@ func (s *StressRelief) GetSampleRate(traceID string) (rate uint, keep bool, reas
 	return uint(s.sampleRate), hash <= s.upperBound, "stress_relief/deterministic/" + s.reason
 }
 
+// CoarsenDecision applies graduated degradation to a decision made by the
+// rules. While stress relief is active below the last step, a kept trace
+// whose rate is below the current step's rate is sampled again, by its trace
+// ID, so that it's kept at the step's rate. The decision is returned
+// unchanged otherwise, and coarsened is false.
+func (s *StressRelief) CoarsenDecision(traceID string, rate uint, keep bool) (newRate uint, newKeep bool, coarsened bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !s.graduated || !keep {
+		return rate, keep, false
+	}
+	step := s.graduatedStep()
+	if step == 0 {
+		return rate, keep, false
+	}
+	floor := s.graduatedRate(step)
+	rate = max(rate, 1)
+	if uint64(rate) >= floor {
+		return rate, keep, false
+	}
+	// the trace was kept with probability 1/rate; keeping it again with
+	// probability rate/floor makes that 1/floor
+	hash := wyhash.Hash([]byte(traceID), hashSeed)
+	threshold := float64(math.MaxUint64) * float64(rate) / float64(floor)
+	return uint(floor), float64(hash) <= threshold, true
+}
+
+// graduatedStep returns which of the steps of graduated degradation the
+// stress level is in, from 1 to the number of steps, or 0 if stress relief
+// isn't active. Only call with the lock held.
+func (s *StressRelief) graduatedStep() int {
+	if !s.stressed {
+		return 0
+	}
+	if s.overallStressLevel <= s.activateLevel || s.activateLevel >= 100 {
+		return 1
+	}
+	fraction := float64(s.overallStressLevel-s.activateLevel) / float64(100-s.activateLevel)
+	step := int(math.Ceil(fraction * float64(s.steps)))
+	return min(max(step, 1), s.steps)
+}
+
+// graduatedRate returns the sample rate of a step of graduated degradation,
+// which rises geometrically from the sampling rate at the first step to the
+// maximum sampling rate at the last. Only call with the lock held.
+func (s *StressRelief) graduatedRate(step int) uint64 {
+	if s.steps <= 1 || step >= s.steps {
+		return s.maxSampleRate
+	}
+	step = max(step, 1)
+	ratio := float64(s.maxSampleRate) / float64(s.sampleRate)
+	rate := float64(s.sampleRate) * math.Pow(ratio, float64(step-1)/float64(s.steps-1))
+	return uint64(rate + 0.5)
+}
+
 // ShouldSampleDeterministically returns true if the trace should be deterministically sampled.
 // It uses the traceID to calculate a hash and then divides it by the maximum possible value
 // to get a percentage. If the percentage is less than the deterministic fraction, it returns true.
+// With graduated degradation, every trace is sampled deterministically at the
+// last step, and none are before it.
 func (s *StressRelief) ShouldSampleDeterministically(traceID string) bool {
+	s.lock.RLock()
+	graduated, last := s.graduated, s.graduatedStep() == s.steps
+	s.lock.RUnlock()
+	if graduated {
+		return last
+	}
+
 	samplePercentage := s.deterministicFraction()
 	hash := wyhash.Hash([]byte(traceID), hashSeed)
 
@@ -334,8 +571,8 @@ type stressReport struct {
 
 // clusterStressLevel calculates the overall stress level for the cluster
 // by using the stress levels reported by each node.
-// It uses the geometric mean of the stress levels reported by each node to
-// calculate the overall stress level for the cluster.
+// By default it uses the quadratic mean of the stress levels reported by each
+// node; ClusterPolicy can choose the median or a percentile instead.
 func (s *StressRelief) clusterStressLevel(level uint) uint {
 	// we need to calculate the stress level from the levels we've been given
 	// and then publish it to the cluster
@@ -349,8 +586,7 @@ func (s *StressRelief) clusterStressLevel(level uint) uint {
 	defer s.lock.Unlock()
 
 	s.stressLevels[s.identification] = report
-	var total float64
-	availablePeers := 0
+	levels := make([]uint, 0, len(s.stressLevels))
 	for _, report := range s.stressLevels {
 		// TODO: maybe make the expiration time configurable
 		if s.Clock.Since(report.timestamp) > 5*time.Second {
@@ -361,15 +597,32 @@ func (s *StressRelief) clusterStressLevel(level uint) uint {
 		if report.level == 0 {
 			continue
 		}
-		availablePeers++
-		total += float64(report.level * report.level)
+		levels = append(levels, report.level)
 	}
-
-	if availablePeers == 0 {
-		availablePeers = 1
+	if len(levels) == 0 {
+		return 0
 	}
 
-	return uint(math.Sqrt(total / float64(availablePeers)))
+	switch s.clusterPolicy {
+	case "median":
+		slices.Sort(levels)
+		mid := len(levels) / 2
+		if len(levels)%2 == 0 {
+			return (levels[mid-1] + levels[mid]) / 2
+		}
+		return levels[mid]
+	case "percentile":
+		// the nearest-rank percentile
+		slices.Sort(levels)
+		rank := int(math.Ceil(float64(s.clusterPercentile) / 100 * float64(len(levels))))
+		return levels[min(max(rank, 1), len(levels))-1]
+	default:
+		var total float64
+		for _, level := range levels {
+			total += float64(level * level)
+		}
+		return uint(math.Sqrt(total / float64(len(levels))))
+	}
 }
 
 // stressLevelMessage is used to communicate stress levels between refinery instances
@@ -188,8 +188,10 @@ func newStressRelief(t *testing.T, clock clockwork.Clock) (*StressRelief, func()
 	}
 	require.NoError(t, healthCheck.Start())
 	channel := &gossip.GossipRedis{
-		Redis:  db,
-		Health: healthCheck,
+		Config:  &config.MockConfig{},
+		Redis:   db,
+		Health:  healthCheck,
+		Metrics: metric,
 	}
 	sr := &StressRelief{
 		Gossip:          channel,
@@ -209,3 +211,188 @@ func newStressRelief(t *testing.T, clock clockwork.Clock) (*StressRelief, func()
 		require.NoError(t, metric.Stop())
 	}
 }
+
+func TestStressRelief_Contributors(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	metric := &metrics.MockMetrics{}
+	metric.Start()
+	healthCheck := &health.Health{Clock: clock}
+	require.NoError(t, healthCheck.Start())
+	defer healthCheck.Stop()
+	channel := &gossip.InMemoryGossip{Logger: &logger.NullLogger{}, Metrics: metric}
+	require.NoError(t, channel.Start())
+	defer channel.Stop()
+	sr := &StressRelief{
+		Gossip:          channel,
+		Clock:           clock,
+		Logger:          &logger.NullLogger{},
+		RefineryMetrics: metric,
+		Health:          healthCheck,
+	}
+	require.NoError(t, sr.Start())
+	defer sr.Stop()
+
+	metric.Register("collector_incoming_queue_length", "gauge")
+	metric.Store("INCOMING_CAP", 1200)
+	metric.Gauge("collector_incoming_queue_length", 300)
+	sr.RegisterContributor("custom", ContributorFunc(func() float64 { return 0.7 }))
+
+	sr.UpdateFromConfig(config.StressReliefConfig{Mode: "monitor"})
+	require.Equal(t, uint(70), sr.Recalc())
+	scores := sr.Contributors()
+	require.Equal(t, ContributorScore{Stress: 0.7, Weight: 1, Score: 70}, scores["custom"])
+	require.Equal(t, ContributorScore{Stress: 0.5, Weight: 1, Score: 50}, scores["incoming_queue"])
+	require.Contains(t, scores, "gc_pause")
+
+	// weights scale each contributor's score, and the highest one wins
+	sr.UpdateFromConfig(config.StressReliefConfig{Mode: "monitor", ContributorWeights: map[string]float64{"custom": 0.5}})
+	require.Equal(t, uint(50), sr.Recalc())
+	require.Equal(t, ContributorScore{Stress: 0.7, Weight: 0.5, Score: 35}, sr.Contributors()["custom"])
+
+	sr.UpdateFromConfig(config.StressReliefConfig{Mode: "monitor", ContributorWeights: map[string]float64{"custom": 0.5, "incoming_queue": 0}})
+	require.Equal(t, uint(35), sr.Recalc())
+}
+
+func TestStressRelief_Graduated(t *testing.T) {
+	sr := &StressRelief{
+		stressed:           true,
+		overallStressLevel: 60,
+		activateLevel:      60,
+		graduated:          true,
+		steps:              4,
+		sampleRate:         100,
+		maxSampleRate:      1000,
+	}
+
+	// the step follows the stress level above the activation level, and the
+	// rate rises geometrically between the sampling and maximum rates
+	expected := []struct {
+		level uint
+		step  int
+		rate  uint64
+	}{
+		{60, 1, 100},
+		{70, 1, 100},
+		{71, 2, 215},
+		{85, 3, 464},
+		{91, 4, 1000},
+		{100, 4, 1000},
+	}
+	for _, e := range expected {
+		sr.overallStressLevel = e.level
+		step := sr.graduatedStep()
+		require.Equal(t, e.step, step, e.level)
+		require.Equal(t, e.rate, sr.graduatedRate(step), e.level)
+	}
+
+	traceID := "0123456789abcdef0123456789abcdef"
+
+	// before the last step, no trace skips the rules
+	sr.overallStressLevel = 85
+	require.False(t, sr.ShouldSampleDeterministically(traceID))
+	rate, _, reason := sr.GetSampleRate(traceID)
+	require.Equal(t, uint(464), rate)
+	require.Equal(t, "stress_relief/graduated/", reason)
+
+	// kept traces with a lower rate are coarsened to the step's rate, and
+	// about the right fraction of them survive
+	traceCount := 10000
+	var kept int
+	for i := 0; i < traceCount; i++ {
+		id := fmt.Sprintf("%016x%016x", rand.Int63(), rand.Int63())
+		newRate, keep, coarsened := sr.CoarsenDecision(id, 10, true)
+		require.True(t, coarsened)
+		require.Equal(t, uint(464), newRate)
+		if keep {
+			kept++
+		}
+	}
+	require.InDelta(t, float64(traceCount)*10/464, float64(kept), float64(traceCount)/100)
+
+	// dropped traces and traces already at a higher rate are left alone
+	_, _, coarsened := sr.CoarsenDecision(traceID, 10, false)
+	require.False(t, coarsened)
+	_, _, coarsened = sr.CoarsenDecision(traceID, 500, true)
+	require.False(t, coarsened)
+
+	// at the last step every trace is sampled deterministically
+	sr.overallStressLevel = 95
+	require.True(t, sr.ShouldSampleDeterministically(traceID))
+
+	sr.stressed = false
+	_, _, coarsened = sr.CoarsenDecision(traceID, 10, true)
+	require.False(t, coarsened)
+}
+
+func TestStressRelief_ClusterPolicy(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	sr := &StressRelief{
+		Clock:          clock,
+		identification: "self",
+		stressLevels:   make(map[string]stressReport),
+	}
+	// a peer that's starting up is left out
+	for i, level := range []uint{95, 30, 20, 10, 0} {
+		id := fmt.Sprintf("peer%d", i)
+		sr.stressLevels[id] = stressReport{key: id, level: level, timestamp: clock.Now()}
+	}
+
+	sr.clusterPolicy = "mean"
+	require.Equal(t, uint(47), sr.clusterStressLevel(25))
+	sr.clusterPolicy = "median"
+	require.Equal(t, uint(25), sr.clusterStressLevel(25))
+	sr.clusterPolicy = "percentile"
+	sr.clusterPercentile = 80
+	require.Equal(t, uint(30), sr.clusterStressLevel(25))
+	sr.clusterPercentile = 100
+	require.Equal(t, uint(95), sr.clusterStressLevel(25))
+
+	// reports expire
+	clock.Advance(6 * time.Second)
+	require.Equal(t, uint(25), sr.clusterStressLevel(25))
+}
+
+func TestStressRelief_Override(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	metric := &metrics.MockMetrics{}
+	metric.Start()
+	healthCheck := &health.Health{Clock: clock}
+	require.NoError(t, healthCheck.Start())
+	defer healthCheck.Stop()
+	channel := &gossip.InMemoryGossip{Logger: &logger.NullLogger{}, Metrics: metric}
+	require.NoError(t, channel.Start())
+	defer channel.Stop()
+
+	// two nodes share the gossip channel
+	nodes := make([]*StressRelief, 2)
+	for i := range nodes {
+		nodes[i] = &StressRelief{
+			Gossip:          channel,
+			Clock:           clock,
+			Logger:          &logger.NullLogger{},
+			RefineryMetrics: metric,
+			Health:          healthCheck,
+		}
+		require.NoError(t, nodes[i].Start())
+		defer nodes[i].Stop()
+		nodes[i].UpdateFromConfig(config.StressReliefConfig{Mode: "monitor", ActivationLevel: 90, DeactivationLevel: 75})
+	}
+
+	require.ErrorIs(t, nodes[0].Override(Monitor), ErrInvalidOverride)
+	require.NoError(t, nodes[0].Override(Always))
+	require.True(t, nodes[0].Stressed())
+	require.Eventually(t, func() bool {
+		mode, ok := nodes[1].Overridden()
+		return ok && mode == Always
+	}, time.Second, 10*time.Millisecond)
+	nodes[1].Recalc()
+	require.True(t, nodes[1].Stressed())
+
+	require.NoError(t, nodes[1].ClearOverride())
+	require.Eventually(t, func() bool {
+		_, ok := nodes[0].Overridden()
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	nodes[0].Recalc()
+	require.False(t, nodes[0].Stressed())
+}
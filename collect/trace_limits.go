@@ -0,0 +1,132 @@
+package collect
+
+import (
+	"context"
+
+	"github.com/honeycombio/refinery/centralstore"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+)
+
+// These are the choices for what happens to a trace that reaches one of its
+// limits.
+const (
+	OnBreachDecide    = "decide"
+	OnBreachTruncate  = "truncate"
+	OnBreachSummarize = "summarize"
+)
+
+// enforceTraceLimits checks a trace against the span count and size limits
+// of its sampler selector after a span is added to it. A trace over a limit
+// is either sent for a decision, once, or has its oldest spans removed.
+func (c *CentralCollector) enforceTraceLimits(ctx context.Context, trace *types.Trace, selector string) error {
+	limits := c.traceLimits(selector)
+	if !overTraceLimits(trace, limits) {
+		return nil
+	}
+	firstBreach := !trace.LimitReached
+	if firstBreach {
+		trace.LimitReached = true
+		c.Metrics.Increment("trace_limit_reached")
+	}
+
+	switch limits.OnBreach {
+	case OnBreachTruncate, OnBreachSummarize:
+		trimmed := c.SpanCache.Trim(trace.TraceID, limits.MaxSpans, int(limits.MaxBytes))
+		if len(trimmed) == 0 {
+			return nil
+		}
+		trace.LimitedSpans += len(trimmed)
+		if limits.OnBreach == OnBreachSummarize {
+			_, spanIDFields, parentIDFields := c.idFieldNames(trace.Dataset)
+			trace.LimitSummary = summarizeLimitedSpans(trace.LimitSummary, trimmed, c.IDGenerator, spanIDFields, parentIDFields)
+			c.Metrics.Count("trace_limit_spans_summarized", len(trimmed))
+		} else {
+			c.Metrics.Count("trace_limit_spans_truncated", len(trimmed))
+		}
+		return nil
+	default:
+		if !firstBreach {
+			return nil
+		}
+		c.Metrics.Increment("trace_limit_decided")
+		c.recordEviction(c.evictionProfile(trace, EvictionTraceLimit))
+		// like an ejection for memory, pretend the root span has arrived so
+		// that the trace is decided now
+		return c.Store.WriteSpan(ctx, &centralstore.CentralSpan{TraceID: trace.TraceID, IsRoot: true})
+	}
+}
+
+// traceLimits returns the trace limits for a sampler selector, with any of
+// its overrides.
+func (c *CentralCollector) traceLimits(selector string) config.TraceLimitsConfig {
+	limits := c.Config.GetTraceLimitsConfig()
+	override := c.Config.GetCollectionOverride(selector)
+	if override.MaxSpans > 0 {
+		limits.MaxSpans = override.MaxSpans
+	}
+	if override.MaxBytes > 0 {
+		limits.MaxBytes = override.MaxBytes
+	}
+	return limits
+}
+
+// overTraceLimits reports whether a trace has more spans or bytes than the
+// limits allow, counting any spans spilled to disk.
+func overTraceLimits(trace *types.Trace, limits config.TraceLimitsConfig) bool {
+	if limits.MaxSpans > 0 && int(trace.DescendantCount())+trace.SpilledSpans > limits.MaxSpans {
+		return true
+	}
+	return limits.MaxBytes > 0 && trace.DataSize+trace.SpilledSize > int(limits.MaxBytes)
+}
+
+// summarizeLimitedSpans folds spans removed from a trace into the span that
+// stands in for them, creating it from a copy of the first of them if there
+// isn't one yet. The summary counts the spans, their errors, and their total
+// duration.
+func summarizeLimitedSpans(summary *types.Span, spans []*types.Span, ids types.IDGenerator, spanIDFields []string, parentIDFields []string) *types.Span {
+	if len(spans) == 0 {
+		return summary
+	}
+	if summary == nil {
+		first := spans[0]
+		data := make(map[string]interface{}, len(first.Data)+3)
+		for k, v := range first.Data {
+			data[k] = v
+		}
+		parentID, _ := firstStringField(first.Data, parentIDFields)
+		id := ids.NewSpanID(first.TraceID, parentID, "meta.refinery.limited_spans")
+		if _, field := firstStringField(first.Data, spanIDFields); field != "" {
+			data[field] = id
+		}
+		delete(data, "error")
+		data["meta.refinery.limited_span_count"] = 0
+		data["meta.refinery.limited_error_count"] = 0
+
+		s := *first
+		s.Data = data
+		s.ID = id
+		s.IsRoot = false
+		summary = &s
+	}
+
+	count, _ := summary.Data["meta.refinery.limited_span_count"].(int)
+	errs, _ := summary.Data["meta.refinery.limited_error_count"].(int)
+	total, haveDurations := summary.Data["meta.refinery.limited_duration_ms_total"].(float64)
+	for _, sp := range spans {
+		count++
+		if config.TryConvertToBool(sp.Data["error"]) {
+			errs++
+		}
+		if d, ok := numericField(sp.Data["duration_ms"]); ok {
+			haveDurations = true
+			total += d
+		}
+	}
+	summary.Data["meta.refinery.limited_span_count"] = count
+	summary.Data["meta.refinery.limited_error_count"] = errs
+	if haveDurations {
+		summary.Data["meta.refinery.limited_duration_ms_total"] = total
+	}
+	return summary
+}
@@ -0,0 +1,106 @@
+package collect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect/cache"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnforceTraceLimits(t *testing.T) {
+	for _, onBreach := range []string{OnBreachTruncate, OnBreachSummarize} {
+		t.Run(onBreach, func(t *testing.T) {
+			conf := &config.MockConfig{
+				GetTraceTimeoutVal: 60 * time.Second,
+				TraceLimits: config.TraceLimitsConfig{
+					MaxSpans: 2,
+					OnBreach: onBreach,
+				},
+				SpanIdFieldNames:   []string{"trace.span_id"},
+				ParentIdFieldNames: []string{"trace.parent_id"},
+			}
+			spanCache := &cache.SpanCache_basic{Cfg: conf, Clock: clockwork.NewFakeClock(), Metrics: &metrics.NullMetrics{}}
+			require.NoError(t, spanCache.Start())
+			coll := &CentralCollector{
+				Config:      conf,
+				SpanCache:   spanCache,
+				Metrics:     &metrics.NullMetrics{},
+				IDGenerator: types.DerivedIDGenerator{},
+			}
+
+			spans := []*types.Span{
+				reductionTestSpan("a", "root", "db", 0, 2),
+				reductionTestSpan("b", "root", "db", time.Millisecond, 3),
+				reductionTestSpan("c", "root", "db", 2*time.Millisecond, 4),
+				reductionTestSpan("d", "root", "db", 3*time.Millisecond, 5),
+				reductionTestSpan("root", "", "request", 4*time.Millisecond, 20),
+			}
+			spans[1].Data["error"] = true
+			for _, sp := range spans {
+				require.NoError(t, spanCache.Set(sp))
+				require.NoError(t, coll.enforceTraceLimits(context.Background(), spanCache.Get("trace"), "ds"))
+			}
+
+			trace := spanCache.Get("trace")
+			assert.True(t, trace.LimitReached)
+			assert.Equal(t, 3, trace.LimitedSpans)
+			var ids []string
+			for _, sp := range trace.GetSpans() {
+				ids = append(ids, sp.ID)
+			}
+			assert.Equal(t, []string{"d", "root"}, ids)
+
+			if onBreach == OnBreachTruncate {
+				assert.Nil(t, trace.LimitSummary)
+				return
+			}
+			summary := trace.LimitSummary
+			require.NotNil(t, summary)
+			assert.False(t, summary.IsRoot)
+			assert.NotEqual(t, "a", summary.ID)
+			assert.Equal(t, summary.ID, summary.Data["trace.span_id"])
+			assert.Equal(t, "root", summary.Data["trace.parent_id"])
+			assert.Equal(t, 3, summary.Data["meta.refinery.limited_span_count"])
+			assert.Equal(t, 1, summary.Data["meta.refinery.limited_error_count"])
+			assert.Equal(t, 9.0, summary.Data["meta.refinery.limited_duration_ms_total"])
+		})
+	}
+}
+
+func TestOverTraceLimits(t *testing.T) {
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"k": "v"}}})
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"k": "v"}}})
+
+	assert.False(t, overTraceLimits(trace, config.TraceLimitsConfig{}))
+	assert.False(t, overTraceLimits(trace, config.TraceLimitsConfig{MaxSpans: 2}))
+	assert.True(t, overTraceLimits(trace, config.TraceLimitsConfig{MaxSpans: 1}))
+	assert.False(t, overTraceLimits(trace, config.TraceLimitsConfig{MaxBytes: config.MemorySize(trace.DataSize)}))
+	assert.True(t, overTraceLimits(trace, config.TraceLimitsConfig{MaxBytes: config.MemorySize(trace.DataSize - 1)}))
+
+	// spans spilled to disk still count
+	size := trace.DataSize
+	trace.TakeSpans()
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"k": "v"}}})
+	assert.True(t, overTraceLimits(trace, config.TraceLimitsConfig{MaxSpans: 2}))
+	assert.True(t, overTraceLimits(trace, config.TraceLimitsConfig{MaxBytes: config.MemorySize(size)}))
+}
+
+func TestTraceLimitsOverride(t *testing.T) {
+	coll := &CentralCollector{Config: &config.MockConfig{
+		TraceLimits: config.TraceLimitsConfig{MaxSpans: 100, MaxBytes: 1000, OnBreach: OnBreachTruncate},
+		CollectionOverrides: map[string]config.CollectionOverride{
+			"batch": {MaxSpans: 10000},
+		},
+	}}
+
+	assert.Equal(t, config.TraceLimitsConfig{MaxSpans: 100, MaxBytes: 1000, OnBreach: OnBreachTruncate}, coll.traceLimits("web"))
+	assert.Equal(t, config.TraceLimitsConfig{MaxSpans: 10000, MaxBytes: 1000, OnBreach: OnBreachTruncate}, coll.traceLimits("batch"))
+}
@@ -23,6 +23,32 @@ type Config interface {
 	// restarting with the new values.
 	RegisterReloadCallback(callback func())
 
+	// Reload rereads and validates the configuration and rules. If they're
+	// valid and have changed, they replace the current configuration all at
+	// once and the reload callbacks are called; if they're not valid, the
+	// current configuration is kept. It's safe to call at any time, in
+	// addition to the periodic reload; trigger says what asked for it, and
+	// is recorded in the history.
+	Reload(trigger string) ReloadResult
+
+	// GetGeneration returns the generation of the current configuration,
+	// which starts at 1 and increases each time a reload changes it
+	GetGeneration() uint64
+
+	// ApplyPublished validates and applies a version of the configuration
+	// and rules that was published for the whole cluster, if its epoch is
+	// newer than the current one. From then on, reloads use the published
+	// documents instead of the local files.
+	ApplyPublished(published PublishedConfig) ReloadResult
+
+	// GetConfigEpoch returns the epoch of the last published configuration
+	// that was applied, or 0 if there hasn't been one
+	GetConfigEpoch() uint64
+
+	// GetConfigHistory returns the most recent versions of the
+	// configuration, newest first, with what changed in each one
+	GetConfigHistory() []ConfigVersion
+
 	// GetListenAddr returns the address and port on which to listen for
 	// incoming events
 	GetListenAddr() string
@@ -34,10 +60,51 @@ type Config interface {
 	// GetHTTPIdleTimeout returns the idle timeout for refinery's HTTP server
 	GetHTTPIdleTimeout() time.Duration
 
+	// GetHTTPMaxConcurrentRequests returns the maximum number of ingest
+	// requests the HTTP listener will process at once; 0 means no limit
+	GetHTTPMaxConcurrentRequests() int
+
+	// GetMaxIngestPause returns the longest time ingestion may be paused via
+	// the admin API before it is automatically resumed
+	GetMaxIngestPause() time.Duration
+
+	// GetOTLPStreamingThreshold returns the body size above which OTLP/HTTP
+	// protobuf requests are decoded incrementally; 0 disables streaming
+	GetOTLPStreamingThreshold() MemorySize
+
+	// GetOTLPStreamingBackpressureTimeout returns how long a streamed OTLP
+	// request waits for the collector to accept spans before dropping them
+	GetOTLPStreamingBackpressureTimeout() time.Duration
+
+	// GetOTLPRejectedSpans returns how OTLP requests respond when some of
+	// their spans are rejected: "partial" or "strict"
+	GetOTLPRejectedSpans() string
+
+	// GetAdmissionQueueThreshold returns the percentage of the collector's
+	// incoming queue above which new ingest requests are rejected; 0 disables
+	// the check
+	GetAdmissionQueueThreshold() int
+
+	// GetAdmissionMemoryThreshold returns the percentage of MaxAlloc above
+	// which new ingest requests are rejected; 0 disables the check
+	GetAdmissionMemoryThreshold() int
+
+	// GetAdmissionRetryAfter returns how long clients are told to wait before
+	// retrying a request rejected by admission control
+	GetAdmissionRetryAfter() time.Duration
+
 	// GetCompressPeerCommunication will be true if refinery should compress
 	// data before forwarding it to a peer.
 	GetCompressPeerCommunication() bool
 
+	// GetUpstreamCompression returns the compression used for data sent
+	// upstream: zstd, snappy or none.
+	GetUpstreamCompression() string
+
+	// GetSyntheticSpanIDs returns how the IDs of spans that Refinery creates
+	// itself are generated: random or derived.
+	GetSyntheticSpanIDs() string
+
 	// GetGRPCEnabled returns or not the GRPC server is enabled.
 	GetGRPCEnabled() bool
 
@@ -48,14 +115,177 @@ type Config interface {
 	// Returns the entire GRPC config block
 	GetGRPCConfig() GRPCServerParameters
 
+	// GetTLSConfig returns the TLS and client certificate settings for the
+	// ingest listeners
+	GetTLSConfig() TLSConfig
+
+	// GetListenerConfig returns the settings for one network listener. The
+	// ingest listeners fall back to ListenAddr, GRPCServerParameters, and the
+	// TLS section for anything they don't set; an admin listener without a
+	// ListenAddr means the admin endpoints are served by the HTTP listener.
+	GetListenerConfig(listener Listener) ListenerConfig
+
+	// GetXRayConfig returns the settings for the AWS X-Ray segment listener
+	GetXRayConfig() XRayConfig
+
+	// GetDatadogConfig returns the settings for Datadog trace intake
+	GetDatadogConfig() DatadogConfig
+
+	// GetSamplingHintsConfig returns the settings for reading sampling hints
+	// sent by upstream services
+	GetSamplingHintsConfig() SamplingHintsConfig
+
+	// GetRedactionConfig returns the rules for removing or obscuring
+	// attributes at ingest
+	GetRedactionConfig() RedactionConfig
+
+	// GetSpanReductionConfig returns the settings for thinning out
+	// repetitive spans in kept traces
+	GetSpanReductionConfig() SpanReductionConfig
+
+	// GetLateErrorRecoveryConfig returns the settings for sending error spans
+	// that arrive after their trace was dropped
+	GetLateErrorRecoveryConfig() LateErrorRecoveryConfig
+
+	// GetLateSpansConfig returns the settings for accounting for spans that
+	// arrive after their trace was decided.
+	GetLateSpansConfig() LateSpansConfig
+
+	// GetTraceSpillConfig returns the settings for writing the spans of
+	// traces to disk when memory runs short.
+	GetTraceSpillConfig() TraceSpillConfig
+
+	// GetTraceLimitsConfig returns the limits on the spans held for a single
+	// trace, and what happens to a trace that reaches them.
+	GetTraceLimitsConfig() TraceLimitsConfig
+
+	// GetAdaptiveTraceTimeoutConfig returns the settings for choosing trace
+	// timeouts from the observed durations of traces.
+	GetAdaptiveTraceTimeoutConfig() AdaptiveTimeoutConfig
+
+	// GetMemoryBudgetConfig returns the settings for sharing one memory
+	// budget between Refinery's caches.
+	GetMemoryBudgetConfig() MemoryBudgetConfig
+
+	// GetSpanDedupConfig returns the settings for dropping duplicate spans.
+	GetSpanDedupConfig() SpanDedupConfig
+
+	// GetMissingRootConfig returns the settings for kept traces whose root
+	// span never arrived.
+	GetMissingRootConfig() MissingRootConfig
+
+	// GetCollectionOverride returns the collection settings that replace
+	// the global ones for a target; settings that aren't overridden are
+	// zero.
+	GetCollectionOverride(target string) CollectionOverride
+
+	// GetCollectionOverrides returns the collection overrides of every
+	// target that has them.
+	GetCollectionOverrides() map[string]CollectionOverride
+
+	// GetDecisionWarmupConfig returns the settings for loading recent trace
+	// decisions into the decision cache at startup
+	GetDecisionWarmupConfig() DecisionWarmupConfig
+
+	// GetStateCompactionConfig returns the settings for compacting the
+	// status of decided traces in Redis
+	GetStateCompactionConfig() StateCompactionConfig
+
+	// GetSpanSummaryConfig returns the targets whose spans are only kept in
+	// memory as summaries until their traces are decided
+	GetSpanSummaryConfig() SpanSummaryConfig
+
+	// GetSendPacingConfig returns the settings for spreading out the sending
+	// of kept traces
+	GetSendPacingConfig() SendPacingConfig
+
+	// GetStateSnapshotConfig returns the settings for keeping the traces
+	// being collected across a restart
+	GetStateSnapshotConfig() StateSnapshotConfig
+
+	// GetConfigDistributionConfig returns the settings for distributing the
+	// configuration to the cluster through Redis
+	GetConfigDistributionConfig() ConfigDistributionConfig
+
+	// GetFeatureFlags returns whether each feature flag is enabled in the
+	// config, by name. Use featureflags.Flags to check a flag, so that
+	// overrides apply.
+	GetFeatureFlags() map[string]bool
+
+	// GetConsistentSamplingConfig returns the settings for OpenTelemetry
+	// consistent probability sampling
+	GetConsistentSamplingConfig() ConsistentSamplingConfig
+
+	// GetSamplingGoalsConfig returns the sample rates that targets should
+	// achieve, and how they're tracked
+	GetSamplingGoalsConfig() SamplingGoalsConfig
+
+	// GetProfilingConfig returns the config for capturing profiles while
+	// Refinery is under stress
+	GetProfilingConfig() ProfilingConfig
+
+	// GetHealthConfig returns the settings for reporting the health of
+	// Refinery's subsystems
+	GetHealthConfig() HealthConfig
+
+	// GetUpstreamProbeConfig returns the settings for checking that the
+	// upstream API can be reached
+	GetUpstreamProbeConfig() UpstreamProbeConfig
+
+	// GetDrainConfig returns the settings for draining a node for
+	// maintenance
+	GetDrainConfig() DrainConfig
+
+	// GetSupervisionConfig returns the settings for restarting goroutines
+	// that panic
+	GetSupervisionConfig() SupervisionConfig
+
+	// GetUpstreamQueueConfig returns the settings for the disk queue of
+	// events that couldn't be sent upstream
+	GetUpstreamQueueConfig() UpstreamQueueConfig
+
+	// GetKafkaOutputConfig returns the settings for sending kept events to
+	// Kafka
+	GetKafkaOutputConfig() KafkaOutputConfig
+
+	// GetOTLPUpstreamConfig returns the settings for sending kept spans
+	// upstream as OTLP
+	GetOTLPUpstreamConfig() OTLPUpstreamConfig
+
+	// GetDestinationsConfig returns the extra upstream destinations that
+	// kept events are copied to
+	GetDestinationsConfig() DestinationsConfig
+
+	// GetAdaptiveBatchingConfig returns the settings for adapting upstream
+	// batch sizes and concurrency to how upstream responds
+	GetAdaptiveBatchingConfig() AdaptiveBatchingConfig
+
+	// GetHTTP2Config returns the HTTP/2 settings for the main ingest listener
+	GetHTTP2Config() HTTP2Config
+
+	// GetProxyProtocolConfig returns the PROXY protocol settings for the
+	// ingest listeners
+	GetProxyProtocolConfig() ProxyProtocolConfig
+
+	// GetFederationConfig returns the other clusters to include in the
+	// federated cluster view
+	GetFederationConfig() FederationConfig
+
 	// IsAPIKeyValid checks if the given API key is valid according to the rules
 	IsAPIKeyValid(key string) bool
 
+	// GetAccessKeyConfig returns the config for which API keys are accepted
+	GetAccessKeyConfig() AccessKeyConfig
+
 	// GetPeers returns a list of other servers participating in this proxy cluster
 	GetPeers() []string
 
 	GetPeerManagementType() string
 
+	// GetRedisSettings returns every setting for connecting to Redis, with
+	// defaults applied.
+	GetRedisSettings() RedisSettings
+
 	// GetRedisHost returns the address of a Redis instance to use for peer
 	// management.
 	GetRedisHost() string
@@ -120,22 +350,43 @@ type Config interface {
 	// GetLoggerLevel returns the level of the logger to use.
 	GetLoggerLevel() Level
 
+	// GetLoggerSubsystemLevels returns the levels of the subsystems that
+	// don't log at the logger's level.
+	GetLoggerSubsystemLevels() map[string]Level
+
 	// GetHoneycombLoggerConfig returns the config specific to the HoneycombLogger
 	GetHoneycombLoggerConfig() HoneycombLoggerConfig
 
 	// GetStdoutLoggerConfig returns the config specific to the StdoutLogger
 	GetStdoutLoggerConfig() StdoutLoggerConfig
 
+	// GetJSONLoggerConfig returns the config specific to the JSONLogger
+	GetJSONLoggerConfig() JSONLoggerConfig
+
 	// GetCollectionConfig returns the config specific to the InMemCollector
 	GetCollectionConfig() CollectionConfig
 
 	// GetSamplerConfigForDestName returns the sampler type and name to use for
-	// the given destination (environment, or dataset in classic)
+	// the given destination (environment, or dataset in classic), which may
+	// be qualified by a tenant with TenantSelector
 	GetSamplerConfigForDestName(string) (interface{}, string, error)
 
+	// GetTenantForAPIKey returns the name of the tenant in the rules that the
+	// API key belongs to, or "" if it belongs to none
+	GetTenantForAPIKey(apiKey string) string
+
+	// GetTenantForTeam returns the name of the tenant in the rules that the
+	// Honeycomb team, identified by its slug, belongs to, or "" if it belongs
+	// to none
+	GetTenantForTeam(team string) string
+
 	// GetAllSamplerRules returns all rules in a single map, including the default rules
 	GetAllSamplerRules() *V2SamplerConfig
 
+	// GetScopedAttributes returns the names of the OTLP resource, scope and
+	// span attributes that rules name with their scope, keyed by scope.
+	GetScopedAttributes() map[string][]string
+
 	// GetLegacyMetricsConfig returns the config specific to LegacyMetrics
 	GetLegacyMetricsConfig() LegacyMetricsConfig
 
@@ -145,6 +396,9 @@ type Config interface {
 	// GetOTelMetricsConfig returns the config specific to OTelMetrics
 	GetOTelMetricsConfig() OTelMetricsConfig
 
+	// GetMetricLabelsConfig returns the config for labeled metrics
+	GetMetricLabelsConfig() MetricLabelsConfig
+
 	// GetOTelTracingConfig returns the config specific to OTelTracing
 	GetOTelTracingConfig() OTelTracingConfig
 
@@ -174,10 +428,23 @@ type Config interface {
 
 	GetAddRuleReasonToTrace() bool
 
+	// GetAddDecisionToSpans returns whether every span of a kept trace is
+	// given the trace's sample rate, the reason it was kept, and the node
+	// that decided it
+	GetAddDecisionToSpans() bool
+
 	GetEnvironmentCacheTTL() time.Duration
 
 	GetDatasetPrefix() string
 
+	// GetValueListRefreshInterval returns how often the lists of values that
+	// rule conditions load from files or Redis are reread.
+	GetValueListRefreshInterval() time.Duration
+
+	// GetSamplerKeyReportInterval returns how often the keys of dynamic
+	// samplers are reported in metrics and logs, or 0 if they aren't.
+	GetSamplerKeyReportInterval() time.Duration
+
 	// GetQueryAuthToken returns the token that must be used to access the /query endpoints
 	GetQueryAuthToken() string
 
@@ -189,6 +456,10 @@ type Config interface {
 
 	GetAddCountsToRoot() bool
 
+	// GetReparentOrphanSpans returns true if spans in kept traces whose
+	// parents never arrived should be attached to the root span
+	GetReparentOrphanSpans() bool
+
 	GetConfigMetadata() []ConfigMetadata
 
 	GetSampleCacheConfig() SampleCacheConfig
@@ -201,7 +472,27 @@ type Config interface {
 
 	GetParentIdFieldNames() []string
 
+	// GetSpanIdFieldNames returns the fields that may hold a span's ID
+	GetSpanIdFieldNames() []string
+
+	// GetIDFieldRules returns the rules for finding the trace and parent IDs
+	// of events in the given dataset, with the global field names filled in
+	// where the dataset doesn't override them
+	GetIDFieldRules(dataset string) IDFieldRules
+
+	// GetChildCountFieldNames returns the fields in which a span may report
+	// how many child spans it has
+	GetChildCountFieldNames() []string
+
 	GetCentralStoreOptions() SmartWrapperOptions
+
+	// GetDecisionExportConfig returns the config for publishing trace
+	// decisions to downstream systems
+	GetDecisionExportConfig() DecisionExportConfig
+
+	// GetDropAuditConfig returns the config for the audit stream of dropped
+	// traces
+	GetDropAuditConfig() DropAuditConfig
 }
 
 type ConfigMetadata struct {
@@ -211,42 +502,139 @@ type ConfigMetadata struct {
 	LoadedAt string `json:"loaded_at"`
 }
 
+// ReloadResult describes the outcome of a configuration reload. A reload
+// that fails validation lists every failure, so that they can all be fixed
+// at once.
+type ReloadResult struct {
+	Applied        bool           `json:"applied"`
+	Changed        bool           `json:"changed"`
+	Generation     uint64         `json:"generation"`
+	Epoch          uint64         `json:"epoch,omitempty"`
+	ConfigHash     string         `json:"config_hash,omitempty"`
+	RulesHash      string         `json:"rules_hash,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	ConfigFailures []string       `json:"config_failures,omitempty"`
+	RulesFailures  []string       `json:"rules_failures,omitempty"`
+	Changes        []ConfigChange `json:"changes,omitempty"`
+}
+
+// ConfigVersion is one version of the configuration and rules, recorded
+// when it was loaded, so that changes in behavior can be matched up with the
+// changes to the configuration that caused them.
+type ConfigVersion struct {
+	Generation uint64         `json:"generation"`
+	Epoch      uint64         `json:"epoch,omitempty"`
+	LoadedAt   time.Time      `json:"loaded_at"`
+	Trigger    string         `json:"trigger"`
+	ConfigHash string         `json:"config_hash"`
+	RulesHash  string         `json:"rules_hash"`
+	Changes    []ConfigChange `json:"changes,omitempty"`
+}
+
+// ConfigChange is one value that differs from the previous version, by its
+// dotted path within the config or rules. The values of secrets aren't
+// recorded; only that they changed.
+type ConfigChange struct {
+	Document string `json:"document"`
+	Path     string `json:"path"`
+	Change   string `json:"change"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// PublishedConfig is a version of the configuration and rules documents that
+// was published for a whole cluster to use. Epochs increase with each
+// version, so that every node switches to the same one.
+type PublishedConfig struct {
+	Epoch        uint64
+	Config       []byte
+	ConfigFormat Format
+	Rules        []byte
+	RulesFormat  Format
+}
+
+// ValidationReport describes the outcome of validating a candidate config
+// and rules. If they're valid, it includes both as they would be used, with
+// every default filled in, as YAML.
+type ValidationReport struct {
+	Valid           bool     `json:"valid"`
+	Error           string   `json:"error,omitempty"`
+	ConfigFailures  []string `json:"config_failures,omitempty"`
+	RulesFailures   []string `json:"rules_failures,omitempty"`
+	EffectiveConfig string   `json:"effective_config,omitempty"`
+	EffectiveRules  string   `json:"effective_rules,omitempty"`
+}
+
+// RedisConfig is the configuration of the Redis client. New settings are
+// added to RedisSettings rather than as getters of their own; the other
+// getters remain for existing callers.
 type RedisConfig interface {
+	// GetRedisSettings returns every setting for connecting to Redis, with
+	// defaults applied.
+	GetRedisSettings() RedisSettings
+
 	// GetRedisHost returns the address of a Redis instance to use for peer
 	// management.
+	//
+	// Deprecated: use GetRedisSettings.
 	GetRedisHost() string
 
 	// GetRedisUsername returns the username of a Redis instance to use for peer
 	// management.
+	//
+	// Deprecated: use GetRedisSettings.
 	GetRedisUsername() string
 
 	// GetRedisPassword returns the password of a Redis instance to use for peer
 	// management.
+	//
+	// Deprecated: use GetRedisSettings.
 	GetRedisPassword() string
 
 	// GetRedisAuthCode returns the AUTH string to use for connecting to a Redis
 	// instance to use for peer management
+	//
+	// Deprecated: use GetRedisSettings.
 	GetRedisAuthCode() string
 
 	// GetRedisPrefix returns the prefix string used in the keys for peer
 	// management.
+	//
+	// Deprecated: use GetRedisSettings.
 	GetRedisPrefix() string
 
 	// GetRedisDatabase returns the ID of the Redis database to use for peer management.
+	//
+	// Deprecated: use GetRedisSettings.
 	GetRedisDatabase() int
 
 	// GetUseTLS returns true when TLS must be enabled to dial the Redis instance to
 	// use for peer management.
+	//
+	// Deprecated: use GetRedisSettings.
 	GetUseTLS() bool
 
 	// UseTLSInsecure returns true when certificate checks are disabled
+	//
+	// Deprecated: use GetRedisSettings.
 	GetUseTLSInsecure() bool
 
+	// Deprecated: use GetRedisSettings.
 	GetRedisMaxIdle() int
 
+	// Deprecated: use GetRedisSettings.
 	GetRedisMaxActive() int
 
+	// GetRedisDrainTimeout returns how long to wait on shutdown for Redis
+	// connections that are in use to be released
+	//
+	// Deprecated: use GetRedisSettings.
+	GetRedisDrainTimeout() time.Duration
+
+	// Deprecated: use GetRedisSettings.
 	GetPeerTimeout() time.Duration
 
+	// Deprecated: use GetRedisSettings.
 	GetParallelism() int
 }
@@ -8,8 +8,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"os"
 	"path/filepath"
 	"reflect"
 
@@ -55,39 +53,6 @@ func formatFromResponse(resp *http.Response) Format {
 	}
 }
 
-// getReaderFor returns an io.ReadCloser for the given URL or filename.
-func getReaderFor(u string) (io.ReadCloser, Format, error) {
-	if u == "" {
-		return nil, FormatUnknown, fmt.Errorf("empty url")
-	}
-	uu, err := url.Parse(u)
-	if err != nil {
-		return nil, FormatUnknown, err
-	}
-	switch uu.Scheme {
-	case "file", "": // we treat an empty scheme as a filename
-		r, err := os.Open(uu.Path)
-		if err != nil {
-			return nil, FormatUnknown, err
-		}
-		return r, formatFromFilename(uu.Path), nil
-	case "http", "https":
-		resp, err := http.Get(u)
-		if err != nil {
-			return nil, FormatUnknown, err
-		}
-		format := formatFromResponse(resp)
-		// if we don't get the format from the Content-Type header, try the path we were given
-		// to see if it offers a hint
-		if format == FormatUnknown {
-			format = formatFromFilename(uu.Path)
-		}
-		return resp.Body, format, nil
-	default:
-		return nil, FormatUnknown, fmt.Errorf("unknown scheme %q", uu.Scheme)
-	}
-}
-
 func load(r io.Reader, format Format, into any) error {
 	switch format {
 	case FormatYAML:
@@ -107,9 +72,9 @@ func load(r io.Reader, format Format, into any) error {
 	}
 }
 
-func validateConfig(opts *CmdEnv) ([]string, error) {
+func validateConfig(opts *CmdEnv, source *configSource) ([]string, error) {
 	location := opts.ConfigLocation
-	r, format, err := getReaderFor(location)
+	r, format, err := openConfig(source, location)
 	if err != nil {
 		return nil, err
 	}
@@ -134,7 +99,7 @@ func validateConfig(opts *CmdEnv) ([]string, error) {
 	// we can apply defaults and options, and then validate a second time.
 
 	// we need a new reader for the source data
-	r2, _, err := getReaderFor(location)
+	r2, _, err := openConfig(source, location)
 	if err != nil {
 		return nil, err
 	}
@@ -168,6 +133,9 @@ func validateConfig(opts *CmdEnv) ([]string, error) {
 	if config.OTelTracing.APIKey == "" {
 		config.OTelTracing.APIKey = "InvalidHoneycombAPIKey"
 	}
+	if config.DropAudit.APIKey == "" {
+		config.DropAudit.APIKey = "InvalidHoneycombAPIKey"
+	}
 
 	// write it out to a YAML buffer
 	buf := new(bytes.Buffer)
@@ -187,8 +155,8 @@ func validateConfig(opts *CmdEnv) ([]string, error) {
 	return failures, nil
 }
 
-func validateRules(location string) ([]string, error) {
-	r, format, err := getReaderFor(location)
+func validateRules(location string, source *configSource) ([]string, error) {
+	r, format, err := source.open(location)
 	if err != nil {
 		return nil, err
 	}
@@ -209,8 +177,16 @@ func validateRules(location string) ([]string, error) {
 }
 
 // readConfigInto reads the config from the given location and applies it to the given struct.
-func readConfigInto(dest any, location string, opts *CmdEnv) (string, error) {
-	r, format, err := getReaderFor(location)
+// Only the main config, which has opts, can refer to environment variables
+// and files.
+func readConfigInto(dest any, location string, opts *CmdEnv, source *configSource) (string, error) {
+	open := source.open
+	if opts != nil {
+		open = func(location string) (io.ReadCloser, Format, error) {
+			return openConfig(source, location)
+		}
+	}
+	r, format, err := open(location)
 	if err != nil {
 		return "", err
 	}
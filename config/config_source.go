@@ -0,0 +1,380 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body, which is what S3
+// expects to be signed for a GET.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signatureSuffix is appended to the location of a remote document to find
+// its detached signature.
+const signatureSuffix = ".sig"
+
+// configSource reads config and rules documents from files, HTTP(S) URLs, S3
+// objects (s3://bucket/key), and GCS objects (gs://bucket/object). Remote
+// documents are cached with their ETag and Last-Modified time and fetched
+// again with a conditional request, so that polling them for changes on
+// every reload is cheap. If a verify key is set, a remote document is only
+// used if the signature next to it is valid.
+type configSource struct {
+	client    *http.Client
+	verifyKey ed25519.PublicKey
+	getenv    func(string) string
+	now       func() time.Time
+
+	mut    sync.Mutex
+	cached map[string]*remoteDocument
+	// pinned documents are used instead of whatever is at their locations
+	pinned map[string]*remoteDocument
+}
+
+// remoteDocument is the last version of a remote document that was fetched.
+type remoteDocument struct {
+	etag         string
+	lastModified string
+	format       Format
+	body         []byte
+}
+
+// newConfigSource creates a config source that verifies remote documents with
+// the key given in the options, if there is one.
+func newConfigSource(opts *CmdEnv) (*configSource, error) {
+	s := &configSource{
+		client: &http.Client{Timeout: 30 * time.Second},
+		getenv: os.Getenv,
+		now:    time.Now,
+		cached: make(map[string]*remoteDocument),
+	}
+	if opts != nil && opts.ConfigVerifyKey != "" {
+		key, err := base64.StdEncoding.DecodeString(opts.ConfigVerifyKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("config verify key must be a base64-encoded Ed25519 public key")
+		}
+		s.verifyKey = ed25519.PublicKey(key)
+	}
+	return s, nil
+}
+
+// open returns a reader for the document at a URL or filename, and its
+// format.
+func (s *configSource) open(location string) (io.ReadCloser, Format, error) {
+	if location == "" {
+		return nil, FormatUnknown, fmt.Errorf("empty url")
+	}
+	if doc := s.pinnedDocument(location); doc != nil {
+		return io.NopCloser(bytes.NewReader(doc.body)), doc.format, nil
+	}
+	uu, err := url.Parse(location)
+	if err != nil {
+		return nil, FormatUnknown, err
+	}
+	switch uu.Scheme {
+	case "file", "": // we treat an empty scheme as a filename
+		r, err := os.Open(uu.Path)
+		if err != nil {
+			return nil, FormatUnknown, err
+		}
+		return r, formatFromFilename(uu.Path), nil
+	case "http", "https", "s3", "gs":
+		doc, err := s.fetch(location, uu)
+		if err != nil {
+			return nil, FormatUnknown, err
+		}
+		return io.NopCloser(bytes.NewReader(doc.body)), doc.format, nil
+	default:
+		return nil, FormatUnknown, fmt.Errorf("unknown scheme %q", uu.Scheme)
+	}
+}
+
+// pin makes the source return the given documents instead of what's at their
+// locations, from now on. It returns the documents that were pinned before,
+// for setPinned.
+func (s *configSource) pin(docs map[string]*remoteDocument) map[string]*remoteDocument {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	previous := s.pinned
+	s.pinned = make(map[string]*remoteDocument, len(previous)+len(docs))
+	for location, doc := range previous {
+		s.pinned[location] = doc
+	}
+	for location, doc := range docs {
+		s.pinned[location] = doc
+	}
+	return previous
+}
+
+// setPinned replaces all of the pinned documents.
+func (s *configSource) setPinned(docs map[string]*remoteDocument) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.pinned = docs
+}
+
+func (s *configSource) pinnedDocument(location string) *remoteDocument {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.pinned[location]
+}
+
+// LoadDocuments reads the config and rules documents at two locations as they
+// are, without validating them, so that they can be published to the rest of
+// a cluster.
+func LoadDocuments(configLocation, rulesLocation string) (PublishedConfig, error) {
+	source, err := newConfigSource(nil)
+	if err != nil {
+		return PublishedConfig{}, err
+	}
+	var published PublishedConfig
+	read := func(location string, body *[]byte, format *Format) error {
+		r, f, err := source.open(location)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if *body, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		*format = f
+		return nil
+	}
+	if err := read(configLocation, &published.Config, &published.ConfigFormat); err != nil {
+		return published, err
+	}
+	if err := read(rulesLocation, &published.Rules, &published.RulesFormat); err != nil {
+		return published, err
+	}
+	return published, nil
+}
+
+// fetch returns the current version of a remote document, using the cached
+// one if the server says it hasn't changed.
+func (s *configSource) fetch(location string, uu *url.URL) (*remoteDocument, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	cached := s.cached[location]
+	req, err := s.newRequest(uu)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", location, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verify(location, body); err != nil {
+		return nil, err
+	}
+
+	doc := &remoteDocument{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		format:       formatFromResponse(resp),
+		body:         body,
+	}
+	// if we don't get the format from the Content-Type header, try the path
+	// we were given to see if it offers a hint
+	if doc.format == FormatUnknown {
+		doc.format = formatFromFilename(uu.Path)
+	}
+	s.cached[location] = doc
+	return doc, nil
+}
+
+// verify checks the detached signature of a remote document, which is the
+// base64-encoded Ed25519 signature of its body, stored next to it.
+func (s *configSource) verify(location string, body []byte) error {
+	if s.verifyKey == nil {
+		return nil
+	}
+	uu, err := url.Parse(location + signatureSuffix)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(uu)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching signature for %s: %w", location, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching signature for %s: unexpected status %s", location, resp.Status)
+	}
+	encoded, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || !ed25519.Verify(s.verifyKey, body, sig) {
+		return fmt.Errorf("signature for %s is not valid", location)
+	}
+	return nil
+}
+
+// newRequest creates the GET request for a remote document.
+func (s *configSource) newRequest(uu *url.URL) (*http.Request, error) {
+	switch uu.Scheme {
+	case "s3":
+		return s.newS3Request(uu.Host, strings.TrimPrefix(uu.Path, "/"))
+	case "gs":
+		return s.newGCSRequest(uu.Host, strings.TrimPrefix(uu.Path, "/"))
+	default:
+		return http.NewRequest(http.MethodGet, uu.String(), nil)
+	}
+}
+
+// newGCSRequest creates a request for a GCS object through its XML API. The
+// request is authorized with the access token in GOOGLE_OAUTH_ACCESS_TOKEN,
+// if it's set; otherwise the object must be public. STORAGE_EMULATOR_HOST
+// replaces the GCS endpoint.
+func (s *configSource) newGCSRequest(bucket, object string) (*http.Request, error) {
+	if bucket == "" || object == "" {
+		return nil, errors.New("GCS locations must be of the form gs://bucket/object")
+	}
+	endpoint := "https://storage.googleapis.com"
+	if host := s.getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = host
+		if !strings.Contains(host, "://") {
+			endpoint = "http://" + host
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/"+bucket+"/"+escapePath(object), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := s.getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// newS3Request creates a request for an S3 object. If AWS credentials are in
+// the environment, the request is signed with them using Signature Version
+// 4; otherwise the object must be public. AWS_ENDPOINT_URL_S3 replaces the
+// S3 endpoint, and addresses buckets by path.
+func (s *configSource) newS3Request(bucket, key string) (*http.Request, error) {
+	if bucket == "" || key == "" {
+		return nil, errors.New("S3 locations must be of the form s3://bucket/key")
+	}
+	region := s.getenv("AWS_REGION")
+	if region == "" {
+		region = s.getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	path := "/" + escapePath(key)
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+	if custom := s.getenv("AWS_ENDPOINT_URL_S3"); custom != "" {
+		endpoint = strings.TrimSuffix(custom, "/")
+		path = "/" + bucket + path
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey := s.getenv("AWS_ACCESS_KEY_ID")
+	secretKey := s.getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return req, nil
+	}
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + emptyPayloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if token := s.getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + token + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet, path, "", canonicalHeaders, signedHeaders, emptyPayloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), day)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent-encodes each segment of an object name, leaving only
+// the characters that S3 and GCS leave unencoded.
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, seg := range segments {
+		var b strings.Builder
+		for _, c := range []byte(seg) {
+			if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+				continue
+			}
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDocumentServer serves documents by path, with ETags, and counts the
+// requests that were answered with a 304.
+type testDocumentServer struct {
+	mut         sync.Mutex
+	docs        map[string]string
+	notModified int
+	requests    []*http.Request
+}
+
+func (s *testDocumentServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.requests = append(s.requests, req)
+	doc, ok := s.docs[req.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := `"` + base64.StdEncoding.EncodeToString([]byte(doc)) + `"`
+	if req.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/yaml")
+	io.WriteString(w, doc)
+}
+
+func (s *testDocumentServer) set(path, doc string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.docs[path] = doc
+}
+
+func readAll(t *testing.T, source *configSource, location string) string {
+	r, format, err := source.open(location)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, FormatYAML, format)
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestConfigSourceHTTP(t *testing.T) {
+	docs := &testDocumentServer{docs: map[string]string{"/rules.yaml": "RulesVersion: 2\n"}}
+	server := httptest.NewServer(docs)
+	defer server.Close()
+
+	source, err := newConfigSource(&CmdEnv{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "RulesVersion: 2\n", readAll(t, source, server.URL+"/rules.yaml"))
+	assert.Equal(t, "RulesVersion: 2\n", readAll(t, source, server.URL+"/rules.yaml"))
+	assert.Equal(t, 1, docs.notModified, "an unchanged document isn't fetched again")
+
+	docs.set("/rules.yaml", "RulesVersion: 3\n")
+	assert.Equal(t, "RulesVersion: 3\n", readAll(t, source, server.URL+"/rules.yaml"))
+
+	_, _, err = source.open(server.URL + "/missing.yaml")
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestConfigSourceSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sign := func(doc string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(doc)))
+	}
+	docs := &testDocumentServer{docs: map[string]string{
+		"/rules.yaml":     "RulesVersion: 2\n",
+		"/rules.yaml.sig": sign("RulesVersion: 2\n"),
+	}}
+	server := httptest.NewServer(docs)
+	defer server.Close()
+
+	_, err = newConfigSource(&CmdEnv{ConfigVerifyKey: "not a key"})
+	assert.Error(t, err)
+	source, err := newConfigSource(&CmdEnv{ConfigVerifyKey: base64.StdEncoding.EncodeToString(public)})
+	require.NoError(t, err)
+
+	assert.Equal(t, "RulesVersion: 2\n", readAll(t, source, server.URL+"/rules.yaml"))
+
+	// a change without a matching signature isn't used
+	docs.set("/rules.yaml", "RulesVersion: 3\n")
+	_, _, err = source.open(server.URL + "/rules.yaml")
+	assert.ErrorContains(t, err, "signature")
+
+	docs.set("/rules.yaml.sig", sign("RulesVersion: 3\n"))
+	assert.Equal(t, "RulesVersion: 3\n", readAll(t, source, server.URL+"/rules.yaml"))
+}
+
+func TestConfigSourceObjectStores(t *testing.T) {
+	docs := &testDocumentServer{docs: map[string]string{
+		"/bucket/configs/rules.yaml": "RulesVersion: 2\n",
+	}}
+	server := httptest.NewServer(docs)
+	defer server.Close()
+
+	env := map[string]string{
+		"AWS_ENDPOINT_URL_S3":       server.URL,
+		"AWS_REGION":                "eu-west-1",
+		"AWS_ACCESS_KEY_ID":         "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY":     "secret",
+		"STORAGE_EMULATOR_HOST":     strings.TrimPrefix(server.URL, "http://"),
+		"GOOGLE_OAUTH_ACCESS_TOKEN": "token",
+	}
+	source, err := newConfigSource(&CmdEnv{})
+	require.NoError(t, err)
+	source.getenv = func(name string) string { return env[name] }
+	source.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	assert.Equal(t, "RulesVersion: 2\n", readAll(t, source, "s3://bucket/configs/rules.yaml"))
+	req := docs.requests[len(docs.requests)-1]
+	auth := req.Header.Get("Authorization")
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="), auth)
+	assert.Equal(t, "20240501T120000Z", req.Header.Get("X-Amz-Date"))
+
+	assert.Equal(t, "RulesVersion: 2\n", readAll(t, source, "gs://bucket/configs/rules.yaml"))
+	req = docs.requests[len(docs.requests)-1]
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+	_, _, err = source.open("s3://bucket")
+	assert.Error(t, err)
+}
+
+func TestConfigSourceReload(t *testing.T) {
+	docs := &testDocumentServer{docs: map[string]string{
+		"/config.yaml": makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "Network.ListenAddr", "0.0.0.0:8080"),
+		"/rules.yaml":  makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1),
+	}}
+	server := httptest.NewServer(docs)
+	defer server.Close()
+
+	c, err := getConfig([]string{"--config", server.URL + "/config.yaml", "--rules_config", server.URL + "/rules.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:8080", c.GetListenAddr())
+
+	result := c.Reload("test")
+	assert.True(t, result.Applied)
+	assert.False(t, result.Changed)
+
+	docs.set("/config.yaml", makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "Network.ListenAddr", "0.0.0.0:9000"))
+	result = c.Reload("test")
+	assert.True(t, result.Changed)
+	assert.Equal(t, "0.0.0.0:9000", c.GetListenAddr())
+}
+
+func TestEscapePath(t *testing.T) {
+	assert.Equal(t, "configs/my%20rules%2Bv2.yaml", escapePath("configs/my rules+v2.yaml"))
+	assert.Equal(t, "a-b_c.d~e", escapePath("a-b_c.d~e"))
+}
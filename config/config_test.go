@@ -3,12 +3,14 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
 )
 
@@ -258,6 +260,140 @@ func TestReload(t *testing.T) {
 
 }
 
+func TestExplicitReload(t *testing.T) {
+	cm := makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "Network.ListenAddr", "0.0.0.0:8080")
+	rm := makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), c.GetGeneration())
+
+	var callbacks int
+	c.RegisterReloadCallback(func() { callbacks++ })
+
+	// nothing has changed
+	result := c.Reload("test")
+	assert.True(t, result.Applied)
+	assert.False(t, result.Changed)
+	assert.Equal(t, uint64(1), result.Generation)
+	assert.Equal(t, 0, callbacks)
+
+	// an invalid config is reported, and not applied
+	require.NoError(t, os.WriteFile(config, []byte(makeYAML("General.ConfigurationVersion", 2, "Network.ListenAddr", "0.0.0.0:9000", "Network.Bogus", true)), 0o644))
+	result = c.Reload("test")
+	assert.False(t, result.Applied)
+	assert.Equal(t, "validation failed", result.Error)
+	assert.NotEmpty(t, result.ConfigFailures)
+	assert.Equal(t, uint64(1), result.Generation)
+	assert.Equal(t, "0.0.0.0:8080", c.GetListenAddr())
+	assert.Equal(t, 0, callbacks)
+
+	// a valid change is applied, with a new generation
+	require.NoError(t, os.WriteFile(config, []byte(makeYAML("General.ConfigurationVersion", 2, "Network.ListenAddr", "0.0.0.0:9000")), 0o644))
+	result = c.Reload("test")
+	assert.True(t, result.Applied)
+	assert.True(t, result.Changed)
+	assert.Equal(t, uint64(2), result.Generation)
+	assert.Equal(t, uint64(2), c.GetGeneration())
+	assert.Equal(t, "0.0.0.0:9000", c.GetListenAddr())
+	assert.Equal(t, 1, callbacks)
+}
+
+func TestConfigHistory(t *testing.T) {
+	cm := makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "General.ConfigHistorySize", 2, "Network.ListenAddr", "0.0.0.0:8080", "RedisPeerManagement.Password", "first")
+	rm := makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+
+	history := c.GetConfigHistory()
+	require.Len(t, history, 1)
+	assert.Equal(t, "startup", history[0].Trigger)
+	assert.Equal(t, uint64(1), history[0].Generation)
+	assert.Empty(t, history[0].Changes)
+
+	cm = makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "General.ConfigHistorySize", 2, "Network.ListenAddr", "0.0.0.0:9000", "RedisPeerManagement.Password", "second")
+	require.NoError(t, os.WriteFile(config, []byte(cm), 0o644))
+	rm = makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 5)
+	require.NoError(t, os.WriteFile(rules, []byte(rm), 0o644))
+	result := c.Reload("test")
+	require.True(t, result.Changed)
+	expected := []ConfigChange{
+		{Document: "config", Path: "Network.ListenAddr", Change: "changed", Old: "0.0.0.0:8080", New: "0.0.0.0:9000"},
+		{Document: "config", Path: "RedisPeerManagement.Password", Change: "changed", Redacted: true},
+		{Document: "rules", Path: "Samplers.__default__.DeterministicSampler.SampleRate", Change: "changed", Old: "1", New: "5"},
+	}
+	assert.Equal(t, expected, result.Changes)
+
+	history = c.GetConfigHistory()
+	require.Len(t, history, 2)
+	assert.Equal(t, "test", history[0].Trigger)
+	assert.Equal(t, uint64(2), history[0].Generation)
+	assert.Equal(t, result.ConfigHash, history[0].ConfigHash)
+	assert.Equal(t, expected, history[0].Changes)
+
+	// an unchanged reload isn't a new version, and only the configured
+	// number of versions are kept
+	assert.False(t, c.Reload("test").Changed)
+	rm = makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 10)
+	require.NoError(t, os.WriteFile(rules, []byte(rm), 0o644))
+	require.True(t, c.Reload("again").Changed)
+	history = c.GetConfigHistory()
+	require.Len(t, history, 2)
+	assert.Equal(t, "again", history[0].Trigger)
+	assert.Equal(t, "test", history[1].Trigger)
+}
+
+func TestApplyPublished(t *testing.T) {
+	cm := makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "Network.ListenAddr", "0.0.0.0:8080")
+	rm := makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), c.GetConfigEpoch())
+
+	published := PublishedConfig{
+		Epoch:        3,
+		Config:       []byte(makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0), "Network.ListenAddr", "0.0.0.0:9000")),
+		ConfigFormat: FormatYAML,
+		Rules:        []byte(rm),
+		RulesFormat:  FormatYAML,
+	}
+	result := c.ApplyPublished(published)
+	assert.True(t, result.Applied)
+	assert.True(t, result.Changed)
+	assert.Equal(t, uint64(3), result.Epoch)
+	assert.Equal(t, uint64(3), c.GetConfigEpoch())
+	assert.Equal(t, "0.0.0.0:9000", c.GetListenAddr())
+
+	// the published version stays in use when the local files are reloaded
+	result = c.Reload("test")
+	assert.True(t, result.Applied)
+	assert.False(t, result.Changed)
+	assert.Equal(t, "0.0.0.0:9000", c.GetListenAddr())
+
+	// an epoch that isn't newer is ignored
+	result = c.ApplyPublished(published)
+	assert.False(t, result.Applied)
+	assert.Equal(t, uint64(3), c.GetConfigEpoch())
+
+	// an invalid version isn't applied, and the previous one stays in use
+	published.Epoch = 4
+	published.Config = []byte(makeYAML("General.ConfigurationVersion", 2, "Network.ListenAddr", "0.0.0.0:7000", "Network.Bogus", true))
+	result = c.ApplyPublished(published)
+	assert.False(t, result.Applied)
+	assert.NotEmpty(t, result.ConfigFailures)
+	assert.Equal(t, uint64(3), c.GetConfigEpoch())
+	assert.True(t, c.Reload("test").Applied)
+	assert.Equal(t, "0.0.0.0:9000", c.GetListenAddr())
+}
+
 func TestReloadDisabled(t *testing.T) {
 	cm := makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0*time.Second), "Network.ListenAddr", "0.0.0.0:8080")
 	rm := makeYAML("ConfigVersion", 2)
@@ -402,6 +538,147 @@ func TestPeerManagementType(t *testing.T) {
 	}
 }
 
+func TestRedisSettings(t *testing.T) {
+	cm := makeYAML(
+		"General.ConfigurationVersion", 2,
+		"RedisPeerManagement.Host", "redis:6379",
+		"RedisPeerManagement.Database", 3,
+		"RedisPeerManagement.UseTLS", true,
+		"RedisPeerManagement.MaxActive", 50,
+	)
+	rm := makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+
+	settings := c.GetRedisSettings()
+	require.NoError(t, settings.Validate())
+	assert.Equal(t, []string{"redis:6379"}, settings.Hosts)
+	assert.False(t, settings.UseSentinel())
+	assert.Equal(t, 3, settings.Database)
+	assert.Equal(t, "refinery", settings.Prefix)
+	assert.Equal(t, RedisTLSSettings{Enabled: true}, settings.TLS)
+	assert.Equal(t, RedisPoolSettings{MaxIdle: 30, MaxActive: 50}, settings.Pool)
+	assert.Equal(t, RedisTimeouts{Connect: 30 * time.Second, Idle: 5 * time.Second, Drain: 10 * time.Second}, settings.Timeouts)
+	assert.Equal(t, 10, settings.Parallelism)
+
+	// Hosts takes precedence over Host
+	cm = makeYAML(
+		"General.ConfigurationVersion", 2,
+		"RedisPeerManagement.Host", "redis:6379",
+		"RedisPeerManagement.Hosts", []string{"sentinel-1:26379", "sentinel-2:26379"},
+		"RedisPeerManagement.SentinelMaster", "refinery",
+		"RedisPeerManagement.ConnectTimeout", "2s",
+	)
+	require.NoError(t, os.WriteFile(config, []byte(cm), 0o644))
+	c, err = getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+	settings = c.GetRedisSettings()
+	require.NoError(t, settings.Validate())
+	assert.Equal(t, []string{"sentinel-1:26379", "sentinel-2:26379"}, settings.Hosts)
+	assert.True(t, settings.UseSentinel())
+	assert.Equal(t, 2*time.Second, settings.Timeouts.Connect)
+}
+
+func TestRedisSettingsValidate(t *testing.T) {
+	settings := RedisSettings{}.withDefaults()
+	assert.Equal(t, []string{DefaultRedisHost}, settings.Hosts)
+	assert.NoError(t, settings.Validate())
+
+	settings.Hosts = []string{"redis-1:6379", "redis-2:6379"}
+	assert.ErrorContains(t, settings.Validate(), "requires SentinelMaster")
+	settings.SentinelMaster = "refinery"
+	assert.NoError(t, settings.Validate())
+
+	settings.Hosts = []string{"redis"}
+	settings.Database = -1
+	err := settings.Validate()
+	assert.ErrorContains(t, err, "invalid Redis host 'redis'")
+	assert.ErrorContains(t, err, "invalid Redis database -1")
+}
+
+func TestListenerConfig(t *testing.T) {
+	cm := makeYAML(
+		"General.ConfigurationVersion", 2,
+		"Network.ListenAddr", "0.0.0.0:8080",
+		"Network.HTTPIdleTimeout", "90s",
+		"GRPCServerParameters.ListenAddr", "0.0.0.0:4317",
+		"TLS.CertFile", "/etc/refinery/ingest.crt",
+		"TLS.KeyFile", "/etc/refinery/ingest.key",
+		"HTTPListener.ReadTimeout", "30s",
+		"HTTPListener.MaxConnections", 1000,
+		"GRPCListener.ListenAddr", "0.0.0.0:14317",
+		"AdminListener.ListenAddr", "127.0.0.1:8082",
+	)
+	rm := makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+
+	// the ingest listeners fall back to the older settings
+	assert.Equal(t, ListenerConfig{
+		ListenAddr:     "0.0.0.0:8080",
+		CertFile:       "/etc/refinery/ingest.crt",
+		KeyFile:        "/etc/refinery/ingest.key",
+		ReadTimeout:    Duration(30 * time.Second),
+		IdleTimeout:    Duration(90 * time.Second),
+		MaxConnections: 1000,
+	}, c.GetListenerConfig(ListenerHTTP))
+	grpcListener := c.GetListenerConfig(ListenerGRPC)
+	assert.Equal(t, "0.0.0.0:14317", grpcListener.ListenAddr)
+	assert.True(t, grpcListener.TLSEnabled())
+
+	// the admin listener doesn't
+	assert.Equal(t, ListenerConfig{ListenAddr: "127.0.0.1:8082"}, c.GetListenerConfig(ListenerAdmin))
+}
+
+func TestOTLPStreamingDefaults(t *testing.T) {
+	cm := makeYAML("General.ConfigurationVersion", 2)
+	rm := makeYAML("ConfigVersion", 2)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--no-validate", "--config", config, "--rules_config", rules})
+	assert.NoError(t, err)
+
+	assert.Equal(t, MemorySize(10*Mi), c.GetOTLPStreamingThreshold())
+	assert.Equal(t, 5*time.Second, c.GetOTLPStreamingBackpressureTimeout())
+}
+
+func TestIDFieldRules(t *testing.T) {
+	cm := makeYAML(
+		"General.ConfigurationVersion", 2,
+		"IDFields.TraceNames", []string{"trace.trace_id"},
+		"IDFields.ParentNames", []string{"trace.parent_id"},
+		"IDFields.DatasetRules", map[string]any{
+			"legacy": map[string]any{
+				"TraceNames":     []string{"request_id"},
+				"TraceTransform": "^req-(.+)$",
+			},
+		},
+	)
+	rm := makeYAML("ConfigVersion", 2)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--no-validate", "--config", config, "--rules_config", rules})
+	assert.NoError(t, err)
+
+	assert.Equal(t, IDFieldRules{
+		TraceNames:     []string{"request_id"},
+		ParentNames:    []string{"trace.parent_id"},
+		TraceTransform: "^req-(.+)$",
+	}, c.GetIDFieldRules("legacy"))
+	assert.Equal(t, IDFieldRules{
+		TraceNames:  []string{"trace.trace_id"},
+		ParentNames: []string{"trace.parent_id"},
+	}, c.GetIDFieldRules("other"))
+}
+
 func TestDebugServiceAddr(t *testing.T) {
 	cm := makeYAML("General.ConfigurationVersion", 2, "Debugging.DebugServiceAddr", "localhost:8085")
 	rm := makeYAML("ConfigVersion", 2)
@@ -430,6 +707,50 @@ func TestHTTPIdleTimeout(t *testing.T) {
 	}
 }
 
+func TestHTTP2Config(t *testing.T) {
+	cm := makeYAML("General.ConfigurationVersion", 2, "HTTP2.Enabled", true, "HTTP2.AllowH2C", true)
+	rm := makeYAML("ConfigVersion", 2)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--no-validate", "--config", config, "--rules_config", rules})
+	assert.NoError(t, err)
+
+	assert.Equal(t, HTTP2Config{
+		Enabled:              true,
+		AllowH2C:             true,
+		MaxConcurrentStreams: 250,
+		MaxReadFrameSize:     1024 * 1024,
+	}, c.GetHTTP2Config())
+}
+
+func TestRedactionConfig(t *testing.T) {
+	cm := makeYAML(
+		"General.ConfigurationVersion", 2,
+		"Redaction.HashSalt", "salt",
+		"Redaction.DatasetRules", map[string]any{
+			"*":        []map[string]any{{"Attributes": []string{"*.password"}, "Action": "drop"}},
+			"checkout": []map[string]any{{"Attributes": []string{"db.statement"}, "Action": "truncate", "MaxLength": 100}},
+		},
+	)
+	rm := makeYAML("ConfigVersion", 2)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--no-validate", "--config", config, "--rules_config", rules})
+	assert.NoError(t, err)
+
+	redaction := c.GetRedactionConfig()
+	assert.Equal(t, "salt", redaction.HashSalt)
+	assert.Equal(t, []RedactionRule{
+		{Attributes: []string{"*.password"}, Action: RedactDrop},
+		{Attributes: []string{"db.statement"}, Action: RedactTruncate, MaxLength: 100},
+	}, redaction.RulesFor("checkout"))
+	assert.Equal(t, []RedactionRule{
+		{Attributes: []string{"*.password"}, Action: RedactDrop},
+	}, redaction.RulesFor("frontend"))
+}
+
 func TestDryRun(t *testing.T) {
 	cm := makeYAML("General.ConfigurationVersion", 2, "Debugging.DryRun", true)
 	rm := makeYAML("ConfigVersion", 2)
@@ -539,6 +860,20 @@ func TestGetSamplerTypes(t *testing.T) {
 		"Samplers.dataset3.EMADynamicSampler.Weight", 0.3,
 		"Samplers.dataset4.TotalThroughputSampler.GoalThroughputPerSec", 100,
 		"Samplers.dataset4.TotalThroughputSampler.FieldList", []string{"request.method"},
+		"Samplers.dataset5.BudgetSampler.GoalThroughputPerSec", 100,
+		"Samplers.dataset5.BudgetSampler.KeyField", "service.name",
+		"Samplers.dataset5.BudgetSampler.Budgets.checkout.MinPerSec", 20,
+		"Samplers.dataset5.BudgetSampler.Budgets.healthcheck.MaxPerSec", 1,
+		"Samplers.dataset6.CompositeSampler.Steps", []map[string]any{
+			{
+				"Name":       "busy",
+				"Conditions": []map[string]any{{"Field": "service.name", "Operator": "=", "Value": "checkout"}},
+				"Sampler":    map[string]any{"EMADynamicSampler": map[string]any{"GoalSampleRate": 10}},
+			},
+			{
+				"Sampler": map[string]any{"DeterministicSampler": map[string]any{"SampleRate": 5}},
+			},
+		},
 	)
 	config, rules := createTempConfigs(t, cm, rm)
 	defer os.Remove(rules)
@@ -570,6 +905,29 @@ func TestGetSamplerTypes(t *testing.T) {
 		assert.IsType(t, &TotalThroughputSamplerConfig{}, d)
 		assert.Equal(t, "TotalThroughputSampler", name)
 	}
+
+	if d, name, err := c.GetSamplerConfigForDestName("dataset5"); assert.Equal(t, nil, err) {
+		assert.Equal(t, &BudgetSamplerConfig{
+			GoalThroughputPerSec: 100,
+			KeyField:             "service.name",
+			Budgets: map[string]KeyBudget{
+				"checkout":    {MinPerSec: 20},
+				"healthcheck": {MaxPerSec: 1},
+			},
+		}, d)
+		assert.Equal(t, "BudgetSampler", name)
+	}
+
+	if d, name, err := c.GetSamplerConfigForDestName("dataset6"); assert.Equal(t, nil, err) {
+		assert.Equal(t, "CompositeSampler", name)
+		if composite, ok := d.(*CompositeSamplerConfig); assert.True(t, ok) && assert.Len(t, composite.Steps, 2) {
+			assert.Equal(t, "busy", composite.Steps[0].Name)
+			assert.Equal(t, "service.name", composite.Steps[0].Conditions[0].Field)
+			assert.Equal(t, 10, composite.Steps[0].Sampler.EMADynamicSampler.GoalSampleRate)
+			assert.Equal(t, 5, composite.Steps[1].Sampler.DeterministicSampler.SampleRate)
+			assert.Equal(t, "1", composite.Steps[1].StepName(1))
+		}
+	}
 }
 
 func TestDefaultSampler(t *testing.T) {
@@ -1124,3 +1482,110 @@ func TestMemorySizeMarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestTenantSamplers(t *testing.T) {
+	cm := makeYAML("General.ConfigurationVersion", 2)
+	rm := makeYAML(
+		"RulesVersion", 2,
+		"Samplers.__default__.DeterministicSampler.SampleRate", 1,
+		"Samplers.production.DeterministicSampler.SampleRate", 2,
+		"Samplers.staging.DeterministicSampler.SampleRate", 3,
+		"Tenants.acme.APIKeys", []string{"acmekey1", "acmekey2"},
+		"Tenants.acme.Samplers.__default__.DeterministicSampler.SampleRate", 10,
+		"Tenants.acme.Samplers.production.DeterministicSampler.SampleRate", 20,
+		"Tenants.globex.APIKeys", []string{"globexkey"},
+		"Tenants.globex.Teams", []string{"globex-corp"},
+	)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--no-validate", "--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+
+	assert.Equal(t, "acme", c.GetTenantForAPIKey("acmekey2"))
+	assert.Equal(t, "globex", c.GetTenantForAPIKey("globexkey"))
+	assert.Equal(t, "", c.GetTenantForAPIKey("otherkey"))
+	assert.Equal(t, "", c.GetTenantForAPIKey(""))
+	assert.Equal(t, "globex", c.GetTenantForTeam("globex-corp"))
+	assert.Equal(t, "", c.GetTenantForTeam("acme-corp"))
+	assert.Equal(t, "", c.GetTenantForTeam(""))
+
+	// the rules shown by /query/allrules don't give the keys away
+	redacted := c.GetAllSamplerRules().RedactTenantKeys(func(string) string { return "****" })
+	assert.Equal(t, []string{"****", "****"}, redacted.Tenants["acme"].APIKeys)
+	assert.Equal(t, []string{"globex-corp"}, redacted.Tenants["globex"].Teams)
+	assert.Equal(t, []string{"acmekey1", "acmekey2"}, c.GetAllSamplerRules().Tenants["acme"].APIKeys)
+
+	for selector, rate := range map[string]int{
+		// a tenant's own samplers come first, then its default
+		TenantSelector("acme", "production"): 20,
+		TenantSelector("acme", "staging"):    10,
+		// a tenant without samplers uses the top-level ones
+		TenantSelector("globex", "staging"):  3,
+		TenantSelector("globex", "dev"):      1,
+		TenantSelector("unknown", "staging"): 3,
+		"production":                         2,
+		"dev":                                1,
+	} {
+		d, name, err := c.GetSamplerConfigForDestName(selector)
+		if assert.NoError(t, err, selector) {
+			assert.Equal(t, "DeterministicSampler", name, selector)
+			assert.Equal(t, rate, d.(*DeterministicSamplerConfig).SampleRate, selector)
+		}
+	}
+
+	tenant, target, ok := ParseTenantSelector(TenantSelector("acme", "my/dataset"))
+	assert.True(t, ok)
+	assert.Equal(t, "acme", tenant)
+	assert.Equal(t, "my/dataset", target)
+	_, _, ok = ParseTenantSelector("production")
+	assert.False(t, ok)
+}
+
+func TestValueListsLoadWithRules(t *testing.T) {
+	t.Cleanup(func() { applyValueLists(nil) })
+	listFile := filepath.Join(t.TempDir(), "beta.txt")
+	require.NoError(t, os.WriteFile(listFile, []byte("cust-1\n"), 0o644))
+	source := "file:" + listFile
+
+	cm := makeYAML("General.ConfigurationVersion", 2, "General.ConfigReloadInterval", Duration(0))
+	rm := fmt.Sprintf(`RulesVersion: 2
+Samplers:
+  __default__:
+    RulesBasedSampler:
+      Rules:
+        - Name: beta
+          SampleRate: 1
+          Conditions:
+            - Field: customer.id
+              Operator: in
+              ValuesFrom: %s
+`, source)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+
+	// the list is ready as soon as the rules are
+	list, err := GetValueList(source)
+	require.NoError(t, err)
+	assert.True(t, list.Loaded())
+	assert.True(t, list.Contains("cust-1", ""))
+
+	// a reload rereads it
+	require.NoError(t, os.WriteFile(listFile, []byte("cust-2\n"), 0o644))
+	require.True(t, c.Reload("test").Applied)
+	assert.True(t, list.Contains("cust-2", ""))
+
+	// rules naming a list that can't be read aren't applied
+	require.NoError(t, os.Remove(listFile))
+	result := c.Reload("test")
+	assert.False(t, result.Applied)
+	require.Len(t, result.RulesFailures, 1)
+	assert.Contains(t, result.RulesFailures[0], "can't be loaded")
+	assert.True(t, list.Contains("cust-2", ""))
+
+	_, err = getConfig([]string{"--config", config, "--rules_config", rules})
+	assert.Error(t, err)
+}
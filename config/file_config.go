@@ -3,9 +3,12 @@ package config
 import (
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"math/rand"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,17 +36,34 @@ func (d *Duration) UnmarshalText(text []byte) error {
 }
 
 type fileConfig struct {
-	mainConfig    *configContents
-	mainHash      string
-	rulesConfig   *V2SamplerConfig
-	rulesHash     string
+	mainConfig  *configContents
+	mainHash    string
+	rulesConfig *V2SamplerConfig
+	rulesHash   string
+	scoped      map[string][]string
+	tenants     tenantIndex
+	// valueLists holds the value lists loaded with the rules, until they're
+	// applied
+	valueLists    map[string][]string
 	opts          *CmdEnv
+	source        *configSource
 	callbacks     []func()
 	errorCallback func(error)
 	done          chan struct{}
 	ticker        *time.Ticker
 	mux           sync.RWMutex
 	lastLoadTime  time.Time
+	// generation increases each time a reload changes the configuration
+	generation uint64
+	// reloadMux keeps reloads from different triggers from overlapping
+	reloadMux sync.Mutex
+	// epoch is the epoch of the last published configuration applied
+	epoch uint64
+	// refs are the values of the config that were resolved from references,
+	// by their paths, as they're written
+	refs map[string]string
+	// history holds the most recent versions, oldest first
+	history []ConfigVersion
 }
 
 type configContents struct {
@@ -56,9 +76,11 @@ type configContents struct {
 	Logger               LoggerConfig              `yaml:"Logger"`
 	HoneycombLogger      HoneycombLoggerConfig     `yaml:"HoneycombLogger"`
 	StdoutLogger         StdoutLoggerConfig        `yaml:"StdoutLogger"`
+	JSONLogger           JSONLoggerConfig          `yaml:"JSONLogger"`
 	PrometheusMetrics    PrometheusMetricsConfig   `yaml:"PrometheusMetrics"`
 	LegacyMetrics        LegacyMetricsConfig       `yaml:"LegacyMetrics"`
 	OTelMetrics          OTelMetricsConfig         `yaml:"OTelMetrics"`
+	MetricLabels         MetricLabelsConfig        `yaml:"MetricLabels"`
 	OTelTracing          OTelTracingConfig         `yaml:"OTelTracing"`
 	PeerManagement       PeerManagementConfig      `yaml:"PeerManagement"`
 	RedisPeerManagement  RedisPeerManagementConfig `yaml:"RedisPeerManagement"`
@@ -70,26 +92,94 @@ type configContents struct {
 	SampleCache          SampleCacheConfig         `yaml:"SampleCache"`
 	StressRelief         StressReliefConfig        `yaml:"StressRelief"`
 	CentralStore         SmartWrapperOptions       `yaml:"CentralStore"`
+	DecisionExport       DecisionExportConfig      `yaml:"DecisionExport"`
+	DropAudit            DropAuditConfig           `yaml:"DropAudit"`
+	TLS                  TLSConfig                 `yaml:"TLS"`
+	XRay                 XRayConfig                `yaml:"XRay"`
+	Datadog              DatadogConfig             `yaml:"Datadog"`
+	Federation           FederationConfig          `yaml:"Federation"`
+	SpanReduction        SpanReductionConfig       `yaml:"SpanReduction"`
+	SamplingHints        SamplingHintsConfig       `yaml:"SamplingHints"`
+	HTTP2                HTTP2Config               `yaml:"HTTP2"`
+	ProxyProtocol        ProxyProtocolConfig       `yaml:"ProxyProtocol"`
+	Redaction            RedactionConfig           `yaml:"Redaction"`
+	LateErrorRecovery    LateErrorRecoveryConfig   `yaml:"LateErrorRecovery"`
+	ConsistentSampling   ConsistentSamplingConfig  `yaml:"ConsistentSampling"`
+	TraceSpill           TraceSpillConfig          `yaml:"TraceSpill"`
+	TraceLimits          TraceLimitsConfig         `yaml:"TraceLimits"`
+	AdaptiveTraceTimeout AdaptiveTimeoutConfig     `yaml:"AdaptiveTraceTimeout"`
+	LateSpans            LateSpansConfig           `yaml:"LateSpans"`
+	MemoryBudget         MemoryBudgetConfig        `yaml:"MemoryBudget"`
+	SpanDedup            SpanDedupConfig           `yaml:"SpanDedup"`
+	MissingRoot          MissingRootConfig         `yaml:"MissingRoot"`
+	CollectionOverrides  CollectionOverridesConfig `yaml:"CollectionOverrides"`
+	DecisionWarmup       DecisionWarmupConfig      `yaml:"DecisionWarmup"`
+	StateCompaction      StateCompactionConfig     `yaml:"StateCompaction"`
+	SpanSummaries        SpanSummaryConfig         `yaml:"SpanSummaries"`
+	SendPacing           SendPacingConfig          `yaml:"SendPacing"`
+	StateSnapshot        StateSnapshotConfig       `yaml:"StateSnapshot"`
+	ConfigDistribution   ConfigDistributionConfig  `yaml:"ConfigDistribution"`
+	HTTPListener         ListenerConfig            `yaml:"HTTPListener"`
+	GRPCListener         ListenerConfig            `yaml:"GRPCListener"`
+	AdminListener        ListenerConfig            `yaml:"AdminListener"`
+	FeatureFlags         FeatureFlagsConfig        `yaml:"FeatureFlags"`
+	SamplingGoals        SamplingGoalsConfig       `yaml:"SamplingGoals"`
+	Profiling            ProfilingConfig           `yaml:"Profiling"`
+	Health               HealthConfig              `yaml:"Health"`
+	UpstreamProbe        UpstreamProbeConfig       `yaml:"UpstreamProbe"`
+	Drain                DrainConfig               `yaml:"Drain"`
+	Supervision          SupervisionConfig         `yaml:"Supervision"`
+	UpstreamQueue        UpstreamQueueConfig       `yaml:"UpstreamQueue"`
+	KafkaOutput          KafkaOutputConfig         `yaml:"KafkaOutput"`
+	OTLPUpstream         OTLPUpstreamConfig        `yaml:"OTLPUpstream"`
+	Destinations         DestinationsConfig        `yaml:"Destinations"`
+	AdaptiveBatching     AdaptiveBatchingConfig    `yaml:"AdaptiveBatching"`
 }
 
 type GeneralConfig struct {
-	ConfigurationVersion int      `yaml:"ConfigurationVersion"`
-	MinRefineryVersion   string   `yaml:"MinRefineryVersion" default:"v2.0"`
-	DatasetPrefix        string   `yaml:"DatasetPrefix" `
-	ConfigReloadInterval Duration `yaml:"ConfigReloadInterval" default:"15s"`
+	ConfigurationVersion     int      `yaml:"ConfigurationVersion"`
+	MinRefineryVersion       string   `yaml:"MinRefineryVersion" default:"v2.0"`
+	DatasetPrefix            string   `yaml:"DatasetPrefix" `
+	ConfigReloadInterval     Duration `yaml:"ConfigReloadInterval" default:"15s"`
+	ValueListRefreshInterval Duration `yaml:"ValueListRefreshInterval" default:"60s"`
+	ConfigHistorySize        int      `yaml:"ConfigHistorySize" default:"20"`
 }
 
 type NetworkConfig struct {
-	ListenAddr      string   `yaml:"ListenAddr" default:"0.0.0.0:8080" cmdenv:"HTTPListenAddr"`
-	PeerListenAddr  string   `yaml:"PeerListenAddr" default:"0.0.0.0:8081" cmdenv:"PeerListenAddr"`
-	HoneycombAPI    string   `yaml:"HoneycombAPI" default:"https://api.honeycomb.io" cmdenv:"HoneycombAPI"`
-	HTTPIdleTimeout Duration `yaml:"HTTPIdleTimeout"`
+	ListenAddr                       string     `yaml:"ListenAddr" default:"0.0.0.0:8080" cmdenv:"HTTPListenAddr"`
+	PeerListenAddr                   string     `yaml:"PeerListenAddr" default:"0.0.0.0:8081" cmdenv:"PeerListenAddr"`
+	HoneycombAPI                     string     `yaml:"HoneycombAPI" default:"https://api.honeycomb.io" cmdenv:"HoneycombAPI"`
+	HTTPIdleTimeout                  Duration   `yaml:"HTTPIdleTimeout"`
+	MaxConcurrentRequests            int        `yaml:"MaxConcurrentRequests" default:"0"`
+	MaxIngestPause                   Duration   `yaml:"MaxIngestPause" default:"15m"`
+	OTLPStreamingThreshold           MemorySize `yaml:"OTLPStreamingThreshold" default:"10MiB"`
+	OTLPStreamingBackpressureTimeout Duration   `yaml:"OTLPStreamingBackpressureTimeout" default:"5s"`
+	OTLPRejectedSpans                string     `yaml:"OTLPRejectedSpans" default:"partial"`
+	AdmissionQueueThreshold          int        `yaml:"AdmissionQueueThreshold" default:"0"`
+	AdmissionMemoryThreshold         int        `yaml:"AdmissionMemoryThreshold" default:"0"`
+	AdmissionRetryAfter              Duration   `yaml:"AdmissionRetryAfter" default:"5s"`
 }
 
 type AccessKeyConfig struct {
 	ReceiveKeys          []string `yaml:"ReceiveKeys" default:"[]"`
 	AcceptOnlyListedKeys bool     `yaml:"AcceptOnlyListedKeys"`
+	DeniedKeys           []string `yaml:"DeniedKeys" default:"[]"`
+	ValidateUnknownKeys  bool     `yaml:"ValidateUnknownKeys"`
+	ValidationCacheTTL   Duration `yaml:"ValidationCacheTTL" default:"10m"`
+	KeyRedaction         string   `yaml:"KeyRedaction" default:"hmac"`
+	KeyRedactionSalt     string   `yaml:"KeyRedactionSalt"`
+	QuarantineThreshold  int      `yaml:"QuarantineThreshold" default:"100"`
+	QuarantineDuration   Duration `yaml:"QuarantineDuration" default:"5m"`
 	keymap               generics.Set[string]
+	denymap              generics.Set[string]
+}
+
+// IsDenied returns true if the key is on the deny list.
+func (a *AccessKeyConfig) IsDenied(key string) bool {
+	if a.denymap == nil {
+		return slices.Contains(a.DeniedKeys, key)
+	}
+	return a.denymap.Contains(key)
 }
 
 type DefaultTrue bool
@@ -121,6 +211,8 @@ type RefineryTelemetryConfig struct {
 	AddSpanCountToRoot     *DefaultTrue `yaml:"AddSpanCountToRoot" default:"true"` // Avoid pointer woe on access, use GetAddSpanCountToRoot() instead.
 	AddCountsToRoot        bool         `yaml:"AddCountsToRoot"`
 	AddHostMetadataToTrace *DefaultTrue `yaml:"AddHostMetadataToTrace" default:"true"` // Avoid pointer woe on access, use GetAddHostMetadataToTrace() instead.
+	ReparentOrphanSpans    bool         `yaml:"ReparentOrphanSpans"`
+	AddDecisionToSpans     bool         `yaml:"AddDecisionToSpans"`
 }
 
 type TracesConfig struct {
@@ -132,15 +224,17 @@ type TracesConfig struct {
 }
 
 type DebuggingConfig struct {
-	DebugServiceAddr      string   `yaml:"DebugServiceAddr"`
-	QueryAuthToken        string   `yaml:"QueryAuthToken" cmdenv:"QueryAuthToken"`
-	AdditionalErrorFields []string `yaml:"AdditionalErrorFields" default:"[\"trace.span_id\"]"`
-	DryRun                bool     `yaml:"DryRun" `
+	DebugServiceAddr         string   `yaml:"DebugServiceAddr"`
+	QueryAuthToken           string   `yaml:"QueryAuthToken" cmdenv:"QueryAuthToken"`
+	AdditionalErrorFields    []string `yaml:"AdditionalErrorFields" default:"[\"trace.span_id\"]"`
+	DryRun                   bool     `yaml:"DryRun" `
+	SamplerKeyReportInterval Duration `yaml:"SamplerKeyReportInterval"`
 }
 
 type LoggerConfig struct {
-	Type  string `yaml:"Type" default:"stdout"`
-	Level Level  `yaml:"Level" default:"warn"`
+	Type       string           `yaml:"Type" default:"stdout"`
+	Level      Level            `yaml:"Level" default:"warn"`
+	Subsystems map[string]Level `yaml:"Subsystems"`
 }
 
 type HoneycombLoggerConfig struct {
@@ -163,9 +257,42 @@ type StdoutLoggerConfig struct {
 	SamplerThroughput int  `yaml:"SamplerThroughput" default:"10"`
 }
 
+type JSONLoggerConfig struct {
+	SamplerEnabled    *DefaultTrue `yaml:"SamplerEnabled" default:"true"` // Avoid pointer woe on access, use GetSamplerEnabled() instead.
+	SamplerThroughput int          `yaml:"SamplerThroughput" default:"10"`
+}
+
+// GetSamplerEnabled returns whether configuration has enabled sampling of
+// repetitive logs written by the JSONLogger.
+func (c *JSONLoggerConfig) GetSamplerEnabled() (enabled bool) {
+	return c.SamplerEnabled.Get()
+}
+
 type PrometheusMetricsConfig struct {
-	Enabled    bool   `yaml:"Enabled" default:"false"`
-	ListenAddr string `yaml:"ListenAddr" default:"localhost:2112"`
+	Enabled                     bool                 `yaml:"Enabled" default:"false"`
+	ListenAddr                  string               `yaml:"ListenAddr" default:"localhost:2112"`
+	NativeHistograms            bool                 `yaml:"NativeHistograms" default:"false"`
+	NativeHistogramBucketFactor float64              `yaml:"NativeHistogramBucketFactor" default:"1.1"`
+	HistogramBuckets            []float64            `yaml:"HistogramBuckets"`
+	MetricBuckets               map[string][]float64 `yaml:"MetricBuckets"`
+	Exemplars                   bool                 `yaml:"Exemplars" default:"false"`
+}
+
+// BucketsFor returns the classic histogram buckets for the named metric: its
+// entry in MetricBuckets, then HistogramBuckets, then nil for the default.
+func (p PrometheusMetricsConfig) BucketsFor(name string) []float64 {
+	if buckets, ok := p.MetricBuckets[name]; ok {
+		return buckets
+	}
+	return p.HistogramBuckets
+}
+
+// MetricLabelsConfig controls which dimensions the metrics that support labels
+// are broken down by, and how many series each of them can have.
+type MetricLabelsConfig struct {
+	Dimensions      []string       `yaml:"Dimensions"`
+	MaxSeries       int            `yaml:"MaxSeries" default:"100"`
+	MetricMaxSeries map[string]int `yaml:"MetricMaxSeries"`
 }
 
 type LegacyMetricsConfig struct {
@@ -177,20 +304,28 @@ type LegacyMetricsConfig struct {
 }
 
 type OTelMetricsConfig struct {
-	Enabled           bool     `yaml:"Enabled" default:"false"`
-	APIHost           string   `yaml:"APIHost" default:"https://api.honeycomb.io"`
-	APIKey            string   `yaml:"APIKey" cmdenv:"OTelMetricsAPIKey,HoneycombAPIKey"`
-	Dataset           string   `yaml:"Dataset" default:"Refinery Metrics"`
-	Compression       string   `yaml:"Compression" default:"gzip"`
-	ReportingInterval Duration `yaml:"ReportingInterval" default:"30s"`
+	Enabled            bool              `yaml:"Enabled" default:"false"`
+	APIHost            string            `yaml:"APIHost" default:"https://api.honeycomb.io"`
+	APIKey             string            `yaml:"APIKey" cmdenv:"OTelMetricsAPIKey,HoneycombAPIKey"`
+	Dataset            string            `yaml:"Dataset" default:"Refinery Metrics"`
+	Compression        string            `yaml:"Compression" default:"gzip"`
+	ReportingInterval  Duration          `yaml:"ReportingInterval" default:"30s"`
+	Protocol           string            `yaml:"Protocol" default:"http/protobuf"`
+	Endpoint           string            `yaml:"Endpoint"`
+	Headers            map[string]string `yaml:"Headers" default:"{}"`
+	Temporality        string            `yaml:"Temporality" default:"delta"`
+	ResourceAttributes map[string]string `yaml:"ResourceAttributes" default:"{}"`
 }
 
 type OTelTracingConfig struct {
-	Type       string `yaml:"Type" default:"none"`
-	APIHost    string `yaml:"APIHost" default:"https://api.honeycomb.io"`
-	APIKey     string `yaml:"APIKey" cmdenv:"OTelTracesAPIKey,HoneycombAPIKey"`
-	Dataset    string `yaml:"Dataset" default:"Refinery Traces"`
-	SampleRate uint64 `yaml:"SampleRate" default:"100"`
+	Type       string            `yaml:"Type" default:"none"`
+	APIHost    string            `yaml:"APIHost" default:"https://api.honeycomb.io"`
+	APIKey     string            `yaml:"APIKey" cmdenv:"OTelTracesAPIKey,HoneycombAPIKey"`
+	Dataset    string            `yaml:"Dataset" default:"Refinery Traces"`
+	SampleRate uint64            `yaml:"SampleRate" default:"100"`
+	Protocol   string            `yaml:"Protocol" default:"http/protobuf"`
+	Endpoint   string            `yaml:"Endpoint"`
+	Headers    map[string]string `yaml:"Headers" default:"{}"`
 }
 
 type PeerManagementConfig struct {
@@ -203,6 +338,8 @@ type PeerManagementConfig struct {
 
 type RedisPeerManagementConfig struct {
 	Host             string   `yaml:"Host" cmdenv:"RedisHost"`
+	Hosts            []string `yaml:"Hosts"`
+	SentinelMaster   string   `yaml:"SentinelMaster"`
 	Username         string   `yaml:"Username" cmdenv:"RedisUsername"`
 	Password         string   `yaml:"Password" cmdenv:"RedisPassword"`
 	AuthCode         string   `yaml:"AuthCode" cmdenv:"RedisAuthCode"`
@@ -210,9 +347,11 @@ type RedisPeerManagementConfig struct {
 	UseTLS           bool     `yaml:"UseTLS"`
 	UseTLSInsecure   bool     `yaml:"UseTLSInsecure"`
 	Timeout          Duration `yaml:"Timeout" default:"5s"`
+	ConnectTimeout   Duration `yaml:"ConnectTimeout" default:"30s"`
 	Prefix           string   `yaml:"Prefix" default:"refinery"`
 	MaxIdle          int      `yaml:"MaxIdle" default:"30"`
 	MaxActive        int      `yaml:"MaxActive" default:"30"`
+	DrainTimeout     Duration `yaml:"DrainTimeout" default:"10s"`
 	Parallelism      int      `yaml:"Parallelism" default:"10"`
 	MetricsCycleRate Duration `yaml:"MetricsCycleRate" default:"1m"`
 }
@@ -231,9 +370,11 @@ type CollectionConfig struct {
 	ShutdownDelay           Duration   `yaml:"ShutdownDelay" default:"30s"`
 	MemoryCycleDuration     Duration   `yaml:"MemoryCycleDuration" default:"10s"`
 	UseDecisionGossip       bool       `yaml:"UseDecisionGossip"`
+	GossipPublishTimes      bool       `yaml:"GossipPublishTimes"`
 	AggregationInterval     Duration   `yaml:"AggregationInterval" default:"50ms"`
 	AggregationCount        int        `yaml:"AggregationCount" default:"500"`
 	AggregationConcurrency  int        `yaml:"AggregationConcurrency" default:"4"`
+	Workers                 int        `yaml:"Workers" default:"1"`
 }
 
 type SmartWrapperOptions struct {
@@ -244,6 +385,9 @@ type SmartWrapperOptions struct {
 	StateBatchSize     int      `yaml:"StateBatchSize" default:"400"`
 	SendDelay          Duration `yaml:"SendDelay" default:"2s"`
 	TraceTimeout       Duration `yaml:"TraceTimeout" default:"60s"`
+	DecisionTrigger    string   `yaml:"DecisionTrigger" default:"send_delay"`
+	QuietPeriod        Duration `yaml:"QuietPeriod" default:"500ms"`
+	RootLinger         Duration `yaml:"RootLinger" default:"100ms"`
 	DecisionTimeout    Duration `yaml:"DecisionTimeout" default:"3s"`
 	ReaperRunInterval  Duration `yaml:"ReaperRunInterval" default:"10s"`
 	ReaperBatchSize    int      `yaml:"ReaperBatchSize" default:"500"`
@@ -275,6 +419,12 @@ func (c CollectionConfig) GetIncomingQueueSize() int {
 	return c.IncomingQueueSize
 }
 
+// GetWorkers returns the number of workers that process incoming spans,
+// which is at least 1.
+func (c CollectionConfig) GetWorkers() int {
+	return max(c.Workers, 1)
+}
+
 func (c CollectionConfig) GetSenderBatchSize() int {
 	if c.SenderBatchSize == 0 {
 		return 50
@@ -305,13 +455,29 @@ type BufferSizeConfig struct {
 type SpecializedConfig struct {
 	EnvironmentCacheTTL       Duration          `yaml:"EnvironmentCacheTTL" default:"1h"`
 	CompressPeerCommunication *DefaultTrue      `yaml:"CompressPeerCommunication" default:"true"` // Avoid pointer woe on access, use GetCompressPeerCommunication() instead.
+	UpstreamCompression       string            `yaml:"UpstreamCompression" default:"zstd"`
+	SyntheticSpanIDs          string            `yaml:"SyntheticSpanIDs" default:"random"`
 	AdditionalAttributes      map[string]string `yaml:"AdditionalAttributes" default:"{}"`
 }
 
 type IDFieldsConfig struct {
-	TraceNames  []string `yaml:"TraceNames" default:"[\"trace.trace_id\",\"traceId\"]"`
-	ParentNames []string `yaml:"ParentNames" default:"[\"trace.parent_id\",\"parentId\"]"`
-	SpanNames   []string `yaml:"SpanNames" default:"[\"span.span_id\",\"spanId\"]"`
+	TraceNames      []string                `yaml:"TraceNames" default:"[\"trace.trace_id\",\"traceId\"]"`
+	ParentNames     []string                `yaml:"ParentNames" default:"[\"trace.parent_id\",\"parentId\"]"`
+	SpanNames       []string                `yaml:"SpanNames" default:"[\"trace.span_id\",\"spanId\"]"`
+	ChildCountNames []string                `yaml:"ChildCountNames" default:"[\"meta.child_count\"]"`
+	DatasetRules    map[string]IDFieldRules `yaml:"DatasetRules"`
+}
+
+// IDFieldRules describes how to find the trace and parent IDs of the events
+// in one dataset. Empty name lists fall back to the global ones. A transform
+// is a regular expression applied to the value of the field; its first
+// capture group (or the whole match, if it has none) becomes the ID, and a
+// field whose value doesn't match is skipped.
+type IDFieldRules struct {
+	TraceNames      []string `yaml:"TraceNames"`
+	ParentNames     []string `yaml:"ParentNames"`
+	TraceTransform  string   `yaml:"TraceTransform"`
+	ParentTransform string   `yaml:"ParentTransform"`
 }
 
 // GRPCServerParameters allow you to configure the GRPC ServerParameters used
@@ -327,21 +493,528 @@ type GRPCServerParameters struct {
 	KeepAliveTimeout      Duration     `yaml:"KeepAliveTimeout" default:"20s"`
 	MaxSendMsgSize        MemorySize   `yaml:"MaxSendMsgSize" default:"5MB"`
 	MaxRecvMsgSize        MemorySize   `yaml:"MaxRecvMsgSize" default:"5MB"`
+	MaxConcurrentStreams  uint32       `yaml:"MaxConcurrentStreams" default:"0"`
 }
 
 type SampleCacheConfig struct {
 	KeptSize          uint     `yaml:"KeptSize" default:"10_000"`
 	DroppedSize       uint     `yaml:"DroppedSize" default:"1_000_000"`
 	SizeCheckInterval Duration `yaml:"SizeCheckInterval" default:"10s"`
+	KeptTTL           Duration `yaml:"KeptTTL"`
+	DroppedTTL        Duration `yaml:"DroppedTTL"`
 }
 
 type StressReliefConfig struct {
-	Mode                      string   `yaml:"Mode" default:"never"`
-	ActivationLevel           uint     `yaml:"ActivationLevel" default:"90"`
-	DeactivationLevel         uint     `yaml:"DeactivationLevel" default:"75"`
-	SamplingRate              uint64   `yaml:"SamplingRate" default:"100"`
-	MinimumActivationDuration Duration `yaml:"MinimumActivationDuration" default:"10s"`
-	MinimumStartupDuration    Duration `yaml:"MinimumStartupDuration" default:"3s"`
+	Mode                      string             `yaml:"Mode" default:"never"`
+	ActivationLevel           uint               `yaml:"ActivationLevel" default:"90"`
+	DeactivationLevel         uint               `yaml:"DeactivationLevel" default:"75"`
+	SamplingRate              uint64             `yaml:"SamplingRate" default:"100"`
+	MinimumActivationDuration Duration           `yaml:"MinimumActivationDuration" default:"10s"`
+	MinimumStartupDuration    Duration           `yaml:"MinimumStartupDuration" default:"3s"`
+	ContributorWeights        map[string]float64 `yaml:"ContributorWeights"`
+	Degradation               string             `yaml:"Degradation" default:"deterministic"`
+	GraduatedSteps            int                `yaml:"GraduatedSteps" default:"4"`
+	MaxSamplingRate           uint64             `yaml:"MaxSamplingRate" default:"1000"`
+	ClusterPolicy             string             `yaml:"ClusterPolicy" default:"mean"`
+	ClusterPercentile         int                `yaml:"ClusterPercentile" default:"90"`
+}
+
+type DecisionExportConfig struct {
+	Type          string   `yaml:"Type" default:"none"`
+	QueueSize     int      `yaml:"QueueSize" default:"10_000"`
+	BatchSize     int      `yaml:"BatchSize" default:"500"`
+	BatchInterval Duration `yaml:"BatchInterval" default:"1s"`
+	RedisStream   string   `yaml:"RedisStream" default:"refinery-decisions"`
+	RedisMaxLen   int      `yaml:"RedisMaxLen" default:"100_000"`
+	WebhookURL    string   `yaml:"WebhookURL"`
+	KafkaRESTURL  string   `yaml:"KafkaRESTURL"`
+	KafkaTopic    string   `yaml:"KafkaTopic" default:"refinery-decisions"`
+}
+
+// DropAuditConfig controls the audit stream of periodic summaries of the
+// traces that were dropped.
+type DropAuditConfig struct {
+	Type               string     `yaml:"Type" default:"none"`
+	Interval           Duration   `yaml:"Interval" default:"60s"`
+	MaxExampleTraceIDs int        `yaml:"MaxExampleTraceIDs" default:"5"`
+	MaxRecords         int        `yaml:"MaxRecords" default:"100"`
+	MaxBytes           MemorySize `yaml:"MaxBytes" default:"1MiB"`
+	FilePath           string     `yaml:"FilePath"`
+	MaxFileSize        MemorySize `yaml:"MaxFileSize" default:"100MiB"`
+	KafkaRESTURL       string     `yaml:"KafkaRESTURL"`
+	KafkaTopic         string     `yaml:"KafkaTopic" default:"refinery-drop-audit"`
+	Dataset            string     `yaml:"Dataset" default:"Refinery Drop Audit"`
+	APIKey             string     `yaml:"APIKey" cmdenv:"HoneycombAPIKey"`
+}
+
+type TLSConfig struct {
+	CertFile           string            `yaml:"CertFile"`
+	KeyFile            string            `yaml:"KeyFile"`
+	ClientCAFile       string            `yaml:"ClientCAFile"`
+	ClientCertAPIKeys  map[string]string `yaml:"ClientCertAPIKeys" default:"{}"`
+	ClientCertDatasets map[string]string `yaml:"ClientCertDatasets" default:"{}"`
+}
+
+type XRayConfig struct {
+	Enabled       bool   `yaml:"Enabled"`
+	UDPListenAddr string `yaml:"UDPListenAddr" default:"0.0.0.0:2000"`
+	APIKey        string `yaml:"APIKey"`
+	Dataset       string `yaml:"Dataset"`
+}
+
+type DatadogConfig struct {
+	Enabled bool   `yaml:"Enabled"`
+	APIKey  string `yaml:"APIKey"`
+	Dataset string `yaml:"Dataset"`
+}
+
+type FederationConfig struct {
+	ClusterName string                      `yaml:"ClusterName"`
+	Clusters    map[string]FederatedCluster `yaml:"Clusters"`
+	Timeout     Duration                    `yaml:"Timeout" default:"5s"`
+}
+
+// HTTP2Config controls HTTP/2 on the main ingest listener.
+type HTTP2Config struct {
+	Enabled              bool       `yaml:"Enabled"`
+	AllowH2C             bool       `yaml:"AllowH2C"`
+	MaxConcurrentStreams uint32     `yaml:"MaxConcurrentStreams" default:"250"`
+	MaxReadFrameSize     MemorySize `yaml:"MaxReadFrameSize" default:"1MiB"`
+}
+
+// ProxyProtocolConfig controls which listeners accept PROXY protocol
+// headers, and from where.
+type ProxyProtocolConfig struct {
+	HTTP           bool     `yaml:"HTTP"`
+	GRPC           bool     `yaml:"GRPC"`
+	TrustedProxies []string `yaml:"TrustedProxies"`
+	HeaderTimeout  Duration `yaml:"HeaderTimeout" default:"5s"`
+}
+
+// The actions a redaction rule can take on a matching attribute.
+const (
+	RedactDrop     = "drop"
+	RedactHash     = "hash"
+	RedactTruncate = "truncate"
+)
+
+// RedactionConfig lists the attributes to remove or obscure at ingest, before
+// spans are buffered or forwarded anywhere.
+type RedactionConfig struct {
+	DatasetRules map[string][]RedactionRule `yaml:"DatasetRules"`
+	HashSalt     string                     `yaml:"HashSalt"`
+}
+
+// RedactionRule applies an action to the attributes whose names match any of
+// its patterns. Patterns use the syntax of path.Match, so "*.password" matches
+// "db.password" and "user.password".
+type RedactionRule struct {
+	Attributes []string `yaml:"Attributes"`
+	Action     string   `yaml:"Action"`
+	MaxLength  int      `yaml:"MaxLength"`
+}
+
+// RulesFor returns the redaction rules for a dataset: those listed under "*",
+// which apply to every dataset, followed by the dataset's own.
+func (r RedactionConfig) RulesFor(dataset string) []RedactionRule {
+	all, own := r.DatasetRules["*"], r.DatasetRules[dataset]
+	if dataset == "*" || len(own) == 0 {
+		return all
+	}
+	if len(all) == 0 {
+		return own
+	}
+	return append(append(make([]RedactionRule, 0, len(all)+len(own)), all...), own...)
+}
+
+// SamplingHintsConfig controls where Refinery looks for sampling hints from
+// upstream services, and the field it puts them in for rules to use.
+type SamplingHintsConfig struct {
+	Field         string   `yaml:"Field" default:"sampling.hint"`
+	TraceStateKey string   `yaml:"TraceStateKey"`
+	Attributes    []string `yaml:"Attributes"`
+}
+
+// ConsistentSamplingConfig controls whether sampling decisions follow the
+// OpenTelemetry consistent probability sampling spec.
+type ConsistentSamplingConfig struct {
+	Enabled bool `yaml:"Enabled"`
+}
+
+// TraceSpillConfig controls whether the spans of traces are written to disk
+// instead of being sent early when memory runs short.
+type TraceSpillConfig struct {
+	Enabled     bool       `yaml:"Enabled"`
+	Directory   string     `yaml:"Directory"`
+	MaxDiskSize MemorySize `yaml:"MaxDiskSize" default:"1GiB"`
+}
+
+// TraceLimitsConfig limits the number of spans and bytes that are held for
+// any one trace, and chooses what happens to a trace that reaches a limit.
+type TraceLimitsConfig struct {
+	MaxSpans int        `yaml:"MaxSpans"`
+	MaxBytes MemorySize `yaml:"MaxBytes"`
+	OnBreach string     `yaml:"OnBreach" default:"decide"`
+}
+
+// AdaptiveTimeoutConfig controls whether the timeout for traces without
+// a root span follows how long each dataset's traces take to complete.
+type AdaptiveTimeoutConfig struct {
+	Enabled    bool     `yaml:"Enabled"`
+	Percentile float64  `yaml:"Percentile" default:"99"`
+	Margin     Duration `yaml:"Margin" default:"5s"`
+	MinTimeout Duration `yaml:"MinTimeout" default:"5s"`
+	MaxTimeout Duration `yaml:"MaxTimeout" default:"5m"`
+	MinSamples int      `yaml:"MinSamples" default:"100"`
+}
+
+// MemoryBudgetConfig sets a single memory budget that is shared between the
+// trace cache, the decision cache, and the samplers' keys.
+type MemoryBudgetConfig struct {
+	Enabled            bool       `yaml:"Enabled"`
+	Total              MemorySize `yaml:"Total"`
+	TraceCacheShare    int        `yaml:"TraceCacheShare" default:"70"`
+	DecisionCacheShare int        `yaml:"DecisionCacheShare" default:"20"`
+	SamplerKeysShare   int        `yaml:"SamplerKeysShare" default:"10"`
+}
+
+// SpanDedupConfig controls the filter that drops exact duplicates of spans,
+// such as those sent again by a retried export.
+type SpanDedupConfig struct {
+	Enabled       bool     `yaml:"Enabled"`
+	FilterBits    int      `yaml:"FilterBits" default:"8192"`
+	IgnoredFields []string `yaml:"IgnoredFields"`
+}
+
+// SamplingGoalsConfig sets the sample rates that targets should achieve,
+// and whether the goals of their dynamic samplers are adjusted to achieve
+// them.
+type SamplingGoalsConfig struct {
+	Targets           map[string]int `yaml:"Targets"`
+	Window            Duration       `yaml:"Window" default:"5m"`
+	Tolerance         int            `yaml:"Tolerance" default:"10"`
+	AutoAdjust        bool           `yaml:"AutoAdjust"`
+	MinGoalSampleRate int            `yaml:"MinGoalSampleRate" default:"1"`
+	MaxGoalSampleRate int            `yaml:"MaxGoalSampleRate" default:"1000"`
+}
+
+// ProfilingConfig controls the automatic capture of CPU and heap profiles
+// while Refinery is under stress.
+type ProfilingConfig struct {
+	Enabled          bool     `yaml:"Enabled"`
+	Directory        string   `yaml:"Directory" default:"/tmp/refinery-profiles"`
+	MaxProfiles      int      `yaml:"MaxProfiles" default:"20"`
+	StressLevel      int      `yaml:"StressLevel" default:"80"`
+	LatencyThreshold Duration `yaml:"LatencyThreshold" default:"1s"`
+	CheckInterval    Duration `yaml:"CheckInterval" default:"5s"`
+	CPUDuration      Duration `yaml:"CPUDuration" default:"10s"`
+	Cooldown         Duration `yaml:"Cooldown" default:"5m"`
+}
+
+// HealthConfig controls how the health of Refinery's subsystems is reported.
+type HealthConfig struct {
+	ReadinessSubsystems []string `yaml:"ReadinessSubsystems"`
+}
+
+// UpstreamProbeConfig controls the background check that the upstream API
+// can be reached.
+type UpstreamProbeConfig struct {
+	Enabled          bool     `yaml:"Enabled"`
+	Interval         Duration `yaml:"Interval" default:"15s"`
+	Timeout          Duration `yaml:"Timeout" default:"5s"`
+	MaxBackoff       Duration `yaml:"MaxBackoff" default:"2m"`
+	FailureThreshold Duration `yaml:"FailureThreshold" default:"2m"`
+}
+
+// DrainConfig controls how a node is drained for maintenance.
+type DrainConfig struct {
+	Timeout         Duration `yaml:"Timeout" default:"5m"`
+	RetryAfter      Duration `yaml:"RetryAfter" default:"30s"`
+	ExitWhenDrained bool     `yaml:"ExitWhenDrained"`
+}
+
+// SupervisionConfig controls how Refinery's long-running goroutines are
+// restarted after a panic.
+type SupervisionConfig struct {
+	MaxRestarts    int      `yaml:"MaxRestarts" default:"5"`
+	RestartWindow  Duration `yaml:"RestartWindow" default:"10m"`
+	RestartBackoff Duration `yaml:"RestartBackoff" default:"1s"`
+}
+
+// UpstreamQueueConfig controls the disk queue that holds events that
+// couldn't be sent upstream until they can be sent again.
+type UpstreamQueueConfig struct {
+	Enabled       bool       `yaml:"Enabled"`
+	Directory     string     `yaml:"Directory"`
+	MaxSize       MemorySize `yaml:"MaxSize" default:"1GiB"`
+	RetryInterval Duration   `yaml:"RetryInterval" default:"10s"`
+}
+
+// KafkaOutputConfig controls whether kept events are also, or instead, sent
+// to Kafka.
+type KafkaOutputConfig struct {
+	Mode          string            `yaml:"Mode" default:"none"`
+	RESTURLs      []string          `yaml:"RESTURLs"`
+	Topic         string            `yaml:"Topic" default:"refinery-events"`
+	DatasetTopics map[string]string `yaml:"DatasetTopics" default:"{}"`
+	Encoding      string            `yaml:"Encoding" default:"json"`
+	BatchSize     int               `yaml:"BatchSize" default:"500"`
+	BatchTimeout  Duration          `yaml:"BatchTimeout" default:"1s"`
+	QueueSize     int               `yaml:"QueueSize" default:"10000"`
+}
+
+// OTLPUpstreamConfig controls whether kept spans are sent upstream as OTLP,
+// instead of to the Honeycomb events API.
+type OTLPUpstreamConfig struct {
+	Enabled      bool              `yaml:"Enabled"`
+	Endpoint     string            `yaml:"Endpoint"`
+	Protocol     string            `yaml:"Protocol" default:"grpc"`
+	Headers      map[string]string `yaml:"Headers" default:"{}"`
+	Compression  string            `yaml:"Compression" default:"gzip"`
+	Timeout      Duration          `yaml:"Timeout" default:"10s"`
+	BatchSize    int               `yaml:"BatchSize" default:"500"`
+	BatchTimeout Duration          `yaml:"BatchTimeout" default:"1s"`
+	QueueSize    int               `yaml:"QueueSize" default:"10000"`
+}
+
+// TopicFor returns the topic that a dataset's events are produced to.
+func (k KafkaOutputConfig) TopicFor(dataset string) string {
+	if topic, ok := k.DatasetTopics[dataset]; ok {
+		return topic
+	}
+	return k.Topic
+}
+
+// DestinationsConfig lists the extra upstream destinations that kept events
+// are copied to, as well as being sent upstream as usual.
+type DestinationsConfig struct {
+	Targets map[string]DestinationConfig `yaml:"Targets"`
+}
+
+// DestinationConfig is an extra upstream destination. Kept events that match
+// all of its conditions are copied to it, with their dataset and API key
+// replaced by the ones mapped to their dataset.
+type DestinationConfig struct {
+	APIHost    string                        `yaml:"APIHost"`
+	APIKey     string                        `yaml:"APIKey"`
+	APIKeys    map[string]string             `yaml:"APIKeys"`
+	Datasets   map[string]string             `yaml:"Datasets"`
+	Conditions []*RulesBasedSamplerCondition `yaml:"Conditions"`
+}
+
+// DatasetFor returns the dataset that a dataset's events are sent to at the
+// destination.
+func (d DestinationConfig) DatasetFor(dataset string) string {
+	if mapped, ok := d.Datasets[dataset]; ok {
+		return mapped
+	}
+	return dataset
+}
+
+// APIKeyFor returns the API key that a dataset's events are sent with at the
+// destination: the one mapped to the dataset, or else APIKey, or else the
+// key the event arrived with.
+func (d DestinationConfig) APIKeyFor(dataset string, apiKey string) string {
+	if mapped, ok := d.APIKeys[dataset]; ok {
+		return mapped
+	}
+	if d.APIKey != "" {
+		return d.APIKey
+	}
+	return apiKey
+}
+
+// AdaptiveBatchingConfig controls whether the size of the batches sent
+// upstream, and how many are sent at once, adapt to how quickly upstream
+// responds and whether it's throttling Refinery.
+type AdaptiveBatchingConfig struct {
+	Enabled        bool       `yaml:"Enabled"`
+	MinBatchSize   int        `yaml:"MinBatchSize" default:"50"`
+	MaxBatchBytes  MemorySize `yaml:"MaxBatchBytes" default:"5MB"`
+	TargetLatency  Duration   `yaml:"TargetLatency" default:"1s"`
+	MinConcurrency int        `yaml:"MinConcurrency" default:"1"`
+	MaxConcurrency int        `yaml:"MaxConcurrency" default:"80"`
+}
+
+// LateErrorRecoveryConfig controls whether error spans that arrive after
+// their trace was dropped are sent anyway.
+type LateErrorRecoveryConfig struct {
+	Enabled         bool     `yaml:"Enabled"`
+	BufferTime      Duration `yaml:"BufferTime" default:"60s"`
+	MaxTraces       int      `yaml:"MaxTraces" default:"10000"`
+	IncludeSiblings bool     `yaml:"IncludeSiblings"`
+	MaxSiblings     int      `yaml:"MaxSiblings" default:"100"`
+}
+
+// LateSpansConfig controls how spans that arrive after their trace was
+// decided are accounted for.
+type LateSpansConfig struct {
+	Annotate     bool   `yaml:"Annotate"`
+	ServiceField string `yaml:"ServiceField" default:"service.name"`
+}
+
+// CollectionOverridesConfig replaces collection settings for particular
+// targets, named as they are in the rules.
+type CollectionOverridesConfig struct {
+	Targets map[string]CollectionOverride `yaml:"Targets"`
+}
+
+// CollectionOverride holds the collection settings for one target. Settings
+// that aren't set use the global ones.
+type CollectionOverride struct {
+	TraceTimeout Duration   `yaml:"TraceTimeout"`
+	SendDelay    Duration   `yaml:"SendDelay"`
+	MaxSpans     int        `yaml:"MaxSpans"`
+	MaxBytes     MemorySize `yaml:"MaxBytes"`
+}
+
+// DecisionWarmupConfig controls loading recent trace decisions from the
+// central store when refinery starts.
+type DecisionWarmupConfig struct {
+	Enabled      bool     `yaml:"Enabled"`
+	MaxDecisions int      `yaml:"MaxDecisions" default:"100_000"`
+	Timeout      Duration `yaml:"Timeout" default:"10s"`
+}
+
+// StateCompactionConfig controls the background job that rewrites the
+// status of decided traces in Redis in a more compact form.
+type StateCompactionConfig struct {
+	Enabled   bool     `yaml:"Enabled"`
+	Interval  Duration `yaml:"Interval" default:"30s"`
+	BatchSize int      `yaml:"BatchSize" default:"1000"`
+	MinAge    Duration `yaml:"MinAge" default:"10s"`
+	MinFields int      `yaml:"MinFields" default:"8"`
+}
+
+// SpanSummaryConfig lists the targets whose spans are held in memory only as
+// summaries while their traces are decided.
+type SpanSummaryConfig struct {
+	Targets []string `yaml:"Targets"`
+	Fields  []string `yaml:"Fields"`
+}
+
+// SendPacingConfig controls how the sending of kept traces is spread out, so
+// that large batches of decided traces aren't flushed at the same moment as a
+// garbage collection.
+type SendPacingConfig struct {
+	Enabled       bool     `yaml:"Enabled"`
+	BatchSize     int      `yaml:"BatchSize" default:"100"`
+	HeapWatermark int      `yaml:"HeapWatermark" default:"90"`
+	MaxGCWait     Duration `yaml:"MaxGCWait" default:"50ms"`
+}
+
+// StateSnapshotConfig controls whether the traces still being collected when
+// refinery shuts down are written to disk and restored when it starts again.
+type StateSnapshotConfig struct {
+	Enabled bool     `yaml:"Enabled"`
+	Path    string   `yaml:"Path"`
+	MaxAge  Duration `yaml:"MaxAge" default:"2m"`
+}
+
+// ConfigDistributionConfig controls whether the configuration and rules are
+// distributed to the whole cluster through Redis, instead of each node using
+// its own files.
+type ConfigDistributionConfig struct {
+	Enabled      bool     `yaml:"Enabled"`
+	Publisher    bool     `yaml:"Publisher"`
+	PollInterval Duration `yaml:"PollInterval" default:"30s"`
+}
+
+// FeatureFlagsConfig defines the feature flags that new behaviors are gated
+// on, and whether each is enabled.
+type FeatureFlagsConfig struct {
+	Flags map[string]bool `yaml:"Flags" default:"{}"`
+}
+
+// Listener names one of the network listeners that can be configured on its
+// own.
+type Listener string
+
+const (
+	ListenerHTTP  Listener = "http"
+	ListenerGRPC  Listener = "grpc"
+	ListenerAdmin Listener = "admin"
+)
+
+// ListenerConfig controls one network listener: where it binds, the TLS
+// material it serves, its timeouts, and how many connections it accepts at
+// once. Zero values mean no limit.
+type ListenerConfig struct {
+	ListenAddr     string   `yaml:"ListenAddr"`
+	CertFile       string   `yaml:"CertFile"`
+	KeyFile        string   `yaml:"KeyFile"`
+	ClientCAFile   string   `yaml:"ClientCAFile"`
+	ReadTimeout    Duration `yaml:"ReadTimeout"`
+	WriteTimeout   Duration `yaml:"WriteTimeout"`
+	IdleTimeout    Duration `yaml:"IdleTimeout"`
+	MaxConnections int      `yaml:"MaxConnections"`
+}
+
+// TLSEnabled returns true if the listener should serve TLS.
+func (l ListenerConfig) TLSEnabled() bool {
+	return l.CertFile != "" && l.KeyFile != ""
+}
+
+// ingestListener fills in the settings an ingest listener doesn't set itself
+// from the older settings that apply to all of them, so that existing
+// configs keep working.
+func ingestListener(l ListenerConfig, listenAddr string, idleTimeout time.Duration, tls TLSConfig) ListenerConfig {
+	if l.ListenAddr == "" {
+		l.ListenAddr = listenAddr
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = Duration(idleTimeout)
+	}
+	if !l.TLSEnabled() {
+		l.CertFile, l.KeyFile = tls.CertFile, tls.KeyFile
+	}
+	if l.ClientCAFile == "" {
+		l.ClientCAFile = tls.ClientCAFile
+	}
+	return l
+}
+
+// MissingRootConfig controls what is done for kept traces whose root span
+// never arrived.
+type MissingRootConfig struct {
+	Annotate     bool   `yaml:"Annotate"`
+	Synthesize   bool   `yaml:"Synthesize"`
+	ServiceField string `yaml:"ServiceField" default:"service.name"`
+}
+
+// SpanReductionConfig controls how repetitive spans in kept traces are
+// thinned out before they're sent.
+type SpanReductionConfig struct {
+	Enabled        bool           `yaml:"Enabled"`
+	NameField      string         `yaml:"NameField" default:"name"`
+	DefaultCap     int            `yaml:"DefaultCap"`
+	Caps           map[string]int `yaml:"Caps"`
+	AddSummarySpan *DefaultTrue   `yaml:"AddSummarySpan" default:"true"` // Avoid pointer woe on access, use GetAddSummarySpan() instead.
+}
+
+// CapFor returns the most spans with the given name that may share a parent;
+// 0 means there is no limit.
+func (s SpanReductionConfig) CapFor(name string) int {
+	if limit, ok := s.Caps[name]; ok {
+		return limit
+	}
+	return s.DefaultCap
+}
+
+func (s SpanReductionConfig) GetAddSummarySpan() bool {
+	return s.AddSummarySpan.Get()
+}
+
+// FederatedCluster is another Refinery cluster whose status is included in
+// the federated cluster view.
+type FederatedCluster struct {
+	URL   string `yaml:"URL"`
+	Token string `yaml:"Token"`
+}
+
+// Enabled returns true if the ingest listeners should serve TLS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
 }
 
 type FileConfigError struct {
@@ -381,15 +1054,15 @@ func (e *FileConfigError) Error() string {
 // It's used by both the main init as well as the reload code.
 // In order to do proper validation, we actually read the file twice -- once into
 // a map, and once into the actual config object.
-func newFileConfig(opts *CmdEnv) (*fileConfig, error) {
+func newFileConfig(opts *CmdEnv, source *configSource) (*fileConfig, error) {
 	// If we're not validating, skip this part
 	if !opts.NoValidate {
-		cfgFails, err := validateConfig(opts)
+		cfgFails, err := validateConfig(opts, source)
 		if err != nil {
 			return nil, err
 		}
 
-		ruleFails, err := validateRules(opts.RulesLocation)
+		ruleFails, err := validateRules(opts.RulesLocation, source)
 		if err != nil {
 			return nil, err
 		}
@@ -406,23 +1079,41 @@ func newFileConfig(opts *CmdEnv) (*fileConfig, error) {
 
 	// Now load the files
 	mainconf := &configContents{}
-	mainhash, err := readConfigInto(mainconf, opts.ConfigLocation, opts)
+	mainhash, err := readConfigInto(mainconf, opts.ConfigLocation, opts, source)
 	if err != nil {
 		return nil, err
 	}
 
 	var rulesconf *V2SamplerConfig
-	ruleshash, err := readConfigInto(&rulesconf, opts.RulesLocation, nil)
+	ruleshash, err := readConfigInto(&rulesconf, opts.RulesLocation, nil, source)
 	if err != nil {
 		return nil, err
 	}
 
+	// value lists in files are loaded with the rules, so that rules never
+	// run without them
+	lists, listFails := loadValueLists(rulesconf)
+	if len(listFails) > 0 && !opts.NoValidate {
+		return nil, &FileConfigError{
+			ConfigLocation: opts.ConfigLocation,
+			RulesLocation:  opts.RulesLocation,
+			RulesFailures:  listFails,
+		}
+	}
+
 	cfg := &fileConfig{
 		mainConfig:  mainconf,
 		mainHash:    mainhash,
 		rulesConfig: rulesconf,
 		rulesHash:   ruleshash,
+		scoped:      rulesconf.ScopedAttributes(),
+		tenants:     rulesconf.indexTenants(),
+		valueLists:  lists,
 		opts:        opts,
+		source:      source,
+	}
+	if cfg.refs, err = cfg.configReferences(); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
@@ -435,7 +1126,46 @@ func writeYAMLToFile(data any, filename string) error {
 		return err
 	}
 	defer f.Close()
-	encoder := yaml.NewEncoder(f)
+	return writeYAML(f, data)
+}
+
+// writeConfigToFile writes the effective config to a YAML file.
+func (f *fileConfig) writeConfigToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return f.writeEffectiveConfig(file)
+}
+
+// writeEffectiveConfig writes the config as it's used, with every default
+// filled in, as YAML. Values that were resolved from references to
+// environment variables or files are written as the references.
+func (f *fileConfig) writeEffectiveConfig(w io.Writer) error {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return writeRedactedYAML(w, f.mainConfig, f.refs)
+}
+
+// configReferences returns the values of the config file that contain
+// references, by their paths, as they're written.
+func (f *fileConfig) configReferences() (map[string]string, error) {
+	r, format, err := f.source.open(f.opts.ConfigLocation)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return references(body, format)
+}
+
+func writeYAML(w io.Writer, data any) error {
+	encoder := yaml.NewEncoder(w)
 	encoder.SetIndent(2)
 	return encoder.Encode(data)
 }
@@ -445,7 +1175,11 @@ func writeYAMLToFile(data any, filename string) error {
 // It also dumps the config and rules to the given files, if specified, which
 // will cause the program to exit.
 func NewConfig(opts *CmdEnv, errorCallback func(error)) (Config, error) {
-	cfg, err := newFileConfig(opts)
+	source, err := newConfigSource(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newFileConfig(opts, source)
 	// only exit if we have no config at all; if it fails validation, we'll
 	// do the rest and return it anyway
 	if err != nil && cfg == nil {
@@ -453,7 +1187,7 @@ func NewConfig(opts *CmdEnv, errorCallback func(error)) (Config, error) {
 	}
 
 	if opts.WriteConfig != "" {
-		if err := writeYAMLToFile(cfg.mainConfig, opts.WriteConfig); err != nil {
+		if err := cfg.writeConfigToFile(opts.WriteConfig); err != nil {
 			fmt.Printf("Error writing config: %s\n", err)
 			os.Exit(1)
 		}
@@ -468,56 +1202,211 @@ func NewConfig(opts *CmdEnv, errorCallback func(error)) (Config, error) {
 		os.Exit(0)
 	}
 
+	applyValueLists(cfg.valueLists)
 	cfg.callbacks = make([]func(), 0)
 	cfg.errorCallback = errorCallback
+	cfg.generation = 1
+	cfg.lastLoadTime = time.Now()
+	cfg.recordVersion("startup", nil)
 
 	if cfg.mainConfig.General.ConfigReloadInterval > 0 {
-		go cfg.monitor()
+		// adjust the time by +/- 10% to avoid everyone reloading at the same time
+		interval := time.Duration(float64(cfg.mainConfig.General.ConfigReloadInterval) * (0.9 + 0.2*rand.Float64()))
+		done := make(chan struct{})
+		ticker := time.NewTicker(interval)
+		cfg.mux.Lock()
+		cfg.done = done
+		cfg.ticker = ticker
+		cfg.mux.Unlock()
+		go cfg.monitor(done, ticker)
 	}
 
 	return cfg, err
 }
 
-func (f *fileConfig) monitor() {
-	f.done = make(chan struct{})
-	// adjust the time by +/- 10% to avoid everyone reloading at the same time
-	reload := time.Duration(float64(f.mainConfig.General.ConfigReloadInterval) * (0.9 + 0.2*rand.Float64()))
-	f.ticker = time.NewTicker(time.Duration(reload))
+func (f *fileConfig) monitor(done chan struct{}, ticker *time.Ticker) {
 	for {
 		select {
-		case <-f.done:
+		case <-done:
 			return
-		case <-f.ticker.C:
-			// reread the configs
-			cfg, err := newFileConfig(f.opts)
-			if err != nil {
-				f.errorCallback(err)
-				continue
-			}
+		case <-ticker.C:
+			f.Reload("interval")
+		}
+	}
+}
 
-			// if nothing's changed, we're fine
-			if f.mainHash == cfg.mainHash && f.rulesHash == cfg.rulesHash {
-				continue
-			}
+// Reload rereads and validates the config and rules files. If they're valid
+// and either has changed, they replace the current configuration together,
+// under one lock, so that no reader sees the new config with the old rules;
+// then the generation is incremented and the callbacks are called. If they
+// aren't valid, the current configuration is kept and the error callback is
+// called.
+func (f *fileConfig) Reload(trigger string) ReloadResult {
+	f.reloadMux.Lock()
+	defer f.reloadMux.Unlock()
 
-			// otherwise, update our state and call the callbacks
-			f.mux.Lock()
-			f.mainConfig = cfg.mainConfig
-			f.mainHash = cfg.mainHash
-			f.rulesConfig = cfg.rulesConfig
-			f.rulesHash = cfg.rulesHash
-			f.mux.Unlock() // can't defer -- routine never ends, and callbacks will deadlock
-			for _, cb := range f.callbacks {
-				cb()
-			}
+	return f.reload(0, trigger)
+}
+
+// ApplyPublished pins the published documents in place of the local config
+// and rules files and reloads. If they aren't valid, the documents that were
+// in use before stay in use.
+func (f *fileConfig) ApplyPublished(published PublishedConfig) ReloadResult {
+	f.reloadMux.Lock()
+	defer f.reloadMux.Unlock()
+
+	if current := f.GetConfigEpoch(); published.Epoch <= current {
+		return ReloadResult{
+			Generation: f.GetGeneration(),
+			Epoch:      current,
+			Error:      fmt.Sprintf("epoch %d is not newer than the current epoch %d", published.Epoch, current),
+		}
+	}
+	previous := f.source.pin(map[string]*remoteDocument{
+		f.opts.ConfigLocation: {body: published.Config, format: published.ConfigFormat},
+		f.opts.RulesLocation:  {body: published.Rules, format: published.RulesFormat},
+	})
+	result := f.reload(published.Epoch, fmt.Sprintf("published epoch %d", published.Epoch))
+	if !result.Applied {
+		f.source.setPinned(previous)
+	}
+	return result
+}
+
+// ValidateDocuments validates a candidate config and rules, without applying
+// them, in the same way as they would be when loaded from files. Unknown keys
+// and values of the wrong type are failures.
+func ValidateDocuments(docs PublishedConfig) ValidationReport {
+	source, err := newConfigSource(nil)
+	if err != nil {
+		return ValidationReport{Error: err.Error()}
+	}
+	opts := &CmdEnv{ConfigLocation: "candidate-config", RulesLocation: "candidate-rules"}
+	source.pin(map[string]*remoteDocument{
+		opts.ConfigLocation: {body: docs.Config, format: docs.ConfigFormat},
+		opts.RulesLocation:  {body: docs.Rules, format: docs.RulesFormat},
+	})
+
+	cfg, err := newFileConfig(opts, source)
+	if err != nil {
+		report := ValidationReport{Error: err.Error()}
+		var fileErr *FileConfigError
+		if errors.As(err, &fileErr) {
+			report.Error = "validation failed"
+			report.ConfigFailures = fileErr.ConfigFailures
+			report.RulesFailures = fileErr.RulesFailures
+		}
+		return report
+	}
+
+	var effectiveConfig, effectiveRules strings.Builder
+	if err := cfg.writeEffectiveConfig(&effectiveConfig); err != nil {
+		return ValidationReport{Error: err.Error()}
+	}
+	if err := writeYAML(&effectiveRules, cfg.rulesConfig); err != nil {
+		return ValidationReport{Error: err.Error()}
+	}
+	return ValidationReport{
+		Valid:           true,
+		EffectiveConfig: effectiveConfig.String(),
+		EffectiveRules:  effectiveRules.String(),
+	}
+}
+
+// reload does the work of Reload; if epoch isn't 0, it becomes the current
+// epoch when the configuration is applied. It must be called with reloadMux
+// held.
+func (f *fileConfig) reload(epoch uint64, trigger string) ReloadResult {
+	cfg, err := newFileConfig(f.opts, f.source)
+	if err != nil {
+		result := ReloadResult{Generation: f.GetGeneration(), Epoch: f.GetConfigEpoch(), Error: err.Error()}
+		var fileErr *FileConfigError
+		if errors.As(err, &fileErr) {
+			result.Error = "validation failed"
+			result.ConfigFailures = fileErr.ConfigFailures
+			result.RulesFailures = fileErr.RulesFailures
+		}
+		if f.errorCallback != nil {
+			f.errorCallback(err)
+		}
+		return result
+	}
+
+	f.mux.Lock()
+	changed := f.mainHash != cfg.mainHash || f.rulesHash != cfg.rulesHash
+	var changes []ConfigChange
+	if epoch > 0 {
+		f.epoch = epoch
+	}
+	if changed {
+		changes = diffConfigs(f, cfg)
+		f.mainConfig = cfg.mainConfig
+		f.mainHash = cfg.mainHash
+		f.rulesConfig = cfg.rulesConfig
+		f.rulesHash = cfg.rulesHash
+		f.scoped = cfg.scoped
+		f.tenants = cfg.tenants
+		f.refs = cfg.refs
+		f.lastLoadTime = time.Now()
+		f.generation++
+		f.recordVersion(trigger, changes)
+	}
+	result := ReloadResult{
+		Applied:    true,
+		Changed:    changed,
+		Generation: f.generation,
+		Epoch:      f.epoch,
+		ConfigHash: f.mainHash,
+		RulesHash:  f.rulesHash,
+		Changes:    changes,
+	}
+	callbacks := f.callbacks
+	f.mux.Unlock() // can't defer -- callbacks read the config and would deadlock
+
+	// the lists were just read, so they're current even if the rules aren't
+	// new
+	applyValueLists(cfg.valueLists)
+	if changed {
+		for _, cb := range callbacks {
+			cb()
 		}
 	}
+	return result
+}
+
+func (f *fileConfig) GetGeneration() uint64 {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.generation
+}
+
+func (f *fileConfig) GetConfigEpoch() uint64 {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.epoch
+}
+
+func (f *fileConfig) GetConfigHistory() []ConfigVersion {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	history := make([]ConfigVersion, len(f.history))
+	for i, v := range f.history {
+		history[len(f.history)-1-i] = v
+	}
+	return history
 }
 
 // Stop halts the monitor goroutine
 func (f *fileConfig) Stop() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
 	if f.ticker != nil {
 		f.ticker.Stop()
+		f.ticker = nil
 	}
 	if f.done != nil {
 		close(f.done)
@@ -557,6 +1446,62 @@ func (f *fileConfig) GetHTTPIdleTimeout() time.Duration {
 	return time.Duration(f.mainConfig.Network.HTTPIdleTimeout)
 }
 
+func (f *fileConfig) GetHTTPMaxConcurrentRequests() int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Network.MaxConcurrentRequests
+}
+
+func (f *fileConfig) GetMaxIngestPause() time.Duration {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return time.Duration(f.mainConfig.Network.MaxIngestPause)
+}
+
+func (f *fileConfig) GetOTLPStreamingThreshold() MemorySize {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Network.OTLPStreamingThreshold
+}
+
+func (f *fileConfig) GetOTLPStreamingBackpressureTimeout() time.Duration {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return time.Duration(f.mainConfig.Network.OTLPStreamingBackpressureTimeout)
+}
+
+func (f *fileConfig) GetOTLPRejectedSpans() string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Network.OTLPRejectedSpans
+}
+
+func (f *fileConfig) GetAdmissionQueueThreshold() int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Network.AdmissionQueueThreshold
+}
+
+func (f *fileConfig) GetAdmissionMemoryThreshold() int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Network.AdmissionMemoryThreshold
+}
+
+func (f *fileConfig) GetAdmissionRetryAfter() time.Duration {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return time.Duration(f.mainConfig.Network.AdmissionRetryAfter)
+}
+
 func (f *fileConfig) GetCompressPeerCommunication() bool {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -564,6 +1509,20 @@ func (f *fileConfig) GetCompressPeerCommunication() bool {
 	return f.mainConfig.Specialized.CompressPeerCommunication.Get()
 }
 
+func (f *fileConfig) GetUpstreamCompression() string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Specialized.UpstreamCompression
+}
+
+func (f *fileConfig) GetSyntheticSpanIDs() string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Specialized.SyntheticSpanIDs
+}
+
 func (f *fileConfig) GetGRPCEnabled() bool {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -589,18 +1548,30 @@ func (f *fileConfig) IsAPIKeyValid(key string) bool {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
 
-	if !f.mainConfig.AccessKeys.AcceptOnlyListedKeys {
-		return true
-	}
-
-	// if we haven't built the keymap yet, do it now
+	// if we haven't built the keymaps yet, do it now
 	if f.mainConfig.AccessKeys.keymap == nil {
 		f.mainConfig.AccessKeys.keymap = generics.NewSet(f.mainConfig.AccessKeys.ReceiveKeys...)
+		f.mainConfig.AccessKeys.denymap = generics.NewSet(f.mainConfig.AccessKeys.DeniedKeys...)
+	}
+
+	if f.mainConfig.AccessKeys.denymap.Contains(key) {
+		return false
+	}
+
+	if !f.mainConfig.AccessKeys.AcceptOnlyListedKeys {
+		return true
 	}
 
 	return f.mainConfig.AccessKeys.keymap.Contains(key)
 }
 
+func (f *fileConfig) GetAccessKeyConfig() AccessKeyConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.AccessKeys
+}
+
 func (f *fileConfig) GetPeerManagementType() string {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -615,6 +1586,13 @@ func (f *fileConfig) GetPeers() []string {
 	return f.mainConfig.PeerManagement.Peers
 }
 
+func (f *fileConfig) GetRedisSettings() RedisSettings {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.RedisPeerManagement.redisSettings()
+}
+
 func (f *fileConfig) GetRedisHost() string {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -713,6 +1691,13 @@ func (f *fileConfig) GetRedisMaxActive() int {
 	return f.mainConfig.RedisPeerManagement.MaxActive
 }
 
+func (f *fileConfig) GetRedisDrainTimeout() time.Duration {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return time.Duration(f.mainConfig.RedisPeerManagement.DrainTimeout)
+}
+
 func (f *fileConfig) GetRedisMaxIdle() int {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -734,6 +1719,13 @@ func (f *fileConfig) GetLoggerLevel() Level {
 	return f.mainConfig.Logger.Level
 }
 
+func (f *fileConfig) GetLoggerSubsystemLevels() map[string]Level {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Logger.Subsystems
+}
+
 func (f *fileConfig) GetLoggerType() string {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -755,6 +1747,13 @@ func (f *fileConfig) GetStdoutLoggerConfig() StdoutLoggerConfig {
 	return f.mainConfig.StdoutLogger
 }
 
+func (f *fileConfig) GetJSONLoggerConfig() JSONLoggerConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.JSONLogger
+}
+
 func (f *fileConfig) GetAllSamplerRules() *V2SamplerConfig {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -763,6 +1762,13 @@ func (f *fileConfig) GetAllSamplerRules() *V2SamplerConfig {
 	return f.rulesConfig
 }
 
+func (f *fileConfig) GetScopedAttributes() map[string][]string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.scoped
+}
+
 // GetSamplerConfigForDestName returns the sampler config for the given
 // destination (environment, or dataset in classic mode), as well as the name of
 // the sampler type. If the specific destination is not found, it returns the
@@ -771,15 +1777,10 @@ func (f *fileConfig) GetSamplerConfigForDestName(destname string) (any, string,
 	f.mux.RLock()
 	defer f.mux.RUnlock()
 
-	nameToUse := "__default__"
-	if _, ok := f.rulesConfig.Samplers[destname]; ok {
-		nameToUse = destname
-	}
-
 	err := errors.New("no sampler found and no default configured")
 	name := "not found"
 	var cfg any
-	if sampler, ok := f.rulesConfig.Samplers[nameToUse]; ok {
+	if sampler, _ := f.rulesConfig.SamplerFor(destname); sampler != nil {
 		cfg, name = sampler.Sampler()
 		if cfg != nil {
 			err = nil
@@ -788,6 +1789,26 @@ func (f *fileConfig) GetSamplerConfigForDestName(destname string) (any, string,
 	return cfg, name, err
 }
 
+func (f *fileConfig) GetTenantForAPIKey(apiKey string) string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	if apiKey == "" {
+		return ""
+	}
+	return f.tenants.byAPIKey[apiKey]
+}
+
+func (f *fileConfig) GetTenantForTeam(team string) string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	if team == "" {
+		return ""
+	}
+	return f.tenants.byTeam[team]
+}
+
 func (f *fileConfig) GetCollectionConfig() CollectionConfig {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -816,6 +1837,13 @@ func (f *fileConfig) GetOTelMetricsConfig() OTelMetricsConfig {
 	return f.mainConfig.OTelMetrics
 }
 
+func (f *fileConfig) GetMetricLabelsConfig() MetricLabelsConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.MetricLabels
+}
+
 func (f *fileConfig) GetOTelTracingConfig() OTelTracingConfig {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -900,6 +1928,13 @@ func (f *fileConfig) GetAddRuleReasonToTrace() bool {
 	return f.mainConfig.Telemetry.AddRuleReasonToTrace
 }
 
+func (f *fileConfig) GetAddDecisionToSpans() bool {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Telemetry.AddDecisionToSpans
+}
+
 func (f *fileConfig) GetEnvironmentCacheTTL() time.Duration {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -914,6 +1949,13 @@ func (f *fileConfig) GetDatasetPrefix() string {
 	return f.mainConfig.General.DatasetPrefix
 }
 
+func (f *fileConfig) GetValueListRefreshInterval() time.Duration {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return time.Duration(f.mainConfig.General.ValueListRefreshInterval)
+}
+
 func (f *fileConfig) GetQueryAuthToken() string {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -928,6 +1970,13 @@ func (f *fileConfig) GetPeerTimeout() time.Duration {
 	return time.Duration(f.mainConfig.RedisPeerManagement.Timeout)
 }
 
+func (f *fileConfig) GetSamplerKeyReportInterval() time.Duration {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return time.Duration(f.mainConfig.Debugging.SamplerKeyReportInterval)
+}
+
 func (f *fileConfig) GetAdditionalErrorFields() []string {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -949,6 +1998,13 @@ func (f *fileConfig) GetAddCountsToRoot() bool {
 	return f.mainConfig.Telemetry.AddCountsToRoot
 }
 
+func (f *fileConfig) GetReparentOrphanSpans() bool {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Telemetry.ReparentOrphanSpans
+}
+
 func (f *fileConfig) GetSampleCacheConfig() SampleCacheConfig {
 	f.mux.RLock()
 	defer f.mux.RUnlock()
@@ -977,6 +2033,34 @@ func (f *fileConfig) GetParentIdFieldNames() []string {
 	return f.mainConfig.IDFieldNames.ParentNames
 }
 
+func (f *fileConfig) GetIDFieldRules(dataset string) IDFieldRules {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	rules := f.mainConfig.IDFieldNames.DatasetRules[dataset]
+	if len(rules.TraceNames) == 0 {
+		rules.TraceNames = f.mainConfig.IDFieldNames.TraceNames
+	}
+	if len(rules.ParentNames) == 0 {
+		rules.ParentNames = f.mainConfig.IDFieldNames.ParentNames
+	}
+	return rules
+}
+
+func (f *fileConfig) GetSpanIdFieldNames() []string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.IDFieldNames.SpanNames
+}
+
+func (f *fileConfig) GetChildCountFieldNames() []string {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.IDFieldNames.ChildCountNames
+}
+
 func (f *fileConfig) GetConfigMetadata() []ConfigMetadata {
 	ret := make([]ConfigMetadata, 2)
 	ret[0] = ConfigMetadata{
@@ -1007,3 +2091,298 @@ func (f *fileConfig) GetCentralStoreOptions() SmartWrapperOptions {
 
 	return f.mainConfig.CentralStore
 }
+
+func (f *fileConfig) GetDecisionExportConfig() DecisionExportConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.DecisionExport
+}
+
+func (f *fileConfig) GetDropAuditConfig() DropAuditConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.DropAudit
+}
+
+func (f *fileConfig) GetTLSConfig() TLSConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.TLS
+}
+
+func (f *fileConfig) GetListenerConfig(listener Listener) ListenerConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	switch listener {
+	case ListenerHTTP:
+		return ingestListener(f.mainConfig.HTTPListener, f.mainConfig.Network.ListenAddr, time.Duration(f.mainConfig.Network.HTTPIdleTimeout), f.mainConfig.TLS)
+	case ListenerGRPC:
+		return ingestListener(f.mainConfig.GRPCListener, f.mainConfig.GRPCServerParameters.ListenAddr, time.Duration(f.mainConfig.GRPCServerParameters.MaxConnectionIdle), f.mainConfig.TLS)
+	case ListenerAdmin:
+		return f.mainConfig.AdminListener
+	}
+	return ListenerConfig{}
+}
+
+func (f *fileConfig) GetXRayConfig() XRayConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.XRay
+}
+
+func (f *fileConfig) GetDatadogConfig() DatadogConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Datadog
+}
+
+func (f *fileConfig) GetSamplingHintsConfig() SamplingHintsConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.SamplingHints
+}
+
+func (f *fileConfig) GetRedactionConfig() RedactionConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Redaction
+}
+
+func (f *fileConfig) GetHTTP2Config() HTTP2Config {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.HTTP2
+}
+
+func (f *fileConfig) GetProxyProtocolConfig() ProxyProtocolConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.ProxyProtocol
+}
+
+func (f *fileConfig) GetSpanReductionConfig() SpanReductionConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.SpanReduction
+}
+
+func (f *fileConfig) GetTraceSpillConfig() TraceSpillConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.TraceSpill
+}
+
+func (f *fileConfig) GetTraceLimitsConfig() TraceLimitsConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.TraceLimits
+}
+
+func (f *fileConfig) GetAdaptiveTraceTimeoutConfig() AdaptiveTimeoutConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.AdaptiveTraceTimeout
+}
+
+func (f *fileConfig) GetLateSpansConfig() LateSpansConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.LateSpans
+}
+
+func (f *fileConfig) GetMemoryBudgetConfig() MemoryBudgetConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.MemoryBudget
+}
+
+func (f *fileConfig) GetSpanDedupConfig() SpanDedupConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.SpanDedup
+}
+
+func (f *fileConfig) GetMissingRootConfig() MissingRootConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.MissingRoot
+}
+
+func (f *fileConfig) GetCollectionOverride(target string) CollectionOverride {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.CollectionOverrides.Targets[target]
+}
+
+func (f *fileConfig) GetCollectionOverrides() map[string]CollectionOverride {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return maps.Clone(f.mainConfig.CollectionOverrides.Targets)
+}
+
+func (f *fileConfig) GetDecisionWarmupConfig() DecisionWarmupConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.DecisionWarmup
+}
+
+func (f *fileConfig) GetStateCompactionConfig() StateCompactionConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.StateCompaction
+}
+
+func (f *fileConfig) GetSpanSummaryConfig() SpanSummaryConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.SpanSummaries
+}
+
+func (f *fileConfig) GetSendPacingConfig() SendPacingConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.SendPacing
+}
+
+func (f *fileConfig) GetStateSnapshotConfig() StateSnapshotConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.StateSnapshot
+}
+
+func (f *fileConfig) GetFeatureFlags() map[string]bool {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.FeatureFlags.Flags
+}
+
+func (f *fileConfig) GetConfigDistributionConfig() ConfigDistributionConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.ConfigDistribution
+}
+
+func (f *fileConfig) GetConsistentSamplingConfig() ConsistentSamplingConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.ConsistentSampling
+}
+
+func (f *fileConfig) GetSamplingGoalsConfig() SamplingGoalsConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.SamplingGoals
+}
+
+func (f *fileConfig) GetProfilingConfig() ProfilingConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Profiling
+}
+
+func (f *fileConfig) GetHealthConfig() HealthConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Health
+}
+
+func (f *fileConfig) GetUpstreamProbeConfig() UpstreamProbeConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.UpstreamProbe
+}
+
+func (f *fileConfig) GetDrainConfig() DrainConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Drain
+}
+
+func (f *fileConfig) GetSupervisionConfig() SupervisionConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Supervision
+}
+
+func (f *fileConfig) GetUpstreamQueueConfig() UpstreamQueueConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.UpstreamQueue
+}
+
+func (f *fileConfig) GetKafkaOutputConfig() KafkaOutputConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.KafkaOutput
+}
+
+func (f *fileConfig) GetOTLPUpstreamConfig() OTLPUpstreamConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.OTLPUpstream
+}
+
+func (f *fileConfig) GetDestinationsConfig() DestinationsConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Destinations
+}
+
+func (f *fileConfig) GetAdaptiveBatchingConfig() AdaptiveBatchingConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.AdaptiveBatching
+}
+
+func (f *fileConfig) GetLateErrorRecoveryConfig() LateErrorRecoveryConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.LateErrorRecovery
+}
+
+func (f *fileConfig) GetFederationConfig() FederationConfig {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	return f.mainConfig.Federation
+}
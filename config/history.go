@@ -0,0 +1,98 @@
+package config
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretFieldPattern matches the names of config fields whose values are
+// secrets, and so are never recorded in the history.
+var secretFieldPattern = regexp.MustCompile(`(?i)(apikeys?|password|authcode|authtoken|salt|receivekeys|deniedkeys|sendkey)$`)
+
+// recordVersion adds the current version to the history, dropping the oldest
+// versions beyond the configured size. It must be called with mux held, or
+// before the config is shared.
+func (f *fileConfig) recordVersion(trigger string, changes []ConfigChange) {
+	f.history = append(f.history, ConfigVersion{
+		Generation: f.generation,
+		Epoch:      f.epoch,
+		LoadedAt:   f.lastLoadTime,
+		Trigger:    trigger,
+		ConfigHash: f.mainHash,
+		RulesHash:  f.rulesHash,
+		Changes:    changes,
+	})
+	size := f.mainConfig.General.ConfigHistorySize
+	if size < 1 {
+		size = 1
+	}
+	if len(f.history) > size {
+		f.history = append([]ConfigVersion(nil), f.history[len(f.history)-size:]...)
+	}
+}
+
+// diffConfigs returns every value that differs between two versions of the
+// configuration and rules, sorted by path.
+func diffConfigs(before, after *fileConfig) []ConfigChange {
+	changes := diffDocument("config", before.mainConfig, after.mainConfig, func(path string) bool {
+		_, beforeRef := before.refs[path]
+		_, afterRef := after.refs[path]
+		return beforeRef || afterRef || isSecretPath(path)
+	})
+	return append(changes, diffDocument("rules", before.rulesConfig, after.rulesConfig, isSecretPath)...)
+}
+
+// isSecretPath returns true if the field at a path holds a secret.
+func isSecretPath(path string) bool {
+	name := path[strings.LastIndex(path, ".")+1:]
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+	return secretFieldPattern.MatchString(name)
+}
+
+func diffDocument(document string, before, after any, secret func(path string) bool) []ConfigChange {
+	oldValues, newValues := flattenValues(before), flattenValues(after)
+	var changes []ConfigChange
+	add := func(path, change, oldValue, newValue string) {
+		c := ConfigChange{Document: document, Path: path, Change: change, Old: oldValue, New: newValue}
+		if secret(path) {
+			c.Old, c.New, c.Redacted = "", "", true
+		}
+		changes = append(changes, c)
+	}
+	for path, oldValue := range oldValues {
+		newValue, ok := newValues[path]
+		switch {
+		case !ok:
+			add(path, "removed", oldValue, "")
+		case newValue != oldValue:
+			add(path, "changed", oldValue, newValue)
+		}
+	}
+	for path, newValue := range newValues {
+		if _, ok := oldValues[path]; !ok {
+			add(path, "added", "", newValue)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// flattenValues returns every scalar value within data, as it would be
+// written in YAML, by its dotted path.
+func flattenValues(data any) map[string]string {
+	values := make(map[string]string)
+	var root yaml.Node
+	if err := root.Encode(data); err != nil {
+		return values
+	}
+	walkScalars(&root, "", func(path string, node *yaml.Node) error {
+		values[path] = node.Value
+		return nil
+	})
+	return values
+}
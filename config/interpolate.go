@@ -0,0 +1,201 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// referencePattern matches a reference to an environment variable or a file
+// within a config value, such as ${env:REDIS_PASSWORD} or
+// ${file:/run/secrets/api-key}, and the escape $${ for a literal ${.
+var referencePattern = regexp.MustCompile(`\$\$\{|\$\{(env|file):([^}]+)\}`)
+
+// openConfig opens the main config document with the references in its
+// values resolved, so that secrets don't have to be written into it. The
+// references are resolved every time it's opened, so a reload picks up a
+// changed variable or file.
+func openConfig(source *configSource, location string) (io.ReadCloser, Format, error) {
+	r, format, err := source.open(location)
+	if err != nil {
+		return nil, format, err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, format, err
+	}
+	body, format, err = interpolate(body, format)
+	if err != nil {
+		return nil, format, fmt.Errorf("unable to resolve references in config %s: %w", location, err)
+	}
+	return io.NopCloser(bytes.NewReader(body)), format, nil
+}
+
+// interpolate resolves the references in every value of a document. A
+// document with references is rewritten as YAML. A resolved value has the
+// type it would have had if it were written in place of the reference, so
+// an unquoted reference can be a number or a bool, and a quoted one is
+// always a string.
+func interpolate(body []byte, format Format) ([]byte, Format, error) {
+	if !bytes.Contains(body, []byte("${")) {
+		return body, format, nil
+	}
+	root, err := yamlTree(body, format)
+	if err != nil {
+		return nil, format, err
+	}
+	if err := walkScalars(root, "", func(_ string, node *yaml.Node) error {
+		value, err := resolveReferences(node.Value)
+		if err != nil || value == node.Value {
+			return err
+		}
+		node.Value = value
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// let the value decide its own type, as it would in place
+			node.Tag = ""
+		}
+		return nil
+	}); err != nil {
+		return nil, format, err
+	}
+	out, err := yaml.Marshal(root)
+	if err != nil {
+		return nil, format, err
+	}
+	return out, FormatYAML, nil
+}
+
+// yamlTree parses a document of any format into a YAML node tree. JSON is
+// also YAML; TOML is converted, and since its strings are always quoted,
+// they stay strings.
+func yamlTree(body []byte, format Format) (*yaml.Node, error) {
+	if format == FormatTOML {
+		var data map[string]any
+		if err := toml.Unmarshal(body, &data); err != nil {
+			return nil, err
+		}
+		var err error
+		if body, err = yaml.Marshal(data); err != nil {
+			return nil, err
+		}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// resolveReferences returns a value with each of its references replaced.
+// It's an error to refer to an environment variable that isn't set or a file
+// that can't be read.
+func resolveReferences(value string) (string, error) {
+	var errs []string
+	resolved := referencePattern.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := referencePattern.FindStringSubmatch(ref)
+		switch m[1] {
+		case "env":
+			v, ok := os.LookupEnv(m[2])
+			if !ok {
+				errs = append(errs, fmt.Sprintf("environment variable %s is not set", m[2]))
+			}
+			return v
+		default:
+			b, err := os.ReadFile(m[2])
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			// files written by editors and secret managers often end with a
+			// newline that isn't part of the secret
+			return strings.TrimRight(string(b), "\r\n")
+		}
+	})
+	if len(errs) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return resolved, nil
+}
+
+// walkScalars calls fn with every scalar value in a YAML document, and its
+// dotted path of keys.
+func walkScalars(node *yaml.Node, path string, fn func(path string, node *yaml.Node) error) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml.SequenceNode {
+				childPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+			if err := walkScalars(child, childPath, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			if err := walkScalars(node.Content[i+1], childPath, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return fn(path, node)
+	}
+	return nil
+}
+
+// references returns the values of a document that contain references, by
+// their paths, as they're written.
+func references(body []byte, format Format) (map[string]string, error) {
+	refs := make(map[string]string)
+	if !bytes.Contains(body, []byte("${")) {
+		return refs, nil
+	}
+	root, err := yamlTree(body, format)
+	if err != nil {
+		return nil, err
+	}
+	err = walkScalars(root, "", func(path string, node *yaml.Node) error {
+		for _, m := range referencePattern.FindAllStringSubmatch(node.Value, -1) {
+			if m[1] != "" {
+				refs[path] = node.Value
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// writeRedactedYAML writes data as YAML, with each value that was resolved
+// from a reference written as the reference instead, so that secrets don't
+// appear in dumps of the config.
+func writeRedactedYAML(w io.Writer, data any, refs map[string]string) error {
+	if len(refs) == 0 {
+		return writeYAML(w, data)
+	}
+	var root yaml.Node
+	if err := root.Encode(data); err != nil {
+		return err
+	}
+	walkScalars(&root, "", func(path string, node *yaml.Node) error {
+		if ref, ok := refs[path]; ok {
+			node.Value = ref
+			node.Tag = "!!str"
+			node.Style = yaml.DoubleQuotedStyle
+		}
+		return nil
+	})
+	return writeYAML(w, &root)
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("TEST_REDIS_PASSWORD", "p@ss: #word")
+	t.Setenv("TEST_REDIS_DATABASE", "3")
+	secret := filepath.Join(t.TempDir(), "username")
+	require.NoError(t, os.WriteFile(secret, []byte("refinery\n"), 0o600))
+
+	cm := strings.Join([]string{
+		"General:",
+		"  ConfigurationVersion: 2",
+		"  ConfigReloadInterval: 0s",
+		"RedisPeerManagement:",
+		"  Host: redis-${env:TEST_REDIS_DATABASE}:6379",
+		"  Username: ${file:" + secret + "}",
+		"  Password: \"${env:TEST_REDIS_PASSWORD}\"",
+		"  AuthCode: \"$${literal}\"",
+		"  Database: ${env:TEST_REDIS_DATABASE}",
+		"",
+	}, "\n")
+	rm := makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1)
+	config, rules := createTempConfigs(t, cm, rm)
+	defer os.Remove(rules)
+	defer os.Remove(config)
+
+	c, err := getConfig([]string{"--config", config, "--rules_config", rules})
+	require.NoError(t, err)
+	assert.Equal(t, "redis-3:6379", c.GetRedisHost())
+	assert.Equal(t, "refinery", c.GetRedisUsername())
+	assert.Equal(t, "p@ss: #word", c.GetRedisPassword())
+	assert.Equal(t, "${literal}", c.GetRedisAuthCode())
+	assert.Equal(t, 3, c.GetRedisDatabase())
+
+	// references are resolved again on reload
+	t.Setenv("TEST_REDIS_PASSWORD", "rotated")
+	result := c.Reload("test")
+	assert.True(t, result.Changed)
+	assert.Equal(t, "rotated", c.GetRedisPassword())
+
+	// dumps of the config have the references, not the secrets
+	var dump strings.Builder
+	require.NoError(t, c.(*fileConfig).writeEffectiveConfig(&dump))
+	assert.Contains(t, dump.String(), `Password: "${env:TEST_REDIS_PASSWORD}"`)
+	assert.Contains(t, dump.String(), `Username: "${file:`+secret+`}"`)
+	assert.NotContains(t, dump.String(), "rotated")
+	assert.NotContains(t, dump.String(), "Username: refinery")
+	assert.Contains(t, dump.String(), "ListenAddr: 0.0.0.0:8080")
+
+	// a reference to a variable that isn't set fails, and the config in use
+	// stays in place
+	require.NoError(t, os.Unsetenv("TEST_REDIS_PASSWORD"))
+	result = c.Reload("test")
+	assert.False(t, result.Applied)
+	assert.Contains(t, result.Error, "TEST_REDIS_PASSWORD is not set")
+	assert.Equal(t, "rotated", c.GetRedisPassword())
+}
+
+func TestInterpolateFormats(t *testing.T) {
+	t.Setenv("TEST_LISTEN_ADDR", "0.0.0.0:9000")
+
+	body, format, err := interpolate([]byte(`{"Network": {"ListenAddr": "${env:TEST_LISTEN_ADDR}"}}`), FormatJSON)
+	require.NoError(t, err)
+	assert.Equal(t, FormatYAML, format)
+	assert.Contains(t, string(body), "0.0.0.0:9000")
+
+	body, format, err = interpolate([]byte("[Network]\nListenAddr = \"${env:TEST_LISTEN_ADDR}\"\n"), FormatTOML)
+	require.NoError(t, err)
+	assert.Equal(t, FormatYAML, format)
+	assert.Contains(t, string(body), "0.0.0.0:9000")
+
+	// documents without references are left alone
+	body, format, err = interpolate([]byte("Network:\n  ListenAddr: 0.0.0.0:8080\n"), FormatYAML)
+	require.NoError(t, err)
+	assert.Equal(t, FormatYAML, format)
+	assert.Equal(t, "Network:\n  ListenAddr: 0.0.0.0:8080\n", string(body))
+
+	_, _, err = interpolate([]byte("Network:\n  ListenAddr: ${file:/does/not/exist}\n"), FormatYAML)
+	assert.Error(t, err)
+}
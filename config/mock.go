@@ -1,6 +1,7 @@
 package config
 
 import (
+	"maps"
 	"sync"
 	"time"
 )
@@ -10,13 +11,24 @@ import (
 type MockConfig struct {
 	Callbacks                        []func()
 	IsAPIKeyValidFunc                func(string) bool
+	AccessKeys                       AccessKeyConfig
 	GetCollectorTypeVal              string
 	GetCollectionConfigVal           CollectionConfig
 	GetHoneycombAPIVal               string
 	GetListenAddrVal                 string
 	GetPeerListenAddrVal             string
 	GetHTTPIdleTimeoutVal            time.Duration
+	HTTPMaxConcurrentRequests        int
+	MaxIngestPause                   time.Duration
+	OTLPStreamingThreshold           MemorySize
+	OTLPStreamingBackpressureTimeout time.Duration
+	OTLPRejectedSpans                string
+	AdmissionQueueThreshold          int
+	AdmissionMemoryThreshold         int
+	AdmissionRetryAfter              time.Duration
 	GetCompressPeerCommunicationsVal bool
+	GetUpstreamCompressionVal        string
+	GetSyntheticSpanIDsVal           string
 	GetGRPCEnabledVal                bool
 	GetGRPCListenAddrVal             string
 	GetGRPCServerParameters          GRPCServerParameters
@@ -24,7 +36,10 @@ type MockConfig struct {
 	GetHoneycombLoggerConfigVal      HoneycombLoggerConfig
 	GetStdoutLoggerConfigVal         StdoutLoggerConfig
 	GetLoggerLevelVal                Level
+	GetLoggerSubsystemLevelsVal      map[string]Level
+	GetJSONLoggerConfigVal           JSONLoggerConfig
 	GetPeersVal                      []string
+	GetRedisSettingsVal              *RedisSettings
 	GetRedisHostVal                  string
 	GetRedisUsernameVal              string
 	GetRedisPasswordVal              string
@@ -32,6 +47,7 @@ type MockConfig struct {
 	GetRedisDatabaseVal              int
 	GetRedisPrefixVal                string
 	GetRedisMaxActiveVal             int
+	GetRedisDrainTimeoutVal          time.Duration
 	GetRedisMaxIdleVal               int
 	GetRedisTimeoutVal               time.Duration
 	GetParallelismVal                int
@@ -41,10 +57,13 @@ type MockConfig struct {
 	GetSamplerTypeErr                error //keep
 	GetSamplerTypeName               string
 	GetSamplerTypeVal                interface{}
+	TenantAPIKeys                    map[string]string
+	TenantTeams                      map[string]string
 	GetMetricsTypeVal                string
 	GetLegacyMetricsConfigVal        LegacyMetricsConfig
 	GetPrometheusMetricsConfigVal    PrometheusMetricsConfig
 	GetOTelMetricsConfigVal          OTelMetricsConfig
+	GetMetricLabelsConfigVal         MetricLabelsConfig
 	GetOTelTracingConfigVal          OTelTracingConfig
 	GetSendDelayVal                  time.Duration
 	GetBatchTimeoutVal               time.Duration
@@ -62,21 +81,74 @@ type MockConfig struct {
 	DryRunFieldName                  string
 	AddHostMetadataToTrace           bool
 	AddRuleReasonToTrace             bool
+	AddDecisionToSpans               bool
 	EnvironmentCacheTTL              time.Duration
 	DatasetPrefix                    string
+	ValueListRefreshInterval         time.Duration
+	SamplerKeyReportInterval         time.Duration
 	QueryAuthToken                   string
 	PeerTimeout                      time.Duration
 	AdditionalErrorFields            []string
 	AddSpanCountToRoot               bool
 	AddCountsToRoot                  bool
+	ReparentOrphanSpans              bool
 	CacheOverrunStrategy             string
 	SampleCache                      SampleCacheConfig
 	StressRelief                     StressReliefConfig
 	AdditionalAttributes             map[string]string
 	TraceIdFieldNames                []string
 	ParentIdFieldNames               []string
+	IDFieldRules                     map[string]IDFieldRules
+	SpanIdFieldNames                 []string
+	ChildCountFieldNames             []string
 	CfgMetadata                      []ConfigMetadata
 	StoreOptions                     SmartWrapperOptions
+	DecisionExport                   DecisionExportConfig
+	DropAudit                        DropAuditConfig
+	TLS                              TLSConfig
+	Listeners                        map[Listener]ListenerConfig
+	XRay                             XRayConfig
+	Datadog                          DatadogConfig
+	Federation                       FederationConfig
+	SpanReduction                    SpanReductionConfig
+	LateErrorRecovery                LateErrorRecoveryConfig
+	LateSpans                        LateSpansConfig
+	ConsistentSampling               ConsistentSamplingConfig
+	TraceSpill                       TraceSpillConfig
+	TraceLimits                      TraceLimitsConfig
+	AdaptiveTraceTimeout             AdaptiveTimeoutConfig
+	MemoryBudget                     MemoryBudgetConfig
+	SpanDedup                        SpanDedupConfig
+	MissingRoot                      MissingRootConfig
+	CollectionOverrides              map[string]CollectionOverride
+	DecisionWarmup                   DecisionWarmupConfig
+	StateCompaction                  StateCompactionConfig
+	SpanSummaries                    SpanSummaryConfig
+	SendPacing                       SendPacingConfig
+	StateSnapshot                    StateSnapshotConfig
+	ConfigDistribution               ConfigDistributionConfig
+	FeatureFlags                     map[string]bool
+	SamplingGoals                    SamplingGoalsConfig
+	Profiling                        ProfilingConfig
+	Health                           HealthConfig
+	UpstreamProbe                    UpstreamProbeConfig
+	Drain                            DrainConfig
+	Supervision                      SupervisionConfig
+	UpstreamQueue                    UpstreamQueueConfig
+	KafkaOutput                      KafkaOutputConfig
+	OTLPUpstream                     OTLPUpstreamConfig
+	Destinations                     DestinationsConfig
+	AdaptiveBatching                 AdaptiveBatchingConfig
+	ScopedAttributes                 map[string][]string
+	SamplingHints                    SamplingHintsConfig
+	HTTP2                            HTTP2Config
+	ProxyProtocol                    ProxyProtocolConfig
+	Redaction                        RedactionConfig
+	ReloadVal                        ReloadResult
+	Generation                       uint64
+	Epoch                            uint64
+	Published                        []PublishedConfig
+	History                          []ConfigVersion
 
 	Mux sync.RWMutex
 }
@@ -92,6 +164,67 @@ func (m *MockConfig) ReloadConfig() {
 	}
 }
 
+// Reload returns ReloadVal; if it was applied with a change, the generation
+// is incremented, the version is added to History, and the callbacks are
+// called.
+func (m *MockConfig) Reload(trigger string) ReloadResult {
+	m.Mux.Lock()
+	result := m.ReloadVal
+	if result.Applied && result.Changed {
+		m.Generation++
+		m.History = append([]ConfigVersion{{
+			Generation: m.Generation,
+			Trigger:    trigger,
+			ConfigHash: result.ConfigHash,
+			RulesHash:  result.RulesHash,
+			Changes:    result.Changes,
+		}}, m.History...)
+	}
+	result.Generation = m.Generation
+	m.Mux.Unlock()
+
+	if result.Applied && result.Changed {
+		m.ReloadConfig()
+	}
+	return result
+}
+
+func (m *MockConfig) GetGeneration() uint64 {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.Generation
+}
+
+func (m *MockConfig) GetConfigHistory() []ConfigVersion {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.History
+}
+
+// ApplyPublished records the published config and takes its epoch, if it's
+// newer than the current one.
+func (m *MockConfig) ApplyPublished(published PublishedConfig) ReloadResult {
+	m.Mux.Lock()
+	defer m.Mux.Unlock()
+
+	if published.Epoch <= m.Epoch {
+		return ReloadResult{Generation: m.Generation, Epoch: m.Epoch, Error: "epoch is not newer"}
+	}
+	m.Published = append(m.Published, published)
+	m.Epoch = published.Epoch
+	m.Generation++
+	return ReloadResult{Applied: true, Changed: true, Generation: m.Generation, Epoch: m.Epoch}
+}
+
+func (m *MockConfig) GetConfigEpoch() uint64 {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.Epoch
+}
+
 func (m *MockConfig) RegisterReloadCallback(callback func()) {
 	m.Mux.Lock()
 	m.Callbacks = append(m.Callbacks, callback)
@@ -110,6 +243,13 @@ func (m *MockConfig) IsAPIKeyValid(key string) bool {
 	return m.IsAPIKeyValidFunc(key)
 }
 
+func (m *MockConfig) GetAccessKeyConfig() AccessKeyConfig {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.AccessKeys
+}
+
 func (m *MockConfig) GetCollectorType() string {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -149,6 +289,62 @@ func (m *MockConfig) GetPeerListenAddr() string {
 	return m.GetPeerListenAddrVal
 }
 
+func (m *MockConfig) GetHTTPMaxConcurrentRequests() int {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.HTTPMaxConcurrentRequests
+}
+
+func (m *MockConfig) GetMaxIngestPause() time.Duration {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.MaxIngestPause
+}
+
+func (m *MockConfig) GetOTLPStreamingThreshold() MemorySize {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.OTLPStreamingThreshold
+}
+
+func (m *MockConfig) GetOTLPStreamingBackpressureTimeout() time.Duration {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.OTLPStreamingBackpressureTimeout
+}
+
+func (m *MockConfig) GetOTLPRejectedSpans() string {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.OTLPRejectedSpans
+}
+
+func (m *MockConfig) GetAdmissionQueueThreshold() int {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.AdmissionQueueThreshold
+}
+
+func (m *MockConfig) GetAdmissionMemoryThreshold() int {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.AdmissionMemoryThreshold
+}
+
+func (m *MockConfig) GetAdmissionRetryAfter() time.Duration {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.AdmissionRetryAfter
+}
+
 func (m *MockConfig) GetHTTPIdleTimeout() time.Duration {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -163,6 +359,20 @@ func (m *MockConfig) GetCompressPeerCommunication() bool {
 	return m.GetCompressPeerCommunicationsVal
 }
 
+func (m *MockConfig) GetUpstreamCompression() string {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.GetUpstreamCompressionVal
+}
+
+func (m *MockConfig) GetSyntheticSpanIDs() string {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.GetSyntheticSpanIDsVal
+}
+
 func (m *MockConfig) GetGRPCEnabled() bool {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -204,6 +414,20 @@ func (m *MockConfig) GetLoggerLevel() Level {
 	return m.GetLoggerLevelVal
 }
 
+func (m *MockConfig) GetLoggerSubsystemLevels() map[string]Level {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.GetLoggerSubsystemLevelsVal
+}
+
+func (m *MockConfig) GetJSONLoggerConfig() JSONLoggerConfig {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.GetJSONLoggerConfigVal
+}
+
 func (m *MockConfig) GetPeers() []string {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -211,6 +435,36 @@ func (m *MockConfig) GetPeers() []string {
 	return m.GetPeersVal
 }
 
+// GetRedisSettings returns GetRedisSettingsVal if it's set, and otherwise
+// builds the settings from the values of the other Redis getters.
+func (m *MockConfig) GetRedisSettings() RedisSettings {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	if m.GetRedisSettingsVal != nil {
+		return *m.GetRedisSettingsVal
+	}
+	var hosts []string
+	if m.GetRedisHostVal != "" {
+		hosts = []string{m.GetRedisHostVal}
+	}
+	return RedisSettings{
+		Hosts:    hosts,
+		Username: m.GetRedisUsernameVal,
+		Password: m.GetRedisPasswordVal,
+		AuthCode: m.GetRedisAuthCodeVal,
+		Database: m.GetRedisDatabaseVal,
+		Prefix:   m.GetRedisPrefixVal,
+		TLS:      RedisTLSSettings{Enabled: m.GetUseTLSVal, Insecure: m.GetUseTLSInsecureVal},
+		Pool:     RedisPoolSettings{MaxIdle: m.GetRedisMaxIdleVal, MaxActive: m.GetRedisMaxActiveVal},
+		Timeouts: RedisTimeouts{
+			Idle:  m.PeerTimeout,
+			Drain: m.GetRedisDrainTimeoutVal,
+		},
+		Parallelism: m.GetParallelismVal,
+	}.withDefaults()
+}
+
 func (m *MockConfig) GetRedisHost() string {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -267,6 +521,13 @@ func (m *MockConfig) GetUseTLSInsecure() bool {
 	return m.GetUseTLSInsecureVal
 }
 
+func (m *MockConfig) GetRedisDrainTimeout() time.Duration {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.GetRedisDrainTimeoutVal
+}
+
 func (m *MockConfig) GetRedisMaxActive() int {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -327,6 +588,13 @@ func (m *MockConfig) GetOTelMetricsConfig() OTelMetricsConfig {
 	return m.GetOTelMetricsConfigVal
 }
 
+func (m *MockConfig) GetMetricLabelsConfig() MetricLabelsConfig {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.GetMetricLabelsConfigVal
+}
+
 func (m *MockConfig) GetOTelTracingConfig() OTelTracingConfig {
 	m.Mux.RLock()
 	defer m.Mux.RUnlock()
@@ -370,6 +638,20 @@ func (m *MockConfig) GetSamplerConfigForDestName(dataset string) (interface{}, s
 	return m.GetSamplerTypeVal, m.GetSamplerTypeName, m.GetSamplerTypeErr
 }
 
+func (m *MockConfig) GetTenantForAPIKey(apiKey string) string {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.TenantAPIKeys[apiKey]
+}
+
+func (m *MockConfig) GetTenantForTeam(team string) string {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.TenantTeams[team]
+}
+
 // GetAllSamplerRules normally returns all dataset rules, including the default
 // In this mock, it returns only the rules for "dataset1" according to the type of the value field
 func (m *MockConfig) GetAllSamplerRules() *V2SamplerConfig {
@@ -476,6 +758,13 @@ func (m *MockConfig) GetAddRuleReasonToTrace() bool {
 	return m.AddRuleReasonToTrace
 }
 
+func (m *MockConfig) GetAddDecisionToSpans() bool {
+	m.Mux.RLock()
+	defer m.Mux.RUnlock()
+
+	return m.AddDecisionToSpans
+}
+
 func (f *MockConfig) GetEnvironmentCacheTTL() time.Duration {
 	f.Mux.RLock()
 	defer f.Mux.RUnlock()
@@ -490,6 +779,20 @@ func (f *MockConfig) GetDatasetPrefix() string {
 	return f.DatasetPrefix
 }
 
+func (f *MockConfig) GetValueListRefreshInterval() time.Duration {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ValueListRefreshInterval
+}
+
+func (f *MockConfig) GetSamplerKeyReportInterval() time.Duration {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SamplerKeyReportInterval
+}
+
 func (f *MockConfig) GetQueryAuthToken() string {
 	f.Mux.RLock()
 	defer f.Mux.RUnlock()
@@ -532,6 +835,13 @@ func (f *MockConfig) GetAddCountsToRoot() bool {
 	return f.AddSpanCountToRoot
 }
 
+func (f *MockConfig) GetReparentOrphanSpans() bool {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ReparentOrphanSpans
+}
+
 func (f *MockConfig) GetSampleCacheConfig() SampleCacheConfig {
 	f.Mux.RLock()
 	defer f.Mux.RUnlock()
@@ -552,6 +862,30 @@ func (f *MockConfig) GetTraceIdFieldNames() []string {
 	return f.TraceIdFieldNames
 }
 
+func (f *MockConfig) GetSpanIdFieldNames() []string {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	if f.SpanIdFieldNames == nil {
+		return []string{"trace.span_id", "spanId"}
+	}
+	return f.SpanIdFieldNames
+}
+
+func (f *MockConfig) GetIDFieldRules(dataset string) IDFieldRules {
+	f.Mux.RLock()
+	rules := f.IDFieldRules[dataset]
+	f.Mux.RUnlock()
+
+	if len(rules.TraceNames) == 0 {
+		rules.TraceNames = f.GetTraceIdFieldNames()
+	}
+	if len(rules.ParentNames) == 0 {
+		rules.ParentNames = f.GetParentIdFieldNames()
+	}
+	return rules
+}
+
 func (f *MockConfig) GetParentIdFieldNames() []string {
 	f.Mux.RLock()
 	defer f.Mux.RUnlock()
@@ -562,6 +896,13 @@ func (f *MockConfig) GetParentIdFieldNames() []string {
 	return f.ParentIdFieldNames
 }
 
+func (f *MockConfig) GetChildCountFieldNames() []string {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ChildCountFieldNames
+}
+
 func (f *MockConfig) GetConfigMetadata() []ConfigMetadata {
 	f.Mux.RLock()
 	defer f.Mux.RUnlock()
@@ -590,3 +931,303 @@ func (f *MockConfig) GetCentralStoreOptions() SmartWrapperOptions {
 
 	return f.StoreOptions
 }
+
+func (f *MockConfig) GetDecisionExportConfig() DecisionExportConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.DecisionExport
+}
+
+func (f *MockConfig) GetDropAuditConfig() DropAuditConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.DropAudit
+}
+
+func (f *MockConfig) GetListenerConfig(listener Listener) ListenerConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	switch listener {
+	case ListenerHTTP:
+		return ingestListener(f.Listeners[listener], f.GetListenAddrVal, f.GetHTTPIdleTimeoutVal, f.TLS)
+	case ListenerGRPC:
+		return ingestListener(f.Listeners[listener], f.GetGRPCListenAddrVal, time.Duration(f.GetGRPCServerParameters.MaxConnectionIdle), f.TLS)
+	}
+	return f.Listeners[listener]
+}
+
+func (f *MockConfig) GetTLSConfig() TLSConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.TLS
+}
+
+func (f *MockConfig) GetXRayConfig() XRayConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.XRay
+}
+
+func (f *MockConfig) GetDatadogConfig() DatadogConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Datadog
+}
+
+func (f *MockConfig) GetSamplingHintsConfig() SamplingHintsConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SamplingHints
+}
+
+func (f *MockConfig) GetRedactionConfig() RedactionConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Redaction
+}
+
+func (f *MockConfig) GetSpanReductionConfig() SpanReductionConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SpanReduction
+}
+
+func (f *MockConfig) GetLateErrorRecoveryConfig() LateErrorRecoveryConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.LateErrorRecovery
+}
+
+func (f *MockConfig) GetLateSpansConfig() LateSpansConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.LateSpans
+}
+
+func (f *MockConfig) GetTraceSpillConfig() TraceSpillConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.TraceSpill
+}
+
+func (f *MockConfig) GetTraceLimitsConfig() TraceLimitsConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.TraceLimits
+}
+
+func (f *MockConfig) GetAdaptiveTraceTimeoutConfig() AdaptiveTimeoutConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.AdaptiveTraceTimeout
+}
+
+func (f *MockConfig) GetMemoryBudgetConfig() MemoryBudgetConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.MemoryBudget
+}
+
+func (f *MockConfig) GetSpanDedupConfig() SpanDedupConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SpanDedup
+}
+
+func (f *MockConfig) GetMissingRootConfig() MissingRootConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.MissingRoot
+}
+
+func (f *MockConfig) GetCollectionOverride(target string) CollectionOverride {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.CollectionOverrides[target]
+}
+
+func (f *MockConfig) GetCollectionOverrides() map[string]CollectionOverride {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return maps.Clone(f.CollectionOverrides)
+}
+
+func (f *MockConfig) GetDecisionWarmupConfig() DecisionWarmupConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.DecisionWarmup
+}
+
+func (f *MockConfig) GetStateCompactionConfig() StateCompactionConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.StateCompaction
+}
+
+func (f *MockConfig) GetSpanSummaryConfig() SpanSummaryConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SpanSummaries
+}
+
+func (f *MockConfig) GetSendPacingConfig() SendPacingConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SendPacing
+}
+
+func (f *MockConfig) GetStateSnapshotConfig() StateSnapshotConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.StateSnapshot
+}
+
+func (f *MockConfig) GetFeatureFlags() map[string]bool {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.FeatureFlags
+}
+
+func (f *MockConfig) GetConfigDistributionConfig() ConfigDistributionConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ConfigDistribution
+}
+
+func (f *MockConfig) GetConsistentSamplingConfig() ConsistentSamplingConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ConsistentSampling
+}
+
+func (f *MockConfig) GetScopedAttributes() map[string][]string {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ScopedAttributes
+}
+
+func (f *MockConfig) GetSamplingGoalsConfig() SamplingGoalsConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.SamplingGoals
+}
+
+func (f *MockConfig) GetProfilingConfig() ProfilingConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Profiling
+}
+
+func (f *MockConfig) GetHealthConfig() HealthConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Health
+}
+
+func (f *MockConfig) GetUpstreamProbeConfig() UpstreamProbeConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.UpstreamProbe
+}
+
+func (f *MockConfig) GetDrainConfig() DrainConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Drain
+}
+
+func (f *MockConfig) GetSupervisionConfig() SupervisionConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Supervision
+}
+
+func (f *MockConfig) GetUpstreamQueueConfig() UpstreamQueueConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.UpstreamQueue
+}
+
+func (f *MockConfig) GetKafkaOutputConfig() KafkaOutputConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.KafkaOutput
+}
+
+func (f *MockConfig) GetOTLPUpstreamConfig() OTLPUpstreamConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.OTLPUpstream
+}
+
+func (f *MockConfig) GetDestinationsConfig() DestinationsConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Destinations
+}
+
+func (f *MockConfig) GetAdaptiveBatchingConfig() AdaptiveBatchingConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.AdaptiveBatching
+}
+
+func (f *MockConfig) GetHTTP2Config() HTTP2Config {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.HTTP2
+}
+
+func (f *MockConfig) GetProxyProtocolConfig() ProxyProtocolConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.ProxyProtocol
+}
+
+func (f *MockConfig) GetFederationConfig() FederationConfig {
+	f.Mux.RLock()
+	defer f.Mux.RUnlock()
+
+	return f.Federation
+}
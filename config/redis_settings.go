@@ -0,0 +1,127 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultRedisHost is the Redis instance that is used when none is
+// configured.
+const DefaultRedisHost = "localhost:6379"
+
+// RedisSettings holds everything needed to connect to Redis, with the
+// defaults applied. It's returned by RedisConfig.GetRedisSettings as a whole,
+// so that a new setting doesn't need a getter of its own.
+type RedisSettings struct {
+	// Hosts are the addresses of the Redis instance or, when SentinelMaster
+	// is set, of the sentinels that monitor it.
+	Hosts []string
+	// SentinelMaster is the name of the master that the sentinels know the
+	// Redis instance by, or empty to connect to Hosts directly.
+	SentinelMaster string
+
+	Username string
+	Password string
+	AuthCode string
+	Database int
+	Prefix   string
+
+	TLS      RedisTLSSettings
+	Pool     RedisPoolSettings
+	Timeouts RedisTimeouts
+
+	Parallelism int
+}
+
+type RedisTLSSettings struct {
+	Enabled bool
+	// Insecure disables certificate checks.
+	Insecure bool
+}
+
+type RedisPoolSettings struct {
+	MaxIdle   int
+	MaxActive int
+}
+
+type RedisTimeouts struct {
+	// Connect is how long to wait to establish a connection.
+	Connect time.Duration
+	// Idle is how long an unused connection stays in the pool.
+	Idle time.Duration
+	// Drain is how long to wait on shutdown for connections that are in use
+	// to be released.
+	Drain time.Duration
+}
+
+// UseSentinel returns true if the Redis instance is found through sentinels.
+func (s RedisSettings) UseSentinel() bool {
+	return s.SentinelMaster != ""
+}
+
+// Validate returns an error describing every setting that can't be used to
+// connect to Redis.
+func (s RedisSettings) Validate() error {
+	var errs []error
+	switch {
+	case len(s.Hosts) == 0:
+		errs = append(errs, errors.New("no Redis host is configured"))
+	case len(s.Hosts) > 1 && !s.UseSentinel():
+		errs = append(errs, errors.New("more than one Redis host requires SentinelMaster"))
+	}
+	for _, host := range s.Hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Redis host '%s': %w", host, err))
+		}
+	}
+	if s.Database < 0 {
+		errs = append(errs, fmt.Errorf("invalid Redis database %d", s.Database))
+	}
+	if s.Pool.MaxIdle < 0 || s.Pool.MaxActive < 0 {
+		errs = append(errs, fmt.Errorf("invalid Redis pool size %d idle, %d active", s.Pool.MaxIdle, s.Pool.MaxActive))
+	}
+	if s.Timeouts.Connect < 0 || s.Timeouts.Idle < 0 || s.Timeouts.Drain < 0 {
+		errs = append(errs, errors.New("invalid Redis timeout, it must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// withDefaults returns the settings with a default in place of each value
+// that must be set.
+func (s RedisSettings) withDefaults() RedisSettings {
+	if len(s.Hosts) == 0 {
+		s.Hosts = []string{DefaultRedisHost}
+	}
+	if s.Timeouts.Connect == 0 {
+		s.Timeouts.Connect = 30 * time.Second
+	}
+	return s
+}
+
+// redisSettings builds the settings from the RedisPeerManagement section.
+// Hosts takes precedence over Host.
+func (r RedisPeerManagementConfig) redisSettings() RedisSettings {
+	hosts := r.Hosts
+	if len(hosts) == 0 && r.Host != "" {
+		hosts = []string{r.Host}
+	}
+	return RedisSettings{
+		Hosts:          append([]string(nil), hosts...),
+		SentinelMaster: r.SentinelMaster,
+		Username:       r.Username,
+		Password:       r.Password,
+		AuthCode:       r.AuthCode,
+		Database:       r.Database,
+		Prefix:         r.Prefix,
+		TLS:            RedisTLSSettings{Enabled: r.UseTLS, Insecure: r.UseTLSInsecure},
+		Pool:           RedisPoolSettings{MaxIdle: r.MaxIdle, MaxActive: r.MaxActive},
+		Timeouts: RedisTimeouts{
+			Connect: time.Duration(r.ConnectTimeout),
+			Idle:    time.Duration(r.Timeout),
+			Drain:   time.Duration(r.DrainTimeout),
+		},
+		Parallelism: r.Parallelism,
+	}.withDefaults()
+}
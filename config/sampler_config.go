@@ -2,9 +2,12 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/honeycombio/refinery/generics"
 )
@@ -28,10 +31,18 @@ const (
 	NotExists      = "not-exists"
 	HasRootSpan    = "has-root-span"
 	MatchesRegexp  = "matches"
+	NotMatches     = "not-matches"
 	In             = "in"
 	NotIn          = "not-in"
+	Between        = "between"
+	InCIDR         = "in-cidr"
+	NotInCIDR      = "not-in-cidr"
 )
 
+// IgnoreCaseSuffix makes a string operator case-insensitive, as in
+// "contains-ignore-case".
+const IgnoreCaseSuffix = "-ignore-case"
+
 // ComputedField is a virtual field. It's value is calculated during rule evaluation.
 // We use the `?.` prefix to distinguish computed fields from regular fields.
 type ComputedField string
@@ -40,8 +51,148 @@ const (
 	// ComputedFieldPrefix is the prefix for computed fields.
 	ComputedFieldPrefix               = "?."
 	NUM_DESCENDANTS     ComputedField = ComputedFieldPrefix + "NUM_DESCENDANTS"
+	// SPAN_COUNT is the number of spans in the trace, not counting span
+	// events and links.
+	SPAN_COUNT ComputedField = ComputedFieldPrefix + "SPAN_COUNT"
+	// DURATION_MS is the duration of the root span, or if it hasn't arrived,
+	// the longest duration of the spans that have.
+	DURATION_MS ComputedField = ComputedFieldPrefix + "DURATION_MS"
+	// ERROR_COUNT is the number of spans with a true error field.
+	ERROR_COUNT ComputedField = ComputedFieldPrefix + "ERROR_COUNT"
+	// SERVICE_COUNT is the number of distinct service names in the trace.
+	SERVICE_COUNT ComputedField = ComputedFieldPrefix + "SERVICE_COUNT"
+	// ROOT_HTTP_STATUS_CODE is the HTTP status code of the root span.
+	ROOT_HTTP_STATUS_CODE ComputedField = ComputedFieldPrefix + "ROOT_HTTP_STATUS_CODE"
+	// ANY_ERROR is true if any span in the trace has a true error field.
+	ANY_ERROR ComputedField = ComputedFieldPrefix + "ANY_ERROR"
+	// MAX_CHILD_DURATION_MS is the longest duration of the spans other than
+	// the root span.
+	MAX_CHILD_DURATION_MS ComputedField = ComputedFieldPrefix + "MAX_CHILD_DURATION_MS"
+	// LEAF_SERVICE_COUNT is the number of distinct service names of the spans
+	// that have no children.
+	LEAF_SERVICE_COUNT ComputedField = ComputedFieldPrefix + "LEAF_SERVICE_COUNT"
+	// ERROR_CHAIN lists the services of the spans with errors, from the one
+	// nearest the root to the deepest, such as "frontend>api>db".
+	ERROR_CHAIN ComputedField = ComputedFieldPrefix + "ERROR_CHAIN"
+)
+
+// SourceFields returns the span fields that a computed field is calculated
+// from, which must be kept with each span until the trace decision is made.
+func (f ComputedField) SourceFields() []string {
+	switch f {
+	case SPAN_COUNT:
+		return []string{"meta.annotation_type"}
+	case DURATION_MS:
+		return []string{"duration_ms"}
+	case ERROR_COUNT:
+		return []string{"error"}
+	case SERVICE_COUNT:
+		return []string{"service.name"}
+	case ROOT_HTTP_STATUS_CODE:
+		return []string{"http.status_code", "http.response.status_code"}
+	case ANY_ERROR:
+		return []string{"error"}
+	case MAX_CHILD_DURATION_MS:
+		return []string{"duration_ms"}
+	case LEAF_SERVICE_COUNT:
+		return []string{"service.name", "meta.annotation_type", SpanIDField, ParentIDField}
+	case ERROR_CHAIN:
+		return []string{"service.name", "error", "meta.annotation_type", SpanIDField, ParentIDField}
+	}
+	return nil
+}
+
+// SpanIDField and ParentIDField are where the computed fields that follow
+// the shape of a trace read its spans' IDs from. Spans may keep their IDs in
+// other fields, as IDFieldNames says, so the collector records them under
+// these names for decisions.
+const (
+	SpanIDField   = "trace.span_id"
+	ParentIDField = "trace.parent_id"
+)
+
+// withSourceFields adds the source fields of any computed fields to a list
+// of fields that samplers build keys from.
+func withSourceFields(fields []string) []string {
+	var sources []string
+	for _, field := range fields {
+		if strings.HasPrefix(field, ComputedFieldPrefix) {
+			sources = append(sources, ComputedField(field).SourceFields()...)
+		}
+	}
+	if len(sources) == 0 {
+		return fields
+	}
+	return append(append([]string{}, fields...), sources...)
+}
+
+// Attribute scopes that a rule's field can name explicitly, since OTLP
+// resource, scope and span attributes are flattened into one set of fields
+// in which they can collide.
+const (
+	ResourceScope = "resource"
+	ScopeScope    = "scope"
+	SpanScope     = "span"
 )
 
+// ScopedAttributesMarker is set on the spans whose scoped attributes have
+// been recorded, so that a scoped field that they don't have isn't looked
+// up by its unscoped name.
+const ScopedAttributesMarker = "meta.refinery.scoped_attributes"
+
+// ParseScopedField splits a field such as "resource.service.name" into its
+// attribute scope and the attribute's name. It returns false for a field
+// without a scope.
+func ParseScopedField(field string) (scope string, name string, ok bool) {
+	scope, name, ok = strings.Cut(field, ".")
+	if !ok || name == "" {
+		return "", "", false
+	}
+	switch scope {
+	case ResourceScope, ScopeScope, SpanScope:
+		return scope, name, true
+	}
+	return "", "", false
+}
+
+// ScopedAttributeField is the field that an OTLP attribute of the given
+// scope is recorded in when a rule names it with its scope.
+func ScopedAttributeField(scope string, name string) string {
+	return "meta.refinery." + scope + "." + name
+}
+
+// StripScopedAttributes removes the fields that a span's scoped attributes
+// were recorded in, which are only there for sampling, before the span is
+// sent on. Spans without ScopedAttributesMarker have none.
+func StripScopedAttributes(data map[string]interface{}) {
+	if _, ok := data[ScopedAttributesMarker]; !ok {
+		return
+	}
+	delete(data, ScopedAttributesMarker)
+	for name := range data {
+		for _, scope := range []string{ResourceScope, ScopeScope, SpanScope} {
+			if strings.HasPrefix(name, ScopedAttributeField(scope, "")) {
+				delete(data, name)
+				break
+			}
+		}
+	}
+}
+
+// scopedSourceFields returns the span fields that the scoped fields in a
+// list of rule fields are looked up in.
+func scopedSourceFields(fields []string) []string {
+	var sources []string
+	for _, field := range fields {
+		scope, name, ok := ParseScopedField(strings.TrimPrefix(field, "root."))
+		if !ok {
+			continue
+		}
+		sources = append(sources, ScopedAttributeField(scope, name), name, ScopedAttributesMarker)
+	}
+	return sources
+}
+
 // The json tags in this file are used for conversion from the old format (see tools/convert for details).
 // They are deliberately all lowercase.
 // The yaml tags are used for the new format and are PascalCase.
@@ -54,6 +205,10 @@ type V2SamplerChoice struct {
 	EMAThroughputSampler      *EMAThroughputSamplerConfig      `json:"emathroughputsampler" yaml:"EMAThroughputSampler,omitempty"`
 	WindowedThroughputSampler *WindowedThroughputSamplerConfig `json:"windowedthroughputsampler" yaml:"WindowedThroughputSampler,omitempty"`
 	TotalThroughputSampler    *TotalThroughputSamplerConfig    `json:"totalthroughputsampler" yaml:"TotalThroughputSampler,omitempty"`
+	ClusterThroughputSampler  *ClusterThroughputSamplerConfig  `json:"clusterthroughputsampler" yaml:"ClusterThroughputSampler,omitempty"`
+	BudgetSampler             *BudgetSamplerConfig             `json:"budgetsampler" yaml:"BudgetSampler,omitempty"`
+	LatencySampler            *LatencySamplerConfig            `json:"latencysampler" yaml:"LatencySampler,omitempty"`
+	CompositeSampler          *CompositeSamplerConfig          `json:"compositesampler" yaml:"CompositeSampler,omitempty"`
 }
 
 func (v *V2SamplerChoice) Sampler() (any, string) {
@@ -72,6 +227,14 @@ func (v *V2SamplerChoice) Sampler() (any, string) {
 		return v.WindowedThroughputSampler, "WindowedThroughputSampler"
 	case v.TotalThroughputSampler != nil:
 		return v.TotalThroughputSampler, "TotalThroughputSampler"
+	case v.ClusterThroughputSampler != nil:
+		return v.ClusterThroughputSampler, "ClusterThroughputSampler"
+	case v.BudgetSampler != nil:
+		return v.BudgetSampler, "BudgetSampler"
+	case v.LatencySampler != nil:
+		return v.LatencySampler, "LatencySampler"
+	case v.CompositeSampler != nil:
+		return v.CompositeSampler, "CompositeSampler"
 	default:
 		return nil, ""
 	}
@@ -107,6 +270,23 @@ func (v *V2SamplerChoice) NameMeaningfulSamplers() []string {
 		names.Add("WindowedThroughputSampler")
 	case v.TotalThroughputSampler != nil:
 		names.Add("TotalThroughputSampler")
+	case v.ClusterThroughputSampler != nil:
+		names.Add("ClusterThroughputSampler")
+	case v.BudgetSampler != nil:
+		names.Add("BudgetSampler")
+	case v.LatencySampler != nil:
+		names.Add("LatencySampler")
+	case v.CompositeSampler != nil:
+		for i, step := range v.CompositeSampler.Steps {
+			if step.Sampler == nil {
+				continue
+			}
+			if step.Sampler.RulesBasedSampler != nil {
+				names.Add(fmt.Sprintf("CompositeSampler(%s, RulesBasedSampler)", step.StepName(i)))
+			} else if step.Sampler.NameMeaningfulRate() != "" {
+				names.Add(fmt.Sprintf("CompositeSampler(%s, %s)", step.StepName(i), step.Sampler.NameMeaningfulRate()))
+			}
+		}
 	default:
 		return nil
 	}
@@ -136,6 +316,8 @@ func (v *RulesBasedDownstreamSampler) NameMeaningfulRate() string {
 		if v.TotalThroughputSampler.GoalThroughputPerSec > 0 {
 			return "TotalThroughputSampler"
 		}
+	case v.LatencySampler != nil:
+		return "LatencySampler"
 	}
 	return ""
 }
@@ -143,6 +325,241 @@ func (v *RulesBasedDownstreamSampler) NameMeaningfulRate() string {
 type V2SamplerConfig struct {
 	RulesVersion int                         `json:"rulesversion" yaml:"RulesVersion" validate:"required,ge=2"`
 	Samplers     map[string]*V2SamplerChoice `json:"samplers" yaml:"Samplers,omitempty" validate:"required"`
+	Tenants      map[string]*TenantConfig    `json:"tenants,omitempty" yaml:"Tenants,omitempty"`
+}
+
+// TenantConfig gives the traces sent with any of a tenant's API keys, or any
+// key of one of its Honeycomb teams, their own samplers, which are used in
+// preference to the top-level ones.
+type TenantConfig struct {
+	APIKeys  []string                    `json:"apikeys" yaml:"APIKeys,omitempty"`
+	Teams    []string                    `json:"teams,omitempty" yaml:"Teams,omitempty"`
+	Samplers map[string]*V2SamplerChoice `json:"samplers" yaml:"Samplers,omitempty"`
+}
+
+// TenantSelectorPrefix starts the sampler selectors of tenants' traces.
+const TenantSelectorPrefix = "@"
+
+// TenantSelector returns the sampler selector for a tenant's trace with the
+// given target, which is an environment or dataset.
+func TenantSelector(tenant, target string) string {
+	return TenantSelectorPrefix + tenant + "/" + target
+}
+
+// ParseTenantSelector splits a selector made by TenantSelector into its
+// tenant and target. It returns false for any other selector.
+func ParseTenantSelector(selector string) (tenant string, target string, ok bool) {
+	rest, ok := strings.CutPrefix(selector, TenantSelectorPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "/")
+}
+
+// tenantIndex finds the tenant that an API key or team belongs to. It's
+// built when the rules are loaded, since it's consulted for every trace.
+type tenantIndex struct {
+	byAPIKey map[string]string
+	byTeam   map[string]string
+}
+
+// indexTenants indexes the rules' tenants. A key or team that is listed by
+// more than one tenant belongs to the first of them by name.
+func (v *V2SamplerConfig) indexTenants() tenantIndex {
+	index := tenantIndex{byAPIKey: make(map[string]string), byTeam: make(map[string]string)}
+	names := make([]string, 0, len(v.Tenants))
+	for name, tenant := range v.Tenants {
+		if tenant != nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, apiKey := range v.Tenants[name].APIKeys {
+			if _, ok := index.byAPIKey[apiKey]; !ok && apiKey != "" {
+				index.byAPIKey[apiKey] = name
+			}
+		}
+		for _, team := range v.Tenants[name].Teams {
+			if _, ok := index.byTeam[team]; !ok && team != "" {
+				index.byTeam[team] = name
+			}
+		}
+	}
+	return index
+}
+
+// RedactTenantKeys returns a copy of the rules with each tenant's API keys
+// passed through redact, for showing the rules to someone who shouldn't
+// see the keys. The samplers are shared with v, not copied.
+func (v *V2SamplerConfig) RedactTenantKeys(redact func(string) string) *V2SamplerConfig {
+	if len(v.Tenants) == 0 {
+		return v
+	}
+	redacted := *v
+	redacted.Tenants = make(map[string]*TenantConfig, len(v.Tenants))
+	for name, tenant := range v.Tenants {
+		if tenant == nil {
+			redacted.Tenants[name] = nil
+			continue
+		}
+		t := *tenant
+		t.APIKeys = make([]string, len(tenant.APIKeys))
+		for i, apiKey := range tenant.APIKeys {
+			t.APIKeys[i] = redact(apiKey)
+		}
+		redacted.Tenants[name] = &t
+	}
+	return &redacted
+}
+
+// SamplerFor returns the sampler to use for a selector, and the target it
+// was found under. A tenant's own target or __default__ is used before the
+// top-level target or __default__.
+func (v *V2SamplerConfig) SamplerFor(selector string) (*V2SamplerChoice, string) {
+	target := selector
+	if name, tenantTarget, ok := ParseTenantSelector(selector); ok {
+		target = tenantTarget
+		if tenant := v.Tenants[name]; tenant != nil {
+			for _, t := range []string{target, "__default__"} {
+				if sampler, ok := tenant.Samplers[t]; ok {
+					return sampler, TenantSelector(name, t)
+				}
+			}
+		}
+	}
+	for _, t := range []string{target, "__default__"} {
+		if sampler, ok := v.Samplers[t]; ok {
+			return sampler, t
+		}
+	}
+	return nil, ""
+}
+
+// HasTarget reports whether selector names a target in the rules: one of the
+// top-level samplers, or a tenant's selector for one of its own samplers or
+// a top-level one.
+func (v *V2SamplerConfig) HasTarget(selector string) bool {
+	if v == nil {
+		return false
+	}
+	if name, target, ok := ParseTenantSelector(selector); ok {
+		tenant := v.Tenants[name]
+		if tenant == nil {
+			return false
+		}
+		if _, ok := tenant.Samplers[target]; ok {
+			return true
+		}
+		selector = target
+	}
+	_, ok := v.Samplers[selector]
+	return ok
+}
+
+// ScopedAttributes returns the names of the OTLP attributes of each scope
+// that the samplers' rules name with their scope, which are recorded as
+// spans arrive.
+func (v *V2SamplerConfig) ScopedAttributes() map[string][]string {
+	if v == nil {
+		return nil
+	}
+	names := make(map[string]generics.Set[string])
+	add := func(choices map[string]*V2SamplerChoice) {
+		for _, choice := range choices {
+			if choice == nil {
+				continue
+			}
+			sampler, _ := choice.Sampler()
+			fielder, ok := sampler.(GetSamplingFielder)
+			if !ok {
+				continue
+			}
+			for _, field := range fielder.GetSamplingFields() {
+				rest, ok := strings.CutPrefix(field, "meta.refinery.")
+				if !ok {
+					continue
+				}
+				if scope, name, ok := ParseScopedField(rest); ok {
+					if names[scope] == nil {
+						names[scope] = generics.NewSet[string]()
+					}
+					names[scope].Add(name)
+				}
+			}
+		}
+	}
+	add(v.Samplers)
+	for _, tenant := range v.Tenants {
+		if tenant != nil {
+			add(tenant.Samplers)
+		}
+	}
+
+	scoped := make(map[string][]string, len(names))
+	for scope, set := range names {
+		scoped[scope] = set.Members()
+		slices.Sort(scoped[scope])
+	}
+	return scoped
+}
+
+// ValueListSources returns the sources of the value lists that the samplers'
+// conditions name, in order.
+func (v *V2SamplerConfig) ValueListSources() []string {
+	if v == nil {
+		return nil
+	}
+	sources := generics.NewSet[string]()
+	addConditions := func(conditions []*RulesBasedSamplerCondition) {
+		for _, cond := range conditions {
+			if cond != nil && cond.ValuesFrom != "" {
+				sources.Add(cond.ValuesFrom)
+			}
+		}
+	}
+	addRules := func(rules *RulesBasedSamplerConfig) {
+		if rules == nil {
+			return
+		}
+		for _, rule := range rules.Rules {
+			if rule != nil {
+				addConditions(rule.Conditions)
+			}
+		}
+	}
+	add := func(choices map[string]*V2SamplerChoice) {
+		for _, choice := range choices {
+			if choice == nil {
+				continue
+			}
+			sampler, _ := choice.Sampler()
+			switch sampler := sampler.(type) {
+			case *RulesBasedSamplerConfig:
+				addRules(sampler)
+			case *CompositeSamplerConfig:
+				for _, step := range sampler.Steps {
+					if step == nil {
+						continue
+					}
+					addConditions(step.Conditions)
+					if step.Sampler != nil {
+						addRules(step.Sampler.RulesBasedSampler)
+					}
+				}
+			}
+		}
+	}
+	add(v.Samplers)
+	for _, tenant := range v.Tenants {
+		if tenant != nil {
+			add(tenant.Samplers)
+		}
+	}
+
+	list := sources.Members()
+	slices.Sort(list)
+	return list
 }
 
 type GetSamplingFielder interface {
@@ -152,10 +569,14 @@ type GetSamplingFielder interface {
 var _ GetSamplingFielder = (*DeterministicSamplerConfig)(nil)
 
 type DeterministicSamplerConfig struct {
-	SampleRate int `json:"samplerate" yaml:"SampleRate,omitempty" default:"1" validate:"required,gte=1"`
+	SampleRate int    `json:"samplerate" yaml:"SampleRate,omitempty" default:"1" validate:"required,gte=1"`
+	HashField  string `json:"hashfield,omitempty" yaml:"HashField,omitempty" toml:",omitempty"`
 }
 
 func (d *DeterministicSamplerConfig) GetSamplingFields() []string {
+	if d.HashField != "" {
+		return []string{d.HashField}
+	}
 	return nil
 }
 
@@ -171,84 +592,206 @@ func (d *MockSamplerConfig) GetSamplingFields() []string {
 var _ GetSamplingFielder = (*DynamicSamplerConfig)(nil)
 
 type DynamicSamplerConfig struct {
-	SampleRate     int64    `json:"samplerate" yaml:"SampleRate,omitempty" validate:"required,gte=1"`
-	ClearFrequency Duration `json:"clearfrequency" yaml:"ClearFrequency,omitempty"`
-	FieldList      []string `json:"fieldlist" yaml:"FieldList,omitempty" validate:"required"`
-	MaxKeys        int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
-	UseTraceLength bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
+	SampleRate                int64    `json:"samplerate" yaml:"SampleRate,omitempty" validate:"required,gte=1"`
+	ClearFrequency            Duration `json:"clearfrequency" yaml:"ClearFrequency,omitempty"`
+	FieldList                 []string `json:"fieldlist" yaml:"FieldList,omitempty" validate:"required"`
+	MaxKeys                   int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
+	DropHighCardinalityFields bool     `json:"drophighcardinalityfields" yaml:"DropHighCardinalityFields,omitempty"`
+	UseTraceLength            bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
 }
 
 func (d *DynamicSamplerConfig) GetSamplingFields() []string {
-	return d.FieldList
+	return withSourceFields(d.FieldList)
 }
 
 var _ GetSamplingFielder = (*EMADynamicSamplerConfig)(nil)
 
 type EMADynamicSamplerConfig struct {
-	GoalSampleRate      int      `json:"goalsamplerate" yaml:"GoalSampleRate,omitempty" validate:"gte=1"`
-	AdjustmentInterval  Duration `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
-	Weight              float64  `json:"weight" yaml:"Weight,omitempty" validate:"gt=0,lt=1"`
-	AgeOutValue         float64  `json:"ageoutvalue" yaml:"AgeOutValue,omitempty"`
-	BurstMultiple       float64  `json:"burstmultiple" yaml:"BurstMultiple,omitempty"`
-	BurstDetectionDelay uint     `json:"burstdetectiondelay" yaml:"BurstDetectionDelay,omitempty"`
-	FieldList           []string `json:"fieldlist" yaml:"FieldList,omitempty" validate:"required"`
-	MaxKeys             int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
-	UseTraceLength      bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
+	GoalSampleRate            int      `json:"goalsamplerate" yaml:"GoalSampleRate,omitempty" validate:"gte=1"`
+	AdjustmentInterval        Duration `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
+	Weight                    float64  `json:"weight" yaml:"Weight,omitempty" validate:"gt=0,lt=1"`
+	AgeOutValue               float64  `json:"ageoutvalue" yaml:"AgeOutValue,omitempty"`
+	BurstMultiple             float64  `json:"burstmultiple" yaml:"BurstMultiple,omitempty"`
+	BurstDetectionDelay       uint     `json:"burstdetectiondelay" yaml:"BurstDetectionDelay,omitempty"`
+	FieldList                 []string `json:"fieldlist" yaml:"FieldList,omitempty" validate:"required"`
+	MaxKeys                   int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
+	DropHighCardinalityFields bool     `json:"drophighcardinalityfields" yaml:"DropHighCardinalityFields,omitempty"`
+	UseTraceLength            bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
 }
 
 func (d *EMADynamicSamplerConfig) GetSamplingFields() []string {
-	return d.FieldList
+	return withSourceFields(d.FieldList)
 }
 
 var _ GetSamplingFielder = (*EMAThroughputSamplerConfig)(nil)
 
 type EMAThroughputSamplerConfig struct {
-	GoalThroughputPerSec int      `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty"`
-	UseClusterSize       bool     `json:"useclustersize" yaml:"UseClusterSize,omitempty"`
-	InitialSampleRate    int      `json:"initialsamplerate" yaml:"InitialSampleRate,omitempty"`
-	AdjustmentInterval   Duration `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
-	Weight               float64  `json:"weight" yaml:"Weight,omitempty"`
-	AgeOutValue          float64  `json:"ageoutvalue" yaml:"AgeOutValue,omitempty"`
-	BurstMultiple        float64  `json:"burstmultiple" yaml:"BurstMultiple,omitempty"`
-	BurstDetectionDelay  uint     `json:"burstdetectiondelay" yaml:"BurstDetectionDelay,omitempty"`
-	FieldList            []string `json:"fieldlist" yaml:"FieldList,omitempty"`
-	MaxKeys              int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
-	UseTraceLength       bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
+	GoalThroughputPerSec      int      `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty"`
+	UseClusterSize            bool     `json:"useclustersize" yaml:"UseClusterSize,omitempty"`
+	InitialSampleRate         int      `json:"initialsamplerate" yaml:"InitialSampleRate,omitempty"`
+	AdjustmentInterval        Duration `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
+	Weight                    float64  `json:"weight" yaml:"Weight,omitempty"`
+	AgeOutValue               float64  `json:"ageoutvalue" yaml:"AgeOutValue,omitempty"`
+	BurstMultiple             float64  `json:"burstmultiple" yaml:"BurstMultiple,omitempty"`
+	BurstDetectionDelay       uint     `json:"burstdetectiondelay" yaml:"BurstDetectionDelay,omitempty"`
+	FieldList                 []string `json:"fieldlist" yaml:"FieldList,omitempty"`
+	MaxKeys                   int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
+	DropHighCardinalityFields bool     `json:"drophighcardinalityfields" yaml:"DropHighCardinalityFields,omitempty"`
+	UseTraceLength            bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
 }
 
 func (d *EMAThroughputSamplerConfig) GetSamplingFields() []string {
-	return d.FieldList
+	return withSourceFields(d.FieldList)
 }
 
 var _ GetSamplingFielder = (*WindowedThroughputSamplerConfig)(nil)
 
 type WindowedThroughputSamplerConfig struct {
-	UpdateFrequency      Duration `json:"updatefrequency" yaml:"UpdateFrequency,omitempty"`
-	LookbackFrequency    Duration `json:"lookbackfrequency" yaml:"LookbackFrequency,omitempty"`
-	GoalThroughputPerSec int      `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty"`
-	UseClusterSize       bool     `json:"useclustersize" yaml:"UseClusterSize,omitempty"`
-	FieldList            []string `json:"fieldlist" yaml:"FieldList,omitempty"`
-	MaxKeys              int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
-	UseTraceLength       bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
+	UpdateFrequency           Duration `json:"updatefrequency" yaml:"UpdateFrequency,omitempty"`
+	LookbackFrequency         Duration `json:"lookbackfrequency" yaml:"LookbackFrequency,omitempty"`
+	GoalThroughputPerSec      int      `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty"`
+	UseClusterSize            bool     `json:"useclustersize" yaml:"UseClusterSize,omitempty"`
+	FieldList                 []string `json:"fieldlist" yaml:"FieldList,omitempty"`
+	MaxKeys                   int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
+	DropHighCardinalityFields bool     `json:"drophighcardinalityfields" yaml:"DropHighCardinalityFields,omitempty"`
+	UseTraceLength            bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
 }
 
 func (d *WindowedThroughputSamplerConfig) GetSamplingFields() []string {
-	return d.FieldList
+	return withSourceFields(d.FieldList)
 }
 
-var _ GetSamplingFielder = (*TotalThroughputSamplerConfig)(nil)
+var _ GetSamplingFielder = (*ClusterThroughputSamplerConfig)(nil)
 
-type TotalThroughputSamplerConfig struct {
+// ClusterThroughputSamplerConfig configures a sampler whose throughput goal
+// is for the whole cluster, however many nodes it has.
+type ClusterThroughputSamplerConfig struct {
 	GoalThroughputPerSec int      `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty" validate:"gte=1"`
-	UseClusterSize       bool     `json:"useclustersize" yaml:"UseClusterSize,omitempty"`
-	ClearFrequency       Duration `json:"clearfrequency" yaml:"ClearFrequency,omitempty"`
+	AdjustmentInterval   Duration `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
 	FieldList            []string `json:"fieldlist" yaml:"FieldList,omitempty" validate:"required"`
-	MaxKeys              int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
 	UseTraceLength       bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
 }
 
+func (d *ClusterThroughputSamplerConfig) GetSamplingFields() []string {
+	return withSourceFields(d.FieldList)
+}
+
+var _ GetSamplingFielder = (*BudgetSamplerConfig)(nil)
+
+// BudgetSamplerConfig configures a sampler that divides a throughput goal
+// between the values of a key field, within a minimum and maximum for each.
+type BudgetSamplerConfig struct {
+	GoalThroughputPerSec int                  `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty" validate:"gte=1"`
+	AdjustmentInterval   Duration             `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
+	KeyField             string               `json:"keyfield" yaml:"KeyField,omitempty" validate:"required"`
+	Budgets              map[string]KeyBudget `json:"budgets" yaml:"Budgets,omitempty"`
+}
+
+// KeyBudget is the range of events per second a key may be sent. A
+// MaxPerSec of 0 means no maximum.
+type KeyBudget struct {
+	MinPerSec int `json:"minpersec" yaml:"MinPerSec,omitempty"`
+	MaxPerSec int `json:"maxpersec" yaml:"MaxPerSec,omitempty"`
+}
+
+func (d *BudgetSamplerConfig) GetSamplingFields() []string {
+	return []string{d.KeyField}
+}
+
+var _ GetSamplingFielder = (*LatencySamplerConfig)(nil)
+
+// LatencySamplerConfig configures a sampler that keeps more of the slowest
+// traces for each key.
+type LatencySamplerConfig struct {
+	Tiers              []LatencyTier `json:"tiers" yaml:"Tiers,omitempty" validate:"required"`
+	BaseSampleRate     int           `json:"basesamplerate" yaml:"BaseSampleRate,omitempty" default:"100"`
+	AdjustmentInterval Duration      `json:"adjustmentinterval" yaml:"AdjustmentInterval,omitempty"`
+	MinTraces          int           `json:"mintraces" yaml:"MinTraces,omitempty"`
+	MaxKeys            int           `json:"maxkeys" yaml:"MaxKeys,omitempty"`
+	FieldList          []string      `json:"fieldlist" yaml:"FieldList,omitempty"`
+}
+
+// LatencyTier is the sample rate of traces at least as slow as a percentile
+// of their key's recent durations.
+type LatencyTier struct {
+	AbovePercentile float64 `json:"abovepercentile" yaml:"AbovePercentile"`
+	SampleRate      int     `json:"samplerate" yaml:"SampleRate"`
+}
+
+func (d *LatencySamplerConfig) GetSamplingFields() []string {
+	return withSourceFields(append(append([]string{}, d.FieldList...), DURATION_MS.SourceFields()...))
+}
+
+var _ GetSamplingFielder = (*CompositeSamplerConfig)(nil)
+
+// CompositeSamplerConfig configures a sampler that tries each of its steps
+// in order until one decides what to do with the trace.
+type CompositeSamplerConfig struct {
+	Steps []*CompositeSamplerStep `json:"steps" yaml:"Steps,omitempty" validate:"required"`
+}
+
+// CompositeSamplerStep is one step of a CompositeSampler. It passes the
+// trace on to the next step if its conditions don't all match the trace,
+// or if its sampler is a rules-based sampler and none of its rules match.
+type CompositeSamplerStep struct {
+	Name       string                        `json:"name" yaml:"Name,omitempty"`
+	Conditions []*RulesBasedSamplerCondition `json:"conditions" yaml:"Conditions,omitempty"`
+	Sampler    *CompositeStepSampler         `json:"sampler" yaml:"Sampler,omitempty" validate:"required"`
+}
+
+// StepName returns the step's name, or its position if it has none.
+func (s *CompositeSamplerStep) StepName(index int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// CompositeStepSampler is the sampler of a composite step: a rules-based
+// sampler, or any of the samplers that a rule can use.
+type CompositeStepSampler struct {
+	RulesBasedSampler           *RulesBasedSamplerConfig `json:"rulesbasedsampler" yaml:"RulesBasedSampler,omitempty"`
+	RulesBasedDownstreamSampler `yaml:",inline"`
+}
+
+func (d *CompositeSamplerConfig) GetSamplingFields() []string {
+	fields := make(generics.Set[string], 0)
+	for _, step := range d.Steps {
+		for _, condition := range step.Conditions {
+			fields.Add(condition.Fields...)
+			if condition.Field != "" {
+				fields.Add(condition.Field)
+			}
+			fields.Add(scopedSourceFields(append([]string{condition.Field}, condition.Fields...))...)
+			if f, ok := condition.GetComputedField(); ok {
+				fields.Add(f.SourceFields()...)
+			}
+		}
+		if step.Sampler == nil {
+			continue
+		}
+		if step.Sampler.RulesBasedSampler != nil {
+			fields.Add(step.Sampler.RulesBasedSampler.GetSamplingFields()...)
+		}
+		fields.Add(step.Sampler.RulesBasedDownstreamSampler.GetSamplingFields()...)
+	}
+	return fields.Members()
+}
+
+var _ GetSamplingFielder = (*TotalThroughputSamplerConfig)(nil)
+
+type TotalThroughputSamplerConfig struct {
+	GoalThroughputPerSec      int      `json:"goalthroughputpersec" yaml:"GoalThroughputPerSec,omitempty" validate:"gte=1"`
+	UseClusterSize            bool     `json:"useclustersize" yaml:"UseClusterSize,omitempty"`
+	ClearFrequency            Duration `json:"clearfrequency" yaml:"ClearFrequency,omitempty"`
+	FieldList                 []string `json:"fieldlist" yaml:"FieldList,omitempty" validate:"required"`
+	MaxKeys                   int      `json:"maxkeys" yaml:"MaxKeys,omitempty"`
+	DropHighCardinalityFields bool     `json:"drophighcardinalityfields" yaml:"DropHighCardinalityFields,omitempty"`
+	UseTraceLength            bool     `json:"usetracelength" yaml:"UseTraceLength,omitempty"`
+}
+
 func (d *TotalThroughputSamplerConfig) GetSamplingFields() []string {
-	return d.FieldList
+	return withSourceFields(d.FieldList)
 }
 
 var _ GetSamplingFielder = (*RulesBasedSamplerConfig)(nil)
@@ -257,6 +800,7 @@ type RulesBasedSamplerConfig struct {
 	// Rules has deliberately different names for json and yaml for conversion from old to new format
 	Rules             []*RulesBasedSamplerRule `json:"rule" yaml:"Rules,omitempty"`
 	CheckNestedFields bool                     `json:"checknestedfields" yaml:"CheckNestedFields,omitempty"`
+	WeightedChoice    bool                     `json:"weightedchoice" yaml:"WeightedChoice,omitempty"`
 }
 
 func (r *RulesBasedSamplerConfig) GetSamplingFields() []string {
@@ -273,6 +817,10 @@ func (r *RulesBasedSamplerConfig) GetSamplingFields() []string {
 			if condition.Field != "" {
 				fields.Add(condition.Field)
 			}
+			fields.Add(scopedSourceFields(append([]string{condition.Field}, condition.Fields...))...)
+			if f, ok := condition.GetComputedField(); ok {
+				fields.Add(f.SourceFields()...)
+			}
 		}
 
 		if rule.Sampler != nil {
@@ -292,6 +840,7 @@ type RulesBasedDownstreamSampler struct {
 	WindowedThroughputSampler *WindowedThroughputSamplerConfig `json:"windowedthroughputsampler" yaml:"WindowedThroughputSampler,omitempty"`
 	TotalThroughputSampler    *TotalThroughputSamplerConfig    `json:"totalthroughputsampler" yaml:"TotalThroughputSampler,omitempty"`
 	DeterministicSampler      *DeterministicSamplerConfig      `json:"deterministicsampler" yaml:"DeterministicSampler,omitempty"`
+	LatencySampler            *LatencySamplerConfig            `json:"latencysampler" yaml:"LatencySampler,omitempty"`
 }
 
 func (r *RulesBasedDownstreamSampler) GetSamplingFields() []string {
@@ -321,6 +870,10 @@ func (r *RulesBasedDownstreamSampler) GetSamplingFields() []string {
 		fields.Add(r.TotalThroughputSampler.GetSamplingFields()...)
 	}
 
+	if r.LatencySampler != nil {
+		fields.Add(r.LatencySampler.GetSamplingFields()...)
+	}
+
 	return fields.Members()
 }
 
@@ -332,6 +885,12 @@ type RulesBasedSamplerRule struct {
 	Scope      string                        `json:"scope" yaml:"Scope,omitempty" validate:"oneof=span trace"`
 	Conditions []*RulesBasedSamplerCondition `json:"condition" yaml:"Conditions,omitempty"`
 	Sampler    *RulesBasedDownstreamSampler  `json:"sampler" yaml:"Sampler,omitempty"`
+	// DryRun rules don't decide; what they would have decided is recorded
+	// on the trace and the following rules are checked as usual.
+	DryRun bool `json:"dryrun" yaml:"DryRun,omitempty"`
+	// Weight is the relative chance of a rule being chosen from the matching
+	// rules when the sampler makes a WeightedChoice.
+	Weight int `json:"weight" yaml:"Weight,omitempty"`
 }
 
 func (r *RulesBasedSamplerRule) String() string {
@@ -339,12 +898,16 @@ func (r *RulesBasedSamplerRule) String() string {
 }
 
 type RulesBasedSamplerCondition struct {
-	Field    string                            `json:"field" yaml:"Field"`
-	Fields   []string                          `json:"fields" yaml:"Fields,omitempty"`
-	Operator string                            `json:"operator" yaml:"Operator" validate:"required"`
-	Value    any                               `json:"value" yaml:"Value" `
-	Datatype string                            `json:"datatype" yaml:"Datatype,omitempty"`
-	Matches  func(value any, exists bool) bool `json:"-" yaml:"-"`
+	Field    string   `json:"field" yaml:"Field"`
+	Fields   []string `json:"fields" yaml:"Fields,omitempty"`
+	Operator string   `json:"operator" yaml:"Operator" validate:"required"`
+	Value    any      `json:"value" yaml:"Value" `
+	Datatype string   `json:"datatype" yaml:"Datatype,omitempty"`
+	// ValuesFrom names a list of values for the in and not-in operators
+	// that is loaded from outside the rules, as "file:<path>" or
+	// "redis:<set key>".
+	ValuesFrom string                            `json:"valuesfrom" yaml:"ValuesFrom,omitempty"`
+	Matches    func(value any, exists bool) bool `json:"-" yaml:"-"`
 }
 
 func (r *RulesBasedSamplerCondition) Init() error {
@@ -374,6 +937,17 @@ func (r *RulesBasedSamplerCondition) GetComputedField() (ComputedField, bool) {
 }
 
 func (r *RulesBasedSamplerCondition) setMatchesFunction() error {
+	operator, ignoreCase := strings.CutSuffix(r.Operator, IgnoreCaseSuffix)
+	if ignoreCase {
+		switch operator {
+		case StartsWith, Contains, DoesNotContain:
+			return setMatchStringBasedOperators(r, operator, true)
+		case MatchesRegexp, NotMatches:
+			return setRegexStringMatchOperator(r, operator, true)
+		default:
+			return fmt.Errorf("unknown operator '%s'", r.Operator)
+		}
+	}
 	switch r.Operator {
 	case Exists:
 		r.Matches = func(value any, exists bool) bool {
@@ -388,15 +962,21 @@ func (r *RulesBasedSamplerCondition) setMatchesFunction() error {
 	case NEQ, EQ, GT, LT, LTE, GTE:
 		return setCompareOperators(r, r.Operator)
 	case StartsWith, Contains, DoesNotContain:
-		err := setMatchStringBasedOperators(r, r.Operator)
+		err := setMatchStringBasedOperators(r, r.Operator, false)
 		if err != nil {
 			return err
 		}
-	case MatchesRegexp:
-		err := setRegexStringMatchOperator(r)
+	case MatchesRegexp, NotMatches:
+		err := setRegexStringMatchOperator(r, r.Operator, false)
 		if err != nil {
 			return err
 		}
+	case InCIDR, NotInCIDR:
+		return setCIDROperator(r, r.Operator)
+	case In, NotIn:
+		return setInListOperator(r, r.Operator)
+	case Between:
+		return setBetweenOperator(r)
 	case HasRootSpan:
 		// this is evaluated at the trace level, so we don't need to do anything here
 		return nil
@@ -668,16 +1248,25 @@ func setCompareOperators(r *RulesBasedSamplerCondition, condition string) error
 	return nil
 }
 
-func setMatchStringBasedOperators(r *RulesBasedSamplerCondition, condition string) error {
+func setMatchStringBasedOperators(r *RulesBasedSamplerCondition, condition string, ignoreCase bool) error {
 	conditionValue, ok := tryConvertToString(r.Value)
 	if !ok {
 		return fmt.Errorf("%s value must be a string, but was '%s'", condition, r.Value)
 	}
+	// for case-insensitive comparisons, both sides are lowercased
+	convert := tryConvertToString
+	if ignoreCase {
+		conditionValue = strings.ToLower(conditionValue)
+		convert = func(v any) (string, bool) {
+			s, ok := tryConvertToString(v)
+			return strings.ToLower(s), ok
+		}
+	}
 
 	switch condition {
 	case StartsWith:
 		r.Matches = func(spanValue any, exists bool) bool {
-			s, ok := tryConvertToString(spanValue)
+			s, ok := convert(spanValue)
 			if ok {
 				return strings.HasPrefix(s, conditionValue)
 			}
@@ -685,7 +1274,7 @@ func setMatchStringBasedOperators(r *RulesBasedSamplerCondition, condition strin
 		}
 	case Contains:
 		r.Matches = func(spanValue any, exists bool) bool {
-			s, ok := tryConvertToString(spanValue)
+			s, ok := convert(spanValue)
 			if ok {
 				return strings.Contains(s, conditionValue)
 			}
@@ -693,7 +1282,7 @@ func setMatchStringBasedOperators(r *RulesBasedSamplerCondition, condition strin
 		}
 	case DoesNotContain:
 		r.Matches = func(spanValue any, exists bool) bool {
-			s, ok := tryConvertToString(spanValue)
+			s, ok := convert(spanValue)
 			if ok {
 				return !strings.Contains(s, conditionValue)
 			}
@@ -704,21 +1293,47 @@ func setMatchStringBasedOperators(r *RulesBasedSamplerCondition, condition strin
 	return nil
 }
 
-func setRegexStringMatchOperator(r *RulesBasedSamplerCondition) error {
+// regexps holds every pattern compiled for a rule condition, so that
+// reloading the rules doesn't compile them again.
+var regexps = struct {
+	mut      sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexps.mut.Lock()
+	defer regexps.mut.Unlock()
+	if regex, ok := regexps.compiled[pattern]; ok {
+		return regex, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexps.compiled[pattern] = regex
+	return regex, nil
+}
+
+func setRegexStringMatchOperator(r *RulesBasedSamplerCondition, condition string, ignoreCase bool) error {
 	conditionValue, ok := tryConvertToString(r.Value)
 	if !ok {
 		return fmt.Errorf("regex value must be a string, but was '%s'", r.Value)
 	}
 
-	regex, err := regexp.Compile(conditionValue)
+	pattern := conditionValue
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	regex, err := compileRegexp(pattern)
 	if err != nil {
-		return fmt.Errorf("'matches' pattern must be a valid Go regexp, but was '%s'", r.Value)
+		return fmt.Errorf("'%s' pattern must be a valid Go regexp, but was '%s'", r.Operator, r.Value)
 	}
 
+	negate := condition == NotMatches
 	r.Matches = func(spanValue any, exists bool) bool {
 		s, ok := tryConvertToString(spanValue)
 		if ok {
-			return regex.MatchString(s)
+			return regex.MatchString(s) != negate
 		}
 		return false
 	}
@@ -726,6 +1341,144 @@ func setRegexStringMatchOperator(r *RulesBasedSamplerCondition) error {
 	return nil
 }
 
+// setCIDROperator matches fields holding an IP address against one or more
+// comma-separated CIDR blocks, like "10.0.0.0/8,192.168.0.0/16". Fields
+// that aren't IP addresses match neither in-cidr nor not-in-cidr.
+func setCIDROperator(r *RulesBasedSamplerCondition, condition string) error {
+	conditionValue, ok := tryConvertToString(r.Value)
+	if !ok {
+		return fmt.Errorf("%s value must be a string, but was '%s'", condition, r.Value)
+	}
+
+	var prefixes []netip.Prefix
+	for _, block := range strings.Split(conditionValue, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(block))
+		if err != nil {
+			return fmt.Errorf("'%s' value must be a list of CIDR blocks, but was '%s'", condition, r.Value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	negate := condition == NotInCIDR
+	r.Matches = func(spanValue any, exists bool) bool {
+		if !exists {
+			return false
+		}
+		s, _ := tryConvertToString(spanValue)
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return false
+		}
+		// IPv4 addresses written as IPv6 are compared as IPv4
+		addr = addr.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return !negate
+			}
+		}
+		return negate
+	}
+
+	return nil
+}
+
+// setInListOperator matches fields whose value, as a string, is one of the
+// condition's values. The values can be listed in Value, loaded from
+// ValuesFrom, or both.
+func setInListOperator(r *RulesBasedSamplerCondition, condition string) error {
+	datatype := r.Datatype
+	inline := make(map[string]struct{})
+	addInline := func(v any) error {
+		key, ok := inListKey(v, datatype)
+		if !ok {
+			return fmt.Errorf("'%s' value '%v' is not a valid %s", condition, v, datatype)
+		}
+		inline[key] = struct{}{}
+		return nil
+	}
+	switch value := r.Value.(type) {
+	case nil:
+	case []any:
+		for _, v := range value {
+			if err := addInline(v); err != nil {
+				return err
+			}
+		}
+	case []string:
+		for _, v := range value {
+			if err := addInline(v); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := addInline(value); err != nil {
+			return err
+		}
+	}
+
+	var external *ValueList
+	if r.ValuesFrom != "" {
+		var err error
+		external, err = GetValueList(r.ValuesFrom)
+		if err != nil {
+			return fmt.Errorf("'%s' ValuesFrom is invalid: %w", condition, err)
+		}
+	} else if len(inline) == 0 {
+		return fmt.Errorf("'%s' needs a list of values in Value or ValuesFrom", condition)
+	}
+
+	negate := condition == NotIn
+	r.Matches = func(spanValue any, exists bool) bool {
+		if !exists {
+			return false
+		}
+		key, ok := inListKey(spanValue, datatype)
+		if !ok {
+			return false
+		}
+		if _, found := inline[key]; found {
+			return !negate
+		}
+		if external == nil {
+			return negate
+		}
+		// until the list is loaded, nothing is known to be in or out of it
+		if !external.Loaded() {
+			return false
+		}
+		return external.Contains(key, datatype) != negate
+	}
+
+	return nil
+}
+
+// setBetweenOperator matches numeric fields within an inclusive range, given
+// as a list of two numbers in Value.
+func setBetweenOperator(r *RulesBasedSamplerCondition) error {
+	bounds, ok := r.Value.([]any)
+	if !ok || len(bounds) != 2 {
+		return fmt.Errorf("'between' value must be a list of two numbers, but was '%v'", r.Value)
+	}
+	low, lowOK := tryConvertToFloat(bounds[0])
+	high, highOK := tryConvertToFloat(bounds[1])
+	if !lowOK || !highOK {
+		return fmt.Errorf("'between' value must be a list of two numbers, but was '%v'", r.Value)
+	}
+	if low > high {
+		return fmt.Errorf("'between' range must be in increasing order, but was '%v'", r.Value)
+	}
+
+	r.Matches = func(spanValue any, exists bool) bool {
+		if !exists {
+			return false
+		}
+		n, ok := tryConvertToFloat(spanValue)
+		return ok && n >= low && n <= high
+	}
+
+	return nil
+}
+
 func (r *RulesBasedSamplerConfig) String() string {
 	return fmt.Sprintf("%+v", *r)
 }
@@ -1,6 +1,11 @@
 package config
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func Test_setCompareOperators(t *testing.T) {
 	tests := []struct {
@@ -97,3 +102,287 @@ func Test_setCompareOperators(t *testing.T) {
 		})
 	}
 }
+
+func Test_setMatchesFunction(t *testing.T) {
+	tests := []struct {
+		name       string
+		testvalue  any
+		exists     bool
+		condition  string
+		value      any
+		wantResult bool
+		wantErr    bool
+	}{
+		{"matches", "GET /health", true, MatchesRegexp, "^GET /health", true, false},
+		{"matches2", "get /health", true, MatchesRegexp, "^GET /health", false, false},
+		{"matchesIC", "get /health", true, MatchesRegexp + IgnoreCaseSuffix, "^GET /health", true, false},
+		{"notMatches", "GET /health", true, NotMatches, "^GET /health", false, false},
+		{"notMatches2", "GET /users", true, NotMatches, "^GET /health", true, false},
+		{"notMatchesIC", "get /health", true, NotMatches + IgnoreCaseSuffix, "^GET /health", false, false},
+		{"badRegexp", "foo", true, NotMatches, "(", false, true},
+		{"containsIC", "Kube-Probe/1.27", true, Contains + IgnoreCaseSuffix, "kube-probe", true, false},
+		{"contains", "Kube-Probe/1.27", true, Contains, "kube-probe", false, false},
+		{"startsWithIC", "HealthCheck", true, StartsWith + IgnoreCaseSuffix, "health", true, false},
+		{"doesNotContainIC", "HealthCheck", true, DoesNotContain + IgnoreCaseSuffix, "CHECK", false, false},
+		{"badIC", "1", true, EQ + IgnoreCaseSuffix, "1", false, true},
+		{"inCIDR", "10.1.2.3", true, InCIDR, "10.0.0.0/8", true, false},
+		{"inCIDR2", "11.1.2.3", true, InCIDR, "10.0.0.0/8", false, false},
+		{"inCIDRList", "192.168.1.1", true, InCIDR, "10.0.0.0/8, 192.168.0.0/16", true, false},
+		{"inCIDRv6", "fd00::1", true, InCIDR, "fd00::/8", true, false},
+		{"inCIDRMapped", "::ffff:10.1.2.3", true, InCIDR, "10.0.0.0/8", true, false},
+		{"inCIDRNotIP", "localhost", true, InCIDR, "10.0.0.0/8", false, false},
+		{"inCIDRMissing", nil, false, InCIDR, "10.0.0.0/8", false, false},
+		{"notInCIDR", "11.1.2.3", true, NotInCIDR, "10.0.0.0/8", true, false},
+		{"notInCIDR2", "10.1.2.3", true, NotInCIDR, "10.0.0.0/8", false, false},
+		{"notInCIDRNotIP", "localhost", true, NotInCIDR, "10.0.0.0/8", false, false},
+		{"badCIDR", "10.1.2.3", true, InCIDR, "10.0.0.0", false, true},
+		{"in", "cust-2", true, In, []any{"cust-1", "cust-2"}, true, false},
+		{"in2", "cust-3", true, In, []any{"cust-1", "cust-2"}, false, false},
+		{"inNumber", int64(200), true, In, []any{200, 201}, true, false},
+		{"inOne", "cust-1", true, In, "cust-1", true, false},
+		{"inMissing", nil, false, In, []any{"cust-1"}, false, false},
+		{"inEmpty", "cust-1", true, In, nil, false, true},
+		{"notIn", "cust-3", true, NotIn, []any{"cust-1", "cust-2"}, true, false},
+		{"notIn2", "cust-1", true, NotIn, []any{"cust-1", "cust-2"}, false, false},
+		{"notInMissing", nil, false, NotIn, []any{"cust-1"}, false, false},
+		{"between", int64(250), true, Between, []any{200, 299}, true, false},
+		{"betweenLow", 200.0, true, Between, []any{200, 299}, true, false},
+		{"betweenHigh", "299", true, Between, []any{200, 299}, true, false},
+		{"betweenOut", int64(300), true, Between, []any{200, 299}, false, false},
+		{"betweenNotNumber", "abc", true, Between, []any{200, 299}, false, false},
+		{"betweenMissing", nil, false, Between, []any{200, 299}, false, false},
+		{"betweenBackwards", 250, true, Between, []any{299, 200}, false, true},
+		{"betweenOneBound", 250, true, Between, []any{200}, false, true},
+		{"betweenScalar", 250, true, Between, 200, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rbsc := &RulesBasedSamplerCondition{
+				Operator: tt.condition,
+				Value:    tt.value,
+			}
+			err := rbsc.setMatchesFunction()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("setMatchesFunction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				result := rbsc.Matches(tt.testvalue, tt.exists)
+				if result != tt.wantResult {
+					t.Errorf("setMatchesFunction() result = %v, wantResult %v", result, tt.wantResult)
+				}
+			}
+		})
+	}
+}
+
+func Test_compileRegexpCaches(t *testing.T) {
+	first, err := compileRegexp("^cached$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := compileRegexp("^cached$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("compileRegexp() compiled the same pattern twice")
+	}
+}
+
+func TestValuesFrom(t *testing.T) {
+	// start from rules that name no lists
+	applyValueLists(nil)
+	t.Cleanup(func() { applyValueLists(nil) })
+
+	cond := &RulesBasedSamplerCondition{
+		Field:      "customer.id",
+		Operator:   In,
+		Value:      []any{"inline"},
+		ValuesFrom: "file:/tmp/test-values-from.txt",
+	}
+	require.NoError(t, cond.Init())
+	notIn := &RulesBasedSamplerCondition{
+		Field:      "customer.id",
+		Operator:   NotIn,
+		ValuesFrom: "file:/tmp/test-values-from.txt",
+	}
+	require.NoError(t, notIn.Init())
+
+	// until the list is loaded, only the inline values are known, and
+	// nothing else is in or out of it
+	assert.True(t, cond.Matches("inline", true))
+	assert.False(t, cond.Matches("beta-1", true))
+	assert.False(t, notIn.Matches("beta-1", true))
+
+	list, err := GetValueList("file:/tmp/test-values-from.txt")
+	require.NoError(t, err)
+	assert.Contains(t, ValueLists(), list)
+	list.Set([]string{"beta-1", "beta-2"})
+	assert.Equal(t, 2, list.Len())
+	assert.True(t, cond.Matches("beta-1", true))
+	assert.True(t, cond.Matches("inline", true))
+	assert.False(t, cond.Matches("beta-3", true))
+	assert.False(t, notIn.Matches("beta-1", true))
+	assert.True(t, notIn.Matches("beta-3", true))
+
+	// conditions built when the rules are reloaded share the loaded values
+	reloaded := &RulesBasedSamplerCondition{
+		Field:      "customer.id",
+		Operator:   In,
+		ValuesFrom: "file:/tmp/test-values-from.txt",
+	}
+	require.NoError(t, reloaded.Init())
+	assert.True(t, reloaded.Matches("beta-2", true))
+
+	// rules that no longer name the list forget it
+	applyValueLists(map[string][]string{"redis:other": nil})
+	assert.Len(t, ValueLists(), 1)
+	assert.Equal(t, "redis:other", ValueLists()[0].Source)
+
+	for _, bad := range []string{"beta.txt", "file:", "http://example.com/beta.txt"} {
+		_, err := GetValueList(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestValuesFromDatatype(t *testing.T) {
+	applyValueLists(nil)
+	t.Cleanup(func() { applyValueLists(nil) })
+	list, err := GetValueList("redis:codes")
+	require.NoError(t, err)
+	list.Set([]string{"500", "1000000", "2.50", "true"})
+
+	for _, tc := range []struct {
+		datatype string
+		value    any
+		want     bool
+	}{
+		// without a datatype, numbers aren't written with exponents
+		{"", float64(1_000_000), true},
+		{"", 500, true},
+		{"", "2.5", false},
+		{"int", "500", true},
+		{"int", float64(500), true},
+		{"float", 2.5, true},
+		{"float", "2.5", true},
+		{"string", "2.50", true},
+		{"string", 2.5, false},
+		{"bool", true, true},
+		{"bool", "TRUE", true},
+		{"bool", false, false},
+	} {
+		cond := &RulesBasedSamplerCondition{Field: "code", Operator: In, Datatype: tc.datatype, ValuesFrom: "redis:codes"}
+		require.NoError(t, cond.Init())
+		assert.Equal(t, tc.want, cond.Matches(tc.value, true), "%s %v", tc.datatype, tc.value)
+	}
+
+	// inline values follow the datatype too
+	cond := &RulesBasedSamplerCondition{Field: "code", Operator: In, Datatype: "int", Value: []any{"404", 503}}
+	require.NoError(t, cond.Init())
+	assert.True(t, cond.Matches(float64(404), true))
+	assert.True(t, cond.Matches("503", true))
+
+	bad := &RulesBasedSamplerCondition{Field: "code", Operator: In, Datatype: "int", Value: []any{"not a number"}}
+	assert.Error(t, bad.Init())
+}
+
+func TestScopedAttributes(t *testing.T) {
+	for field, want := range map[string][]string{
+		"resource.service.name": {ResourceScope, "service.name"},
+		"scope.name":            {ScopeScope, "name"},
+		"span.http.route":       {SpanScope, "http.route"},
+	} {
+		scope, name, ok := ParseScopedField(field)
+		assert.True(t, ok, field)
+		assert.Equal(t, want, []string{scope, name}, field)
+	}
+	for _, field := range []string{"service.name", "span", "span.", "root.span.kind"} {
+		_, _, ok := ParseScopedField(field)
+		assert.False(t, ok, field)
+	}
+
+	rules := &V2SamplerConfig{
+		Samplers: map[string]*V2SamplerChoice{
+			"__default__": {DeterministicSampler: &DeterministicSamplerConfig{SampleRate: 1}},
+			"ds": {RulesBasedSampler: &RulesBasedSamplerConfig{
+				Rules: []*RulesBasedSamplerRule{{
+					Conditions: []*RulesBasedSamplerCondition{
+						{Field: "root.resource.service.name", Operator: EQ, Value: "api"},
+						{Fields: []string{"span.http.route", "http.target"}, Operator: Exists},
+					},
+				}},
+			}},
+		},
+		Tenants: map[string]*TenantConfig{
+			"acme": {Samplers: map[string]*V2SamplerChoice{
+				"__default__": {RulesBasedSampler: &RulesBasedSamplerConfig{
+					Rules: []*RulesBasedSamplerRule{{
+						Conditions: []*RulesBasedSamplerCondition{
+							{Field: "scope.name", Operator: EQ, Value: "db"},
+							{Field: "resource.deployment.environment", Operator: Exists},
+						},
+					}},
+				}},
+			}},
+		},
+	}
+	assert.Equal(t, map[string][]string{
+		ResourceScope: {"deployment.environment", "service.name"},
+		ScopeScope:    {"name"},
+		SpanScope:     {"http.route"},
+	}, rules.ScopedAttributes())
+
+	fields := rules.Samplers["ds"].RulesBasedSampler.GetSamplingFields()
+	assert.Subset(t, fields, []string{
+		"root.resource.service.name", "meta.refinery.resource.service.name", "service.name",
+		"span.http.route", "meta.refinery.span.http.route", "http.route",
+		ScopedAttributesMarker,
+	})
+}
+
+func TestHasTarget(t *testing.T) {
+	rules := &V2SamplerConfig{
+		Samplers: map[string]*V2SamplerChoice{
+			"__default__": {DeterministicSampler: &DeterministicSamplerConfig{SampleRate: 1}},
+			"production":  {DeterministicSampler: &DeterministicSamplerConfig{SampleRate: 2}},
+		},
+		Tenants: map[string]*TenantConfig{
+			"acme": {Samplers: map[string]*V2SamplerChoice{
+				"staging": {DeterministicSampler: &DeterministicSamplerConfig{SampleRate: 3}},
+			}},
+		},
+	}
+	for selector, want := range map[string]bool{
+		"production":                           true,
+		"__default__":                          true,
+		"staging":                              false,
+		TenantSelector("acme", "staging"):      true,
+		TenantSelector("acme", "production"):   true,
+		TenantSelector("acme", "dev"):          false,
+		TenantSelector("globex", "production"): false,
+	} {
+		assert.Equal(t, want, rules.HasTarget(selector), selector)
+	}
+	assert.False(t, (*V2SamplerConfig)(nil).HasTarget("production"))
+}
+
+func TestStripScopedAttributes(t *testing.T) {
+	data := map[string]interface{}{
+		"service.name":                        "api",
+		"meta.refinery.resource.service.name": "api",
+		"meta.refinery.scope.name":            "db",
+		"meta.refinery.span.http.route":       "/cart",
+		ScopedAttributesMarker:                true,
+		"meta.refinery.reason":                "rules/trace/keep",
+	}
+	StripScopedAttributes(data)
+	assert.Equal(t, map[string]interface{}{
+		"service.name":         "api",
+		"meta.refinery.reason": "rules/trace/keep",
+	}, data)
+
+	// spans whose scoped attributes weren't recorded are left alone
+	data = map[string]interface{}{"meta.refinery.span.name": "user field"}
+	StripScopedAttributes(data)
+	assert.Equal(t, map[string]interface{}{"meta.refinery.span.name": "user field"}, data)
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"strings"
+)
+
+// jsonSchemaDialect is the version of JSON Schema that the schemas are
+// written in.
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// durationPattern matches the durations that time.ParseDuration accepts.
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`
+
+// ConfigSchema returns a JSON schema for config files. It's generated from
+// the same metadata that config files are validated against, so that editors
+// and CI tools can check a file without running Refinery.
+func ConfigSchema() (map[string]any, error) {
+	m, err := LoadConfigMetadata()
+	if err != nil {
+		return nil, err
+	}
+	properties := make(map[string]any, len(m.Groups))
+	for _, g := range m.Groups {
+		properties[g.Name] = m.groupSchema(g)
+	}
+	return map[string]any{
+		"$schema":              jsonSchemaDialect,
+		"title":                "Refinery config",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}, nil
+}
+
+// RulesSchema returns a JSON schema for rules files, generated from the rules
+// metadata. Each sampler, and each group that appears in a list within a
+// sampler, such as Rules and Conditions, is a definition in the schema.
+func RulesSchema() (map[string]any, error) {
+	m, err := LoadRulesMetadata()
+	if err != nil {
+		return nil, err
+	}
+	defs := make(map[string]any, len(m.Groups)+1)
+	samplers := make(map[string]any)
+	for _, g := range m.Groups {
+		if g.Name == "Samplers" {
+			continue
+		}
+		defs[g.Name] = m.groupSchema(g)
+		if strings.HasSuffix(g.Name, "Sampler") {
+			samplers[g.Name] = map[string]any{"$ref": "#/$defs/" + g.Name}
+		}
+	}
+	// a sampler is an object with exactly one key, the type of sampler
+	defs["sampler"] = map[string]any{
+		"type":                 "object",
+		"properties":           samplers,
+		"additionalProperties": false,
+		"minProperties":        1,
+		"maxProperties":        1,
+	}
+	samplerList := map[string]any{
+		"type":                 "object",
+		"additionalProperties": map[string]any{"$ref": "#/$defs/sampler"},
+	}
+	if g := m.GetGroup("Samplers"); g != nil {
+		samplerList["description"] = strings.TrimSpace(g.Description)
+	}
+
+	return map[string]any{
+		"$schema": jsonSchemaDialect,
+		"title":   "Refinery rules",
+		"type":    "object",
+		"properties": map[string]any{
+			"RulesVersion": map[string]any{"const": 2},
+			"Samplers":     withRequired(samplerList, "__default__"),
+			"Tenants": map[string]any{
+				"type": "object",
+				"additionalProperties": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"APIKeys":  map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+						"Teams":    map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+						"Samplers": samplerList,
+					},
+					"anyOf": []any{
+						map[string]any{"required": []string{"APIKeys"}},
+						map[string]any{"required": []string{"Teams"}},
+					},
+					"additionalProperties": false,
+				},
+			},
+		},
+		"required":             []string{"RulesVersion", "Samplers"},
+		"additionalProperties": false,
+		"$defs":                defs,
+	}, nil
+}
+
+// withRequired returns a copy of an object schema that requires the given
+// properties.
+func withRequired(schema map[string]any, required ...string) map[string]any {
+	result := make(map[string]any, len(schema)+1)
+	for k, v := range schema {
+		result[k] = v
+	}
+	result["required"] = required
+	return result
+}
+
+// groupSchema returns the schema for the object that holds a group's fields.
+func (m *Metadata) groupSchema(g Group) map[string]any {
+	properties := make(map[string]any, len(g.Fields))
+	var required []string
+	for _, f := range g.Fields {
+		properties[f.Name] = m.fieldSchema(f)
+		for _, v := range f.Validations {
+			if v.Type == "required" || v.Type == "requiredInGroup" {
+				required = append(required, f.Name)
+			}
+		}
+	}
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if g.Title != "" {
+		schema["title"] = g.Title
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fieldSchema returns the schema for a field's value.
+func (m *Metadata) fieldSchema(f Field) map[string]any {
+	schema := typeSchema(f.Type)
+	switch f.Type {
+	case "object":
+		// the keys of the object are the names of groups
+		children := make(map[string]any)
+		for _, v := range f.Validations {
+			if v.Type == "validChildren" {
+				for _, name := range v.GetArgAsStringSlice() {
+					children[name] = map[string]any{"$ref": "#/$defs/" + name}
+				}
+			}
+		}
+		schema["properties"] = children
+		schema["additionalProperties"] = false
+	case "objectarray":
+		// the items of the array are objects of the group with the field's name
+		schema["items"] = map[string]any{"$ref": "#/$defs/" + f.Name}
+	}
+
+	if f.Summary != "" {
+		schema["description"] = f.Name + " " + strings.TrimSpace(f.Summary)
+	}
+	if f.Default != nil {
+		schema["default"] = f.Default
+	}
+	if len(f.Choices) > 0 {
+		switch f.Type {
+		case "stringarray":
+			schema["items"] = map[string]any{"type": "string", "enum": f.Choices}
+		case "map":
+			schema["additionalProperties"] = map[string]any{"type": "string", "enum": f.Choices}
+		default:
+			schema["enum"] = f.Choices
+		}
+	}
+	for _, v := range f.Validations {
+		switch v.Type {
+		case "minimum", "maximum":
+			// durations and memory sizes can't be compared by a schema
+			if t := schema["type"]; t == "integer" || t == "number" {
+				if n, msg := asFloat(v.Arg); msg == "" {
+					schema[v.Type] = n
+				}
+			}
+		case "elementType":
+			item := typeSchema(v.Arg.(string))
+			if f.Type == "map" {
+				schema["additionalProperties"] = item
+			} else {
+				schema["items"] = item
+			}
+		case "notempty":
+			if schema["type"] == "string" {
+				schema["minLength"] = 1
+			}
+		}
+	}
+	return schema
+}
+
+// typeSchema returns the schema for one of the data types of the metadata.
+func typeSchema(typ string) map[string]any {
+	scalar := []string{"string", "integer", "number", "boolean"}
+	switch typ {
+	case "string", "hostport":
+		return map[string]any{"type": "string"}
+	case "url":
+		return map[string]any{"type": "string", "format": "uri"}
+	case "urlOrBlank":
+		return map[string]any{"anyOf": []any{
+			map[string]any{"type": "string", "format": "uri"},
+			map[string]any{"const": ""},
+		}}
+	case "int":
+		return map[string]any{"type": "integer"}
+	case "percentage":
+		return map[string]any{"type": "integer", "minimum": 0, "maximum": 100}
+	case "float":
+		return map[string]any{"type": "number"}
+	case "bool":
+		return map[string]any{"type": "boolean"}
+	case "defaulttrue":
+		return map[string]any{"anyOf": []any{
+			map[string]any{"type": "boolean"},
+			map[string]any{"type": "string", "pattern": "^([tT]([rR][uU][eE])?|[fF]([aA][lL][sS][eE])?)$"},
+		}}
+	case "duration":
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	case "memorysize":
+		return map[string]any{"type": []string{"string", "integer"}}
+	case "stringarray":
+		return map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+	case "floatarray":
+		return map[string]any{"type": "array", "items": map[string]any{"type": "number"}}
+	case "map", "object":
+		return map[string]any{"type": "object"}
+	case "objectarray":
+		return map[string]any{"type": "array"}
+	case "anyscalar":
+		return map[string]any{"type": scalar}
+	case "anyscalarorlist":
+		return map[string]any{"anyOf": []any{
+			map[string]any{"type": scalar},
+			map[string]any{"type": "array", "items": map[string]any{"type": scalar}},
+		}}
+	default:
+		return map[string]any{}
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectRefs returns every $ref in a schema.
+func collectRefs(v any) []string {
+	var refs []string
+	switch val := v.(type) {
+	case map[string]any:
+		for k, vv := range val {
+			if ref, ok := vv.(string); ok && k == "$ref" {
+				refs = append(refs, ref)
+				continue
+			}
+			refs = append(refs, collectRefs(vv)...)
+		}
+	case []any:
+		for _, vv := range val {
+			refs = append(refs, collectRefs(vv)...)
+		}
+	}
+	return refs
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema, err := ConfigSchema()
+	require.NoError(t, err)
+	metadata, err := LoadConfigMetadata()
+	require.NoError(t, err)
+
+	properties := schema["properties"].(map[string]any)
+	assert.Len(t, properties, len(metadata.Groups))
+	assert.Equal(t, false, schema["additionalProperties"])
+
+	general := properties["General"].(map[string]any)
+	assert.Equal(t, false, general["additionalProperties"])
+	reload := general["properties"].(map[string]any)["ConfigReloadInterval"].(map[string]any)
+	assert.Equal(t, "string", reload["type"])
+	assert.Equal(t, "15s", reload["default"])
+	assert.Empty(t, collectRefs(schema))
+}
+
+func TestRulesSchema(t *testing.T) {
+	schema, err := RulesSchema()
+	require.NoError(t, err)
+
+	defs := schema["$defs"].(map[string]any)
+	for _, ref := range collectRefs(schema) {
+		name := strings.TrimPrefix(ref, "#/$defs/")
+		assert.Contains(t, defs, name, "reference %s has no definition", ref)
+	}
+
+	samplers := defs["sampler"].(map[string]any)["properties"].(map[string]any)
+	assert.Contains(t, samplers, "DeterministicSampler")
+	assert.Contains(t, samplers, "RulesBasedSampler")
+	assert.NotContains(t, samplers, "Rules")
+
+	rules := defs["RulesBasedSampler"].(map[string]any)["properties"].(map[string]any)["Rules"].(map[string]any)
+	assert.Equal(t, "array", rules["type"])
+	assert.Equal(t, map[string]any{"$ref": "#/$defs/Rules"}, rules["items"])
+}
+
+func TestValidateDocuments(t *testing.T) {
+	rules := []byte(makeYAML("RulesVersion", 2, "Samplers.__default__.DeterministicSampler.SampleRate", 1))
+	report := ValidateDocuments(PublishedConfig{
+		Config:       []byte(makeYAML("General.ConfigurationVersion", 2, "Network.ListenAddr", "0.0.0.0:9000")),
+		ConfigFormat: FormatYAML,
+		Rules:        rules,
+		RulesFormat:  FormatYAML,
+	})
+	require.True(t, report.Valid, report.Error)
+	assert.Contains(t, report.EffectiveConfig, "ListenAddr: 0.0.0.0:9000")
+	// defaults are filled in
+	assert.Contains(t, report.EffectiveConfig, "ConfigReloadInterval: 15s")
+	assert.Contains(t, report.EffectiveRules, "SampleRate: 1")
+
+	report = ValidateDocuments(PublishedConfig{
+		Config:       []byte(makeYAML("General.ConfigurationVersion", 2, "General.Bogus", true, "Network.ListenAddr", 5)),
+		ConfigFormat: FormatYAML,
+		Rules:        []byte(makeYAML("RulesVersion", 2)),
+		RulesFormat:  FormatYAML,
+	})
+	assert.False(t, report.Valid)
+	assert.Equal(t, "validation failed", report.Error)
+	assert.Len(t, report.ConfigFailures, 2)
+	assert.Contains(t, report.RulesFailures, "Samplers is required")
+	assert.Empty(t, report.EffectiveConfig)
+}
@@ -76,6 +76,15 @@ func mustFloat(v any) float64 {
 	return f
 }
 
+// shownValue returns the value to show in an error message about the field at
+// path k, which is a placeholder for secrets.
+func shownValue(k string, v any) any {
+	if isSecretPath(k) {
+		return "(redacted)"
+	}
+	return v
+}
+
 func validateDatatype(k string, v any, typ string) string {
 	if v == nil {
 		return fmt.Sprintf("field %s must not be nil", k)
@@ -99,9 +108,20 @@ func validateDatatype(k string, v any, typ string) string {
 		default:
 			return fmt.Sprintf("field %s must be a string, int, float, or bool", k)
 		}
+	case "anyscalarorlist":
+		// a list of scalars is also allowed, for operators like in and between
+		if arr, ok := v.([]any); ok {
+			for i, a := range arr {
+				if e := validateDatatype(fmt.Sprintf("%s[%d]", k, i), a, "anyscalar"); e != "" {
+					return e
+				}
+			}
+			return ""
+		}
+		return validateDatatype(k, v, "anyscalar")
 	case "string":
 		if !isString(v) {
-			return fmt.Sprintf("field %s must be a string but %v is %T", k, v, v)
+			return fmt.Sprintf("field %s must be a string but %v is %T", k, shownValue(k, v), v)
 		}
 	case "int", "percentage":
 		i, ok := v.(int)
@@ -125,11 +145,21 @@ func validateDatatype(k string, v any, typ string) string {
 		if arr, ok := v.([]any); ok {
 			for _, a := range arr {
 				if !isString(a) {
-					return fmt.Sprintf("field %s must be a string array but contains non-string %#v", k, a)
+					return fmt.Sprintf("field %s must be a string array but contains non-string %#v", k, shownValue(k, a))
 				}
 			}
 		} else {
-			return fmt.Sprintf("field %s must be a string array but %v is %T", k, v, v)
+			return fmt.Sprintf("field %s must be a string array but %v is %T", k, shownValue(k, v), v)
+		}
+	case "floatarray":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Sprintf("field %s must be a float array but %v is %T", k, v, v)
+		}
+		for i, a := range arr {
+			if e := validateDatatype(fmt.Sprintf("%s[%d]", k, i), a, "float"); e != "" {
+				return e
+			}
 		}
 	case "map":
 		if _, ok := v.(map[string]any); !ok {
@@ -163,7 +193,14 @@ func validateDatatype(k string, v any, typ string) string {
 				return fmt.Sprintf("field %s (%v) must be a hostport: %v", k, v, err)
 			}
 		}
-	case "url":
+	case "cidr":
+		if !isString(v) {
+			return fmt.Sprintf("field %s must be a CIDR range", k)
+		}
+		if _, _, err := net.ParseCIDR(v.(string)); err != nil {
+			return fmt.Sprintf("field %s (%v) must be a CIDR range like '10.0.0.0/8': %v", k, v, err)
+		}
+	case "url", "urlOrBlank":
 		if !isString(v) {
 			return fmt.Sprintf("field %s must be a URL", k)
 		}
@@ -271,8 +308,23 @@ func (m *Metadata) Validate(data map[string]any) []string {
 		for _, validation := range field.Validations {
 			switch validation.Type {
 			case "choice":
-				if !(isString(v) && slices.Contains(field.Choices, v.(string))) {
-					errors = append(errors, fmt.Sprintf("field %s (%v) must be one of %v", k, v, field.Choices))
+				// every element of a list, or value of a map, must be one of
+				// the choices
+				var vals []any
+				switch vv := v.(type) {
+				case []any:
+					vals = vv
+				case map[string]any:
+					for _, mv := range vv {
+						vals = append(vals, mv)
+					}
+				default:
+					vals = []any{v}
+				}
+				for _, vv := range vals {
+					if !(isString(vv) && slices.Contains(field.Choices, vv.(string))) {
+						errors = append(errors, fmt.Sprintf("field %s (%v) must be one of %v", k, vv, field.Choices))
+					}
 				}
 			case "format":
 				var pat *regexp.Regexp
@@ -452,6 +504,8 @@ func (m *Metadata) ValidateRules(data map[string]any) []string {
 				}
 			}
 			hasSamplers = true
+		case "Tenants":
+			errors = append(errors, validateTenants(v)...)
 		default:
 			errors = append(errors, fmt.Sprintf("unknown top-level key %s", k))
 		}
@@ -476,6 +530,63 @@ func (m *Metadata) ValidateRules(data map[string]any) []string {
 			errors = append(errors, fmt.Sprintf("Within sampler %s: %s", k, e))
 		}
 	}
+	tenants, _ := data["Tenants"].(map[string]any)
+	for name, tenant := range tenants {
+		samplers, _ := tenant.(map[string]any)["Samplers"].(map[string]any)
+		for k, v := range samplers {
+			suberrors := m.Validate(v.(map[string]any))
+			for _, e := range suberrors {
+				errors = append(errors, fmt.Sprintf("Within tenant %s sampler %s: %s", name, k, e))
+			}
+		}
+	}
+
+	return errors
+}
 
+// validateTenants checks the shape of the Tenants section of a rules file;
+// the samplers within it are validated along with the top-level ones.
+func validateTenants(v any) []string {
+	errors := make([]string, 0)
+	tenants, ok := v.(map[string]any)
+	if !ok {
+		return append(errors, fmt.Sprintf("Tenants must be a collection of tenants, but %v is %T", v, v))
+	}
+	for name, tenant := range tenants {
+		if strings.Contains(name, "/") {
+			errors = append(errors, fmt.Sprintf("Tenant name %s must not contain '/'", name))
+		}
+		fields, ok := tenant.(map[string]any)
+		if !ok {
+			errors = append(errors, fmt.Sprintf("Tenant %s must be a map, but %v is %T", name, tenant, tenant))
+			continue
+		}
+		_, hasKeys := fields["APIKeys"]
+		_, hasTeams := fields["Teams"]
+		if !hasKeys && !hasTeams {
+			errors = append(errors, fmt.Sprintf("Tenant %s must have APIKeys or Teams", name))
+		}
+		for k, fv := range fields {
+			switch k {
+			case "APIKeys", "Teams":
+				if e := validateDatatype(fmt.Sprintf("Tenants.%s.%s", name, k), fv, "stringarray"); e != "" {
+					errors = append(errors, e)
+				}
+			case "Samplers":
+				samplers, ok := fv.(map[string]any)
+				if !ok {
+					errors = append(errors, fmt.Sprintf("Tenant %s Samplers must be a collection of samplers, but %v is %T", name, fv, fv))
+					continue
+				}
+				for sk, sv := range samplers {
+					if _, ok := sv.(map[string]any); !ok {
+						errors = append(errors, fmt.Sprintf("Tenant %s sampler %s must be a map, but %v is %T", name, sk, sv, sv))
+					}
+				}
+			default:
+				errors = append(errors, fmt.Sprintf("unknown key %s in tenant %s", k, name))
+			}
+		}
+	}
 	return errors
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_asFloat(t *testing.T) {
@@ -60,9 +61,20 @@ func Test_validateType(t *testing.T) {
 		{"stringarray5", "k", []any{nil}, "stringarray", "field k must be a string array but contains non-string <nil>"},
 		{"stringarray6", "k", []any{"v", 1}, "stringarray", "field k must be a string array but contains non-string 1"},
 		{"stringarray7", "k", []any{"v", true}, "stringarray", "field k must be a string array but contains non-string true"},
+		{"floatarray1", "k", []any{0.5, 1, 2.5}, "floatarray", ""},
+		{"floatarray2", "k", []any{1, "v"}, "floatarray", "field k[1] must be a float but v is string"},
+		{"floatarray3", "k", 1.0, "floatarray", "field k must be a float array but 1 is float64"},
 		{"stringarray8", "k", []any{"v", 1.0}, "stringarray", "field k must be a string array but contains non-string 1"},
 		{"stringarray9", "k", []any{"v", nil}, "stringarray", "field k must be a string array but contains non-string <nil>"},
 		{"stringarray10", "k", []any{"v", "v"}, "stringarray", ""},
+		{"secretstring", "Logger.APIKey", 1234, "string", "field Logger.APIKey must be a string but (redacted) is int"},
+		{"secretstringarray", "AccessKeys.ReceiveKeys", []any{"v", 1234}, "stringarray", `field AccessKeys.ReceiveKeys must be a string array but contains non-string "(redacted)"`},
+		{"secretmapvalue", "TLS.ClientCertAPIKeys[spiffe://svc]", 1234, "string", "field TLS.ClientCertAPIKeys[spiffe://svc] must be a string but (redacted) is int"},
+		{"secretpassword", "Redis.Password", []any{"hunter2"}, "string", "field Redis.Password must be a string but (redacted) is []interface {}"},
+		{"anyscalarorlist1", "k", "v", "anyscalarorlist", ""},
+		{"anyscalarorlist2", "k", []any{"v", 1, 2.5, true}, "anyscalarorlist", ""},
+		{"anyscalarorlist3", "k", []any{"v", []any{1}}, "anyscalarorlist", "field k[1] must be a string, int, float, or bool"},
+		{"anyscalarorlist4", "k", map[string]any{"k": "v"}, "anyscalarorlist", "field k must be a string, int, float, or bool"},
 		{"map1", "k", map[string]any{"k": "v"}, "map", ""},
 		{"map2", "k", map[string]any{"k": 1}, "map", ""},
 		{"map3", "k", map[string]any{"k": true, "x": 1, "y": "hi"}, "map", ""},
@@ -75,6 +87,8 @@ func Test_validateType(t *testing.T) {
 		{"hostport", "k", "host:port", "hostport", ""},
 		{"hostport bad", "k", "host:port:port", "hostport", `field k (host:port:port) must be a hostport: address host:port:port: too many colons in address`},
 		{"hostport blank", "k", "", "hostport", ""},
+		{"cidr", "k", "10.0.0.0/8", "cidr", ""},
+		{"cidr bad", "k", "10.0.0.1", "cidr", `field k (10.0.0.1) must be a CIDR range like '10.0.0.0/8': invalid CIDR address: 10.0.0.1`},
 		{"url", "k", "http://example.com", "url", ""},
 		{"url bad", "k", "not a url", "url", `field k (not a url) must be a valid URL with a host`},
 		{"url blank", "k", "", "url", `field k may not be blank`},
@@ -363,3 +377,58 @@ func Test_flatten(t *testing.T) {
 	}
 	assert.Equal(t, expected, output)
 }
+
+func Test_validateRulesTenants(t *testing.T) {
+	metadata, err := LoadRulesMetadata()
+	require.NoError(t, err)
+
+	deterministic := func(rate any) map[string]any {
+		return map[string]any{"DeterministicSampler": map[string]any{"SampleRate": rate}}
+	}
+	rules := func(tenants any) map[string]any {
+		return map[string]any{
+			"RulesVersion": 2,
+			"Samplers":     map[string]any{"__default__": deterministic(1)},
+			"Tenants":      tenants,
+		}
+	}
+	tests := []struct {
+		name    string
+		tenants any
+		want    string
+	}{
+		{"valid", map[string]any{"acme": map[string]any{
+			"APIKeys":  []any{"key1"},
+			"Samplers": map[string]any{"production": deterministic(10)},
+		}}, ""},
+		{"no samplers", map[string]any{"acme": map[string]any{"APIKeys": []any{"key1"}}}, ""},
+		{"teams", map[string]any{"acme": map[string]any{"Teams": []any{"acme-corp"}}}, ""},
+		{"not a map", []any{"acme"}, "Tenants must be a collection of tenants"},
+		{"no keys", map[string]any{"acme": map[string]any{}}, "Tenant acme must have APIKeys or Teams"},
+		{"bad keys", map[string]any{"acme": map[string]any{"APIKeys": "key1"}}, "field Tenants.acme.APIKeys must be a string array"},
+		{"bad teams", map[string]any{"acme": map[string]any{"Teams": "acme-corp"}}, "field Tenants.acme.Teams must be a string array"},
+		{"bad name", map[string]any{"ac/me": map[string]any{"APIKeys": []any{"key1"}}}, "must not contain '/'"},
+		{"unknown key", map[string]any{"acme": map[string]any{"APIKeys": []any{"key1"}, "Rate": 1}}, "unknown key Rate in tenant acme"},
+		{"bad sampler", map[string]any{"acme": map[string]any{
+			"APIKeys":  []any{"key1"},
+			"Samplers": map[string]any{"production": deterministic("ten")},
+		}}, "Within tenant acme sampler production"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := metadata.ValidateRules(rules(tt.tenants))
+			if tt.want == "" {
+				assert.Empty(t, got)
+				return
+			}
+			found := false
+			for _, e := range got {
+				if strings.Contains(e, tt.want) {
+					found = true
+					break
+				}
+			}
+			assert.True(t, found, "got %v, want %v", got, tt.want)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The kinds of source a ValueList can be loaded from.
+const (
+	ValueListFile  = "file"
+	ValueListRedis = "redis"
+)
+
+// ValueList is a set of values for the in and not-in rule operators that is
+// loaded from outside the rules, so that it can hold many thousands of
+// values and change without the rules changing. Until it is first loaded,
+// conditions that use it match nothing.
+type ValueList struct {
+	// Source is where the list comes from, as "file:<path>" or
+	// "redis:<set key>".
+	Source string
+	// Kind is ValueListFile or ValueListRedis, and Location is the path or
+	// key.
+	Kind     string
+	Location string
+
+	values atomic.Pointer[valueSet]
+}
+
+// valueSet holds a list's values as each condition datatype sees them, so
+// that a condition matches the list the same way it matches its own values.
+type valueSet struct {
+	byDatatype map[string]map[string]struct{}
+	len        int
+}
+
+// inListDatatypes are the datatypes a list's values are keyed by; values that
+// aren't valid for a datatype are left out of its set.
+var inListDatatypes = []string{"", "int", "float", "bool"}
+
+// Contains reports whether the list holds key, as made by inListKey for a
+// condition of the given datatype.
+func (l *ValueList) Contains(key string, datatype string) bool {
+	values := l.values.Load()
+	if values == nil {
+		return false
+	}
+	if datatype == "string" {
+		datatype = ""
+	}
+	_, ok := values.byDatatype[datatype][key]
+	return ok
+}
+
+// Loaded reports whether the list has been loaded.
+func (l *ValueList) Loaded() bool {
+	return l.values.Load() != nil
+}
+
+// Set replaces the values in the list.
+func (l *ValueList) Set(values []string) {
+	set := &valueSet{byDatatype: make(map[string]map[string]struct{}, len(inListDatatypes))}
+	for _, datatype := range inListDatatypes {
+		keys := make(map[string]struct{}, len(values))
+		for _, v := range values {
+			if key, ok := inListKey(v, datatype); ok {
+				keys[key] = struct{}{}
+			}
+		}
+		set.byDatatype[datatype] = keys
+	}
+	set.len = len(set.byDatatype[""])
+	l.values.Store(set)
+}
+
+// Len returns the number of values in the list.
+func (l *ValueList) Len() int {
+	values := l.values.Load()
+	if values == nil {
+		return 0
+	}
+	return values.len
+}
+
+// inListKey is how a value is compared by the in and not-in operators. With
+// a datatype, the value is converted to it, so that 1.0 and "1" are the same
+// float; without one, numbers are written out in full rather than with %v,
+// which would write a large float in exponent form.
+func inListKey(v any, datatype string) (string, bool) {
+	switch datatype {
+	case "int":
+		n, ok := tryConvertToInt(v)
+		return strconv.Itoa(n), ok
+	case "float":
+		f, ok := tryConvertToFloat(v)
+		return strconv.FormatFloat(f, 'g', -1, 64), ok
+	case "bool":
+		switch b := v.(type) {
+		case bool:
+			return strconv.FormatBool(b), true
+		case string:
+			parsed, err := strconv.ParseBool(b)
+			return strconv.FormatBool(parsed), err == nil
+		}
+		return "", false
+	}
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(value), 'f', -1, 32), true
+	case int:
+		return strconv.Itoa(value), true
+	case int64:
+		return strconv.FormatInt(value, 10), true
+	case bool:
+		return strconv.FormatBool(value), true
+	default:
+		return fmt.Sprintf("%v", v), true
+	}
+}
+
+// valueLists holds every list named by the current rules, so that conditions
+// built when a sampler is created share the values already loaded.
+var valueLists = struct {
+	mut   sync.Mutex
+	lists map[string]*ValueList
+}{lists: make(map[string]*ValueList)}
+
+func parseValueListSource(source string) (kind, location string, err error) {
+	kind, location, ok := strings.Cut(source, ":")
+	if !ok || location == "" || (kind != ValueListFile && kind != ValueListRedis) {
+		return "", "", fmt.Errorf("value list source must be 'file:<path>' or 'redis:<key>', but was '%s'", source)
+	}
+	return kind, location, nil
+}
+
+// GetValueList returns the list for a source, registering it to be loaded
+// if it is new.
+func GetValueList(source string) (*ValueList, error) {
+	kind, location, err := parseValueListSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	valueLists.mut.Lock()
+	defer valueLists.mut.Unlock()
+	if list, ok := valueLists.lists[source]; ok {
+		return list, nil
+	}
+	list := &ValueList{Source: source, Kind: kind, Location: location}
+	valueLists.lists[source] = list
+	return list, nil
+}
+
+// ValueLists returns every registered list, in order of source.
+func ValueLists() []*ValueList {
+	valueLists.mut.Lock()
+	defer valueLists.mut.Unlock()
+	lists := make([]*ValueList, 0, len(valueLists.lists))
+	for _, list := range valueLists.lists {
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Source < lists[j].Source })
+	return lists
+}
+
+// applyValueLists makes the lists named by rules that are being applied the
+// registered ones, and forgets the rest. Lists that are still named keep
+// their values unless new ones were loaded with the rules, which is nil for
+// lists that are loaded later, such as those in Redis.
+func applyValueLists(loaded map[string][]string) {
+	valueLists.mut.Lock()
+	defer valueLists.mut.Unlock()
+	lists := make(map[string]*ValueList, len(loaded))
+	for source, values := range loaded {
+		list, ok := valueLists.lists[source]
+		if !ok {
+			kind, location, err := parseValueListSource(source)
+			if err != nil {
+				continue
+			}
+			list = &ValueList{Source: source, Kind: kind, Location: location}
+		}
+		if values != nil {
+			list.Set(values)
+		}
+		lists[source] = list
+	}
+	valueLists.lists = lists
+}
+
+// loadValueLists reads the file lists named by the rules, so that they're
+// ready before any sampler uses them. It returns the values of every list
+// named, nil for those that aren't files, and a failure for each source that
+// is invalid or can't be read.
+func loadValueLists(rules *V2SamplerConfig) (map[string][]string, []string) {
+	loaded := make(map[string][]string)
+	var failures []string
+	for _, source := range rules.ValueListSources() {
+		kind, location, err := parseValueListSource(source)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("ValuesFrom %s", err))
+			continue
+		}
+		if kind != ValueListFile {
+			loaded[source] = nil
+			continue
+		}
+		values, err := ReadValueListFile(location)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("ValuesFrom '%s' can't be loaded: %s", source, err))
+			continue
+		}
+		if values == nil {
+			values = []string{}
+		}
+		loaded[source] = values
+	}
+	return loaded, failures
+}
+
+// ReadValueListFile reads a list with one value per line. Surrounding
+// whitespace, blank lines and lines starting with # are ignored.
+func ReadValueListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	return values, scanner.Err()
+}
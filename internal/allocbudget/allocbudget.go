@@ -0,0 +1,30 @@
+// Package allocbudget checks hot paths against a fixed number of allocations
+// per item, so that a change which makes one of them allocate more fails a
+// test instead of showing up later as GC pressure. A budget is meant to be
+// raised on purpose, with the reason in the change that raises it.
+package allocbudget
+
+import "testing"
+
+// runs is how many times a path is run to average its allocations.
+const runs = 20
+
+// Check fails t if f allocates more than budget times per item, where each
+// call of f handles items items.
+func Check(t *testing.T, what string, budget float64, items int, f func()) {
+	t.Helper()
+	allocs := testing.AllocsPerRun(runs, f) / float64(items)
+	t.Logf("%s: %.1f allocations per item", what, allocs)
+	if allocs > budget {
+		t.Errorf("%s takes %.1f allocations per item, more than the budget of %g", what, allocs, budget)
+	}
+}
+
+// Benchmark runs f b.N times, reporting its allocations.
+func Benchmark(b *testing.B, f func()) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f()
+	}
+}
@@ -0,0 +1,222 @@
+package apikeys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultCacheTTL = 10 * time.Minute
+
+// KeyInfo is what the upstream API told us about an API key. Team is the
+// team's slug, and Environment is the name of the key's environment, which is
+// what datasets are routed by.
+type KeyInfo struct {
+	Valid       bool   `json:"valid"`
+	Team        string `json:"team,omitempty"`
+	Environment string `json:"environment,omitempty"`
+}
+
+// Cache stores the results of key validation.
+type Cache interface {
+	Get(ctx context.Context, key string) (KeyInfo, bool)
+	Set(ctx context.Context, key string, info KeyInfo, ttl time.Duration)
+}
+
+// Validator checks API keys against the upstream /1/auth endpoint, caching
+// the results so that each key is only checked once per TTL. It's the only
+// caller of /1/auth; the router gets environment names from it too.
+type Validator struct {
+	Config        config.Config   `inject:""`
+	Logger        logger.Logger   `inject:""`
+	Metrics       metrics.Metrics `inject:"genericMetrics"`
+	HTTPTransport *http.Transport `inject:"upstreamTransport"`
+	Cache         Cache           `inject:""`
+
+	client *http.Client
+	group  singleflight.Group
+}
+
+func (v *Validator) Start() error {
+	v.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: v.HTTPTransport,
+	}
+
+	v.Metrics.Register("apikey_validation_cache_hit", "counter")
+	v.Metrics.Register("apikey_validation_upstream", "counter")
+	v.Metrics.Register("apikey_validation_rejected", "counter")
+	v.Metrics.Register("apikey_validation_errors", "counter")
+	return nil
+}
+
+// Lookup returns what is known about the key, asking the upstream API if the
+// key isn't in the cache. Concurrent lookups of the same key share a single
+// upstream request. An error means the key's validity couldn't be
+// determined; nothing is cached in that case.
+func (v *Validator) Lookup(ctx context.Context, key string) (KeyInfo, error) {
+	if info, ok := v.Cache.Get(ctx, key); ok {
+		v.Metrics.Increment("apikey_validation_cache_hit")
+		return info, nil
+	}
+
+	result, err, _ := v.group.Do(key, func() (any, error) {
+		v.Metrics.Increment("apikey_validation_upstream")
+		info, err := v.fetch(ctx, key)
+		if err != nil {
+			v.Metrics.Increment("apikey_validation_errors")
+			return KeyInfo{}, err
+		}
+		if !info.Valid {
+			v.Metrics.Increment("apikey_validation_rejected")
+		}
+
+		ttl := time.Duration(v.Config.GetAccessKeyConfig().ValidationCacheTTL)
+		if ttl <= 0 {
+			ttl = defaultCacheTTL
+		}
+		v.Cache.Set(ctx, key, info, ttl)
+		return info, nil
+	})
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return result.(KeyInfo), nil
+}
+
+// Team returns the team of a valid key that's in the cache, without asking
+// the upstream API, so that it's cheap enough to call for every trace. It
+// returns "" for keys that haven't been looked up.
+func (v *Validator) Team(ctx context.Context, key string) string {
+	info, ok := v.Cache.Get(ctx, key)
+	if !ok || !info.Valid {
+		return ""
+	}
+	return info.Team
+}
+
+type authInfo struct {
+	Team struct {
+		Slug string `json:"slug"`
+	} `json:"team"`
+	Environment struct {
+		Name string `json:"name"`
+	} `json:"environment"`
+}
+
+func (v *Validator) fetch(ctx context.Context, key string) (KeyInfo, error) {
+	authURL, err := url.Parse(v.Config.GetHoneycombAPI())
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("failed to parse Honeycomb API URL config value. %w", err)
+	}
+	authURL.Path = "/1/auth"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authURL.String(), nil)
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("failed to create auth request. %w", err)
+	}
+	req.Header.Set("x-Honeycomb-team", key)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("failed sending auth request to Honeycomb API. %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return KeyInfo{Valid: false}, nil
+	case resp.StatusCode > 299:
+		return KeyInfo{}, fmt.Errorf("received %d response for auth request from Honeycomb API", resp.StatusCode)
+	}
+
+	ai := authInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&ai); err != nil {
+		return KeyInfo{}, errors.New("failed to JSON decode auth response from Honeycomb API")
+	}
+	return KeyInfo{
+		Valid:       true,
+		Team:        ai.Team.Slug,
+		Environment: ai.Environment.Name,
+	}, nil
+}
+
+var _ Cache = &LocalCache{}
+
+const (
+	// localCacheSize is the most accepted keys that a LocalCache holds.
+	localCacheSize = 10_000
+	// localRejectedCacheSize is the most rejected keys that a LocalCache
+	// holds. It's kept apart and smaller, so that a flood of made-up keys
+	// can't push out the keys that are in use.
+	localRejectedCacheSize = 1_000
+)
+
+// LocalCache keeps validation results in memory on this node only. When it's
+// full, the least recently used entries are evicted.
+type LocalCache struct {
+	Clock clockwork.Clock `inject:""`
+
+	mut      sync.Mutex
+	accepted *simplelru.LRU[string, localItem]
+	rejected *simplelru.LRU[string, localItem]
+}
+
+type localItem struct {
+	info      KeyInfo
+	expiresAt time.Time
+}
+
+// init creates the LRUs on first use; c.mut must be held.
+func (c *LocalCache) init() {
+	if c.accepted == nil {
+		c.accepted, _ = simplelru.NewLRU[string, localItem](localCacheSize, nil)
+		c.rejected, _ = simplelru.NewLRU[string, localItem](localRejectedCacheSize, nil)
+	}
+}
+
+func (c *LocalCache) Get(ctx context.Context, key string) (KeyInfo, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.init()
+
+	for _, lru := range []*simplelru.LRU[string, localItem]{c.accepted, c.rejected} {
+		item, ok := lru.Get(key)
+		if !ok {
+			continue
+		}
+		if !c.Clock.Now().Before(item.expiresAt) {
+			lru.Remove(key)
+			return KeyInfo{}, false
+		}
+		return item.info, true
+	}
+	return KeyInfo{}, false
+}
+
+func (c *LocalCache) Set(ctx context.Context, key string, info KeyInfo, ttl time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.init()
+
+	item := localItem{info: info, expiresAt: c.Clock.Now().Add(ttl)}
+	if info.Valid {
+		c.rejected.Remove(key)
+		c.accepted.Add(key, item)
+	} else {
+		c.accepted.Remove(key)
+		c.rejected.Add(key, item)
+	}
+}
@@ -0,0 +1,145 @@
+package apikeys
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthServer(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "/1/auth", r.URL.Path)
+		switch r.Header.Get("x-Honeycomb-team") {
+		case "good":
+			w.Write([]byte(`{"team":{"slug":"myteam"},"environment":{"slug":"prod","name":"Production"}}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+}
+
+func newTestValidator(apiHost string, cache Cache) *Validator {
+	v := &Validator{
+		Config: &config.MockConfig{
+			GetHoneycombAPIVal: apiHost,
+			AccessKeys:         config.AccessKeyConfig{ValidationCacheTTL: config.Duration(time.Minute)},
+		},
+		Logger:        &logger.NullLogger{},
+		Metrics:       &metrics.NullMetrics{},
+		HTTPTransport: http.DefaultTransport.(*http.Transport),
+		Cache:         cache,
+	}
+	v.Start()
+	return v
+}
+
+func TestValidatorLookup(t *testing.T) {
+	calls := &atomic.Int32{}
+	server := newAuthServer(t, calls)
+	defer server.Close()
+
+	clock := clockwork.NewFakeClock()
+	v := newTestValidator(server.URL, &LocalCache{Clock: clock})
+	ctx := context.Background()
+
+	info, err := v.Lookup(ctx, "good")
+	require.NoError(t, err)
+	assert.Equal(t, KeyInfo{Valid: true, Team: "myteam", Environment: "Production"}, info)
+
+	info, err = v.Lookup(ctx, "bad")
+	require.NoError(t, err)
+	assert.False(t, info.Valid)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// both results are served from the cache until the TTL passes
+	_, err = v.Lookup(ctx, "good")
+	require.NoError(t, err)
+	_, err = v.Lookup(ctx, "bad")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+
+	clock.Advance(2 * time.Minute)
+	_, err = v.Lookup(ctx, "good")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// upstream failures are reported and not cached
+	_, err = v.Lookup(ctx, "broken")
+	assert.Error(t, err)
+	_, err = v.Lookup(ctx, "broken")
+	assert.Error(t, err)
+	assert.Equal(t, int32(5), calls.Load())
+}
+
+func TestRedisCacheSharedAcrossNodes(t *testing.T) {
+	calls := &atomic.Int32{}
+	server := newAuthServer(t, calls)
+	defer server.Close()
+
+	client := &redis.TestService{}
+	require.NoError(t, client.Start())
+	defer client.Stop()
+
+	newNode := func() *Validator {
+		cache := &RedisCache{Redis: client, Logger: &logger.NullLogger{}, Clock: clockwork.NewFakeClock()}
+		require.NoError(t, cache.Start())
+		return newTestValidator(server.URL, cache)
+	}
+	node1 := newNode()
+	node2 := newNode()
+
+	info, err := node1.Lookup(context.Background(), "good")
+	require.NoError(t, err)
+	assert.True(t, info.Valid)
+
+	info, err = node2.Lookup(context.Background(), "good")
+	require.NoError(t, err)
+	assert.Equal(t, KeyInfo{Valid: true, Team: "myteam", Environment: "Production"}, info)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// the raw key is never written to redis
+	assert.False(t, client.Service.Exists("good"))
+	assert.True(t, client.Service.Exists(redisKey("good")))
+}
+
+func TestLocalCacheBoundsRejectedKeys(t *testing.T) {
+	ctx := context.Background()
+	cache := &LocalCache{Clock: clockwork.NewFakeClock()}
+	cache.Set(ctx, "good", KeyInfo{Valid: true}, time.Minute)
+
+	// a flood of rejected keys only pushes out other rejected keys
+	for i := 0; i < localRejectedCacheSize+100; i++ {
+		cache.Set(ctx, fmt.Sprintf("bad-%d", i), KeyInfo{Valid: false}, time.Minute)
+	}
+	assert.Equal(t, localRejectedCacheSize, cache.rejected.Len())
+	_, ok := cache.Get(ctx, "bad-0")
+	assert.False(t, ok)
+	info, ok := cache.Get(ctx, fmt.Sprintf("bad-%d", localRejectedCacheSize+99))
+	assert.True(t, ok)
+	assert.False(t, info.Valid)
+	info, ok = cache.Get(ctx, "good")
+	assert.True(t, ok)
+	assert.True(t, info.Valid)
+
+	// a key that becomes valid moves to the accepted entries
+	cache.Set(ctx, "bad-500", KeyInfo{Valid: true}, time.Minute)
+	info, ok = cache.Get(ctx, "bad-500")
+	assert.True(t, ok)
+	assert.True(t, info.Valid)
+	assert.Equal(t, localRejectedCacheSize-1, cache.rejected.Len())
+}
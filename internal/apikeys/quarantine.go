@@ -0,0 +1,116 @@
+package apikeys
+
+import (
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+// Quarantine tracks keys that the upstream API keeps rejecting. Once a key
+// has been rejected QuarantineThreshold times in a row it is quarantined for
+// QuarantineDuration, during which new ingest using it is refused instead of
+// being buffered and sent only to be rejected again.
+type Quarantine struct {
+	Config  config.Config   `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	Clock   clockwork.Clock `inject:""`
+
+	mut        sync.Mutex
+	rejections map[string]int
+	until      map[string]time.Time
+	lastSweep  time.Time
+}
+
+// quarantineSweepInterval is how often lookups clear out expired quarantines,
+// so that the gauge of quarantined keys goes down even if none are added.
+const quarantineSweepInterval = 10 * time.Second
+
+func (q *Quarantine) Start() error {
+	q.rejections = make(map[string]int)
+	q.until = make(map[string]time.Time)
+
+	q.Metrics.Register("apikey_quarantined", "counter")
+	q.Metrics.Register("apikey_quarantined_keys", "gauge")
+	return nil
+}
+
+// RecordRejection notes that upstream rejected an event sent with the key,
+// and quarantines the key if that has happened too many times in a row.
+func (q *Quarantine) RecordRejection(key string) {
+	akc := q.Config.GetAccessKeyConfig()
+	if akc.QuarantineThreshold <= 0 {
+		return
+	}
+
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	now := q.Clock.Now()
+	if until, ok := q.until[key]; ok && now.Before(until) {
+		// events sent before the key was quarantined are still coming back
+		return
+	}
+	q.rejections[key]++
+	if q.rejections[key] < akc.QuarantineThreshold {
+		return
+	}
+
+	until := now.Add(time.Duration(akc.QuarantineDuration))
+	delete(q.rejections, key)
+	q.until[key] = until
+	q.removeExpired(now)
+
+	q.Metrics.Increment("apikey_quarantined")
+	q.Logger.Warn().
+		WithString("api_key", NewRedactor(akc.KeyRedaction, akc.KeyRedactionSalt).Redact(key)).
+		WithField("rejections", akc.QuarantineThreshold).
+		WithString("until", until.Format(time.RFC3339)).
+		Logf("upstream keeps rejecting api key; quarantining it")
+}
+
+// RecordSuccess notes that upstream accepted an event sent with the key. A
+// quarantined key is released, since upstream is taking it again.
+func (q *Quarantine) RecordSuccess(key string) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	delete(q.rejections, key)
+	if _, ok := q.until[key]; ok {
+		delete(q.until, key)
+		q.Metrics.Gauge("apikey_quarantined_keys", len(q.until))
+	}
+}
+
+// QuarantinedUntil reports whether the key is currently quarantined, and if
+// so, when the quarantine ends.
+func (q *Quarantine) QuarantinedUntil(key string) (time.Time, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	now := q.Clock.Now()
+	if now.Sub(q.lastSweep) >= quarantineSweepInterval {
+		q.removeExpired(now)
+	}
+	until, ok := q.until[key]
+	if !ok || !now.Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// removeExpired ends the quarantines that have run out and updates the gauge
+// of quarantined keys; q.mut must be held.
+func (q *Quarantine) removeExpired(now time.Time) {
+	q.lastSweep = now
+	for k, until := range q.until {
+		if !now.Before(until) {
+			delete(q.until, k)
+		}
+	}
+	q.Metrics.Gauge("apikey_quarantined_keys", len(q.until))
+}
@@ -0,0 +1,104 @@
+package apikeys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQuarantine(threshold int) (*Quarantine, clockwork.FakeClock) {
+	clock := clockwork.NewFakeClock()
+	q := &Quarantine{
+		Config: &config.MockConfig{
+			AccessKeys: config.AccessKeyConfig{
+				QuarantineThreshold: threshold,
+				QuarantineDuration:  config.Duration(time.Minute),
+			},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Clock:   clock,
+	}
+	return q, clock
+}
+
+func TestQuarantine(t *testing.T) {
+	q, clock := newTestQuarantine(3)
+	require.NoError(t, q.Start())
+
+	q.RecordRejection("bad")
+	q.RecordRejection("bad")
+	_, quarantined := q.QuarantinedUntil("bad")
+	assert.False(t, quarantined)
+
+	q.RecordRejection("bad")
+	until, quarantined := q.QuarantinedUntil("bad")
+	assert.True(t, quarantined)
+	assert.Equal(t, clock.Now().Add(time.Minute), until)
+
+	// rejections of events sent before the quarantine don't extend it
+	clock.Advance(30 * time.Second)
+	q.RecordRejection("bad")
+	q.RecordRejection("bad")
+	q.RecordRejection("bad")
+	clock.Advance(31 * time.Second)
+	_, quarantined = q.QuarantinedUntil("bad")
+	assert.False(t, quarantined)
+
+	_, quarantined = q.QuarantinedUntil("good")
+	assert.False(t, quarantined)
+}
+
+func TestQuarantineResetOnSuccess(t *testing.T) {
+	q, _ := newTestQuarantine(2)
+	require.NoError(t, q.Start())
+
+	q.RecordRejection("flaky")
+	q.RecordSuccess("flaky")
+	q.RecordRejection("flaky")
+	_, quarantined := q.QuarantinedUntil("flaky")
+	assert.False(t, quarantined)
+}
+
+func TestQuarantineDisabled(t *testing.T) {
+	q, _ := newTestQuarantine(0)
+	require.NoError(t, q.Start())
+
+	for i := 0; i < 10; i++ {
+		q.RecordRejection("bad")
+	}
+	_, quarantined := q.QuarantinedUntil("bad")
+	assert.False(t, quarantined)
+}
+
+func TestQuarantineGauge(t *testing.T) {
+	q, clock := newTestQuarantine(1)
+	m := &metrics.MockMetrics{}
+	m.Start()
+	q.Metrics = m
+	require.NoError(t, q.Start())
+
+	gauge := func() float64 {
+		v, _ := m.Get("apikey_quarantined_keys")
+		return v
+	}
+
+	q.RecordRejection("expires")
+	q.RecordRejection("released")
+	assert.Equal(t, float64(2), gauge())
+
+	// a key upstream accepts again is released
+	q.RecordSuccess("released")
+	assert.Equal(t, float64(1), gauge())
+
+	// expired quarantines are cleared out by lookups of any key
+	clock.Advance(time.Minute)
+	q.QuarantinedUntil("other")
+	assert.Equal(t, float64(0), gauge())
+}
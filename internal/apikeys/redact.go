@@ -0,0 +1,58 @@
+package apikeys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Redactor turns an API key into something that is safe to put in logs,
+// metrics, and error messages.
+type Redactor interface {
+	Redact(key string) string
+}
+
+// NewRedactor returns the Redactor for the given KeyRedaction mode. Unknown
+// modes fall back to HMAC so that a typo never exposes keys.
+func NewRedactor(mode string, salt string) Redactor {
+	switch mode {
+	case "none":
+		return NoopRedactor{}
+	case "mask":
+		return MaskRedactor{}
+	default:
+		return HMACRedactor{Salt: []byte(salt)}
+	}
+}
+
+// HMACRedactor replaces keys with a truncated HMAC-SHA256 of the key, so that
+// the same key is always reported the same way.
+type HMACRedactor struct {
+	Salt []byte
+}
+
+func (h HMACRedactor) Redact(key string) string {
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, h.Salt)
+	mac.Write([]byte(key))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// MaskRedactor shows only the last 4 characters of keys.
+type MaskRedactor struct{}
+
+func (MaskRedactor) Redact(key string) string {
+	if len(key) < 8 {
+		return "****"
+	}
+	return "****" + key[len(key)-4:]
+}
+
+// NoopRedactor leaves keys as they are.
+type NoopRedactor struct{}
+
+func (NoopRedactor) Redact(key string) string {
+	return key
+}
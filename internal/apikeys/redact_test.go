@@ -0,0 +1,29 @@
+package apikeys
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactors(t *testing.T) {
+	key := "abcdefghijklmnopqrstuv"
+
+	hmacRedactor := NewRedactor("hmac", "salt")
+	redacted := hmacRedactor.Redact(key)
+	assert.NotContains(t, redacted, key)
+	assert.Len(t, redacted, len("hmac:")+16)
+	// the same key and salt always give the same result, and a different
+	// salt gives a different one
+	assert.Equal(t, redacted, NewRedactor("hmac", "salt").Redact(key))
+	assert.NotEqual(t, redacted, NewRedactor("hmac", "pepper").Redact(key))
+	assert.NotEqual(t, redacted, hmacRedactor.Redact(key+"x"))
+
+	// unknown modes fall back to hmac
+	assert.Equal(t, redacted, NewRedactor("bogus", "salt").Redact(key))
+
+	assert.Equal(t, "****stuv", NewRedactor("mask", "").Redact(key))
+	assert.Equal(t, "****", NewRedactor("mask", "").Redact("short"))
+	assert.Equal(t, key, NewRedactor("none", "").Redact(key))
+	assert.Equal(t, "", hmacRedactor.Redact(""))
+}
@@ -0,0 +1,85 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/redis"
+	"github.com/jonboulle/clockwork"
+)
+
+// localTTL bounds how long a node trusts its own copy of a shared cache entry
+// before checking Redis again.
+const localTTL = 30 * time.Second
+
+var _ Cache = &RedisCache{}
+
+// RedisCache shares validation results across the cluster through Redis, so
+// that each key is only checked upstream once per TTL no matter how many
+// nodes see it. Keys are stored hashed so that Redis never holds raw API keys.
+type RedisCache struct {
+	Redis  redis.Client    `inject:"redis"`
+	Logger logger.Logger   `inject:""`
+	Clock  clockwork.Clock `inject:""`
+
+	local LocalCache
+}
+
+func (c *RedisCache) Start() error {
+	c.local.Clock = c.Clock
+	return nil
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) (KeyInfo, bool) {
+	if info, ok := c.local.Get(ctx, key); ok {
+		return info, true
+	}
+
+	conn, err := c.Redis.GetContext(ctx)
+	if err != nil {
+		c.Logger.Error().Logf("failed to get redis connection for api key cache: %s", err)
+		return KeyInfo{}, false
+	}
+	defer conn.Close()
+
+	val, err := conn.GetString(ctx, redisKey(key))
+	if err != nil || val == "" {
+		return KeyInfo{}, false
+	}
+
+	var info KeyInfo
+	if err := json.Unmarshal([]byte(val), &info); err != nil {
+		return KeyInfo{}, false
+	}
+	c.local.Set(ctx, key, info, localTTL)
+	return info, true
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, info KeyInfo, ttl time.Duration) {
+	c.local.Set(ctx, key, info, min(ttl, localTTL))
+
+	val, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+
+	conn, err := c.Redis.GetContext(ctx)
+	if err != nil {
+		c.Logger.Error().Logf("failed to get redis connection for api key cache: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.SetStringTTL(ctx, redisKey(key), string(val), ttl); err != nil {
+		c.Logger.Error().Logf("failed to store api key validation in redis: %s", err)
+	}
+}
+
+func redisKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "refinery:apikey:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,75 @@
+// Package clustercount adds up counts from every Refinery in a cluster, so
+// that decisions which ought to be cluster-wide, such as how much to sample to
+// meet a throughput goal, don't depend on how many nodes there are.
+package clustercount
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Counter adds up per-key counts from every node, in numbered windows of
+// time. Nodes agree on the numbering by deriving it from the clock.
+type Counter interface {
+	// Add adds this node's counts to a window. The window's counts are kept
+	// for at least retention.
+	Add(ctx context.Context, name string, window int64, counts map[string]int64, retention time.Duration) error
+	// Totals returns the counts of every node for a window.
+	Totals(ctx context.Context, name string, window int64) (map[string]int64, error)
+}
+
+// Window returns the number of the window that contains t.
+func Window(t time.Time, interval time.Duration) int64 {
+	return t.UnixNano() / int64(interval)
+}
+
+var _ Counter = &LocalCounter{}
+
+// LocalCounter keeps counts in memory, for a cluster of one.
+type LocalCounter struct {
+	mut    sync.Mutex
+	counts map[string]map[int64]map[string]int64
+}
+
+// localWindows is how many windows of each name LocalCounter keeps.
+const localWindows = 4
+
+func (c *LocalCounter) Add(ctx context.Context, name string, window int64, counts map[string]int64, retention time.Duration) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]map[int64]map[string]int64)
+	}
+	windows := c.counts[name]
+	if windows == nil {
+		windows = make(map[int64]map[string]int64)
+		c.counts[name] = windows
+	}
+	totals := windows[window]
+	if totals == nil {
+		totals = make(map[string]int64, len(counts))
+		windows[window] = totals
+	}
+	for key, n := range counts {
+		totals[key] += n
+	}
+	for w := range windows {
+		if w <= window-localWindows {
+			delete(windows, w)
+		}
+	}
+	return nil
+}
+
+func (c *LocalCounter) Totals(ctx context.Context, name string, window int64) (map[string]int64, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	totals := make(map[string]int64, len(c.counts[name][window]))
+	for key, n := range c.counts[name][window] {
+		totals[key] = n
+	}
+	return totals, nil
+}
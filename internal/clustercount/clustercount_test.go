@@ -0,0 +1,68 @@
+package clustercount
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	assert.Equal(t, Window(start, 10*time.Second), Window(start.Add(9*time.Second), 10*time.Second))
+	assert.Equal(t, Window(start, 10*time.Second)+1, Window(start.Add(10*time.Second), 10*time.Second))
+}
+
+func testCounter(t *testing.T, c Counter) {
+	ctx := context.Background()
+
+	require.NoError(t, c.Add(ctx, "a", 10, map[string]int64{"x": 1, "y": 2}, time.Minute))
+	require.NoError(t, c.Add(ctx, "a", 10, map[string]int64{"x": 3}, time.Minute))
+	require.NoError(t, c.Add(ctx, "a", 11, map[string]int64{"x": 5}, time.Minute))
+	require.NoError(t, c.Add(ctx, "b", 10, map[string]int64{"x": 7}, time.Minute))
+
+	totals, err := c.Totals(ctx, "a", 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"x": 4, "y": 2}, totals)
+
+	totals, err = c.Totals(ctx, "a", 11)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"x": 5}, totals)
+
+	totals, err = c.Totals(ctx, "b", 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"x": 7}, totals)
+
+	totals, err = c.Totals(ctx, "a", 12)
+	require.NoError(t, err)
+	assert.Empty(t, totals)
+}
+
+func TestLocalCounter(t *testing.T) {
+	c := &LocalCounter{}
+	testCounter(t, c)
+
+	// old windows are dropped as new ones arrive
+	ctx := context.Background()
+	require.NoError(t, c.Add(ctx, "a", 10+localWindows, map[string]int64{"x": 1}, time.Minute))
+	totals, err := c.Totals(ctx, "a", 10)
+	require.NoError(t, err)
+	assert.Empty(t, totals)
+	totals, err = c.Totals(ctx, "a", 11)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"x": 5}, totals)
+}
+
+func TestRedisCounter(t *testing.T) {
+	client := &redis.TestService{}
+	require.NoError(t, client.Start())
+	defer client.Stop()
+
+	testCounter(t, &RedisCounter{Redis: client})
+
+	ttl := client.Service.TTL(redisKey("a", 10))
+	assert.Equal(t, time.Minute, ttl)
+}
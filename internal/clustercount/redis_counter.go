@@ -0,0 +1,63 @@
+package clustercount
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/honeycombio/refinery/redis"
+)
+
+var _ Counter = &RedisCounter{}
+
+// RedisCounter adds up counts in a Redis hash per name and window, which
+// every node in the cluster increments.
+type RedisCounter struct {
+	Redis redis.Client `inject:"redis"`
+}
+
+func (c *RedisCounter) Add(ctx context.Context, name string, window int64, counts map[string]int64, retention time.Duration) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	conn, err := c.Redis.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := redisKey(name, window)
+	commands := make([]redis.Command, 0, len(counts)+1)
+	for field, n := range counts {
+		commands = append(commands, redis.NewIncrByHashCommand(key, field, n))
+	}
+	commands = append(commands, redis.NewExpireCommand(key, int64(retention.Seconds())))
+	return conn.Exec(commands...)
+}
+
+func (c *RedisCounter) Totals(ctx context.Context, name string, window int64) (map[string]int64, error) {
+	conn, err := c.Redis.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	values, err := conn.GetAllStringsHash(redisKey(name, window))
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64, len(values))
+	for field, value := range values {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count for '%s' in %s: %w", field, redisKey(name, window), err)
+		}
+		totals[field] = n
+	}
+	return totals, nil
+}
+
+func redisKey(name string, window int64) string {
+	return fmt.Sprintf("refinery:cluster_count:%s:%d", name, window)
+}
@@ -0,0 +1,248 @@
+// Package configsync distributes the configuration and rules to every node of
+// a cluster through Redis, so that they all switch to a new version together
+// instead of each picking up its own files at a different time.
+package configsync
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+)
+
+// publishedConfigKey is the Redis hash that holds the latest published
+// version of the configuration and rules, and its epoch.
+const publishedConfigKey = "refinery:config:published"
+
+// gossipChannel is the gossip channel that announces each new epoch.
+const gossipChannel = "config"
+
+// publishScript stores a new version of the configuration and rules with the
+// next epoch, and announces the epoch on the gossip channel. If the
+// documents are the same as those already published, nothing changes and it
+// returns 0; otherwise it returns the new epoch.
+// It takes the following arguments:
+// KEYS[1] - the published config hash
+// ARGV[1] - the config document
+// ARGV[2] - the config document's format
+// ARGV[3] - the rules document
+// ARGV[4] - the rules document's format
+// ARGV[5] - the hash of the config and rules documents
+// ARGV[6] - the Redis channel that gossip is published on
+// ARGV[7] - the gossip message for the channel, without the epoch
+const publishScriptKeys = 1
+const publishScript = `
+	local key = KEYS[1]
+	local current = redis.call('HGET', key, 'hash')
+	if current == ARGV[5] then
+	  return 0
+	end
+
+	local epoch = redis.call('HINCRBY', key, 'epoch', 1)
+	redis.call('HSET', key,
+	  'config', ARGV[1], 'config_format', ARGV[2],
+	  'rules', ARGV[3], 'rules_format', ARGV[4],
+	  'hash', ARGV[5])
+	redis.call('PUBLISH', ARGV[6], ARGV[7] .. epoch)
+	return epoch
+`
+
+// Publish stores a new version of the configuration and rules in Redis for
+// the whole cluster, and tells every node about it. It returns the new
+// epoch, or 0 if the documents are the same as those already published.
+func Publish(ctx context.Context, client redis.Client, published config.PublishedConfig) (uint64, error) {
+	conn, err := client.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	h := md5.New()
+	h.Write(published.Config)
+	h.Write([]byte{0})
+	h.Write(published.Rules)
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	script := client.NewScript(publishScriptKeys, publishScript)
+	epoch, err := script.DoInt(ctx, conn, publishedConfigKey,
+		published.Config, string(published.ConfigFormat),
+		published.Rules, string(published.RulesFormat),
+		hash, gossip.RedisChannel, gossip.EncodeMessage(gossipChannel, nil))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(epoch), nil
+}
+
+// Latest reads the latest published version of the configuration and rules
+// from Redis. Its epoch is 0 if nothing has been published.
+func Latest(ctx context.Context, client redis.Client) (config.PublishedConfig, error) {
+	conn, err := client.GetContext(ctx)
+	if err != nil {
+		return config.PublishedConfig{}, err
+	}
+	defer conn.Close()
+
+	fields, err := conn.GetAllStringsHash(publishedConfigKey)
+	if err != nil || len(fields) == 0 {
+		return config.PublishedConfig{}, err
+	}
+	epoch, err := strconv.ParseUint(fields["epoch"], 10, 64)
+	if err != nil {
+		return config.PublishedConfig{}, fmt.Errorf("invalid epoch '%s' for published config: %w", fields["epoch"], err)
+	}
+	return config.PublishedConfig{
+		Epoch:        epoch,
+		Config:       []byte(fields["config"]),
+		ConfigFormat: config.Format(fields["config_format"]),
+		Rules:        []byte(fields["rules"]),
+		RulesFormat:  config.Format(fields["rules_format"]),
+	}, nil
+}
+
+// Distributor keeps this node's configuration at the latest version
+// published for the cluster. Each new epoch is announced through gossip, and
+// the published version is also polled for in case an announcement is
+// missed. A node that is the publisher instead publishes its own config and
+// rules files whenever they change, and leaves them in use.
+type Distributor struct {
+	Config  config.Config   `inject:""`
+	Redis   redis.Client    `inject:"redis"`
+	Gossip  gossip.Gossiper `inject:"gossip"`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+
+	// mut keeps syncs from the gossip and poll loops from overlapping
+	mut  sync.Mutex
+	done chan struct{}
+}
+
+func (d *Distributor) Start() error {
+	cfg := d.Config.GetConfigDistributionConfig()
+	if !cfg.Enabled {
+		return nil
+	}
+	d.Metrics.Register("config_distribution_published", "counter")
+	d.Metrics.Register("config_distribution_applied", "counter")
+	d.Metrics.Register("config_distribution_rejected", "counter")
+	d.Metrics.Register("config_epoch", "gauge")
+	d.done = make(chan struct{})
+
+	if cfg.Publisher {
+		d.Config.RegisterReloadCallback(d.publish)
+		d.publish()
+		return nil
+	}
+
+	// applying the current version before starting means that a node joins
+	// the cluster with the rules everyone else is using
+	d.sync()
+	announcements := d.Gossip.Subscribe(gossipChannel, 10)
+	go d.watch(announcements, time.Duration(cfg.PollInterval))
+	return nil
+}
+
+func (d *Distributor) Stop() error {
+	if d.done != nil {
+		close(d.done)
+	}
+	return nil
+}
+
+// watch syncs whenever a new epoch is announced, and every interval.
+func (d *Distributor) watch(announcements chan []byte, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case msg := <-announcements:
+			epoch, err := strconv.ParseUint(string(msg), 10, 64)
+			if err == nil && epoch <= d.Config.GetConfigEpoch() {
+				continue
+			}
+			d.sync()
+		case <-ticker.C:
+			d.sync()
+		}
+	}
+}
+
+// sync applies the latest published version, if it's newer than the one in
+// use.
+func (d *Distributor) sync() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	published, err := Latest(context.Background(), d.Redis)
+	if err != nil {
+		d.Logger.Error().WithField("error", err.Error()).Logf("unable to read the published configuration")
+		return
+	}
+	if published.Epoch == 0 || published.Epoch <= d.Config.GetConfigEpoch() {
+		return
+	}
+
+	result := d.Config.ApplyPublished(published)
+	if !result.Applied {
+		d.Metrics.Increment("config_distribution_rejected")
+		d.Logger.Error().WithFields(map[string]interface{}{
+			"epoch":           published.Epoch,
+			"error":           result.Error,
+			"config_failures": result.ConfigFailures,
+			"rules_failures":  result.RulesFailures,
+		}).Logf("published configuration was not applied")
+		return
+	}
+	d.Metrics.Increment("config_distribution_applied")
+	d.Metrics.Gauge("config_epoch", result.Epoch)
+	d.Logger.Info().WithFields(map[string]interface{}{
+		"epoch":      result.Epoch,
+		"generation": result.Generation,
+		"changed":    result.Changed,
+	}).Logf("applied published configuration")
+}
+
+// publish publishes this node's config and rules files, as they are now.
+func (d *Distributor) publish() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	var configLocation, rulesLocation string
+	for _, md := range d.Config.GetConfigMetadata() {
+		switch md.Type {
+		case "config":
+			configLocation = md.ID
+		case "rules":
+			rulesLocation = md.ID
+		}
+	}
+	published, err := config.LoadDocuments(configLocation, rulesLocation)
+	if err == nil {
+		published.Epoch, err = Publish(context.Background(), d.Redis, published)
+	}
+	if err != nil {
+		d.Logger.Error().WithField("error", err.Error()).Logf("unable to publish the configuration")
+		return
+	}
+	if published.Epoch == 0 {
+		return
+	}
+	d.Metrics.Increment("config_distribution_published")
+	d.Metrics.Gauge("config_epoch", published.Epoch)
+	d.Logger.Info().WithField("epoch", published.Epoch).Logf("published configuration to the cluster")
+}
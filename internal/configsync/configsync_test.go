@@ -0,0 +1,108 @@
+package configsync
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+)
+
+func testPublished(rules string) config.PublishedConfig {
+	return config.PublishedConfig{
+		Config:       []byte("General:\n  ConfigurationVersion: 2\n"),
+		ConfigFormat: config.FormatYAML,
+		Rules:        []byte(rules),
+		RulesFormat:  config.FormatYAML,
+	}
+}
+
+func TestPublish(t *testing.T) {
+	client := &redis.TestService{}
+	require.NoError(t, client.Start())
+	defer client.Stop()
+	ctx := context.Background()
+
+	// miniredis blocks publishing until a subscriber's message is read
+	sub := client.Service.NewSubscriber()
+	defer sub.Close()
+	sub.Subscribe(gossip.RedisChannel)
+	announced := make(chan string, 10)
+	go func() {
+		for msg := range sub.Messages() {
+			announced <- msg.Message
+		}
+	}()
+
+	latest, err := Latest(ctx, client)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), latest.Epoch)
+
+	epoch, err := Publish(ctx, client, testPublished("RulesVersion: 2\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), epoch)
+	select {
+	case msg := <-announced:
+		assert.Equal(t, string(gossip.EncodeMessage(gossipChannel, []byte("1"))), msg)
+	case <-time.After(time.Second):
+		t.Fatal("the new epoch wasn't announced")
+	}
+
+	// the same documents again aren't a new version
+	epoch, err = Publish(ctx, client, testPublished("RulesVersion: 2\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), epoch)
+
+	epoch, err = Publish(ctx, client, testPublished("RulesVersion: 2\nSamplers: {}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), epoch)
+
+	latest, err = Latest(ctx, client)
+	require.NoError(t, err)
+	want := testPublished("RulesVersion: 2\nSamplers: {}\n")
+	want.Epoch = 2
+	assert.Equal(t, want, latest)
+}
+
+func TestDistributor(t *testing.T) {
+	client := &redis.TestService{}
+	require.NoError(t, client.Start())
+	defer client.Stop()
+	m := &metrics.MockMetrics{}
+	m.Start()
+	g := &gossip.InMemoryGossip{Logger: &logger.NullLogger{}, Metrics: m}
+	require.NoError(t, g.Start())
+	defer g.Stop()
+
+	// a version published before the node starts is applied when it starts
+	_, err := Publish(context.Background(), client, testPublished("RulesVersion: 2\n"))
+	require.NoError(t, err)
+
+	cfg := &config.MockConfig{
+		ConfigDistribution: config.ConfigDistributionConfig{Enabled: true, PollInterval: config.Duration(time.Hour)},
+	}
+	d := &Distributor{Config: cfg, Redis: client, Gossip: g, Logger: &logger.NullLogger{}, Metrics: m}
+	require.NoError(t, d.Start())
+	defer d.Stop()
+	assert.Equal(t, uint64(1), cfg.GetConfigEpoch())
+	require.Len(t, cfg.Published, 1)
+	assert.Equal(t, "RulesVersion: 2\n", string(cfg.Published[0].Rules))
+
+	// a new version is applied as soon as it's announced
+	epoch, err := Publish(context.Background(), client, testPublished("RulesVersion: 2\nSamplers: {}\n"))
+	require.NoError(t, err)
+	require.NoError(t, g.Publish(gossipChannel, []byte(strconv.FormatUint(epoch, 10))))
+	require.Eventually(t, func() bool {
+		return cfg.GetConfigEpoch() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	applied, _ := m.Get("config_distribution_applied")
+	assert.Equal(t, float64(2), applied)
+}
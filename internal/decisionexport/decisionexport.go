@@ -0,0 +1,173 @@
+package decisionexport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/startstop"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	defaultQueueSize     = 10_000
+	defaultBatchSize     = 500
+	defaultBatchInterval = time.Second
+	sendTimeout          = 10 * time.Second
+)
+
+// Decision is the final sampling decision for a single trace, in the form
+// that is published to downstream systems.
+type Decision struct {
+	TraceID string `json:"trace_id"`
+	// Dataset is the sampler selector for the trace: the dataset for classic
+	// API keys, or the environment otherwise.
+	Dataset   string    `json:"dataset"`
+	Kept      bool      `json:"kept"`
+	Rate      uint      `json:"rate"`
+	Rule      string    `json:"rule"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Exporter publishes trace decisions to a downstream system. Export must
+// never block the caller.
+type Exporter interface {
+	Export(Decision)
+
+	startstop.Starter
+	startstop.Stopper
+}
+
+// Sink delivers a batch of decisions to a single destination.
+type Sink interface {
+	Send(ctx context.Context, decisions []Decision) error
+}
+
+var _ Exporter = &NullExporter{}
+
+// NullExporter discards all decisions; it is used when decision export is
+// disabled.
+type NullExporter struct{}
+
+func (n *NullExporter) Export(Decision) {}
+func (n *NullExporter) Start() error    { return nil }
+func (n *NullExporter) Stop() error     { return nil }
+
+var _ Exporter = &StreamExporter{}
+
+// StreamExporter queues decisions in memory and sends them to its Sink in
+// batches, either when a batch is full or when the batch interval passes.
+// If the queue is full, decisions are dropped rather than slowing down the
+// collector.
+type StreamExporter struct {
+	Config  config.Config   `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	Clock   clockwork.Clock `inject:""`
+	Sink    Sink            `inject:"decisionSink"`
+
+	queue chan Decision
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func (s *StreamExporter) Start() error {
+	cfg := s.Config.GetDecisionExportConfig()
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	interval := time.Duration(cfg.BatchInterval)
+	if interval <= 0 {
+		interval = defaultBatchInterval
+	}
+
+	s.Metrics.Register("decision_export_sent", "counter")
+	s.Metrics.Register("decision_export_dropped", "counter")
+	s.Metrics.Register("decision_export_errors", "counter")
+	s.Metrics.Register("decision_export_queue_length", "gauge")
+
+	s.queue = make(chan Decision, queueSize)
+	s.done = make(chan struct{})
+
+	s.wg.Add(1)
+	go s.run(batchSize, interval)
+	return nil
+}
+
+// Stop flushes any queued decisions before returning.
+func (s *StreamExporter) Stop() error {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+	return nil
+}
+
+func (s *StreamExporter) Export(d Decision) {
+	select {
+	case s.queue <- d:
+	default:
+		s.Metrics.Increment("decision_export_dropped")
+	}
+}
+
+func (s *StreamExporter) run(batchSize int, interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := s.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]Decision, 0, batchSize)
+	for {
+		select {
+		case d := <-s.queue:
+			batch = append(batch, d)
+			if len(batch) >= batchSize {
+				batch = s.flush(batch)
+			}
+		case <-ticker.Chan():
+			s.Metrics.Gauge("decision_export_queue_length", len(s.queue))
+			batch = s.flush(batch)
+		case <-s.done:
+			for {
+				select {
+				case d := <-s.queue:
+					batch = append(batch, d)
+					if len(batch) >= batchSize {
+						batch = s.flush(batch)
+					}
+				default:
+					s.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush sends the batch to the sink and returns an empty batch that reuses
+// the same backing array.
+func (s *StreamExporter) flush(batch []Decision) []Decision {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	if err := s.Sink.Send(ctx, batch); err != nil {
+		s.Metrics.Count("decision_export_errors", len(batch))
+		s.Logger.Error().WithField("batch_size", len(batch)).Logf("failed to export trace decisions: %s", err)
+	} else {
+		s.Metrics.Count("decision_export_sent", len(batch))
+	}
+	return batch[:0]
+}
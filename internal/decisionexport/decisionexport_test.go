@@ -0,0 +1,176 @@
+package decisionexport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	mut     sync.Mutex
+	batches [][]Decision
+}
+
+func (r *recordingSink) Send(ctx context.Context, decisions []Decision) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.batches = append(r.batches, append([]Decision(nil), decisions...))
+	return nil
+}
+
+func (r *recordingSink) sent() [][]Decision {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.batches
+}
+
+func newTestExporter(cfg config.DecisionExportConfig, sink Sink, clock clockwork.Clock) *StreamExporter {
+	return &StreamExporter{
+		Config:  &config.MockConfig{DecisionExport: cfg},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Clock:   clock,
+		Sink:    sink,
+	}
+}
+
+func TestStreamExporterBatches(t *testing.T) {
+	sink := &recordingSink{}
+	clock := clockwork.NewFakeClock()
+	exp := newTestExporter(config.DecisionExportConfig{
+		BatchSize:     2,
+		BatchInterval: config.Duration(time.Minute),
+	}, sink, clock)
+	require.NoError(t, exp.Start())
+
+	exp.Export(Decision{TraceID: "1"})
+	exp.Export(Decision{TraceID: "2"})
+	exp.Export(Decision{TraceID: "3"})
+
+	// the first two decisions fill a batch and are sent immediately
+	assert.Eventually(t, func() bool { return len(sink.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Len(t, sink.sent()[0], 2)
+
+	// the third is sent when the interval passes
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return len(sink.sent()) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "3", sink.sent()[1][0].TraceID)
+
+	require.NoError(t, exp.Stop())
+}
+
+func TestStreamExporterFlushesOnStop(t *testing.T) {
+	sink := &recordingSink{}
+	exp := newTestExporter(config.DecisionExportConfig{
+		BatchSize:     100,
+		BatchInterval: config.Duration(time.Hour),
+	}, sink, clockwork.NewFakeClock())
+	require.NoError(t, exp.Start())
+
+	for i := 0; i < 10; i++ {
+		exp.Export(Decision{TraceID: "t"})
+	}
+	require.NoError(t, exp.Stop())
+
+	total := 0
+	for _, b := range sink.sent() {
+		total += len(b)
+	}
+	assert.Equal(t, 10, total)
+}
+
+func TestRedisStreamSink(t *testing.T) {
+	cfg := &config.MockConfig{DecisionExport: config.DecisionExportConfig{RedisStream: "decisions", RedisMaxLen: 1000}}
+	client := &redis.TestService{Config: cfg}
+	require.NoError(t, client.Start())
+	defer client.Stop()
+
+	sink := &RedisStreamSink{Config: cfg, Redis: client}
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := sink.Send(context.Background(), []Decision{
+		{TraceID: "abc", Dataset: "ds", Kept: true, Rate: 10, Rule: "rules/1", Timestamp: ts},
+		{TraceID: "def", Dataset: "ds", Kept: false, Rate: 10, Rule: "rules/1", Timestamp: ts},
+	})
+	require.NoError(t, err)
+
+	entries, err := client.Service.Stream("decisions")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(entries[0].Values); i += 2 {
+		fields[entries[0].Values[i]] = entries[0].Values[i+1]
+	}
+	assert.Equal(t, map[string]string{
+		"trace_id":  "abc",
+		"dataset":   "ds",
+		"kept":      "true",
+		"rate":      "10",
+		"rule":      "rules/1",
+		"timestamp": "2024-01-02T03:04:05Z",
+	}, fields)
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received []Decision
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{Config: &config.MockConfig{DecisionExport: config.DecisionExportConfig{WebhookURL: server.URL}}}
+	require.NoError(t, sink.Start())
+
+	err := sink.Send(context.Background(), []Decision{{TraceID: "abc", Kept: true, Rate: 5, Rule: "deterministic/always"}})
+	require.NoError(t, err)
+	require.Len(t, received, 1)
+	assert.Equal(t, "abc", received[0].TraceID)
+	assert.Equal(t, uint(5), received[0].Rate)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	assert.Error(t, sink.Send(context.Background(), []Decision{{TraceID: "abc"}}))
+}
+
+func TestKafkaSink(t *testing.T) {
+	var body map[string][]struct {
+		Key   string   `json:"key"`
+		Value Decision `json:"value"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/decisions", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer server.Close()
+
+	sink := &KafkaSink{Config: &config.MockConfig{DecisionExport: config.DecisionExportConfig{KafkaRESTURL: server.URL, KafkaTopic: "decisions"}}}
+	require.NoError(t, sink.Start())
+
+	err := sink.Send(context.Background(), []Decision{{TraceID: "abc", Kept: true, Rate: 5, Rule: "deterministic/always"}})
+	require.NoError(t, err)
+	require.Len(t, body["records"], 1)
+	assert.Equal(t, "abc", body["records"][0].Key)
+	assert.True(t, body["records"][0].Value.Kept)
+	assert.Equal(t, uint(5), body["records"][0].Value.Rate)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	assert.Error(t, sink.Send(context.Background(), []Decision{{TraceID: "abc"}}))
+}
@@ -0,0 +1,34 @@
+package decisionexport
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/kafkarest"
+)
+
+var _ Sink = &KafkaSink{}
+
+// KafkaSink produces each decision as a JSON message to a Kafka topic,
+// through a Kafka REST Proxy. Messages are keyed by trace ID.
+type KafkaSink struct {
+	Config config.Config `inject:""`
+	Client *http.Client
+}
+
+func (k *KafkaSink) Start() error {
+	if k.Client == nil {
+		k.Client = &http.Client{Timeout: sendTimeout}
+	}
+	return nil
+}
+
+func (k *KafkaSink) Send(ctx context.Context, decisions []Decision) error {
+	cfg := k.Config.GetDecisionExportConfig()
+	msgs := make([]kafkarest.Record, len(decisions))
+	for i, d := range decisions {
+		msgs[i] = kafkarest.Record{Key: d.TraceID, Value: d}
+	}
+	return kafkarest.ProduceJSON(ctx, k.Client, cfg.KafkaRESTURL, cfg.KafkaTopic, msgs)
+}
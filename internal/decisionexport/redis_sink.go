@@ -0,0 +1,41 @@
+package decisionexport
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/redis"
+)
+
+var _ Sink = &RedisStreamSink{}
+
+// RedisStreamSink appends each decision as an entry in a Redis stream.
+type RedisStreamSink struct {
+	Config config.Config `inject:""`
+	Redis  redis.Client  `inject:"redis"`
+}
+
+func (r *RedisStreamSink) Send(ctx context.Context, decisions []Decision) error {
+	cfg := r.Config.GetDecisionExportConfig()
+
+	conn, err := r.Redis.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	commands := make([]redis.Command, 0, len(decisions))
+	for _, d := range decisions {
+		commands = append(commands, redis.NewStreamAddCommand(cfg.RedisStream, cfg.RedisMaxLen, map[string]any{
+			"trace_id":  d.TraceID,
+			"dataset":   d.Dataset,
+			"kept":      strconv.FormatBool(d.Kept),
+			"rate":      d.Rate,
+			"rule":      d.Rule,
+			"timestamp": d.Timestamp.UTC().Format(time.RFC3339Nano),
+		}))
+	}
+	return conn.Exec(commands...)
+}
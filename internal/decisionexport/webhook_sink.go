@@ -0,0 +1,52 @@
+package decisionexport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+var _ Sink = &WebhookSink{}
+
+// WebhookSink POSTs each batch of decisions as a JSON array to a URL.
+type WebhookSink struct {
+	Config config.Config `inject:""`
+	Client *http.Client
+}
+
+func (w *WebhookSink) Start() error {
+	if w.Client == nil {
+		w.Client = &http.Client{Timeout: sendTimeout}
+	}
+	return nil
+}
+
+func (w *WebhookSink) Send(ctx context.Context, decisions []Decision) error {
+	body, err := json.Marshal(decisions)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Config.GetDecisionExportConfig().WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("decision webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
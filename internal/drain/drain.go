@@ -0,0 +1,267 @@
+// Package drain implements maintenance mode, in which a node stops accepting
+// new traces, finishes or forwards the ones it holds, and optionally exits,
+// so that it can be taken out of service without losing data.
+package drain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+// HealthSource is the name that the drainer reports to Health under; it's
+// reported as failed for as long as the node is in maintenance mode, so that
+// load balancers stop sending it traffic.
+const HealthSource = "drain"
+
+// checkInterval is how often the drainer reports to Health and, while
+// draining, checks how many traces are in flight.
+const checkInterval = time.Second
+
+// ErrDraining is returned by Begin when a drain is already in progress.
+var ErrDraining = errors.New("the node is already draining")
+
+// Status describes the progress of a drain.
+type Status struct {
+	Draining bool `json:"draining"`
+	// Done is true once there are no traces left in flight, or they've been
+	// forwarded.
+	Done      bool      `json:"done"`
+	Trigger   string    `json:"trigger,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	Elapsed   string    `json:"elapsed,omitempty"`
+	// InitialInFlight is the number of traces in flight when the drain
+	// began, and InFlight is the number now.
+	InitialInFlight int `json:"initial_in_flight"`
+	InFlight        int `json:"in_flight"`
+	// ForwardedSpans is the number of spans handed to the rest of the
+	// cluster because they weren't decided before the timeout.
+	ForwardedSpans int `json:"forwarded_spans"`
+	// Progress is the fraction of the initial traces that are no longer in
+	// flight, from 0 to 1.
+	Progress     float64 `json:"progress"`
+	ExitWhenDone bool    `json:"exit_when_done"`
+}
+
+// Drainer runs a drain when one is requested through the admin API or by a
+// signal. While draining, Draining returns true, which the router uses to
+// refuse new ingest requests.
+type Drainer struct {
+	Config    config.Config     `inject:""`
+	Logger    logger.Logger     `inject:""`
+	Metrics   metrics.Metrics   `inject:"genericMetrics"`
+	Clock     clockwork.Clock   `inject:""`
+	Health    health.Recorder   `inject:""`
+	Collector collect.Collector `inject:"collector"`
+
+	mut    sync.Mutex
+	status Status
+	// forwarded is true once the current drain has timed out and forwarded
+	// the traces left in flight
+	forwarded bool
+
+	// exit is closed when a drain that should exit is done
+	exit chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (d *Drainer) Start() error {
+	d.exit = make(chan struct{})
+	d.done = make(chan struct{})
+	d.Metrics.Register("drain_active", "gauge")
+	d.Metrics.Register("drain_in_flight", "gauge")
+	d.Metrics.Register("drain_forwarded_spans", "counter")
+
+	d.Health.Register(HealthSource, 5*checkInterval)
+	d.Health.Ready(HealthSource, true)
+
+	d.wg.Add(1)
+	go d.run()
+	return nil
+}
+
+func (d *Drainer) Stop() error {
+	if d.done != nil {
+		close(d.done)
+		d.wg.Wait()
+		d.Health.Unregister(HealthSource)
+	}
+	return nil
+}
+
+// Draining returns true while the node is in maintenance mode.
+func (d *Drainer) Draining() bool {
+	if d == nil {
+		return false
+	}
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.status.Draining
+}
+
+// Exit returns a channel that's closed when a drain that was asked to exit
+// is done.
+func (d *Drainer) Exit() <-chan struct{} {
+	return d.exit
+}
+
+// Status returns the progress of the current drain.
+func (d *Drainer) Status() Status {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.currentStatus()
+}
+
+// currentStatus is Status for callers that hold the lock.
+func (d *Drainer) currentStatus() Status {
+	status := d.status
+	if status.Draining {
+		status.Elapsed = d.Clock.Since(status.StartedAt).Round(time.Second).String()
+	}
+	return status
+}
+
+// Begin puts the node in maintenance mode and starts draining it. The
+// trigger is recorded in the status and logs. If exit is true, the channel
+// returned by Exit is closed once the drain is done.
+func (d *Drainer) Begin(trigger string, exit bool) (Status, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.status.Draining {
+		return d.currentStatus(), ErrDraining
+	}
+	inFlight := d.Collector.InFlight()
+	d.status = Status{
+		Draining:        true,
+		Trigger:         trigger,
+		StartedAt:       d.Clock.Now(),
+		InitialInFlight: inFlight,
+		InFlight:        inFlight,
+		Progress:        progress(inFlight, inFlight),
+		ExitWhenDone:    exit,
+	}
+	d.forwarded = false
+
+	d.Health.Report(HealthSource, health.StatusFailed, "draining")
+	d.Metrics.Gauge("drain_active", 1)
+	d.Logger.Warn().WithField("trigger", trigger).WithField("in_flight", inFlight).WithField("exit_when_done", exit).Logf("drain started; refusing new traces")
+	return d.currentStatus(), nil
+}
+
+// End takes the node out of maintenance mode, stopping any drain in
+// progress; it returns false if the node wasn't draining.
+func (d *Drainer) End() bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if !d.status.Draining {
+		return false
+	}
+	d.status = Status{}
+	d.Health.Ready(HealthSource, true)
+	d.Metrics.Gauge("drain_active", 0)
+	d.Logger.Warn().Logf("drain ended; accepting new traces")
+	return true
+}
+
+func (d *Drainer) run() {
+	defer d.wg.Done()
+
+	ticker := d.Clock.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.Chan():
+			d.check()
+		}
+	}
+}
+
+// check reports the drain's state to Health and, while draining, records the
+// number of traces in flight, forwarding them once the timeout has passed.
+func (d *Drainer) check() {
+	if !d.Draining() {
+		d.Health.Ready(HealthSource, true)
+		return
+	}
+
+	inFlight := d.Collector.InFlight()
+	d.mut.Lock()
+	timedOut := !d.forwarded && inFlight > 0 &&
+		d.Clock.Since(d.status.StartedAt) >= time.Duration(d.Config.GetDrainConfig().Timeout)
+	d.forwarded = d.forwarded || timedOut
+	d.mut.Unlock()
+	if timedOut {
+		d.forward()
+		inFlight = d.Collector.InFlight()
+	}
+	d.Metrics.Gauge("drain_in_flight", inFlight)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	// the drain can be ended while the collector is counting
+	if !d.status.Draining {
+		return
+	}
+	d.status.InFlight = inFlight
+	d.status.Progress = progress(d.status.InitialInFlight, inFlight)
+	// once the traces have been forwarded, any that couldn't be are left
+	// to be forwarded again on shutdown
+	if inFlight > 0 && !d.forwarded {
+		d.Health.Report(HealthSource, health.StatusFailed, fmt.Sprintf("draining; %d traces in flight", inFlight))
+		return
+	}
+	d.Health.Report(HealthSource, health.StatusFailed, "drained")
+	if d.status.Done {
+		return
+	}
+
+	d.status.Done = true
+	d.Logger.Warn().WithField("elapsed", d.Clock.Since(d.status.StartedAt).String()).Logf("drain complete")
+	if d.status.ExitWhenDone {
+		select {
+		case <-d.exit:
+		default:
+			close(d.exit)
+		}
+	}
+}
+
+// forward hands the traces that weren't decided in time to the rest of the
+// cluster.
+func (d *Drainer) forward() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.Config.GetDrainConfig().Timeout))
+	defer cancel()
+	forwarded, err := d.Collector.ForwardInFlight(ctx)
+	if err != nil {
+		d.Logger.Error().Logf("error forwarding traces during drain: %s", err)
+	}
+	d.Metrics.Count("drain_forwarded_spans", forwarded)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.status.ForwardedSpans += forwarded
+}
+
+// progress returns the fraction of the initial in-flight traces that are no
+// longer in flight.
+func progress(initial int, current int) float64 {
+	if current <= 0 {
+		return 1
+	}
+	if initial <= 0 {
+		return 0
+	}
+	return max(0, 1-float64(current)/float64(initial))
+}
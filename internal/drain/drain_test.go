@@ -0,0 +1,118 @@
+package drain
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inFlightCollector only implements the methods that a drain uses.
+type inFlightCollector struct {
+	collect.Collector
+	inFlight atomic.Int64
+	// forwardable is how many of the traces in flight can be forwarded
+	forwardable int64
+}
+
+func (c *inFlightCollector) InFlight() int { return int(c.inFlight.Load()) }
+
+func (c *inFlightCollector) ForwardInFlight(context.Context) (int, error) {
+	c.inFlight.Add(-c.forwardable)
+	return int(c.forwardable) * 3, nil
+}
+
+func newTestDrainer(t *testing.T, collector collect.Collector) (*Drainer, *health.Health, clockwork.FakeClock) {
+	clock := clockwork.NewFakeClock()
+	h := &health.Health{Clock: clock}
+	require.NoError(t, h.Start())
+	t.Cleanup(func() { h.Stop() })
+
+	d := &Drainer{
+		Config:    &config.MockConfig{Drain: config.DrainConfig{Timeout: config.Duration(time.Minute)}},
+		Logger:    &logger.NullLogger{},
+		Metrics:   &metrics.NullMetrics{},
+		Clock:     clock,
+		Health:    h,
+		Collector: collector,
+	}
+	require.NoError(t, d.Start())
+	t.Cleanup(func() { d.Stop() })
+	return d, h, clock
+}
+
+func TestDrain(t *testing.T) {
+	collector := &inFlightCollector{}
+	collector.inFlight.Store(10)
+	d, h, _ := newTestDrainer(t, collector)
+
+	require.False(t, d.Draining())
+	require.True(t, h.IsReady())
+
+	status, err := d.Begin("test", true)
+	require.NoError(t, err)
+	assert.True(t, status.Draining)
+	assert.Equal(t, 10, status.InitialInFlight)
+	assert.True(t, d.Draining())
+	assert.False(t, h.IsReady())
+
+	_, err = d.Begin("test", false)
+	require.ErrorIs(t, err, ErrDraining)
+
+	collector.inFlight.Store(4)
+	d.check()
+	status = d.Status()
+	assert.Equal(t, 4, status.InFlight)
+	assert.InDelta(t, 0.6, status.Progress, 0.001)
+	assert.False(t, status.Done)
+
+	collector.inFlight.Store(0)
+	d.check()
+	assert.True(t, d.Status().Done)
+	select {
+	case <-d.Exit():
+	default:
+		t.Fatal("a drain that should exit didn't signal it")
+	}
+
+	// ending the drain makes the node ready again
+	require.True(t, d.End())
+	assert.False(t, d.Draining())
+	d.check()
+	assert.True(t, h.IsReady())
+	assert.False(t, d.End())
+}
+
+func TestDrainForwardsAfterTimeout(t *testing.T) {
+	collector := &inFlightCollector{forwardable: 3}
+	collector.inFlight.Store(5)
+	d, _, clock := newTestDrainer(t, collector)
+
+	_, err := d.Begin("test", false)
+	require.NoError(t, err)
+	d.check()
+	assert.Zero(t, d.Status().ForwardedSpans)
+
+	// traces that couldn't be forwarded don't hold up the drain
+	clock.Advance(time.Minute)
+	d.check()
+	status := d.Status()
+	assert.Equal(t, 9, status.ForwardedSpans)
+	assert.Equal(t, 2, status.InFlight)
+	assert.True(t, status.Done)
+	assert.True(t, d.Draining())
+	select {
+	case <-d.Exit():
+		t.Fatal("a drain that shouldn't exit signaled it")
+	default:
+	}
+}
@@ -0,0 +1,263 @@
+package dropaudit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/startstop"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	defaultInterval = time.Minute
+	defaultRecords  = 100
+	sendTimeout     = 10 * time.Second
+
+	// maxGroups bounds the number of dataset and rule pairs counted in one
+	// interval; once it is reached, drops for new pairs are counted under
+	// OtherKey.
+	maxGroups = 10_000
+)
+
+// OtherKey is the dataset and rule of the record that combines the drops
+// that don't fit in the records of an interval.
+const OtherKey = "_other"
+
+// Record summarizes the traces that one rule dropped in one dataset (or
+// environment) during an interval.
+type Record struct {
+	Dataset         string    `json:"dataset"`
+	Rule            string    `json:"rule"`
+	Count           int64     `json:"count"`
+	ExampleTraceIDs []string  `json:"example_trace_ids,omitempty"`
+	IntervalStart   time.Time `json:"interval_start"`
+	IntervalEnd     time.Time `json:"interval_end"`
+	Host            string    `json:"host,omitempty"`
+}
+
+// Auditor counts dropped traces and periodically writes a summary of them.
+// RecordDrop must never block the caller.
+type Auditor interface {
+	RecordDrop(dataset string, rule string, traceID string)
+
+	startstop.Starter
+	startstop.Stopper
+}
+
+// Sink delivers the records of one interval to a single destination.
+type Sink interface {
+	Send(ctx context.Context, records []Record) error
+}
+
+var _ Auditor = &NullAuditor{}
+
+// NullAuditor discards all drops; it is used when the audit stream is
+// disabled.
+type NullAuditor struct{}
+
+func (n *NullAuditor) RecordDrop(string, string, string) {}
+func (n *NullAuditor) Start() error                      { return nil }
+func (n *NullAuditor) Stop() error                       { return nil }
+
+type groupKey struct {
+	dataset string
+	rule    string
+}
+
+var _ Auditor = &StreamAuditor{}
+
+// StreamAuditor counts drops for each dataset and rule in memory, and sends
+// one record for each of them to its Sink at the end of every interval. The
+// number and total size of the records sent in an interval are capped, so
+// the stream stays small however much is dropped.
+type StreamAuditor struct {
+	Config  config.Config   `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	Clock   clockwork.Clock `inject:""`
+	Sink    Sink            `inject:"dropAuditSink"`
+
+	mut    sync.Mutex
+	groups map[groupKey]*Record
+	start  time.Time
+
+	maxExamples int
+	host        string
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func (s *StreamAuditor) Start() error {
+	s.Metrics.Register("drop_audit_records_sent", "counter")
+	s.Metrics.Register("drop_audit_records_truncated", "counter")
+	s.Metrics.Register("drop_audit_errors", "counter")
+
+	if hostname, err := os.Hostname(); err == nil {
+		s.host = hostname
+	}
+	s.maxExamples = s.Config.GetDropAuditConfig().MaxExampleTraceIDs
+	s.groups = make(map[groupKey]*Record)
+	s.start = s.Clock.Now()
+
+	interval := time.Duration(s.Config.GetDropAuditConfig().Interval)
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.run(interval)
+	return nil
+}
+
+// Stop sends the records of the current interval before returning.
+func (s *StreamAuditor) Stop() error {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+	return nil
+}
+
+func (s *StreamAuditor) RecordDrop(dataset string, rule string, traceID string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	key := groupKey{dataset: dataset, rule: rule}
+	rec, ok := s.groups[key]
+	if !ok {
+		if len(s.groups) >= maxGroups {
+			key = groupKey{dataset: OtherKey, rule: OtherKey}
+			rec, ok = s.groups[key]
+		}
+		if !ok {
+			rec = &Record{Dataset: key.dataset, Rule: key.rule}
+			s.groups[key] = rec
+		}
+	}
+	rec.Count++
+	if len(rec.ExampleTraceIDs) < s.maxExamples {
+		rec.ExampleTraceIDs = append(rec.ExampleTraceIDs, traceID)
+	}
+}
+
+func (s *StreamAuditor) run(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := s.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+			s.flush()
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends the records of the interval that just ended and starts a new
+// one.
+func (s *StreamAuditor) flush() {
+	end := s.Clock.Now()
+	s.mut.Lock()
+	groups := s.groups
+	start := s.start
+	s.groups = make(map[groupKey]*Record)
+	s.start = end
+	s.mut.Unlock()
+
+	if len(groups) == 0 {
+		return
+	}
+	records, truncated := s.limit(groups, start, end)
+	if truncated > 0 {
+		s.Metrics.Count("drop_audit_records_truncated", truncated)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := s.Sink.Send(ctx, records); err != nil {
+		s.Metrics.Count("drop_audit_errors", len(records))
+		s.Logger.Error().WithField("records", len(records)).Logf("failed to send drop audit records: %s", err)
+		return
+	}
+	s.Metrics.Count("drop_audit_records_sent", len(records))
+}
+
+// limit returns the records to send for an interval, those with the most
+// drops first, keeping within MaxRecords and MaxBytes. Records past
+// MaxRecords are combined into one OtherKey record; records past MaxBytes
+// aren't sent, and their number is returned.
+func (s *StreamAuditor) limit(groups map[groupKey]*Record, start time.Time, end time.Time) ([]Record, int) {
+	cfg := s.Config.GetDropAuditConfig()
+	maxRecords := cfg.MaxRecords
+	if maxRecords <= 0 {
+		maxRecords = defaultRecords
+	}
+
+	// drops already counted under OtherKey, because there were too many
+	// groups, go in the same record as those that don't fit
+	var other *Record
+	records := make([]Record, 0, len(groups))
+	for key, rec := range groups {
+		if key.dataset == OtherKey && key.rule == OtherKey {
+			other = &Record{Dataset: OtherKey, Rule: OtherKey, Count: rec.Count, ExampleTraceIDs: rec.ExampleTraceIDs}
+			continue
+		}
+		records = append(records, *rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Count != records[j].Count {
+			return records[i].Count > records[j].Count
+		}
+		if records[i].Dataset != records[j].Dataset {
+			return records[i].Dataset < records[j].Dataset
+		}
+		return records[i].Rule < records[j].Rule
+	})
+
+	if len(records) > maxRecords || (other != nil && len(records) >= maxRecords) {
+		if other == nil {
+			other = &Record{Dataset: OtherKey, Rule: OtherKey}
+		}
+		for _, rec := range records[maxRecords-1:] {
+			other.Count += rec.Count
+			for _, id := range rec.ExampleTraceIDs {
+				if len(other.ExampleTraceIDs) < s.maxExamples {
+					other.ExampleTraceIDs = append(other.ExampleTraceIDs, id)
+				}
+			}
+		}
+		records = records[:maxRecords-1]
+	}
+	if other != nil {
+		records = append(records, *other)
+	}
+
+	var size int
+	for i := range records {
+		records[i].IntervalStart = start
+		records[i].IntervalEnd = end
+		records[i].Host = s.host
+		if cfg.MaxBytes <= 0 {
+			continue
+		}
+		encoded, err := json.Marshal(records[i])
+		if err != nil {
+			continue
+		}
+		size += len(encoded)
+		if size > int(cfg.MaxBytes) {
+			return records[:i], len(records) - i
+		}
+	}
+	return records, 0
+}
@@ -0,0 +1,150 @@
+package dropaudit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	mut     sync.Mutex
+	batches [][]Record
+}
+
+func (r *recordingSink) Send(ctx context.Context, records []Record) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.batches = append(r.batches, append([]Record(nil), records...))
+	return nil
+}
+
+func (r *recordingSink) sent() [][]Record {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.batches
+}
+
+func newTestAuditor(cfg config.DropAuditConfig, sink Sink, clock clockwork.Clock) *StreamAuditor {
+	return &StreamAuditor{
+		Config:  &config.MockConfig{DropAudit: cfg},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Clock:   clock,
+		Sink:    sink,
+	}
+}
+
+func TestStreamAuditorSummarizesEachInterval(t *testing.T) {
+	sink := &recordingSink{}
+	clock := clockwork.NewFakeClock()
+	a := newTestAuditor(config.DropAuditConfig{
+		Interval:           config.Duration(time.Minute),
+		MaxExampleTraceIDs: 2,
+	}, sink, clock)
+	require.NoError(t, a.Start())
+	start := clock.Now()
+
+	a.RecordDrop("ds1", "rule A", "t1")
+	a.RecordDrop("ds1", "rule A", "t2")
+	a.RecordDrop("ds1", "rule A", "t3")
+	a.RecordDrop("ds2", "rule B", "t4")
+
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return len(sink.sent()) == 1
+	}, time.Second, 5*time.Millisecond)
+	records := sink.sent()[0]
+	require.Len(t, records, 2)
+	assert.Equal(t, "ds1", records[0].Dataset)
+	assert.Equal(t, "rule A", records[0].Rule)
+	assert.Equal(t, int64(3), records[0].Count)
+	assert.Equal(t, []string{"t1", "t2"}, records[0].ExampleTraceIDs)
+	assert.Equal(t, start, records[0].IntervalStart)
+	assert.True(t, records[0].IntervalEnd.After(start))
+	assert.Equal(t, int64(1), records[1].Count)
+
+	// intervals without drops send nothing, and drops are sent on stop
+	a.RecordDrop("ds1", "rule A", "t5")
+	require.NoError(t, a.Stop())
+	require.Len(t, sink.sent(), 2)
+	assert.Equal(t, int64(1), sink.sent()[1][0].Count)
+}
+
+func TestStreamAuditorLimits(t *testing.T) {
+	a := newTestAuditor(config.DropAuditConfig{MaxRecords: 2, MaxExampleTraceIDs: 1}, nil, clockwork.NewFakeClock())
+	a.maxExamples = 1
+	groups := map[groupKey]*Record{
+		{"ds1", "a"}: {Dataset: "ds1", Rule: "a", Count: 10, ExampleTraceIDs: []string{"t1"}},
+		{"ds2", "b"}: {Dataset: "ds2", Rule: "b", Count: 5, ExampleTraceIDs: []string{"t2"}},
+		{"ds3", "c"}: {Dataset: "ds3", Rule: "c", Count: 1, ExampleTraceIDs: []string{"t3"}},
+	}
+
+	// the records with fewest drops are combined
+	records, truncated := a.limit(groups, time.Time{}, time.Time{})
+	assert.Zero(t, truncated)
+	require.Len(t, records, 2)
+	assert.Equal(t, "ds1", records[0].Dataset)
+	assert.Equal(t, Record{Dataset: OtherKey, Rule: OtherKey, Count: 6, ExampleTraceIDs: []string{"t2"}}, records[1])
+
+	// records past the size limit aren't sent
+	a.Config = &config.MockConfig{DropAudit: config.DropAuditConfig{MaxRecords: 10, MaxBytes: 250}}
+	records, truncated = a.limit(groups, time.Time{}, time.Time{})
+	assert.Len(t, records, 1)
+	assert.Equal(t, 2, truncated)
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink := &FileSink{Config: &config.MockConfig{DropAudit: config.DropAuditConfig{FilePath: path, MaxFileSize: 300}}}
+	require.NoError(t, sink.Start())
+
+	rec := Record{Dataset: "ds", Rule: "rule", Count: 1}
+	require.NoError(t, sink.Send(context.Background(), []Record{rec, rec}))
+	require.NoError(t, sink.Send(context.Background(), []Record{rec}))
+	require.NoError(t, sink.Stop())
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(rotated)), "\n"), 2)
+	lines := strings.Split(strings.TrimSpace(string(current)), "\n")
+	require.Len(t, lines, 1)
+	var got Record
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &got))
+	assert.Equal(t, "ds", got.Dataset)
+}
+
+func TestKafkaSink(t *testing.T) {
+	var body map[string][]struct {
+		Key   string `json:"key"`
+		Value Record `json:"value"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/drops", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer server.Close()
+
+	sink := &KafkaSink{Config: &config.MockConfig{DropAudit: config.DropAuditConfig{KafkaRESTURL: server.URL + "/", KafkaTopic: "drops"}}}
+	require.NoError(t, sink.Start())
+	require.NoError(t, sink.Send(context.Background(), []Record{{Dataset: "ds", Rule: "rule", Count: 3}}))
+	require.Len(t, body["records"], 1)
+	assert.Equal(t, "ds", body["records"][0].Key)
+	assert.Equal(t, int64(3), body["records"][0].Value.Count)
+}
@@ -0,0 +1,98 @@
+package dropaudit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+var _ Sink = &FileSink{}
+
+// FileSink appends each record to a file as a line of JSON. When the file
+// reaches MaxFileSize, it's renamed with a .1 suffix and a new one started,
+// so at most two files' worth of records are kept.
+type FileSink struct {
+	Config config.Config `inject:""`
+
+	mut  sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func (f *FileSink) Start() error {
+	f.path = f.Config.GetDropAuditConfig().FilePath
+	if f.path == "" {
+		return errors.New("DropAudit.FilePath must be set when DropAudit.Type is file")
+	}
+	return f.open()
+}
+
+func (f *FileSink) Stop() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileSink) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *FileSink) Send(ctx context.Context, records []Record) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.file == nil {
+		return errors.New("drop audit file is closed")
+	}
+
+	maxSize := int64(f.Config.GetDropAuditConfig().MaxFileSize)
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > maxSize {
+			if err := f.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := f.file.Write(line)
+		f.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
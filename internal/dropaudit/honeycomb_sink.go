@@ -0,0 +1,42 @@
+package dropaudit
+
+import (
+	"context"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+)
+
+var _ Sink = &HoneycombSink{}
+
+// HoneycombSink sends each record as an event to a Honeycomb dataset, through
+// the upstream transmission.
+type HoneycombSink struct {
+	Config       config.Config         `inject:""`
+	Transmission transmit.Transmission `inject:"upstreamTransmission"`
+}
+
+func (h *HoneycombSink) Send(ctx context.Context, records []Record) error {
+	cfg := h.Config.GetDropAuditConfig()
+	apiHost := h.Config.GetHoneycombAPI()
+	for _, rec := range records {
+		h.Transmission.EnqueueEvent(&types.Event{
+			Context:    ctx,
+			APIHost:    apiHost,
+			APIKey:     cfg.APIKey,
+			Dataset:    cfg.Dataset,
+			SampleRate: 1,
+			Timestamp:  rec.IntervalEnd,
+			Data: map[string]interface{}{
+				"dataset":           rec.Dataset,
+				"rule":              rec.Rule,
+				"count":             rec.Count,
+				"example_trace_ids": rec.ExampleTraceIDs,
+				"interval_start":    rec.IntervalStart,
+				"host":              rec.Host,
+			},
+		})
+	}
+	return nil
+}
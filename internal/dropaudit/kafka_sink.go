@@ -0,0 +1,35 @@
+package dropaudit
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/kafkarest"
+)
+
+var _ Sink = &KafkaSink{}
+
+// KafkaSink produces each record as a JSON message to a Kafka topic, through
+// a Kafka REST Proxy. Messages are keyed by dataset, so that the records of
+// a dataset stay in order within a partition.
+type KafkaSink struct {
+	Config config.Config `inject:""`
+	Client *http.Client
+}
+
+func (k *KafkaSink) Start() error {
+	if k.Client == nil {
+		k.Client = &http.Client{Timeout: sendTimeout}
+	}
+	return nil
+}
+
+func (k *KafkaSink) Send(ctx context.Context, records []Record) error {
+	cfg := k.Config.GetDropAuditConfig()
+	msgs := make([]kafkarest.Record, len(records))
+	for i, rec := range records {
+		msgs[i] = kafkarest.Record{Key: rec.Dataset, Value: rec}
+	}
+	return kafkarest.ProduceJSON(ctx, k.Client, cfg.KafkaRESTURL, cfg.KafkaTopic, msgs)
+}
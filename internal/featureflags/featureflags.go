@@ -0,0 +1,172 @@
+// Package featureflags gates new behaviors behind named flags, so that they
+// can be rolled out across a cluster a step at a time without redeploying the
+// config. Flags are defined in the config, and can be overridden at runtime;
+// each override is published to every node in the cluster.
+package featureflags
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+// gossipChannel is the gossip channel that overrides are published on. Each
+// message is name=true, name=false, or name= to clear an override.
+const gossipChannel = "feature_flags"
+
+// ErrInvalidName is returned for a flag name that can't be published.
+var ErrInvalidName = errors.New("invalid feature flag name")
+
+// Flag is the state of one flag on this node.
+type Flag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Configured is the flag's value in the config, which applies when it
+	// isn't overridden.
+	Configured bool `json:"configured"`
+	Overridden bool `json:"overridden"`
+}
+
+// Flags reports whether each feature flag is enabled.
+type Flags struct {
+	Config  config.Config   `inject:""`
+	Gossip  gossip.Gossiper `inject:"gossip"`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+
+	mut       sync.RWMutex
+	overrides map[string]bool
+	done      chan struct{}
+}
+
+func (f *Flags) Start() error {
+	f.overrides = make(map[string]bool)
+	f.done = make(chan struct{})
+	f.Metrics.Register("feature_flag_overrides", "gauge")
+
+	go f.watch(f.Gossip.Subscribe(gossipChannel, 20))
+	return nil
+}
+
+func (f *Flags) Stop() error {
+	if f.done != nil {
+		close(f.done)
+	}
+	return nil
+}
+
+// Enabled returns true if the named flag is enabled. A flag that isn't
+// defined is disabled.
+func (f *Flags) Enabled(name string) bool {
+	f.mut.RLock()
+	enabled, ok := f.overrides[name]
+	f.mut.RUnlock()
+	if ok {
+		return enabled
+	}
+	return f.Config.GetFeatureFlags()[name]
+}
+
+// List returns every flag that is defined in the config or overridden,
+// sorted by name.
+func (f *Flags) List() []Flag {
+	configured := f.Config.GetFeatureFlags()
+
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+
+	flags := make([]Flag, 0, len(configured)+len(f.overrides))
+	for name, enabled := range configured {
+		flag := Flag{Name: name, Enabled: enabled, Configured: enabled}
+		if override, ok := f.overrides[name]; ok {
+			flag.Enabled, flag.Overridden = override, true
+		}
+		flags = append(flags, flag)
+	}
+	for name, enabled := range f.overrides {
+		if _, ok := configured[name]; !ok {
+			flags = append(flags, Flag{Name: name, Enabled: enabled, Overridden: true})
+		}
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// Override sets a flag on every node in the cluster, regardless of the
+// config, until the override is cleared or the node restarts.
+func (f *Flags) Override(name string, enabled bool) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	f.apply(name, strconv.FormatBool(enabled))
+	return f.Gossip.Publish(gossipChannel, []byte(name+"="+strconv.FormatBool(enabled)))
+}
+
+// Clear removes the override of a flag on every node in the cluster, so that
+// its config value applies again.
+func (f *Flags) Clear(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	f.apply(name, "")
+	return f.Gossip.Publish(gossipChannel, []byte(name+"="))
+}
+
+func validName(name string) error {
+	if name == "" || strings.ContainsAny(name, "=\n") {
+		return fmt.Errorf("%w '%s'", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// watch applies the overrides published by other nodes. A node also receives
+// its own overrides, which it has already applied.
+func (f *Flags) watch(overrides chan []byte) {
+	for {
+		select {
+		case <-f.done:
+			return
+		case msg := <-overrides:
+			name, value, found := strings.Cut(string(msg), "=")
+			if !found || validName(name) != nil {
+				f.Logger.Error().WithString("message", string(msg)).Logf("ignoring invalid feature flag override")
+				continue
+			}
+			f.apply(name, value)
+		}
+	}
+}
+
+// apply sets or, if value is empty, clears the override of a flag.
+func (f *Flags) apply(name string, value string) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if value == "" {
+		if _, ok := f.overrides[name]; !ok {
+			return
+		}
+		delete(f.overrides, name)
+		f.Logger.Info().WithString("flag", name).Logf("feature flag override cleared")
+	} else {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			f.Logger.Error().WithString("flag", name).WithString("value", value).Logf("ignoring invalid feature flag override")
+			return
+		}
+		if current, ok := f.overrides[name]; ok && current == enabled {
+			return
+		}
+		f.overrides[name] = enabled
+		f.Logger.Info().WithString("flag", name).WithField("enabled", enabled).Logf("feature flag overridden")
+	}
+	f.Metrics.Gauge("feature_flag_overrides", len(f.overrides))
+}
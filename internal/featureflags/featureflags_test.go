@@ -0,0 +1,58 @@
+package featureflags
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+func TestFlags(t *testing.T) {
+	m := &metrics.MockMetrics{}
+	m.Start()
+	g := &gossip.InMemoryGossip{Logger: &logger.NullLogger{}, Metrics: m}
+	require.NoError(t, g.Start())
+	defer g.Stop()
+
+	// two nodes of a cluster that share the gossip channels
+	cfg := &config.MockConfig{FeatureFlags: map[string]bool{"on": true, "off": false}}
+	nodes := make([]*Flags, 2)
+	for i := range nodes {
+		nodes[i] = &Flags{Config: cfg, Gossip: g, Logger: &logger.NullLogger{}, Metrics: m}
+		require.NoError(t, nodes[i].Start())
+		defer nodes[i].Stop()
+	}
+	a, b := nodes[0], nodes[1]
+
+	assert.True(t, a.Enabled("on"))
+	assert.False(t, a.Enabled("off"))
+	assert.False(t, a.Enabled("undefined"))
+
+	// an override applies at once on the node that made it, and on the other
+	// nodes when it arrives
+	require.NoError(t, a.Override("off", true))
+	assert.True(t, a.Enabled("off"))
+	require.Eventually(t, func() bool { return b.Enabled("off") }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, a.Override("new", true))
+	require.Eventually(t, func() bool { return b.Enabled("new") }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []Flag{
+		{Name: "new", Enabled: true, Overridden: true},
+		{Name: "off", Enabled: true, Configured: false, Overridden: true},
+		{Name: "on", Enabled: true, Configured: true},
+	}, b.List())
+
+	// clearing an override restores the config value everywhere
+	require.NoError(t, b.Clear("off"))
+	assert.False(t, b.Enabled("off"))
+	require.Eventually(t, func() bool { return !a.Enabled("off") }, time.Second, 10*time.Millisecond)
+
+	assert.ErrorIs(t, a.Override("bad=name", true), ErrInvalidName)
+	assert.ErrorIs(t, a.Clear(""), ErrInvalidName)
+}
@@ -2,8 +2,13 @@ package gossip
 
 import (
 	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/facebookgo/startstop"
+	"github.com/honeycombio/refinery/metrics"
 )
 
 // Gossiper is an interface for broadcasting messages to all receivers
@@ -24,16 +29,121 @@ type Gossiper interface {
 type message struct {
 	key  string
 	data []byte
+	// publishedAt is when the sender published the message; it is zero
+	// unless the sender was asked to record it
+	publishedAt time.Time
 }
 
+// ToBytes encodes the message as key:data. If the publish time is known, it
+// is added to the key as key@unixnanos. Releases before publish times were
+// added route messages by the whole key, so they drop messages that carry a
+// time; senders only add it when told that every node understands it.
 func (m message) ToBytes() []byte {
-	return append([]byte(m.key+":"), m.data...)
+	key := m.key
+	if !m.publishedAt.IsZero() {
+		key += "@" + strconv.FormatInt(m.publishedAt.UnixNano(), 10)
+	}
+	return append([]byte(key+":"), m.data...)
 }
 
 func newMessageFromBytes(b []byte) message {
 	splits := bytes.SplitN(b, []byte(":"), 2)
-	return message{
+	msg := message{
 		key:  string(splits[0]),
 		data: splits[1],
 	}
+	if key, ts, found := strings.Cut(msg.key, "@"); found {
+		if nanos, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			msg.key = key
+			msg.publishedAt = time.Unix(0, nanos)
+		}
+	}
+	return msg
+}
+
+// channelMetrics records throughput and lag for each gossip channel. Channels
+// are created by whoever uses them, so their metrics are registered when this
+// node first subscribes or publishes to each one. Messages received for other
+// channels are counted together, so that what arrives over the wire can't
+// create new metrics.
+type channelMetrics struct {
+	metrics    metrics.Metrics
+	lock       sync.Mutex
+	registered map[string]string
+}
+
+func newChannelMetrics(m metrics.Metrics) *channelMetrics {
+	m.Register("gossip_handler_latency_ms", "histogram")
+	m.Register("gossip_unknown_channel_received", "counter")
+	return &channelMetrics{
+		metrics:    m,
+		registered: make(map[string]string),
+	}
+}
+
+// register registers the metrics for a channel, if they aren't already.
+func (c *channelMetrics) register(channel string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.registered[channel]; ok {
+		return
+	}
+	prefix := "gossip_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, channel) + "_"
+	c.metrics.Register(prefix+"published", "counter")
+	c.metrics.Register(prefix+"published_bytes", "counter")
+	c.metrics.Register(prefix+"received", "counter")
+	c.metrics.Register(prefix+"received_bytes", "counter")
+	c.metrics.Register(prefix+"dropped", "counter")
+	c.metrics.Register(prefix+"lag_ms", "histogram")
+	c.registered[channel] = prefix
+}
+
+// prefix returns the metric name prefix for a channel, and whether its
+// metrics have been registered.
+func (c *channelMetrics) prefix(channel string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prefix, ok := c.registered[channel]
+	return prefix, ok
+}
+
+func (c *channelMetrics) published(msg message) {
+	c.register(msg.key)
+	prefix, _ := c.prefix(msg.key)
+	c.metrics.Increment(prefix + "published")
+	c.metrics.Count(prefix+"published_bytes", len(msg.data))
+}
+
+// received records a message arriving at now. The lag is only an estimate,
+// since it depends on the clocks of the sender and receiver agreeing.
+func (c *channelMetrics) received(msg message, now time.Time) {
+	prefix, ok := c.prefix(msg.key)
+	if !ok {
+		c.metrics.Increment("gossip_unknown_channel_received")
+		return
+	}
+	c.metrics.Increment(prefix + "received")
+	c.metrics.Count(prefix+"received_bytes", len(msg.data))
+	if !msg.publishedAt.IsZero() {
+		c.metrics.Histogram(prefix+"lag_ms", float64(now.Sub(msg.publishedAt))/float64(time.Millisecond))
+	}
+}
+
+// dropped records a message that a subscriber had no room for.
+func (c *channelMetrics) dropped(channel string) {
+	if prefix, ok := c.prefix(channel); ok {
+		c.metrics.Increment(prefix + "dropped")
+	}
+}
+
+// handled records how long it took to hand a received message to its
+// subscribers.
+func (c *channelMetrics) handled(start time.Time) {
+	c.metrics.Histogram("gossip_handler_latency_ms", float64(time.Since(start))/float64(time.Millisecond))
 }
@@ -3,17 +3,25 @@ package gossip
 import (
 	"errors"
 	"sync"
+	"time"
 
+	"github.com/honeycombio/refinery/internal/supervisor"
 	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
 	"golang.org/x/sync/errgroup"
 )
 
 // InMemoryGossip is a Gossiper that uses an in-memory channel
 type InMemoryGossip struct {
-	Logger        logger.Logger `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	// Supervisor restarts the listener if it panics
+	Supervisor    *supervisor.Supervisor `inject:""`
 	gossipCh      chan []byte
 	subscriptions map[string][]chan []byte
 
+	channelMetrics *channelMetrics
+
 	done chan struct{}
 	mut  sync.RWMutex
 	eg   *errgroup.Group
@@ -22,16 +30,21 @@ type InMemoryGossip struct {
 var _ Gossiper = &InMemoryGossip{}
 
 func (g *InMemoryGossip) Publish(channel string, value []byte) error {
+	// messages never leave this process, so they can always carry the time
 	msg := message{
-		key:  channel,
-		data: value,
+		key:         channel,
+		data:        value,
+		publishedAt: time.Now(),
 	}
+	g.channelMetrics.register(channel)
 
 	select {
 	case <-g.done:
 		return errors.New("gossip has been stopped")
 	case g.gossipCh <- msg.ToBytes():
+		g.channelMetrics.published(msg)
 	default:
+		g.channelMetrics.dropped(channel)
 		g.Logger.Warn().WithFields(map[string]interface{}{
 			"channel": channel,
 			"msg":     string(value),
@@ -47,6 +60,7 @@ func (g *InMemoryGossip) Subscribe(channel string, depth int) chan []byte {
 	default:
 	}
 
+	g.channelMetrics.register(channel)
 	ch := make(chan []byte, depth)
 	g.mut.Lock()
 	g.subscriptions[channel] = append(g.subscriptions[channel], ch)
@@ -60,33 +74,48 @@ func (g *InMemoryGossip) Start() error {
 	g.eg = &errgroup.Group{}
 	g.subscriptions = make(map[string][]chan []byte)
 	g.done = make(chan struct{})
+	g.channelMetrics = newChannelMetrics(g.Metrics)
 
-	g.eg.Go(func() error {
+	g.eg.Go(g.Supervisor.Wrap("gossip_listener", func() error {
 		for {
 			select {
 			case <-g.done:
 				return nil
-			case value := <-g.gossipCh:
-				msg := newMessageFromBytes(value)
-				g.mut.RLock()
-				for _, ch := range g.subscriptions[msg.key] {
-					select {
-					case ch <- msg.data:
-					default:
-						g.Logger.Warn().WithFields(map[string]interface{}{
-							"channel": msg.key,
-							"msg":     string(msg.data),
-						}).Logf("Unable to forward message")
-					}
+			case value, ok := <-g.gossipCh:
+				// Stop closes the channel as well as done, and either can
+				// be seen first
+				if !ok {
+					return nil
 				}
-				g.mut.RUnlock()
+				start := time.Now()
+				msg := newMessageFromBytes(value)
+				g.channelMetrics.received(msg, start)
+				g.forward(msg)
+				g.channelMetrics.handled(start)
 			}
 		}
-	})
+	}))
 
 	return nil
 }
 
+// forward sends a message to its channel's subscribers.
+func (g *InMemoryGossip) forward(msg message) {
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	for _, ch := range g.subscriptions[msg.key] {
+		select {
+		case ch <- msg.data:
+		default:
+			g.channelMetrics.dropped(msg.key)
+			g.Logger.Warn().WithFields(map[string]interface{}{
+				"channel": msg.key,
+				"msg":     string(msg.data),
+			}).Logf("Unable to forward message")
+		}
+	}
+}
+
 func (g *InMemoryGossip) Stop() error {
 	close(g.done)
 	close(g.gossipCh)
@@ -3,16 +3,31 @@ package gossip
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/facebookgo/startstop"
+	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/supervisor"
 	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/redis"
 	"golang.org/x/sync/errgroup"
 )
 
 const gossipRedisHealth = "gossip-redis"
 
+// RedisChannel is the Redis pub/sub channel that carries the messages of
+// every gossip channel.
+const RedisChannel = "refinery-gossip"
+
+// EncodeMessage returns a message for a gossip channel as it's published to
+// RedisChannel, so that it can be published by something other than a
+// Gossiper, such as a Lua script.
+func EncodeMessage(channel string, data []byte) []byte {
+	return message{key: channel, data: data}.ToBytes()
+}
+
 var _ Gossiper = &GossipRedis{}
 
 // GossipRedis is a Gossiper that uses Redis as the transport
@@ -20,10 +35,16 @@ var _ Gossiper = &GossipRedis{}
 // It multiplexes messages to subscribers based on the channel
 // name.
 type GossipRedis struct {
-	Redis  redis.Client    `inject:"redis"`
-	Logger logger.Logger   `inject:""`
-	Health health.Recorder `inject:""`
-	eg     *errgroup.Group
+	Config  config.Config   `inject:""`
+	Redis   redis.Client    `inject:"redis"`
+	Logger  logger.Logger   `inject:""`
+	Health  health.Recorder `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	// Supervisor restarts the listener if it panics
+	Supervisor *supervisor.Supervisor `inject:""`
+	eg         *errgroup.Group
+
+	channelMetrics *channelMetrics
 
 	lock          sync.RWMutex
 	subscriptions map[string][]chan []byte
@@ -40,17 +61,21 @@ func (g *GossipRedis) Start() error {
 	g.eg = &errgroup.Group{}
 	g.done = make(chan struct{})
 	g.subscriptions = make(map[string][]chan []byte)
+	g.channelMetrics = newChannelMetrics(g.Metrics)
 
 	g.Health.Register(gossipRedisHealth, redis.HealthCheckPeriod*5)
 
-	g.eg.Go(func() error {
+	g.eg.Go(g.Supervisor.Wrap("gossip_listener", func() error {
 		for {
 			select {
 			case <-g.done:
 				return nil
 			default:
 				err := g.Redis.ListenPubSubChannels(nil, func(channel string, b []byte) {
+					start := time.Now()
 					msg := newMessageFromBytes(b)
+					g.channelMetrics.received(msg, start)
+					defer g.channelMetrics.handled(start)
 					g.lock.RLock()
 					chans := g.subscriptions[msg.key]
 					g.lock.RUnlock()
@@ -59,13 +84,14 @@ func (g *GossipRedis) Start() error {
 						select {
 						case ch <- msg.data:
 						default:
+							g.channelMetrics.dropped(msg.key)
 							g.Logger.Warn().WithFields(map[string]interface{}{
 								"channel": msg.key,
 								"msg":     string(msg.data),
 							}).Logf("Unable to forward message")
 						}
 					}
-				}, g.onHealthCheck, g.done, "refinery-gossip")
+				}, g.onHealthCheck, g.done, RedisChannel)
 				if err != nil {
 					g.Logger.Warn().Logf("Error listening to refinery-gossip channel: %v", err)
 				}
@@ -73,7 +99,7 @@ func (g *GossipRedis) Start() error {
 			}
 		}
 
-	})
+	}))
 
 	return nil
 }
@@ -93,6 +119,7 @@ func (g *GossipRedis) Subscribe(channel string, depth int) chan []byte {
 	default:
 	}
 
+	g.channelMetrics.register(channel)
 	ch := make(chan []byte, depth)
 	g.lock.Lock()
 	defer g.lock.Unlock()
@@ -116,8 +143,15 @@ func (g *GossipRedis) Publish(channel string, value []byte) error {
 		key:  channel,
 		data: value,
 	}
+	if g.Config.GetCollectionConfig().GossipPublishTimes {
+		msg.publishedAt = time.Now()
+	}
 
-	return conn.Publish("refinery-gossip", msg.ToBytes())
+	if err := conn.Publish(RedisChannel, msg.ToBytes()); err != nil {
+		return err
+	}
+	g.channelMetrics.published(msg)
+	return nil
 }
 
 func (g *GossipRedis) onHealthCheck(data string) {
@@ -16,7 +16,8 @@ import (
 
 func TestRoundTripChanRedis(t *testing.T) {
 	cfg := config.MockConfig{
-		GetRedisHostVal: "localhost:6379",
+		GetRedisHostVal:        "localhost:6379",
+		GetCollectionConfigVal: config.CollectionConfig{GossipPublishTimes: true},
 	}
 	metric := &metrics.MockMetrics{}
 	metric.Start()
@@ -34,9 +35,11 @@ func TestRoundTripChanRedis(t *testing.T) {
 	defer healthCheck.Stop()
 
 	g := &GossipRedis{
-		Redis:  redis,
-		Logger: &logger.NullLogger{},
-		Health: healthCheck,
+		Config:  &cfg,
+		Redis:   redis,
+		Logger:  &logger.NullLogger{},
+		Health:  healthCheck,
+		Metrics: metric,
 	}
 
 	require.NoError(t, g.Start())
@@ -77,7 +80,9 @@ func TestRoundTripChanRedis(t *testing.T) {
 }
 
 func TestRoundTripChanInMem(t *testing.T) {
-	g := &InMemoryGossip{}
+	metric := &metrics.MockMetrics{}
+	metric.Start()
+	g := &InMemoryGossip{Metrics: metric}
 
 	require.NoError(t, g.Start())
 
@@ -111,4 +116,41 @@ func TestRoundTripChanInMem(t *testing.T) {
 	}
 
 	require.NoError(t, g.Stop())
+
+	assert.Equal(t, 1, metric.CounterIncrements["gossip_test_published"])
+	assert.Equal(t, 1, metric.CounterIncrements["gossip_test_received"])
+	assert.Equal(t, 3, metric.CounterIncrements["gossip_test2_received_bytes"])
+	assert.Equal(t, 0, metric.CounterIncrements["gossip_test_dropped"])
+	assert.NotEmpty(t, metric.Histograms["gossip_test_lag_ms"])
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	published := time.Unix(1700000000, 123456789)
+	msg := newMessageFromBytes(message{key: "keep", data: []byte("trace:1"), publishedAt: published}.ToBytes())
+	assert.Equal(t, "keep", msg.key)
+	assert.Equal(t, "trace:1", string(msg.data))
+	assert.True(t, published.Equal(msg.publishedAt))
+
+	// without a publish time, messages are encoded as older releases expect
+	assert.Equal(t, "keep:abc", string(message{key: "keep", data: []byte("abc")}.ToBytes()))
+	msg = newMessageFromBytes([]byte("keep:abc"))
+	assert.Equal(t, "keep", msg.key)
+	assert.Equal(t, "abc", string(msg.data))
+	assert.True(t, msg.publishedAt.IsZero())
+}
+
+func TestChannelMetricsOnlyForKnownChannels(t *testing.T) {
+	metric := &metrics.MockMetrics{}
+	metric.Start()
+	c := newChannelMetrics(metric)
+	c.register("keep")
+
+	c.received(message{key: "keep", data: []byte("abc")}, time.Now())
+	c.received(message{key: "made-up", data: []byte("abc")}, time.Now())
+	c.dropped("made-up")
+
+	assert.Equal(t, 1, metric.CounterIncrements["gossip_keep_received"])
+	assert.Equal(t, 1, metric.CounterIncrements["gossip_unknown_channel_received"])
+	assert.NotContains(t, metric.Registrations, "gossip_made_up_received")
+	assert.NotContains(t, metric.Registrations, "gossip_made_up_dropped")
 }
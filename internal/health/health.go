@@ -1,10 +1,13 @@
 package health
 
 import (
+	"fmt"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/facebookgo/startstop"
+	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/jonboulle/clockwork"
@@ -26,18 +29,46 @@ import (
 // does not start the ticker -- it only starts once Ready is called for the
 // first time.
 
+// Services that are working, but not well, can report themselves as degraded
+// instead; a degraded service is still ready. Which services can make the
+// system not ready is set by Health.ReadinessSubsystems in the config.
+
+// Status is the state a service reports itself in.
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDegraded Status = "degraded"
+	StatusFailed   Status = "failed"
+)
+
 // Recorder is the interface used by object that want to record their own health
 // status and make it available to the system.
 type Recorder interface {
 	Register(source string, timeout time.Duration)
 	Unregister(source string)
 	Ready(source string, ready bool)
+	// Report is like Ready, but can also report the service as degraded,
+	// and describe why it isn't ok.
+	Report(source string, status Status, detail string)
 }
 
 // Reporter is the interface that is used to read back the health status of the system.
 type Reporter interface {
 	IsAlive() bool
 	IsReady() bool
+	Subsystems() map[string]SubsystemStatus
+}
+
+// SubsystemStatus is the health of a single registered service.
+type SubsystemStatus struct {
+	Status Status `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Alive  bool   `json:"alive"`
+	Ready  bool   `json:"ready"`
+	// GatesReadiness is true if the system isn't ready while this service
+	// isn't.
+	GatesReadiness bool `json:"gates_readiness"`
 }
 
 // TickerTime is the interval at which we will check the health of the system.
@@ -53,10 +84,13 @@ type Health struct {
 	Clock    clockwork.Clock `inject:""`
 	Metrics  metrics.Metrics `inject:"genericMetrics"`
 	Logger   logger.Logger   `inject:""`
+	Config   config.Config   `inject:""`
 	timeouts map[string]time.Duration
 	timeLeft map[string]time.Duration
 	readies  map[string]bool
 	alives   map[string]bool
+	statuses map[string]Status
+	details  map[string]string
 	mut      sync.RWMutex
 	done     chan struct{}
 	startstop.Starter
@@ -77,6 +111,8 @@ func (h *Health) Start() error {
 	h.timeLeft = make(map[string]time.Duration)
 	h.readies = make(map[string]bool)
 	h.alives = make(map[string]bool)
+	h.statuses = make(map[string]Status)
+	h.details = make(map[string]string)
 	h.done = make(chan struct{})
 	go h.ticker()
 	return nil
@@ -118,6 +154,8 @@ func (h *Health) Register(source string, timeout time.Duration) {
 	defer h.mut.Unlock()
 	h.timeouts[source] = timeout
 	h.readies[source] = false
+	delete(h.statuses, source)
+	delete(h.details, source)
 	// we use a negative value to indicate that we haven't seen a report yet so
 	// we don't return "dead" immediately
 	h.timeLeft[source] = -1
@@ -144,12 +182,26 @@ func (h *Health) Unregister(source string) {
 	// we don't remove it from readies, but we mark it as not ready;
 	// an unregistered services can never be ready.
 	h.readies[source] = false
+	h.statuses[source] = StatusFailed
+	h.details[source] = "unregistered"
 }
 
 // Ready is called by services to indicate their readiness to receive traffic.
 // If any service is not ready, the system as a whole is not ready.
 // Even unready services will be marked as alive as long as they report in.
 func (h *Health) Ready(source string, ready bool) {
+	if ready {
+		h.Report(source, StatusOK, "")
+	} else {
+		h.Report(source, StatusFailed, "")
+	}
+}
+
+// Report is called by services to report their status. A degraded service is
+// still ready to receive traffic; a failed one is not. Either way, reporting
+// keeps the service alive.
+func (h *Health) Report(source string, status Status, detail string) {
+	ready := status != StatusFailed
 	h.mut.Lock()
 	defer h.mut.Unlock()
 	if _, ok := h.timeouts[source]; !ok {
@@ -161,13 +213,17 @@ func (h *Health) Ready(source string, ready bool) {
 		}
 		return
 	}
-	if h.readies[source] != ready {
+	if h.readies[source] != ready || h.statuses[source] != status {
 		h.Logger.Info().WithFields(map[string]any{
 			"source": source,
 			"ready":  ready,
+			"status": status,
+			"detail": detail,
 		}).Logf("Health.Ready reporting source changing state")
 	}
 	h.readies[source] = ready
+	h.statuses[source] = status
+	h.details[source] = detail
 	h.timeLeft[source] = h.timeouts[source]
 	if !h.alives[source] {
 		h.alives[source] = true
@@ -216,9 +272,11 @@ func (h *Health) checkReady() bool {
 		return false
 	}
 
+	gates := h.readinessGates()
+
 	// if any counter is not positive, we're not ready
 	for source, counter := range h.timeLeft {
-		if counter <= 0 {
+		if counter <= 0 && gates(source) {
 			h.Logger.Info().WithFields(map[string]any{
 				"source":  source,
 				"counter": counter,
@@ -230,6 +288,9 @@ func (h *Health) checkReady() bool {
 	// if any registered service is not ready, we're not ready
 	ready := true
 	for source, r := range h.readies {
+		if !gates(source) {
+			continue
+		}
 		if !r {
 			h.Logger.Info().WithFields(map[string]any{
 				"source": source,
@@ -240,3 +301,49 @@ func (h *Health) checkReady() bool {
 	}
 	return ready
 }
+
+// readinessGates returns a function that reports whether a source's
+// readiness affects that of the system.
+func (h *Health) readinessGates() func(source string) bool {
+	var gating []string
+	if h.Config != nil {
+		gating = h.Config.GetHealthConfig().ReadinessSubsystems
+	}
+	return func(source string) bool {
+		return len(gating) == 0 || slices.Contains(gating, source)
+	}
+}
+
+// Subsystems returns the health of every service that has registered,
+// including those that have since unregistered.
+func (h *Health) Subsystems() map[string]SubsystemStatus {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+
+	gates := h.readinessGates()
+	result := make(map[string]SubsystemStatus, len(h.readies))
+	for source, ready := range h.readies {
+		sub := SubsystemStatus{
+			Status:         h.statuses[source],
+			Detail:         h.details[source],
+			Alive:          true,
+			Ready:          ready,
+			GatesReadiness: gates(source),
+		}
+		timeLeft, registered := h.timeLeft[source]
+		switch {
+		case !registered:
+			sub.Alive = false
+		case timeLeft < 0:
+			sub.Status = StatusFailed
+			sub.Detail = "no report yet"
+		case timeLeft == 0:
+			sub.Alive = false
+			sub.Ready = false
+			sub.Status = StatusFailed
+			sub.Detail = fmt.Sprintf("no report in %s", h.timeouts[source])
+		}
+		result[source] = sub
+	}
+	return result
+}
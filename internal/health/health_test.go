@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/honeycombio/refinery/config"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 )
@@ -143,3 +144,70 @@ func TestNotReadyFromOneService(t *testing.T) {
 	// Stop the Health object
 	h.Stop()
 }
+
+func TestDegradedServiceIsReady(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	h := &Health{
+		Clock: cl,
+	}
+	h.Start()
+	defer h.Stop()
+	h.Register("foo", 1500*time.Millisecond)
+	h.Register("bar", 1500*time.Millisecond)
+	h.Ready("foo", true)
+	h.Report("bar", StatusDegraded, "slow")
+	assert.True(t, h.IsAlive())
+	assert.True(t, h.IsReady())
+
+	subsystems := h.Subsystems()
+	assert.Equal(t, SubsystemStatus{Status: StatusOK, Alive: true, Ready: true, GatesReadiness: true}, subsystems["foo"])
+	assert.Equal(t, SubsystemStatus{Status: StatusDegraded, Detail: "slow", Alive: true, Ready: true, GatesReadiness: true}, subsystems["bar"])
+
+	h.Report("bar", StatusFailed, "down")
+	assert.False(t, h.IsReady())
+	assert.Equal(t, StatusFailed, h.Subsystems()["bar"].Status)
+	assert.False(t, h.Subsystems()["bar"].Ready)
+}
+
+func TestReadinessSubsystems(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	h := &Health{
+		Clock:  cl,
+		Config: &config.MockConfig{Health: config.HealthConfig{ReadinessSubsystems: []string{"foo"}}},
+	}
+	h.Start()
+	defer h.Stop()
+	h.Register("foo", 1500*time.Millisecond)
+	h.Register("bar", 1500*time.Millisecond)
+	h.Ready("foo", true)
+
+	// bar hasn't reported, and then fails, but it doesn't gate readiness
+	assert.True(t, h.IsReady())
+	assert.Equal(t, SubsystemStatus{Status: StatusFailed, Detail: "no report yet", Alive: true}, h.Subsystems()["bar"])
+	h.Report("bar", StatusFailed, "down")
+	assert.True(t, h.IsReady())
+	assert.False(t, h.Subsystems()["bar"].GatesReadiness)
+
+	h.Ready("foo", false)
+	assert.False(t, h.IsReady())
+}
+
+func TestSubsystemTimeout(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	h := &Health{
+		Clock: cl,
+	}
+	h.Start()
+	defer h.Stop()
+	h.Register("foo", 500*time.Millisecond)
+	h.Ready("foo", true)
+	for i := 0; i < 10; i++ {
+		cl.Advance(100 * time.Millisecond)
+		time.Sleep(1 * time.Millisecond) // give goroutines time to run
+	}
+	assert.False(t, h.IsAlive())
+	assert.Equal(t, SubsystemStatus{Status: StatusFailed, Detail: "no report in 500ms", GatesReadiness: true}, h.Subsystems()["foo"])
+
+	h.Unregister("foo")
+	assert.Equal(t, SubsystemStatus{Status: StatusFailed, Detail: "unregistered", GatesReadiness: true}, h.Subsystems()["foo"])
+}
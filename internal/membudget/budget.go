@@ -0,0 +1,164 @@
+// Package membudget shares a single memory budget between the parts of
+// Refinery that hold the most data.
+package membudget
+
+import (
+	"sync"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+// These are the names of the components that share the budget.
+const (
+	TraceCache    = "trace_cache"
+	DecisionCache = "decision_cache"
+	SamplerKeys   = "sampler_keys"
+)
+
+// Budget meters the memory used by a set of components, and divides a single
+// budget between them. Each component is given the part of the budget set by
+// its share; a component that isn't using all of its part lends what it
+// isn't using to the components that need more, in proportion to their
+// shares, until it needs it back. Components are metered when an allocation
+// is asked for, and each is responsible for fitting its own allowance. A nil
+// Budget is never enabled.
+type Budget struct {
+	Config  config.Config   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+
+	mut        sync.Mutex
+	components []*component
+}
+
+// component is a part of Refinery whose memory use is metered by its size
+// function, which estimates the bytes it's using.
+type component struct {
+	name string
+	size func() int64
+}
+
+// Allocation is a component's part of the budget.
+type Allocation struct {
+	Used      int64
+	Allowance int64
+}
+
+// Over returns the number of bytes by which the component is over its
+// allowance, or 0 if it's within it.
+func (a Allocation) Over() int64 {
+	return max(0, a.Used-a.Allowance)
+}
+
+// Enabled reports whether the budget is in use.
+func (b *Budget) Enabled() bool {
+	return b != nil && b.Config.GetMemoryBudgetConfig().Enabled
+}
+
+// Register adds a component to the budget. It may be called before the
+// budget is enabled.
+func (b *Budget) Register(name string, size func() int64) {
+	if b == nil {
+		return
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.components = append(b.components, &component{name: name, size: size})
+	b.Metrics.Register("memory_budget_"+name+"_used", "gauge")
+	b.Metrics.Register("memory_budget_"+name+"_allowance", "gauge")
+}
+
+// Allocation meters every component and returns the part of the budget for
+// the named one; it returns false if the budget isn't enabled or there's no
+// such component.
+func (b *Budget) Allocation(name string) (Allocation, bool) {
+	if !b.Enabled() {
+		return Allocation{}, false
+	}
+	allocations := b.allocate()
+	a, ok := allocations[name]
+	return a, ok
+}
+
+// total returns the size of the budget.
+func (b *Budget) total() int64 {
+	if total := b.Config.GetMemoryBudgetConfig().Total; total > 0 {
+		return int64(total)
+	}
+	return int64(b.Config.GetCollectionConfig().GetMaxAlloc())
+}
+
+// share returns the configured share of the named component.
+func (b *Budget) share(name string) int64 {
+	cfg := b.Config.GetMemoryBudgetConfig()
+	var share int
+	switch name {
+	case TraceCache:
+		share = cfg.TraceCacheShare
+	case DecisionCache:
+		share = cfg.DecisionCacheShare
+	case SamplerKeys:
+		share = cfg.SamplerKeysShare
+	}
+	return int64(max(share, 0))
+}
+
+// allocate meters the components and divides the budget between them.
+func (b *Budget) allocate() map[string]Allocation {
+	b.mut.Lock()
+	components := b.components
+	b.mut.Unlock()
+
+	used := make([]int64, len(components))
+	shares := make([]int64, len(components))
+	var totalShares int64
+	for i, c := range components {
+		used[i] = c.size()
+		shares[i] = b.share(c.name)
+		totalShares += shares[i]
+	}
+	allocations := divide(b.total(), used, shares, totalShares)
+
+	result := make(map[string]Allocation, len(components))
+	for i, c := range components {
+		result[c.name] = allocations[i]
+		b.Metrics.Gauge("memory_budget_"+c.name+"_used", allocations[i].Used)
+		b.Metrics.Gauge("memory_budget_"+c.name+"_allowance", allocations[i].Allowance)
+	}
+	return result
+}
+
+// divide gives each component its share of the total, then lends the part
+// that components under their share aren't using to those over theirs. A
+// component under its share is also allowed a part of what the others
+// aren't using, so that one that has been shrunk can grow back.
+func divide(total int64, used []int64, shares []int64, totalShares int64) []Allocation {
+	allocations := make([]Allocation, len(used))
+	if totalShares <= 0 {
+		for i := range used {
+			allocations[i] = Allocation{Used: used[i]}
+		}
+		return allocations
+	}
+
+	unused := make([]int64, len(used))
+	var slack, overShares int64
+	for i := range used {
+		base := total * shares[i] / totalShares
+		allocations[i] = Allocation{Used: used[i], Allowance: base}
+		if used[i] > base {
+			overShares += shares[i]
+		} else {
+			unused[i] = base - used[i]
+			slack += unused[i]
+		}
+	}
+	for i := range allocations {
+		if used[i] > allocations[i].Allowance {
+			allocations[i].Allowance += slack * shares[i] / overShares
+		} else {
+			allocations[i].Allowance += (slack - unused[i]) * shares[i] / totalShares
+		}
+	}
+	return allocations
+}
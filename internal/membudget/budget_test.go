@@ -0,0 +1,85 @@
+package membudget
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+func TestDivide(t *testing.T) {
+	tests := []struct {
+		name   string
+		total  int64
+		used   []int64
+		shares []int64
+		want   []int64
+	}{
+		{"all under", 1000, []int64{100, 100, 100}, []int64{70, 20, 10}, []int64{770, 320, 170}},
+		{"one over, slack lent", 1000, []int64{900, 50, 50}, []int64{70, 20, 10}, []int64{900, 210, 115}},
+		{"two over, slack shared by share", 1000, []int64{900, 300, 0}, []int64{70, 20, 10}, []int64{777, 222, 100}},
+		{"all over", 1000, []int64{800, 300, 200}, []int64{70, 20, 10}, []int64{700, 200, 100}},
+		{"no shares", 1000, []int64{10, 10}, []int64{0, 0}, []int64{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var totalShares int64
+			for _, s := range tt.shares {
+				totalShares += s
+			}
+			allocations := divide(tt.total, tt.used, tt.shares, totalShares)
+			require.Len(t, allocations, len(tt.want))
+			for i, a := range allocations {
+				assert.Equal(t, tt.used[i], a.Used)
+				assert.Equal(t, tt.want[i], a.Allowance, "component %d", i)
+			}
+		})
+	}
+}
+
+func TestBudgetAllocation(t *testing.T) {
+	cfg := &config.MockConfig{
+		MemoryBudget: config.MemoryBudgetConfig{
+			Enabled:            true,
+			Total:              1000,
+			TraceCacheShare:    70,
+			DecisionCacheShare: 20,
+			SamplerKeysShare:   10,
+		},
+	}
+	b := &Budget{Config: cfg, Metrics: &metrics.NullMetrics{}}
+	traces := int64(900)
+	b.Register(TraceCache, func() int64 { return traces })
+	b.Register(DecisionCache, func() int64 { return 250 })
+	b.Register(SamplerKeys, func() int64 { return 0 })
+
+	a, ok := b.Allocation(TraceCache)
+	require.True(t, ok)
+	assert.Equal(t, int64(777), a.Allowance)
+	assert.Equal(t, int64(123), a.Over())
+
+	// when the trace cache shrinks, the decision cache can borrow its slack
+	traces = 100
+	a, ok = b.Allocation(DecisionCache)
+	require.True(t, ok)
+	assert.Equal(t, int64(900), a.Allowance)
+	assert.Equal(t, int64(0), a.Over())
+
+	_, ok = b.Allocation("unknown")
+	assert.False(t, ok)
+
+	cfg.MemoryBudget.Enabled = false
+	_, ok = b.Allocation(TraceCache)
+	assert.False(t, ok)
+}
+
+func TestNilBudget(t *testing.T) {
+	var b *Budget
+	assert.False(t, b.Enabled())
+	b.Register(TraceCache, func() int64 { return 1 })
+	_, ok := b.Allocation(TraceCache)
+	assert.False(t, ok)
+}
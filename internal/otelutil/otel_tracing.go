@@ -4,15 +4,18 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/url"
 	"strings"
+	"time"
 
-	"github.com/honeycombio/otel-config-go/otelconfig"
 	"github.com/honeycombio/refinery/config"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	samplers "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
-	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // telemetry helpers
@@ -75,36 +78,90 @@ func StartSpanMulti(ctx context.Context, tracer trace.Tracer, name string, field
 	return tracer.Start(ctx, name, trace.WithAttributes(Attributes(fields)...))
 }
 
+// SetupTracing returns the tracer for Refinery's own traces, which sends them
+// with the configured protocol to Endpoint, or to APIHost if it isn't set.
+// Traces are sampled by trace ID, so that each trace is complete; the spans of
+// a trace that starts in another component follow that trace's decision.
 func SetupTracing(cfg config.OTelTracingConfig, resourceLibrary string, resourceVersion string) (tracer trace.Tracer, shutdown func()) {
-	if cfg.APIKey != "" {
-		var protocol otelconfig.Protocol = otelconfig.ProtocolHTTPProto
+	ctx := context.Background()
+	exporter, err := newTraceExporter(ctx, cfg)
+	if err != nil {
+		log.Fatalf("failure configuring otel: %v", err)
+	}
 
-		cfg.APIHost = strings.TrimSuffix(cfg.APIHost, "/")
-		apihost := fmt.Sprintf("%s:443", cfg.APIHost)
+	sampleRate := cfg.SampleRate
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+	var sampleRatio float64 = 1.0 / float64(sampleRate)
 
-		sampleRate := cfg.SampleRate
-		if sampleRate < 1 {
-			sampleRate = 1
-		}
+	res, err := resource.New(ctx, resource.WithAttributes(
+		attribute.String("service.name", cfg.Dataset),
+		attribute.String("service.version", resourceVersion),
+	))
+	if err != nil {
+		log.Fatalf("failure configuring otel: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
 
-		var sampleRatio float64 = 1.0 / float64(sampleRate)
-
-		otelshutdown, err := otelconfig.ConfigureOpenTelemetry(
-			otelconfig.WithExporterProtocol(protocol),
-			otelconfig.WithServiceName(cfg.Dataset),
-			otelconfig.WithTracesExporterEndpoint(apihost),
-			otelconfig.WithMetricsEnabled(false),
-			otelconfig.WithTracesEnabled(true),
-			otelconfig.WithSampler(samplers.TraceIDRatioBased(sampleRatio)),
-			otelconfig.WithHeaders(map[string]string{
-				"x-honeycomb-team": cfg.APIKey,
-			}),
-		)
-		if err != nil {
-			log.Fatalf("failure configuring otel: %v", err)
+	shutdown = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		provider.Shutdown(ctx)
+	}
+	return provider.Tracer(resourceLibrary, trace.WithInstrumentationVersion(resourceVersion)), shutdown
+}
+
+// newTraceExporter returns an exporter that sends traces with the configured
+// protocol to Endpoint, or to APIHost if it isn't set.
+func newTraceExporter(ctx context.Context, cfg config.OTelTracingConfig) (sdktrace.SpanExporter, error) {
+	endpoint := strings.TrimSuffix(cfg.APIHost, "/")
+	if cfg.Endpoint != "" {
+		endpoint = cfg.Endpoint
+	}
+	// otel can't handle a URL as the endpoint so we have to parse it
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse traces endpoint '%s': %w", endpoint, err)
+	}
+
+	// the Honeycomb headers are only needed if there's a key to send
+	headers := make(map[string]string, len(cfg.Headers)+1)
+	if cfg.APIKey != "" {
+		headers["x-honeycomb-team"] = cfg.APIKey
+	}
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+
+	if cfg.Protocol == "grpc" {
+		options := []otlptracegrpc.Option{
+			otlptracegrpc.WithEndpoint(u.Host),
+			otlptracegrpc.WithHeaders(headers),
+			otlptracegrpc.WithCompressor("gzip"),
 		}
-		return otel.Tracer(resourceLibrary, trace.WithInstrumentationVersion(resourceVersion)), otelshutdown
+		if u.Scheme == "http" {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, options...)
+	}
+
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithHeaders(headers),
+		otlptracehttp.WithCompression(otlptracehttp.GzipCompression),
+	}
+	// APIHost is only a host, but a full Endpoint has its own path
+	if cfg.Endpoint != "" && u.Path != "" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
 	}
-	pr := noop.NewTracerProvider()
-	return pr.Tracer(resourceLibrary, trace.WithInstrumentationVersion(resourceVersion)), func() {}
+	return otlptracehttp.New(ctx, options...)
 }
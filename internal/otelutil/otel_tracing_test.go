@@ -0,0 +1,80 @@
+package otelutil
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSetupTracingEndpoint(t *testing.T) {
+	type export struct {
+		path    string
+		headers http.Header
+		request *collectortrace.ExportTraceServiceRequest
+	}
+	exports := make(chan export, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		data, _ := io.ReadAll(body)
+		request := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(data, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		exports <- export{path: req.URL.Path, headers: req.Header, request: request}
+	}))
+	defer srv.Close()
+
+	tracer, shutdown := SetupTracing(config.OTelTracingConfig{
+		Type:       "otel",
+		Endpoint:   srv.URL + "/collector/v1/traces",
+		Dataset:    "Refinery Traces",
+		SampleRate: 1,
+		Protocol:   "http/protobuf",
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+	}, "refinery", "1.2.3")
+	_, span := StartSpanWith(context.Background(), tracer, "Router.ingest", "route", "batch")
+	span.End()
+	// shutting down sends what's been recorded
+	shutdown()
+
+	var got export
+	select {
+	case got = <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no traces were exported")
+	}
+	assert.Equal(t, "/collector/v1/traces", got.path)
+	assert.Equal(t, "Bearer token", got.headers.Get("Authorization"))
+	// without an API key, no Honeycomb header is sent
+	assert.Empty(t, got.headers.Get("x-honeycomb-team"))
+
+	require.Len(t, got.request.ResourceSpans, 1)
+	attrs := make(map[string]string)
+	for _, kv := range got.request.ResourceSpans[0].Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	assert.Equal(t, "Refinery Traces", attrs["service.name"])
+	require.Len(t, got.request.ResourceSpans[0].ScopeSpans, 1)
+	spans := got.request.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, "Router.ingest", spans[0].Name)
+}
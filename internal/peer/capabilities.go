@@ -0,0 +1,194 @@
+package peer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CapabilitiesPath is where a Refinery reports its Capabilities to its peers.
+const CapabilitiesPath = "/peer/version"
+
+// MessageSchemas are the versions of the messages between peers that this
+// Refinery can read and write.
+var MessageSchemas = []int{1}
+
+// Capabilities is what a Refinery can do when talking to its peers. During a
+// rolling upgrade, peers of different versions use the features they have in
+// common.
+type Capabilities struct {
+	Version string `json:"version"`
+	// Compression lists the codecs the Refinery can decode, most preferred
+	// first, by their Content-Encoding names.
+	Compression []string `json:"compression"`
+	// MessageSchemas lists the versions of peer messages it understands.
+	MessageSchemas []int `json:"message_schemas"`
+	// Sharder is the algorithm it uses to assign traces to peers.
+	Sharder string `json:"sharder"`
+}
+
+// Query encodes c as the query of a capabilities request, so that the peer
+// being asked can negotiate with the one asking.
+func (c Capabilities) Query() url.Values {
+	schemas := make([]string, len(c.MessageSchemas))
+	for i, schema := range c.MessageSchemas {
+		schemas[i] = strconv.Itoa(schema)
+	}
+	return url.Values{
+		"version":         {c.Version},
+		"compression":     {strings.Join(c.Compression, ",")},
+		"message_schemas": {strings.Join(schemas, ",")},
+		"sharder":         {c.Sharder},
+	}
+}
+
+// CapabilitiesFromQuery decodes the Capabilities of the peer asking for ours.
+// It returns false if the peer didn't send any.
+func CapabilitiesFromQuery(q url.Values) (Capabilities, bool, error) {
+	if !q.Has("sharder") && !q.Has("message_schemas") {
+		return Capabilities{}, false, nil
+	}
+	c := Capabilities{Version: q.Get("version"), Sharder: q.Get("sharder")}
+	if codecs := q.Get("compression"); codecs != "" {
+		c.Compression = strings.Split(codecs, ",")
+	}
+	if schemas := q.Get("message_schemas"); schemas != "" {
+		for _, s := range strings.Split(schemas, ",") {
+			schema, err := strconv.Atoi(s)
+			if err != nil {
+				return Capabilities{}, false, fmt.Errorf("invalid message schema '%s'", s)
+			}
+			c.MessageSchemas = append(c.MessageSchemas, schema)
+		}
+	}
+	return c, true, nil
+}
+
+// Agreement is the best set of features two peers have in common.
+type Agreement struct {
+	// Compression is the codec to use, or "none" if there isn't one in
+	// common.
+	Compression   string `json:"compression"`
+	MessageSchema int    `json:"message_schema"`
+}
+
+// Negotiate returns the features c and other have in common, preferring the
+// codecs earlier in c's list and the highest schema. Peers that don't share
+// a schema can't talk to each other, and peers with different sharders would
+// disagree about where traces belong, so either is an error.
+func (c Capabilities) Negotiate(other Capabilities) (Agreement, error) {
+	if c.Sharder != other.Sharder {
+		return Agreement{}, fmt.Errorf("peer uses sharder '%s', but we use '%s'", other.Sharder, c.Sharder)
+	}
+
+	agreement := Agreement{Compression: "none"}
+	for _, codec := range c.Compression {
+		if slices.Contains(other.Compression, codec) {
+			agreement.Compression = codec
+			break
+		}
+	}
+	for _, schema := range c.MessageSchemas {
+		if schema > agreement.MessageSchema && slices.Contains(other.MessageSchemas, schema) {
+			agreement.MessageSchema = schema
+		}
+	}
+	if agreement.MessageSchema == 0 {
+		return Agreement{}, fmt.Errorf("no message schema in common: peer has %v, we have %v", other.MessageSchemas, c.MessageSchemas)
+	}
+	return agreement, nil
+}
+
+// Reply is a Refinery's answer to a capabilities request. If the peer asking
+// sent its own Capabilities, the answer includes what the two agreed on; the
+// codec is the one the answering Refinery prefers to receive.
+type Reply struct {
+	Capabilities
+	Agreement *Agreement `json:"agreement,omitempty"`
+}
+
+// CapabilityCache negotiates with each peer the first time it's needed, and
+// remembers what they agreed. A peer's entry should be forgotten when it
+// leaves the cluster, since it may come back as a different version.
+type CapabilityCache struct {
+	Client *http.Client
+	// Local is what this Refinery can do, which is sent to each peer.
+	Local Capabilities
+
+	mut   sync.Mutex
+	peers map[string]Agreement
+}
+
+// Get returns what this Refinery and the peer at address, which is a base URL
+// such as http://refinery-1:8080, agreed on.
+func (c *CapabilityCache) Get(ctx context.Context, address string) (Agreement, error) {
+	c.mut.Lock()
+	agreement, ok := c.peers[address]
+	c.mut.Unlock()
+	if ok {
+		return agreement, nil
+	}
+
+	agreement, err := c.negotiate(ctx, address)
+	if err != nil {
+		return Agreement{}, err
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.peers == nil {
+		c.peers = make(map[string]Agreement)
+	}
+	c.peers[address] = agreement
+	return agreement, nil
+}
+
+// Forget drops what's known about the peer at address.
+func (c *CapabilityCache) Forget(address string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	delete(c.peers, address)
+}
+
+func (c *CapabilityCache) negotiate(ctx context.Context, address string) (Agreement, error) {
+	u := strings.TrimSuffix(address, "/") + CapabilitiesPath + "?" + c.Local.Query().Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return Agreement{}, err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Agreement{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Agreement{}, errors.New("peer doesn't report its capabilities")
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Agreement{}, fmt.Errorf("peer capabilities request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var reply Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return Agreement{}, fmt.Errorf("couldn't decode peer capabilities: %w", err)
+	}
+	if reply.Agreement != nil {
+		return *reply.Agreement, nil
+	}
+	// an older peer only reports its capabilities, so agree for it, with the
+	// codec it prefers to receive
+	return reply.Capabilities.Negotiate(c.Local)
+}
@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := Capabilities{
+		Compression:    []string{"zstd", "x-snappy-framed", "gzip"},
+		MessageSchemas: []int{1, 2, 3},
+		Sharder:        "deterministic",
+	}
+
+	for _, tc := range []struct {
+		name    string
+		remote  Capabilities
+		want    Agreement
+		wantErr bool
+	}{
+		{
+			name:   "same",
+			remote: local,
+			want:   Agreement{Compression: "zstd", MessageSchema: 3},
+		},
+		{
+			name:   "older peer",
+			remote: Capabilities{Compression: []string{"gzip", "x-snappy-framed"}, MessageSchemas: []int{1, 2}, Sharder: "deterministic"},
+			want:   Agreement{Compression: "x-snappy-framed", MessageSchema: 2},
+		},
+		{
+			name:   "no common codec",
+			remote: Capabilities{Compression: []string{"br"}, MessageSchemas: []int{1}, Sharder: "deterministic"},
+			want:   Agreement{Compression: "none", MessageSchema: 1},
+		},
+		{
+			name:    "no common schema",
+			remote:  Capabilities{Compression: []string{"zstd"}, MessageSchemas: []int{4}, Sharder: "deterministic"},
+			wantErr: true,
+		},
+		{
+			name:    "different sharder",
+			remote:  Capabilities{Compression: []string{"zstd"}, MessageSchemas: []int{1}, Sharder: "single"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := local.Negotiate(tc.remote)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCapabilitiesQuery(t *testing.T) {
+	caps := Capabilities{Version: "3.0.0", Compression: []string{"zstd", "gzip"}, MessageSchemas: []int{1, 2}, Sharder: "deterministic"}
+	got, ok, err := CapabilitiesFromQuery(caps.Query())
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, caps, got)
+
+	_, ok, err = CapabilitiesFromQuery(url.Values{})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = CapabilitiesFromQuery(url.Values{"message_schemas": {"1,x"}})
+	assert.Error(t, err)
+}
+
+func TestCapabilityCache(t *testing.T) {
+	var requests atomic.Int32
+	local := Capabilities{Version: "3.0.0", Compression: []string{"gzip"}, MessageSchemas: []int{1}, Sharder: "deterministic"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		assert.Equal(t, CapabilitiesPath, req.URL.Path)
+		theirs, ok, err := CapabilitiesFromQuery(req.URL.Query())
+		require.NoError(t, err)
+		assert.True(t, ok, "the asking peer sends its capabilities")
+		assert.Equal(t, local, theirs)
+		json.NewEncoder(w).Encode(Reply{
+			Capabilities: Capabilities{Version: "3.1.0", Compression: []string{"zstd", "gzip"}, MessageSchemas: []int{1, 2}, Sharder: "deterministic"},
+			Agreement:    &Agreement{Compression: "gzip", MessageSchema: 1},
+		})
+	}))
+	defer server.Close()
+
+	cache := &CapabilityCache{Local: local}
+	want := Agreement{Compression: "gzip", MessageSchema: 1}
+	got, err := cache.Get(context.Background(), server.URL+"/")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// later lookups don't ask again
+	got, err = cache.Get(context.Background(), server.URL+"/")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.Equal(t, int32(1), requests.Load())
+
+	cache.Forget(server.URL + "/")
+	_, err = cache.Get(context.Background(), server.URL+"/")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestCapabilityCachePeerWithoutAgreement(t *testing.T) {
+	// a peer that only reports its capabilities is agreed with locally,
+	// using the codec it prefers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(Capabilities{Compression: []string{"x-snappy-framed", "gzip"}, MessageSchemas: []int{1}, Sharder: "deterministic"})
+	}))
+	defer server.Close()
+
+	cache := &CapabilityCache{Local: Capabilities{Compression: []string{"gzip", "x-snappy-framed"}, MessageSchemas: []int{1, 2}, Sharder: "deterministic"}}
+	got, err := cache.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, Agreement{Compression: "x-snappy-framed", MessageSchema: 1}, got)
+}
+
+func TestCapabilityCacheOldPeer(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cache := &CapabilityCache{}
+	_, err := cache.Get(context.Background(), server.URL)
+	assert.Error(t, err)
+}
@@ -53,7 +53,7 @@ func (p *RedisPeers) Start() error {
 	}
 
 	p.store = &redimem.RedisMembership{
-		Prefix: p.Config.GetRedisPrefix(),
+		Prefix: p.Config.GetRedisSettings().Prefix,
 		Pool:   p.RedisClient,
 	}
 	p.peers = make([]string, 1)
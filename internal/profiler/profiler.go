@@ -0,0 +1,295 @@
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/refinery/collect/stressRelief"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	KindCPU  = "cpu"
+	KindHeap = "heap"
+
+	TriggerStress  = "stress"
+	TriggerLatency = "latency"
+
+	// timeFormat is used in profile file names, so it sorts in time order and
+	// has no separators that the name uses.
+	timeFormat = "20060102T150405.000Z"
+	fileSuffix = ".pprof"
+)
+
+// ErrNotFound is returned by Open for a name that isn't a stored profile.
+var ErrNotFound = errors.New("no such profile")
+
+// Profile describes one profile stored on disk.
+type Profile struct {
+	Name     string    `json:"name"`
+	Kind     string    `json:"kind"`
+	Trigger  string    `json:"trigger"`
+	Captured time.Time `json:"captured"`
+	Size     int64     `json:"size"`
+}
+
+// Profiler captures CPU and heap profiles when the cluster's stress level or
+// the latency of ingest requests crosses a threshold, and keeps the most
+// recent of them in a directory, deleting the oldest as new ones are added.
+type Profiler struct {
+	Config       config.Config               `inject:""`
+	Logger       logger.Logger               `inject:""`
+	Metrics      metrics.Metrics             `inject:"genericMetrics"`
+	Clock        clockwork.Clock             `inject:""`
+	StressRelief stressRelief.StressReliever `inject:"stressRelief"`
+
+	// maxLatency is the longest ingest request since the last check, in
+	// nanoseconds.
+	maxLatency atomic.Int64
+
+	mut sync.Mutex
+	// profiles are in the order they were captured
+	profiles    []Profile
+	lastCapture time.Time
+
+	dir  string
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *Profiler) Start() error {
+	cfg := p.Config.GetProfilingConfig()
+	if !cfg.Enabled {
+		return nil
+	}
+	p.Metrics.Register("profiler_captures", "counter")
+	p.Metrics.Register("profiler_errors", "counter")
+
+	p.dir = cfg.Directory
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create profile directory: %w", err)
+	}
+	if err := p.loadExisting(); err != nil {
+		return err
+	}
+
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go p.run(time.Duration(cfg.CheckInterval))
+	return nil
+}
+
+func (p *Profiler) Stop() error {
+	if p.done != nil {
+		close(p.done)
+		p.wg.Wait()
+	}
+	return nil
+}
+
+// ObserveLatency records how long an ingest request took. It's safe to call
+// on a nil Profiler.
+func (p *Profiler) ObserveLatency(d time.Duration) {
+	if p == nil {
+		return
+	}
+	for {
+		current := p.maxLatency.Load()
+		if int64(d) <= current || p.maxLatency.CompareAndSwap(current, int64(d)) {
+			return
+		}
+	}
+}
+
+// Profiles returns the stored profiles, oldest first.
+func (p *Profiler) Profiles() []Profile {
+	if p == nil {
+		return []Profile{}
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return append([]Profile{}, p.profiles...)
+}
+
+// Open returns the file of the named stored profile.
+func (p *Profiler) Open(name string) (*os.File, error) {
+	if p == nil {
+		return nil, ErrNotFound
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	// only names in the list are opened, so a name can't reach outside the
+	// directory
+	for _, prof := range p.profiles {
+		if prof.Name == name {
+			return os.Open(filepath.Join(p.dir, name))
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (p *Profiler) run(interval time.Duration) {
+	defer p.wg.Done()
+
+	ticker := p.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+			if trigger := p.check(); trigger != "" {
+				p.capture(trigger)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// check returns the reason profiles should be captured now, or "" if they
+// shouldn't be.
+func (p *Profiler) check() string {
+	cfg := p.Config.GetProfilingConfig()
+	latency := time.Duration(p.maxLatency.Swap(0))
+
+	p.mut.Lock()
+	cooling := !p.lastCapture.IsZero() && p.Clock.Since(p.lastCapture) < time.Duration(cfg.Cooldown)
+	p.mut.Unlock()
+	if cooling {
+		return ""
+	}
+
+	if cfg.StressLevel > 0 && p.StressRelief.StressLevel() >= uint(cfg.StressLevel) {
+		return TriggerStress
+	}
+	if cfg.LatencyThreshold > 0 && latency >= time.Duration(cfg.LatencyThreshold) {
+		return TriggerLatency
+	}
+	return ""
+}
+
+// capture writes a CPU profile over CPUDuration, then a heap profile. Both
+// are named for the time the capture started, and sort in the order they
+// were written.
+func (p *Profiler) capture(trigger string) {
+	now := p.Clock.Now().UTC()
+	p.mut.Lock()
+	p.lastCapture = now
+	p.mut.Unlock()
+
+	p.Logger.Warn().WithString("trigger", trigger).Logf("capturing profiles")
+	p.Metrics.Increment("profiler_captures")
+
+	p.write(KindCPU, trigger, now, func(f *os.File) error {
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		select {
+		case <-p.Clock.After(time.Duration(p.Config.GetProfilingConfig().CPUDuration)):
+		case <-p.done:
+		}
+		pprof.StopCPUProfile()
+		return nil
+	})
+	p.write(KindHeap, trigger, now, func(f *os.File) error {
+		return pprof.Lookup("heap").WriteTo(f, 0)
+	})
+}
+
+// write creates a profile file, fills it with fill, and adds it to the
+// stored profiles.
+func (p *Profiler) write(kind string, trigger string, captured time.Time, fill func(*os.File) error) {
+	name := fmt.Sprintf("%s-%s-%s%s", captured.Format(timeFormat), trigger, kind, fileSuffix)
+	path := filepath.Join(p.dir, name)
+	f, err := os.Create(path)
+	if err == nil {
+		err = fill(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		p.Metrics.Increment("profiler_errors")
+		p.Logger.Error().WithString("kind", kind).Logf("failed to capture profile: %s", err)
+		return
+	}
+
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	p.add(Profile{Name: name, Kind: kind, Trigger: trigger, Captured: captured, Size: size})
+}
+
+// add stores a profile, deleting the oldest ones past MaxProfiles.
+func (p *Profiler) add(prof Profile) {
+	maxProfiles := p.Config.GetProfilingConfig().MaxProfiles
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.profiles = append(p.profiles, prof)
+	for maxProfiles > 0 && len(p.profiles) > maxProfiles {
+		if err := os.Remove(filepath.Join(p.dir, p.profiles[0].Name)); err != nil && !os.IsNotExist(err) {
+			p.Logger.Error().WithString("name", p.profiles[0].Name).Logf("failed to delete old profile: %s", err)
+		}
+		p.profiles = p.profiles[1:]
+	}
+}
+
+// loadExisting adds the profiles already in the directory, so that they're
+// served and rotated out like new ones.
+func (p *Profiler) loadExisting() error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read profile directory: %w", err)
+	}
+	var existing []Profile
+	for _, entry := range entries {
+		prof, ok := parseName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			prof.Size = info.Size()
+		}
+		existing = append(existing, prof)
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		if !existing[i].Captured.Equal(existing[j].Captured) {
+			return existing[i].Captured.Before(existing[j].Captured)
+		}
+		return existing[i].Name < existing[j].Name
+	})
+	for _, prof := range existing {
+		p.add(prof)
+	}
+	return nil
+}
+
+// parseName reads the details of a profile from its file name.
+func parseName(name string) (Profile, bool) {
+	base, ok := strings.CutSuffix(name, fileSuffix)
+	if !ok {
+		return Profile{}, false
+	}
+	parts := strings.Split(base, "-")
+	if len(parts) != 3 {
+		return Profile{}, false
+	}
+	captured, err := time.Parse(timeFormat, parts[0])
+	if err != nil {
+		return Profile{}, false
+	}
+	return Profile{Name: name, Captured: captured, Trigger: parts[1], Kind: parts[2]}, true
+}
@@ -0,0 +1,139 @@
+package profiler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect/stressRelief"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestProfiler(t *testing.T, cfg config.ProfilingConfig, stress *stressRelief.MockStressReliever, clock clockwork.Clock) *Profiler {
+	cfg.Enabled = true
+	if cfg.Directory == "" {
+		cfg.Directory = t.TempDir()
+	}
+	return &Profiler{
+		Config:       &config.MockConfig{Profiling: cfg},
+		Logger:       &logger.NullLogger{},
+		Metrics:      &metrics.NullMetrics{},
+		Clock:        clock,
+		StressRelief: stress,
+	}
+}
+
+func TestProfilerCapturesUnderStress(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	stress := &stressRelief.MockStressReliever{Level: 90}
+	p := newTestProfiler(t, config.ProfilingConfig{
+		MaxProfiles:   3,
+		StressLevel:   80,
+		CheckInterval: config.Duration(time.Second),
+		CPUDuration:   config.Duration(time.Second),
+	}, stress, clock)
+	require.NoError(t, p.Start())
+
+	// each capture writes a CPU profile, then a heap profile
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return len(p.Profiles()) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	profiles := p.Profiles()
+	assert.Equal(t, KindCPU, profiles[0].Kind)
+	assert.Equal(t, KindHeap, profiles[1].Kind)
+	assert.Equal(t, TriggerStress, profiles[0].Trigger)
+	assert.Positive(t, profiles[0].Size)
+
+	f, err := p.Open(profiles[0].Name)
+	require.NoError(t, err)
+	f.Close()
+	_, err = p.Open("../" + profiles[0].Name)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// only the most recent profiles are kept
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return len(p.Profiles()) == 3 && p.Profiles()[0].Name != profiles[0].Name
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, p.Stop())
+	files, err := os.ReadDir(p.dir)
+	require.NoError(t, err)
+	assert.Len(t, files, len(p.Profiles()))
+	assert.LessOrEqual(t, len(files), 3)
+}
+
+func TestProfilerTriggers(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	stress := &stressRelief.MockStressReliever{}
+	p := newTestProfiler(t, config.ProfilingConfig{
+		StressLevel:      80,
+		LatencyThreshold: config.Duration(time.Second),
+		Cooldown:         config.Duration(time.Minute),
+	}, stress, clock)
+
+	assert.Equal(t, "", p.check())
+	p.ObserveLatency(2 * time.Second)
+	p.ObserveLatency(time.Millisecond)
+	assert.Equal(t, TriggerLatency, p.check())
+	// latency is measured afresh for each check
+	assert.Equal(t, "", p.check())
+
+	stress.Level = 80
+	assert.Equal(t, TriggerStress, p.check())
+
+	// no captures during the cooldown
+	p.lastCapture = clock.Now()
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, "", p.check())
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, TriggerStress, p.check())
+
+	var nilProfiler *Profiler
+	nilProfiler.ObserveLatency(time.Second)
+	assert.Empty(t, nilProfiler.Profiles())
+}
+
+func TestProfilerLoadsExistingProfiles(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"20260101T000000.000Z-stress-cpu.pprof",
+		"20260101T000000.000Z-stress-heap.pprof",
+		"20260102T000000.000Z-latency-heap.pprof",
+		"unrelated.txt",
+	}
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644))
+	}
+
+	p := newTestProfiler(t, config.ProfilingConfig{
+		Directory:     dir,
+		MaxProfiles:   2,
+		CheckInterval: config.Duration(time.Hour),
+	}, &stressRelief.MockStressReliever{}, clockwork.NewFakeClock())
+	require.NoError(t, p.Start())
+	defer p.Stop()
+
+	profiles := p.Profiles()
+	require.Len(t, profiles, 2)
+	assert.Equal(t, names[1], profiles[0].Name)
+	assert.Equal(t, Profile{
+		Name:     names[2],
+		Kind:     KindHeap,
+		Trigger:  TriggerLatency,
+		Captured: time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC),
+		Size:     1,
+	}, profiles[1])
+
+	// the oldest was deleted, and other files are left alone
+	_, err := os.Stat(filepath.Join(dir, names[0]))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, names[3]))
+	assert.NoError(t, err)
+}
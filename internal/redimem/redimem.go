@@ -10,6 +10,7 @@ import (
 
 	"github.com/honeycombio/refinery/redis"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 // Membership allows services to register themselves as members of a group and
@@ -58,6 +59,9 @@ type RedisMembership struct {
 	// in the pool before taking the union of results and returning. Defaults to
 	// 2.
 	RepeatCount int
+
+	// memberReads coalesces concurrent GetMembers calls into a single scan
+	memberReads singleflight.Group
 }
 
 func (rm *RedisMembership) validateDefaults() error {
@@ -117,12 +121,45 @@ func (rm *RedisMembership) Unregister(ctx context.Context, memberName string) er
 
 // GetMembers reaches out to Redis to retrieve a list of all members in the
 // cluster. It does this multiple times (how many is configured on
-// initialization) and takes the union of the results returned.
+// initialization) and takes the union of the results returned. Concurrent
+// calls share the result of a single set of scans.
 func (rm *RedisMembership) GetMembers(ctx context.Context) ([]string, error) {
 	err := rm.validateDefaults()
 	if err != nil {
 		return nil, err
 	}
+	ch := rm.memberReads.DoChan("members", func() (any, error) {
+		// the scan is shared, so one caller giving up mustn't fail it for
+		// the others
+		members, err := rm.getMembers(context.WithoutCancel(ctx))
+		if err != nil {
+			// don't let later callers join a failed scan
+			rm.memberReads.Forget("members")
+		}
+		return members, err
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		// the scan may be stuck; later callers start a new one instead of
+		// joining it
+		rm.memberReads.Forget("members")
+		return nil, ctx.Err()
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	members := res.Val.([]string)
+	if res.Shared {
+		// callers may sort or modify the list, so each needs its own copy
+		members = append([]string(nil), members...)
+	}
+	return members, nil
+}
+
+func (rm *RedisMembership) getMembers(ctx context.Context) ([]string, error) {
 	// get the list of members multiple times
 	allMembers := make([]string, 0)
 	for i := 0; i < rm.RepeatCount; i++ {
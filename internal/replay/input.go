@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// queryCountColumn is the column of a query export that holds how many
+// events each row stands for.
+const queryCountColumn = "COUNT"
+
+// ReadSummaries reads recorded traffic in either of two formats:
+//
+//   - JSON lines, each a TraceSummary
+//   - a Honeycomb query export: a JSON array of result rows, each an object
+//     of the query's breakdown columns and a COUNT column. Each row stands
+//     for COUNT traces of one span with the row's fields.
+func ReadSummaries(r io.Reader) ([]TraceSummary, error) {
+	br := bufio.NewReader(r)
+	first, err := firstByte(br)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if first == '[' {
+		return readQueryExport(br)
+	}
+
+	var summaries []TraceSummary
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+	for {
+		var summary TraceSummary
+		err := dec.Decode(&summary)
+		if err == io.EOF {
+			return summaries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("trace summary %d: %w", len(summaries)+1, err)
+		}
+		for _, span := range summary.Spans {
+			normalizeNumbers(span)
+		}
+		summaries = append(summaries, summary)
+	}
+}
+
+func readQueryExport(r io.Reader) ([]TraceSummary, error) {
+	var rows []map[string]interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&rows); err != nil {
+		return nil, fmt.Errorf("query export: %w", err)
+	}
+	summaries := make([]TraceSummary, 0, len(rows))
+	for i, row := range rows {
+		normalizeNumbers(row)
+		count, ok := row[queryCountColumn].(int64)
+		if !ok || count < 0 || count > math.MaxInt32 {
+			return nil, fmt.Errorf("query export row %d: %s must be a non-negative integer", i+1, queryCountColumn)
+		}
+		delete(row, queryCountColumn)
+		if count == 0 {
+			continue
+		}
+		summaries = append(summaries, TraceSummary{
+			Count: int(count),
+			Spans: []map[string]interface{}{row},
+		})
+	}
+	return summaries, nil
+}
+
+// normalizeNumbers turns JSON numbers into int64 if they're whole, or
+// float64 if not, as they'd be in events that Refinery receives.
+func normalizeNumbers(fields map[string]interface{}) {
+	for k, v := range fields {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil && !strings.ContainsAny(n.String(), ".eE") {
+			fields[k] = i
+		} else if f, err := n.Float64(); err == nil {
+			fields[k] = f
+		}
+	}
+}
+
+func firstByte(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsRune([]byte(" \t\r\n"), rune(b)) {
+			return b, br.UnreadByte()
+		}
+	}
+}
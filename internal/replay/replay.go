@@ -0,0 +1,266 @@
+// Package replay runs recorded traffic through a sampler config offline, to
+// project how much of it the config would keep.
+package replay
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+)
+
+// TraceSummary is a recorded trace, or a group of traces with the same
+// fields.
+type TraceSummary struct {
+	TraceID     string `json:"trace_id"`
+	Dataset     string `json:"dataset"`
+	Environment string `json:"environment"`
+	APIKey      string `json:"api_key"`
+	// Count is how many traces the summary stands for; 0 means 1.
+	Count int `json:"count"`
+	// SpanCount is how many events the trace had, if Spans doesn't list all
+	// of them; 0 means the number of spans listed.
+	SpanCount int `json:"span_count"`
+	// Spans holds the fields of the spans that were recorded. The span
+	// without a parent ID is the root span.
+	Spans []map[string]interface{} `json:"spans"`
+}
+
+// Report is the projected outcome of a replay.
+type Report struct {
+	Traces     int64   `json:"traces"`
+	KeptTraces int64   `json:"kept_traces"`
+	KeepRate   float64 `json:"keep_rate"`
+	Events     int64   `json:"events"`
+	KeptEvents int64   `json:"kept_events"`
+	// Reasons counts the traces that each sampler or rule decided about,
+	// busiest first.
+	Reasons []ReasonCount `json:"reasons"`
+	// DryRun counts the traces that dry run rules matched.
+	DryRun []ReasonCount `json:"dry_run,omitempty"`
+}
+
+// ReasonCount is the part of a Report decided by one reason.
+type ReasonCount struct {
+	Target     string `json:"target"`
+	Reason     string `json:"reason"`
+	Traces     int64  `json:"traces"`
+	KeptTraces int64  `json:"kept_traces"`
+	Events     int64  `json:"events"`
+	KeptEvents int64  `json:"kept_events"`
+}
+
+// Replayer runs traces through the samplers of a config. Samplers are made
+// the first time their target is seen, and kept for the rest of the replay,
+// so the dynamic samplers learn from the replayed traffic as they would from
+// live traffic. They're given the traces as fast as they can take them,
+// though, so samplers that adjust their rates over time only approximate
+// what they'd do live.
+type Replayer struct {
+	Config  config.Config
+	Factory *sample.SamplerFactory
+
+	samplers map[string]sample.Sampler
+	reasons  map[reasonKey]*ReasonCount
+	dryRun   map[reasonKey]*ReasonCount
+	report   Report
+	// transforms caches the compiled parent ID transforms of the datasets
+	transforms map[string]*regexp.Regexp
+}
+
+type reasonKey struct {
+	target string
+	reason string
+}
+
+// Prepare makes the samplers for the traces, which registers the value
+// lists that their rules use, so that the lists can be loaded before the
+// traces are replayed.
+func (r *Replayer) Prepare(summaries []TraceSummary) error {
+	if r.samplers == nil {
+		r.samplers = make(map[string]sample.Sampler)
+		r.reasons = make(map[reasonKey]*ReasonCount)
+		r.dryRun = make(map[reasonKey]*ReasonCount)
+		r.transforms = make(map[string]*regexp.Regexp)
+	}
+	for i, summary := range summaries {
+		selector := r.selector(summary)
+		if _, ok := r.samplers[selector]; ok {
+			continue
+		}
+		sampler := r.Factory.GetSamplerImplementationForKey(selector)
+		if sampler == nil {
+			return fmt.Errorf("trace summary %d: no sampler for %q", i+1, selector)
+		}
+		r.samplers[selector] = sampler
+	}
+	return nil
+}
+
+// Replay runs each trace that a summary stands for through its sampler.
+func (r *Replayer) Replay(summaries []TraceSummary) error {
+	if err := r.Prepare(summaries); err != nil {
+		return err
+	}
+	consistent := r.Config.GetConsistentSamplingConfig().Enabled
+	spanIDFields := r.Config.GetSpanIdFieldNames()
+
+	for i, summary := range summaries {
+		selector := r.selector(summary)
+		sampler := r.samplers[selector]
+
+		rules := r.Config.GetIDFieldRules(summary.Dataset)
+		events := int64(summary.SpanCount)
+		if events == 0 {
+			events = int64(len(summary.Spans))
+		}
+		for n := 0; n < max(summary.Count, 1); n++ {
+			trace := summary.trace(n, i, r.hasParentFunc(summary.Dataset))
+			var decisionTrace sample.FieldsExtractor = sample.NewIDFieldsTrace(trace, spanIDFields, rules.ParentNames)
+			if consistent {
+				decisionTrace = sample.NewConsistentTrace(decisionTrace)
+			}
+			tr := sample.NewDryRunTrace(decisionTrace)
+			_, keep, reason, _ := sampler.GetSampleRate(tr)
+
+			r.count(r.reasons, reasonKey{selector, reason}, keep, events)
+			r.report.Traces++
+			r.report.Events += events
+			if keep {
+				r.report.KeptTraces++
+				r.report.KeptEvents += events
+			}
+			if tr.Matched {
+				r.count(r.dryRun, reasonKey{selector, tr.Reason}, tr.Keep, events)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) count(counts map[reasonKey]*ReasonCount, key reasonKey, keep bool, events int64) {
+	c, ok := counts[key]
+	if !ok {
+		c = &ReasonCount{Target: key.target, Reason: key.reason}
+		counts[key] = c
+	}
+	c.Traces++
+	c.Events += events
+	if keep {
+		c.KeptTraces++
+		c.KeptEvents += events
+	}
+}
+
+// Report returns the projected outcome of the traces replayed so far.
+func (r *Replayer) Report() Report {
+	report := r.report
+	if report.Traces > 0 {
+		report.KeepRate = float64(report.KeptTraces) / float64(report.Traces)
+	}
+	report.Reasons = sortedCounts(r.reasons)
+	report.DryRun = sortedCounts(r.dryRun)
+	return report
+}
+
+func sortedCounts(counts map[reasonKey]*ReasonCount) []ReasonCount {
+	sorted := make([]ReasonCount, 0, len(counts))
+	for _, c := range counts {
+		sorted = append(sorted, *c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Traces != sorted[j].Traces {
+			return sorted[i].Traces > sorted[j].Traces
+		}
+		if sorted[i].Target != sorted[j].Target {
+			return sorted[i].Target < sorted[j].Target
+		}
+		return sorted[i].Reason < sorted[j].Reason
+	})
+	return sorted
+}
+
+// selector returns the sampler selector for a trace, as the collector would
+// choose it.
+func (r *Replayer) selector(summary TraceSummary) string {
+	selector := summary.Environment
+	if selector == "" {
+		selector = summary.Dataset
+		if prefix := r.Config.GetDatasetPrefix(); prefix != "" && selector != "" {
+			selector = prefix + "." + selector
+		}
+	}
+	if tenant := r.Config.GetTenantForAPIKey(summary.APIKey); tenant != "" {
+		selector = config.TenantSelector(tenant, selector)
+	}
+	return selector
+}
+
+// trace makes the nth trace that a summary stands for. Each has its own
+// trace ID, so that samplers that hash it don't decide the same way about
+// all of them.
+func (s TraceSummary) trace(n int, index int, hasParent func(map[string]interface{}) bool) *types.Trace {
+	traceID := s.TraceID
+	if traceID == "" {
+		traceID = fmt.Sprintf("replay-%d", index)
+	}
+	if n > 0 {
+		traceID = fmt.Sprintf("%s-%d", traceID, n)
+	}
+	trace := &types.Trace{
+		TraceID: traceID,
+		Dataset: s.Dataset,
+		APIKey:  s.APIKey,
+	}
+	for _, fields := range s.Spans {
+		span := &types.Span{
+			TraceID: traceID,
+			Event: types.Event{
+				Dataset:     s.Dataset,
+				Environment: s.Environment,
+				APIKey:      s.APIKey,
+				Data:        fields,
+			},
+		}
+		trace.AddSpan(span)
+		if trace.RootSpan == nil && !hasParent(fields) {
+			trace.RootSpan = span
+		}
+	}
+	return trace
+}
+
+// hasParentFunc returns a function that reports whether a span in the
+// dataset has a parent ID, by the dataset's ID field rules. As in the router,
+// if the dataset has a parent ID transform, only a value that matches it is
+// a parent ID.
+func (r *Replayer) hasParentFunc(dataset string) func(map[string]interface{}) bool {
+	rules := r.Config.GetIDFieldRules(dataset)
+	var re *regexp.Regexp
+	if rules.ParentTransform != "" {
+		var ok bool
+		if re, ok = r.transforms[rules.ParentTransform]; !ok {
+			// an invalid transform is ignored, as it is by the router
+			re, _ = regexp.Compile(rules.ParentTransform)
+			r.transforms[rules.ParentTransform] = re
+		}
+	}
+	return func(fields map[string]interface{}) bool {
+		for _, name := range rules.ParentNames {
+			value, ok := fields[name]
+			if !ok {
+				continue
+			}
+			if re == nil {
+				return true
+			}
+			if s, ok := value.(string); ok && re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,138 @@
+package replay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
+)
+
+func TestReadSummaries(t *testing.T) {
+	summaries, err := ReadSummaries(strings.NewReader(`
+{"trace_id": "a", "dataset": "ds", "count": 3, "spans": [{"status": 500, "duration_ms": 1.5}]}
+{"trace_id": "b", "environment": "prod", "span_count": 40, "spans": [{"status": 200}]}
+`))
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, 3, summaries[0].Count)
+	assert.Equal(t, int64(500), summaries[0].Spans[0]["status"])
+	assert.Equal(t, 1.5, summaries[0].Spans[0]["duration_ms"])
+	assert.Equal(t, "prod", summaries[1].Environment)
+	assert.Equal(t, 40, summaries[1].SpanCount)
+
+	summaries, err = ReadSummaries(strings.NewReader(`[
+		{"status": 500, "COUNT": 12},
+		{"status": 200, "COUNT": 0},
+		{"status": 404, "COUNT": 3}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, 12, summaries[0].Count)
+	assert.Equal(t, map[string]interface{}{"status": int64(500)}, summaries[0].Spans[0])
+	assert.Equal(t, 3, summaries[1].Count)
+
+	_, err = ReadSummaries(strings.NewReader(`[{"status": 500}]`))
+	assert.Error(t, err)
+
+	summaries, err = ReadSummaries(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Empty(t, summaries)
+}
+
+func TestReplay(t *testing.T) {
+	rules := &config.RulesBasedSamplerConfig{
+		Rules: []*config.RulesBasedSamplerRule{{
+			Name:       "keep errors",
+			SampleRate: 1,
+			Conditions: []*config.RulesBasedSamplerCondition{{
+				Field: "status", Operator: config.GTE, Value: 500, Datatype: "int",
+			}},
+		}, {
+			Name:   "would drop health checks",
+			Drop:   true,
+			DryRun: true,
+			Conditions: []*config.RulesBasedSamplerCondition{{
+				Field: "path", Operator: config.EQ, Value: "/health",
+			}},
+		}, {
+			Name: "drop the rest",
+			Drop: true,
+		}},
+	}
+	cfg := &config.MockConfig{
+		GetSamplerTypeVal:  rules,
+		ParentIdFieldNames: []string{"trace.parent_id"},
+	}
+	factory := &sample.SamplerFactory{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	replayer := &Replayer{Config: cfg, Factory: factory}
+
+	err := replayer.Replay([]TraceSummary{
+		{Dataset: "ds", Count: 2, Spans: []map[string]interface{}{
+			{"status": int64(503)},
+			{"trace.parent_id": "x", "status": int64(200)},
+		}},
+		{Dataset: "ds", Count: 5, SpanCount: 10, Spans: []map[string]interface{}{
+			{"status": int64(200), "path": "/health"},
+		}},
+		{Dataset: "ds", Spans: []map[string]interface{}{
+			{"status": int64(200)},
+		}},
+	})
+	require.NoError(t, err)
+
+	report := replayer.Report()
+	assert.Equal(t, int64(8), report.Traces)
+	assert.Equal(t, int64(2), report.KeptTraces)
+	assert.Equal(t, 0.25, report.KeepRate)
+	assert.Equal(t, int64(2*2+5*10+1), report.Events)
+	assert.Equal(t, int64(4), report.KeptEvents)
+
+	assert.Equal(t, []ReasonCount{
+		{Target: "ds", Reason: "rules/trace/drop the rest", Traces: 6, Events: 51},
+		{Target: "ds", Reason: "rules/trace/keep errors", Traces: 2, KeptTraces: 2, Events: 4, KeptEvents: 4},
+	}, report.Reasons)
+	assert.Equal(t, []ReasonCount{
+		{Target: "ds", Reason: "rules/trace/would drop health checks", Traces: 5, Events: 50},
+	}, report.DryRun)
+}
+
+func TestReplayDatasetIDRules(t *testing.T) {
+	rules := &config.RulesBasedSamplerConfig{
+		Rules: []*config.RulesBasedSamplerRule{{
+			Name:       "keep by root",
+			SampleRate: 1,
+			Conditions: []*config.RulesBasedSamplerCondition{{
+				Field: "root.kind", Operator: config.EQ, Value: "entry",
+			}},
+		}, {
+			Name: "drop the rest",
+			Drop: true,
+		}},
+	}
+	cfg := &config.MockConfig{
+		GetSamplerTypeVal:  rules,
+		ParentIdFieldNames: []string{"trace.parent_id"},
+		IDFieldRules: map[string]config.IDFieldRules{
+			"legacy": {ParentNames: []string{"parent"}, ParentTransform: "^span-(.+)$"},
+		},
+	}
+	factory := &sample.SamplerFactory{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	replayer := &Replayer{Config: cfg, Factory: factory}
+
+	// the legacy dataset's root is the span whose parent field doesn't match
+	// its transform; the global parent field means nothing there
+	err := replayer.Replay([]TraceSummary{
+		{Dataset: "legacy", Spans: []map[string]interface{}{
+			{"parent": "span-1", "trace.parent_id": "x", "kind": "child"},
+			{"parent": "none", "trace.parent_id": "x", "kind": "entry"},
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), replayer.Report().KeptTraces)
+}
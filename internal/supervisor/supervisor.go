@@ -0,0 +1,185 @@
+// Package supervisor runs Refinery's long-running goroutines so that a panic
+// in one of them is recovered and reported, and the goroutine restarted,
+// instead of taking down the whole process.
+package supervisor
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+// maxReports is the number of recent crash reports that are kept.
+const maxReports = 20
+
+// labelSubsystem is the label that the restart metrics are broken down by.
+const labelSubsystem = "subsystem"
+
+// CrashReport describes one panic in a supervised goroutine.
+type CrashReport struct {
+	Subsystem string    `json:"subsystem"`
+	Time      time.Time `json:"time"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	// Restarts is the number of times the goroutine has been restarted
+	// within the restart window, including after this panic.
+	Restarts int `json:"restarts"`
+	// Restarted is false if the goroutine had been restarted too often, and
+	// the panic was allowed to end the process.
+	Restarted bool `json:"restarted"`
+}
+
+// Supervisor recovers panics in the goroutines it runs and restarts them, up
+// to the limits in the Supervision config. A nil Supervisor runs goroutines
+// without supervision, so components that are built without one, as in
+// tests, behave as before.
+type Supervisor struct {
+	Config  config.Config   `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	Clock   clockwork.Clock `inject:""`
+
+	mut sync.Mutex
+	// restarts holds the times of each subsystem's restarts within the
+	// restart window
+	restarts map[string][]time.Time
+	// reports are the most recent crash reports, oldest first
+	reports []CrashReport
+}
+
+func (s *Supervisor) Start() error {
+	metrics.RegisterLabeled(s.Metrics, "goroutine_panics", "counter", []string{labelSubsystem})
+	metrics.RegisterLabeled(s.Metrics, "goroutine_restarts", "counter", []string{labelSubsystem})
+	return nil
+}
+
+// Wrap returns a function that calls fn, and calls it again each time it
+// panics, until it returns or the subsystem has been restarted too often.
+// It's meant to be passed to an errgroup.
+func (s *Supervisor) Wrap(subsystem string, fn func() error) func() error {
+	if s == nil {
+		return fn
+	}
+	return func() error {
+		for {
+			recovered, err := s.call(fn)
+			if recovered == nil {
+				return err
+			}
+			delay, ok := s.recordCrash(subsystem, recovered)
+			if !ok {
+				panic(recovered.value)
+			}
+			s.Clock.Sleep(delay)
+		}
+	}
+}
+
+// Go runs fn in a new goroutine under supervision.
+func (s *Supervisor) Go(subsystem string, fn func()) {
+	go func() {
+		_ = s.Wrap(subsystem, func() error {
+			fn()
+			return nil
+		})()
+	}()
+}
+
+// Reports returns the most recent crash reports, newest first.
+func (s *Supervisor) Reports() []CrashReport {
+	if s == nil {
+		return nil
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	reports := make([]CrashReport, 0, len(s.reports))
+	for i := len(s.reports) - 1; i >= 0; i-- {
+		reports = append(reports, s.reports[i])
+	}
+	return reports
+}
+
+// panicked holds a recovered panic along with the stack it was raised on.
+type panicked struct {
+	value interface{}
+	stack []byte
+}
+
+// call runs fn, recovering a panic; it returns the recovered panic, or what
+// fn returned.
+func (s *Supervisor) call(fn func() error) (recovered *panicked, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			recovered = &panicked{value: r, stack: debug.Stack()}
+		}
+	}()
+	return nil, fn()
+}
+
+// recordCrash reports a panic and decides whether to restart the subsystem;
+// it returns how long to wait before restarting it, and false if it has been
+// restarted too often.
+func (s *Supervisor) recordCrash(subsystem string, p *panicked) (time.Duration, bool) {
+	cfg := s.Config.GetSupervisionConfig()
+	labels := metrics.Labels{labelSubsystem: subsystem}
+	metrics.IncrementLabeled(s.Metrics, "goroutine_panics", labels)
+
+	s.mut.Lock()
+	if s.restarts == nil {
+		s.restarts = make(map[string][]time.Time)
+	}
+	now := s.Clock.Now()
+	// forget the restarts that are outside the window
+	window := time.Duration(cfg.RestartWindow)
+	recent := s.restarts[subsystem][:0]
+	for _, t := range s.restarts[subsystem] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	restart := len(recent) < cfg.MaxRestarts
+	if restart {
+		recent = append(recent, now)
+	}
+	s.restarts[subsystem] = recent
+
+	report := CrashReport{
+		Subsystem: subsystem,
+		Time:      now,
+		Panic:     fmt.Sprint(p.value),
+		Stack:     string(p.stack),
+		Restarts:  len(recent),
+		Restarted: restart,
+	}
+	s.reports = append(s.reports, report)
+	if len(s.reports) > maxReports {
+		s.reports = s.reports[len(s.reports)-maxReports:]
+	}
+	s.mut.Unlock()
+
+	fields := map[string]interface{}{
+		"subsystem": report.Subsystem,
+		"panic":     report.Panic,
+		"stack":     report.Stack,
+		"restarts":  report.Restarts,
+	}
+	if !restart {
+		s.Logger.Error().WithFields(fields).Logf("goroutine panicked and has been restarted too often; exiting")
+		return 0, false
+	}
+	s.Logger.Error().WithFields(fields).Logf("goroutine panicked; restarting it")
+	metrics.IncrementLabeled(s.Metrics, "goroutine_restarts", labels)
+
+	// the wait doubles with each restart in the window
+	delay := time.Duration(cfg.RestartBackoff)
+	for i := 1; i < len(recent) && delay < window; i++ {
+		delay *= 2
+	}
+	return min(delay, window), true
+}
@@ -0,0 +1,93 @@
+package supervisor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSupervisor(t *testing.T, clock clockwork.Clock, maxRestarts int) *Supervisor {
+	s := &Supervisor{
+		Config: &config.MockConfig{Supervision: config.SupervisionConfig{
+			MaxRestarts:    maxRestarts,
+			RestartWindow:  config.Duration(time.Minute),
+			RestartBackoff: config.Duration(time.Millisecond),
+		}},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Clock:   clock,
+	}
+	require.NoError(t, s.Start())
+	return s
+}
+
+func TestWrapRestartsAfterPanic(t *testing.T) {
+	s := newTestSupervisor(t, clockwork.NewRealClock(), 3)
+
+	var calls int
+	errDone := errors.New("done")
+	err := s.Wrap("test", func() error {
+		calls++
+		if calls < 3 {
+			panic("bad field type")
+		}
+		return errDone
+	})()
+	require.ErrorIs(t, err, errDone)
+	assert.Equal(t, 3, calls)
+
+	reports := s.Reports()
+	require.Len(t, reports, 2)
+	assert.Equal(t, "test", reports[0].Subsystem)
+	assert.Equal(t, "bad field type", reports[0].Panic)
+	assert.Contains(t, reports[0].Stack, "TestWrapRestartsAfterPanic")
+	assert.Equal(t, 2, reports[0].Restarts)
+	assert.True(t, reports[0].Restarted)
+}
+
+func TestWrapGivesUpAfterMaxRestarts(t *testing.T) {
+	s := newTestSupervisor(t, clockwork.NewRealClock(), 2)
+
+	var calls int
+	fn := s.Wrap("test", func() error {
+		calls++
+		panic("always")
+	})
+	assert.PanicsWithValue(t, "always", func() { fn() })
+	assert.Equal(t, 3, calls)
+	reports := s.Reports()
+	require.Len(t, reports, 3)
+	assert.False(t, reports[0].Restarted)
+}
+
+func TestRestartBackoff(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s := newTestSupervisor(t, clock, 10)
+	p := &panicked{value: "oops"}
+
+	for _, expected := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond} {
+		delay, ok := s.recordCrash("test", p)
+		require.True(t, ok)
+		assert.Equal(t, expected, delay)
+	}
+
+	// restarts outside the window no longer count
+	clock.Advance(2 * time.Minute)
+	delay, ok := s.recordCrash("test", p)
+	require.True(t, ok)
+	assert.Equal(t, time.Millisecond, delay)
+}
+
+func TestNilSupervisor(t *testing.T) {
+	var s *Supervisor
+	errDone := errors.New("done")
+	assert.ErrorIs(t, s.Wrap("test", func() error { return errDone })(), errDone)
+	assert.Nil(t, s.Reports())
+}
@@ -0,0 +1,162 @@
+package upstreamprobe
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+)
+
+// HealthSource is the name the probe reports its results to Health under.
+const HealthSource = "upstream"
+
+// Probe periodically checks that the upstream API can be reached, backing
+// off while it can't. The results are reported to Health, and the length of
+// the current failure is published as the upstream_probe_failure_seconds
+// gauge, which stress relief compares to UPSTREAM_PROBE_FAILURE_LIMIT.
+type Probe struct {
+	Config        config.Config   `inject:""`
+	Logger        logger.Logger   `inject:""`
+	Metrics       metrics.Metrics `inject:"genericMetrics"`
+	Clock         clockwork.Clock `inject:""`
+	HTTPTransport *http.Transport `inject:"upstreamTransport"`
+	Health        health.Recorder `inject:""`
+
+	client *http.Client
+	// failingSince is when the current run of failed probes began; it's zero
+	// while the upstream API is reachable. Only the run loop uses it.
+	failingSince time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (p *Probe) Start() error {
+	cfg := p.Config.GetUpstreamProbeConfig()
+	if !cfg.Enabled {
+		return nil
+	}
+	p.client = &http.Client{Transport: p.HTTPTransport}
+
+	p.Metrics.Register("upstream_probe_failures", "counter")
+	p.Metrics.Register("upstream_probe_latency_ms", "histogram")
+	p.Metrics.Register("upstream_probe_failure_seconds", "gauge")
+	p.Metrics.Store("UPSTREAM_PROBE_FAILURE_LIMIT", time.Duration(cfg.FailureThreshold).Seconds())
+
+	// the longest gap between reports is a timed-out probe after the
+	// longest backoff
+	p.Health.Register(HealthSource, 2*(time.Duration(cfg.MaxBackoff)+time.Duration(cfg.Timeout)))
+
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go p.run()
+	return nil
+}
+
+func (p *Probe) Stop() error {
+	if p.done != nil {
+		close(p.done)
+		p.wg.Wait()
+		p.Health.Unregister(HealthSource)
+	}
+	return nil
+}
+
+func (p *Probe) run() {
+	defer p.wg.Done()
+
+	var delay time.Duration
+	for {
+		cfg := p.Config.GetUpstreamProbeConfig()
+		delay = nextDelay(delay, p.check(), time.Duration(cfg.Interval), time.Duration(cfg.MaxBackoff))
+		select {
+		case <-p.Clock.After(delay):
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// nextDelay returns the time until the next probe: interval after a success,
+// and twice the previous delay, up to maxBackoff, after a failure.
+func nextDelay(previous time.Duration, ok bool, interval time.Duration, maxBackoff time.Duration) time.Duration {
+	if ok || previous <= 0 {
+		return interval
+	}
+	return max(min(2*previous, maxBackoff), interval)
+}
+
+// check probes the upstream API once and reports the result. It returns
+// whether the API was reachable.
+func (p *Probe) check() bool {
+	cfg := p.Config.GetUpstreamProbeConfig()
+	start := p.Clock.Now()
+	err := p.probe(time.Duration(cfg.Timeout))
+	now := p.Clock.Now()
+	p.Metrics.Histogram("upstream_probe_latency_ms", float64(now.Sub(start).Milliseconds()))
+
+	if err == nil {
+		if !p.failingSince.IsZero() {
+			p.Logger.Info().WithField("failed_for", now.Sub(p.failingSince).String()).Logf("upstream API is reachable again")
+		}
+		p.failingSince = time.Time{}
+		p.Metrics.Gauge("upstream_probe_failure_seconds", 0)
+		p.Health.Ready(HealthSource, true)
+		return true
+	}
+
+	p.Metrics.Increment("upstream_probe_failures")
+	if p.failingSince.IsZero() {
+		p.failingSince = start
+		p.Logger.Warn().Logf("upstream API is unreachable: %s", err)
+	}
+	failing := now.Sub(p.failingSince)
+	p.Metrics.Gauge("upstream_probe_failure_seconds", failing.Seconds())
+
+	detail := fmt.Sprintf("unreachable for %s: %s", failing.Round(time.Second), err)
+	if failing >= time.Duration(cfg.FailureThreshold) {
+		p.Health.Report(HealthSource, health.StatusFailed, detail)
+	} else {
+		p.Health.Report(HealthSource, health.StatusDegraded, detail)
+	}
+	return false
+}
+
+// probe sends a HEAD request to the API's auth endpoint. No API key is sent,
+// so the expected answer is a 401; only server errors and failures to get an
+// answer at all mean the API can't be reached.
+func (p *Probe) probe(timeout time.Duration) error {
+	authURL, err := url.Parse(p.Config.GetHoneycombAPI())
+	if err != nil {
+		return fmt.Errorf("failed to parse Honeycomb API URL config value. %w", err)
+	}
+	authURL.Path = "/1/auth"
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, authURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("received %d response", resp.StatusCode)
+	}
+	return nil
+}
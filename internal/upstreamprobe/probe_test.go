@@ -0,0 +1,83 @@
+package upstreamprobe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeReportsProlongedFailure(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusUnauthorized)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		assert.Equal(t, "/1/auth", r.URL.Path)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	clock := clockwork.NewFakeClock()
+	h := &health.Health{Clock: clock}
+	require.NoError(t, h.Start())
+	defer h.Stop()
+	m := &metrics.MockMetrics{}
+	m.Start()
+
+	p := &Probe{
+		Config: &config.MockConfig{
+			GetHoneycombAPIVal: server.URL,
+			UpstreamProbe: config.UpstreamProbeConfig{
+				Timeout:          config.Duration(time.Second),
+				MaxBackoff:       config.Duration(time.Minute),
+				FailureThreshold: config.Duration(time.Minute),
+			},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: m,
+		Clock:   clock,
+		Health:  h,
+		client:  server.Client(),
+	}
+	h.Register(HealthSource, time.Hour)
+
+	// a 401 still means the API can be reached
+	assert.True(t, p.check())
+	assert.Equal(t, health.StatusOK, h.Subsystems()[HealthSource].Status)
+
+	status.Store(http.StatusServiceUnavailable)
+	assert.False(t, p.check())
+	assert.Equal(t, health.StatusDegraded, h.Subsystems()[HealthSource].Status)
+	assert.True(t, h.IsReady())
+
+	clock.Advance(time.Minute)
+	assert.False(t, p.check())
+	assert.Equal(t, health.StatusFailed, h.Subsystems()[HealthSource].Status)
+	assert.False(t, h.IsReady())
+	failing, _ := m.Get("upstream_probe_failure_seconds")
+	assert.Equal(t, float64(60), failing)
+
+	status.Store(http.StatusOK)
+	assert.True(t, p.check())
+	assert.True(t, h.IsReady())
+	failing, _ = m.Get("upstream_probe_failure_seconds")
+	assert.Zero(t, failing)
+}
+
+func TestNextDelay(t *testing.T) {
+	interval, maxBackoff := 10*time.Second, time.Minute
+	assert.Equal(t, interval, nextDelay(0, false, interval, maxBackoff))
+	assert.Equal(t, 20*time.Second, nextDelay(interval, false, interval, maxBackoff))
+	assert.Equal(t, 40*time.Second, nextDelay(20*time.Second, false, interval, maxBackoff))
+	assert.Equal(t, maxBackoff, nextDelay(40*time.Second, false, interval, maxBackoff))
+	assert.Equal(t, interval, nextDelay(maxBackoff, true, interval, maxBackoff))
+}
@@ -0,0 +1,125 @@
+package valuelists
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+	"github.com/jonboulle/clockwork"
+)
+
+// Loader keeps the value lists named by rule conditions up to date. Lists in
+// files are first loaded with the rules; lists in Redis are loaded when the
+// loader starts and whenever the rules change, and conditions that use a list
+// match nothing until it has been. Every list is reloaded every
+// ValueListRefreshInterval, and if it can't be, its last values are kept.
+type Loader struct {
+	Config  config.Config   `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	Clock   clockwork.Clock `inject:""`
+	// Redis is the client for lists kept in Redis sets. It is nil if there
+	// is no Redis, and then those lists can't be loaded.
+	Redis redis.Client
+
+	mut       sync.Mutex
+	refreshed map[string]time.Time
+	done      chan struct{}
+}
+
+func (l *Loader) Start() error {
+	l.refreshed = make(map[string]time.Time)
+	l.done = make(chan struct{})
+
+	l.Metrics.Register("value_list_loads", "counter")
+	l.Metrics.Register("value_list_load_errors", "counter")
+	l.Metrics.Register("value_lists", "gauge")
+
+	l.refresh(l.Clock.Now())
+	l.Config.RegisterReloadCallback(l.Refresh)
+	go l.run()
+	return nil
+}
+
+func (l *Loader) Stop() error {
+	close(l.done)
+	return nil
+}
+
+// run checks every second for lists that are new or due to be reloaded.
+func (l *Loader) run() {
+	ticker := l.Clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.Chan():
+			l.refresh(now)
+		}
+	}
+}
+
+// Refresh loads every list that is due to be loaded now, rather than waiting
+// for the next check, for tools that sample traces without running for long.
+func (l *Loader) Refresh() {
+	l.refresh(l.Clock.Now())
+}
+
+// refresh loads every list that hasn't been loaded in the last refresh
+// interval.
+func (l *Loader) refresh(now time.Time) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	interval := l.Config.GetValueListRefreshInterval()
+	lists := config.ValueLists()
+	l.Metrics.Gauge("value_lists", len(lists))
+	// forget lists that the rules no longer name
+	named := make(map[string]bool, len(lists))
+	for _, list := range lists {
+		named[list.Source] = true
+	}
+	for source := range l.refreshed {
+		if !named[source] {
+			delete(l.refreshed, source)
+		}
+	}
+	for _, list := range lists {
+		if now.Sub(l.refreshed[list.Source]) < interval {
+			continue
+		}
+		// a list that failed to load is retried at the next interval too
+		l.refreshed[list.Source] = now
+
+		values, err := l.load(list)
+		if err != nil {
+			l.Metrics.Increment("value_list_load_errors")
+			l.Logger.Error().WithField("source", list.Source).Logf("failed to load value list: %s", err)
+			continue
+		}
+		list.Set(values)
+		l.Metrics.Increment("value_list_loads")
+		l.Logger.Debug().WithField("source", list.Source).WithField("values", len(values)).Logf("loaded value list")
+	}
+}
+
+func (l *Loader) load(list *config.ValueList) ([]string, error) {
+	switch list.Kind {
+	case config.ValueListFile:
+		return config.ReadValueListFile(list.Location)
+	case config.ValueListRedis:
+		if l.Redis == nil {
+			return nil, fmt.Errorf("redis value lists need a redis store")
+		}
+		conn := l.Redis.Get()
+		defer conn.Close()
+		return conn.SMembers(list.Location)
+	default:
+		return nil, fmt.Errorf("unknown value list kind '%s'", list.Kind)
+	}
+}
@@ -0,0 +1,81 @@
+package valuelists
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLoader(t *testing.T) *Loader {
+	l := &Loader{
+		Config:  &config.MockConfig{ValueListRefreshInterval: time.Minute},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Clock:   clockwork.NewFakeClock(),
+	}
+	require.NoError(t, l.Start())
+	t.Cleanup(func() { l.Stop() })
+	return l
+}
+
+func TestLoaderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "beta.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# beta customers\ncust-1\n\n  cust-2  \n"), 0644))
+	list, err := config.GetValueList("file:" + path)
+	require.NoError(t, err)
+
+	l := newTestLoader(t)
+	now := l.Clock.Now()
+	l.refresh(now)
+	assert.True(t, list.Contains("cust-1", ""))
+	assert.True(t, list.Contains("cust-2", ""))
+	assert.False(t, list.Contains("# beta customers", ""))
+	assert.Equal(t, 2, list.Len())
+
+	// changes are only picked up once the interval has passed
+	require.NoError(t, os.WriteFile(path, []byte("cust-3\n"), 0644))
+	l.refresh(now.Add(30 * time.Second))
+	assert.True(t, list.Contains("cust-1", ""))
+	l.refresh(now.Add(time.Minute))
+	assert.False(t, list.Contains("cust-1", ""))
+	assert.True(t, list.Contains("cust-3", ""))
+
+	// a list that can't be read keeps its last values
+	require.NoError(t, os.Remove(path))
+	l.refresh(now.Add(2 * time.Minute))
+	assert.True(t, list.Contains("cust-3", ""))
+}
+
+func TestLoaderRedis(t *testing.T) {
+	list, err := config.GetValueList("redis:beta-customers")
+	require.NoError(t, err)
+
+	l := newTestLoader(t)
+	now := l.Clock.Now()
+
+	// without redis the list can't be loaded
+	l.refresh(now)
+	assert.False(t, list.Loaded())
+	assert.Equal(t, 0, list.Len())
+
+	rs := &redis.TestService{}
+	require.NoError(t, rs.Start())
+	defer rs.Stop()
+	_, err = rs.Service.SAdd("beta-customers", "cust-1", "cust-2")
+	require.NoError(t, err)
+	l.Redis = rs
+
+	l.refresh(now.Add(time.Minute))
+	assert.True(t, list.Contains("cust-1", ""))
+	assert.True(t, list.Contains("cust-2", ""))
+	assert.False(t, list.Contains("cust-3", ""))
+}
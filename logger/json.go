@@ -0,0 +1,299 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/honeycombio/dynsampler-go"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+// DefaultSubsystem names the level that applies to every subsystem without a
+// level of its own.
+const DefaultSubsystem = "default"
+
+// levelPanic is the slog level for config.PanicLevel, which is above every
+// level that Refinery logs at.
+const levelPanic = slog.LevelError + 4
+
+// SubsystemLogger is implemented by loggers that can log each subsystem at a
+// level of its own.
+type SubsystemLogger interface {
+	Subsystem(name string) Logger
+}
+
+// ForSubsystem returns the logger for the named subsystem, or l itself if it
+// doesn't support subsystems.
+func ForSubsystem(l Logger, name string) Logger {
+	if sl, ok := l.(SubsystemLogger); ok {
+		return sl.Subsystem(name)
+	}
+	return l
+}
+
+// LevelController is implemented by loggers whose levels can be changed for
+// each subsystem while Refinery is running.
+type LevelController interface {
+	// Levels returns the level of each subsystem that has one, and of
+	// DefaultSubsystem.
+	Levels() map[string]string
+	// SetSubsystemLevel sets the level of a subsystem, or of every subsystem
+	// without one if it's DefaultSubsystem.
+	SetSubsystemLevel(subsystem string, level string) error
+	// ClearSubsystemLevel returns a subsystem to the default level.
+	ClearSubsystemLevel(subsystem string)
+}
+
+// levelSet is an immutable set of levels; it's replaced as a whole when a
+// level changes, so that checking a level doesn't need a lock.
+type levelSet struct {
+	def        slog.Level
+	subsystems map[string]slog.Level
+}
+
+func (s *levelSet) level(subsystem string) slog.Level {
+	if level, ok := s.subsystems[subsystem]; ok {
+		return level
+	}
+	return s.def
+}
+
+// JSONLogger is a Logger implementation that writes each log to stdout as a
+// JSON object, using log/slog. Each subsystem can have its own level, which
+// can be changed at runtime, and repetitive logs are sampled.
+type JSONLogger struct {
+	Config config.Config `inject:""`
+	// Output is where logs are written; if nil, it's stdout.
+	Output io.Writer
+
+	// these are shared by the logger of every subsystem
+	shared *jsonShared
+	// subsystem is empty for the root logger
+	subsystem string
+}
+
+type jsonShared struct {
+	once    sync.Once
+	handler slog.Handler
+	levels  atomic.Pointer[levelSet]
+	// mut serializes changes to levels
+	mut     sync.Mutex
+	sampler dynsampler.Sampler
+}
+
+var _ = Logger((*JSONLogger)(nil))
+var _ = LevelController((*JSONLogger)(nil))
+
+// init sets up the state shared by every subsystem; it's needed before Start
+// since SetLevel is called before the logger is started.
+func (l *JSONLogger) init() *jsonShared {
+	if l.shared == nil {
+		l.shared = &jsonShared{}
+	}
+	l.shared.once.Do(func() {
+		l.shared.levels.Store(&levelSet{def: slog.LevelWarn})
+	})
+	return l.shared
+}
+
+func (l *JSONLogger) Start() error {
+	shared := l.init()
+	out := l.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	// levels are checked before a record is built, so the handler takes
+	// every record it's given
+	shared.handler = slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.Level(-100)})
+
+	for subsystem, level := range l.Config.GetLoggerSubsystemLevels() {
+		if err := l.SetSubsystemLevel(subsystem, level.String()); err != nil {
+			return err
+		}
+	}
+
+	cfg := l.Config.GetJSONLoggerConfig()
+	if cfg.GetSamplerEnabled() {
+		shared.sampler = &dynsampler.PerKeyThroughput{
+			ClearFrequencyDuration: 10 * time.Second,
+			PerKeyThroughputPerSec: cfg.SamplerThroughput,
+			MaxKeys:                1000,
+		}
+		if err := shared.sampler.Start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subsystem returns a logger for the named subsystem, which logs at that
+// subsystem's level and adds a subsystem field to each log.
+func (l *JSONLogger) Subsystem(name string) Logger {
+	return &JSONLogger{Config: l.Config, Output: l.Output, shared: l.init(), subsystem: name}
+}
+
+func (l *JSONLogger) Debug() Entry { return l.entry(slog.LevelDebug) }
+func (l *JSONLogger) Info() Entry  { return l.entry(slog.LevelInfo) }
+func (l *JSONLogger) Warn() Entry  { return l.entry(slog.LevelWarn) }
+func (l *JSONLogger) Error() Entry { return l.entry(slog.LevelError) }
+
+func (l *JSONLogger) entry(level slog.Level) Entry {
+	shared := l.init()
+	if level < shared.levels.Load().level(l.subsystem) || shared.handler == nil {
+		return nullEntry
+	}
+	return &JSONEntry{logger: l, level: level}
+}
+
+// SetLevel sets the default level.
+func (l *JSONLogger) SetLevel(level string) error {
+	return l.SetSubsystemLevel(DefaultSubsystem, level)
+}
+
+func (l *JSONLogger) SetSubsystemLevel(subsystem string, level string) error {
+	slogLevel, err := parseSlogLevel(level)
+	if err != nil {
+		return err
+	}
+	l.updateLevels(func(s *levelSet) {
+		if subsystem == DefaultSubsystem {
+			s.def = slogLevel
+		} else {
+			s.subsystems[subsystem] = slogLevel
+		}
+	})
+	return nil
+}
+
+func (l *JSONLogger) ClearSubsystemLevel(subsystem string) {
+	l.updateLevels(func(s *levelSet) {
+		delete(s.subsystems, subsystem)
+	})
+}
+
+// updateLevels replaces the levels with a changed copy.
+func (l *JSONLogger) updateLevels(change func(*levelSet)) {
+	shared := l.init()
+	shared.mut.Lock()
+	defer shared.mut.Unlock()
+
+	current := shared.levels.Load()
+	updated := &levelSet{def: current.def, subsystems: make(map[string]slog.Level, len(current.subsystems)+1)}
+	for k, v := range current.subsystems {
+		updated.subsystems[k] = v
+	}
+	change(updated)
+	shared.levels.Store(updated)
+}
+
+func (l *JSONLogger) Levels() map[string]string {
+	current := l.init().levels.Load()
+	levels := make(map[string]string, len(current.subsystems)+1)
+	levels[DefaultSubsystem] = slogLevelName(current.def)
+	for subsystem, level := range current.subsystems {
+		levels[subsystem] = slogLevelName(level)
+	}
+	return levels
+}
+
+// parseSlogLevel converts a config level name to a slog level.
+func parseSlogLevel(level string) (slog.Level, error) {
+	switch config.ParseLevel(level) {
+	case config.DebugLevel:
+		return slog.LevelDebug, nil
+	case config.InfoLevel:
+		return slog.LevelInfo, nil
+	case config.WarnLevel:
+		return slog.LevelWarn, nil
+	case config.ErrorLevel:
+		return slog.LevelError, nil
+	case config.PanicLevel:
+		return levelPanic, nil
+	default:
+		return 0, fmt.Errorf("unknown log level '%s'", level)
+	}
+}
+
+func slogLevelName(level slog.Level) string {
+	switch {
+	case level >= levelPanic:
+		return config.PanicLevel.String()
+	case level >= slog.LevelError:
+		return config.ErrorLevel.String()
+	case level >= slog.LevelWarn:
+		return config.WarnLevel.String()
+	case level >= slog.LevelInfo:
+		return config.InfoLevel.String()
+	default:
+		return config.DebugLevel.String()
+	}
+}
+
+type JSONEntry struct {
+	logger *JSONLogger
+	level  slog.Level
+	attrs  []slog.Attr
+}
+
+// with returns a copy of the entry with attrs added; entries are shared, so
+// the original's attrs are never appended to in place.
+func (e *JSONEntry) with(attrs ...slog.Attr) *JSONEntry {
+	combined := make([]slog.Attr, 0, len(e.attrs)+len(attrs))
+	combined = append(combined, e.attrs...)
+	return &JSONEntry{logger: e.logger, level: e.level, attrs: append(combined, attrs...)}
+}
+
+func (e *JSONEntry) WithField(key string, value interface{}) Entry {
+	// errors are written as their messages, since most don't marshal to JSON
+	if err, ok := value.(error); ok {
+		return e.with(slog.String(key, err.Error()))
+	}
+	return e.with(slog.Any(key, value))
+}
+
+func (e *JSONEntry) WithString(key string, value string) Entry {
+	return e.with(slog.String(key, value))
+}
+
+func (e *JSONEntry) WithFields(fields map[string]interface{}) Entry {
+	var entry Entry = e
+	for k, v := range fields {
+		entry = entry.WithField(k, v)
+	}
+	return entry
+}
+
+func (e *JSONEntry) Logf(f string, args ...interface{}) {
+	shared := e.logger.shared
+	attrs := e.attrs
+	if shared.sampler != nil {
+		// sample on the subsystem, level and format string, so that a log
+		// that repeats is sampled whatever its args are
+		rate := shared.sampler.GetSampleRate(fmt.Sprintf("%s:%s:%s", e.logger.subsystem, e.level, f))
+		if shouldDrop(uint(rate)) {
+			return
+		}
+		if rate > 1 {
+			attrs = append(attrs[:len(attrs):len(attrs)], slog.Int("sample_rate", rate))
+		}
+	}
+	if e.logger.subsystem != "" {
+		attrs = append(attrs[:len(attrs):len(attrs)], slog.String("subsystem", e.logger.subsystem))
+	}
+
+	msg := f
+	if len(args) > 0 {
+		msg = fmt.Sprintf(f, args...)
+	}
+	record := slog.NewRecord(time.Now(), e.level, msg, 0)
+	record.AddAttrs(attrs...)
+	shared.handler.Handle(context.Background(), record)
+}
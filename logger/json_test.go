@@ -0,0 +1,108 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/dynsampler-go"
+	"github.com/honeycombio/refinery/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJSONLogger(t *testing.T, cfg *config.MockConfig) (*JSONLogger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	l := &JSONLogger{Config: cfg, Output: out}
+	require.NoError(t, l.SetLevel(cfg.GetLoggerLevel().String()))
+	require.NoError(t, l.Start())
+	return l, out
+}
+
+func jsonLines(t *testing.T, out *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestJSONLoggerSubsystemLevels(t *testing.T) {
+	disabled := config.DefaultTrue(false)
+	l, out := newTestJSONLogger(t, &config.MockConfig{
+		GetLoggerLevelVal:           config.WarnLevel,
+		GetLoggerSubsystemLevelsVal: map[string]config.Level{"collector": config.DebugLevel},
+		GetJSONLoggerConfigVal:      config.JSONLoggerConfig{SamplerEnabled: &disabled},
+	})
+	collector := ForSubsystem(l, "collector")
+	router := ForSubsystem(l, "router")
+
+	collector.Debug().WithField("err", errors.New("boom")).WithString("dataset", "ds").Logf("collector %s", "debug")
+	router.Info().Logf("router info")
+	router.Warn().WithFields(map[string]interface{}{"count": 3}).Logf("router warn")
+	l.Info().Logf("root info")
+
+	lines := jsonLines(t, out)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "DEBUG", lines[0]["level"])
+	assert.Equal(t, "collector debug", lines[0]["msg"])
+	assert.Equal(t, "collector", lines[0]["subsystem"])
+	assert.Equal(t, "boom", lines[0]["err"])
+	assert.Equal(t, "ds", lines[0]["dataset"])
+	assert.Equal(t, "router", lines[1]["subsystem"])
+	assert.Equal(t, 3.0, lines[1]["count"])
+
+	// levels are shared by every subsystem's logger and can change at any time
+	assert.Equal(t, map[string]string{DefaultSubsystem: "warn", "collector": "debug"}, l.Levels())
+	require.NoError(t, l.SetSubsystemLevel("router", "info"))
+	assert.Error(t, l.SetSubsystemLevel("router", "loud"))
+	l.ClearSubsystemLevel("collector")
+	assert.Equal(t, map[string]string{DefaultSubsystem: "warn", "router": "info"}, router.(LevelController).Levels())
+
+	out.Reset()
+	router.Info().Logf("router info")
+	collector.Info().Logf("collector info")
+	lines = jsonLines(t, out)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "router info", lines[0]["msg"])
+}
+
+func TestJSONLoggerSamplesRepetitiveLogs(t *testing.T) {
+	l, out := newTestJSONLogger(t, &config.MockConfig{
+		GetLoggerLevelVal:      config.WarnLevel,
+		GetJSONLoggerConfigVal: config.JSONLoggerConfig{SamplerThroughput: 1},
+	})
+
+	// a short interval, so that rates are computed within the test
+	sampler := &dynsampler.PerKeyThroughput{ClearFrequencyDuration: time.Second, PerKeyThroughputPerSec: 1}
+	require.NoError(t, sampler.Start())
+	l.shared.sampler = sampler
+
+	for i := 0; i < 10; i++ {
+		l.Error().Logf("failed to send batch %d", i)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	out.Reset()
+	for i := 0; i < 1000; i++ {
+		l.Error().Logf("failed to send batch %d", i)
+	}
+	l.Error().Logf("something else")
+
+	// the log was seen 10 times in the last interval, so about 1 in 10 is kept
+	lines := jsonLines(t, out)
+	assert.Greater(t, len(lines), 20)
+	assert.Less(t, len(lines), 500)
+	for _, line := range lines[:len(lines)-1] {
+		assert.Equal(t, 10.0, line["sample_rate"])
+	}
+	assert.Equal(t, "something else", lines[len(lines)-1]["msg"], "a log that doesn't repeat is kept")
+	assert.NotContains(t, lines[len(lines)-1], "sample_rate")
+}
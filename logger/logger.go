@@ -35,6 +35,8 @@ func GetLoggerImplementation(c config.Config) Logger {
 		logger = &HoneycombLogger{}
 	case "stdout":
 		logger = &StdoutLogger{}
+	case "json":
+		logger = &JSONLogger{}
 	case "none":
 		logger = &NullLogger{}
 	default:
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+// These are the dimensions that a labeled metric can be broken down by. Each
+// one is only used if it's enabled in MetricLabels.Dimensions.
+const (
+	DimensionDataset     = "dataset"
+	DimensionEnvironment = "environment"
+	// DimensionAPIKey values are always hashes of the API key, never the key.
+	DimensionAPIKey = "api_key"
+)
+
+// OtherLabelValue replaces every label value of a series once its metric has
+// reached its cap on series.
+const OtherLabelValue = "_other"
+
+// Labels are the values of the dimensions of one observation of a labeled
+// metric.
+type Labels map[string]string
+
+// LabeledMetrics is implemented by metrics backends that can break a metric
+// down by labels. The labels passed to it have already been limited, so a
+// backend doesn't need to guard against unbounded cardinality.
+type LabeledMetrics interface {
+	// RegisterLabeled declares a metric with the named labels; metricType
+	// should be one of counter, gauge, histogram
+	RegisterLabeled(name string, metricType string, labelNames []string)
+	IncrementLabeled(name string, labels Labels)
+	CountLabeled(name string, n interface{}, labels Labels)
+	GaugeLabeled(name string, val interface{}, labels Labels)
+	HistogramLabeled(name string, obs interface{}, labels Labels)
+}
+
+// RegisterLabeled declares a metric that can be broken down by the named
+// dimensions. If m doesn't support labels, it's registered without them.
+func RegisterLabeled(m Metrics, name string, metricType string, labelNames []string) {
+	if lm, ok := m.(LabeledMetrics); ok {
+		lm.RegisterLabeled(name, metricType, labelNames)
+		return
+	}
+	m.Register(name, metricType)
+}
+
+func IncrementLabeled(m Metrics, name string, labels Labels) {
+	if lm, ok := m.(LabeledMetrics); ok {
+		lm.IncrementLabeled(name, labels)
+		return
+	}
+	m.Increment(name)
+}
+
+func CountLabeled(m Metrics, name string, n interface{}, labels Labels) {
+	if lm, ok := m.(LabeledMetrics); ok {
+		lm.CountLabeled(name, n, labels)
+		return
+	}
+	m.Count(name, n)
+}
+
+func GaugeLabeled(m Metrics, name string, val interface{}, labels Labels) {
+	if lm, ok := m.(LabeledMetrics); ok {
+		lm.GaugeLabeled(name, val, labels)
+		return
+	}
+	m.Gauge(name, val)
+}
+
+func HistogramLabeled(m Metrics, name string, obs interface{}, labels Labels) {
+	if lm, ok := m.(LabeledMetrics); ok {
+		lm.HistogramLabeled(name, obs, labels)
+		return
+	}
+	m.Histogram(name, obs)
+}
+
+// labeledMetric is the state of one labeled metric in a labelLimiter.
+type labeledMetric struct {
+	// names are the labels that are enabled, in the order they were
+	// registered.
+	names     []string
+	maxSeries int
+	// series holds the label values of each series seen so far.
+	series map[string]struct{}
+}
+
+// labelLimiter keeps labeled metrics to the dimensions that are enabled, and
+// caps the number of series of each metric. Once a metric reaches its cap,
+// observations for new series are recorded with every label set to
+// OtherLabelValue, so the totals stay correct.
+type labelLimiter struct {
+	config  config.MetricLabelsConfig
+	lock    sync.Mutex
+	metrics map[string]*labeledMetric
+}
+
+func newLabelLimiter(cfg config.MetricLabelsConfig) *labelLimiter {
+	return &labelLimiter{
+		config:  cfg,
+		metrics: make(map[string]*labeledMetric),
+	}
+}
+
+// register returns the labels of the named metric that are enabled.
+func (l *labelLimiter) register(name string, labelNames []string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if lm, ok := l.metrics[name]; ok {
+		return lm.names
+	}
+	var names []string
+	for _, n := range labelNames {
+		if slices.Contains(l.config.Dimensions, n) {
+			names = append(names, n)
+		}
+	}
+	maxSeries := l.config.MaxSeries
+	if n, ok := l.config.MetricMaxSeries[name]; ok {
+		maxSeries = n
+	}
+	l.metrics[name] = &labeledMetric{
+		names:     names,
+		maxSeries: maxSeries,
+		series:    make(map[string]struct{}),
+	}
+	return names
+}
+
+// limit returns the labels to record an observation of the named metric
+// with, or nil if the metric has no enabled labels.
+func (l *labelLimiter) limit(name string, labels Labels) Labels {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lm, ok := l.metrics[name]
+	if !ok || len(lm.names) == 0 {
+		return nil
+	}
+	values := make([]string, len(lm.names))
+	for i, n := range lm.names {
+		values[i] = labels[n]
+	}
+	key := strings.Join(values, "\x00")
+	if _, seen := lm.series[key]; !seen {
+		if len(lm.series) >= lm.maxSeries {
+			for i := range values {
+				values[i] = OtherLabelValue
+			}
+		} else {
+			lm.series[key] = struct{}{}
+		}
+	}
+	limited := make(Labels, len(lm.names))
+	for i, n := range lm.names {
+		limited[n] = values[i]
+	}
+	return limited
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	l := newLabelLimiter(config.MetricLabelsConfig{
+		Dimensions:      []string{DimensionDataset, DimensionAPIKey},
+		MaxSeries:       2,
+		MetricMaxSeries: map[string]int{"wide": 3},
+	})
+
+	assert.Equal(t, []string{DimensionDataset, DimensionAPIKey},
+		l.register("narrow", []string{DimensionDataset, DimensionEnvironment, DimensionAPIKey}))
+	assert.Empty(t, l.register("unlabeled", []string{DimensionEnvironment}))
+	assert.Nil(t, l.limit("unlabeled", Labels{DimensionEnvironment: "prod"}))
+	assert.Nil(t, l.limit("unregistered", Labels{DimensionDataset: "a"}))
+
+	// disabled dimensions are dropped
+	assert.Equal(t, Labels{DimensionDataset: "a", DimensionAPIKey: "k1"},
+		l.limit("narrow", Labels{DimensionDataset: "a", DimensionEnvironment: "prod", DimensionAPIKey: "k1"}))
+	assert.Equal(t, Labels{DimensionDataset: "b", DimensionAPIKey: ""},
+		l.limit("narrow", Labels{DimensionDataset: "b"}))
+
+	// once the cap is reached, only the series already seen keep their labels
+	other := Labels{DimensionDataset: OtherLabelValue, DimensionAPIKey: OtherLabelValue}
+	assert.Equal(t, other, l.limit("narrow", Labels{DimensionDataset: "c", DimensionAPIKey: "k1"}))
+	assert.Equal(t, Labels{DimensionDataset: "a", DimensionAPIKey: "k1"},
+		l.limit("narrow", Labels{DimensionDataset: "a", DimensionAPIKey: "k1"}))
+
+	// a metric can have its own cap
+	l.register("wide", []string{DimensionDataset})
+	for _, ds := range []string{"a", "b", "c"} {
+		assert.Equal(t, Labels{DimensionDataset: ds}, l.limit("wide", Labels{DimensionDataset: ds}))
+	}
+	assert.Equal(t, Labels{DimensionDataset: OtherLabelValue}, l.limit("wide", Labels{DimensionDataset: "d"}))
+}
+
+func TestLabeledPromMetrics(t *testing.T) {
+	mc := &config.MockConfig{
+		GetMetricLabelsConfigVal: config.MetricLabelsConfig{
+			Dimensions: []string{DimensionDataset},
+			MaxSeries:  2,
+		},
+	}
+	p := &PromMetrics{Logger: &logger.NullLogger{}, Config: mc}
+	require.NoError(t, p.Start())
+	mm := NewMultiMetrics()
+	mm.Config = mc
+	mm.AddChild(p)
+	require.NoError(t, mm.Start())
+	m := NewMetricsPrefixer("labeled")
+	m.Metrics = mm
+
+	RegisterLabeled(m, "events", "counter", []string{DimensionDataset, DimensionAPIKey})
+	for _, ds := range []string{"a", "a", "b", "c", "d"} {
+		IncrementLabeled(m, "events", Labels{DimensionDataset: ds, DimensionAPIKey: "key"})
+	}
+	// a metric with no enabled dimensions is an ordinary one
+	RegisterLabeled(m, "plain", "counter", []string{DimensionAPIKey})
+	IncrementLabeled(m, "plain", Labels{DimensionAPIKey: "key"})
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	series := make(map[string]float64)
+	for _, family := range families {
+		switch family.GetName() {
+		case "labeled_events":
+			for _, metric := range family.GetMetric() {
+				require.Len(t, metric.GetLabel(), 1)
+				series[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+			}
+		case "labeled_plain":
+			assert.Empty(t, family.GetMetric()[0].GetLabel())
+			assert.Equal(t, 1.0, family.GetMetric()[0].GetCounter().GetValue())
+		}
+	}
+	assert.Equal(t, map[string]float64{"a": 2, "b": 1, OtherLabelValue: 2}, series)
+
+	total, ok := p.Get("labeled_events")
+	assert.True(t, ok)
+	assert.Equal(t, 5.0, total)
+}
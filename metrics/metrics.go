@@ -45,6 +45,22 @@ type Metrics interface {
 	Store(name string, val float64)         // for storing a rarely-changing value not sent as a metric
 }
 
+// ExemplarMetrics is implemented by metrics backends that can link a histogram
+// observation to the trace it was made for.
+type ExemplarMetrics interface {
+	HistogramWithExemplar(name string, obs interface{}, traceID string)
+}
+
+// HistogramWithExemplar records obs in the named histogram, with traceID as
+// its exemplar if m supports exemplars.
+func HistogramWithExemplar(m Metrics, name string, obs interface{}, traceID string) {
+	if em, ok := m.(ExemplarMetrics); ok {
+		em.HistogramWithExemplar(name, obs, traceID)
+		return
+	}
+	m.Histogram(name, obs)
+}
+
 func GetMetricsImplementation(c config.Config) *MultiMetrics {
 	return NewMultiMetrics()
 }
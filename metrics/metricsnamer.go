@@ -44,6 +44,30 @@ func (p *MetricsPrefixer) Histogram(name string, obs interface{}) {
 	p.Metrics.Histogram(p.prefix+name, obs)
 }
 
+func (p *MetricsPrefixer) HistogramWithExemplar(name string, obs interface{}, traceID string) {
+	HistogramWithExemplar(p.Metrics, p.prefix+name, obs, traceID)
+}
+
+func (p *MetricsPrefixer) RegisterLabeled(name string, metricType string, labelNames []string) {
+	RegisterLabeled(p.Metrics, p.prefix+name, metricType, labelNames)
+}
+
+func (p *MetricsPrefixer) IncrementLabeled(name string, labels Labels) {
+	IncrementLabeled(p.Metrics, p.prefix+name, labels)
+}
+
+func (p *MetricsPrefixer) CountLabeled(name string, n interface{}, labels Labels) {
+	CountLabeled(p.Metrics, p.prefix+name, n, labels)
+}
+
+func (p *MetricsPrefixer) GaugeLabeled(name string, val interface{}, labels Labels) {
+	GaugeLabeled(p.Metrics, p.prefix+name, val, labels)
+}
+
+func (p *MetricsPrefixer) HistogramLabeled(name string, obs interface{}, labels Labels) {
+	HistogramLabeled(p.Metrics, p.prefix+name, obs, labels)
+}
+
 func (p *MetricsPrefixer) Up(name string) {
 	p.Metrics.Up(p.prefix + name)
 }
@@ -20,6 +20,7 @@ type MultiMetrics struct {
 	OTelMetrics   Metrics       `inject:"otelMetrics"`
 	children      []Metrics
 	values        map[string]float64
+	labels        *labelLimiter
 	lock          sync.RWMutex
 }
 
@@ -27,6 +28,7 @@ func NewMultiMetrics() *MultiMetrics {
 	return &MultiMetrics{
 		children: []Metrics{},
 		values:   make(map[string]float64),
+		labels:   newLabelLimiter(config.MetricLabelsConfig{}),
 	}
 }
 
@@ -47,6 +49,10 @@ func (m *MultiMetrics) Start() error {
 		m.AddChild(m.OTelMetrics)
 	}
 
+	// labels are limited here rather than in each child, so that every
+	// backend sees the same series
+	m.labels = newLabelLimiter(m.Config.GetMetricLabelsConfig())
+
 	return nil
 }
 
@@ -97,6 +103,72 @@ func (m *MultiMetrics) Histogram(name string, obs interface{}) { // for histogra
 	}
 }
 
+func (m *MultiMetrics) HistogramWithExemplar(name string, obs interface{}, traceID string) {
+	for _, ch := range m.children {
+		HistogramWithExemplar(ch, name, obs, traceID)
+	}
+}
+
+// RegisterLabeled declares a metric with the named labels; the labels that
+// aren't enabled in the config are dropped, and a metric with none left is
+// registered without labels.
+func (m *MultiMetrics) RegisterLabeled(name string, metricType string, labelNames []string) {
+	names := m.labels.register(name, labelNames)
+	if len(names) == 0 {
+		m.Register(name, metricType)
+		return
+	}
+	for _, ch := range m.children {
+		RegisterLabeled(ch, name, metricType, names)
+	}
+}
+
+func (m *MultiMetrics) IncrementLabeled(name string, labels Labels) {
+	limited := m.labels.limit(name, labels)
+	if limited == nil {
+		m.Increment(name)
+		return
+	}
+	for _, ch := range m.children {
+		IncrementLabeled(ch, name, limited)
+	}
+}
+
+func (m *MultiMetrics) CountLabeled(name string, n interface{}, labels Labels) {
+	limited := m.labels.limit(name, labels)
+	if limited == nil {
+		m.Count(name, n)
+		return
+	}
+	for _, ch := range m.children {
+		CountLabeled(ch, name, n, limited)
+	}
+}
+
+// GaugeLabeled sets one series of a gauge. Unlike Gauge, the value can't be
+// retrieved with Get, since there's more than one.
+func (m *MultiMetrics) GaugeLabeled(name string, val interface{}, labels Labels) {
+	limited := m.labels.limit(name, labels)
+	if limited == nil {
+		m.Gauge(name, val)
+		return
+	}
+	for _, ch := range m.children {
+		GaugeLabeled(ch, name, val, limited)
+	}
+}
+
+func (m *MultiMetrics) HistogramLabeled(name string, obs interface{}, labels Labels) {
+	limited := m.labels.limit(name, labels)
+	if limited == nil {
+		m.Histogram(name, obs)
+		return
+	}
+	for _, ch := range m.children {
+		HistogramLabeled(ch, name, obs, limited)
+	}
+}
+
 func (m *MultiMetrics) Up(name string) { // for updown
 	for _, ch := range m.children {
 		ch.Up(name)
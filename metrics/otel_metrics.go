@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"context"
+	"fmt"
 	"net/url"
 	"os"
 	"runtime"
@@ -11,6 +12,7 @@ import (
 	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/logger"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/metric"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
@@ -30,12 +32,16 @@ type OTelMetrics struct {
 	Logger  logger.Logger `inject:""`
 	Version string        `inject:"version"`
 
-	meter metric.Meter
+	provider *sdkmetric.MeterProvider
+	meter    metric.Meter
 
 	counters   map[string]metric.Int64Counter
 	gauges     map[string]metric.Float64ObservableGauge
 	histograms map[string]metric.Int64Histogram
 	updowns    map[string]metric.Int64UpDownCounter
+	// gaugeSeries holds the current value of each series of the labeled
+	// gauges, since gauges are observed rather than recorded
+	gaugeSeries map[string]map[attribute.Distinct]gaugeSeries
 
 	// values keeps a map of all the non-histogram metrics and their current value
 	// so that we can retrieve them with Get()
@@ -54,59 +60,15 @@ func (o *OTelMetrics) Start() error {
 	o.gauges = make(map[string]metric.Float64ObservableGauge)
 	o.histograms = make(map[string]metric.Int64Histogram)
 	o.updowns = make(map[string]metric.Int64UpDownCounter)
+	o.gaugeSeries = make(map[string]map[attribute.Distinct]gaugeSeries)
 
 	o.values = make(map[string]float64)
 
 	ctx := context.Background()
 
-	// otel can't handle the default endpoint so we have to parse it
-	host, err := url.Parse(cfg.APIHost)
-	if err != nil {
-		o.Logger.Error().WithString("msg", "failed to parse metrics apihost").WithString("apihost", cfg.APIHost)
-		return err
-	}
-
-	compression := otlpmetrichttp.GzipCompression
-	if cfg.Compression == "none" {
-		compression = otlpmetrichttp.NoCompression
-	}
-
-	options := []otlpmetrichttp.Option{
-		otlpmetrichttp.WithEndpoint(host.Host),
-		otlpmetrichttp.WithCompression(compression),
-		// this is how we tell otel to reset metrics every time they're sent -- for some kinds of metrics.
-		// Updown counters should not be reset, nor should gauges.
-		// Histograms should definitely be reset.
-		// Counters are a bit of a tossup, but we'll reset them because Legacy metrics did.
-		otlpmetrichttp.WithTemporalitySelector(func(ik sdkmetric.InstrumentKind) metricdata.Temporality {
-			switch ik {
-			// These are the ones we care about today. If we add more, we'll need to add them here.
-			case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindHistogram:
-				return metricdata.DeltaTemporality
-			default:
-				return metricdata.CumulativeTemporality
-			}
-		}),
-	}
-	// if we ever need to add user-specified headers, that would go here
-	hdrs := map[string]string{}
-	if cfg.APIKey != "" {
-		hdrs["x-honeycomb-team"] = cfg.APIKey
-	}
-	if cfg.Dataset != "" {
-		hdrs["x-honeycomb-dataset"] = cfg.Dataset
-	}
-	if len(hdrs) > 0 {
-		options = append(options, otlpmetrichttp.WithHeaders(hdrs))
-	}
-
-	if host.Scheme == "http" {
-		options = append(options, otlpmetrichttp.WithInsecure())
-	}
-
-	exporter, err := otlpmetrichttp.New(ctx, options...)
-
+	exporter, err := newOTelExporter(ctx, cfg)
 	if err != nil {
+		o.Logger.Error().WithString("msg", "failed to create metrics exporter").WithString("error", err.Error())
 		return err
 	}
 
@@ -124,13 +86,14 @@ func (o *OTelMetrics) Start() error {
 		resource.WithAttributes(attribute.KeyValue{Key: "service.version", Value: attribute.StringValue(o.Version)}),
 		resource.WithAttributes(attribute.KeyValue{Key: "host.name", Value: attribute.StringValue(hostname)}),
 		resource.WithAttributes(attribute.KeyValue{Key: "hostname", Value: attribute.StringValue(hostname)}),
+		resource.WithAttributes(resourceAttributes(cfg.ResourceAttributes)...),
 	)
 
 	if err != nil {
 		return err
 	}
 
-	provider := sdkmetric.NewMeterProvider(
+	o.provider = sdkmetric.NewMeterProvider(
 		sdkmetric.WithReader(
 			sdkmetric.NewPeriodicReader(exporter,
 				sdkmetric.WithInterval(time.Duration(cfg.ReportingInterval)),
@@ -138,7 +101,7 @@ func (o *OTelMetrics) Start() error {
 		),
 		sdkmetric.WithResource(res),
 	)
-	o.meter = provider.Meter("otelmetrics")
+	o.meter = o.provider.Meter("otelmetrics")
 
 	// These metrics are dynamic fields that should always be collected
 	name := "num_goroutines"
@@ -181,6 +144,103 @@ func (o *OTelMetrics) Start() error {
 	return nil
 }
 
+// Stop sends the metrics recorded since the last export.
+func (o *OTelMetrics) Stop() error {
+	if o.provider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return o.provider.Shutdown(ctx)
+}
+
+// newOTelExporter returns an exporter that sends metrics with the configured
+// protocol to Endpoint, or to APIHost if it isn't set.
+func newOTelExporter(ctx context.Context, cfg config.OTelMetricsConfig) (sdkmetric.Exporter, error) {
+	endpoint := cfg.APIHost
+	if cfg.Endpoint != "" {
+		endpoint = cfg.Endpoint
+	}
+	// otel can't handle a URL as the endpoint so we have to parse it
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics endpoint '%s': %w", endpoint, err)
+	}
+
+	// the Honeycomb headers are only needed if there's a key to send
+	headers := make(map[string]string, len(cfg.Headers)+2)
+	if cfg.APIKey != "" {
+		headers["x-honeycomb-team"] = cfg.APIKey
+		if cfg.Dataset != "" {
+			headers["x-honeycomb-dataset"] = cfg.Dataset
+		}
+	}
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	temporality := temporalitySelector(cfg.Temporality)
+
+	if cfg.Protocol == "grpc" {
+		options := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(u.Host),
+			otlpmetricgrpc.WithTemporalitySelector(temporality),
+			otlpmetricgrpc.WithHeaders(headers),
+		}
+		if cfg.Compression != "none" {
+			options = append(options, otlpmetricgrpc.WithCompressor("gzip"))
+		}
+		if u.Scheme == "http" {
+			options = append(options, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, options...)
+	}
+
+	compression := otlpmetrichttp.GzipCompression
+	if cfg.Compression == "none" {
+		compression = otlpmetrichttp.NoCompression
+	}
+	options := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(u.Host),
+		otlpmetrichttp.WithCompression(compression),
+		otlpmetrichttp.WithTemporalitySelector(temporality),
+		otlpmetrichttp.WithHeaders(headers),
+	}
+	// APIHost is only a host, but a full Endpoint has its own path
+	if cfg.Endpoint != "" && u.Path != "" {
+		options = append(options, otlpmetrichttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlpmetrichttp.WithInsecure())
+	}
+	return otlpmetrichttp.New(ctx, options...)
+}
+
+// temporalitySelector returns the temporality of each kind of instrument.
+// With delta temporality, counters and histograms are reset every time
+// they're sent, as Legacy metrics did; up/down counters and gauges never are.
+func temporalitySelector(temporality string) sdkmetric.TemporalitySelector {
+	if temporality == "cumulative" {
+		return sdkmetric.DefaultTemporalitySelector
+	}
+	return func(ik sdkmetric.InstrumentKind) metricdata.Temporality {
+		switch ik {
+		// These are the ones we care about today. If we add more, we'll need to add them here.
+		case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindHistogram:
+			return metricdata.DeltaTemporality
+		default:
+			return metricdata.CumulativeTemporality
+		}
+	}
+}
+
+func resourceAttributes(attrs map[string]string) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	return kvs
+}
+
 func (o *OTelMetrics) Register(name string, metricType string) {
 	o.lock.Lock()
 	defer o.lock.Unlock()
@@ -228,6 +288,86 @@ func (o *OTelMetrics) Register(name string, metricType string) {
 	}
 }
 
+type gaugeSeries struct {
+	attrs attribute.Set
+	value float64
+}
+
+// RegisterLabeled takes a name, a metric type, and the names of its labels.
+// Only labeled gauges need anything different from Register, since the
+// instruments of the other types take their attributes with each recording.
+func (o *OTelMetrics) RegisterLabeled(name string, metricType string, labelNames []string) {
+	if metricType != "gauge" || len(labelNames) == 0 {
+		o.Register(name, metricType)
+		return
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var f metric.Float64Callback = func(_ context.Context, result metric.Float64Observer) error {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		for _, series := range o.gaugeSeries[name] {
+			result.Observe(series.value, metric.WithAttributeSet(series.attrs))
+		}
+		return nil
+	}
+	g, err := o.meter.Float64ObservableGauge(name,
+		metric.WithFloat64Callback(f),
+	)
+	if err != nil {
+		o.Logger.Error().WithString("msg", "failed to create gauge").WithString("name", name)
+		return
+	}
+	o.gauges[name] = g
+	o.gaugeSeries[name] = make(map[attribute.Distinct]gaugeSeries)
+}
+
+func labelAttributes(labels Labels) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+func (o *OTelMetrics) IncrementLabeled(name string, labels Labels) {
+	o.CountLabeled(name, 1, labels)
+}
+
+func (o *OTelMetrics) CountLabeled(name string, val interface{}, labels Labels) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if ctr, ok := o.counters[name]; ok {
+		f := ConvertNumeric(val)
+		ctr.Add(context.Background(), int64(f), metric.WithAttributeSet(labelAttributes(labels)))
+		o.values[name] += f
+	}
+}
+
+func (o *OTelMetrics) GaugeLabeled(name string, val interface{}, labels Labels) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if series, ok := o.gaugeSeries[name]; ok {
+		attrs := labelAttributes(labels)
+		series[attrs.Equivalent()] = gaugeSeries{attrs: attrs, value: ConvertNumeric(val)}
+	}
+}
+
+func (o *OTelMetrics) HistogramLabeled(name string, val interface{}, labels Labels) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if h, ok := o.histograms[name]; ok {
+		f := ConvertNumeric(val)
+		h.Record(context.Background(), int64(f), metric.WithAttributeSet(labelAttributes(labels)))
+		o.values[name] += f
+	}
+}
+
 func (o *OTelMetrics) Increment(name string) {
 	o.lock.Lock()
 	defer o.lock.Unlock()
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTelMetricsEndpoint(t *testing.T) {
+	type export struct {
+		path    string
+		headers http.Header
+		request *collectormetrics.ExportMetricsServiceRequest
+	}
+	exports := make(chan export, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		request := &collectormetrics.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		exports <- export{path: req.URL.Path, headers: req.Header, request: request}
+	}))
+	defer srv.Close()
+
+	o := &OTelMetrics{
+		Config: &config.MockConfig{GetOTelMetricsConfigVal: config.OTelMetricsConfig{
+			Enabled:            true,
+			Endpoint:           srv.URL + "/collector/v1/metrics",
+			Dataset:            "Refinery Metrics",
+			Compression:        "none",
+			ReportingInterval:  config.Duration(time.Hour),
+			Protocol:           "http/protobuf",
+			Headers:            map[string]string{"Authorization": "Bearer token"},
+			Temporality:        "cumulative",
+			ResourceAttributes: map[string]string{"deployment.environment": "test"},
+		}},
+		Logger:  &logger.NullLogger{},
+		Version: "1.2.3",
+	}
+	require.NoError(t, o.Start())
+	o.Register("spans_received", "counter")
+	o.Increment("spans_received")
+	o.Increment("spans_received")
+	// stopping sends what's been recorded
+	require.NoError(t, o.Stop())
+
+	var got export
+	select {
+	case got = <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics were exported")
+	}
+	assert.Equal(t, "/collector/v1/metrics", got.path)
+	assert.Equal(t, "Bearer token", got.headers.Get("Authorization"))
+	// without an API key, no Honeycomb headers are sent
+	assert.Empty(t, got.headers.Get("x-honeycomb-dataset"))
+
+	require.Len(t, got.request.ResourceMetrics, 1)
+	attrs := make(map[string]string)
+	for _, kv := range got.request.ResourceMetrics[0].Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	assert.Equal(t, "test", attrs["deployment.environment"])
+	assert.Equal(t, "refinery", attrs["service.name"])
+	assert.Equal(t, "1.2.3", attrs["service.version"])
+
+	var found bool
+	for _, sm := range got.request.ResourceMetrics[0].ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "spans_received" {
+				continue
+			}
+			found = true
+			sum := m.GetSum()
+			require.NotNil(t, sum)
+			assert.Equal(t, "AGGREGATION_TEMPORALITY_CUMULATIVE", sum.AggregationTemporality.String())
+			assert.Equal(t, int64(2), sum.DataPoints[0].GetAsInt())
+		}
+	}
+	assert.True(t, found, "spans_received wasn't exported")
+}
@@ -3,6 +3,8 @@ package metrics
 import (
 	"net/http"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,8 +25,22 @@ type PromMetrics struct {
 	// so that we can retrieve them with Get()
 	values map[string]float64
 	lock   sync.RWMutex
+	config config.PrometheusMetricsConfig
 }
 
+const (
+	// nativeHistogramMaxBuckets bounds the memory used by each native
+	// histogram; when it's reached, the buckets are widened.
+	nativeHistogramMaxBuckets = 160
+	// exemplarLabel is the name of the exemplar label holding the trace ID.
+	exemplarLabel = "trace_id"
+)
+
+// defaultBuckets is an attempt at a usable set of buckets for a wide range of
+// metrics: 16 buckets, first upper bound of 1, each following upper bound is 4x
+// the previous.
+var defaultBuckets = prometheus.ExponentialBuckets(1, 4, 16)
+
 func (p *PromMetrics) Start() error {
 	p.Logger.Debug().Logf("Starting PromMetrics")
 	defer func() { p.Logger.Debug().Logf("Finished starting PromMetrics") }()
@@ -35,10 +51,15 @@ func (p *PromMetrics) Start() error {
 
 	p.metrics = make(map[string]interface{})
 	p.values = make(map[string]float64)
+	p.config = pc
 
 	muxxer := mux.NewRouter()
 
-	muxxer.Handle("/metrics", promhttp.Handler())
+	// exemplars are only exposed in the OpenMetrics format
+	handler := promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: pc.Exemplars,
+	})
+	muxxer.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handler))
 	go http.ListenAndServe(pc.ListenAddr, muxxer)
 	return nil
 }
@@ -68,19 +89,70 @@ func (p *PromMetrics) Register(name string, metricType string) {
 			Help: name,
 		})
 	case "histogram":
-		newmet = promauto.NewHistogram(prometheus.HistogramOpts{
+		newmet = promauto.NewHistogram(p.histogramOpts(name))
+	}
+
+	p.metrics[name] = newmet
+	p.values[name] = 0
+}
+
+// RegisterLabeled takes a name, a metric type, and the names of its labels.
+// The type should be one of "counter", "gauge", or "histogram".
+func (p *PromMetrics) RegisterLabeled(name string, metricType string, labelNames []string) {
+	if len(labelNames) == 0 {
+		p.Register(name, metricType)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	newmet, exists := p.metrics[name]
+
+	// don't attempt to add the metric again as this will cause a panic
+	if exists {
+		return
+	}
+
+	switch metricType {
+	case "counter":
+		newmet = promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: name,
 			Help: name,
-			// This is an attempt at a usable set of buckets for a wide range of metrics
-			// 16 buckets, first upper bound of 1, each following upper bound is 4x the previous
-			Buckets: prometheus.ExponentialBuckets(1, 4, 16),
-		})
+		}, labelNames)
+	case "gauge":
+		newmet = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: name,
+		}, labelNames)
+	case "histogram":
+		newmet = promauto.NewHistogramVec(p.histogramOpts(name), labelNames)
 	}
 
 	p.metrics[name] = newmet
 	p.values[name] = 0
 }
 
+// histogramOpts returns the options for the named histogram. The classic
+// buckets are always kept, so that scrapers that don't support native
+// histograms can still read it.
+func (p *PromMetrics) histogramOpts(name string) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{
+		Name:    name,
+		Help:    name,
+		Buckets: p.config.BucketsFor(name),
+	}
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = defaultBuckets
+	}
+	if p.config.NativeHistograms {
+		opts.NativeHistogramBucketFactor = p.config.NativeHistogramBucketFactor
+		opts.NativeHistogramMaxBucketNumber = nativeHistogramMaxBuckets
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
 func (p *PromMetrics) Get(name string) (float64, bool) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -139,6 +211,66 @@ func (p *PromMetrics) Histogram(name string, obs interface{}) {
 		}
 	}
 }
+
+// HistogramWithExemplar records obs in the named histogram, with traceID as
+// its exemplar if exemplars are enabled.
+func (p *PromMetrics) HistogramWithExemplar(name string, obs interface{}, traceID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	histIface, ok := p.metrics[name]
+	if !ok {
+		return
+	}
+	hist, ok := histIface.(prometheus.Histogram)
+	if !ok {
+		return
+	}
+	// the client panics on an exemplar that's too long, so those are dropped
+	eo, ok := hist.(prometheus.ExemplarObserver)
+	if !ok || !p.config.Exemplars || traceID == "" || !utf8.ValidString(traceID) ||
+		utf8.RuneCountInString(exemplarLabel+traceID) > prometheus.ExemplarMaxRunes {
+		hist.Observe(ConvertNumeric(obs))
+		return
+	}
+	eo.ObserveWithExemplar(ConvertNumeric(obs), prometheus.Labels{exemplarLabel: traceID})
+}
+
+// IncrementLabeled and CountLabeled keep the total of every series, so that it
+// can be retrieved with Get.
+func (p *PromMetrics) IncrementLabeled(name string, labels Labels) {
+	p.CountLabeled(name, 1, labels)
+}
+
+func (p *PromMetrics) CountLabeled(name string, n interface{}, labels Labels) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if vec, ok := p.metrics[name].(*prometheus.CounterVec); ok {
+		f := ConvertNumeric(n)
+		vec.With(prometheus.Labels(labels)).Add(f)
+		p.values[name] += f
+	}
+}
+
+func (p *PromMetrics) GaugeLabeled(name string, val interface{}, labels Labels) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if vec, ok := p.metrics[name].(*prometheus.GaugeVec); ok {
+		vec.With(prometheus.Labels(labels)).Set(ConvertNumeric(val))
+	}
+}
+
+func (p *PromMetrics) HistogramLabeled(name string, obs interface{}, labels Labels) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if vec, ok := p.metrics[name].(*prometheus.HistogramVec); ok {
+		vec.With(prometheus.Labels(labels)).Observe(ConvertNumeric(obs))
+	}
+}
+
 func (p *PromMetrics) Up(name string) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
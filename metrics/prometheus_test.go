@@ -2,11 +2,15 @@ package metrics
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/honeycombio/refinery/config"
 	"github.com/honeycombio/refinery/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMultipleRegistrations(t *testing.T) {
@@ -49,3 +53,82 @@ func TestRaciness(t *testing.T) {
 		}(i)
 	}
 }
+
+// gatherHistogram returns the named histogram from the default registry.
+func gatherHistogram(t *testing.T, name string) *dto.Histogram {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetHistogram()
+		}
+	}
+	t.Fatalf("histogram %s not found", name)
+	return nil
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	p := &PromMetrics{
+		Logger: &logger.MockLogger{},
+		Config: &config.MockConfig{
+			GetPrometheusMetricsConfigVal: config.PrometheusMetricsConfig{
+				NativeHistograms:            true,
+				NativeHistogramBucketFactor: 1.1,
+				HistogramBuckets:            []float64{1, 10},
+				MetricBuckets: map[string][]float64{
+					"buckets_custom": {100, 1000, 10000},
+				},
+			},
+		},
+	}
+	require.NoError(t, p.Start())
+
+	p.Register("buckets_default", "histogram")
+	p.Register("buckets_custom", "histogram")
+	p.Histogram("buckets_default", 5)
+	p.Histogram("buckets_custom", 500)
+
+	hist := gatherHistogram(t, "buckets_default")
+	assert.Len(t, hist.GetBucket(), 2)
+	assert.Equal(t, 10.0, hist.GetBucket()[1].GetUpperBound())
+	assert.Equal(t, uint64(1), hist.GetBucket()[1].GetCumulativeCount())
+	// a native histogram has a schema and sparse buckets
+	assert.NotNil(t, hist.Schema)
+	assert.NotEmpty(t, hist.GetPositiveSpan())
+
+	hist = gatherHistogram(t, "buckets_custom")
+	assert.Len(t, hist.GetBucket(), 3)
+	assert.Equal(t, 1000.0, hist.GetBucket()[1].GetUpperBound())
+}
+
+func TestHistogramExemplars(t *testing.T) {
+	mc := &config.MockConfig{
+		GetPrometheusMetricsConfigVal: config.PrometheusMetricsConfig{Exemplars: true},
+	}
+	p := &PromMetrics{
+		Logger: &logger.MockLogger{},
+		Config: mc,
+	}
+	require.NoError(t, p.Start())
+
+	p.Register("exemplar_latency_ms", "histogram")
+	HistogramWithExemplar(p, "exemplar_latency_ms", 3, "4bf92f3577b34da6a3ce929d0e0e4736")
+	// a trace ID too long for an exemplar is observed without one
+	HistogramWithExemplar(p, "exemplar_latency_ms", 3, strings.Repeat("a", 200))
+
+	hist := gatherHistogram(t, "exemplar_latency_ms")
+	assert.Equal(t, uint64(2), hist.GetSampleCount())
+	bucket := hist.GetBucket()[1]
+	require.NotNil(t, bucket.GetExemplar())
+	assert.Equal(t, "trace_id", bucket.GetExemplar().GetLabel()[0].GetName())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", bucket.GetExemplar().GetLabel()[0].GetValue())
+
+	// a prefixer passes exemplars through to the backend
+	prefixer := NewMetricsPrefixer("exemplar")
+	prefixer.Metrics = p
+	p.Register("exemplar_prefixed_ms", "histogram")
+	HistogramWithExemplar(prefixer, "prefixed_ms", 3, "0af7651916cd43dd8448eb211c80319c")
+	exemplar := gatherHistogram(t, "exemplar_prefixed_ms").GetBucket()[1].GetExemplar()
+	require.NotNil(t, exemplar)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", exemplar.GetLabel()[0].GetValue())
+}
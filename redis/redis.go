@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"time"
 
@@ -21,6 +22,14 @@ import (
 // the connection and server.
 const HealthCheckPeriod = time.Minute
 
+// The client pings the server with this period to report its health to the
+// Health system; pings slower than slowPing report it as degraded.
+const (
+	redisHealth         = "redis"
+	redisHealthInterval = 5 * time.Second
+	slowPing            = time.Second
+)
+
 var ErrKeyNotFound = errors.New("key not found")
 
 type Script interface {
@@ -48,6 +57,7 @@ type Conn interface {
 	AcquireLockWithRetries(context.Context, string, time.Duration, int, time.Duration) (bool, func() error)
 	Close() error
 	Del(...string) (int64, error)
+	Unlink(...string) (int64, error)
 	Exists(string) (bool, error)
 	GetInt64(string) (int64, error)
 	GetInt64NoDefault(string) (int64, error)
@@ -77,6 +87,7 @@ type Conn interface {
 	SetHashTTL(string, any, time.Duration) (any, error)
 
 	SAdd(string, ...any) error
+	SMembers(string) ([]string, error)
 
 	RPush(string, any) error
 	RPushTTL(string, string, time.Duration) (bool, error)
@@ -85,6 +96,7 @@ type Conn interface {
 
 	ZAdd(string, []any) error
 	ZRange(string, int, int) ([]string, error)
+	ZRevRangeByScore(string, int64, int) ([]string, error)
 	ZScore(string, string) (int64, error)
 	ZMScore(string, []string) ([]int64, error)
 	ZCard(string) (int64, error)
@@ -93,6 +105,7 @@ type Conn interface {
 	ZRandom(string, int) ([]string, error)
 	ZCount(string, int64, int64) (int64, error)
 	TTL(string) (int64, error)
+	IdleTime(string) (time.Duration, error)
 
 	ReceiveStrings(int) ([]string, error)
 	Do(string, ...any) (any, error)
@@ -122,13 +135,16 @@ func (d *DefaultPubSubConn) Close() error {
 var _ Client = &DefaultClient{}
 
 type DefaultClient struct {
-	pool    *redis.Pool
-	Config  config.RedisConfig `inject:""`
-	Metrics metrics.Metrics    `inject:"genericMetrics"`
-	Health  health.Recorder    `inject:""`
+	pool         *redis.Pool
+	drainTimeout time.Duration
+	Config       config.RedisConfig `inject:""`
+	Metrics      metrics.Metrics    `inject:"genericMetrics"`
+	Health       health.Recorder    `inject:""`
 
 	// An overwritable clockwork.Clock for test injection
 	Clock clockwork.Clock
+
+	done chan struct{}
 }
 
 type DefaultConn struct {
@@ -143,31 +159,27 @@ type DefaultScript struct {
 	script *redis.Script
 }
 
-func buildOptions(c config.RedisConfig) []redis.DialOption {
+func buildOptions(settings config.RedisSettings) []redis.DialOption {
 	options := []redis.DialOption{
 		redis.DialReadTimeout(HealthCheckPeriod + 10*time.Second),
-		redis.DialConnectTimeout(30 * time.Second),
-		redis.DialDatabase(c.GetRedisDatabase()),
+		redis.DialConnectTimeout(settings.Timeouts.Connect),
+		redis.DialDatabase(settings.Database),
 	}
 
-	username := c.GetRedisUsername()
-	if username != "" {
-		options = append(options, redis.DialUsername(username))
+	if settings.Username != "" {
+		options = append(options, redis.DialUsername(settings.Username))
 	}
 
-	password := c.GetRedisPassword()
-	if password != "" {
-		options = append(options, redis.DialPassword(password))
+	if settings.Password != "" {
+		options = append(options, redis.DialPassword(settings.Password))
 	}
 
-	useTLS := c.GetUseTLS()
-	tlsInsecure := c.GetUseTLSInsecure()
-	if useTLS {
+	if settings.TLS.Enabled {
 		tlsConfig := &tls.Config{
 			MinVersion: tls.VersionTLS12,
 		}
 
-		if tlsInsecure {
+		if settings.TLS.Insecure {
 			tlsConfig.InsecureSkipVerify = true
 		}
 
@@ -180,16 +192,16 @@ func buildOptions(c config.RedisConfig) []redis.DialOption {
 }
 
 func (d *DefaultClient) Start() error {
-	redisHost := d.Config.GetRedisHost()
-
-	if redisHost == "" {
-		redisHost = "localhost:6379"
+	settings := d.Config.GetRedisSettings()
+	if err := settings.Validate(); err != nil {
+		return err
 	}
-	options := buildOptions(d.Config)
+
+	options := buildOptions(settings)
 	pool := &redis.Pool{
-		MaxIdle:     d.Config.GetRedisMaxIdle(),
-		MaxActive:   d.Config.GetRedisMaxActive(),
-		IdleTimeout: d.Config.GetPeerTimeout(),
+		MaxIdle:     settings.Pool.MaxIdle,
+		MaxActive:   settings.Pool.MaxActive,
+		IdleTimeout: settings.Timeouts.Idle,
 		Wait:        true,
 		Dial: func() (redis.Conn, error) {
 			// if redis is started at the same time as refinery, connecting to redis can
@@ -205,38 +217,142 @@ func (d *DefaultClient) Start() error {
 				case <-timeout:
 					return nil, err
 				default:
-					if authCode := d.Config.GetRedisAuthCode(); authCode != "" {
-						conn, err = redis.Dial("tcp", redisHost, options...)
+					host := settings.Hosts[0]
+					if settings.UseSentinel() {
+						host, err = sentinelMaster(settings, options)
+						if err != nil {
+							break
+						}
+					}
+					if settings.AuthCode != "" {
+						conn, err = redis.Dial("tcp", host, options...)
 						if err != nil {
 							return nil, err
 						}
-						if _, err := conn.Do("AUTH", authCode); err != nil {
+						if _, err := conn.Do("AUTH", settings.AuthCode); err != nil {
 							conn.Close()
 							return nil, err
 						}
 						return conn, nil
 					} else {
-						conn, err = redis.Dial("tcp", redisHost, options...)
+						conn, err = redis.Dial("tcp", host, options...)
 						if err == nil {
 							return conn, nil
 						}
 					}
-					time.Sleep(time.Second)
 				}
+				time.Sleep(time.Second)
 			}
 		},
 	}
 
 	d.pool = pool
+	d.drainTimeout = settings.Timeouts.Drain
 	d.Metrics.Register("redis_request_latency", "histogram")
+	d.Metrics.Register("redis_drain_duration_ms", "gauge")
+	d.Metrics.Register("redis_drain_force_closed", "gauge")
 
+	if d.Health != nil {
+		d.Metrics.Register("redis_ping_latency_ms", "gauge")
+		d.Metrics.Store("REDIS_PING_LIMIT_MS", float64(slowPing.Milliseconds()))
+		d.done = make(chan struct{})
+		d.Health.Register(redisHealth, 5*redisHealthInterval)
+		go d.reportHealth()
+	}
 	return nil
 }
 
+// reportHealth pings the server until the client stops, reporting the
+// result of each ping to Health.
+func (d *DefaultClient) reportHealth() {
+	ticker := time.NewTicker(redisHealthInterval)
+	defer ticker.Stop()
+	for {
+		status, detail := d.ping()
+		d.Health.Report(redisHealth, status, detail)
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *DefaultClient) ping() (health.Status, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisHealthInterval)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.pool.GetContext(ctx)
+	if err != nil {
+		return health.StatusFailed, err.Error()
+	}
+	defer conn.Close()
+	if _, err := redis.DoContext(conn, ctx, "PING"); err != nil {
+		return health.StatusFailed, err.Error()
+	}
+	elapsed := time.Since(start)
+	d.Metrics.Gauge("redis_ping_latency_ms", elapsed.Milliseconds())
+	if elapsed > slowPing {
+		return health.StatusDegraded, fmt.Sprintf("ping took %s", elapsed)
+	}
+	return health.StatusOK, ""
+}
+
+// sentinelMaster asks each sentinel in turn for the address of the current
+// master, and returns the first answer. Sentinels don't hold data, so they
+// are dialed without selecting a database.
+func sentinelMaster(settings config.RedisSettings, options []redis.DialOption) (string, error) {
+	options = append(options, redis.DialDatabase(0))
+	var err error
+	for _, sentinel := range settings.Hosts {
+		var conn redis.Conn
+		conn, err = redis.Dial("tcp", sentinel, options...)
+		if err != nil {
+			continue
+		}
+		var addr []string
+		addr, err = redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", settings.SentinelMaster))
+		conn.Close()
+		if err == nil && len(addr) != 2 {
+			err = fmt.Errorf("sentinel %s doesn't know master %s", sentinel, settings.SentinelMaster)
+		}
+		if err == nil {
+			return net.JoinHostPort(addr[0], addr[1]), nil
+		}
+	}
+	return "", err
+}
+
+// Stop waits for the connections that are in use to be released, up to the
+// drain timeout, before closing the pool. Connections still in use after that
+// are closed by the pool when they are released.
 func (d *DefaultClient) Stop() error {
+	if d.done != nil {
+		close(d.done)
+		d.Health.Unregister(redisHealth)
+	}
+	start := time.Now()
+	inUse := drainPool(d.pool, d.drainTimeout)
+	d.Metrics.Gauge("redis_drain_duration_ms", time.Since(start).Milliseconds())
+	d.Metrics.Gauge("redis_drain_force_closed", inUse)
 	return d.pool.Close()
 }
 
+// drainPool waits until none of the pool's connections are in use, or the
+// timeout passes, and returns the number still in use.
+func drainPool(pool *redis.Pool, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		stats := pool.Stats()
+		inUse := stats.ActiveCount - stats.IdleCount
+		if inUse <= 0 || !time.Now().Before(deadline) {
+			return inUse
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func (d *DefaultClient) Stats() redis.PoolStats {
 	return d.pool.Stats()
 }
@@ -365,6 +481,13 @@ func (c *DefaultConn) Del(keys ...string) (int64, error) {
 	return redis.Int64(c.conn.Do("DEL", args...))
 }
 
+// Unlink deletes keys like Del, but frees their memory in the background so
+// that deleting large keys doesn't block the server.
+func (c *DefaultConn) Unlink(keys ...string) (int64, error) {
+	args := redis.Args{}.AddFlat(keys)
+	return redis.Int64(c.conn.Do("UNLINK", args...))
+}
+
 func (c *DefaultConn) Exists(key string) (bool, error) {
 	return redis.Bool(c.conn.Do("EXISTS", key))
 }
@@ -666,6 +789,12 @@ func (c *DefaultConn) ZRange(key string, start, stop int) ([]string, error) {
 	return redis.Strings(c.conn.Do("ZRANGE", key, start, stop))
 }
 
+// ZRevRangeByScore returns up to count members of the sorted set at key
+// whose score is at least min, highest score first.
+func (c *DefaultConn) ZRevRangeByScore(key string, min int64, count int) ([]string, error) {
+	return redis.Strings(c.conn.Do("ZREVRANGEBYSCORE", key, "+inf", min, "LIMIT", 0, count))
+}
+
 func (c *DefaultConn) ZScore(key string, member string) (int64, error) {
 	return redis.Int64(c.conn.Do("ZSCORE", key, member))
 }
@@ -701,6 +830,16 @@ func (c *DefaultConn) TTL(key string) (int64, error) {
 	return redis.Int64(c.conn.Do("TTL", key))
 }
 
+// IdleTime returns how long it has been since a key was last read or
+// written. It returns ErrKeyNotFound if the key doesn't exist.
+func (c *DefaultConn) IdleTime(key string) (time.Duration, error) {
+	seconds, err := redis.Int64(c.conn.Do("OBJECT", "IDLETIME", key))
+	if errors.Is(err, redis.ErrNil) {
+		return 0, ErrKeyNotFound
+	}
+	return time.Duration(seconds) * time.Second, err
+}
+
 func (c *DefaultConn) GetAllStringsHash(key string) (map[string]string, error) {
 	return redis.StringMap(c.conn.Do("HGETALL", key))
 }
@@ -998,6 +1137,20 @@ func NewGetHashCommand(key string, field string) command {
 	}
 }
 
+// NewStreamAddCommand appends an entry to a stream, trimming the stream to
+// approximately maxLen entries. A maxLen of 0 means the stream is not trimmed.
+func NewStreamAddCommand(key string, maxLen int, fields map[string]any) command {
+	args := redis.Args{key}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	args = args.Add("*").AddFlat(fields)
+	return command{
+		name: "XADD",
+		args: args,
+	}
+}
+
 func (c *DefaultConn) ZCount(key string, start int64, stop int64) (int64, error) {
 	startArg := strconv.FormatInt(start, 10)
 	stopArg := strconv.FormatInt(stop, 10)
@@ -1054,8 +1207,22 @@ func (c *DefaultConn) SAdd(key string, members ...any) error {
 	return nil
 }
 
+func (c *DefaultConn) SMembers(key string) ([]string, error) {
+	return redis.Strings(c.conn.Do("SMEMBERS", key))
+}
+
 // Args is a helper function to convert a list of arguments to a redis.Args
 // It returns the result the flattened value of args.
 func Args(args ...any) redis.Args {
 	return redis.Args{}.AddFlat(args)
 }
+
+// ScanStructFields sets the fields of the struct val from a map of field
+// names to values, as GetStructHash does from the fields of a hash.
+func ScanStructFields(fields map[string]string, val any) error {
+	values := make([]any, 0, 2*len(fields))
+	for name, value := range fields {
+		values = append(values, []byte(name), []byte(value))
+	}
+	return redis.ScanStruct(values, val)
+}
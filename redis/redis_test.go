@@ -184,6 +184,43 @@ func Test_SetStringsTTL(t *testing.T) {
 	require.EqualValues(t, []string{"fooval", "barval", ""}, vals)
 }
 
+func TestStopDrainsConnections(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	newClient := func(drainTimeout time.Duration) (*redis.DefaultClient, *metrics.MockMetrics) {
+		m := &metrics.MockMetrics{}
+		m.Start()
+		client := &redis.DefaultClient{
+			Config:  &config.MockConfig{GetRedisHostVal: server.Addr(), GetRedisDrainTimeoutVal: drainTimeout},
+			Metrics: m,
+		}
+		require.NoError(t, client.Start())
+		return client, m
+	}
+
+	// a connection released during the drain isn't force-closed
+	client, m := newClient(time.Second)
+	conn := client.Get()
+	_, err = conn.SetString("key", "value")
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	require.NoError(t, client.Stop())
+	assert.Equal(t, 0.0, m.GaugeRecords["redis_drain_force_closed"])
+	assert.GreaterOrEqual(t, m.GaugeRecords["redis_drain_duration_ms"], 20.0)
+
+	// one that's never released is
+	client, m = newClient(20 * time.Millisecond)
+	conn = client.Get()
+	defer conn.Close()
+	require.NoError(t, client.Stop())
+	assert.Equal(t, 1.0, m.GaugeRecords["redis_drain_force_closed"])
+}
+
 func createArbitraryUniqueKey() string {
 	return uuid.Must(uuid.NewV4()).String()
 }
@@ -0,0 +1,398 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+// maxAccountingEntries bounds the number of rows in each accounting table;
+// once it is reached, traffic from new senders is recorded under overflowKey.
+const maxAccountingEntries = 10000
+
+const overflowKey = "_other"
+
+// ingestRoutes are the routes that ingest accounting knows about; each gets
+// its own set of metrics.
+var ingestRoutes = []string{"event", "batch", "otlp-http", "otlp-grpc", "zipkin", "xray", "datadog"}
+
+// ingestRouteContextKey holds the name of the route a request arrived on, so
+// that events can be attributed to it.
+type ingestRouteContextKey struct{}
+
+// requestAccountingKey identifies a row in the request table.
+type requestAccountingKey struct {
+	Route   string `json:"route"`
+	KeyHash string `json:"key_hash"`
+}
+
+type requestAccounting struct {
+	requestAccountingKey
+	Requests int64            `json:"requests"`
+	Bytes    int64            `json:"bytes"`
+	Rejects  map[string]int64 `json:"rejects,omitempty"`
+}
+
+// eventAccountingKey identifies a row in the event table.
+type eventAccountingKey struct {
+	Route   string `json:"route"`
+	Signal  string `json:"signal"`
+	KeyHash string `json:"key_hash"`
+	Dataset string `json:"dataset"`
+}
+
+type eventAccounting struct {
+	eventAccountingKey
+	Events  int64            `json:"events"`
+	Rejects map[string]int64 `json:"rejects,omitempty"`
+}
+
+// ingestAccounting keeps running totals of ingest traffic, so that a surge
+// can be traced back to the API key and dataset responsible for it. Requests
+// and bytes are counted per route and key, since a single request can hold
+// events for many datasets; events are counted per route, signal, key and
+// dataset. API keys are only ever recorded as hashes.
+//
+// Events are recorded for every span, so the tables are built to be updated
+// without a shared lock: rows are found in sync.Maps and their counters are
+// atomic.
+type ingestAccounting struct {
+	requests accountingTable[requestAccountingKey, requestRow]
+	events   accountingTable[eventAccountingKey, eventRow]
+	// keyHashes caches the hash of each API key, since hashing every span
+	// would be expensive
+	keyHashes     sync.Map
+	keyHashesSize atomic.Int64
+}
+
+// accountingTable is a set of rows of counters, bounded to about
+// maxAccountingEntries rows; concurrent inserts can overshoot slightly.
+type accountingTable[K comparable, R any] struct {
+	rows sync.Map
+	size atomic.Int64
+}
+
+// row returns the row for key, creating it if needed. Once the table is full,
+// new keys are replaced with overflow(key).
+func (t *accountingTable[K, R]) row(key K, overflow func(K) K) *R {
+	if row, ok := t.rows.Load(key); ok {
+		return row.(*R)
+	}
+	if t.size.Load() >= maxAccountingEntries {
+		key = overflow(key)
+	}
+	row, loaded := t.rows.LoadOrStore(key, new(R))
+	if !loaded {
+		t.size.Add(1)
+	}
+	return row.(*R)
+}
+
+func (t *accountingTable[K, R]) each(f func(K, *R)) {
+	t.rows.Range(func(key, row any) bool {
+		f(key.(K), row.(*R))
+		return true
+	})
+}
+
+type requestRow struct {
+	requests atomic.Int64
+	bytes    atomic.Int64
+	rejects  rejectCounts
+}
+
+type eventRow struct {
+	events  atomic.Int64
+	rejects rejectCounts
+}
+
+// rejectCounts counts rejections by reason. Rejections are rare compared to
+// accepted traffic, so a lock per row is fine.
+type rejectCounts struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func (c *rejectCounts) add(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[reason]++
+}
+
+func (c *rejectCounts) copy() map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		return nil
+	}
+	counts := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+// hashKey returns the hash of an API key.
+func (a *ingestAccounting) hashKey(apiKey string, salt string) string {
+	if hash, ok := a.keyHashes.Load(apiKey); ok {
+		return hash.(string)
+	}
+	hash := apikeys.HMACRedactor{Salt: []byte(salt)}.Redact(apiKey)
+	if a.keyHashesSize.Load() < maxAccountingEntries {
+		if _, loaded := a.keyHashes.LoadOrStore(apiKey, hash); !loaded {
+			a.keyHashesSize.Add(1)
+		}
+	}
+	return hash
+}
+
+func (a *ingestAccounting) recordRequest(route string, apiKey string, salt string, bytes int64, rejectReason string) {
+	key := requestAccountingKey{Route: route, KeyHash: a.hashKey(apiKey, salt)}
+	row := a.requests.row(key, func(key requestAccountingKey) requestAccountingKey {
+		key.KeyHash = overflowKey
+		return key
+	})
+	row.requests.Add(1)
+	row.bytes.Add(bytes)
+	if rejectReason != "" {
+		row.rejects.add(rejectReason)
+	}
+}
+
+// recordEvent counts an event, and returns the hash of its API key.
+func (a *ingestAccounting) recordEvent(route string, signal string, apiKey string, salt string, dataset string, rejectReason string) string {
+	keyHash := a.hashKey(apiKey, salt)
+	key := eventAccountingKey{Route: route, Signal: signal, KeyHash: keyHash, Dataset: dataset}
+	row := a.events.row(key, func(key eventAccountingKey) eventAccountingKey {
+		key.KeyHash = overflowKey
+		key.Dataset = overflowKey
+		return key
+	})
+	if rejectReason != "" {
+		row.rejects.add(rejectReason)
+		return keyHash
+	}
+	row.events.Add(1)
+	return keyHash
+}
+
+// snapshot returns copies of the largest top rows of each table, busiest
+// first; top <= 0 returns everything. Rows are read one at a time, so the
+// snapshot isn't a single instant across rows.
+func (a *ingestAccounting) snapshot(top int) ([]requestAccounting, []eventAccounting) {
+	requests := make([]requestAccounting, 0, a.requests.size.Load())
+	a.requests.each(func(key requestAccountingKey, row *requestRow) {
+		requests = append(requests, requestAccounting{
+			requestAccountingKey: key,
+			Requests:             row.requests.Load(),
+			Bytes:                row.bytes.Load(),
+			Rejects:              row.rejects.copy(),
+		})
+	})
+	events := make([]eventAccounting, 0, a.events.size.Load())
+	a.events.each(func(key eventAccountingKey, row *eventRow) {
+		events = append(events, eventAccounting{
+			eventAccountingKey: key,
+			Events:             row.events.Load(),
+			Rejects:            row.rejects.copy(),
+		})
+	})
+
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].Bytes != requests[j].Bytes {
+			return requests[i].Bytes > requests[j].Bytes
+		}
+		if requests[i].Requests != requests[j].Requests {
+			return requests[i].Requests > requests[j].Requests
+		}
+		return requests[i].Route+requests[i].KeyHash < requests[j].Route+requests[j].KeyHash
+	})
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Events != events[j].Events {
+			return events[i].Events > events[j].Events
+		}
+		a, b := events[i].eventAccountingKey, events[j].eventAccountingKey
+		return a.Route+a.Signal+a.KeyHash+a.Dataset < b.Route+b.Signal+b.KeyHash+b.Dataset
+	})
+	if top > 0 && len(requests) > top {
+		requests = requests[:top]
+	}
+	if top > 0 && len(events) > top {
+		events = events[:top]
+	}
+	return requests, events
+}
+
+// ingestMetricName returns the name of a per-route ingest metric.
+func ingestMetricName(route string, parts ...string) string {
+	return "ingest_" + strings.ReplaceAll(route, "-", "_") + "_" + strings.Join(parts, "_")
+}
+
+func (r *Router) registerIngestMetrics() {
+	for _, route := range ingestRoutes {
+		r.Metrics.Register(ingestMetricName(route, "requests"), "counter")
+		r.Metrics.Register(ingestMetricName(route, "bytes"), "counter")
+		r.Metrics.Register(ingestMetricName(route, "rejected_requests"), "counter")
+		for _, signal := range []string{"trace", "event"} {
+			r.Metrics.Register(ingestMetricName(route, signal, "accepted"), "counter")
+			r.Metrics.Register(ingestMetricName(route, signal, "rejected"), "counter")
+		}
+	}
+	// these break ingest down by sender, for the dimensions that are enabled
+	senderLabels := []string{metrics.DimensionDataset, metrics.DimensionEnvironment, metrics.DimensionAPIKey}
+	metrics.RegisterLabeled(r.Metrics, "ingest_events_accepted", "counter", senderLabels)
+	metrics.RegisterLabeled(r.Metrics, "ingest_events_rejected", "counter", senderLabels)
+}
+
+// ingestRouteName maps the name of a mux route to the name used for
+// accounting.
+func ingestRouteName(name string) string {
+	if name == "otlp" {
+		return "otlp-http"
+	}
+	return name
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// accountIngest is middleware that records each ingest request, the bytes of
+// its body as sent (that is, before decompression), and whether it was
+// rejected. It must come before any middleware that can reject the request.
+// Events from the request are attributed to the route through the context.
+func (r *Router) accountIngest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(req); current != nil {
+			route = ingestRouteName(current.GetName())
+		}
+		body := &countingReader{ReadCloser: req.Body}
+		req.Body = body
+		ctx, span := r.startIngestSpan(req.Context(), route)
+		defer span.End()
+		req = req.WithContext(context.WithValue(ctx, ingestRouteContextKey{}, route))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+		r.Profiler.ObserveLatency(time.Since(start))
+		otelutil.AddSpanFields(span, map[string]interface{}{
+			"status": rec.status,
+			"bytes":  body.n,
+		})
+
+		// the API key is read afterward, since middleware may have filled it in
+		apiKey := req.Header.Get(types.APIKeyHeader)
+		if apiKey == "" {
+			apiKey = req.Header.Get(types.APIKeyHeaderShort)
+		}
+		var rejectReason string
+		if rec.status >= 400 {
+			rejectReason = strconv.Itoa(rec.status)
+		}
+		r.recordIngestRequest(route, apiKey, body.n, rejectReason)
+	})
+}
+
+func (r *Router) recordIngestRequest(route string, apiKey string, bytes int64, rejectReason string) {
+	r.Metrics.Increment(ingestMetricName(route, "requests"))
+	r.Metrics.Count(ingestMetricName(route, "bytes"), bytes)
+	if rejectReason != "" {
+		r.Metrics.Increment(ingestMetricName(route, "rejected_requests"))
+	}
+	r.ingestAccounting.recordRequest(route, apiKey, r.Config.GetAccessKeyConfig().KeyRedactionSalt, bytes, rejectReason)
+}
+
+// recordIngestEvent records an event that processEvent accepted or rejected.
+func (r *Router) recordIngestEvent(ev *types.Event, isSpan bool, err error) {
+	route := "unknown"
+	if ev.Context != nil {
+		if name, ok := ev.Context.Value(ingestRouteContextKey{}).(string); ok {
+			route = name
+		}
+	}
+	signal := "event"
+	if isSpan {
+		signal = "trace"
+	}
+
+	var rejectReason string
+	switch {
+	case err == nil:
+		r.Metrics.Increment(ingestMetricName(route, signal, "accepted"))
+	case errors.Is(err, collect.ErrWouldBlock):
+		rejectReason = "queue_full"
+	default:
+		rejectReason = "error"
+	}
+	if rejectReason != "" {
+		r.Metrics.Increment(ingestMetricName(route, signal, "rejected"))
+	}
+	keyHash := r.ingestAccounting.recordEvent(route, signal, ev.APIKey, r.Config.GetAccessKeyConfig().KeyRedactionSalt, ev.Dataset, rejectReason)
+
+	labels := metrics.Labels{
+		metrics.DimensionDataset:     ev.Dataset,
+		metrics.DimensionEnvironment: ev.Environment,
+		metrics.DimensionAPIKey:      keyHash,
+	}
+	if rejectReason != "" {
+		metrics.IncrementLabeled(r.Metrics, "ingest_events_rejected", labels)
+	} else {
+		metrics.IncrementLabeled(r.Metrics, "ingest_events_accepted", labels)
+	}
+}
+
+// ingestAccountingReport handles GET /admin/ingest/accounting. It takes an
+// optional top query parameter to limit the number of rows returned.
+func (r *Router) ingestAccountingReport(w http.ResponseWriter, req *http.Request) {
+	top, err := topParam(req)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, err)
+		return
+	}
+	requests, events := r.ingestAccounting.snapshot(top)
+	r.marshalToFormat(w, map[string]interface{}{
+		"requests": requests,
+		"events":   events,
+	}, "json")
+}
+
+// topParam returns the value of the optional top query parameter, which
+// limits the number of rows in a report; 0 means no limit.
+func topParam(req *http.Request) (int, error) {
+	param := req.URL.Query().Get("top")
+	if param == "" {
+		return 0, nil
+	}
+	top, err := strconv.Atoi(param)
+	if err != nil || top < 0 {
+		return 0, errors.New("invalid top parameter '" + param + "'")
+	}
+	return top, nil
+}
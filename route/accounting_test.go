@@ -0,0 +1,146 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestAccounting(t *testing.T) {
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	mockTransmission := &transmit.MockTransmission{}
+	mockTransmission.Start()
+	decoders, err := makeDecoders(1)
+	require.NoError(t, err)
+	router := &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:  []string{"trace.trace_id"},
+			ParentIdFieldNames: []string{"trace.parent_id"},
+			AccessKeys:         config.AccessKeyConfig{KeyRedactionSalt: "salt"},
+		},
+		Logger:               &logger.NullLogger{},
+		Metrics:              mockMetrics,
+		Collector:            &busyCollector{refusals: 1},
+		UpstreamTransmission: mockTransmission,
+		iopLogger:            iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		zstdDecoders:         decoders,
+		environmentCache:     newEnvironmentCache(time.Second, nil),
+	}
+	router.registerIngestMetrics()
+
+	m := mux.NewRouter()
+	batchMuxxer := m.PathPrefix("/1/").Subrouter()
+	batchMuxxer.Use(router.accountIngest)
+	batchMuxxer.HandleFunc("/batch/{datasetName}", router.batch).Name("batch")
+
+	body := `[{"data":{"trace.trace_id":"1"}},{"data":{"trace.trace_id":"2"}},{"data":{"foo":"bar"}}]`
+	req := httptest.NewRequest("POST", "/1/batch/checkout", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(types.APIKeyHeader, legacyAPIKey)
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["ingest_batch_requests"])
+	assert.Equal(t, len(body), mockMetrics.CounterIncrements["ingest_batch_bytes"])
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["ingest_batch_trace_accepted"])
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["ingest_batch_trace_rejected"])
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["ingest_batch_event_accepted"])
+
+	requests, events := router.ingestAccounting.snapshot(0)
+	require.Len(t, requests, 1)
+	assert.Equal(t, "batch", requests[0].Route)
+	assert.True(t, strings.HasPrefix(requests[0].KeyHash, "hmac:"))
+	assert.NotContains(t, requests[0].KeyHash, legacyAPIKey)
+	assert.Equal(t, int64(len(body)), requests[0].Bytes)
+
+	// rows with the same count are ordered by key, so "event" sorts first
+	require.Len(t, events, 2)
+	assert.Equal(t, eventAccountingKey{Route: "batch", Signal: "event", KeyHash: requests[0].KeyHash, Dataset: "checkout"}, events[0].eventAccountingKey)
+	assert.Equal(t, eventAccountingKey{Route: "batch", Signal: "trace", KeyHash: requests[0].KeyHash, Dataset: "checkout"}, events[1].eventAccountingKey)
+	assert.Equal(t, int64(1), events[1].Events)
+	assert.Equal(t, map[string]int64{"queue_full": 1}, events[1].Rejects)
+
+	// requests rejected by later middleware are counted as rejects
+	rejecting := router.accountIngest(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		router.handlerReturnWithError(w, ErrAuthNeeded, errors.New("no api key"))
+	}))
+	rr = httptest.NewRecorder()
+	rejecting.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/checkout", strings.NewReader(body)))
+	requests, _ = router.ingestAccounting.snapshot(0)
+	require.Len(t, requests, 2)
+	assert.Equal(t, map[string]int64{"400": 1}, requests[1].Rejects)
+}
+
+func TestIngestAccountingOverflow(t *testing.T) {
+	a := &ingestAccounting{}
+	for i := 0; i < maxAccountingEntries+10; i++ {
+		a.recordEvent("otlp-http", "trace", "key", "", strings.Repeat("x", i%50)+string(rune('a'+i%26))+time.Duration(i).String(), "")
+	}
+	_, events := a.snapshot(0)
+	assert.Len(t, events, maxAccountingEntries+1)
+
+	_, events = a.snapshot(5)
+	require.Len(t, events, 5)
+	assert.Equal(t, overflowKey, events[0].Dataset)
+	assert.Equal(t, int64(10), events[0].Events)
+}
+
+func TestIngestAccountingConcurrent(t *testing.T) {
+	a := &ingestAccounting{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				a.recordEvent("otlp-grpc", "trace", "key", "", "dataset", "")
+			}
+			a.recordEvent("otlp-grpc", "trace", "key", "", "dataset", "queue_full")
+		}()
+	}
+	wg.Wait()
+
+	_, events := a.snapshot(0)
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(8000), events[0].Events)
+	assert.Equal(t, map[string]int64{"queue_full": 8}, events[0].Rejects)
+}
+
+func TestIngestAccountingReport(t *testing.T) {
+	router := newAdminTestRouter(time.Minute)
+	router.ingestAccounting.recordRequest("zipkin", "key1", "", 100, "")
+	router.ingestAccounting.recordRequest("zipkin", "key2", "", 500, "")
+
+	rr := httptest.NewRecorder()
+	router.ingestAccountingReport(rr, httptest.NewRequest("GET", "/admin/ingest/accounting?top=1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var report struct {
+		Requests []requestAccounting `json:"requests"`
+		Events   []eventAccounting   `json:"events"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Len(t, report.Requests, 1)
+	assert.Equal(t, int64(500), report.Requests[0].Bytes)
+	assert.Equal(t, "zipkin", report.Requests[0].Route)
+
+	rr = httptest.NewRecorder()
+	router.ingestAccountingReport(rr, httptest.NewRequest("GET", "/admin/ingest/accounting?top=many", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,385 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/featureflags"
+	"github.com/honeycombio/refinery/logger"
+)
+
+// ingestPause records whether ingestion has been paused through the admin API.
+// A pause always has an expiration; when it passes, ingestion resumes on its
+// own so that a forgotten pause can't drop traffic forever.
+type ingestPause struct {
+	paused atomic.Bool
+
+	mut         sync.Mutex
+	pausedAt    time.Time
+	pausedUntil time.Time
+	timer       *time.Timer
+}
+
+// pause stops ingestion until d has elapsed or resume is called. The onResume
+// function is called if the pause expires on its own.
+func (p *ingestPause) pause(d time.Duration, onResume func()) time.Time {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	now := time.Now()
+	if !p.paused.Load() {
+		p.pausedAt = now
+	}
+	p.pausedUntil = now.Add(d)
+	p.paused.Store(true)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		p.mut.Lock()
+		// a newer pause or an explicit resume has replaced this timer
+		if p.timer != timer {
+			p.mut.Unlock()
+			return
+		}
+		p.clear()
+		p.mut.Unlock()
+		onResume()
+	})
+	p.timer = timer
+	return p.pausedUntil
+}
+
+// resume restarts ingestion; it returns false if ingestion wasn't paused.
+func (p *ingestPause) resume() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if !p.paused.Load() {
+		return false
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.clear()
+	return true
+}
+
+// clear resets the pause state; only call with the lock held.
+func (p *ingestPause) clear() {
+	p.paused.Store(false)
+	p.timer = nil
+	p.pausedAt = time.Time{}
+	p.pausedUntil = time.Time{}
+}
+
+func (p *ingestPause) isPaused() bool {
+	return p.paused.Load()
+}
+
+func (p *ingestPause) status() map[string]interface{} {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if !p.paused.Load() {
+		return map[string]interface{}{"source": "refinery", "paused": false}
+	}
+	return map[string]interface{}{
+		"source":       "refinery",
+		"paused":       true,
+		"paused_at":    p.pausedAt.UTC().Format(time.RFC3339),
+		"paused_until": p.pausedUntil.UTC().Format(time.RFC3339),
+		"remaining":    time.Until(p.pausedUntil).Round(time.Second).String(),
+	}
+}
+
+// pauseIngest handles POST /admin/ingest/pause. It takes an optional duration
+// query parameter, which is capped at the configured MaxIngestPause.
+func (r *Router) pauseIngest(w http.ResponseWriter, req *http.Request) {
+	maxPause := r.Config.GetMaxIngestPause()
+	if maxPause <= 0 {
+		maxPause = defaultMaxIngestPause
+	}
+
+	d := maxPause
+	if durParam := req.URL.Query().Get("duration"); durParam != "" {
+		var err error
+		d, err = time.ParseDuration(durParam)
+		if err != nil || d <= 0 {
+			r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("invalid pause duration '%s'", durParam))
+			return
+		}
+		if d > maxPause {
+			d = maxPause
+		}
+	}
+
+	until := r.ingestPause.pause(d, func() {
+		r.Metrics.Gauge("ingest_paused", 0)
+		r.Logger.Info().Logf("ingestion pause expired; ingestion resumed")
+	})
+	r.Metrics.Gauge("ingest_paused", 1)
+	r.Logger.Info().WithField("paused_until", until.UTC().Format(time.RFC3339)).Logf("ingestion paused by admin request")
+	r.marshalToFormat(w, r.ingestPause.status(), "json")
+}
+
+// resumeIngest handles POST /admin/ingest/resume.
+func (r *Router) resumeIngest(w http.ResponseWriter, req *http.Request) {
+	if r.ingestPause.resume() {
+		r.Metrics.Gauge("ingest_paused", 0)
+		r.Logger.Info().Logf("ingestion resumed by admin request")
+	}
+	r.marshalToFormat(w, r.ingestPause.status(), "json")
+}
+
+// ingestStatus handles GET /admin/ingest/status.
+func (r *Router) ingestStatus(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.ingestPause.status(), "json")
+}
+
+// lateSpanReport handles GET /admin/late-spans. It takes an optional top
+// query parameter to limit the number of rows returned.
+func (r *Router) lateSpanReport(w http.ResponseWriter, req *http.Request) {
+	top, err := topParam(req)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, err)
+		return
+	}
+	r.marshalToFormat(w, r.Collector.LateSpanReports(top), "json")
+}
+
+// evictionReport handles GET /admin/evictions. It returns the most recent
+// evictions from the trace cache, newest first, and takes an optional top
+// query parameter to limit how many are returned.
+func (r *Router) evictionReport(w http.ResponseWriter, req *http.Request) {
+	top, err := topParam(req)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, err)
+		return
+	}
+	r.marshalToFormat(w, r.Collector.Evictions(top), "json")
+}
+
+// reloadConfig handles POST /admin/config/reload. The new configuration is
+// only applied if it's valid; if it isn't, the response lists every
+// validation failure with a 422 status, and the current configuration stays
+// in place.
+func (r *Router) reloadConfig(w http.ResponseWriter, req *http.Request) {
+	result := r.Config.Reload("admin request from " + req.RemoteAddr)
+	r.Logger.Info().WithFields(map[string]interface{}{
+		"applied":    result.Applied,
+		"changed":    result.Changed,
+		"generation": result.Generation,
+	}).Logf("configuration reload requested by admin request")
+
+	if !result.Applied {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	r.marshalToFormat(w, result, "json")
+}
+
+// getConfigHistory handles GET /admin/config/history, which lists the most
+// recent versions of the configuration, newest first, with what changed in
+// each and what caused it to be loaded.
+func (r *Router) getConfigHistory(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.Config.GetConfigHistory(), "json")
+}
+
+// validateConfigRequest is the body of a request to
+// /admin/config/validate. A document that's left out is the one this node is
+// using, so that a candidate rules file can be checked on its own.
+type validateConfigRequest struct {
+	Config       string        `json:"config"`
+	ConfigFormat config.Format `json:"config_format"`
+	Rules        string        `json:"rules"`
+	RulesFormat  config.Format `json:"rules_format"`
+}
+
+// validateConfig handles POST /admin/config/validate. It validates a
+// candidate config and rules without applying them, and responds with the
+// effective config if they're valid, or every failure with a 422 status.
+func (r *Router) validateConfig(w http.ResponseWriter, req *http.Request) {
+	var body validateConfigRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		r.handlerReturnWithError(w, ErrJSONFailed, err)
+		return
+	}
+	if body.Config == "" && body.Rules == "" {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("a config or rules document is required"))
+		return
+	}
+
+	docs := config.PublishedConfig{
+		Config:       []byte(body.Config),
+		ConfigFormat: defaultFormat(body.ConfigFormat),
+		Rules:        []byte(body.Rules),
+		RulesFormat:  defaultFormat(body.RulesFormat),
+	}
+	if body.Config == "" || body.Rules == "" {
+		var configLocation, rulesLocation string
+		for _, md := range r.Config.GetConfigMetadata() {
+			switch md.Type {
+			case "config":
+				configLocation = md.ID
+			case "rules":
+				rulesLocation = md.ID
+			}
+		}
+		current, err := config.LoadDocuments(configLocation, rulesLocation)
+		if err != nil {
+			r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("unable to read the current configuration: %w", err))
+			return
+		}
+		if body.Config == "" {
+			docs.Config, docs.ConfigFormat = current.Config, current.ConfigFormat
+		}
+		if body.Rules == "" {
+			docs.Rules, docs.RulesFormat = current.Rules, current.RulesFormat
+		}
+	}
+
+	report := config.ValidateDocuments(docs)
+	if !report.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	r.marshalToFormat(w, report, "json")
+}
+
+// defaultFormat returns the format of a document posted to the admin API;
+// YAML if none is given.
+func defaultFormat(format config.Format) config.Format {
+	if format == "" {
+		return config.FormatYAML
+	}
+	return format
+}
+
+// getConfigSchema handles GET /admin/config/schema/{kind}, which returns the
+// JSON schema for config or rules files.
+func (r *Router) getConfigSchema(w http.ResponseWriter, req *http.Request) {
+	var schema map[string]any
+	var err error
+	switch kind := mux.Vars(req)["kind"]; kind {
+	case "config":
+		schema, err = config.ConfigSchema()
+	case "rules":
+		schema, err = config.RulesSchema()
+	default:
+		r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("unknown schema '%s'; must be config or rules", kind))
+		return
+	}
+	if err != nil {
+		r.handlerReturnWithError(w, ErrJSONBuildFailed, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema)
+}
+
+// listFeatureFlags handles GET /admin/flags.
+func (r *Router) listFeatureFlags(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.FeatureFlags.List(), "json")
+}
+
+// overrideFeatureFlag handles PUT /admin/flags/{name}?enabled=true|false,
+// which overrides the flag on every node in the cluster.
+func (r *Router) overrideFeatureFlag(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	param := req.URL.Query().Get("enabled")
+	enabled, err := strconv.ParseBool(param)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("invalid value '%s' for enabled; must be true or false", param))
+		return
+	}
+	if err := r.FeatureFlags.Override(name, enabled); err != nil {
+		r.flagError(w, err)
+		return
+	}
+	r.marshalToFormat(w, r.FeatureFlags.List(), "json")
+}
+
+// clearFeatureFlag handles DELETE /admin/flags/{name}, which clears the
+// flag's override on every node in the cluster.
+func (r *Router) clearFeatureFlag(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if err := r.FeatureFlags.Clear(name); err != nil {
+		r.flagError(w, err)
+		return
+	}
+	r.marshalToFormat(w, r.FeatureFlags.List(), "json")
+}
+
+func (r *Router) flagError(w http.ResponseWriter, err error) {
+	if errors.Is(err, featureflags.ErrInvalidName) {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, err)
+		return
+	}
+	r.handlerReturnWithError(w, ErrFlagPublish, err)
+}
+
+// logLevels returns the router's logger if its levels can be changed, or
+// writes an error and returns nil.
+func (r *Router) logLevels(w http.ResponseWriter) logger.LevelController {
+	lc, ok := r.Logger.(logger.LevelController)
+	if !ok {
+		r.handlerReturnWithError(w, ErrNoLogLevels, errors.New("set Logger.Type to json to use log levels per subsystem"))
+		return nil
+	}
+	return lc
+}
+
+// getLogLevels handles GET /admin/log_levels.
+func (r *Router) getLogLevels(w http.ResponseWriter, req *http.Request) {
+	if lc := r.logLevels(w); lc != nil {
+		r.marshalToFormat(w, lc.Levels(), "json")
+	}
+}
+
+// setLogLevel handles PUT /admin/log_levels/{subsystem}?level=debug. The
+// level only changes on this node, and lasts until it restarts.
+func (r *Router) setLogLevel(w http.ResponseWriter, req *http.Request) {
+	lc := r.logLevels(w)
+	if lc == nil {
+		return
+	}
+	subsystem := mux.Vars(req)["subsystem"]
+	if err := lc.SetSubsystemLevel(subsystem, req.URL.Query().Get("level")); err != nil {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, err)
+		return
+	}
+	r.Logger.Info().WithString("subsystem", subsystem).WithString("level", req.URL.Query().Get("level")).Logf("log level changed through the admin API")
+	r.marshalToFormat(w, lc.Levels(), "json")
+}
+
+// clearLogLevel handles DELETE /admin/log_levels/{subsystem}, which returns
+// the subsystem to the default level on this node.
+func (r *Router) clearLogLevel(w http.ResponseWriter, req *http.Request) {
+	lc := r.logLevels(w)
+	if lc == nil {
+		return
+	}
+	subsystem := mux.Vars(req)["subsystem"]
+	if subsystem == logger.DefaultSubsystem {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, errors.New("the default level can't be cleared"))
+		return
+	}
+	lc.ClearSubsystemLevel(subsystem)
+	r.marshalToFormat(w, lc.Levels(), "json")
+}
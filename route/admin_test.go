@@ -0,0 +1,358 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/featureflags"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newAdminTestRouter(maxPause time.Duration) *Router {
+	return &Router{
+		Config:  &config.MockConfig{MaxIngestPause: maxPause},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+}
+
+func TestIngestPauseAndResume(t *testing.T) {
+	router := newAdminTestRouter(time.Minute)
+	handler := router.ingestLimiter(&dummyHandler{})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.pauseIngest(rr, httptest.NewRequest("POST", "/admin/ingest/pause?duration=1h", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	status := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, true, status["paused"])
+	// the requested duration is capped at MaxIngestPause
+	assert.Equal(t, "1m0s", status["remaining"])
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), "ingestion is paused")
+
+	rr = httptest.NewRecorder()
+	router.resumeIngest(rr, httptest.NewRequest("POST", "/admin/ingest/resume", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"paused":false`)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestIngestPauseExpires(t *testing.T) {
+	router := newAdminTestRouter(time.Minute)
+
+	rr := httptest.NewRecorder()
+	router.pauseIngest(rr, httptest.NewRequest("POST", "/admin/ingest/pause?duration=10ms", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, router.ingestPause.isPaused())
+
+	assert.Eventually(t, func() bool {
+		return !router.ingestPause.isPaused()
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestIngestPauseInvalidDuration(t *testing.T) {
+	router := newAdminTestRouter(time.Minute)
+
+	for _, dur := range []string{"bogus", "-5s", "0s"} {
+		rr := httptest.NewRecorder()
+		router.pauseIngest(rr, httptest.NewRequest("POST", "/admin/ingest/pause?duration="+dur, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, dur)
+		assert.False(t, router.ingestPause.isPaused(), dur)
+	}
+}
+
+func TestIngestConcurrencyLimit(t *testing.T) {
+	router := newAdminTestRouter(time.Minute)
+	router.inflight = make(chan struct{}, 1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})
+	handler := router.ingestLimiter(blocking)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	close(release)
+	<-done
+	assert.Len(t, router.inflight, 0)
+}
+
+// saturatedCollector reports fixed queue and memory saturation.
+type saturatedCollector struct {
+	collect.MockCollector
+	queue, memory float64
+}
+
+func (s *saturatedCollector) Saturation() (float64, float64) { return s.queue, s.memory }
+
+func TestAdmissionControl(t *testing.T) {
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	collector := &saturatedCollector{queue: 0.5, memory: 0.5}
+	router := newAdminTestRouter(time.Minute)
+	router.Metrics = mockMetrics
+	router.Collector = collector
+	router.Config = &config.MockConfig{
+		AdmissionQueueThreshold:  90,
+		AdmissionMemoryThreshold: 80,
+		AdmissionRetryAfter:      1500 * time.Millisecond,
+	}
+	handler := router.ingestLimiter(&dummyHandler{})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	collector.queue = 0.95
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["incoming_router_rejected_queue_full"])
+
+	collector.queue = 0
+	collector.memory = 0.85
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/traces", nil)
+	req.Header.Set("Content-Type", "application/protobuf")
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, 1, mockMetrics.CounterIncrements["incoming_router_rejected_memory_full"])
+
+	md := metadata.New(map[string]string{"x-honeycomb-team": legacyAPIKey, "x-honeycomb-dataset": "ds"})
+	_, err := NewTraceServer(router).Export(metadata.NewIncomingContext(context.Background(), md), &collectortrace.ExportTraceServiceRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// with no thresholds, saturation is ignored
+	router.Config = &config.MockConfig{}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfg := &config.MockConfig{Generation: 1}
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	var reloaded bool
+	cfg.RegisterReloadCallback(func() { reloaded = true })
+
+	cfg.ReloadVal = config.ReloadResult{Applied: true, Changed: true}
+	rr := httptest.NewRecorder()
+	router.reloadConfig(rr, httptest.NewRequest("POST", "/admin/config/reload", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var result config.ReloadResult
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.True(t, result.Applied)
+	assert.Equal(t, uint64(2), result.Generation)
+	assert.True(t, reloaded)
+
+	cfg.ReloadVal = config.ReloadResult{Error: "validation failed", RulesFailures: []string{"Samplers is required"}}
+	rr = httptest.NewRecorder()
+	router.reloadConfig(rr, httptest.NewRequest("POST", "/admin/config/reload", nil))
+	require.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	result = config.ReloadResult{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.False(t, result.Applied)
+	assert.Equal(t, []string{"Samplers is required"}, result.RulesFailures)
+	assert.Equal(t, uint64(2), result.Generation)
+}
+
+func TestValidateConfig(t *testing.T) {
+	router := newAdminTestRouter(0)
+	validate := func(body string) (int, config.ValidationReport) {
+		rr := httptest.NewRecorder()
+		router.validateConfig(rr, httptest.NewRequest("POST", "/admin/config/validate", strings.NewReader(body)))
+		var report config.ValidationReport
+		if rr.Code != http.StatusBadRequest {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		}
+		return rr.Code, report
+	}
+
+	code, report := validate(`{
+		"config": "General:\n  ConfigurationVersion: 2\n",
+		"rules": "RulesVersion: 2\nSamplers:\n  __default__:\n    DeterministicSampler:\n      SampleRate: 1\n"
+	}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Valid)
+	assert.Contains(t, report.EffectiveConfig, "ListenAddr: 0.0.0.0:8080")
+
+	code, report = validate(`{
+		"config": "General:\n  ConfigurationVersion: 2\n  Bogus: 1\n",
+		"rules": "RulesVersion: 2\n"
+	}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.False(t, report.Valid)
+	assert.Len(t, report.ConfigFailures, 1)
+	assert.Equal(t, []string{"Samplers is required"}, report.RulesFailures)
+
+	code, _ = validate(`{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = validate(`not json`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestGetConfigSchema(t *testing.T) {
+	router := newAdminTestRouter(0)
+	for _, kind := range []string{"config", "rules"} {
+		rr := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/admin/config/schema/"+kind, nil), map[string]string{"kind": kind})
+		router.getConfigSchema(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		var schema map[string]any
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &schema))
+		assert.Equal(t, "https://json-schema.org/draft/2020-12/schema", schema["$schema"])
+	}
+
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/admin/config/schema/other", nil), map[string]string{"kind": "other"})
+	router.getConfigSchema(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestGetConfigHistory(t *testing.T) {
+	cfg := &config.MockConfig{Generation: 1}
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+
+	cfg.ReloadVal = config.ReloadResult{Applied: true, Changed: true, Changes: []config.ConfigChange{
+		{Document: "config", Path: "Network.ListenAddr", Change: "changed", Old: "0.0.0.0:8080", New: "0.0.0.0:9000"},
+	}}
+	req := httptest.NewRequest("POST", "/admin/config/reload", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	router.reloadConfig(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	router.getConfigHistory(rr, httptest.NewRequest("GET", "/admin/config/history", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var history []config.ConfigVersion
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, uint64(2), history[0].Generation)
+	assert.Equal(t, "admin request from 10.0.0.1:1234", history[0].Trigger)
+	assert.Equal(t, "Network.ListenAddr", history[0].Changes[0].Path)
+}
+
+func TestFeatureFlagEndpoints(t *testing.T) {
+	g := &gossip.InMemoryGossip{Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, g.Start())
+	defer g.Stop()
+	cfg := &config.MockConfig{FeatureFlags: map[string]bool{"new-behavior": false}}
+	flags := &featureflags.Flags{Config: cfg, Gossip: g, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, flags.Start())
+	defer flags.Stop()
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}, FeatureFlags: flags}
+
+	m := mux.NewRouter()
+	m.HandleFunc("/admin/flags", router.listFeatureFlags).Methods("GET")
+	m.HandleFunc("/admin/flags/{name}", router.overrideFeatureFlag).Methods("PUT")
+	m.HandleFunc("/admin/flags/{name}", router.clearFeatureFlag).Methods("DELETE")
+	do := func(method, target string) (int, []featureflags.Flag) {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		var result []featureflags.Flag
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		}
+		return rr.Code, result
+	}
+
+	code, result := do("GET", "/admin/flags")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []featureflags.Flag{{Name: "new-behavior"}}, result)
+
+	code, result = do("PUT", "/admin/flags/new-behavior?enabled=true")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []featureflags.Flag{{Name: "new-behavior", Enabled: true, Overridden: true}}, result)
+	assert.True(t, flags.Enabled("new-behavior"))
+
+	code, _ = do("PUT", "/admin/flags/new-behavior?enabled=maybe")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, result = do("DELETE", "/admin/flags/new-behavior")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []featureflags.Flag{{Name: "new-behavior"}}, result)
+}
+
+func TestLogLevelEndpoints(t *testing.T) {
+	cfg := &config.MockConfig{GetLoggerLevelVal: config.WarnLevel}
+	lgr := &logger.JSONLogger{Config: cfg, Output: io.Discard}
+	require.NoError(t, lgr.Start())
+	router := &Router{Config: cfg, Logger: logger.ForSubsystem(lgr, "router"), Metrics: &metrics.NullMetrics{}}
+
+	m := mux.NewRouter()
+	m.HandleFunc("/admin/log_levels", router.getLogLevels).Methods("GET")
+	m.HandleFunc("/admin/log_levels/{subsystem}", router.setLogLevel).Methods("PUT")
+	m.HandleFunc("/admin/log_levels/{subsystem}", router.clearLogLevel).Methods("DELETE")
+	do := func(method, target string) (int, map[string]string) {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		var result map[string]string
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		}
+		return rr.Code, result
+	}
+
+	code, result := do("GET", "/admin/log_levels")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"default": "warn"}, result)
+
+	code, result = do("PUT", "/admin/log_levels/collector?level=debug")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"default": "warn", "collector": "debug"}, result)
+
+	code, _ = do("PUT", "/admin/log_levels/collector?level=loud")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("DELETE", "/admin/log_levels/default")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, result = do("DELETE", "/admin/log_levels/collector")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"default": "warn"}, result)
+
+	// loggers without subsystem levels can't be changed
+	router.Logger = &logger.NullLogger{}
+	code, _ = do("GET", "/admin/log_levels")
+	assert.Equal(t, http.StatusNotImplemented, code)
+}
@@ -0,0 +1,89 @@
+//go:build all || !race
+
+package route
+
+import (
+	"context"
+	"testing"
+
+	huskyotlp "github.com/honeycombio/husky/otlp"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/internal/allocbudget"
+	"github.com/honeycombio/refinery/types"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	trace "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// ingestAllocsPerSpan is the most allocations translating and routing a
+// single OTLP span may take, counting both husky's translation and
+// Refinery's routing.
+const ingestAllocsPerSpan = 30
+
+const allocTestSpans = 100
+
+// discardCollector accepts spans without keeping them, so that the collector
+// doesn't count towards the allocations being measured.
+type discardCollector struct {
+	collect.MockCollector
+}
+
+func (d *discardCollector) AddSpan(*types.Span) error { return nil }
+
+func allocTestRequest(spans int) *collectortrace.ExportTraceServiceRequest {
+	stringAttr := func(key, value string) *common.KeyValue {
+		return &common.KeyValue{Key: key, Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: value}}}
+	}
+	scope := &trace.ScopeSpans{}
+	for i := 0; i < spans; i++ {
+		scope.Spans = append(scope.Spans, &trace.Span{
+			TraceId:           []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, byte(i)},
+			SpanId:            []byte{0, 1, 2, 3, 4, 5, 6, byte(i)},
+			Name:              "GET /users",
+			Kind:              trace.Span_SPAN_KIND_SERVER,
+			StartTimeUnixNano: uint64(1_700_000_000_000_000_000 + i),
+			EndTimeUnixNano:   uint64(1_700_000_000_001_000_000 + i),
+			Attributes: []*common.KeyValue{
+				stringAttr("http.method", "GET"),
+				stringAttr("http.route", "/users"),
+				{Key: "http.status_code", Value: &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: 200}}},
+			},
+		})
+	}
+	return &collectortrace.ExportTraceServiceRequest{
+		ResourceSpans: []*trace.ResourceSpans{{
+			Resource:   &resource.Resource{Attributes: []*common.KeyValue{stringAttr("service.name", "frontend")}},
+			ScopeSpans: []*trace.ScopeSpans{scope},
+		}},
+	}
+}
+
+// ingestOTLP is the part of the OTLP ingest path that runs for every span:
+// translating the request into events and handing them to the collector.
+func ingestOTLP(b testing.TB, router *Router, req *collectortrace.ExportTraceServiceRequest, ri huskyotlp.RequestInfo) {
+	result, err := huskyotlp.TranslateTraceRequest(context.Background(), req, ri)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rejected, err := processTraceRequest(context.Background(), router, result.Batches, ri.ApiKey)
+	if err != nil || rejected.count > 0 {
+		b.Fatalf("processing failed: %v, %d rejected", err, rejected.count)
+	}
+}
+
+func TestIngestAllocsPerSpan(t *testing.T) {
+	router := newStreamingTestRouter(&discardCollector{})
+	req := allocTestRequest(allocTestSpans)
+	ri := huskyotlp.RequestInfo{ApiKey: legacyAPIKey, Dataset: "ds", ContentType: "application/protobuf"}
+
+	allocbudget.Check(t, "OTLP ingest", ingestAllocsPerSpan, allocTestSpans, func() { ingestOTLP(t, router, req, ri) })
+}
+
+func BenchmarkIngestTranslate(b *testing.B) {
+	router := newStreamingTestRouter(&discardCollector{})
+	req := allocTestRequest(allocTestSpans)
+	ri := huskyotlp.RequestInfo{ApiKey: legacyAPIKey, Dataset: "ds", ContentType: "application/protobuf"}
+
+	allocbudget.Benchmark(b, func() { ingestOTLP(b, router, req, ri) })
+}
@@ -0,0 +1,134 @@
+package route
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// loadTLSConfig builds the TLS config for a listener. It returns nil if TLS
+// isn't configured for it.
+func (r *Router) loadTLSConfig(tlsCfg config.ListenerConfig) (*tls.Config, error) {
+	if !tlsCfg.TLSEnabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsCfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(tlsCfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		config.ClientCAs = pool
+		// clients without a certificate can still use an API key
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// clientCertIdentity returns the API key and dataset mapped to a verified
+// client certificate on the connection, if there is one.
+func (r *Router) clientCertIdentity(state *tls.ConnectionState) (apiKey string, dataset string, ok bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+
+	tlsCfg := r.Config.GetTLSConfig()
+	for _, san := range certSANs(state.VerifiedChains[0][0]) {
+		if key, found := tlsCfg.ClientCertAPIKeys[san]; found {
+			return key, tlsCfg.ClientCertDatasets[san], true
+		}
+	}
+	return "", "", false
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.URIs)+len(cert.EmailAddresses))
+	sans = append(sans, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	return sans
+}
+
+// clientCertAuth fills in the API key, and optionally the dataset, for
+// requests that authenticate with a client certificate instead of an API key.
+func (r *Router) clientCertAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(types.APIKeyHeader) != "" || req.Header.Get(types.APIKeyHeaderShort) != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		apiKey, dataset, ok := r.clientCertIdentity(req.TLS)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		r.Metrics.Increment("incoming_router_client_cert_auth")
+		req.Header.Set(types.APIKeyHeader, apiKey)
+		if dataset != "" {
+			req.Header.Set(types.DatasetHeader, dataset)
+			if vars := mux.Vars(req); vars["datasetName"] != "" {
+				vars["datasetName"] = dataset
+				req = mux.SetURLVars(req, vars)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// clientCertUnaryInterceptor does for gRPC requests what clientCertAuth does
+// for HTTP, by adding the mapped API key and dataset to the incoming metadata.
+func (r *Router) clientCertUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if getFirstValueFromMetadata(types.APIKeyHeader, md) != "" || getFirstValueFromMetadata(types.APIKeyHeaderShort, md) != "" {
+		return handler(ctx, req)
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return handler(ctx, req)
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return handler(ctx, req)
+	}
+	apiKey, dataset, ok := r.clientCertIdentity(&tlsInfo.State)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	r.Metrics.Increment("incoming_router_client_cert_auth")
+	md = md.Copy()
+	md.Set(types.APIKeyHeader, apiKey)
+	if dataset != "" {
+		md.Set(types.DatasetHeader, dataset)
+	}
+	return handler(metadata.NewIncomingContext(ctx, md), req)
+}
@@ -0,0 +1,118 @@
+package route
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func newClientCertTestRouter() *Router {
+	return &Router{
+		Config: &config.MockConfig{
+			TLS: config.TLSConfig{
+				ClientCertAPIKeys:  map[string]string{"spiffe://internal/svc": "svc-key", "other.internal": "other-key"},
+				ClientCertDatasets: map[string]string{"spiffe://internal/svc": "svc-dataset"},
+			},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+}
+
+func verifiedState(cert *x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestClientCertAuthHTTP(t *testing.T) {
+	router := newClientCertTestRouter()
+	svcURI, _ := url.Parse("spiffe://internal/svc")
+
+	var gotKey, gotDataset string
+	m := mux.NewRouter()
+	sub := m.PathPrefix("/1/").Subrouter()
+	sub.Use(router.clientCertAuth)
+	sub.HandleFunc("/events/{datasetName}", func(w http.ResponseWriter, req *http.Request) {
+		gotKey = req.Header.Get(types.APIKeyHeader)
+		gotDataset = mux.Vars(req)["datasetName"]
+	})
+
+	t.Run("mapped certificate", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/1/events/original", nil)
+		req.TLS = verifiedState(&x509.Certificate{URIs: []*url.URL{svcURI}})
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "svc-key", gotKey)
+		assert.Equal(t, "svc-dataset", gotDataset)
+	})
+
+	t.Run("mapped certificate without dataset", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/1/events/original", nil)
+		req.TLS = verifiedState(&x509.Certificate{DNSNames: []string{"other.internal"}})
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "other-key", gotKey)
+		assert.Equal(t, "original", gotDataset)
+	})
+
+	t.Run("explicit api key wins", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/1/events/original", nil)
+		req.Header.Set(types.APIKeyHeader, "header-key")
+		req.TLS = verifiedState(&x509.Certificate{URIs: []*url.URL{svcURI}})
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "header-key", gotKey)
+		assert.Equal(t, "original", gotDataset)
+	})
+
+	t.Run("unmapped or unverified certificate", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/1/events/original", nil)
+		req.TLS = verifiedState(&x509.Certificate{DNSNames: []string{"unknown.internal"}})
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "", gotKey)
+
+		req = httptest.NewRequest("POST", "/1/events/original", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{DNSNames: []string{"other.internal"}}}}
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "", gotKey)
+	})
+}
+
+func TestClientCertAuthGRPC(t *testing.T) {
+	router := newClientCertTestRouter()
+	svcURI, _ := url.Parse("spiffe://internal/svc")
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: *verifiedState(&x509.Certificate{URIs: []*url.URL{svcURI}})},
+	})
+
+	var gotMD metadata.MD
+	handler := func(ctx context.Context, req any) (any, error) {
+		gotMD, _ = metadata.FromIncomingContext(ctx)
+		return nil, nil
+	}
+
+	_, err := router.clientCertUnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "svc-key", getFirstValueFromMetadata(types.APIKeyHeader, gotMD))
+	assert.Equal(t, "svc-dataset", getFirstValueFromMetadata(types.DatasetHeader, gotMD))
+
+	// an API key in the request metadata is left alone
+	withKey := metadata.NewIncomingContext(ctx, metadata.Pairs(types.APIKeyHeader, "header-key"))
+	_, err = router.clientCertUnaryInterceptor(withKey, nil, &grpc.UnaryServerInfo{}, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "header-key", getFirstValueFromMetadata(types.APIKeyHeader, gotMD))
+	assert.Empty(t, getFirstValueFromMetadata(types.DatasetHeader, gotMD))
+}
@@ -0,0 +1,274 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+const localClusterName = "local"
+
+const (
+	// clusterStatusChannel is the gossip channel on which each node
+	// publishes its nodeStatus
+	clusterStatusChannel = "cluster_status"
+	// clusterStatusInterval is how often each node publishes its status
+	clusterStatusInterval = 5 * time.Second
+	// clusterStatusTTL is how long a node's status is reported after the
+	// last time it was heard from
+	clusterStatusTTL = 3 * clusterStatusInterval
+)
+
+// clusterStatus is what /admin/cluster reports about this cluster. Host,
+// Version, and IngestStatus are those of the Refinery that answered; Alive
+// and Ready are true only if every node in the cluster is, and Stressed if
+// any node is.
+type clusterStatus struct {
+	Name         string                 `json:"name"`
+	Host         string                 `json:"host"`
+	Version      string                 `json:"version"`
+	Alive        bool                   `json:"alive"`
+	Ready        bool                   `json:"ready"`
+	Stressed     bool                   `json:"stressed"`
+	IngestStatus map[string]interface{} `json:"ingest"`
+	Time         time.Time              `json:"time"`
+	Nodes        []nodeStatus           `json:"nodes,omitempty"`
+}
+
+// nodeStatus is one Refinery's part of its cluster's status. Every node
+// publishes its own over gossip, so that whichever node answers
+// /admin/cluster can report on all of them.
+type nodeStatus struct {
+	Host         string    `json:"host"`
+	Version      string    `json:"version"`
+	Alive        bool      `json:"alive"`
+	Ready        bool      `json:"ready"`
+	Stressed     bool      `json:"stressed"`
+	IngestPaused bool      `json:"ingest_paused"`
+	Time         time.Time `json:"time"`
+}
+
+// clusterNodes holds the latest status heard from each node in the cluster.
+type clusterNodes struct {
+	lock  sync.Mutex
+	nodes map[string]nodeStatus
+}
+
+func (c *clusterNodes) update(status nodeStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.nodes == nil {
+		c.nodes = make(map[string]nodeStatus)
+	}
+	c.nodes[status.Host] = status
+}
+
+// current returns the statuses heard from since ttl before now, and forgets
+// the others.
+func (c *clusterNodes) current(now time.Time, ttl time.Duration) []nodeStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	nodes := make([]nodeStatus, 0, len(c.nodes))
+	for host, status := range c.nodes {
+		if now.Sub(status.Time) > ttl {
+			delete(c.nodes, host)
+			continue
+		}
+		nodes = append(nodes, status)
+	}
+	return nodes
+}
+
+// federatedCluster is one cluster's entry in the federated view.
+type federatedCluster struct {
+	Name   string         `json:"name"`
+	URL    string         `json:"url,omitempty"`
+	Status *clusterStatus `json:"status,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+type federatedStatus struct {
+	Clusters  []federatedCluster `json:"clusters"`
+	Healthy   int                `json:"healthy"`
+	Unhealthy int                `json:"unhealthy"`
+}
+
+// localNodeStatus returns the status of this node.
+func (r *Router) localNodeStatus() nodeStatus {
+	host, _ := os.Hostname()
+	return nodeStatus{
+		Host:         host,
+		Version:      r.versionStr,
+		Alive:        r.Health.IsAlive(),
+		Ready:        r.Health.IsReady(),
+		Stressed:     r.Collector.Stressed(),
+		IngestPaused: r.ingestPause.paused.Load(),
+		Time:         time.Now().UTC(),
+	}
+}
+
+// localClusterStatus returns the status of this cluster: this node's, along
+// with that of every peer heard from recently.
+func (r *Router) localClusterStatus() *clusterStatus {
+	name := r.Config.GetFederationConfig().ClusterName
+	if name == "" {
+		name = localClusterName
+	}
+	local := r.localNodeStatus()
+	status := &clusterStatus{
+		Name:         name,
+		Host:         local.Host,
+		Version:      local.Version,
+		Alive:        true,
+		Ready:        true,
+		IngestStatus: r.ingestPause.status(),
+		Time:         local.Time,
+	}
+
+	nodes := []nodeStatus{local}
+	for _, node := range r.clusterNodes.current(local.Time, clusterStatusTTL) {
+		if node.Host != local.Host {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Host < nodes[j].Host })
+	for _, node := range nodes {
+		status.Alive = status.Alive && node.Alive
+		status.Ready = status.Ready && node.Ready
+		status.Stressed = status.Stressed || node.Stressed
+	}
+	status.Nodes = nodes
+	return status
+}
+
+// shareClusterStatus publishes this node's status to its peers every
+// clusterStatusInterval, and records theirs as they arrive, until the router
+// is stopped.
+func (r *Router) shareClusterStatus() {
+	if r.Gossip == nil {
+		return
+	}
+	updates := r.Gossip.Subscribe(clusterStatusChannel, 20)
+	r.doneWG.Add(1)
+	go func() {
+		defer r.doneWG.Done()
+		ticker := time.NewTicker(clusterStatusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				data, err := json.Marshal(r.localNodeStatus())
+				if err == nil {
+					err = r.Gossip.Publish(clusterStatusChannel, data)
+				}
+				if err != nil {
+					r.iopLogger.Error().Logf("error publishing cluster status: %s", err)
+				}
+			case data := <-updates:
+				var status nodeStatus
+				if err := json.Unmarshal(data, &status); err != nil || status.Host == "" {
+					r.iopLogger.Error().Logf("ignoring invalid cluster status message")
+					continue
+				}
+				// use our own clock, so that skew between nodes doesn't
+				// expire their statuses early or late
+				status.Time = time.Now().UTC()
+				r.clusterNodes.update(status)
+			case <-r.donech:
+				return
+			}
+		}
+	}()
+}
+
+// getClusterStatus handles GET /admin/cluster. It reports on every node in
+// the cluster that has shared its status within clusterStatusTTL.
+func (r *Router) getClusterStatus(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.localClusterStatus(), "json")
+}
+
+// getFederatedClusterStatus handles GET /admin/cluster/federated. It reports
+// this cluster's status along with that of every cluster configured in
+// Federation.Clusters, which are all queried at once. A cluster that can't be
+// reached is reported as unhealthy rather than failing the whole request.
+func (r *Router) getFederatedClusterStatus(w http.ResponseWriter, req *http.Request) {
+	cfg := r.Config.GetFederationConfig()
+
+	local := r.localClusterStatus()
+	clusters := []federatedCluster{{Name: local.Name, Status: local}}
+
+	names := make([]string, 0, len(cfg.Clusters))
+	for name := range cfg.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	remotes := make([]federatedCluster, len(names))
+	wg := sync.WaitGroup{}
+	for i, name := range names {
+		remote := cfg.Clusters[name]
+		remotes[i] = federatedCluster{Name: name, URL: remote.URL}
+		wg.Add(1)
+		go func(fc *federatedCluster, token string) {
+			defer wg.Done()
+			status, err := r.fetchClusterStatus(req.Context(), fc.URL, token, time.Duration(cfg.Timeout))
+			if err != nil {
+				fc.Error = err.Error()
+				return
+			}
+			fc.Status = status
+		}(&remotes[i], remote.Token)
+	}
+	wg.Wait()
+	clusters = append(clusters, remotes...)
+
+	result := federatedStatus{Clusters: clusters}
+	for _, c := range clusters {
+		if c.Status != nil && c.Status.Alive && c.Status.Ready {
+			result.Healthy++
+		} else {
+			result.Unhealthy++
+		}
+	}
+	r.marshalToFormat(w, result, "json")
+}
+
+// fetchClusterStatus asks the Refinery at baseURL for its cluster's status.
+func (r *Router) fetchClusterStatus(ctx context.Context, baseURL string, token string, timeout time.Duration) (*clusterStatus, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(baseURL, "/")+"/admin/cluster", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(types.QueryTokenHeader, token)
+
+	resp, err := r.proxyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// don't let a misbehaving cluster fill the response with its body
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("cluster status request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	status := &clusterStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("couldn't decode cluster status: %w", err)
+	}
+	return status, nil
+}
@@ -0,0 +1,175 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/peer"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedHealth struct {
+	alive, ready bool
+}
+
+func (h fixedHealth) IsAlive() bool { return h.alive }
+func (h fixedHealth) IsReady() bool { return h.ready }
+func (h fixedHealth) Subsystems() map[string]health.SubsystemStatus {
+	return map[string]health.SubsystemStatus{}
+}
+
+func newClusterTestRouter(name string, token string, ready bool) *Router {
+	return &Router{
+		Config: &config.MockConfig{
+			QueryAuthToken: token,
+			Federation:     config.FederationConfig{ClusterName: name},
+		},
+		Logger:      &logger.NullLogger{},
+		Metrics:     &metrics.NullMetrics{},
+		Health:      fixedHealth{alive: true, ready: ready},
+		Collector:   &collect.MockCollector{},
+		proxyClient: http.DefaultClient,
+		versionStr:  "3.0.0",
+	}
+}
+
+func TestFederatedClusterStatus(t *testing.T) {
+	eu := newClusterTestRouter("eu", "eu-token", true)
+	euServer := httptest.NewServer(eu.queryTokenChecker(http.HandlerFunc(eu.getClusterStatus)))
+	defer euServer.Close()
+
+	ap := newClusterTestRouter("ap", "ap-token", false)
+	apServer := httptest.NewServer(ap.queryTokenChecker(http.HandlerFunc(ap.getClusterStatus)))
+	defer apServer.Close()
+
+	router := newClusterTestRouter("us", "us-token", true)
+	router.Config.(*config.MockConfig).Federation.Clusters = map[string]config.FederatedCluster{
+		"eu":       {URL: euServer.URL + "/", Token: "eu-token"},
+		"ap":       {URL: apServer.URL, Token: "ap-token"},
+		"badtoken": {URL: euServer.URL, Token: "wrong"},
+	}
+
+	rr := httptest.NewRecorder()
+	router.getFederatedClusterStatus(rr, httptest.NewRequest("GET", "/admin/cluster/federated", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var result federatedStatus
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	require.Len(t, result.Clusters, 4)
+	assert.Equal(t, 2, result.Healthy)
+	assert.Equal(t, 2, result.Unhealthy)
+
+	// the local cluster comes first, then the others by name
+	assert.Equal(t, "us", result.Clusters[0].Name)
+	assert.Equal(t, "3.0.0", result.Clusters[0].Status.Version)
+
+	assert.Equal(t, "ap", result.Clusters[1].Name)
+	require.NotNil(t, result.Clusters[1].Status)
+	assert.False(t, result.Clusters[1].Status.Ready)
+
+	assert.Equal(t, "badtoken", result.Clusters[2].Name)
+	assert.Nil(t, result.Clusters[2].Status)
+	assert.Contains(t, result.Clusters[2].Error, "400")
+
+	assert.Equal(t, "eu", result.Clusters[3].Name)
+	require.NotNil(t, result.Clusters[3].Status)
+	assert.Equal(t, "eu", result.Clusters[3].Status.Name)
+	assert.True(t, result.Clusters[3].Status.Ready)
+}
+
+func TestClusterStatusAggregatesPeers(t *testing.T) {
+	g := &gossip.InMemoryGossip{Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, g.Start())
+	defer g.Stop()
+
+	router := newClusterTestRouter("us", "us-token", true)
+	router.Gossip = g
+	router.iopLogger = iopLogger{Logger: &logger.NullLogger{}}
+	router.donech = make(chan struct{})
+	router.shareClusterStatus()
+	defer func() {
+		close(router.donech)
+		router.doneWG.Wait()
+	}()
+
+	peer, err := json.Marshal(nodeStatus{Host: "zz-peer", Version: "3.0.0", Alive: true, Stressed: true})
+	require.NoError(t, err)
+	require.NoError(t, g.Publish(clusterStatusChannel, peer))
+
+	var status clusterStatus
+	require.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		router.getClusterStatus(rr, httptest.NewRequest("GET", "/admin/cluster", nil))
+		status = clusterStatus{}
+		return json.Unmarshal(rr.Body.Bytes(), &status) == nil && len(status.Nodes) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// the peer isn't ready, so neither is the cluster
+	assert.True(t, status.Alive)
+	assert.False(t, status.Ready)
+	assert.True(t, status.Stressed)
+	for _, node := range status.Nodes {
+		assert.Equal(t, node.Host != "zz-peer", node.Ready, node.Host)
+	}
+
+	// peers that stop reporting are forgotten
+	assert.Empty(t, router.clusterNodes.current(time.Now().Add(clusterStatusTTL+time.Second), clusterStatusTTL))
+}
+
+func TestPeerVersion(t *testing.T) {
+	router := newClusterTestRouter("us", "us-token", true)
+
+	rr := httptest.NewRecorder()
+	router.getPeerVersion(rr, httptest.NewRequest("GET", peer.CapabilitiesPath, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var caps peer.Capabilities
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &caps))
+	assert.Equal(t, "3.0.0", caps.Version)
+	assert.Equal(t, "deterministic", caps.Sharder)
+	assert.Contains(t, caps.Compression, "zstd")
+	assert.Equal(t, peer.MessageSchemas, caps.MessageSchemas)
+}
+
+func TestPeerVersionNegotiates(t *testing.T) {
+	router := newClusterTestRouter("us", "us-token", true)
+	router.iopLogger = iopLogger{Logger: &logger.NullLogger{}}
+	server := httptest.NewServer(http.HandlerFunc(router.getPeerVersion))
+	defer server.Close()
+
+	// an older peer that only knows gzip learns what to send us with
+	older := &peer.CapabilityCache{Local: peer.Capabilities{
+		Version:        "2.9.0",
+		Compression:    []string{"gzip"},
+		MessageSchemas: []int{1},
+		Sharder:        "deterministic",
+	}}
+	agreement, err := older.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, peer.Agreement{Compression: "gzip", MessageSchema: 1}, agreement)
+
+	// a peer that would shard traces differently is refused
+	other := &peer.CapabilityCache{Local: peer.Capabilities{
+		Compression:    []string{"zstd"},
+		MessageSchemas: []int{1},
+		Sharder:        "single",
+	}}
+	_, err = other.Get(context.Background(), server.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "409")
+
+	rr := httptest.NewRecorder()
+	router.getPeerVersion(rr, httptest.NewRequest("GET", peer.CapabilitiesPath+"?message_schemas=one", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
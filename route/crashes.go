@@ -0,0 +1,17 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/honeycombio/refinery/internal/supervisor"
+)
+
+// getCrashReports handles GET /debug/crashes. It lists the most recent panics
+// that were recovered in supervised goroutines, newest first.
+func (r *Router) getCrashReports(w http.ResponseWriter, req *http.Request) {
+	reports := r.Supervisor.Reports()
+	if reports == nil {
+		reports = []supervisor.CrashReport{}
+	}
+	r.marshalToFormat(w, reports, "json")
+}
@@ -0,0 +1,259 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+)
+
+// ddSpan is a span as sent by the dd-trace libraries to the Datadog agent.
+type ddSpan struct {
+	Service  string             `json:"service" msgpack:"service"`
+	Name     string             `json:"name" msgpack:"name"`
+	Resource string             `json:"resource" msgpack:"resource"`
+	TraceID  uint64             `json:"trace_id" msgpack:"trace_id"`
+	SpanID   uint64             `json:"span_id" msgpack:"span_id"`
+	ParentID uint64             `json:"parent_id" msgpack:"parent_id"`
+	Start    int64              `json:"start" msgpack:"start"`       // nanoseconds since the epoch
+	Duration int64              `json:"duration" msgpack:"duration"` // nanoseconds
+	Error    int32              `json:"error" msgpack:"error"`
+	Meta     map[string]string  `json:"meta" msgpack:"meta"`
+	Metrics  map[string]float64 `json:"metrics" msgpack:"metrics"`
+	Type     string             `json:"type" msgpack:"type"`
+}
+
+// ddTracerPayload is the body of a v0.7 request, which groups traces into
+// chunks along with tags that apply to all of them.
+type ddTracerPayload struct {
+	LanguageName string            `msgpack:"language_name"`
+	Chunks       []ddTraceChunk    `msgpack:"chunks"`
+	Tags         map[string]string `msgpack:"tags"`
+	Env          string            `msgpack:"env"`
+	Hostname     string            `msgpack:"hostname"`
+	AppVersion   string            `msgpack:"app_version"`
+}
+
+type ddTraceChunk struct {
+	Priority int32             `msgpack:"priority"`
+	Origin   string            `msgpack:"origin"`
+	Spans    []ddSpan          `msgpack:"spans"`
+	Tags     map[string]string `msgpack:"tags"`
+}
+
+// ddTraceIDHighTag holds the upper 64 bits of a 128-bit trace ID, as hex.
+const ddTraceIDHighTag = "_dd.p.tid"
+
+// postDatadogTraces handles the trace endpoints of the Datadog agent API.
+// v0.4 requests hold a list of traces, each a list of spans; v0.7 requests
+// hold a tracer payload.
+func (r *Router) postDatadogTraces(w http.ResponseWriter, req *http.Request) {
+	r.Metrics.Increment("incoming_router_datadog")
+	defer req.Body.Close()
+
+	bodyReader, err := r.getMaybeCompressedBody(req)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+	reqBod, err := io.ReadAll(bodyReader)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+
+	var chunks []ddTraceChunk
+	var payloadTags map[string]string
+	switch mux.Vars(req)["version"] {
+	case "v0.7":
+		var payload ddTracerPayload
+		if err := unmarshal(req, bytes.NewReader(reqBod), &payload); err != nil {
+			r.handlerReturnWithError(w, ErrDatadogDecode, err)
+			return
+		}
+		chunks = payload.Chunks
+		payloadTags = payload.tags()
+	default:
+		var traces [][]ddSpan
+		if err := unmarshal(req, bytes.NewReader(reqBod), &traces); err != nil {
+			r.handlerReturnWithError(w, ErrDatadogDecode, err)
+			return
+		}
+		chunks = make([]ddTraceChunk, len(traces))
+		for i, trace := range traces {
+			chunks[i].Spans = trace
+		}
+	}
+
+	apiKey := req.Header.Get(types.APIKeyHeader)
+	if apiKey == "" {
+		apiKey = req.Header.Get(types.APIKeyHeaderShort)
+	}
+	environment, err := r.getEnvironmentName(apiKey)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrReqToEvent, err)
+		return
+	}
+
+	reqID := req.Context().Value(types.RequestIDContextKey{})
+	apiHost := r.Config.GetHoneycombAPI()
+	dataset := req.Header.Get(types.DatasetHeader)
+	if dataset == "" {
+		dataset = r.Config.GetDatadogConfig().Dataset
+	}
+	// the sampler selector for each service and env in the request, for the
+	// rates returned to the tracer
+	selectors := make(map[ddServiceEnv]string)
+	for _, chunk := range chunks {
+		for _, span := range chunk.Spans {
+			spanDataset := dataset
+			if spanDataset == "" {
+				spanDataset = span.Service
+			}
+			env := span.Meta["env"]
+			if env == "" {
+				env = chunk.Tags["env"]
+			}
+			if env == "" {
+				env = payloadTags["env"]
+			}
+			selectors[ddServiceEnv{service: span.Service, env: env}] = r.samplerSelector(apiKey, environment, spanDataset)
+			ev := &types.Event{
+				Context:     req.Context(),
+				APIHost:     apiHost,
+				APIKey:      apiKey,
+				Dataset:     spanDataset,
+				Environment: environment,
+				SampleRate:  1,
+				Timestamp:   time.Unix(0, span.Start).UTC(),
+				Data:        span.toEventData(payloadTags, chunk.Tags),
+			}
+			if err := r.processEvent(ev, reqID); err != nil {
+				r.Logger.Error().Logf("Error processing Datadog span: " + err.Error())
+			}
+		}
+	}
+
+	// tracers use the returned rates to set the sampling priority of new
+	// traces; Refinery still makes the decision, but the priority recorded on
+	// spans then reflects what Refinery is likely to keep
+	rates := map[string]float64{"service:,env:": 1}
+	for key, selector := range selectors {
+		rates["service:"+key.service+",env:"+key.env] = r.samplerKeepRate(selector)
+	}
+	r.marshalToFormat(w, map[string]interface{}{
+		"rate_by_service": rates,
+	}, "json")
+}
+
+// ddServiceEnv is a service and env, which Datadog tracers are given a
+// sampling rate for.
+type ddServiceEnv struct {
+	service string
+	env     string
+}
+
+// samplerSelector returns the selector of the sampler that decides traces
+// sent with the API key to the dataset, as the collector chooses it.
+func (r *Router) samplerSelector(apiKey, environment, dataset string) string {
+	if !types.IsLegacyAPIKey(apiKey) {
+		return environment
+	}
+	if prefix := r.Config.GetDatasetPrefix(); prefix != "" {
+		return prefix + "." + dataset
+	}
+	return dataset
+}
+
+// samplerKeepRate estimates the fraction of traces that the sampler for
+// selector keeps. For samplers that report their keys, it's the average of
+// their keys' keep rates, weighted by throughput; for deterministic samplers
+// it's their fixed rate. Anything else is assumed to keep everything.
+func (r *Router) samplerKeepRate(selector string) float64 {
+	if r.SamplerFactory != nil {
+		if reports, ok := r.SamplerFactory.SamplerKeys(selector); ok {
+			var seen, kept float64
+			for _, report := range reports {
+				for _, key := range report.Keys {
+					if key.SampleRate == 0 {
+						continue
+					}
+					seen += key.TracesPerSec
+					kept += key.TracesPerSec / float64(key.SampleRate)
+				}
+			}
+			if seen > 0 {
+				return kept / seen
+			}
+		}
+	}
+	if c, _, err := r.Config.GetSamplerConfigForDestName(selector); err == nil {
+		if d, ok := c.(*config.DeterministicSamplerConfig); ok && d.SampleRate > 1 {
+			return 1 / float64(d.SampleRate)
+		}
+	}
+	return 1
+}
+
+// tags returns the payload-level fields that apply to every span in it.
+func (p *ddTracerPayload) tags() map[string]string {
+	tags := make(map[string]string, len(p.Tags)+4)
+	for k, v := range p.Tags {
+		tags[k] = v
+	}
+	addTag := func(k, v string) {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	addTag("env", p.Env)
+	addTag("host.name", p.Hostname)
+	addTag("version", p.AppVersion)
+	addTag("language", p.LanguageName)
+	return tags
+}
+
+// toEventData converts the span to the fields Refinery expects. Datadog's
+// 64-bit IDs are written as hex, and trace IDs are padded to 128 bits as
+// OpenTelemetry does, so that traces that cross between Datadog and
+// OpenTelemetry instrumentation keep the same ID.
+func (s *ddSpan) toEventData(tagSets ...map[string]string) map[string]interface{} {
+	data := make(map[string]interface{}, len(s.Meta)+len(s.Metrics)+10)
+	for _, tags := range tagSets {
+		for k, v := range tags {
+			data[k] = v
+		}
+	}
+	for k, v := range s.Meta {
+		data[k] = v
+	}
+	for k, v := range s.Metrics {
+		data[k] = v
+	}
+
+	traceIDHigh := s.Meta[ddTraceIDHighTag]
+	if len(traceIDHigh) != 16 {
+		traceIDHigh = "0000000000000000"
+	}
+	data["trace.trace_id"] = fmt.Sprintf("%s%016x", traceIDHigh, s.TraceID)
+	data["trace.span_id"] = fmt.Sprintf("%016x", s.SpanID)
+	if s.ParentID != 0 {
+		data["trace.parent_id"] = fmt.Sprintf("%016x", s.ParentID)
+	}
+	data["name"] = s.Name
+	data["service.name"] = s.Service
+	data["resource.name"] = s.Resource
+	if s.Type != "" {
+		data["span.type"] = s.Type
+	}
+	data["duration_ms"] = float64(s.Duration) / float64(time.Millisecond)
+	if s.Error != 0 {
+		data["error"] = true
+	}
+	return data
+}
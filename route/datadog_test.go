@@ -0,0 +1,143 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func newDatadogTestRouter() (*Router, *collect.MockCollector, *mux.Router) {
+	collector := &collect.MockCollector{}
+	router := &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:  []string{"trace.trace_id"},
+			ParentIdFieldNames: []string{"trace.parent_id"},
+		},
+		Logger:           &logger.NullLogger{},
+		Metrics:          &metrics.NullMetrics{},
+		Collector:        collector,
+		iopLogger:        iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		environmentCache: newEnvironmentCache(time.Second, nil),
+	}
+	m := mux.NewRouter()
+	m.HandleFunc("/{version:v0\\.[47]}/traces", router.postDatadogTraces)
+	return router, collector, m
+}
+
+func TestDatadogV04Traces(t *testing.T) {
+	_, collector, m := newDatadogTestRouter()
+
+	traces := [][]ddSpan{{
+		{
+			Service: "web", Name: "http.request", Resource: "GET /users",
+			TraceID: 1234, SpanID: 1234, Start: 1700000000000000000, Duration: 2500000,
+			Meta:    map[string]string{"http.method": "GET", ddTraceIDHighTag: "6550c1b300000000"},
+			Metrics: map[string]float64{"_sampling_priority_v1": 1},
+			Type:    "web",
+		},
+		{
+			Service: "web", Name: "postgres.query", Resource: "SELECT 1",
+			TraceID: 1234, SpanID: 5678, ParentID: 1234, Start: 1700000000001000000, Duration: 1000000,
+			Error: 1,
+		},
+	}}
+	body, err := msgpack.Marshal(traces)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("PUT", "/v0.4/traces", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set(types.APIKeyHeader, legacyAPIKey)
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "rate_by_service")
+
+	require.Len(t, collector.Spans, 2)
+	root := collector.Spans[0]
+	assert.True(t, root.IsRoot)
+	assert.Equal(t, "web", root.Dataset)
+	assert.Equal(t, "6550c1b30000000000000000000004d2", root.TraceID)
+	assert.Equal(t, "00000000000004d2", root.Data["trace.span_id"])
+	assert.Equal(t, "GET /users", root.Data["resource.name"])
+	assert.Equal(t, "GET", root.Data["http.method"])
+	assert.Equal(t, 2.5, root.Data["duration_ms"])
+	assert.Equal(t, time.Unix(0, 1700000000000000000).UTC(), root.Timestamp)
+
+	child := collector.Spans[1]
+	assert.False(t, child.IsRoot)
+	assert.Equal(t, "00000000000004d2", child.Data["trace.parent_id"])
+	assert.Equal(t, true, child.Data["error"])
+}
+
+func TestDatadogV07Traces(t *testing.T) {
+	_, collector, m := newDatadogTestRouter()
+
+	payload := ddTracerPayload{
+		Env:      "prod",
+		Hostname: "host-1",
+		Chunks: []ddTraceChunk{{
+			Priority: 1,
+			Tags:     map[string]string{"_dd.origin": "lambda"},
+			Spans:    []ddSpan{{Service: "worker", Name: "job", TraceID: 42, SpanID: 42, Duration: 1000}},
+		}},
+	}
+	body, err := msgpack.Marshal(payload)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/v0.7/traces", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set(types.DatasetHeader, "migration")
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	require.Len(t, collector.Spans, 1)
+	span := collector.Spans[0]
+	assert.Equal(t, "migration", span.Dataset)
+	assert.Equal(t, "0000000000000000000000000000002a", span.TraceID)
+	assert.Equal(t, "prod", span.Data["env"])
+	assert.Equal(t, "host-1", span.Data["host.name"])
+	assert.Equal(t, "lambda", span.Data["_dd.origin"])
+}
+
+func TestDatadogRateByService(t *testing.T) {
+	router, _, m := newDatadogTestRouter()
+	router.Config.(*config.MockConfig).GetSamplerTypeVal = &config.DeterministicSamplerConfig{SampleRate: 4}
+
+	traces := [][]ddSpan{{{
+		Service: "web", Name: "http.request", TraceID: 1234, SpanID: 1234,
+		Start: 1700000000000000000, Duration: 2500000,
+		Meta: map[string]string{"env": "prod"},
+	}}}
+	body, err := msgpack.Marshal(traces)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("PUT", "/v0.4/traces", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set(types.APIKeyHeader, legacyAPIKey)
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		RateByService map[string]float64 `json:"rate_by_service"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, map[string]float64{
+		"service:,env:":        1,
+		"service:web,env:prod": 0.25,
+	}, resp.RateByService)
+}
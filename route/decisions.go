@@ -0,0 +1,102 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/honeycombio/refinery/centralstore"
+)
+
+// maxDecisionQueryTraceIDs limits how many trace IDs may be looked up in a
+// single request to the decisions endpoint.
+const maxDecisionQueryTraceIDs = 10_000
+
+// maxDecisionQueryBodySize limits the size of a decisions request body. It
+// leaves room for the largest allowed number of long trace IDs.
+const maxDecisionQueryBodySize = 2 << 20
+
+type decisionQuery struct {
+	TraceIDs []string `json:"trace_ids"`
+}
+
+type traceDecision struct {
+	TraceID string `json:"trace_id"`
+	// Decision is one of "kept", "dropped", "pending" (the trace is known but
+	// not yet decided), or "unknown".
+	Decision string `json:"decision"`
+	Rate     uint   `json:"rate,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// getTraceDecisions handles POST /query/decisions. It lets log pipelines ask
+// in bulk whether the traces their logs belong to were kept, so that they can
+// sample logs to match. The body is a JSON object with a trace_ids array; the
+// response lists a decision for each ID in the same order.
+func (r *Router) getTraceDecisions(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxDecisionQueryBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			r.handlerReturnWithError(w, ErrBadDecisionQuery, fmt.Errorf("request body is larger than %d bytes", tooLarge.Limit))
+			return
+		}
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+
+	var query decisionQuery
+	if err := json.Unmarshal(body, &query); err != nil {
+		r.handlerReturnWithError(w, ErrJSONFailed, err)
+		return
+	}
+	if len(query.TraceIDs) > maxDecisionQueryTraceIDs {
+		r.handlerReturnWithError(w, ErrBadDecisionQuery, fmt.Errorf("%d trace IDs requested; the limit is %d", len(query.TraceIDs), maxDecisionQueryTraceIDs))
+		return
+	}
+
+	r.Metrics.Increment("decision_query_requests")
+	r.Metrics.Count("decision_query_trace_ids", len(query.TraceIDs))
+
+	statuses, err := r.Store.GetStatusForTraces(req.Context(), query.TraceIDs,
+		centralstore.Collecting,
+		centralstore.DecisionDelay,
+		centralstore.ReadyToDecide,
+		centralstore.AwaitingDecision,
+		centralstore.DecisionKeep,
+		centralstore.DecisionDrop,
+	)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrDecisionLookup, err)
+		return
+	}
+
+	byID := make(map[string]*centralstore.CentralTraceStatus, len(statuses))
+	for _, status := range statuses {
+		if status != nil {
+			byID[status.TraceID] = status
+		}
+	}
+
+	decisions := make([]traceDecision, 0, len(query.TraceIDs))
+	for _, traceID := range query.TraceIDs {
+		d := traceDecision{TraceID: traceID, Decision: "unknown"}
+		if status, ok := byID[traceID]; ok {
+			switch status.State {
+			case centralstore.DecisionKeep:
+				d.Decision = "kept"
+				d.Rate = status.Rate
+				d.Reason = status.KeepReason
+			case centralstore.DecisionDrop:
+				d.Decision = "dropped"
+			default:
+				d.Decision = "pending"
+			}
+		}
+		decisions = append(decisions, d)
+	}
+
+	r.marshalToFormat(w, map[string]interface{}{"decisions": decisions}, "json")
+}
@@ -0,0 +1,95 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/honeycombio/refinery/centralstore"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDecisionStore only implements the part of SmartStorer used for
+// decision queries.
+type fakeDecisionStore struct {
+	centralstore.SmartStorer
+	statuses map[string]*centralstore.CentralTraceStatus
+}
+
+func (f *fakeDecisionStore) GetStatusForTraces(ctx context.Context, traceIDs []string, states ...centralstore.CentralTraceState) ([]*centralstore.CentralTraceStatus, error) {
+	result := make([]*centralstore.CentralTraceStatus, 0, len(traceIDs))
+	for _, id := range traceIDs {
+		if status, ok := f.statuses[id]; ok {
+			result = append(result, status)
+		}
+	}
+	return result, nil
+}
+
+func TestGetTraceDecisions(t *testing.T) {
+	router := &Router{
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Store: &fakeDecisionStore{statuses: map[string]*centralstore.CentralTraceStatus{
+			"kept":    {TraceID: "kept", State: centralstore.DecisionKeep, Rate: 10, KeepReason: "rules/1"},
+			"dropped": {TraceID: "dropped", State: centralstore.DecisionDrop, Rate: 10},
+			"pending": {TraceID: "pending", State: centralstore.Collecting},
+		}},
+	}
+
+	rr := httptest.NewRecorder()
+	body := `{"trace_ids":["dropped","kept","missing","pending"]}`
+	router.getTraceDecisions(rr, httptest.NewRequest("POST", "/query/decisions", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Decisions []traceDecision `json:"decisions"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, []traceDecision{
+		{TraceID: "dropped", Decision: "dropped"},
+		{TraceID: "kept", Decision: "kept", Rate: 10, Reason: "rules/1"},
+		{TraceID: "missing", Decision: "unknown"},
+		{TraceID: "pending", Decision: "pending"},
+	}, resp.Decisions)
+}
+
+func TestGetTraceDecisionsTooMany(t *testing.T) {
+	router := &Router{
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Store:   &fakeDecisionStore{},
+	}
+
+	ids := make([]string, maxDecisionQueryTraceIDs+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("trace-%d", i)
+	}
+	body, err := json.Marshal(decisionQuery{TraceIDs: ids})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.getTraceDecisions(rr, httptest.NewRequest("POST", "/query/decisions", strings.NewReader(string(body))))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestGetTraceDecisionsBodyTooLarge(t *testing.T) {
+	router := &Router{
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Store:   &fakeDecisionStore{},
+	}
+
+	body := `{"trace_ids":["` + strings.Repeat("a", maxDecisionQueryBodySize) + `"]}`
+	rr := httptest.NewRecorder()
+	router.getTraceDecisions(rr, httptest.NewRequest("POST", "/query/decisions", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "larger than")
+}
@@ -0,0 +1,128 @@
+package route
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/inject"
+	"github.com/facebookgo/startstop"
+	"github.com/honeycombio/refinery/centralstore"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/collect/cache"
+	"github.com/honeycombio/refinery/collect/stressRelief"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/decisionexport"
+	"github.com/honeycombio/refinery/internal/dropaudit"
+	"github.com/honeycombio/refinery/internal/gossip"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/peer"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/redis"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TestProcessEventDuplicateSpan sends a span and a retried copy of it
+// through the router to a real collector. The router gives each copy a new
+// ID, so the collector has to recognize the copy by the span ID in its data.
+func TestProcessEventDuplicateSpan(t *testing.T) {
+	cfg := &config.MockConfig{
+		TraceIdFieldNames:  []string{"trace.trace_id"},
+		ParentIdFieldNames: []string{"trace.parent_id"},
+		SpanIdFieldNames:   []string{"trace.span_id"},
+		GetSamplerTypeVal:  &config.DeterministicSamplerConfig{SampleRate: 1},
+		SpanDedup:          config.SpanDedupConfig{Enabled: true, FilterBits: 8192},
+		StoreOptions: config.SmartWrapperOptions{
+			SpanChannelSize: 100,
+			StateTicker:     config.Duration(50 * time.Millisecond),
+			SendDelay:       config.Duration(time.Minute),
+			TraceTimeout:    config.Duration(time.Minute),
+			DecisionTimeout: config.Duration(time.Minute),
+		},
+		SampleCache: config.SampleCacheConfig{
+			KeptSize:          100,
+			DroppedSize:       100,
+			SizeCheckInterval: config.Duration(time.Second),
+		},
+		GetCollectionConfigVal: config.CollectionConfig{
+			IncomingQueueSize:    100,
+			DeciderBatchSize:     10,
+			SenderBatchSize:      10,
+			DeciderCycleDuration: config.Duration(50 * time.Millisecond),
+			SenderCycleDuration:  config.Duration(50 * time.Millisecond),
+			ShutdownDelay:        config.Duration(10 * time.Millisecond),
+			MemoryCycleDuration:  config.Duration(time.Second),
+		},
+		SendTickerVal:      50 * time.Millisecond,
+		GetTraceTimeoutVal: time.Minute,
+	}
+	collectorMetrics := &metrics.MockMetrics{}
+	collector := &collect.CentralCollector{}
+	g := inject.Graph{}
+	require.NoError(t, g.Provide(
+		&inject.Object{Value: "version", Name: "version"},
+		&inject.Object{Value: cfg},
+		&inject.Object{Value: &logger.NullLogger{}},
+		&inject.Object{Value: collectorMetrics, Name: "genericMetrics"},
+		&inject.Object{Value: trace.Tracer(noop.Tracer{}), Name: "tracer"},
+		&inject.Object{Value: &cache.CuckooSentCache{}},
+		&inject.Object{Value: &cache.SpanCache_basic{}},
+		&inject.Object{Value: &transmit.MockTransmission{}, Name: "upstreamTransmission"},
+		&inject.Object{Value: &peer.MockPeers{}},
+		&inject.Object{Value: &sample.SamplerFactory{Config: cfg, Logger: &logger.NullLogger{}}},
+		&inject.Object{Value: &redis.TestService{}, Name: "redis"},
+		&inject.Object{Value: clockwork.NewRealClock()},
+		&inject.Object{Value: &stressRelief.MockStressReliever{}, Name: "stressRelief"},
+		&inject.Object{Value: &centralstore.LocalStore{}},
+		&inject.Object{Value: &centralstore.SmartWrapper{}},
+		&inject.Object{Value: collector},
+		&inject.Object{Value: &health.Health{}},
+		&inject.Object{Value: &gossip.InMemoryGossip{}, Name: "gossip"},
+		&inject.Object{Value: &decisionexport.NullExporter{}},
+		&inject.Object{Value: &dropaudit.NullAuditor{}},
+		&inject.Object{Value: &types.RandomIDGenerator{}},
+		&inject.Object{Value: &clustercount.LocalCounter{}},
+		&inject.Object{Value: &apikeys.LocalCache{}},
+		&inject.Object{Value: http.DefaultTransport, Name: "upstreamTransport"},
+	))
+	require.NoError(t, g.Populate())
+	require.NoError(t, startstop.Start(g.Objects(), nil))
+	defer startstop.Stop(g.Objects(), nil)
+
+	router := &Router{
+		Config:           cfg,
+		Logger:           &logger.NullLogger{},
+		Metrics:          &metrics.NullMetrics{},
+		Collector:        collector,
+		iopLogger:        iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		environmentCache: newEnvironmentCache(time.Second, nil),
+	}
+	event := func(spanID string) *types.Event {
+		return &types.Event{Dataset: "ds", Data: map[string]interface{}{
+			"trace.trace_id":  "trace1",
+			"trace.parent_id": "root",
+			"trace.span_id":   spanID,
+			"name":            "query",
+		}}
+	}
+	require.NoError(t, router.processEvent(event("span1"), nil))
+	require.NoError(t, router.processEvent(event("span1"), nil))
+	require.NoError(t, router.processEvent(event("span2"), nil))
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		processed, _ := collectorMetrics.Get("span_processed")
+		assert.Equal(c, float64(3), processed)
+	}, 2*time.Second, 10*time.Millisecond)
+	dropped, _ := collectorMetrics.Get("span_duplicates_dropped")
+	assert.Equal(t, float64(1), dropped)
+}
@@ -0,0 +1,43 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/honeycombio/refinery/internal/drain"
+)
+
+// beginDrain handles POST /admin/drain. The node stops accepting new traces
+// and drains the ones it holds; if the optional exit query parameter is
+// true, Refinery exits once the drain is done.
+func (r *Router) beginDrain(w http.ResponseWriter, req *http.Request) {
+	var exit bool
+	if param := req.URL.Query().Get("exit"); param != "" {
+		var err error
+		exit, err = strconv.ParseBool(param)
+		if err != nil {
+			r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("invalid value '%s' for exit; must be true or false", param))
+			return
+		}
+	}
+	status, err := r.Drainer.Begin("admin", exit)
+	if errors.Is(err, drain.ErrDraining) {
+		r.handlerReturnWithError(w, ErrDrainInProgress, err)
+		return
+	}
+	r.marshalToFormat(w, status, "json")
+}
+
+// endDrain handles DELETE /admin/drain, which takes the node out of
+// maintenance mode so that it accepts traces again.
+func (r *Router) endDrain(w http.ResponseWriter, req *http.Request) {
+	r.Drainer.End()
+	r.marshalToFormat(w, r.Drainer.Status(), "json")
+}
+
+// drainStatus handles GET /admin/drain/status.
+func (r *Router) drainStatus(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.Drainer.Status(), "json")
+}
@@ -0,0 +1,76 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/drain"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainEndpoints(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	h := &health.Health{Clock: clock}
+	require.NoError(t, h.Start())
+	defer h.Stop()
+	cfg := &config.MockConfig{Drain: config.DrainConfig{Timeout: config.Duration(time.Minute), RetryAfter: config.Duration(45 * time.Second)}}
+	drainer := &drain.Drainer{
+		Config:    cfg,
+		Logger:    &logger.NullLogger{},
+		Metrics:   &metrics.NullMetrics{},
+		Clock:     clock,
+		Health:    h,
+		Collector: &collect.MockCollector{},
+	}
+	require.NoError(t, drainer.Start())
+	defer drainer.Stop()
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}, Drainer: drainer}
+	handler := router.ingestLimiter(&dummyHandler{})
+
+	rr := httptest.NewRecorder()
+	router.beginDrain(rr, httptest.NewRequest("POST", "/admin/drain?exit=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.beginDrain(rr, httptest.NewRequest("POST", "/admin/drain?exit=true", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status drain.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.True(t, status.Draining)
+	assert.True(t, status.ExitWhenDone)
+	assert.Equal(t, "admin", status.Trigger)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "45", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), "draining")
+
+	rr = httptest.NewRecorder()
+	router.beginDrain(rr, httptest.NewRequest("POST", "/admin/drain", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.drainStatus(rr, httptest.NewRequest("GET", "/admin/drain/status", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"draining":true`)
+
+	rr = httptest.NewRecorder()
+	router.endDrain(rr, httptest.NewRequest("DELETE", "/admin/drain", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"draining":false`)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/1/batch/dataset", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -37,6 +37,27 @@ var (
 	ErrReqToEvent          = handlerError{nil, "failed to parse event", http.StatusBadRequest, false, true}
 	ErrBatchToEvent        = handlerError{nil, "failed to parse event within batch", http.StatusBadRequest, false, true}
 	ErrInvalidContentType  = handlerError{nil, husky.ErrInvalidContentType.Message, husky.ErrInvalidContentType.HTTPStatusCode, false, true}
+	ErrIngestPaused        = handlerError{nil, "ingestion is paused - try again later", http.StatusServiceUnavailable, false, true}
+	ErrDraining            = handlerError{nil, "this node is draining for maintenance - try again later", http.StatusServiceUnavailable, false, true}
+	ErrDrainInProgress     = handlerError{nil, "this node is already draining", http.StatusConflict, true, true}
+	ErrTooManyRequests     = handlerError{nil, "too many concurrent requests - try again later", http.StatusTooManyRequests, false, true}
+	ErrOverloaded          = handlerError{nil, "refinery is overloaded - try again later", http.StatusTooManyRequests, false, true}
+	ErrBadAdminRequest     = handlerError{nil, "invalid admin request", http.StatusBadRequest, true, true}
+	ErrAdminBusy           = handlerError{nil, "another admin operation is in progress", http.StatusConflict, true, true}
+	ErrBadDecisionQuery    = handlerError{nil, "invalid decision query", http.StatusBadRequest, true, true}
+	ErrDecisionLookup      = handlerError{nil, "failed to look up trace decisions", http.StatusServiceUnavailable, false, true}
+	ErrBadSamplePreview    = handlerError{nil, "invalid sample preview", http.StatusBadRequest, true, true}
+	ErrBadSamplerKeysQuery = handlerError{nil, "invalid sampler keys query", http.StatusBadRequest, true, true}
+	ErrNoSamplerKeys       = handlerError{nil, "no sampler keys for dataset", http.StatusNotFound, true, true}
+	ErrKeyQuarantined      = handlerError{nil, "api key quarantined", http.StatusUnauthorized, true, true}
+	ErrDatadogDecode       = handlerError{nil, "failed to parse Datadog traces", http.StatusBadRequest, true, true}
+	ErrZipkinDecode        = handlerError{nil, "failed to parse zipkin spans", http.StatusBadRequest, true, true}
+	ErrFlagPublish         = handlerError{nil, "failed to publish feature flag override", http.StatusServiceUnavailable, false, true}
+	ErrStressPublish       = handlerError{nil, "failed to publish stress relief override", http.StatusServiceUnavailable, false, true}
+	ErrNoProfile           = handlerError{nil, "profile not found", http.StatusNotFound, true, true}
+	ErrNoLogLevels         = handlerError{nil, "the configured logger does not support log levels per subsystem", http.StatusNotImplemented, true, true}
+	ErrBadPeerCapabilities = handlerError{nil, "invalid peer capabilities", http.StatusBadRequest, true, true}
+	ErrPeerIncompatible    = handlerError{nil, "peer is incompatible", http.StatusConflict, true, true}
 )
 
 func (r *Router) handlerReturnWithError(w http.ResponseWriter, he handlerError, err error) {
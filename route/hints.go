@@ -0,0 +1,190 @@
+package route
+
+import (
+	"strings"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// applyTraceStateHints copies the configured vendor key's value from the
+// tracestate of each span into a span attribute, since the tracestate is
+// otherwise lost when spans are translated into events.
+func (r *Router) applyTraceStateHints(resourceSpans []*tracev1.ResourceSpans) {
+	r.applyOTelTraceState(resourceSpans)
+	cfg := r.Config.GetSamplingHintsConfig()
+	if cfg.TraceStateKey == "" || cfg.Field == "" {
+		return
+	}
+	for _, rs := range resourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				hint, ok := traceStateValue(span.TraceState, cfg.TraceStateKey)
+				if !ok || hasAttribute(span.Attributes, cfg.Field) {
+					continue
+				}
+				span.Attributes = append(span.Attributes, &common.KeyValue{
+					Key:   cfg.Field,
+					Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: hint}},
+				})
+				r.Metrics.Increment("incoming_router_sampling_hint")
+			}
+		}
+	}
+}
+
+// applyOTelTraceState copies the th and rv values of the ot entry of each
+// span's tracestate into span attributes when consistent sampling is
+// enabled, so that the collector can sample consistently with the head
+// sampler that set them.
+func (r *Router) applyOTelTraceState(resourceSpans []*tracev1.ResourceSpans) {
+	if !r.Config.GetConsistentSamplingConfig().Enabled {
+		return
+	}
+	for _, rs := range resourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				ot, ok := traceStateValue(span.TraceState, "ot")
+				if !ok {
+					continue
+				}
+				for _, sub := range []struct{ key, field string }{
+					{"th", sample.OTelThresholdField},
+					{"rv", sample.OTelRandomnessField},
+				} {
+					value, ok := otTraceStateValue(ot, sub.key)
+					if !ok || hasAttribute(span.Attributes, sub.field) {
+						continue
+					}
+					span.Attributes = append(span.Attributes, &common.KeyValue{
+						Key:   sub.field,
+						Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: value}},
+					})
+				}
+			}
+		}
+	}
+}
+
+// applyScopedAttributes records the resource, scope and span attributes that
+// rules name with their scope in fields of their own on each span, since
+// they're flattened into one set of fields in which they can collide when
+// spans are translated into events.
+func (r *Router) applyScopedAttributes(resourceSpans []*tracev1.ResourceSpans) {
+	scoped := r.Config.GetScopedAttributes()
+	if len(scoped) == 0 {
+		return
+	}
+	for _, rs := range resourceSpans {
+		var resourceAttrs []*common.KeyValue
+		if rs.Resource != nil {
+			resourceAttrs = scopedAttributes(config.ResourceScope, scoped, rs.Resource.Attributes)
+		}
+		for _, ss := range rs.ScopeSpans {
+			var scopeAttrs []*common.KeyValue
+			if ss.Scope != nil {
+				attrs := ss.Scope.Attributes
+				for _, kv := range []struct{ key, value string }{
+					{"name", ss.Scope.Name},
+					{"version", ss.Scope.Version},
+				} {
+					if kv.value != "" && !hasAttribute(attrs, kv.key) {
+						attrs = append(attrs, &common.KeyValue{
+							Key:   kv.key,
+							Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: kv.value}},
+						})
+					}
+				}
+				scopeAttrs = scopedAttributes(config.ScopeScope, scoped, attrs)
+			}
+			for _, span := range ss.Spans {
+				spanAttrs := scopedAttributes(config.SpanScope, scoped, span.Attributes)
+				span.Attributes = append(span.Attributes, resourceAttrs...)
+				span.Attributes = append(span.Attributes, scopeAttrs...)
+				span.Attributes = append(span.Attributes, spanAttrs...)
+				span.Attributes = append(span.Attributes, &common.KeyValue{
+					Key:   config.ScopedAttributesMarker,
+					Value: &common.AnyValue{Value: &common.AnyValue_BoolValue{BoolValue: true}},
+				})
+			}
+		}
+	}
+}
+
+// scopedAttributes returns the attributes of a scope that rules name, keyed
+// by the fields they're recorded in.
+func scopedAttributes(scope string, scoped map[string][]string, attrs []*common.KeyValue) []*common.KeyValue {
+	var recorded []*common.KeyValue
+	for _, name := range scoped[scope] {
+		for _, kv := range attrs {
+			if kv.Key == name {
+				recorded = append(recorded, &common.KeyValue{
+					Key:   config.ScopedAttributeField(scope, name),
+					Value: kv.Value,
+				})
+				break
+			}
+		}
+	}
+	return recorded
+}
+
+// applyAttributeHints copies the first of the configured hint attributes that
+// an event has into the hint field, unless it's already set.
+func (r *Router) applyAttributeHints(ev *types.Event) {
+	cfg := r.Config.GetSamplingHintsConfig()
+	if cfg.Field == "" || len(cfg.Attributes) == 0 {
+		return
+	}
+	if _, ok := ev.Data[cfg.Field]; ok {
+		return
+	}
+	for _, attr := range cfg.Attributes {
+		if hint, ok := ev.Data[attr]; ok {
+			ev.Data[cfg.Field] = hint
+			r.Metrics.Increment("incoming_router_sampling_hint")
+			return
+		}
+	}
+}
+
+// traceStateValue returns the value of a vendor key in a W3C tracestate
+// header, which is a comma-separated list of key=value pairs.
+func traceStateValue(traceState string, key string) (string, bool) {
+	for traceState != "" {
+		var member string
+		member, traceState, _ = strings.Cut(traceState, ",")
+		k, v, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// otTraceStateValue returns the value of a sub-key of the OpenTelemetry ot
+// entry of a tracestate, which is a semicolon-separated list of key:value
+// pairs.
+func otTraceStateValue(ot string, key string) (string, bool) {
+	for ot != "" {
+		var member string
+		member, ot, _ = strings.Cut(ot, ";")
+		k, v, ok := strings.Cut(member, ":")
+		if ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func hasAttribute(attrs []*common.KeyValue, key string) bool {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	trace "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTraceStateValue(t *testing.T) {
+	tests := []struct {
+		traceState string
+		want       string
+		found      bool
+	}{
+		{"", "", false},
+		{"hny=keep", "keep", true},
+		{"congo=t61rcWkgMzE, hny=keep,rojo=00f067aa0ba902b7", "keep", true},
+		{"congo=t61rcWkgMzE", "", false},
+		{"hnyx=keep", "", false},
+		{"hny=", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.traceState, func(t *testing.T) {
+			got, found := traceStateValue(tt.traceState, "hny")
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.found, found)
+		})
+	}
+}
+
+func newHintsTestRouter(collector *collect.MockCollector) *Router {
+	decoders, _ := makeDecoders(1)
+	mockTransmission := &transmit.MockTransmission{}
+	mockTransmission.Start()
+	return &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:  []string{"trace.trace_id"},
+			ParentIdFieldNames: []string{"trace.parent_id"},
+			SamplingHints: config.SamplingHintsConfig{
+				Field:         "sampling.hint",
+				TraceStateKey: "hny",
+				Attributes:    []string{"sampling.priority"},
+			},
+		},
+		Logger:               &logger.NullLogger{},
+		Metrics:              &metrics.NullMetrics{},
+		Collector:            collector,
+		UpstreamTransmission: mockTransmission,
+		iopLogger:            iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		zstdDecoders:         decoders,
+		environmentCache:     newEnvironmentCache(time.Second, nil),
+	}
+}
+
+func hintsTestRequest() *collectortrace.ExportTraceServiceRequest {
+	return &collectortrace.ExportTraceServiceRequest{
+		ResourceSpans: []*trace.ResourceSpans{{
+			ScopeSpans: []*trace.ScopeSpans{{
+				Spans: []*trace.Span{
+					{TraceId: []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, SpanId: []byte{1, 1, 1, 1, 1, 1, 1, 1}, TraceState: "other=x,hny=keep"},
+					{TraceId: []byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}, SpanId: []byte{2, 2, 2, 2, 2, 2, 2, 2}, TraceState: "other=x"},
+					{
+						TraceId:    []byte{3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
+						SpanId:     []byte{3, 3, 3, 3, 3, 3, 3, 3},
+						TraceState: "hny=keep",
+						Attributes: []*common.KeyValue{{
+							Key: "sampling.priority", Value: &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: 1}},
+						}, {
+							Key: "sampling.hint", Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: "explicit"}},
+						}},
+					},
+				},
+			}},
+		}},
+	}
+}
+
+func TestTraceStateHintsGRPC(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newHintsTestRouter(collector)
+
+	md := metadata.New(map[string]string{"x-honeycomb-team": legacyAPIKey, "x-honeycomb-dataset": "ds"})
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	_, err := NewTraceServer(router).Export(ctx, hintsTestRequest())
+	require.NoError(t, err)
+
+	require.Len(t, collector.Spans, 3)
+	assert.Equal(t, "keep", collector.Spans[0].Data["sampling.hint"])
+	assert.NotContains(t, collector.Spans[1].Data, "sampling.hint")
+	// an explicit attribute wins over the tracestate
+	assert.Equal(t, "explicit", collector.Spans[2].Data["sampling.hint"])
+}
+
+func TestTraceStateHintsHTTP(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newHintsTestRouter(collector)
+
+	body, err := proto.Marshal(hintsTestRequest())
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(body))
+	req.Header.Set("content-type", "application/protobuf")
+	req.Header.Set("x-honeycomb-team", legacyAPIKey)
+	req.Header.Set("x-honeycomb-dataset", "ds")
+	rr := httptest.NewRecorder()
+	router.postOTLP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	require.Len(t, collector.Spans, 3)
+	assert.Equal(t, "keep", collector.Spans[0].Data["sampling.hint"])
+	assert.NotContains(t, collector.Spans[1].Data, "sampling.hint")
+}
+
+func TestAttributeHints(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newHintsTestRouter(collector)
+
+	events := []*types.Event{
+		{Data: map[string]interface{}{"trace.trace_id": "1", "sampling.priority": 1}},
+		{Data: map[string]interface{}{"trace.trace_id": "2", "sampling.priority": 1, "sampling.hint": "drop"}},
+		{Data: map[string]interface{}{"trace.trace_id": "3"}},
+	}
+	for _, ev := range events {
+		require.NoError(t, router.processEvent(ev, nil))
+	}
+
+	require.Len(t, collector.Spans, 3)
+	assert.Equal(t, 1, collector.Spans[0].Data["sampling.hint"])
+	assert.Equal(t, "drop", collector.Spans[1].Data["sampling.hint"])
+	assert.NotContains(t, collector.Spans[2].Data, "sampling.hint")
+}
+
+func TestOTelTraceState(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newHintsTestRouter(collector)
+	router.Config.(*config.MockConfig).ConsistentSampling = config.ConsistentSamplingConfig{Enabled: true}
+
+	req := hintsTestRequest()
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	spans[0].TraceState = "ot=th:c;rv:0123456789abcd,hny=keep"
+	spans[1].TraceState = "other=x,ot=th:8"
+
+	md := metadata.New(map[string]string{"x-honeycomb-team": legacyAPIKey, "x-honeycomb-dataset": "ds"})
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	_, err := NewTraceServer(router).Export(ctx, req)
+	require.NoError(t, err)
+
+	require.Len(t, collector.Spans, 3)
+	assert.Equal(t, "c", collector.Spans[0].Data[sample.OTelThresholdField])
+	assert.Equal(t, "0123456789abcd", collector.Spans[0].Data[sample.OTelRandomnessField])
+	assert.Equal(t, "keep", collector.Spans[0].Data["sampling.hint"])
+	assert.Equal(t, "8", collector.Spans[1].Data[sample.OTelThresholdField])
+	assert.NotContains(t, collector.Spans[1].Data, sample.OTelRandomnessField)
+	assert.NotContains(t, collector.Spans[2].Data, sample.OTelThresholdField)
+}
+
+func TestScopedAttributes(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newHintsTestRouter(collector)
+	router.Config.(*config.MockConfig).ScopedAttributes = map[string][]string{
+		config.ResourceScope: {"service.name"},
+		config.ScopeScope:    {"name"},
+		config.SpanScope:     {"service.name", "http.route"},
+	}
+
+	str := func(s string) *common.AnyValue {
+		return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: s}}
+	}
+	req := hintsTestRequest()
+	req.ResourceSpans[0].Resource = &resource.Resource{
+		Attributes: []*common.KeyValue{{Key: "service.name", Value: str("api")}},
+	}
+	req.ResourceSpans[0].ScopeSpans[0].Scope = &common.InstrumentationScope{Name: "db", Version: "1.0"}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	spans[0].Attributes = append(spans[0].Attributes, &common.KeyValue{Key: "service.name", Value: str("peer")})
+
+	md := metadata.New(map[string]string{"x-honeycomb-team": legacyAPIKey, "x-honeycomb-dataset": "ds"})
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	_, err := NewTraceServer(router).Export(ctx, req)
+	require.NoError(t, err)
+
+	require.Len(t, collector.Spans, 3)
+	// the span's attribute wins the flattened field, but both are recorded
+	assert.Equal(t, "peer", collector.Spans[0].Data["service.name"])
+	assert.Equal(t, "api", collector.Spans[0].Data["meta.refinery.resource.service.name"])
+	assert.Equal(t, "peer", collector.Spans[0].Data["meta.refinery.span.service.name"])
+	assert.Equal(t, "db", collector.Spans[0].Data["meta.refinery.scope.name"])
+	assert.Equal(t, true, collector.Spans[0].Data[config.ScopedAttributesMarker])
+
+	assert.Equal(t, "api", collector.Spans[1].Data["service.name"])
+	assert.Equal(t, "api", collector.Spans[1].Data["meta.refinery.resource.service.name"])
+	assert.NotContains(t, collector.Spans[1].Data, "meta.refinery.span.service.name")
+	assert.NotContains(t, collector.Spans[1].Data, "meta.refinery.span.http.route")
+	assert.NotContains(t, collector.Spans[1].Data, "meta.refinery.scope.version")
+	assert.Equal(t, true, collector.Spans[1].Data[config.ScopedAttributesMarker])
+}
@@ -0,0 +1,32 @@
+package route
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 applies the HTTP/2 settings to the ingest server. With TLS,
+// HTTP/2 is negotiated with ALPN; without it, the handler is wrapped to also
+// accept plaintext HTTP/2 if h2c is allowed.
+func (r *Router) configureHTTP2(server *http.Server, useTLS bool) error {
+	cfg := r.Config.GetHTTP2Config()
+	if !cfg.Enabled {
+		return nil
+	}
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams: cfg.MaxConcurrentStreams,
+		MaxReadFrameSize:     uint32(cfg.MaxReadFrameSize),
+		IdleTimeout:          server.IdleTimeout,
+	}
+	if useTLS {
+		return http2.ConfigureServer(server, h2)
+	}
+	if cfg.AllowH2C {
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+		r.iopLogger.Info().Logf("accepting plaintext HTTP/2 (h2c)")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package route
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestH2C(t *testing.T) {
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	for _, allow := range []bool{true, false} {
+		t.Run(fmt.Sprint(allow), func(t *testing.T) {
+			router := &Router{
+				Config: &config.MockConfig{HTTP2: config.HTTP2Config{
+					Enabled:              true,
+					AllowH2C:             allow,
+					MaxConcurrentStreams: 10,
+					MaxReadFrameSize:     1 << 20,
+				}},
+				iopLogger: iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+			}
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprint(w, req.Proto)
+			})}
+			require.NoError(t, router.configureHTTP2(server, false))
+
+			ts := httptest.NewServer(server.Handler)
+			defer ts.Close()
+
+			resp, err := h2cClient.Get(ts.URL)
+			if !allow {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, 2, resp.ProtoMajor)
+
+			// HTTP/1.1 clients still work
+			resp, err = http.Get(ts.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, 1, resp.ProtoMajor)
+		})
+	}
+}
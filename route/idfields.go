@@ -0,0 +1,68 @@
+package route
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/honeycombio/refinery/logger"
+)
+
+// idTransforms caches the compiled ID transform patterns from the config.
+// Patterns that fail to compile are cached as nil, so that the error is only
+// logged once.
+type idTransforms struct {
+	lock     sync.RWMutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (t *idTransforms) get(pattern string, lgr logger.Logger) *regexp.Regexp {
+	t.lock.RLock()
+	re, ok := t.patterns[pattern]
+	t.lock.RUnlock()
+	if ok {
+		return re
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		lgr.Error().WithString("pattern", pattern).Logf("invalid ID field transform, ignoring it: %s", err)
+		re = nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.patterns == nil {
+		t.patterns = make(map[string]*regexp.Regexp)
+	}
+	t.patterns[pattern] = re
+	return re
+}
+
+// extractID returns the ID found in the first of the named fields that has
+// one, and the name of that field. If there is a transform, a field only has
+// an ID if its value matches the transform, and the ID is the first capture
+// group, or the whole match if there are no groups.
+func (r *Router) extractID(data map[string]interface{}, names []string, transform string) (id string, field string) {
+	var re *regexp.Regexp
+	if transform != "" {
+		re = r.idTransforms.get(transform, r.Logger)
+	}
+	for _, name := range names {
+		value, ok := data[name].(string)
+		if !ok {
+			continue
+		}
+		if re == nil {
+			return value, name
+		}
+		match := re.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			continue
+		case len(match) > 1:
+			return match[1], name
+		default:
+			return match[0], name
+		}
+	}
+	return "", ""
+}
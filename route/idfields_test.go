@@ -0,0 +1,98 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractID(t *testing.T) {
+	router := &Router{Logger: &logger.NullLogger{}}
+	data := map[string]interface{}{
+		"request_id": "req-abc123",
+		"legacy_id":  "abc",
+		"numeric":    12,
+	}
+
+	id, field := router.extractID(data, []string{"missing", "legacy_id", "request_id"}, "")
+	assert.Equal(t, "abc", id)
+	assert.Equal(t, "legacy_id", field)
+
+	// values that don't match the transform are skipped
+	id, field = router.extractID(data, []string{"legacy_id", "request_id"}, "^req-(.+)$")
+	assert.Equal(t, "abc123", id)
+	assert.Equal(t, "request_id", field)
+
+	// without a capture group, the whole match is the ID
+	id, _ = router.extractID(data, []string{"request_id"}, "[0-9]+")
+	assert.Equal(t, "123", id)
+
+	// non-string values are not IDs
+	id, _ = router.extractID(data, []string{"numeric"}, "")
+	assert.Equal(t, "", id)
+
+	// an invalid pattern is ignored
+	id, _ = router.extractID(data, []string{"request_id"}, "(")
+	assert.Equal(t, "req-abc123", id)
+}
+
+func TestProcessEventDatasetIDRules(t *testing.T) {
+	collector := &collect.MockCollector{}
+	mockTransmission := &transmit.MockTransmission{}
+	mockTransmission.Start()
+	router := &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:  []string{"trace.trace_id"},
+			ParentIdFieldNames: []string{"trace.parent_id"},
+			IDFieldRules: map[string]config.IDFieldRules{
+				"legacy": {
+					TraceNames:      []string{"request_id", "trace.trace_id"},
+					ParentNames:     []string{"caller_id"},
+					TraceTransform:  "^req-(.+)$",
+					ParentTransform: "^[0-9a-f]+$",
+				},
+			},
+		},
+		Logger:               &logger.NullLogger{},
+		Metrics:              &metrics.NullMetrics{},
+		Collector:            collector,
+		UpstreamTransmission: mockTransmission,
+		iopLogger:            iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		environmentCache:     newEnvironmentCache(time.Second, nil),
+	}
+
+	events := []*types.Event{
+		{Dataset: "legacy", Data: map[string]interface{}{"request_id": "req-1", "caller_id": "none"}},
+		{Dataset: "legacy", Data: map[string]interface{}{"request_id": "req-1", "caller_id": "beef"}},
+		{Dataset: "legacy", Data: map[string]interface{}{"request_id": "unrelated", "trace.trace_id": "req-2"}},
+		// other datasets use the global field names
+		{Dataset: "modern", Data: map[string]interface{}{"request_id": "req-3", "trace.trace_id": "3", "trace.parent_id": "p"}},
+		{Dataset: "modern", Data: map[string]interface{}{"request_id": "req-4"}},
+	}
+	for _, ev := range events {
+		require.NoError(t, router.processEvent(ev, nil))
+	}
+
+	require.Len(t, collector.Spans, 4)
+	assert.Equal(t, "1", collector.Spans[0].TraceID)
+	assert.True(t, collector.Spans[0].IsRoot, "a parent ID that doesn't match the transform is not a parent ID")
+	assert.Equal(t, "1", collector.Spans[0].Data["request_id"], "the transformed ID is written back")
+	assert.Equal(t, "1", collector.Spans[1].TraceID)
+	assert.False(t, collector.Spans[1].IsRoot)
+	assert.Equal(t, "2", collector.Spans[2].TraceID)
+	assert.Equal(t, "unrelated", collector.Spans[2].Data["request_id"])
+	assert.Equal(t, "3", collector.Spans[3].TraceID)
+	assert.False(t, collector.Spans[3].IsRoot)
+	assert.Equal(t, "req-3", collector.Spans[3].Data["request_id"])
+
+	// the event without a trace ID went straight upstream
+	assert.Len(t, mockTransmission.Events, 1)
+}
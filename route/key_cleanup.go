@@ -0,0 +1,111 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/refinery/centralstore"
+)
+
+// cleanupRedisKeys handles POST /admin/redis/cleanup, which deletes the
+// per-trace keys in Redis that haven't been touched for at least min_idle.
+// The class parameter is a comma-separated list of key classes, and defaults
+// to all of them. Nothing is deleted unless dry_run=false is given. Progress
+// is streamed as one JSON object per line, one per batch of keys.
+func (r *Router) cleanupRedisKeys(w http.ResponseWriter, req *http.Request) {
+	cleaner, ok := r.Store.(centralstore.KeyCleaner)
+	if !ok {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, centralstore.ErrKeyCleanupUnsupported)
+		return
+	}
+
+	query := req.URL.Query()
+	opts := centralstore.KeyCleanupOptions{
+		Classes: centralstore.KeyClasses(),
+		DryRun:  query.Get("dry_run") != "false",
+	}
+	if classes := query.Get("class"); classes != "" {
+		opts.Classes = strings.Split(classes, ",")
+		for _, class := range opts.Classes {
+			if !slices.Contains(centralstore.KeyClasses(), class) {
+				r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("unknown key class '%s'; must be one of %v", class, centralstore.KeyClasses()))
+				return
+			}
+		}
+	}
+	minIdle, err := time.ParseDuration(query.Get("min_idle"))
+	if leastIdle := r.minKeyCleanupIdle(); err != nil || minIdle < leastIdle {
+		r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("min_idle must be a duration of at least %s", leastIdle))
+		return
+	}
+	opts.MinIdle = minIdle
+	if batchSize := query.Get("batch_size"); batchSize != "" {
+		opts.BatchSize, err = strconv.Atoi(batchSize)
+		if err != nil || opts.BatchSize <= 0 {
+			r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("invalid batch_size '%s'", batchSize))
+			return
+		}
+	}
+
+	if !r.keyCleanupRunning.CompareAndSwap(false, true) {
+		r.handlerReturnWithError(w, ErrAdminBusy, errors.New("a redis key cleanup is already running"))
+		return
+	}
+	defer r.keyCleanupRunning.Store(false)
+
+	logger := r.Logger.Info().WithFields(map[string]interface{}{
+		"classes":  strings.Join(opts.Classes, ","),
+		"min_idle": opts.MinIdle.String(),
+		"dry_run":  opts.DryRun,
+	})
+	logger.Logf("redis key cleanup started by admin request")
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	progress := func(p centralstore.KeyCleanupProgress) {
+		enc.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	total, err := cleaner.CleanupKeys(req.Context(), opts, progress)
+	if err != nil {
+		// the response has already started, so the error goes in the stream
+		enc.Encode(map[string]string{"error": err.Error()})
+		r.Logger.Error().WithField("err", err.Error()).Logf("redis key cleanup failed")
+		return
+	}
+	enc.Encode(total)
+	logger.WithFields(map[string]interface{}{
+		"scanned": total.Scanned,
+		"matched": total.Matched,
+		"deleted": total.Deleted,
+	}).Logf("redis key cleanup finished")
+}
+
+// minKeyCleanupIdle returns the shortest min_idle a cleanup may use, which
+// keeps it from deleting the state of traces that are still in flight. A
+// trace can wait for its trace timeout for its root span, then for its send
+// delay (or, with the quiet period trigger, up to its trace timeout again)
+// before it's ready, and then for the decision timeout. Targets with
+// collection overrides can wait longer, so the longest of each is used.
+func (r *Router) minKeyCleanupIdle() time.Duration {
+	opts := r.Config.GetCentralStoreOptions()
+	traceTimeout, sendDelay := time.Duration(opts.TraceTimeout), time.Duration(opts.SendDelay)
+	for _, override := range r.Config.GetCollectionOverrides() {
+		traceTimeout = max(traceTimeout, time.Duration(override.TraceTimeout))
+		sendDelay = max(sendDelay, time.Duration(override.SendDelay))
+	}
+	if opts.DecisionTrigger == "quiet_period" {
+		sendDelay = max(sendDelay, traceTimeout)
+	}
+	return traceTimeout + sendDelay + time.Duration(opts.DecisionTimeout)
+}
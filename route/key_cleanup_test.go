@@ -0,0 +1,95 @@
+package route
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/centralstore"
+	"github.com/honeycombio/refinery/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeKeyCleaner struct {
+	centralstore.SmartStorer
+	opts centralstore.KeyCleanupOptions
+}
+
+func (f *fakeKeyCleaner) CleanupKeys(ctx context.Context, opts centralstore.KeyCleanupOptions, progress func(centralstore.KeyCleanupProgress)) (centralstore.KeyCleanupProgress, error) {
+	f.opts = opts
+	progress(centralstore.KeyCleanupProgress{Class: "spans", Scanned: 10, Matched: 4, DryRun: opts.DryRun})
+	return centralstore.KeyCleanupProgress{Scanned: 10, Matched: 4, DryRun: opts.DryRun, Done: true}, nil
+}
+
+func TestCleanupRedisKeys(t *testing.T) {
+	router := newAdminTestRouter(0)
+	cfg := router.Config.(*config.MockConfig)
+	cfg.StoreOptions = config.SmartWrapperOptions{
+		TraceTimeout:    config.Duration(time.Minute),
+		SendDelay:       config.Duration(2 * time.Second),
+		DecisionTimeout: config.Duration(3 * time.Second),
+	}
+	// the slowest target sets the least idle time
+	cfg.CollectionOverrides = map[string]config.CollectionOverride{
+		"slow": {TraceTimeout: config.Duration(10 * time.Minute)},
+	}
+	cleaner := &fakeKeyCleaner{}
+	router.Store = cleaner
+
+	rr := httptest.NewRecorder()
+	router.cleanupRedisKeys(rr, httptest.NewRequest("POST", "/admin/redis/cleanup?min_idle=2h", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, centralstore.KeyCleanupOptions{
+		Classes: centralstore.KeyClasses(),
+		MinIdle: 2 * time.Hour,
+		DryRun:  true,
+	}, cleaner.opts)
+
+	var lines []centralstore.KeyCleanupProgress
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var p centralstore.KeyCleanupProgress
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &p))
+		lines = append(lines, p)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, "spans", lines[0].Class)
+	assert.True(t, lines[1].Done)
+	assert.Equal(t, 4, lines[1].Matched)
+
+	rr = httptest.NewRecorder()
+	router.cleanupRedisKeys(rr, httptest.NewRequest("POST", "/admin/redis/cleanup?min_idle=1h&class=status&dry_run=false&batch_size=50", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, centralstore.KeyCleanupOptions{
+		Classes:   []string{"status"},
+		MinIdle:   time.Hour,
+		BatchSize: 50,
+	}, cleaner.opts)
+
+	rr = httptest.NewRecorder()
+	router.cleanupRedisKeys(rr, httptest.NewRequest("POST", "/admin/redis/cleanup?min_idle=10m", nil))
+	assert.Contains(t, rr.Body.String(), "at least 10m5s")
+
+	for _, query := range []string{"", "min_idle=10s", "min_idle=10m", "min_idle=1h&class=everything", "min_idle=1h&batch_size=0"} {
+		rr = httptest.NewRecorder()
+		router.cleanupRedisKeys(rr, httptest.NewRequest("POST", "/admin/redis/cleanup?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+
+	router.keyCleanupRunning.Store(true)
+	rr = httptest.NewRecorder()
+	router.cleanupRedisKeys(rr, httptest.NewRequest("POST", "/admin/redis/cleanup?min_idle=1h", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestCleanupRedisKeysUnsupported(t *testing.T) {
+	router := newAdminTestRouter(0)
+	rr := httptest.NewRecorder()
+	router.cleanupRedisKeys(rr, httptest.NewRequest("POST", "/admin/redis/cleanup?min_idle=1h", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	husky "github.com/honeycombio/husky/otlp"
 	"github.com/honeycombio/refinery/types"
 )
 
@@ -33,7 +37,7 @@ func (r *Router) queryTokenChecker(next http.Handler) http.Handler {
 			return
 		}
 
-		err := fmt.Errorf("token %s found in %s not authorized for query", token, types.QueryTokenHeader)
+		err := fmt.Errorf("token %s found in %s not authorized for query", r.redactKey(token), types.QueryTokenHeader)
 		r.handlerReturnWithError(w, ErrAuthNeeded, err)
 	})
 }
@@ -49,15 +53,104 @@ func (r *Router) apiKeyChecker(next http.Handler) http.Handler {
 			r.handlerReturnWithError(w, ErrAuthNeeded, err)
 			return
 		}
-		if r.Config.IsAPIKeyValid(apiKey) {
+		if err := r.quarantineError(apiKey); err != nil {
+			r.Metrics.Increment("incoming_router_quarantined")
+			r.handlerReturnWithError(w, ErrKeyQuarantined, err)
+			return
+		}
+		if r.isAPIKeyAccepted(req.Context(), apiKey) {
 			next.ServeHTTP(w, req)
 			return
 		}
-		err := fmt.Errorf("api key %s not found in list of authorized keys", apiKey)
+		err := fmt.Errorf("api key %s not found in list of authorized keys", r.redactKey(apiKey))
 		r.handlerReturnWithError(w, ErrAuthNeeded, err)
 	})
 }
 
+// fallbackAPIKey supplies a configured API key to requests that don't carry
+// one, for clients such as the X-Ray and Datadog tracers that have no way to
+// send it.
+func (r *Router) fallbackAPIKey(getKey func() string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(types.APIKeyHeader) == "" && req.Header.Get(types.APIKeyHeaderShort) == "" {
+				if apiKey := getKey(); apiKey != "" {
+					req.Header.Set(types.APIKeyHeader, apiKey)
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// ingestLimiter rejects ingest requests while ingestion is paused or the
+// collector is overloaded, and sheds requests beyond the listener's
+// concurrency limit so that clients retry instead of piling up in memory.
+func (r *Router) ingestLimiter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.Drainer.Draining() {
+			r.Metrics.Increment("incoming_router_draining")
+			retryAfter := int(math.Ceil(time.Duration(r.Config.GetDrainConfig().RetryAfter).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			r.rejectIngest(w, req, ErrDraining)
+			return
+		}
+		if r.ingestPause.isPaused() {
+			r.Metrics.Increment("incoming_router_paused")
+			w.Header().Set("Retry-After", "30")
+			r.rejectIngest(w, req, ErrIngestPaused)
+			return
+		}
+		if reason := r.admissionRejection(); reason != "" {
+			r.Metrics.Increment("incoming_router_rejected_" + reason)
+			retryAfter := int(math.Ceil(r.Config.GetAdmissionRetryAfter().Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			r.rejectIngest(w, req, ErrOverloaded)
+			return
+		}
+		if r.inflight != nil {
+			select {
+			case r.inflight <- struct{}{}:
+				defer func() { <-r.inflight }()
+			default:
+				r.Metrics.Increment("incoming_router_throttled")
+				r.rejectIngest(w, req, ErrTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// admissionRejection returns the reason new ingest requests should be turned
+// away, if the collector's queue or memory use is over its threshold, or ""
+// if they should be accepted.
+func (r *Router) admissionRejection() string {
+	queueThreshold := r.Config.GetAdmissionQueueThreshold()
+	memoryThreshold := r.Config.GetAdmissionMemoryThreshold()
+	if queueThreshold <= 0 && memoryThreshold <= 0 {
+		return ""
+	}
+	queue, memory := r.Collector.Saturation()
+	if queueThreshold > 0 && queue*100 >= float64(queueThreshold) {
+		return "queue_full"
+	}
+	if memoryThreshold > 0 && memory*100 >= float64(memoryThreshold) {
+		return "memory_full"
+	}
+	return ""
+}
+
+// rejectIngest responds with an OTLP-formatted error for OTLP requests so
+// that exporters can interpret it, and the usual JSON error otherwise.
+func (r *Router) rejectIngest(w http.ResponseWriter, req *http.Request, he handlerError) {
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		r.handleOTLPFailureResponse(w, req, husky.OTLPError{Message: he.msg, HTTPStatusCode: he.status})
+		return
+	}
+	r.handlerReturnWithError(w, he, errors.New(he.msg))
+}
+
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
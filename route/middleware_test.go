@@ -5,10 +5,16 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
 	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type dummyHandler struct{}
@@ -31,6 +37,7 @@ func TestRouter_queryTokenChecker(t *testing.T) {
 		{"req_empty", "foo", "", 400, "not authorized for query", "good"},
 		{"correct", "testtoken", "testtoken", 200, "good", "authorized"},
 		{"incorrect", "testtoken", "wrongtoken", 400, "not authorized for query", "good"},
+		{"incorrect_redacted", "testtoken", "wrongtoken", 400, "hmac:", "wrongtoken"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -72,3 +79,42 @@ func TestRouter_queryTokenChecker(t *testing.T) {
 		})
 	}
 }
+
+func TestRouter_apiKeyCheckerRedactsKeys(t *testing.T) {
+	const rejected = "rejected0123456789abcd"
+	const quarantined = "quarantined0123456789a"
+	cfg := &config.MockConfig{
+		IsAPIKeyValidFunc: func(k string) bool { return k == quarantined },
+		AccessKeys: config.AccessKeyConfig{
+			QuarantineThreshold: 1,
+			QuarantineDuration:  config.Duration(time.Minute),
+		},
+	}
+	quarantine := &apikeys.Quarantine{
+		Config:  cfg,
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Clock:   clockwork.NewRealClock(),
+	}
+	require.NoError(t, quarantine.Start())
+	quarantine.RecordRejection(quarantined)
+	router := &Router{
+		Logger:        &logger.NullLogger{},
+		Metrics:       &metrics.NullMetrics{},
+		Config:        cfg,
+		KeyQuarantine: quarantine,
+	}
+
+	for _, key := range []string{rejected, quarantined} {
+		t.Run(key, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/1/events/dataset", nil)
+			req.Header.Set(types.APIKeyHeader, key)
+			rr := httptest.NewRecorder()
+			router.apiKeyChecker(&dummyHandler{}).ServeHTTP(rr, req)
+
+			assert.NotEqual(t, http.StatusOK, rr.Code)
+			assert.Contains(t, rr.Body.String(), "hmac:")
+			assert.NotContains(t, rr.Body.String(), key)
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package route
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	huskyotlp "github.com/honeycombio/husky/otlp"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/types"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// resourceSpansField is the field number of resource_spans in
+// ExportTraceServiceRequest.
+const resourceSpansField = 1
+
+// shouldStreamOTLP reports whether an OTLP/HTTP request is large enough, or
+// of unknown size, that it should be decoded incrementally. Only protobuf
+// bodies can be streamed.
+func (r *Router) shouldStreamOTLP(req *http.Request, ri huskyotlp.RequestInfo) bool {
+	threshold := r.Config.GetOTLPStreamingThreshold()
+	if threshold <= 0 {
+		return false
+	}
+	switch ri.ContentType {
+	case "application/protobuf", "application/x-protobuf":
+	default:
+		return false
+	}
+	return req.ContentLength < 0 || req.ContentLength > int64(threshold)
+}
+
+// processOTLPTraceStream decodes a protobuf ExportTraceServiceRequest one
+// ResourceSpans at a time and sends each resource's spans on before reading
+// the next, so that only one resource is held in memory at once. If the
+// collector can't keep up, it waits for it, which in turn slows down the
+// sender.
+func (r *Router) processOTLPTraceStream(ctx context.Context, body io.Reader, ri huskyotlp.RequestInfo) (spanRejections, error) {
+	var rejected spanRejections
+	body, done, err := r.decompressOTLPBody(body, ri.ContentEncoding)
+	if err != nil {
+		return rejected, err
+	}
+	defer done()
+
+	// get environment name - will be empty for legacy keys
+	environment, err := r.getEnvironmentName(ri.ApiKey)
+	if err != nil {
+		return rejected, err
+	}
+
+	br := bufio.NewReader(body)
+	for {
+		tag, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return rejected, nil
+		}
+		if err != nil {
+			return rejected, err
+		}
+		num, typ := protowire.DecodeTag(tag)
+		if num != resourceSpansField || typ != protowire.BytesType {
+			if err := skipProtoField(br, typ); err != nil {
+				return rejected, err
+			}
+			continue
+		}
+
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return rejected, unexpectedEOF(err)
+		}
+		// read rather than allocating up front, so a bogus length can't make
+		// us allocate more than the sender actually sends
+		buf, err := io.ReadAll(io.LimitReader(br, int64(length)))
+		if err != nil {
+			return rejected, err
+		}
+		if uint64(len(buf)) != length {
+			return rejected, io.ErrUnexpectedEOF
+		}
+
+		resourceSpans := &tracev1.ResourceSpans{}
+		if err := proto.Unmarshal(buf, resourceSpans); err != nil {
+			return rejected, err
+		}
+		r.applyTraceStateHints([]*tracev1.ResourceSpans{resourceSpans})
+		r.applyScopedAttributes([]*tracev1.ResourceSpans{resourceSpans})
+		r.applyOTLPStructure([]*tracev1.ResourceSpans{resourceSpans})
+		result, err := huskyotlp.TranslateTraceRequest(ctx, &collectortrace.ExportTraceServiceRequest{
+			ResourceSpans: []*tracev1.ResourceSpans{resourceSpans},
+		}, ri)
+		if err != nil {
+			return rejected, err
+		}
+		rejected.merge(r.processStreamedBatches(ctx, result.Batches, ri.ApiKey, environment))
+	}
+}
+
+// decompressOTLPBody wraps an OTLP request body in a decompressor for its
+// content encoding. The returned function must be called when the body is no
+// longer needed.
+func (r *Router) decompressOTLPBody(body io.Reader, encoding string) (io.Reader, func(), error) {
+	switch encoding {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gzipReader, func() { gzipReader.Close() }, nil
+	case "zstd":
+		zReader := <-r.zstdDecoders
+		done := func() {
+			zReader.Reset(nil)
+			r.zstdDecoders <- zReader
+		}
+		if err := zReader.Reset(body); err != nil {
+			done()
+			return nil, nil, err
+		}
+		return zReader, done, nil
+	}
+	return body, func() {}, nil
+}
+
+// processStreamedBatches sends on the events from a single resource. All of
+// them share one deadline for the collector to accept them, so a stalled
+// collector delays each resource by at most the backpressure timeout.
+func (r *Router) processStreamedBatches(ctx context.Context, batches []huskyotlp.Batch, apiKey string, environment string) spanRejections {
+	var requestID types.RequestIDContextKey
+	var rejected spanRejections
+	apiHost := r.Config.GetHoneycombAPI()
+	deadline := time.Now().Add(r.Config.GetOTLPStreamingBackpressureTimeout())
+
+	for _, batch := range batches {
+		for _, ev := range batch.Events {
+			event := &types.Event{
+				Context:     ctx,
+				APIHost:     apiHost,
+				APIKey:      apiKey,
+				Dataset:     batch.Dataset,
+				Environment: environment,
+				SampleRate:  uint(ev.SampleRate),
+				Timestamp:   ev.Timestamp,
+				Data:        ev.Attributes,
+			}
+			if err := r.processEventWithDeadline(event, requestID, deadline); err != nil {
+				r.Logger.Error().Logf("Error processing event: " + err.Error())
+				rejected.add(err)
+			}
+		}
+	}
+	return rejected
+}
+
+// addSpanBefore adds a span to the collector, retrying until the deadline
+// while the collector's queue is full.
+func (r *Router) addSpanBefore(span *types.Span, deadline time.Time) error {
+	var done <-chan struct{}
+	if span.Context != nil {
+		done = span.Context.Done()
+	}
+	backoff := time.Millisecond
+	for {
+		err := r.Collector.AddSpan(span)
+		if !errors.Is(err, collect.ErrWouldBlock) || !time.Now().Add(backoff).Before(deadline) {
+			return err
+		}
+		select {
+		case <-done:
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff < 50*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+// skipProtoField reads past the value of a field we don't care about.
+func skipProtoField(br *bufio.Reader, typ protowire.Type) error {
+	var n uint64
+	switch typ {
+	case protowire.VarintType:
+		_, err := binary.ReadUvarint(br)
+		return unexpectedEOF(err)
+	case protowire.Fixed32Type:
+		n = 4
+	case protowire.Fixed64Type:
+		n = 8
+	case protowire.BytesType:
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		n = length
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", typ)
+	}
+	_, err := io.CopyN(io.Discard, br, int64(n))
+	return unexpectedEOF(err)
+}
+
+// unexpectedEOF converts io.EOF, which is only expected between fields, to
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
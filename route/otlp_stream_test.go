@@ -0,0 +1,144 @@
+package route
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	huskyotlp "github.com/honeycombio/husky/otlp"
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	trace "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// busyCollector refuses the first few spans it's given, as if its queue
+// were full.
+type busyCollector struct {
+	collect.MockCollector
+	refusals int
+}
+
+func (b *busyCollector) AddSpan(sp *types.Span) error {
+	if b.refusals > 0 {
+		b.refusals--
+		return collect.ErrWouldBlock
+	}
+	return b.MockCollector.AddSpan(sp)
+}
+
+func newStreamingTestRouter(collector collect.Collector) *Router {
+	decoders, _ := makeDecoders(1)
+	return &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:                []string{"trace.trace_id"},
+			ParentIdFieldNames:               []string{"trace.parent_id"},
+			OTLPStreamingThreshold:           1024,
+			OTLPStreamingBackpressureTimeout: time.Second,
+		},
+		Logger:           &logger.NullLogger{},
+		Metrics:          &metrics.NullMetrics{},
+		Collector:        collector,
+		iopLogger:        iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		zstdDecoders:     decoders,
+		environmentCache: newEnvironmentCache(time.Second, nil),
+	}
+}
+
+func streamingTestRequest(services ...string) *collectortrace.ExportTraceServiceRequest {
+	req := &collectortrace.ExportTraceServiceRequest{}
+	for i, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, &trace.ResourceSpans{
+			Resource: &resource.Resource{Attributes: []*common.KeyValue{{
+				Key: "service.name", Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: service}},
+			}}},
+			ScopeSpans: []*trace.ScopeSpans{{
+				Spans: []*trace.Span{{
+					TraceId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, byte(i)},
+					SpanId:  []byte{1, 2, 3, 4, 5, 6, 7, byte(i)},
+					Name:    "span",
+				}},
+			}},
+		})
+	}
+	return req
+}
+
+func TestShouldStreamOTLP(t *testing.T) {
+	router := newStreamingTestRouter(&collect.MockCollector{})
+	protobuf := huskyotlp.RequestInfo{ContentType: "application/protobuf"}
+
+	req := httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(make([]byte, 2048)))
+	assert.True(t, router.shouldStreamOTLP(req, protobuf))
+	assert.False(t, router.shouldStreamOTLP(req, huskyotlp.RequestInfo{ContentType: "application/json"}))
+
+	req = httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(make([]byte, 512)))
+	assert.False(t, router.shouldStreamOTLP(req, protobuf))
+
+	// chunked requests have no length, so they might be huge
+	req.ContentLength = -1
+	assert.True(t, router.shouldStreamOTLP(req, protobuf))
+}
+
+func TestProcessOTLPTraceStream(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newStreamingTestRouter(collector)
+
+	body, err := proto.Marshal(streamingTestRequest("frontend", "backend", "database"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err = w.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	ri := huskyotlp.RequestInfo{ApiKey: legacyAPIKey, Dataset: "ds", ContentType: "application/protobuf", ContentEncoding: "gzip"}
+	rejected, err := router.processOTLPTraceStream(context.Background(), buf, ri)
+	require.NoError(t, err)
+	assert.Zero(t, rejected.count)
+
+	require.Len(t, collector.Spans, 3)
+	assert.Equal(t, "ds", collector.Spans[0].Dataset)
+	assert.Equal(t, "frontend", collector.Spans[0].Data["service.name"])
+	assert.Equal(t, "backend", collector.Spans[1].Data["service.name"])
+	assert.Equal(t, "database", collector.Spans[2].Data["service.name"])
+	assert.Equal(t, "0102030405060708090a0b0c0d0e0f02", collector.Spans[2].TraceID)
+
+	// a truncated body is an error, but the resources before the cut are kept
+	collector.Spans = nil
+	_, err = router.processOTLPTraceStream(context.Background(), bytes.NewReader(body[:len(body)-5]), huskyotlp.RequestInfo{ApiKey: legacyAPIKey, Dataset: "ds", ContentType: "application/protobuf"})
+	assert.Error(t, err)
+	assert.Len(t, collector.Spans, 2)
+}
+
+func TestProcessOTLPTraceStreamBackpressure(t *testing.T) {
+	collector := &busyCollector{refusals: 3}
+	router := newStreamingTestRouter(collector)
+
+	body, err := proto.Marshal(streamingTestRequest("frontend"))
+	require.NoError(t, err)
+	ri := huskyotlp.RequestInfo{ApiKey: legacyAPIKey, Dataset: "ds", ContentType: "application/protobuf"}
+	_, err = router.processOTLPTraceStream(context.Background(), bytes.NewReader(body), ri)
+	require.NoError(t, err)
+	assert.Len(t, collector.Spans, 1, "the span should be added once the collector has room")
+
+	// a collector that stays full eventually causes the span to be dropped
+	collector = &busyCollector{refusals: 1000}
+	router = newStreamingTestRouter(collector)
+	router.Config.(*config.MockConfig).OTLPStreamingBackpressureTimeout = 20 * time.Millisecond
+	rejected, err := router.processOTLPTraceStream(context.Background(), bytes.NewReader(body), ri)
+	require.NoError(t, err)
+	assert.Empty(t, collector.Spans)
+	assert.Equal(t, int64(1), rejected.count)
+}
@@ -0,0 +1,56 @@
+package route
+
+import (
+	"encoding/json"
+
+	"github.com/honeycombio/refinery/types"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// preservesOTLPStructure reports whether kept spans are sent on as OTLP, so
+// that their resources and scopes need to be rebuilt.
+func (r *Router) preservesOTLPStructure() bool {
+	if r.Config.GetOTLPUpstreamConfig().Enabled {
+		return true
+	}
+	kafka := r.Config.GetKafkaOutputConfig()
+	return kafka.Mode != "none" && kafka.Mode != "" && kafka.Encoding == "otlp"
+}
+
+// applyOTLPStructure records the names of the attributes of each resource
+// and scope in an attribute of their own, which is copied to each of their
+// spans when the spans are translated into events.
+func (r *Router) applyOTLPStructure(resourceSpans []*tracev1.ResourceSpans) {
+	if !r.preservesOTLPStructure() {
+		return
+	}
+	for _, rs := range resourceSpans {
+		if rs.Resource == nil {
+			rs.Resource = &resource.Resource{}
+		}
+		rs.Resource.Attributes = append(rs.Resource.Attributes, attributeNames(types.OTLPResourceFieldsField, rs.Resource.Attributes))
+		for _, ss := range rs.ScopeSpans {
+			// spans without a scope get none of its fields
+			if ss.Scope == nil {
+				continue
+			}
+			ss.Scope.Attributes = append(ss.Scope.Attributes, attributeNames(types.OTLPScopeFieldsField, ss.Scope.Attributes))
+		}
+	}
+}
+
+// attributeNames returns an attribute holding the names of a set of
+// attributes as a JSON array.
+func attributeNames(key string, attrs []*common.KeyValue) *common.KeyValue {
+	names := make([]string, 0, len(attrs))
+	for _, kv := range attrs {
+		names = append(names, kv.Key)
+	}
+	encoded, _ := json.Marshal(names)
+	return &common.KeyValue{
+		Key:   key,
+		Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: string(encoded)}},
+	}
+}
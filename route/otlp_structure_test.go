@@ -0,0 +1,50 @@
+package route
+
+import (
+	"context"
+	"testing"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestOTLPStructureRecorded(t *testing.T) {
+	str := func(s string) *common.AnyValue {
+		return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: s}}
+	}
+	for _, enabled := range []bool{false, true} {
+		collector := &collect.MockCollector{}
+		router := newHintsTestRouter(collector)
+		router.Config.(*config.MockConfig).OTLPUpstream = config.OTLPUpstreamConfig{Enabled: enabled}
+
+		req := hintsTestRequest()
+		req.ResourceSpans[0].Resource = &resource.Resource{
+			Attributes: []*common.KeyValue{{Key: "service.name", Value: str("api")}},
+		}
+		req.ResourceSpans[0].ScopeSpans[0].Scope = &common.InstrumentationScope{
+			Name:       "db",
+			Attributes: []*common.KeyValue{{Key: "db.flavor", Value: str("sql")}},
+		}
+
+		md := metadata.New(map[string]string{"x-honeycomb-team": legacyAPIKey, "x-honeycomb-dataset": "ds"})
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := NewTraceServer(router).Export(ctx, req)
+		require.NoError(t, err)
+
+		require.Len(t, collector.Spans, 3)
+		data := collector.Spans[0].Data
+		if !enabled {
+			assert.NotContains(t, data, types.OTLPResourceFieldsField)
+			assert.NotContains(t, data, types.OTLPScopeFieldsField)
+			continue
+		}
+		assert.Equal(t, `["service.name"]`, data[types.OTLPResourceFieldsField])
+		assert.Equal(t, `["db.flavor"]`, data[types.OTLPScopeFieldsField])
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	huskyotlp "github.com/honeycombio/husky/otlp"
 	"github.com/honeycombio/refinery/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 
 	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 )
@@ -24,23 +30,139 @@ func (r *Router) postOTLP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !r.Config.IsAPIKeyValid(ri.ApiKey) {
-		r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: fmt.Sprintf("api key %s not found in list of authorized keys", ri.ApiKey), HTTPStatusCode: http.StatusUnauthorized})
+	if err := r.quarantineError(ri.ApiKey); err != nil {
+		r.Metrics.Increment("incoming_router_quarantined")
+		r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: err.Error(), HTTPStatusCode: http.StatusUnauthorized})
 		return
 	}
 
-	result, err := huskyotlp.TranslateTraceRequestFromReader(req.Context(), req.Body, ri)
+	if !r.isAPIKeyAccepted(req.Context(), ri.ApiKey) {
+		r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: fmt.Sprintf("api key %s not found in list of authorized keys", r.redactKey(ri.ApiKey)), HTTPStatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	if r.shouldStreamOTLP(req, ri) {
+		r.Metrics.Increment("incoming_router_otlp_streamed")
+		defer req.Body.Close()
+		rejected, err := r.processOTLPTraceStream(req.Context(), req.Body, ri)
+		if err != nil {
+			r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: fmt.Sprintf("%s: %s", huskyotlp.ErrFailedParseBody.Message, err), HTTPStatusCode: http.StatusBadRequest})
+			return
+		}
+		r.writeOTLPTraceResponse(w, req, rejected)
+		return
+	}
+
+	var result *huskyotlp.TranslateOTLPRequestResult
+	var err error
+	if r.Config.GetSamplingHintsConfig().TraceStateKey != "" || r.Config.GetConsistentSamplingConfig().Enabled ||
+		len(r.Config.GetScopedAttributes()) > 0 || r.preservesOTLPStructure() {
+		// husky drops the tracestate and flattens the attributes' scopes, so
+		// we need to see the spans first
+		var request *collectortrace.ExportTraceServiceRequest
+		request, err = r.readOTLPTraceRequest(req.Body, ri)
+		if err == nil {
+			r.applyTraceStateHints(request.ResourceSpans)
+			r.applyScopedAttributes(request.ResourceSpans)
+			r.applyOTLPStructure(request.ResourceSpans)
+			result, err = huskyotlp.TranslateTraceRequest(req.Context(), request, ri)
+		}
+	} else {
+		result, err = huskyotlp.TranslateTraceRequestFromReader(req.Context(), req.Body, ri)
+	}
 	if err != nil {
 		r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: err.Error(), HTTPStatusCode: http.StatusInternalServerError})
 		return
 	}
 
-	if err := processTraceRequest(req.Context(), r, result.Batches, ri.ApiKey); err != nil {
+	rejected, err := processTraceRequest(req.Context(), r, result.Batches, ri.ApiKey)
+	if err != nil {
 		r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: err.Error(), HTTPStatusCode: http.StatusInternalServerError})
 		return
 	}
 
-	_ = huskyotlp.WriteOtlpHttpTraceSuccessResponse(w, req)
+	r.writeOTLPTraceResponse(w, req, rejected)
+}
+
+// writeOTLPTraceResponse responds to an OTLP/HTTP trace request whose spans
+// have been processed.
+func (r *Router) writeOTLPTraceResponse(w http.ResponseWriter, req *http.Request, rejected spanRejections) {
+	resp, err := r.otlpTraceResponse(rejected)
+	if err != nil {
+		r.handleOTLPFailureResponse(w, req, huskyotlp.OTLPError{Message: err.Error(), HTTPStatusCode: http.StatusBadRequest})
+		return
+	}
+	_ = huskyotlp.WriteOtlpHttpResponse(w, req, http.StatusOK, resp)
+}
+
+// spanRejections counts the spans of an OTLP request that weren't accepted,
+// and remembers why the first of them wasn't.
+type spanRejections struct {
+	count int64
+	first error
+}
+
+func (s *spanRejections) add(err error) {
+	if s.count == 0 {
+		s.first = err
+	}
+	s.count++
+}
+
+func (s *spanRejections) merge(other spanRejections) {
+	if s.count == 0 {
+		s.first = other.first
+	}
+	s.count += other.count
+}
+
+// otlpTraceResponse builds the response to an OTLP trace request. If some of
+// its spans were rejected, the response reports a partial success, or in
+// strict mode an error is returned so that the whole request fails.
+func (r *Router) otlpTraceResponse(rejected spanRejections) (*collectortrace.ExportTraceServiceResponse, error) {
+	resp := &collectortrace.ExportTraceServiceResponse{}
+	if rejected.count == 0 {
+		return resp, nil
+	}
+	r.Metrics.Count("incoming_router_otlp_rejected_spans", rejected.count)
+
+	msg := fmt.Sprintf("%d span(s) rejected, the first because: %s", rejected.count, rejected.first)
+	if r.Config.GetOTLPRejectedSpans() == "strict" {
+		return nil, errors.New(msg)
+	}
+	resp.PartialSuccess = &collectortrace.ExportTracePartialSuccess{
+		RejectedSpans: rejected.count,
+		ErrorMessage:  msg,
+	}
+	return resp, nil
+}
+
+// readOTLPTraceRequest decodes an OTLP/HTTP trace request body.
+func (r *Router) readOTLPTraceRequest(body io.ReadCloser, ri huskyotlp.RequestInfo) (*collectortrace.ExportTraceServiceRequest, error) {
+	defer body.Close()
+	reader, done, err := r.decompressOTLPBody(body, ri.ContentEncoding)
+	if err != nil {
+		return nil, huskyotlp.ErrFailedParseBody
+	}
+	defer done()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, huskyotlp.ErrFailedParseBody
+	}
+
+	request := &collectortrace.ExportTraceServiceRequest{}
+	switch ri.ContentType {
+	case "application/protobuf", "application/x-protobuf":
+		err = proto.Unmarshal(data, request)
+	case "application/json":
+		err = protojson.Unmarshal(data, request)
+	default:
+		return nil, huskyotlp.ErrInvalidContentType
+	}
+	if err != nil {
+		return nil, huskyotlp.ErrFailedParseBody
+	}
+	return request, nil
 }
 
 type TraceServer struct {
@@ -53,37 +175,83 @@ func NewTraceServer(router *Router) *TraceServer {
 	return &traceServer
 }
 
-func (t *TraceServer) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+func (t *TraceServer) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (resp *collectortrace.ExportTraceServiceResponse, err error) {
+	ctx, span := t.router.startIngestSpan(ctx, "otlp-grpc")
+	defer span.End()
+	ctx = context.WithValue(ctx, ingestRouteContextKey{}, "otlp-grpc")
+	// measured now, since sampling hints can add to the request
+	size := int64(proto.Size(req))
+	start := time.Now()
+	defer func() {
+		t.router.Profiler.ObserveLatency(time.Since(start))
+		var rejectReason string
+		if err != nil {
+			rejectReason = status.Code(err).String()
+		}
+		t.router.recordIngestRequest("otlp-grpc", huskyotlp.GetRequestInfoFromGrpcMetadata(ctx).ApiKey, size, rejectReason)
+	}()
+
+	if t.router.Drainer.Draining() {
+		t.router.Metrics.Increment("incoming_router_draining")
+		return nil, status.Error(codes.Unavailable, ErrDraining.msg)
+	}
+	if t.router.ingestPause.isPaused() {
+		t.router.Metrics.Increment("incoming_router_paused")
+		return nil, status.Error(codes.Unavailable, ErrIngestPaused.msg)
+	}
+	if reason := t.router.admissionRejection(); reason != "" {
+		t.router.Metrics.Increment("incoming_router_rejected_" + reason)
+		return nil, status.Error(codes.Unavailable, ErrOverloaded.msg)
+	}
+
 	ri := huskyotlp.GetRequestInfoFromGrpcMetadata(ctx)
 	if err := ri.ValidateTracesHeaders(); err != nil {
 		return nil, huskyotlp.AsGRPCError(err)
 	}
 
+	if err := t.router.quarantineError(ri.ApiKey); err != nil {
+		t.router.Metrics.Increment("incoming_router_quarantined")
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if !t.router.isAPIKeyAccepted(ctx, ri.ApiKey) {
+		return nil, status.Error(codes.Unauthenticated, fmt.Sprintf("api key %s not found in list of authorized keys", t.router.redactKey(ri.ApiKey)))
+	}
+
+	t.router.applyTraceStateHints(req.ResourceSpans)
+	t.router.applyScopedAttributes(req.ResourceSpans)
+	t.router.applyOTLPStructure(req.ResourceSpans)
 	result, err := huskyotlp.TranslateTraceRequest(ctx, req, ri)
 	if err != nil {
 		return nil, huskyotlp.AsGRPCError(err)
 	}
 
-	if err := processTraceRequest(ctx, t.router, result.Batches, ri.ApiKey); err != nil {
+	rejected, err := processTraceRequest(ctx, t.router, result.Batches, ri.ApiKey)
+	if err != nil {
 		return nil, huskyotlp.AsGRPCError(err)
 	}
 
-	return &collectortrace.ExportTraceServiceResponse{}, nil
+	resp, err = t.router.otlpTraceResponse(rejected)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return resp, nil
 }
 
 func processTraceRequest(
 	ctx context.Context,
 	router *Router,
 	batches []huskyotlp.Batch,
-	apiKey string) error {
+	apiKey string) (spanRejections, error) {
 
 	var requestID types.RequestIDContextKey
+	var rejected spanRejections
 	apiHost := router.Config.GetHoneycombAPI()
 
 	// get environment name - will be empty for legacy keys
 	environment, err := router.getEnvironmentName(apiKey)
 	if err != nil {
-		return nil
+		return rejected, nil
 	}
 
 	for _, batch := range batches {
@@ -100,9 +268,10 @@ func processTraceRequest(
 			}
 			if err = router.processEvent(event, requestID); err != nil {
 				router.Logger.Error().Logf("Error processing event: " + err.Error())
+				rejected.add(err)
 			}
 		}
 	}
 
-	return nil
+	return rejected, nil
 }
@@ -24,7 +24,9 @@ import (
 	common "go.opentelemetry.io/proto/otlp/common/v1"
 	resource "go.opentelemetry.io/proto/otlp/resource/v1"
 	trace "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
@@ -465,6 +467,12 @@ func TestOTLPHandler(t *testing.T) {
 		router.postOTLP(w, request)
 		assert.Equal(t, http.StatusUnauthorized, w.Code)
 		assert.Contains(t, w.Body.String(), "not found in list of authorized keys")
+		assert.NotContains(t, w.Body.String(), legacyAPIKey)
+
+		_, err = NewTraceServer(router).Export(ctx, req)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not found in list of authorized keys")
+		assert.NotContains(t, err.Error(), legacyAPIKey)
 
 		assert.Equal(t, 0, len(mockTransmission.Events))
 		mockTransmission.Flush()
@@ -472,6 +480,62 @@ func TestOTLPHandler(t *testing.T) {
 
 }
 
+func TestOTLPPartialSuccess(t *testing.T) {
+	body, err := proto.Marshal(streamingTestRequest("frontend", "backend", "database"))
+	require.NoError(t, err)
+	md := metadata.New(map[string]string{"x-honeycomb-team": legacyAPIKey, "x-honeycomb-dataset": "ds"})
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	post := func(router *Router) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(body))
+		req.Header.Set("content-type", "application/protobuf")
+		req.Header.Set("x-honeycomb-team", legacyAPIKey)
+		req.Header.Set("x-honeycomb-dataset", "ds")
+		w := httptest.NewRecorder()
+		router.postOTLP(w, req)
+		return w
+	}
+
+	t.Run("partial", func(t *testing.T) {
+		collector := &busyCollector{refusals: 2}
+		router := newStreamingTestRouter(collector)
+		router.Config.(*config.MockConfig).OTLPRejectedSpans = "partial"
+
+		w := post(router)
+		require.Equal(t, http.StatusOK, w.Code)
+		resp := &collectortrace.ExportTraceServiceResponse{}
+		require.NoError(t, proto.Unmarshal(w.Body.Bytes(), resp))
+		require.NotNil(t, resp.PartialSuccess)
+		assert.Equal(t, int64(2), resp.PartialSuccess.RejectedSpans)
+		assert.Contains(t, resp.PartialSuccess.ErrorMessage, "2 span(s) rejected")
+		assert.Len(t, collector.Spans, 1)
+
+		collector.refusals = 1
+		grpcResp, err := NewTraceServer(router).Export(ctx, streamingTestRequest("frontend", "backend"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), grpcResp.PartialSuccess.GetRejectedSpans())
+
+		// a fully accepted request has no partial success
+		grpcResp, err = NewTraceServer(router).Export(ctx, streamingTestRequest("frontend"))
+		require.NoError(t, err)
+		assert.Nil(t, grpcResp.PartialSuccess)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		collector := &busyCollector{refusals: 1}
+		router := newStreamingTestRouter(collector)
+		router.Config.(*config.MockConfig).OTLPRejectedSpans = "strict"
+
+		w := post(router)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Len(t, collector.Spans, 2)
+
+		collector.refusals = 1
+		_, err := NewTraceServer(router).Export(ctx, streamingTestRequest("frontend"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
 func helperOTLPRequestSpansWithoutStatus() []*trace.Span {
 	now := time.Now()
 	return []*trace.Span{
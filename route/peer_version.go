@@ -0,0 +1,42 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/honeycombio/refinery/internal/peer"
+	"github.com/honeycombio/refinery/sharder"
+	"github.com/honeycombio/refinery/transmit"
+)
+
+// peerCapabilities is what this Refinery can do when talking to its peers.
+// Compression is the codecs getMaybeCompressedBody can decode.
+func (r *Router) peerCapabilities() peer.Capabilities {
+	return peer.Capabilities{
+		Version:        r.versionStr,
+		Compression:    []string{"zstd", transmit.SnappyFramedEncoding, "gzip"},
+		MessageSchemas: peer.MessageSchemas,
+		Sharder:        sharder.DefaultType,
+	}
+}
+
+// getPeerVersion handles GET /peer/version, which peers ask on first contact
+// so that peers of different versions can agree on what to use. A peer that
+// sends its own capabilities in the query gets the agreement back, or a
+// conflict if the two can't work together.
+func (r *Router) getPeerVersion(w http.ResponseWriter, req *http.Request) {
+	reply := peer.Reply{Capabilities: r.peerCapabilities()}
+	theirs, ok, err := peer.CapabilitiesFromQuery(req.URL.Query())
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadPeerCapabilities, err)
+		return
+	}
+	if ok {
+		agreement, err := reply.Negotiate(theirs)
+		if err != nil {
+			r.handlerReturnWithError(w, ErrPeerIncompatible, err)
+			return
+		}
+		reply.Agreement = &agreement
+	}
+	r.marshalToFormat(w, reply, "json")
+}
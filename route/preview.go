@@ -0,0 +1,119 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// maxPreviewSpans limits how many spans a previewed trace may have.
+const maxPreviewSpans = 10_000
+
+// maxPreviewBodySize limits the size of a sample preview request body, which
+// leaves room for a few hundred bytes of fields in each span allowed.
+const maxPreviewBodySize = 4 << 20
+
+// samplePreviewRequest describes a synthetic trace to preview a sampling
+// decision for.
+type samplePreviewRequest struct {
+	// APIKey, Dataset and Environment choose the sampler as they would for
+	// a live trace, unless Sampler names it.
+	APIKey      string `json:"api_key"`
+	Dataset     string `json:"dataset"`
+	Environment string `json:"environment"`
+	Sampler     string `json:"sampler"`
+	// Fields are the fields of the root span.
+	Fields map[string]interface{} `json:"fields"`
+	// Spans are the fields of the other spans in the trace.
+	Spans []map[string]interface{} `json:"spans"`
+	// SpanCount, if more than the number of spans given, adds spans with no
+	// fields to make the trace that long, counting the root.
+	SpanCount int `json:"span_count"`
+	// DurationMs, if set, is the duration_ms of the root span.
+	DurationMs *float64 `json:"duration_ms"`
+}
+
+// trace builds the trace that the request describes.
+func (p *samplePreviewRequest) trace() (*types.Trace, error) {
+	if p.SpanCount > maxPreviewSpans || len(p.Spans)+1 > maxPreviewSpans {
+		return nil, fmt.Errorf("a previewed trace may have at most %d spans", maxPreviewSpans)
+	}
+	if p.Sampler == "" && p.Environment == "" && !types.IsLegacyAPIKey(p.APIKey) {
+		return nil, errors.New("environment is needed to choose a sampler unless api_key is a classic key or sampler is given")
+	}
+
+	trace := &types.Trace{
+		APIKey:  p.APIKey,
+		Dataset: p.Dataset,
+		TraceID: "sample-preview",
+	}
+	newSpan := func(fields map[string]interface{}) *types.Span {
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		return &types.Span{
+			TraceID: trace.TraceID,
+			Event: types.Event{
+				APIKey:      p.APIKey,
+				Dataset:     p.Dataset,
+				Environment: p.Environment,
+				Data:        fields,
+			},
+		}
+	}
+
+	root := newSpan(p.Fields)
+	root.IsRoot = true
+	if p.DurationMs != nil {
+		root.Data["duration_ms"] = *p.DurationMs
+	}
+	trace.RootSpan = root
+	trace.AddSpan(root)
+	for _, fields := range p.Spans {
+		trace.AddSpan(newSpan(fields))
+	}
+	for n := len(p.Spans) + 1; n < p.SpanCount; n++ {
+		trace.AddSpan(newSpan(nil))
+	}
+	return trace, nil
+}
+
+// samplePreview handles POST /debug/sample-preview. It returns the decision
+// that the currently loaded rules would make about the trace described by
+// the body, so that rule changes can be checked before they're deployed.
+// Nothing is recorded or sent.
+func (r *Router) samplePreview(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPreviewBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			r.handlerReturnWithError(w, ErrBadSamplePreview, fmt.Errorf("request body is larger than %d bytes", tooLarge.Limit))
+			return
+		}
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+
+	var preview samplePreviewRequest
+	if err := json.Unmarshal(body, &preview); err != nil {
+		r.handlerReturnWithError(w, ErrJSONFailed, err)
+		return
+	}
+	trace, err := preview.trace()
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadSamplePreview, err)
+		return
+	}
+
+	r.Metrics.Increment("sample_preview_requests")
+	result, err := r.Collector.PreviewSample(trace, preview.Sampler)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadSamplePreview, err)
+		return
+	}
+	r.marshalToFormat(w, result, "json")
+}
@@ -0,0 +1,79 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// previewCollector remembers the trace it was asked to preview.
+type previewCollector struct {
+	collect.MockCollector
+	trace    *types.Trace
+	selector string
+}
+
+func (p *previewCollector) PreviewSample(trace *types.Trace, selector string) (collect.SamplePreview, error) {
+	p.trace, p.selector = trace, selector
+	if selector == "unknown" {
+		return collect.SamplePreview{}, errors.New("no sampler named 'unknown' in the rules")
+	}
+	return collect.SamplePreview{Sampler: "production", Keep: true, Rate: 10, Reason: "rules/trace/slow"}, nil
+}
+
+func TestSamplePreview(t *testing.T) {
+	collector := &previewCollector{}
+	router := &Router{
+		Logger:    &logger.NullLogger{},
+		Metrics:   &metrics.NullMetrics{},
+		Collector: collector,
+	}
+
+	rr := httptest.NewRecorder()
+	body := `{"environment":"production","fields":{"http.route":"/cart"},"spans":[{"error":true}],"span_count":5,"duration_ms":1500}`
+	router.samplePreview(rr, httptest.NewRequest("POST", "/debug/sample-preview", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp collect.SamplePreview
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, collect.SamplePreview{Sampler: "production", Keep: true, Rate: 10, Reason: "rules/trace/slow"}, resp)
+
+	trace := collector.trace
+	require.NotNil(t, trace)
+	assert.Equal(t, "", collector.selector)
+	assert.Equal(t, "production", trace.GetSamplerSelector(""))
+	assert.Equal(t, uint32(5), trace.DescendantCount())
+	assert.Equal(t, "/cart", trace.RootSpan.Data["http.route"])
+	assert.Equal(t, 1500.0, trace.RootSpan.Data["duration_ms"])
+	assert.Equal(t, true, trace.GetSpans()[1].Data["error"])
+}
+
+func TestSamplePreviewInvalid(t *testing.T) {
+	router := &Router{
+		Logger:    &logger.NullLogger{},
+		Metrics:   &metrics.NullMetrics{},
+		Collector: &previewCollector{},
+	}
+
+	for name, body := range map[string]string{
+		"not json":       `{`,
+		"no sampler":     `{"fields":{"a":1}}`,
+		"too many spans": `{"environment":"production","span_count":100000}`,
+		"too large":      `{"environment":"production","fields":{"a":"` + strings.Repeat("x", maxPreviewBodySize) + `"}}`,
+		"unknown":        `{"sampler":"unknown"}`,
+	} {
+		rr := httptest.NewRecorder()
+		router.samplePreview(rr, httptest.NewRequest("POST", "/debug/sample-preview", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, name)
+	}
+}
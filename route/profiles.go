@@ -0,0 +1,31 @@
+package route
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// listProfiles handles GET /debug/profiles. It lists the profiles captured
+// on this node while it was under stress, oldest first.
+func (r *Router) listProfiles(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.Profiler.Profiles(), "json")
+}
+
+// getProfile handles GET /debug/profiles/{name}, which downloads a profile
+// for use with go tool pprof.
+func (r *Router) getProfile(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	f, err := r.Profiler.Open(name)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrNoProfile, fmt.Errorf("profile %s: %w", name, err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	io.Copy(w, f)
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/collect/stressRelief"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/profiler"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	name := "20260101T000000.000Z-stress-heap.pprof"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("profile data"), 0o644))
+
+	cfg := &config.MockConfig{Profiling: config.ProfilingConfig{
+		Enabled:       true,
+		Directory:     dir,
+		MaxProfiles:   10,
+		CheckInterval: config.Duration(time.Hour),
+	}}
+	p := &profiler.Profiler{
+		Config:       cfg,
+		Logger:       &logger.NullLogger{},
+		Metrics:      &metrics.NullMetrics{},
+		Clock:        clockwork.NewFakeClock(),
+		StressRelief: &stressRelief.MockStressReliever{},
+	}
+	require.NoError(t, p.Start())
+	defer p.Stop()
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}, Profiler: p}
+
+	m := mux.NewRouter()
+	m.HandleFunc("/debug/profiles", router.listProfiles).Methods("GET")
+	m.HandleFunc("/debug/profiles/{name}", router.getProfile).Methods("GET")
+	do := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+
+	rr := do("/debug/profiles")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var profiles []profiler.Profile
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &profiles))
+	require.Len(t, profiles, 1)
+	assert.Equal(t, name, profiles[0].Name)
+
+	rr = do("/debug/profiles/" + name)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "profile data", rr.Body.String())
+
+	rr = do("/debug/profiles/missing.pprof")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,101 @@
+package route
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(command byte, family byte, addrs []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x15, 0xb3, 0, 80}
+	v6 := append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...)
+	v6 = append(v6, 0x15, 0xb3, 0, 80)
+
+	tests := []struct {
+		name   string
+		input  string
+		remote string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n", "203.0.113.7:5555", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 5555 80\r\n", "[2001:db8::7]:5555", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 invalid", "PROXY TCP4 nope 10.0.0.1 5555 80\r\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("x", 200), "", true},
+		{"v2 tcp4", proxyV2Header(1, 0x11, v4), "203.0.113.7:5555", false},
+		{"v2 tcp6", proxyV2Header(1, 0x21, v6), "[2001:db8::7]:5555", false},
+		{"v2 local", proxyV2Header(0, 0x00, nil), "", false},
+		{"v2 truncated", proxyV2Header(1, 0x11, make([]byte, 1000))[:20], "", true},
+		{"no header", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "GET / HTTP/1.1\r\n"))
+			addr, err := readProxyHeader(r)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.remote == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, tt.remote, addr.String())
+			}
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+		})
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	for _, tt := range []struct {
+		trusted []string
+		want    string
+	}{
+		// no proxy is trusted by default
+		{nil, "400 Bad Request"},
+		{[]string{"127.0.0.0/8"}, "203.0.113.7:5555"},
+		// the header isn't read from an untrusted source, so the request is garbage
+		{[]string{"10.0.0.0/8"}, "400 Bad Request"},
+	} {
+		t.Run(fmt.Sprint(tt.trusted), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			pl, err := newProxyProtoListener(l, tt.trusted, time.Second)
+			require.NoError(t, err)
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprint(w, req.RemoteAddr)
+			})}
+			go server.Serve(pl)
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\nGET / HTTP/1.1\r\nHost: refinery\r\nConnection: close\r\n\r\n")
+			resp, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.Contains(t, string(resp), tt.want)
+		})
+	}
+
+	_, err := newProxyProtoListener(nil, []string{"not a cidr"}, time.Second)
+	assert.Error(t, err)
+}
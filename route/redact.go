@@ -0,0 +1,84 @@
+package route
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"unicode/utf8"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/types"
+)
+
+// applyRedaction drops, hashes, or truncates the attributes of an event that
+// match the redaction rules for its dataset. It runs before the event is
+// handed to the collector or sent upstream, so redacted values are never
+// buffered or forwarded.
+func (r *Router) applyRedaction(ev *types.Event) {
+	cfg := r.Config.GetRedactionConfig()
+	rules := cfg.RulesFor(ev.Dataset)
+	if len(rules) == 0 {
+		return
+	}
+	for name, value := range ev.Data {
+		rule, ok := matchRedactionRule(rules, name)
+		if !ok {
+			continue
+		}
+		switch rule.Action {
+		case config.RedactHash:
+			ev.Data[name] = hashAttribute(cfg.HashSalt, value)
+		case config.RedactTruncate:
+			s, ok := value.(string)
+			if !ok || len(s) <= rule.MaxLength {
+				continue
+			}
+			ev.Data[name] = truncateString(s, rule.MaxLength)
+		default:
+			// unknown actions drop the attribute, so that a typo in the
+			// config doesn't let sensitive values through
+			delete(ev.Data, name)
+		}
+		r.Metrics.Increment("incoming_router_redacted_attributes")
+	}
+}
+
+// matchRedactionRule returns the first rule with a pattern that matches the
+// attribute name.
+func matchRedactionRule(rules []config.RedactionRule, name string) (config.RedactionRule, bool) {
+	for _, rule := range rules {
+		for _, pattern := range rule.Attributes {
+			// a malformed pattern can only match itself
+			if matched, err := path.Match(pattern, name); matched || (err != nil && pattern == name) {
+				return rule, true
+			}
+		}
+	}
+	return config.RedactionRule{}, false
+}
+
+// hashAttribute returns the hex SHA-256 hash of the salt followed by the
+// value, so that equal values can still be grouped after they're hashed.
+func hashAttribute(salt string, value any) string {
+	h := sha256.New()
+	h.Write([]byte(salt))
+	if s, ok := value.(string); ok {
+		h.Write([]byte(s))
+	} else {
+		fmt.Fprint(h, value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// truncateString shortens s to at most n bytes without splitting a UTF-8
+// character.
+func truncateString(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,81 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRedaction(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := newHintsTestRouter(collector)
+	router.Config.(*config.MockConfig).Redaction = config.RedactionConfig{
+		HashSalt: "salt",
+		DatasetRules: map[string][]config.RedactionRule{
+			"*": {
+				{Attributes: []string{"*.password", "http.request.header.authorization"}, Action: config.RedactDrop},
+			},
+			"checkout": {
+				{Attributes: []string{"user.email"}, Action: config.RedactHash},
+				{Attributes: []string{"db.statement"}, Action: config.RedactTruncate, MaxLength: 8},
+				{Attributes: []string{"user.*"}, Action: "typo"},
+			},
+		},
+	}
+
+	ev := &types.Event{
+		Dataset: "checkout",
+		Data: map[string]interface{}{
+			"trace.trace_id":                    "abc",
+			"db.password":                       "hunter2",
+			"http.request.header.authorization": "Bearer xyz",
+			"user.email":                        "someone@example.com",
+			"user.name":                         "someone",
+			"db.statement":                      "SELECT * FROM users",
+			"http.route":                        "/checkout",
+		},
+	}
+	require.NoError(t, router.processEvent(ev, nil))
+	require.Len(t, collector.Spans, 1)
+	data := collector.Spans[0].Data
+
+	assert.NotContains(t, data, "db.password")
+	assert.NotContains(t, data, "http.request.header.authorization")
+	assert.Equal(t, hashAttribute("salt", "someone@example.com"), data["user.email"], "the first matching rule wins")
+	assert.Len(t, data["user.email"], 64)
+	assert.NotContains(t, data, "user.name", "an unknown action drops the attribute")
+	assert.Equal(t, "SELECT *", data["db.statement"])
+	assert.Equal(t, "/checkout", data["http.route"])
+	assert.Equal(t, "abc", data["trace.trace_id"])
+
+	// other datasets only get the rules that apply to every dataset
+	ev = &types.Event{
+		Dataset: "frontend",
+		Data: map[string]interface{}{
+			"db.password": "hunter2",
+			"user.email":  "someone@example.com",
+		},
+	}
+	require.NoError(t, router.processEvent(ev, nil))
+	mockTransmission := router.UpstreamTransmission.(*transmit.MockTransmission)
+	events := mockTransmission.Events
+	require.Len(t, events, 1)
+	assert.NotContains(t, events[0].Data, "db.password", "events that aren't spans are redacted too")
+	assert.Equal(t, "someone@example.com", events[0].Data["user.email"])
+}
+
+func TestTruncateString(t *testing.T) {
+	assert.Equal(t, "héllo", truncateString("héllo, world", 6))
+	assert.Equal(t, "h", truncateString("héllo", 2), "a multibyte character isn't split")
+	assert.Equal(t, "", truncateString("hello", 0))
+}
+
+func TestHashAttribute(t *testing.T) {
+	assert.Equal(t, hashAttribute("", "200"), hashAttribute("", 200), "values hash the same whatever their type")
+	assert.NotEqual(t, hashAttribute("a", "value"), hashAttribute("b", "value"))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,32 +12,48 @@ import (
 	"math"
 	"net"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/klauspost/compress/s2"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/netutil"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	healthserver "google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
 	"gopkg.in/yaml.v3"
 
 	// grpc/gzip compressor, auto registers on import
 	_ "google.golang.org/grpc/encoding/gzip"
 
+	"github.com/honeycombio/refinery/centralstore"
 	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/collect/stressRelief"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/drain"
+	"github.com/honeycombio/refinery/internal/featureflags"
+	"github.com/honeycombio/refinery/internal/gossip"
 	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/otelutil"
+	"github.com/honeycombio/refinery/internal/peer"
+	"github.com/honeycombio/refinery/internal/profiler"
+	"github.com/honeycombio/refinery/internal/supervisor"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
 	"github.com/honeycombio/refinery/transmit"
 	"github.com/honeycombio/refinery/types"
 
@@ -47,21 +64,33 @@ const (
 	// numZstdDecoders is set statically here - we may make it into a config option
 	// A normal practice might be to use some multiple of the CPUs, but that goes south
 	// in kubernetes
-	numZstdDecoders        = 4
-	traceIDShortLength     = 8
-	traceIDLongLength      = 16
-	GRPCMessageSizeMax int = 5000000 // 5MB
-	defaultSampleRate      = 1
+	numZstdDecoders           = 4
+	traceIDShortLength        = 8
+	traceIDLongLength         = 16
+	GRPCMessageSizeMax    int = 5000000 // 5MB
+	defaultSampleRate         = 1
+	defaultMaxIngestPause     = 15 * time.Minute
 )
 
 type Router struct {
-	Config               config.Config         `inject:""`
-	Logger               logger.Logger         `inject:""`
-	Health               health.Reporter       `inject:""`
-	HTTPTransport        *http.Transport       `inject:"upstreamTransport"`
-	UpstreamTransmission transmit.Transmission `inject:"upstreamTransmission"`
-	Collector            collect.Collector     `inject:"collector"`
-	Metrics              metrics.Metrics       `inject:"genericMetrics"`
+	Config               config.Config               `inject:""`
+	Logger               logger.Logger               `inject:""`
+	Health               health.Reporter             `inject:""`
+	HTTPTransport        *http.Transport             `inject:"upstreamTransport"`
+	UpstreamTransmission transmit.Transmission       `inject:"upstreamTransmission"`
+	Collector            collect.Collector           `inject:"collector"`
+	Store                centralstore.SmartStorer    `inject:""`
+	Metrics              metrics.Metrics             `inject:"genericMetrics"`
+	KeyValidator         *apikeys.Validator          `inject:""`
+	KeyQuarantine        *apikeys.Quarantine         `inject:""`
+	SamplerFactory       *sample.SamplerFactory      `inject:""`
+	FeatureFlags         *featureflags.Flags         `inject:""`
+	Profiler             *profiler.Profiler          `inject:""`
+	Drainer              *drain.Drainer              `inject:""`
+	Supervisor           *supervisor.Supervisor      `inject:""`
+	StressRelief         stressRelief.StressReliever `inject:"stressRelief"`
+	Tracer               trace.Tracer                `inject:"tracer"`
+	Gossip               gossip.Gossiper             `inject:"gossip"`
 
 	// version is set on startup so that the router may answer HTTP requests for
 	// the version
@@ -74,13 +103,32 @@ type Router struct {
 
 	zstdDecoders chan *zstd.Decoder
 
-	server     *http.Server
-	grpcServer *grpc.Server
-	doneWG     sync.WaitGroup
-	donech     chan struct{}
+	server      *http.Server
+	adminServer *http.Server
+	grpcServer  *grpc.Server
+	xrayConn    net.PacketConn
+	doneWG      sync.WaitGroup
+	donech      chan struct{}
 
 	environmentCache *environmentCache
 	hsrv             *healthserver.Server
+
+	// ingestPause is set through the admin API to temporarily refuse new
+	// ingest requests while still serving health, admin, and proxy traffic
+	ingestPause ingestPause
+	// inflight limits concurrent ingest requests on the HTTP listener; it is
+	// nil when there is no limit
+	inflight chan struct{}
+
+	ingestAccounting ingestAccounting
+
+	// clusterNodes holds the statuses that peers have shared
+	clusterNodes clusterNodes
+
+	idTransforms idTransforms
+
+	// keyCleanupRunning keeps more than one key cleanup from running at once
+	keyCleanupRunning atomic.Bool
 }
 
 type BatchResponse struct {
@@ -112,8 +160,9 @@ func (r *Router) SetVersion(ver string) {
 // LnS spins up the Listen and Serve portion of the router. A router is
 // initialized as being for either incoming traffic from clients or traffic from
 // a peer. They listen on different addresses so peer traffic can be
-// prioritized.
-func (r *Router) LnS() {
+// prioritized. It returns an error if the listeners can't be set up.
+func (r *Router) LnS() error {
+	r.Logger = logger.ForSubsystem(r.Logger, "router")
 	r.iopLogger = iopLogger{
 		Logger: r.Logger,
 	}
@@ -127,19 +176,43 @@ func (r *Router) LnS() {
 	var err error
 	r.zstdDecoders, err = makeDecoders(numZstdDecoders)
 	if err != nil {
-		r.iopLogger.Error().Logf("couldn't start zstd decoders: %s", err.Error())
-		return
+		return fmt.Errorf("couldn't start zstd decoders: %w", err)
 	}
 
 	r.Metrics.Register("incoming_router_proxied", "counter")
 	r.Metrics.Register("incoming_router_event", "counter")
 	r.Metrics.Register("incoming_router_batch", "counter")
 	r.Metrics.Register("incoming_router_nonspan", "counter")
+	r.Metrics.Register("incoming_router_sampling_hint", "counter")
 	r.Metrics.Register("incoming_router_span", "counter")
 	r.Metrics.Register("incoming_router_peer", "counter")
 	r.Metrics.Register("incoming_router_dropped", "counter")
+	r.Metrics.Register("incoming_router_paused", "counter")
+	r.Metrics.Register("incoming_router_draining", "counter")
+	r.Metrics.Register("incoming_router_throttled", "counter")
+	r.Metrics.Register("incoming_router_client_cert_auth", "counter")
+	r.Metrics.Register("incoming_router_zipkin", "counter")
+	r.Metrics.Register("incoming_router_quarantined", "counter")
+	r.Metrics.Register("incoming_router_xray", "counter")
+	r.Metrics.Register("incoming_router_xray_dropped", "counter")
+	r.Metrics.Register("incoming_router_datadog", "counter")
+	r.Metrics.Register("incoming_router_otlp_streamed", "counter")
+	r.Metrics.Register("incoming_router_otlp_rejected_spans", "counter")
+	r.Metrics.Register("incoming_router_redacted_attributes", "counter")
+	r.Metrics.Register("ingest_paused", "gauge")
+	r.Metrics.Register("incoming_router_rejected_queue_full", "counter")
+	r.Metrics.Register("incoming_router_rejected_memory_full", "counter")
+	r.Metrics.Register("decision_query_requests", "counter")
+	r.Metrics.Register("decision_query_trace_ids", "counter")
+	r.Metrics.Register("sample_preview_requests", "counter")
+	r.Metrics.Register("sampler_keys_requests", "counter")
 	r.Metrics.Register("is_alive", "gauge")
 	r.Metrics.Register("is_ready", "gauge")
+	r.registerIngestMetrics()
+
+	if maxRequests := r.Config.GetHTTPMaxConcurrentRequests(); maxRequests > 0 {
+		r.inflight = make(chan struct{}, maxRequests)
+	}
 
 	muxxer := mux.NewRouter()
 
@@ -150,20 +223,85 @@ func (r *Router) LnS() {
 	// answer a basic health check locally
 	muxxer.HandleFunc("/alive", r.alive).Name("local health")
 	muxxer.HandleFunc("/ready", r.ready).Name("local readiness")
+	muxxer.HandleFunc("/health", r.health).Name("local subsystem health")
 	muxxer.HandleFunc("/panic", r.panic).Name("intentional panic")
 	muxxer.HandleFunc("/version", r.version).Name("report version info")
+	muxxer.HandleFunc(peer.CapabilitiesPath, r.getPeerVersion).Methods("GET").Name("report capabilities to peers")
+
+	// the query, debug, and admin endpoints are served by their own listener
+	// if one is configured, so that they can be bound to a private address
+	adminCfg := r.Config.GetListenerConfig(config.ListenerAdmin)
+	privateMuxxer := muxxer
+	if adminCfg.ListenAddr != "" {
+		privateMuxxer = mux.NewRouter()
+		privateMuxxer.Use(r.setResponseHeaders)
+		privateMuxxer.Use(r.requestLogger)
+		privateMuxxer.Use(r.panicCatcher)
+		privateMuxxer.HandleFunc("/alive", r.alive).Name("local health")
+		privateMuxxer.HandleFunc("/ready", r.ready).Name("local readiness")
+		privateMuxxer.HandleFunc("/health", r.health).Name("local subsystem health")
+		privateMuxxer.HandleFunc("/version", r.version).Name("report version info")
+	}
 
 	// require a local auth for query usage
-	queryMuxxer := muxxer.PathPrefix("/query/").Methods("GET").Subrouter()
+	queryMuxxer := privateMuxxer.PathPrefix("/query/").Methods("GET").Subrouter()
 	queryMuxxer.Use(r.queryTokenChecker)
 
 	queryMuxxer.HandleFunc("/trace/{traceID}", r.debugTrace).Name("get debug information for given trace ID")
 	queryMuxxer.HandleFunc("/rules/{format}/{dataset}", r.getSamplerRules).Name("get formatted sampler rules for given dataset")
 	queryMuxxer.HandleFunc("/allrules/{format}", r.getAllSamplerRules).Name("get formatted sampler rules for all datasets")
 	queryMuxxer.HandleFunc("/configmetadata", r.getConfigMetadata).Name("get configuration metadata")
+	queryMuxxer.HandleFunc("/budgets", r.getBudgetReports).Name("get per-key rates of budget samplers")
+
+	// bulk decision lookups are a POST so that large lists of trace IDs fit in the body
+	decisionMuxxer := privateMuxxer.PathPrefix("/query/").Methods("POST").Subrouter()
+	decisionMuxxer.Use(r.queryTokenChecker)
+	decisionMuxxer.HandleFunc("/decisions", r.getTraceDecisions).Name("get trace decisions for a list of trace IDs")
+
+	// sampler debugging uses the same token as the query endpoints
+	debugMuxxer := privateMuxxer.PathPrefix("/debug/").Subrouter()
+	debugMuxxer.Use(r.queryTokenChecker)
+	debugMuxxer.HandleFunc("/sample-preview", r.samplePreview).Methods("POST").Name("preview the sampling decision for a described trace")
+	debugMuxxer.HandleFunc("/sampler-keys", r.getSamplerKeys).Methods("GET").Name("get the keys and rates of the sampler for a dataset")
+	debugMuxxer.HandleFunc("/profiles", r.listProfiles).Methods("GET").Name("list the profiles captured under stress")
+	debugMuxxer.HandleFunc("/profiles/{name}", r.getProfile).Methods("GET").Name("download a profile captured under stress")
+	debugMuxxer.HandleFunc("/crashes", r.getCrashReports).Methods("GET").Name("get reports of recent panics in Refinery's goroutines")
+	debugMuxxer.HandleFunc("/stress", r.getStress).Methods("GET").Name("get the stress level and the score of each contributor to it")
+
+	// admin operations use the same token as the query endpoints
+	adminMuxxer := privateMuxxer.PathPrefix("/admin/").Subrouter()
+	adminMuxxer.Use(r.queryTokenChecker)
+
+	adminMuxxer.HandleFunc("/ingest/pause", r.pauseIngest).Methods("POST").Name("pause ingestion")
+	adminMuxxer.HandleFunc("/ingest/resume", r.resumeIngest).Methods("POST").Name("resume ingestion")
+	adminMuxxer.HandleFunc("/ingest/status", r.ingestStatus).Methods("GET").Name("get ingestion pause status")
+	adminMuxxer.HandleFunc("/drain", r.beginDrain).Methods("POST").Name("drain this node for maintenance")
+	adminMuxxer.HandleFunc("/drain", r.endDrain).Methods("DELETE").Name("end maintenance mode on this node")
+	adminMuxxer.HandleFunc("/drain/status", r.drainStatus).Methods("GET").Name("get the progress of draining this node")
+	adminMuxxer.HandleFunc("/ingest/accounting", r.ingestAccountingReport).Methods("GET").Name("get ingest traffic by route, API key, and dataset")
+	adminMuxxer.HandleFunc("/late-spans", r.lateSpanReport).Methods("GET").Name("get spans that arrived after their trace was decided, by dataset and service")
+	adminMuxxer.HandleFunc("/evictions", r.evictionReport).Methods("GET").Name("get recent evictions from the trace cache")
+	adminMuxxer.HandleFunc("/cluster", r.getClusterStatus).Methods("GET").Name("get cluster status")
+	adminMuxxer.HandleFunc("/redis/cleanup", r.cleanupRedisKeys).Methods("POST").Name("delete stale trace state keys from redis")
+	adminMuxxer.HandleFunc("/cluster/federated", r.getFederatedClusterStatus).Methods("GET").Name("get status of all federated clusters")
+	adminMuxxer.HandleFunc("/config/reload", r.reloadConfig).Methods("POST").Name("reload and validate the configuration and rules")
+	adminMuxxer.HandleFunc("/config/history", r.getConfigHistory).Methods("GET").Name("get the recent versions of the configuration and what changed in each")
+	adminMuxxer.HandleFunc("/config/validate", r.validateConfig).Methods("POST").Name("validate a candidate configuration and rules without applying them")
+	adminMuxxer.HandleFunc("/config/schema/{kind}", r.getConfigSchema).Methods("GET").Name("get the JSON schema for config or rules files")
+	adminMuxxer.HandleFunc("/stress_relief/override", r.overrideStressRelief).Methods("PUT").Name("force stress relief on or off across the cluster")
+	adminMuxxer.HandleFunc("/stress_relief/override", r.clearStressReliefOverride).Methods("DELETE").Name("clear the stress relief override across the cluster")
+	adminMuxxer.HandleFunc("/flags", r.listFeatureFlags).Methods("GET").Name("get the state of every feature flag")
+	adminMuxxer.HandleFunc("/flags/{name}", r.overrideFeatureFlag).Methods("PUT").Name("override a feature flag across the cluster")
+	adminMuxxer.HandleFunc("/flags/{name}", r.clearFeatureFlag).Methods("DELETE").Name("clear a feature flag override across the cluster")
+	adminMuxxer.HandleFunc("/log_levels", r.getLogLevels).Methods("GET").Name("get the log level of each subsystem")
+	adminMuxxer.HandleFunc("/log_levels/{subsystem}", r.setLogLevel).Methods("PUT").Name("set the log level of a subsystem on this node")
+	adminMuxxer.HandleFunc("/log_levels/{subsystem}", r.clearLogLevel).Methods("DELETE").Name("return a subsystem to the default log level on this node")
 
 	// require an auth header for events and batches
 	authedMuxxer := muxxer.PathPrefix("/1/").Methods("POST").Subrouter()
+	authedMuxxer.Use(r.accountIngest)
+	authedMuxxer.Use(r.ingestLimiter)
+	authedMuxxer.Use(r.clientCertAuth)
 	authedMuxxer.Use(r.apiKeyChecker)
 
 	// handle events and batches
@@ -173,33 +311,66 @@ func (r *Router) LnS() {
 	// require an auth header for OTLP requests
 	r.AddOTLPMuxxer(muxxer)
 
+	// require an auth header for zipkin ingest
+	zipkinMuxxer := muxxer.PathPrefix("/api/v2/").Methods("POST").Subrouter()
+	zipkinMuxxer.Use(r.accountIngest)
+	zipkinMuxxer.Use(r.ingestLimiter)
+	zipkinMuxxer.Use(r.clientCertAuth)
+	zipkinMuxxer.Use(r.apiKeyChecker)
+	zipkinMuxxer.HandleFunc("/spans", r.postZipkin).Name("zipkin")
+
+	// X-Ray SDKs can't send an API key, so one may be configured for them
+	if r.Config.GetXRayConfig().Enabled {
+		xrayMuxxer := muxxer.Path("/TraceSegments").Methods("POST").Subrouter()
+		xrayMuxxer.Use(r.accountIngest)
+		xrayMuxxer.Use(r.ingestLimiter)
+		xrayMuxxer.Use(r.clientCertAuth)
+		xrayMuxxer.Use(r.fallbackAPIKey(func() string { return r.Config.GetXRayConfig().APIKey }))
+		xrayMuxxer.Use(r.apiKeyChecker)
+		xrayMuxxer.HandleFunc("", r.putTraceSegments).Name("xray")
+	}
+
+	// Datadog tracers can't send an API key either
+	if r.Config.GetDatadogConfig().Enabled {
+		datadogMuxxer := muxxer.Path("/{version:v0\\.[47]}/traces").Methods("POST", "PUT").Subrouter()
+		datadogMuxxer.Use(r.accountIngest)
+		datadogMuxxer.Use(r.ingestLimiter)
+		datadogMuxxer.Use(r.clientCertAuth)
+		datadogMuxxer.Use(r.fallbackAPIKey(func() string { return r.Config.GetDatadogConfig().APIKey }))
+		datadogMuxxer.Use(r.apiKeyChecker)
+		datadogMuxxer.HandleFunc("", r.postDatadogTraces).Name("datadog")
+	}
+
 	// pass everything else through unmolested
 	muxxer.PathPrefix("/").HandlerFunc(r.proxy).Name("proxy")
 
-	listenAddr := r.Config.GetListenAddr()
+	httpCfg := r.Config.GetListenerConfig(config.ListenerHTTP)
+	listenAddr := httpCfg.ListenAddr
+	// GRPC listen addr is optional
+	grpcCfg := r.Config.GetListenerConfig(config.ListenerGRPC)
+	grpcAddr := grpcCfg.ListenAddr
+
+	tlsConfig, err := r.loadTLSConfig(httpCfg)
 	if err != nil {
-		r.iopLogger.Error().Logf("failed to get listen addr config: %s", err)
-		return
+		return fmt.Errorf("failed to set up TLS for the HTTP listener: %w", err)
 	}
-	// GRPC listen addr is optional, err means addr was not empty and invalid
-	grpcAddr := r.Config.GetGRPCListenAddr()
+	grpcTLSConfig, err := r.loadTLSConfig(grpcCfg)
 	if err != nil {
-		r.iopLogger.Error().Logf("failed to get grpc listen addr config: %s", err)
-		return
+		return fmt.Errorf("failed to set up TLS for the gRPC listener: %w", err)
 	}
 
 	r.iopLogger.Info().Logf("Listening on %s", listenAddr)
-	r.server = &http.Server{
-		Addr:        listenAddr,
-		Handler:     muxxer,
-		IdleTimeout: r.Config.GetHTTPIdleTimeout(),
+	r.server = newHTTPServer(httpCfg, muxxer, tlsConfig)
+	if err := r.configureHTTP2(r.server, tlsConfig != nil); err != nil {
+		return fmt.Errorf("failed to configure HTTP/2: %w", err)
 	}
 
 	r.donech = make(chan struct{})
+	r.shareClusterStatus()
 	if r.Config.GetGRPCEnabled() && len(grpcAddr) > 0 {
-		l, err := net.Listen("tcp", grpcAddr)
+		l, err := r.listen(grpcAddr, r.Config.GetProxyProtocolConfig().GRPC, grpcCfg.MaxConnections)
 		if err != nil {
-			r.iopLogger.Error().Logf("failed to listen to grpc addr: " + grpcAddr)
+			return fmt.Errorf("failed to listen to grpc addr %s: %w", grpcAddr, err)
 		}
 
 		r.iopLogger.Info().Logf("gRPC listening on %s", grpcAddr)
@@ -208,13 +379,26 @@ func (r *Router) LnS() {
 			grpc.MaxSendMsgSize(int(grpcConfig.MaxSendMsgSize)),
 			grpc.MaxRecvMsgSize(int(grpcConfig.MaxRecvMsgSize)),
 			grpc.KeepaliveParams(keepalive.ServerParameters{
-				MaxConnectionIdle:     time.Duration(grpcConfig.MaxConnectionIdle),
+				MaxConnectionIdle:     time.Duration(grpcCfg.IdleTimeout),
 				MaxConnectionAge:      time.Duration(grpcConfig.MaxConnectionAge),
 				MaxConnectionAgeGrace: time.Duration(grpcConfig.MaxConnectionAgeGrace),
 				Time:                  time.Duration(grpcConfig.KeepAlive),
 				Timeout:               time.Duration(grpcConfig.KeepAliveTimeout),
 			}),
 		}
+		if grpcConfig.MaxConcurrentStreams > 0 {
+			serverOpts = append(serverOpts, grpc.MaxConcurrentStreams(grpcConfig.MaxConcurrentStreams))
+		}
+		if grpcCfg.ReadTimeout > 0 {
+			// gRPC has no per-request read timeout; this bounds the handshake
+			serverOpts = append(serverOpts, grpc.ConnectionTimeout(time.Duration(grpcCfg.ReadTimeout)))
+		}
+		if grpcTLSConfig != nil {
+			serverOpts = append(serverOpts,
+				grpc.Creds(credentials.NewTLS(grpcTLSConfig)),
+				grpc.UnaryInterceptor(r.clientCertUnaryInterceptor),
+			)
+		}
 		traceServer := NewTraceServer(r)
 		r.grpcServer = grpc.NewServer(serverOpts...)
 		collectortrace.RegisterTraceServiceServer(r.grpcServer, traceServer)
@@ -224,20 +408,99 @@ func (r *Router) LnS() {
 		grpc_health_v1.RegisterHealthServer(r.grpcServer, r.hsrv)
 		go r.healthchecker()
 
+		// reflection lets tools like grpcurl discover the services without
+		// needing a local copy of the proto files
+		reflection.Register(r.grpcServer)
+
 		go r.grpcServer.Serve(l)
 	}
 
+	if xrayCfg := r.Config.GetXRayConfig(); xrayCfg.Enabled {
+		r.xrayConn, err = net.ListenPacket("udp", xrayCfg.UDPListenAddr)
+		if err != nil {
+			r.iopLogger.Error().Logf("failed to listen for X-Ray segments on %s: %s", xrayCfg.UDPListenAddr, err)
+		} else {
+			r.iopLogger.Info().Logf("X-Ray UDP listening on %s", xrayCfg.UDPListenAddr)
+			r.doneWG.Add(1)
+			go r.listenXRayUDP(r.xrayConn)
+		}
+	}
+
+	r.serve(r.server, httpCfg, r.Config.GetProxyProtocolConfig().HTTP)
+
+	if adminCfg.ListenAddr != "" {
+		adminTLSConfig, err := r.loadTLSConfig(adminCfg)
+		if err != nil {
+			return fmt.Errorf("failed to set up TLS for the admin listener: %w", err)
+		}
+		r.iopLogger.Info().Logf("Admin endpoints listening on %s", adminCfg.ListenAddr)
+		r.adminServer = newHTTPServer(adminCfg, privateMuxxer, adminTLSConfig)
+		r.serve(r.adminServer, adminCfg, false)
+	}
+	return nil
+}
+
+// newHTTPServer returns a server for a listener's address, timeouts, and
+// TLS config.
+func newHTTPServer(cfg config.ListenerConfig, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+		TLSConfig:    tlsConfig,
+	}
+}
+
+// serve listens on a listener's address and serves HTTP on it until the
+// server is shut down.
+func (r *Router) serve(server *http.Server, cfg config.ListenerConfig, proxyProtocol bool) {
 	r.doneWG.Add(1)
 	go func() {
 		defer r.doneWG.Done()
 
-		err = r.server.ListenAndServe()
+		l, err := r.listen(cfg.ListenAddr, proxyProtocol, cfg.MaxConnections)
+		if err == nil {
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(l, "", "")
+			} else {
+				err = server.Serve(l)
+			}
+		}
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			r.iopLogger.Error().Logf("failed to ListenAndServe: %s", err)
+			r.iopLogger.Error().Logf("failed to ListenAndServe on %s: %s", cfg.ListenAddr, err)
 		}
 	}()
 }
 
+// listen opens a TCP listener, which accepts PROXY protocol headers if
+// proxyProtocol is set, and at most maxConns connections at once if it's
+// positive.
+func (r *Router) listen(addr string, proxyProtocol bool, maxConns int) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if maxConns > 0 {
+		l = netutil.LimitListener(l, maxConns)
+	}
+	if !proxyProtocol {
+		return l, nil
+	}
+	cfg := r.Config.GetProxyProtocolConfig()
+	pl, err := newProxyProtoListener(l, cfg.TrustedProxies, time.Duration(cfg.HeaderTimeout))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if len(cfg.TrustedProxies) == 0 {
+		r.iopLogger.Warn().Logf("PROXY protocol is enabled on %s but no TrustedProxies are set, so no headers will be read", addr)
+	}
+	r.iopLogger.Info().Logf("accepting PROXY protocol headers on %s", addr)
+	return pl, nil
+}
+
 func (r *Router) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -246,9 +509,22 @@ func (r *Router) Stop() error {
 	if err != nil {
 		return err
 	}
+	if r.adminServer != nil {
+		if err := r.adminServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if r.hsrv != nil {
+		// report NOT_SERVING for everything so that load balancers stop
+		// sending new work while in-flight requests drain
+		r.hsrv.Shutdown()
+	}
 	if r.grpcServer != nil {
 		r.grpcServer.GracefulStop()
 	}
+	if r.xrayConn != nil {
+		r.xrayConn.Close()
+	}
 	close(r.donech)
 	r.doneWG.Wait()
 	return nil
@@ -272,12 +548,45 @@ func (r *Router) ready(w http.ResponseWriter, req *http.Request) {
 
 	ready := r.Health.IsReady()
 	r.Metrics.Gauge("is_ready", ready)
+	subsystems := r.Health.Subsystems()
 	if !ready {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		r.marshalToFormat(w, map[string]interface{}{"source": "refinery", "ready": "no"}, "json")
+		r.marshalToFormat(w, map[string]interface{}{"source": "refinery", "ready": "no", "subsystems": subsystems}, "json")
 		return
 	}
-	r.marshalToFormat(w, map[string]interface{}{"source": "refinery", "ready": "yes"}, "json")
+	r.marshalToFormat(w, map[string]interface{}{"source": "refinery", "ready": "yes", "subsystems": subsystems}, "json")
+}
+
+// health reports the status of every subsystem. Unlike /ready, it only
+// fails when Refinery isn't alive, so that a degraded or unready Refinery can
+// still be inspected through it.
+func (r *Router) health(w http.ResponseWriter, req *http.Request) {
+	r.iopLogger.Debug().Logf("answered /health check")
+
+	alive := r.Health.IsAlive()
+	ready := r.Health.IsReady()
+	subsystems := r.Health.Subsystems()
+
+	status := health.StatusOK
+	for _, sub := range subsystems {
+		if sub.Status != health.StatusOK {
+			status = health.StatusDegraded
+		}
+	}
+	if !alive || !ready {
+		status = health.StatusFailed
+	}
+
+	if !alive {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	r.marshalToFormat(w, map[string]interface{}{
+		"source":     "refinery",
+		"status":     status,
+		"alive":      alive,
+		"ready":      ready,
+		"subsystems": subsystems,
+	}, "json")
 }
 
 func (r *Router) panic(w http.ResponseWriter, req *http.Request) {
@@ -307,7 +616,9 @@ func (r *Router) getSamplerRules(w http.ResponseWriter, req *http.Request) {
 
 func (r *Router) getAllSamplerRules(w http.ResponseWriter, req *http.Request) {
 	format := strings.ToLower(mux.Vars(req)["format"])
-	cfgs := r.Config.GetAllSamplerRules()
+	// tenants' API keys are redacted like keys in logs, since the rules are
+	// served to anyone who has the query token
+	cfgs := r.Config.GetAllSamplerRules().RedactTenantKeys(r.redactKey)
 	r.marshalToFormat(w, cfgs, format)
 }
 
@@ -316,6 +627,12 @@ func (r *Router) getConfigMetadata(w http.ResponseWriter, req *http.Request) {
 	r.marshalToFormat(w, cm, "json")
 }
 
+// getBudgetReports handles GET /query/budgets, reporting how each budget
+// sampler divided its goal between keys in its last interval.
+func (r *Router) getBudgetReports(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.SamplerFactory.BudgetReports(), "json")
+}
+
 func (r *Router) marshalToFormat(w http.ResponseWriter, obj interface{}, format string) {
 	var body []byte
 	var err error
@@ -497,6 +814,32 @@ func (r *Router) batch(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *Router) processEvent(ev *types.Event, reqID interface{}) error {
+	return r.processEventWithDeadline(ev, reqID, time.Time{})
+}
+
+// processEventWithDeadline is processEvent, except that if the collector's
+// queue is full it keeps trying to add the span until the deadline.
+func (r *Router) processEventWithDeadline(ev *types.Event, reqID interface{}, deadline time.Time) (err error) {
+	ctx := ev.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// this is on the path of every span, so the fields are only built for a
+	// span that's sampled
+	_, processSpan := otelutil.StartSpan(ctx, r.tracer(), "Router.processEvent")
+	if processSpan.IsRecording() {
+		otelutil.AddSpanFields(processSpan, map[string]interface{}{
+			"dataset":     ev.Dataset,
+			"environment": ev.Environment,
+		})
+	}
+	defer func() {
+		if err != nil {
+			otelutil.AddException(processSpan, err)
+		}
+		processSpan.End()
+	}()
+
 	debugLog := r.iopLogger.Debug().
 		WithField("request_id", reqID).
 		WithString("api_host", ev.APIHost).
@@ -509,33 +852,48 @@ func (r *Router) processEvent(ev *types.Event, reqID interface{}) error {
 		return nil
 	}
 
+	r.applyRedaction(ev)
+	r.applyAttributeHints(ev)
+
 	// extract trace ID
-	var traceID string
-	for _, traceIdFieldName := range r.Config.GetTraceIdFieldNames() {
-		if trID, ok := ev.Data[traceIdFieldName]; ok {
-			traceID = trID.(string)
-			break
-		}
-	}
+	idRules := r.Config.GetIDFieldRules(ev.Dataset)
+	traceID, traceIDField := r.extractID(ev.Data, idRules.TraceNames, idRules.TraceTransform)
 	if traceID == "" {
 		// not part of a trace. send along upstream
 		r.Metrics.Increment("incoming_router_nonspan")
 		debugLog.WithString("api_host", ev.APIHost).
 			WithString("dataset", ev.Dataset).
 			Logf("sending non-trace event from batch")
+		config.StripScopedAttributes(ev.Data)
 		r.UpstreamTransmission.EnqueueEvent(ev)
+		r.recordIngestEvent(ev, false, nil)
 		return nil
 	}
 
+	if idRules.TraceTransform != "" {
+		// so that Honeycomb sees the same trace ID we do
+		ev.Data[traceIDField] = traceID
+	}
+
 	uniqueID := types.GenerateSpanID()
 	debugLog = debugLog.WithString("trace_id", traceID).WithString("unique_id", uniqueID)
+	if processSpan.IsRecording() {
+		otelutil.AddSpanField(processSpan, "trace_id", traceID)
+	}
 
 	// check if this is a root span; if we can't find a parent ID, it is.
 	isRoot := true
-	for _, parentIdFieldName := range r.Config.GetParentIdFieldNames() {
-		if _, hasParent := ev.Data[parentIdFieldName]; hasParent {
+	if idRules.ParentTransform != "" {
+		if parentID, parentIDField := r.extractID(ev.Data, idRules.ParentNames, idRules.ParentTransform); parentID != "" {
+			ev.Data[parentIDField] = parentID
 			isRoot = false
-			break
+		}
+	} else {
+		for _, parentIdFieldName := range idRules.ParentNames {
+			if _, hasParent := ev.Data[parentIdFieldName]; hasParent {
+				isRoot = false
+				break
+			}
 		}
 	}
 
@@ -555,21 +913,25 @@ func (r *Router) processEvent(ev *types.Event, reqID interface{}) error {
 	if r.Collector.Stressed() {
 		processed, err := r.Collector.ProcessSpanImmediately(span)
 		if err != nil {
+			r.recordIngestEvent(ev, true, err)
 			return err
 		}
 		if processed {
+			r.recordIngestEvent(ev, true, nil)
 			return nil
 		}
 	}
 
 	// we're supposed to handle it normally
-	if err := r.Collector.AddSpan(span); err != nil {
+	if err := r.addSpanBefore(span, deadline); err != nil {
 		r.Metrics.Increment("incoming_router_dropped")
+		r.recordIngestEvent(ev, true, err)
 		debugLog.Logf("Dropping span from batch, channel full")
 		return err
 	}
 
 	r.Metrics.Increment("incoming_router_span")
+	r.recordIngestEvent(ev, true, nil)
 
 	debugLog.WithField("source", "incoming").Logf("Accepting span from batch for collection into a trace")
 	return nil
@@ -606,6 +968,12 @@ func (r *Router) getMaybeCompressedBody(req *http.Request) (io.Reader, error) {
 			return nil, err
 		}
 
+		reader = buf
+	case transmit.SnappyFramedEncoding:
+		buf := &bytes.Buffer{}
+		if _, err := io.Copy(buf, s2.NewReader(req.Body)); err != nil {
+			return nil, err
+		}
 		reader = buf
 	default:
 		reader = req.Body
@@ -815,19 +1183,45 @@ func (c *environmentCache) addItem(key string, value string, ttl time.Duration)
 	}
 }
 
-type TeamInfo struct {
-	Slug string `json:"slug"`
+// isAPIKeyAccepted checks the key against the configured access rules. When
+// ValidateUnknownKeys is on, keys that aren't listed are checked with the
+// upstream API instead of being rejected outright.
+func (r *Router) isAPIKeyAccepted(ctx context.Context, apiKey string) bool {
+	if r.Config.IsAPIKeyValid(apiKey) {
+		return true
+	}
+
+	akc := r.Config.GetAccessKeyConfig()
+	if !akc.ValidateUnknownKeys || akc.IsDenied(apiKey) || r.KeyValidator == nil {
+		return false
+	}
+
+	info, err := r.KeyValidator.Lookup(ctx, apiKey)
+	if err != nil {
+		r.Logger.Error().Logf("unable to validate api key: %s", err)
+		return false
+	}
+	return info.Valid
 }
 
-type EnvironmentInfo struct {
-	Slug string `json:"slug"`
-	Name string `json:"name"`
+// quarantineError returns an error if the key is quarantined because upstream
+// has been rejecting it.
+func (r *Router) quarantineError(apiKey string) error {
+	if r.KeyQuarantine == nil {
+		return nil
+	}
+	until, quarantined := r.KeyQuarantine.QuarantinedUntil(apiKey)
+	if !quarantined {
+		return nil
+	}
+	return fmt.Errorf("api key %s is being rejected by Honeycomb; refusing data for it until %s", r.redactKey(apiKey), until.Format(time.RFC3339))
 }
 
-type AuthInfo struct {
-	APIKeyAccess map[string]bool `json:"api_key_access"`
-	Team         TeamInfo        `json:"team"`
-	Environment  EnvironmentInfo `json:"environment"`
+// redactKey returns a form of the API key that is safe to log or return in
+// an error message.
+func (r *Router) redactKey(apiKey string) string {
+	akc := r.Config.GetAccessKeyConfig()
+	return apikeys.NewRedactor(akc.KeyRedaction, akc.KeyRedactionSalt).Redact(apiKey)
 }
 
 func (r *Router) getEnvironmentName(apiKey string) (string, error) {
@@ -842,51 +1236,49 @@ func (r *Router) getEnvironmentName(apiKey string) (string, error) {
 	return env, nil
 }
 
+// lookupEnvironment gets the key's environment name from the key validator,
+// so that a key is only sent to /1/auth once for both purposes.
 func (r *Router) lookupEnvironment(apiKey string) (string, error) {
-	apiEndpoint := r.Config.GetHoneycombAPI()
-	authURL, err := url.Parse(apiEndpoint)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse Honeycomb API URL config value. %w", err)
-	}
-
-	authURL.Path = "/1/auth"
-	req, err := http.NewRequest("GET", authURL.String(), nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create AuthInfo request. %w", err)
-	}
-
-	req.Header.Set("x-Honeycomb-team", apiKey)
-
-	r.Logger.Debug().WithString("endpoint", authURL.String()).Logf("Attempting to get environment name using API key")
-	resp, err := r.proxyClient.Do(req)
+	info, err := r.KeyValidator.Lookup(context.Background(), apiKey)
 	if err != nil {
-		return "", fmt.Errorf("failed sending AuthInfo request to Honeycomb API. %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
-
-	switch {
-	case resp.StatusCode == http.StatusUnauthorized:
+	if !info.Valid {
 		return "", fmt.Errorf("received 401 response for AuthInfo request from Honeycomb API - check your API key")
-	case resp.StatusCode > 299:
-		return "", fmt.Errorf("received %d response for AuthInfo request from Honeycomb API", resp.StatusCode)
 	}
-
-	authinfo := AuthInfo{}
-	if err := json.NewDecoder(resp.Body).Decode(&authinfo); err != nil {
-		return "", fmt.Errorf("failed to JSON decode of AuthInfo response from Honeycomb API")
-	}
-	r.Logger.Debug().WithString("environment", authinfo.Environment.Name).Logf("Got environment")
-	return authinfo.Environment.Name, nil
+	r.Logger.Debug().WithString("environment", info.Environment).Logf("Got environment")
+	return info.Environment, nil
 }
 
 // healthchecker is a goroutine that periodically checks the health of the system and updates the grpc health server
 func (r *Router) healthchecker() {
+	r.iopLogger.Debug().Logf("running grpc health monitor")
+
+	go func() {
+		// TODO: Does this time need to be configurable?
+		watchticker := time.NewTicker(3 * time.Second)
+		defer watchticker.Stop()
+		for {
+			select {
+			case <-watchticker.C:
+				r.updateGRPCHealth()
+			case <-r.donech:
+				return
+			}
+		}
+	}()
+}
+
+// updateGRPCHealth copies the current health of the system into the grpc
+// health server. Besides the overall status, the OTLP trace service reports
+// its own status so that clients checking it by name stop sending while
+// ingestion is paused.
+func (r *Router) updateGRPCHealth() {
 	const (
 		system      = "" // empty string represents the generic health of the whole system (corresponds to "ready")
 		systemReady = "ready"
 		systemAlive = "alive"
 	)
-	r.iopLogger.Debug().Logf("running grpc health monitor")
 
 	setStatus := func(svc string, stat bool) {
 		if stat {
@@ -896,31 +1288,23 @@ func (r *Router) healthchecker() {
 		}
 	}
 
-	go func() {
-		// TODO: Does this time need to be configurable?
-		watchticker := time.NewTicker(3 * time.Second)
-		defer watchticker.Stop()
-		for {
-			select {
-			case <-watchticker.C:
-				alive := r.Health.IsAlive()
-				ready := r.Health.IsReady()
+	alive := r.Health.IsAlive()
+	ready := r.Health.IsReady()
 
-				// we can just update everything because the grpc health server will only send updates if the status changes
-				setStatus(systemReady, ready)
-				setStatus(systemAlive, alive)
-				setStatus(system, ready && alive)
-			case <-r.donech:
-				return
-			}
-		}
-	}()
+	// we can just update everything because the grpc health server will only send updates if the status changes
+	setStatus(systemReady, ready)
+	setStatus(systemAlive, alive)
+	setStatus(system, ready && alive)
+	setStatus(collectortrace.TraceService_ServiceDesc.ServiceName, ready && alive && !r.ingestPause.isPaused() && !r.Drainer.Draining())
 }
 
 // AddOTLPMuxxer adds muxxer for OTLP requests
 func (r *Router) AddOTLPMuxxer(muxxer *mux.Router) {
 	// require an auth header for OTLP requests
 	otlpMuxxer := muxxer.PathPrefix("/v1/").Methods("POST").Subrouter()
+	otlpMuxxer.Use(r.accountIngest)
+	otlpMuxxer.Use(r.ingestLimiter)
+	otlpMuxxer.Use(r.clientCertAuth)
 
 	// handle OTLP trace requests
 	otlpMuxxer.HandleFunc("/traces", r.postOTLP).Name("otlp")
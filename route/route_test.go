@@ -3,12 +3,16 @@ package route
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +22,10 @@ import (
 	"github.com/honeycombio/refinery/collect/cache"
 	"github.com/honeycombio/refinery/collect/stressRelief"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/decisionexport"
+	"github.com/honeycombio/refinery/internal/dropaudit"
 	"github.com/honeycombio/refinery/internal/gossip"
 	"github.com/honeycombio/refinery/internal/health"
 	"github.com/honeycombio/refinery/internal/peer"
@@ -26,6 +34,7 @@ import (
 	"github.com/honeycombio/refinery/redis"
 	"github.com/honeycombio/refinery/sample"
 	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -36,8 +45,11 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/honeycombio/refinery/sharder"
+	"github.com/klauspost/compress/s2"
 	"github.com/klauspost/compress/zstd"
 	"github.com/vmihailenco/msgpack/v5"
+	healthserver "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/encoding/protojson"
 )
@@ -110,6 +122,28 @@ func TestDecompression(t *testing.T) {
 		t.Errorf("unexpected err: %s", err.Error())
 	}
 
+	b, err = io.ReadAll(reader)
+	if err != nil {
+		t.Errorf("unexpected err: %s", err.Error())
+	}
+	if string(b) != payload {
+		t.Errorf("%s != %s", string(b), payload)
+	}
+	buf = &bytes.Buffer{}
+	snappyW := s2.NewWriter(buf, s2.WriterSnappyCompat())
+	_, err = snappyW.Write([]byte(payload))
+	if err != nil {
+		t.Errorf("unexpected err: %s", err.Error())
+	}
+	snappyW.Close()
+
+	req.Body = io.NopCloser(buf)
+	req.Header.Set("Content-Encoding", transmit.SnappyFramedEncoding)
+	reader, err = router.getMaybeCompressedBody(req)
+	if err != nil {
+		t.Errorf("unexpected err: %s", err.Error())
+	}
+
 	b, err = io.ReadAll(reader)
 	if err != nil {
 		t.Errorf("unexpected err: %s", err.Error())
@@ -387,7 +421,7 @@ func TestDebugAllRules(t *testing.T) {
 	}{
 		{
 			format: "json",
-			expect: `{"rulesversion":0,"samplers":{"dataset1":{"deterministicsampler":{"samplerate":0},"rulesbasedsampler":null,"dynamicsampler":null,"emadynamicsampler":null,"emathroughputsampler":null,"windowedthroughputsampler":null,"totalthroughputsampler":null}}}`,
+			expect: `{"rulesversion":0,"samplers":{"dataset1":{"deterministicsampler":{"samplerate":0},"rulesbasedsampler":null,"dynamicsampler":null,"emadynamicsampler":null,"emathroughputsampler":null,"windowedthroughputsampler":null,"totalthroughputsampler":null,"clusterthroughputsampler":null,"budgetsampler":null,"latencysampler":null,"compositesampler":null}}}`,
 		},
 		{
 			format: "toml",
@@ -506,6 +540,11 @@ func TestDependencyInjection(t *testing.T) {
 		&inject.Object{Value: &cache.CuckooSentCache{}},
 		&inject.Object{Value: &health.Health{}},
 		&inject.Object{Value: &gossip.InMemoryGossip{}, Name: "gossip"},
+		&inject.Object{Value: &decisionexport.NullExporter{}},
+		&inject.Object{Value: &dropaudit.NullAuditor{}},
+		&inject.Object{Value: &types.RandomIDGenerator{}},
+		&inject.Object{Value: &clustercount.LocalCounter{}},
+		&inject.Object{Value: &apikeys.LocalCache{}},
 	)
 	if err != nil {
 		t.Error(err)
@@ -599,3 +638,204 @@ func TestEnvironmentCache(t *testing.T) {
 		}
 	})
 }
+
+func TestIsAPIKeyAccepted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("x-Honeycomb-team") == "upstream-good" {
+			w.Write([]byte(`{"team":{"slug":"t"},"environment":{"slug":"e"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	cfg := &config.MockConfig{
+		GetHoneycombAPIVal: server.URL,
+		IsAPIKeyValidFunc:  func(k string) bool { return k == "listed" },
+		AccessKeys: config.AccessKeyConfig{
+			DeniedKeys:          []string{"denied"},
+			ValidateUnknownKeys: true,
+		},
+	}
+	validator := &apikeys.Validator{
+		Config:        cfg,
+		Logger:        &logger.NullLogger{},
+		Metrics:       &metrics.NullMetrics{},
+		HTTPTransport: http.DefaultTransport.(*http.Transport),
+		Cache:         &apikeys.LocalCache{Clock: clockwork.NewRealClock()},
+	}
+	require.NoError(t, validator.Start())
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, KeyValidator: validator}
+
+	ctx := context.Background()
+	assert.True(t, router.isAPIKeyAccepted(ctx, "listed"))
+	assert.True(t, router.isAPIKeyAccepted(ctx, "upstream-good"))
+	assert.False(t, router.isAPIKeyAccepted(ctx, "upstream-bad"))
+	assert.False(t, router.isAPIKeyAccepted(ctx, "denied"))
+
+	cfg.AccessKeys.ValidateUnknownKeys = false
+	assert.False(t, router.isAPIKeyAccepted(ctx, "upstream-good"))
+}
+
+func TestLookupEnvironmentSharesValidation(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"team":{"slug":"t"},"environment":{"slug":"e","name":"Env"}}`))
+	}))
+	defer server.Close()
+
+	cfg := &config.MockConfig{
+		GetHoneycombAPIVal: server.URL,
+		AccessKeys:         config.AccessKeyConfig{ValidateUnknownKeys: true},
+	}
+	validator := &apikeys.Validator{
+		Config:        cfg,
+		Logger:        &logger.NullLogger{},
+		Metrics:       &metrics.NullMetrics{},
+		HTTPTransport: http.DefaultTransport.(*http.Transport),
+		Cache:         &apikeys.LocalCache{Clock: clockwork.NewRealClock()},
+	}
+	require.NoError(t, validator.Start())
+	router := &Router{Config: cfg, Logger: &logger.NullLogger{}, KeyValidator: validator}
+	router.environmentCache = newEnvironmentCache(time.Minute, router.lookupEnvironment)
+
+	assert.True(t, router.isAPIKeyAccepted(context.Background(), "abc123DEF456ghi789jklm"))
+	env, err := router.getEnvironmentName("abc123DEF456ghi789jklm")
+	require.NoError(t, err)
+	assert.Equal(t, "Env", env)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+type fakeHealthReporter struct {
+	alive, ready bool
+	subsystems   map[string]health.SubsystemStatus
+}
+
+func (f *fakeHealthReporter) IsAlive() bool { return f.alive }
+func (f *fakeHealthReporter) IsReady() bool { return f.ready }
+func (f *fakeHealthReporter) Subsystems() map[string]health.SubsystemStatus {
+	return f.subsystems
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	reporter := &fakeHealthReporter{alive: true, ready: true, subsystems: map[string]health.SubsystemStatus{
+		"receiver": {Status: health.StatusOK, Alive: true, Ready: true, GatesReadiness: true},
+	}}
+	router := &Router{
+		Config:    &config.MockConfig{},
+		Logger:    &logger.NullLogger{},
+		iopLogger: iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		Metrics:   &metrics.NullMetrics{},
+		Health:    reporter,
+	}
+	get := func(handler http.HandlerFunc) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	code, body := get(router.health)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+	assert.Equal(t, "ok", body["subsystems"].(map[string]any)["receiver"].(map[string]any)["status"])
+
+	reporter.subsystems["upstream_transmission"] = health.SubsystemStatus{Status: health.StatusDegraded, Detail: "3 of 4 sends failed", Alive: true, Ready: true}
+	_, body = get(router.health)
+	assert.Equal(t, "degraded", body["status"])
+
+	// an unready Refinery is still healthy enough to report on itself
+	reporter.ready = false
+	code, body = get(router.health)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "failed", body["status"])
+	code, body = get(router.ready)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "no", body["ready"])
+	assert.Len(t, body["subsystems"], 2)
+
+	reporter.alive = false
+	code, _ = get(router.health)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestUpdateGRPCHealth(t *testing.T) {
+	reporter := &fakeHealthReporter{alive: true, ready: true}
+	router := &Router{
+		Config:  &config.MockConfig{MaxIngestPause: time.Minute},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Health:  reporter,
+		hsrv:    healthserver.NewServer(),
+	}
+	traceService := collectortrace.TraceService_ServiceDesc.ServiceName
+
+	check := func(svc string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		resp, err := router.hsrv.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: svc})
+		require.NoError(t, err)
+		return resp.Status
+	}
+
+	router.updateGRPCHealth()
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, check(""))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, check(traceService))
+
+	// pausing ingestion only affects the trace service
+	router.ingestPause.pause(time.Minute, func() {})
+	router.updateGRPCHealth()
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, check(""))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, check(traceService))
+	router.ingestPause.resume()
+
+	reporter.ready = false
+	router.updateGRPCHealth()
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, check(""))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, check("alive"))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, check("ready"))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, check(traceService))
+}
+
+func TestListenMaxConnections(t *testing.T) {
+	router := &Router{
+		Config:    &config.MockConfig{},
+		iopLogger: iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+	}
+	l, err := router.listen("127.0.0.1:0", false, 1)
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// closing the first connection makes room for the second
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("second connection was never accepted")
+	}
+}
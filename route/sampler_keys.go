@@ -0,0 +1,100 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/honeycombio/refinery/sample"
+)
+
+const (
+	defaultSamplerKeysLimit = 100
+	maxSamplerKeysLimit     = 10_000
+)
+
+// samplerKeysPage is a page of the keys of one sampler.
+type samplerKeysPage struct {
+	Target    string                  `json:"target"`
+	Sampler   string                  `json:"sampler"`
+	TotalKeys int                     `json:"total_keys"`
+	Offset    int                     `json:"offset"`
+	Keys      []sample.SamplerKeyStat `json:"keys"`
+}
+
+// getSamplerKeys handles GET /debug/sampler-keys. It reports the keys that
+// the dynamic and throughput samplers for the dataset given by the dataset
+// parameter have seen recently, with the throughput and sample rate of each.
+// Keys are listed in order, a page at a time, using the limit and offset
+// parameters. With the top parameter, the busiest keys are listed instead.
+func (r *Router) getSamplerKeys(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	dataset := query.Get("dataset")
+	if dataset == "" {
+		r.handlerReturnWithError(w, ErrBadSamplerKeysQuery, fmt.Errorf("dataset is required"))
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultSamplerKeysLimit)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadSamplerKeysQuery, fmt.Errorf("invalid limit: %w", err))
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadSamplerKeysQuery, fmt.Errorf("invalid offset: %w", err))
+		return
+	}
+	top, err := queryInt(query.Get("top"), 0)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrBadSamplerKeysQuery, fmt.Errorf("invalid top: %w", err))
+		return
+	}
+	if top > 0 {
+		limit, offset = top, 0
+	}
+	limit = min(limit, maxSamplerKeysLimit)
+
+	reports, ok := r.SamplerFactory.SamplerKeys(dataset)
+	if !ok {
+		r.handlerReturnWithError(w, ErrNoSamplerKeys, fmt.Errorf("dataset %s has no sampler that reports its keys", dataset))
+		return
+	}
+	r.Metrics.Increment("sampler_keys_requests")
+
+	pages := make([]samplerKeysPage, 0, len(reports))
+	for _, report := range reports {
+		keys := report.Keys
+		if top > 0 {
+			sample.SortKeysByThroughput(keys)
+		} else {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+		}
+		start := min(offset, len(keys))
+		end := min(start+limit, len(keys))
+		pages = append(pages, samplerKeysPage{
+			Target:    report.Target,
+			Sampler:   report.Sampler,
+			TotalKeys: len(keys),
+			Offset:    start,
+			Keys:      keys[start:end],
+		})
+	}
+	r.marshalToFormat(w, map[string]interface{}{"samplers": pages}, "json")
+}
+
+// queryInt parses a non-negative integer query parameter, which is def if
+// it's empty.
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%d is negative", n)
+	}
+	return n, nil
+}
@@ -0,0 +1,85 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSamplerKeys(t *testing.T) {
+	conf := &config.MockConfig{
+		GetSamplerTypeVal: &config.DynamicSamplerConfig{SampleRate: 1, FieldList: []string{"http.route"}},
+	}
+	factory := &sample.SamplerFactory{Config: conf, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, factory.Start())
+	defer factory.Stop()
+	sampler := factory.GetSamplerImplementationForKey("production")
+	// route N gets N traces
+	for n := 1; n <= 5; n++ {
+		for i := 0; i < n; i++ {
+			trace := &types.Trace{}
+			trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"http.route": fmt.Sprintf("/%d", n)}}})
+			sampler.GetSampleRate(trace)
+		}
+	}
+
+	router := &Router{
+		Logger:         &logger.NullLogger{},
+		Metrics:        &metrics.NullMetrics{},
+		SamplerFactory: factory,
+	}
+	get := func(query string) (int, []samplerKeysPage) {
+		rr := httptest.NewRecorder()
+		router.getSamplerKeys(rr, httptest.NewRequest("GET", "/debug/sampler-keys?"+query, nil))
+		var resp struct {
+			Samplers []samplerKeysPage `json:"samplers"`
+		}
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		}
+		return rr.Code, resp.Samplers
+	}
+	keys := func(page samplerKeysPage) []string {
+		var keys []string
+		for _, k := range page.Keys {
+			keys = append(keys, k.Key)
+		}
+		return keys
+	}
+
+	code, pages := get("dataset=production&limit=2&offset=1")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, pages, 1)
+	assert.Equal(t, "production", pages[0].Target)
+	assert.Equal(t, "dynamic", pages[0].Sampler)
+	assert.Equal(t, 5, pages[0].TotalKeys)
+	assert.Equal(t, 1, pages[0].Offset)
+	assert.Equal(t, []string{"/2•,", "/3•,"}, keys(pages[0]))
+
+	// top lists the busiest keys
+	code, pages = get("dataset=production&top=2")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"/5•,", "/4•,"}, keys(pages[0]))
+
+	// an offset past the end gives no keys
+	code, pages = get("dataset=production&offset=10")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, pages[0].Keys)
+
+	code, _ = get("dataset=staging")
+	assert.Equal(t, http.StatusNotFound, code)
+	for _, query := range []string{"", "dataset=production&limit=x", "dataset=production&offset=-1"} {
+		code, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/honeycombio/refinery/collect/stressRelief"
+)
+
+type stressStatus struct {
+	Level    uint `json:"level"`
+	Stressed bool `json:"stressed"`
+	// Override is "always" or "never" while stress relief is forced on or
+	// off across the cluster, and empty otherwise.
+	Override     string                                   `json:"override,omitempty"`
+	Contributors map[string]stressRelief.ContributorScore `json:"contributors"`
+}
+
+func (r *Router) stressStatus() stressStatus {
+	status := stressStatus{
+		Level:        r.StressRelief.StressLevel(),
+		Stressed:     r.StressRelief.Stressed(),
+		Contributors: r.StressRelief.Contributors(),
+	}
+	if mode, ok := r.StressRelief.Overridden(); ok {
+		status.Override = mode.String()
+	}
+	return status
+}
+
+// getStress handles GET /debug/stress. It reports the cluster's stress level
+// and the score of each of this node's contributors to it, as of the last
+// calculation.
+func (r *Router) getStress(w http.ResponseWriter, req *http.Request) {
+	r.marshalToFormat(w, r.stressStatus(), "json")
+}
+
+// overrideStressRelief handles PUT /admin/stress_relief/override?mode=always
+// or mode=never, which forces stress relief on or off on every node in the
+// cluster.
+func (r *Router) overrideStressRelief(w http.ResponseWriter, req *http.Request) {
+	var mode stressRelief.StressReliefMode
+	switch param := req.URL.Query().Get("mode"); param {
+	case "always":
+		mode = stressRelief.Always
+	case "never":
+		mode = stressRelief.Never
+	default:
+		r.handlerReturnWithError(w, ErrBadAdminRequest, fmt.Errorf("invalid value '%s' for mode; must be always or never", param))
+		return
+	}
+	if err := r.StressRelief.Override(mode); err != nil {
+		r.handlerReturnWithError(w, ErrStressPublish, err)
+		return
+	}
+	r.marshalToFormat(w, r.stressStatus(), "json")
+}
+
+// clearStressReliefOverride handles DELETE /admin/stress_relief/override,
+// which clears the override on every node in the cluster.
+func (r *Router) clearStressReliefOverride(w http.ResponseWriter, req *http.Request) {
+	if err := r.StressRelief.ClearOverride(); err != nil {
+		r.handlerReturnWithError(w, ErrStressPublish, err)
+		return
+	}
+	r.marshalToFormat(w, r.stressStatus(), "json")
+}
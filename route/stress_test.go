@@ -0,0 +1,70 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/honeycombio/refinery/collect/stressRelief"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStressEndpoint(t *testing.T) {
+	router := &Router{
+		Config:  &config.MockConfig{},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		StressRelief: &stressRelief.MockStressReliever{
+			IsStressed: true,
+			Level:      92,
+			Scores: map[string]stressRelief.ContributorScore{
+				"incoming_queue": {Stress: 0.92, Weight: 1, Score: 92},
+				"gc_pause":       {Stress: 0.4, Weight: 0.5, Score: 20},
+			},
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	router.getStress(rr, httptest.NewRequest("GET", "/debug/stress", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status stressStatus
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, uint(92), status.Level)
+	assert.True(t, status.Stressed)
+	assert.Equal(t, stressRelief.ContributorScore{Stress: 0.4, Weight: 0.5, Score: 20}, status.Contributors["gc_pause"])
+}
+
+func TestStressOverrideEndpoints(t *testing.T) {
+	sr := &stressRelief.MockStressReliever{}
+	router := &Router{
+		Config:       &config.MockConfig{},
+		Logger:       &logger.NullLogger{},
+		Metrics:      &metrics.NullMetrics{},
+		StressRelief: sr,
+	}
+
+	rr := httptest.NewRecorder()
+	router.overrideStressRelief(rr, httptest.NewRequest("PUT", "/admin/stress_relief/override?mode=monitor", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.overrideStressRelief(rr, httptest.NewRequest("PUT", "/admin/stress_relief/override?mode=always", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status stressStatus
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, "always", status.Override)
+	assert.Equal(t, stressRelief.Always, sr.OverrideMode)
+
+	rr = httptest.NewRecorder()
+	router.clearStressReliefOverride(rr, httptest.NewRequest("DELETE", "/admin/stress_relief/override", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	status = stressStatus{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Empty(t, status.Override)
+	assert.False(t, sr.IsOverridden)
+}
@@ -0,0 +1,27 @@
+package route
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/honeycombio/refinery/internal/otelutil"
+)
+
+// noopTracer is used by a router that wasn't built by injection.
+var noopTracer = noop.NewTracerProvider().Tracer("refinery")
+
+// tracer returns the tracer for Refinery's own traces.
+func (r *Router) tracer() trace.Tracer {
+	if r.Tracer == nil {
+		return noopTracer
+	}
+	return r.Tracer
+}
+
+// startIngestSpan starts the root span of Refinery's own trace of an ingest
+// request; the span of each event in the request is a child of it.
+func (r *Router) startIngestSpan(ctx context.Context, route string) (context.Context, trace.Span) {
+	return otelutil.StartSpanWith(ctx, r.tracer(), "Router.ingest", "route", route)
+}
@@ -0,0 +1,80 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/transmit"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestIngestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	mockMetrics := &metrics.MockMetrics{}
+	mockMetrics.Start()
+	mockTransmission := &transmit.MockTransmission{}
+	mockTransmission.Start()
+	decoders, err := makeDecoders(1)
+	require.NoError(t, err)
+	router := &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:  []string{"trace.trace_id"},
+			ParentIdFieldNames: []string{"trace.parent_id"},
+		},
+		Logger:               &logger.NullLogger{},
+		Metrics:              mockMetrics,
+		Collector:            &busyCollector{},
+		UpstreamTransmission: mockTransmission,
+		Tracer:               provider.Tracer("test"),
+		iopLogger:            iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		zstdDecoders:         decoders,
+		environmentCache:     newEnvironmentCache(time.Second, nil),
+	}
+	router.registerIngestMetrics()
+
+	m := mux.NewRouter()
+	batchMuxxer := m.PathPrefix("/1/").Subrouter()
+	batchMuxxer.Use(router.accountIngest)
+	batchMuxxer.HandleFunc("/batch/{datasetName}", router.batch).Name("batch")
+
+	body := `[{"data":{"trace.trace_id":"1"}},{"data":{"foo":"bar"}}]`
+	req := httptest.NewRequest("POST", "/1/batch/checkout", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(types.APIKeyHeader, legacyAPIKey)
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	// the events' spans end before the request's
+	ingest := spans[2]
+	assert.Equal(t, "Router.ingest", ingest.Name)
+	assert.False(t, ingest.Parent.IsValid())
+	for _, sp := range spans[:2] {
+		assert.Equal(t, "Router.processEvent", sp.Name)
+		assert.Equal(t, ingest.SpanContext.SpanID(), sp.Parent.SpanID())
+	}
+	var traceIDs []string
+	for _, sp := range spans[:2] {
+		for _, attr := range sp.Attributes {
+			if attr.Key == "trace_id" {
+				traceIDs = append(traceIDs, attr.Value.AsString())
+			}
+		}
+	}
+	// only the span has a trace ID
+	assert.Equal(t, []string{"1"}, traceIDs)
+}
@@ -0,0 +1,365 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// maxXRayDatagramSize is the largest segment document the X-Ray daemon
+// protocol allows in a single UDP packet.
+const maxXRayDatagramSize = 64 * 1024
+
+// xraySegment is an X-Ray segment or subsegment document. Only the fields
+// that map onto span fields are decoded.
+type xraySegment struct {
+	TraceID     string                 `json:"trace_id"`
+	ID          string                 `json:"id"`
+	ParentID    string                 `json:"parent_id"`
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name"`
+	StartTime   float64                `json:"start_time"`
+	EndTime     float64                `json:"end_time"`
+	InProgress  bool                   `json:"in_progress"`
+	Origin      string                 `json:"origin"`
+	Namespace   string                 `json:"namespace"`
+	Error       bool                   `json:"error"`
+	Fault       bool                   `json:"fault"`
+	Throttle    bool                   `json:"throttle"`
+	HTTP        *xrayHTTP              `json:"http"`
+	AWS         map[string]interface{} `json:"aws"`
+	SQL         map[string]interface{} `json:"sql"`
+	Annotations map[string]interface{} `json:"annotations"`
+	Metadata    map[string]interface{} `json:"metadata"`
+	Subsegments []xraySegment          `json:"subsegments"`
+}
+
+type xrayHTTP struct {
+	Request struct {
+		Method    string `json:"method"`
+		URL       string `json:"url"`
+		UserAgent string `json:"user_agent"`
+		ClientIP  string `json:"client_ip"`
+	} `json:"request"`
+	Response struct {
+		Status        int `json:"status"`
+		ContentLength int `json:"content_length"`
+	} `json:"response"`
+}
+
+type putTraceSegmentsInput struct {
+	TraceSegmentDocuments []string `json:"TraceSegmentDocuments"`
+}
+
+type unprocessedTraceSegment struct {
+	ID        string `json:"Id,omitempty"`
+	ErrorCode string `json:"ErrorCode"`
+	Message   string `json:"Message"`
+}
+
+// putTraceSegments handles POST /TraceSegments, which accepts the same
+// request and response bodies as the X-Ray PutTraceSegments API.
+func (r *Router) putTraceSegments(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	bodyReader, err := r.getMaybeCompressedBody(req)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+	reqBod, err := io.ReadAll(bodyReader)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+
+	var input putTraceSegmentsInput
+	if err := json.Unmarshal(reqBod, &input); err != nil {
+		r.handlerReturnWithError(w, ErrJSONFailed, err)
+		return
+	}
+
+	apiKey := req.Header.Get(types.APIKeyHeader)
+	if apiKey == "" {
+		apiKey = req.Header.Get(types.APIKeyHeaderShort)
+	}
+	environment, err := r.getEnvironmentName(apiKey)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrReqToEvent, err)
+		return
+	}
+
+	unprocessed := make([]unprocessedTraceSegment, 0)
+	for _, doc := range input.TraceSegmentDocuments {
+		if err := r.processXRaySegment(req.Context(), []byte(doc), apiKey, environment, req.Header.Get(types.DatasetHeader)); err != nil {
+			unprocessed = append(unprocessed, unprocessedTraceSegment{
+				ID:        segmentID(doc),
+				ErrorCode: "InvalidSegment",
+				Message:   err.Error(),
+			})
+		}
+	}
+
+	r.marshalToFormat(w, map[string]interface{}{"UnprocessedTraceSegments": unprocessed}, "json")
+}
+
+// segmentID makes a best effort to find the ID of a segment document that
+// couldn't be processed, for the error response.
+func segmentID(doc string) string {
+	var seg struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal([]byte(doc), &seg)
+	return seg.ID
+}
+
+// xrayAuthTTL is how long the UDP listener trusts its check of the X-Ray API
+// key before checking it again.
+const xrayAuthTTL = 10 * time.Second
+
+// xrayAuth is the result of checking the API key configured for X-Ray
+// segments received over UDP, which can't carry one of their own.
+type xrayAuth struct {
+	apiKey      string
+	accepted    bool
+	environment string
+	err         error
+	expiresAt   time.Time
+}
+
+// checkXRayAuth checks whether apiKey is accepted and looks up its
+// environment.
+func (r *Router) checkXRayAuth(ctx context.Context, apiKey string) xrayAuth {
+	auth := xrayAuth{apiKey: apiKey, expiresAt: time.Now().Add(xrayAuthTTL)}
+	auth.accepted = apiKey != "" && r.isAPIKeyAccepted(ctx, apiKey)
+	if auth.accepted {
+		auth.environment, auth.err = r.getEnvironmentName(apiKey)
+	}
+	return auth
+}
+
+// listenXRayUDP receives segments sent with the X-Ray daemon protocol, in
+// which each packet holds a JSON header line followed by a segment document.
+// Every packet uses the same configured API key, so it's only checked again
+// when it changes or its check expires.
+func (r *Router) listenXRayUDP(conn net.PacketConn) {
+	defer r.doneWG.Done()
+
+	ctx := context.WithValue(context.Background(), ingestRouteContextKey{}, "xray")
+	buf := make([]byte, maxXRayDatagramSize)
+	var auth xrayAuth
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				r.iopLogger.Error().Logf("failed to read X-Ray segment: %s", err)
+			}
+			return
+		}
+
+		xrayCfg := r.Config.GetXRayConfig()
+		drop := func(reason string) {
+			r.Metrics.Increment("incoming_router_xray_dropped")
+			r.recordIngestRequest("xray", xrayCfg.APIKey, int64(n), reason)
+		}
+
+		_, doc, found := bytes.Cut(buf[:n], []byte("\n"))
+		if !found {
+			drop("invalid")
+			continue
+		}
+
+		if auth.apiKey != xrayCfg.APIKey || !time.Now().Before(auth.expiresAt) {
+			auth = r.checkXRayAuth(ctx, xrayCfg.APIKey)
+		}
+		if !auth.accepted {
+			drop("unauthorized")
+			r.iopLogger.Debug().Logf("dropping X-Ray segment: no accepted API key is configured for X-Ray")
+			continue
+		}
+		if r.quarantineError(xrayCfg.APIKey) != nil {
+			drop("quarantined")
+			continue
+		}
+		if auth.err != nil {
+			drop("environment_lookup")
+			r.iopLogger.Error().Logf("dropping X-Ray segment: %s", auth.err)
+			continue
+		}
+
+		if err := r.processXRaySegment(ctx, doc, xrayCfg.APIKey, auth.environment, ""); err != nil {
+			drop("invalid")
+			r.iopLogger.Debug().Logf("dropping X-Ray segment: %s", err)
+			continue
+		}
+		r.recordIngestRequest("xray", xrayCfg.APIKey, int64(n), "")
+	}
+}
+
+// processXRaySegment converts a segment document, including its nested
+// subsegments, to spans and sends them on for sampling. Segments that are
+// still in progress are skipped, since the SDK sends them again when they
+// complete.
+func (r *Router) processXRaySegment(ctx context.Context, doc []byte, apiKey string, environment string, dataset string) error {
+	r.Metrics.Increment("incoming_router_xray")
+
+	var seg xraySegment
+	if err := json.Unmarshal(doc, &seg); err != nil {
+		return fmt.Errorf("invalid segment document: %w", err)
+	}
+	if seg.TraceID == "" || seg.ID == "" {
+		return errors.New("segment document is missing trace_id or id")
+	}
+	if seg.InProgress {
+		return nil
+	}
+
+	if dataset == "" {
+		dataset = r.Config.GetXRayConfig().Dataset
+	}
+	serviceName := seg.Name
+	if seg.Type == "subsegment" {
+		// subsegments sent on their own don't say which service they're from
+		serviceName = ""
+	}
+	if dataset == "" {
+		dataset = serviceName
+	}
+	if dataset == "" {
+		dataset = "xray"
+	}
+
+	reqID := ctx.Value(types.RequestIDContextKey{})
+	apiHost := r.Config.GetHoneycombAPI()
+	for _, sp := range xraySegmentToSpans(seg, translateXRayTraceID(seg.TraceID), seg.ParentID, serviceName) {
+		ev := &types.Event{
+			Context:     ctx,
+			APIHost:     apiHost,
+			APIKey:      apiKey,
+			Dataset:     dataset,
+			Environment: environment,
+			SampleRate:  1,
+			Timestamp:   sp.timestamp,
+			Data:        sp.data,
+		}
+		if err := r.processEvent(ev, reqID); err != nil {
+			r.Logger.Error().Logf("Error processing X-Ray segment: " + err.Error())
+		}
+	}
+	return nil
+}
+
+type xraySpan struct {
+	timestamp time.Time
+	data      map[string]interface{}
+}
+
+// xraySegmentToSpans flattens a segment and its subsegments into spans.
+func xraySegmentToSpans(seg xraySegment, traceID string, parentID string, serviceName string) []xraySpan {
+	data := make(map[string]interface{}, len(seg.Annotations)+12)
+	for k, v := range seg.Annotations {
+		data[k] = v
+	}
+	data["trace.trace_id"] = traceID
+	data["trace.span_id"] = seg.ID
+	if parentID != "" {
+		data["trace.parent_id"] = parentID
+	}
+	data["name"] = seg.Name
+	if serviceName != "" {
+		data["service.name"] = serviceName
+	}
+	data["duration_ms"] = math.Max(seg.EndTime-seg.StartTime, 0) * 1000
+	if seg.Origin != "" {
+		data["xray.origin"] = seg.Origin
+	}
+	if seg.Namespace != "" {
+		data["xray.namespace"] = seg.Namespace
+	}
+	if seg.Error || seg.Fault {
+		data["error"] = true
+	}
+	if seg.Fault {
+		data["xray.fault"] = true
+	}
+	if seg.Throttle {
+		data["xray.throttle"] = true
+	}
+	if h := seg.HTTP; h != nil {
+		addNonEmpty(data, "http.method", h.Request.Method)
+		addNonEmpty(data, "http.url", h.Request.URL)
+		addNonEmpty(data, "http.user_agent", h.Request.UserAgent)
+		addNonEmpty(data, "http.client_ip", h.Request.ClientIP)
+		if h.Response.Status != 0 {
+			data["http.status_code"] = h.Response.Status
+		}
+		if h.Response.ContentLength != 0 {
+			data["http.response_content_length"] = h.Response.ContentLength
+		}
+	}
+	addScalars(data, "aws.", seg.AWS)
+	addScalars(data, "db.", seg.SQL)
+	for namespace, md := range seg.Metadata {
+		if b, err := json.Marshal(md); err == nil {
+			data["xray.metadata."+namespace] = string(b)
+		}
+	}
+
+	sec, frac := math.Modf(seg.StartTime)
+	spans := []xraySpan{{
+		timestamp: time.Unix(int64(sec), int64(frac*1e9)).UTC(),
+		data:      data,
+	}}
+	for _, sub := range seg.Subsegments {
+		if sub.InProgress {
+			continue
+		}
+		spans = append(spans, xraySegmentToSpans(sub, traceID, seg.ID, serviceName)...)
+	}
+	return spans
+}
+
+func addNonEmpty(data map[string]interface{}, key string, value string) {
+	if value != "" {
+		data[key] = value
+	}
+}
+
+// addScalars copies the scalar values from an X-Ray field object, such as
+// "aws" or "sql", into the span with the given prefix.
+func addScalars(data map[string]interface{}, prefix string, values map[string]interface{}) {
+	for k, v := range values {
+		switch v.(type) {
+		case string, float64, bool:
+			data[prefix+k] = v
+		}
+	}
+}
+
+// translateXRayTraceID converts an X-Ray trace ID, such as
+// 1-5759e988-bd862e3fe1be46a994272793, to the 32 hex digit form used by
+// W3C trace context, so that traces that cross between X-Ray and
+// OpenTelemetry instrumentation keep the same ID. IDs in any other format
+// are passed through unchanged.
+func translateXRayTraceID(id string) string {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 || parts[0] != "1" || len(parts[1]) != 8 || len(parts[2]) != 24 {
+		return id
+	}
+	translated := parts[1] + parts[2]
+	if _, err := hex.DecodeString(translated); err != nil {
+		return id
+	}
+	return strings.ToLower(translated)
+}
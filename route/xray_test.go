@@ -0,0 +1,153 @@
+package route
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/collect"
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateXRayTraceID(t *testing.T) {
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", translateXRayTraceID("1-5759e988-bd862e3fe1be46a994272793"))
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", translateXRayTraceID("1-5759E988-BD862E3FE1BE46A994272793"))
+	assert.Equal(t, "not-an-xray-id", translateXRayTraceID("not-an-xray-id"))
+	assert.Equal(t, "1-5759e988-zzz62e3fe1be46a994272793", translateXRayTraceID("1-5759e988-zzz62e3fe1be46a994272793"))
+}
+
+func TestXRaySegmentToSpans(t *testing.T) {
+	doc := `{
+		"trace_id": "1-5759e988-bd862e3fe1be46a994272793",
+		"id": "defdfd9912dc5a56",
+		"name": "checkout",
+		"start_time": 1461096053.37518,
+		"end_time": 1461096053.4042,
+		"origin": "AWS::Lambda::Function",
+		"fault": true,
+		"http": {"request": {"method": "GET", "url": "https://example.com/"}, "response": {"status": 500}},
+		"annotations": {"customer": "alice"},
+		"subsegments": [{
+			"id": "53995c3f42cd8ad8",
+			"name": "DynamoDB",
+			"namespace": "aws",
+			"start_time": 1461096053.38,
+			"end_time": 1461096053.39,
+			"aws": {"operation": "GetItem", "table_name": "orders", "retries": 0},
+			"subsegments": [{"id": "0f910026178b71eb", "name": "marshal", "in_progress": true}]
+		}]
+	}`
+
+	var seg xraySegment
+	require.NoError(t, json.Unmarshal([]byte(doc), &seg))
+	spans := xraySegmentToSpans(seg, translateXRayTraceID(seg.TraceID), seg.ParentID, seg.Name)
+	require.Len(t, spans, 2)
+
+	root := spans[0].data
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", root["trace.trace_id"])
+	assert.Equal(t, "defdfd9912dc5a56", root["trace.span_id"])
+	assert.NotContains(t, root, "trace.parent_id")
+	assert.Equal(t, "checkout", root["service.name"])
+	assert.InDelta(t, 29.02, root["duration_ms"], 0.001)
+	assert.Equal(t, true, root["error"])
+	assert.Equal(t, 500, root["http.status_code"])
+	assert.Equal(t, "alice", root["customer"])
+	assert.Equal(t, "AWS::Lambda::Function", root["xray.origin"])
+	assert.Equal(t, time.Unix(1461096053, 375180000).UTC(), spans[0].timestamp.Round(time.Microsecond))
+
+	child := spans[1].data
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", child["trace.trace_id"])
+	assert.Equal(t, "defdfd9912dc5a56", child["trace.parent_id"])
+	assert.Equal(t, "DynamoDB", child["name"])
+	assert.Equal(t, "checkout", child["service.name"])
+	assert.Equal(t, "GetItem", child["aws.operation"])
+	assert.Equal(t, float64(0), child["aws.retries"])
+}
+
+func TestPutTraceSegments(t *testing.T) {
+	collector := &collect.MockCollector{}
+	router := &Router{
+		Config:           &config.MockConfig{TraceIdFieldNames: []string{"trace.trace_id"}, ParentIdFieldNames: []string{"trace.parent_id"}},
+		Logger:           &logger.NullLogger{},
+		Metrics:          &metrics.NullMetrics{},
+		Collector:        collector,
+		iopLogger:        iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		environmentCache: newEnvironmentCache(time.Second, nil),
+	}
+
+	complete := `{"trace_id":"1-5759e988-bd862e3fe1be46a994272793","id":"defdfd9912dc5a56","name":"checkout","start_time":1461096053.37,"end_time":1461096053.40}`
+	inProgress := `{"trace_id":"1-5759e988-bd862e3fe1be46a994272793","id":"0f910026178b71eb","name":"checkout","start_time":1461096053.37,"in_progress":true}`
+	invalid := `{"id":"1234567890abcdef"}`
+	body, err := json.Marshal(putTraceSegmentsInput{TraceSegmentDocuments: []string{complete, inProgress, invalid}})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/TraceSegments", strings.NewReader(string(body)))
+	req.Header.Set(types.APIKeyHeader, legacyAPIKey)
+	rr := httptest.NewRecorder()
+	router.putTraceSegments(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		UnprocessedTraceSegments []unprocessedTraceSegment
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	require.Len(t, resp.UnprocessedTraceSegments, 1)
+	assert.Equal(t, "1234567890abcdef", resp.UnprocessedTraceSegments[0].ID)
+
+	require.Len(t, collector.Spans, 1)
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", collector.Spans[0].TraceID)
+	assert.Equal(t, "checkout", collector.Spans[0].Dataset)
+	assert.True(t, collector.Spans[0].IsRoot)
+}
+
+func TestXRayUDPChecksKeyOnce(t *testing.T) {
+	var checks atomic.Int32
+	collector := &collect.MockCollector{}
+	router := &Router{
+		Config: &config.MockConfig{
+			TraceIdFieldNames:  []string{"trace.trace_id"},
+			ParentIdFieldNames: []string{"trace.parent_id"},
+			XRay:               config.XRayConfig{Enabled: true, APIKey: legacyAPIKey, Dataset: "xray"},
+			IsAPIKeyValidFunc: func(string) bool {
+				checks.Add(1)
+				return true
+			},
+		},
+		Logger:           &logger.NullLogger{},
+		Metrics:          &metrics.NullMetrics{},
+		Collector:        collector,
+		iopLogger:        iopLogger{Logger: &logger.NullLogger{}, incomingOrPeer: "incoming"},
+		environmentCache: newEnvironmentCache(time.Second, nil),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	router.doneWG.Add(1)
+	go router.listenXRayUDP(conn)
+	defer func() {
+		conn.Close()
+		router.doneWG.Wait()
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	for _, id := range []string{"defdfd9912dc5a56", "53995c3f42cd8ad8"} {
+		_, err := client.Write([]byte(`{"format":"json","version":1}` + "\n" +
+			`{"trace_id":"1-5759e988-bd862e3fe1be46a994272793","id":"` + id + `","name":"checkout","start_time":1461096053.37,"end_time":1461096053.40}`))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool { return len(collector.GetSpans()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(1), checks.Load())
+}
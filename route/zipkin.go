@@ -0,0 +1,356 @@
+package route
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// zipkinSpan is a span in the Zipkin v2 model. The JSON encoding uses hex
+// strings for IDs; spans decoded from protobuf are converted to the same form.
+type zipkinSpan struct {
+	TraceID        string             `json:"traceId"`
+	ParentID       string             `json:"parentId"`
+	ID             string             `json:"id"`
+	Kind           string             `json:"kind"`
+	Name           string             `json:"name"`
+	Timestamp      uint64             `json:"timestamp"` // microseconds since the epoch
+	Duration       uint64             `json:"duration"`  // microseconds
+	LocalEndpoint  *zipkinEndpoint    `json:"localEndpoint"`
+	RemoteEndpoint *zipkinEndpoint    `json:"remoteEndpoint"`
+	Annotations    []zipkinAnnotation `json:"annotations"`
+	Tags           map[string]string  `json:"tags"`
+	Debug          bool               `json:"debug"`
+	Shared         bool               `json:"shared"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+	IPv4        string `json:"ipv4"`
+	IPv6        string `json:"ipv6"`
+	Port        int32  `json:"port"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp uint64 `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// postZipkin handles POST /api/v2/spans, accepting the JSON or protobuf list
+// of spans that Zipkin reporters send. The dataset comes from the dataset
+// header if one is set, and otherwise from each span's local service name.
+func (r *Router) postZipkin(w http.ResponseWriter, req *http.Request) {
+	r.Metrics.Increment("incoming_router_zipkin")
+	defer req.Body.Close()
+
+	bodyReader, err := r.getMaybeCompressedBody(req)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+	reqBod, err := io.ReadAll(bodyReader)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrPostBody, err)
+		return
+	}
+
+	var spans []zipkinSpan
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/x-protobuf", "application/protobuf":
+		spans, err = unmarshalZipkinProto(reqBod)
+		if err != nil {
+			r.handlerReturnWithError(w, ErrZipkinDecode, err)
+			return
+		}
+	case "", "application/json":
+		if err := json.Unmarshal(reqBod, &spans); err != nil {
+			r.handlerReturnWithError(w, ErrJSONFailed, err)
+			return
+		}
+	default:
+		r.handlerReturnWithError(w, ErrInvalidContentType, fmt.Errorf("unsupported content type %q", contentType))
+		return
+	}
+
+	apiKey := req.Header.Get(types.APIKeyHeader)
+	if apiKey == "" {
+		apiKey = req.Header.Get(types.APIKeyHeaderShort)
+	}
+	environment, err := r.getEnvironmentName(apiKey)
+	if err != nil {
+		r.handlerReturnWithError(w, ErrReqToEvent, err)
+		return
+	}
+
+	reqID := req.Context().Value(types.RequestIDContextKey{})
+	apiHost := r.Config.GetHoneycombAPI()
+	datasetOverride := req.Header.Get(types.DatasetHeader)
+	for _, span := range spans {
+		dataset := datasetOverride
+		if dataset == "" {
+			dataset = span.serviceName()
+		}
+		for _, data := range span.toEventData() {
+			ev := &types.Event{
+				Context:     req.Context(),
+				APIHost:     apiHost,
+				APIKey:      apiKey,
+				Dataset:     dataset,
+				Environment: environment,
+				SampleRate:  1,
+				Timestamp:   span.startTime(),
+				Data:        data,
+			}
+			if err := r.processEvent(ev, reqID); err != nil {
+				r.Logger.Error().Logf("Error processing zipkin span: " + err.Error())
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *zipkinSpan) serviceName() string {
+	if s.LocalEndpoint != nil && s.LocalEndpoint.ServiceName != "" {
+		return s.LocalEndpoint.ServiceName
+	}
+	return "unknown_service"
+}
+
+func (s *zipkinSpan) startTime() time.Time {
+	if s.Timestamp == 0 {
+		return time.Now().UTC()
+	}
+	return time.UnixMicro(int64(s.Timestamp)).UTC()
+}
+
+// toEventData converts the span to the fields Refinery expects, followed by
+// one span event for each of its annotations.
+func (s *zipkinSpan) toEventData() []map[string]interface{} {
+	data := make(map[string]interface{}, len(s.Tags)+10)
+	for k, v := range s.Tags {
+		data[k] = v
+	}
+	data["trace.trace_id"] = strings.ToLower(s.TraceID)
+	data["trace.span_id"] = strings.ToLower(s.ID)
+	if s.ParentID != "" {
+		data["trace.parent_id"] = strings.ToLower(s.ParentID)
+	}
+	data["name"] = s.Name
+	data["service.name"] = s.serviceName()
+	data["duration_ms"] = float64(s.Duration) / 1000.0
+	if s.Kind != "" {
+		data["span.kind"] = strings.ToLower(s.Kind)
+	}
+	if s.Debug {
+		data["zipkin.debug"] = true
+	}
+	if s.Shared {
+		data["zipkin.shared"] = true
+	}
+	if ep := s.LocalEndpoint; ep != nil {
+		addZipkinEndpoint(data, "net.host", ep)
+	}
+	if ep := s.RemoteEndpoint; ep != nil {
+		addZipkinEndpoint(data, "net.peer", ep)
+		if ep.ServiceName != "" {
+			data["peer.service"] = ep.ServiceName
+		}
+	}
+
+	events := []map[string]interface{}{data}
+	for _, a := range s.Annotations {
+		events = append(events, map[string]interface{}{
+			"trace.trace_id":                data["trace.trace_id"],
+			"trace.parent_id":               data["trace.span_id"],
+			"name":                          a.Value,
+			"service.name":                  data["service.name"],
+			"meta.annotation_type":          "span_event",
+			"meta.time_since_span_start_ms": float64(int64(a.Timestamp)-int64(s.Timestamp)) / 1000.0,
+		})
+	}
+	return events
+}
+
+func addZipkinEndpoint(data map[string]interface{}, prefix string, ep *zipkinEndpoint) {
+	if ep.IPv4 != "" {
+		data[prefix+".ip"] = ep.IPv4
+	} else if ep.IPv6 != "" {
+		data[prefix+".ip"] = ep.IPv6
+	}
+	if ep.Port != 0 {
+		data[prefix+".port"] = int64(ep.Port)
+	}
+}
+
+var errZipkinProto = errors.New("malformed zipkin protobuf")
+
+// unmarshalZipkinProto decodes a zipkin.proto3.ListOfSpans message. The
+// schema is small and stable, so it's decoded field by field rather than
+// pulling in generated code.
+func unmarshalZipkinProto(b []byte) ([]zipkinSpan, error) {
+	var spans []zipkinSpan
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		span, err := unmarshalZipkinProtoSpan(v)
+		if err != nil {
+			return err
+		}
+		spans = append(spans, span)
+		return nil
+	})
+	return spans, err
+}
+
+func unmarshalZipkinProtoSpan(b []byte) (zipkinSpan, error) {
+	var s zipkinSpan
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			s.TraceID = hex.EncodeToString(v)
+		case 2:
+			s.ParentID = hex.EncodeToString(v)
+		case 3:
+			s.ID = hex.EncodeToString(v)
+		case 4:
+			s.Kind = zipkinProtoKinds[n]
+		case 5:
+			s.Name = string(v)
+		case 6:
+			s.Timestamp = n
+		case 7:
+			s.Duration = n
+		case 8, 9:
+			ep, err := unmarshalZipkinProtoEndpoint(v)
+			if err != nil {
+				return err
+			}
+			if num == 8 {
+				s.LocalEndpoint = ep
+			} else {
+				s.RemoteEndpoint = ep
+			}
+		case 10:
+			var a zipkinAnnotation
+			err := walkProto(v, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					a.Timestamp = n
+				case 2:
+					a.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.Annotations = append(s.Annotations, a)
+		case 11:
+			var key, value string
+			err := walkProto(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					key = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if s.Tags == nil {
+				s.Tags = make(map[string]string)
+			}
+			s.Tags[key] = value
+		case 12:
+			s.Debug = n != 0
+		case 13:
+			s.Shared = n != 0
+		}
+		return nil
+	})
+	return s, err
+}
+
+func unmarshalZipkinProtoEndpoint(b []byte) (*zipkinEndpoint, error) {
+	ep := &zipkinEndpoint{}
+	err := walkProto(b, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			ep.ServiceName = string(v)
+		case 2, 3:
+			if len(v) == net.IPv4len || len(v) == net.IPv6len {
+				if num == 2 {
+					ep.IPv4 = net.IP(v).String()
+				} else {
+					ep.IPv6 = net.IP(v).String()
+				}
+			}
+		case 4:
+			ep.Port = int32(n)
+		}
+		return nil
+	})
+	return ep, err
+}
+
+// zipkinProtoKinds maps the zipkin.proto3.Span.Kind enum to the names used
+// in the JSON encoding.
+var zipkinProtoKinds = map[uint64]string{
+	1: "CLIENT",
+	2: "SERVER",
+	3: "PRODUCER",
+	4: "CONSUMER",
+}
+
+// walkProto calls fn for every field in a protobuf message. Length-delimited
+// values are passed in v; varint and fixed-width values are passed in n.
+func walkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return errZipkinProto
+		}
+		b = b[l:]
+
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return errZipkinProto
+		}
+		b = b[l:]
+
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
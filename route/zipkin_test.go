@@ -0,0 +1,131 @@
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestZipkinJSONToEventData(t *testing.T) {
+	body := `[{
+		"traceId": "5AF7183FB1D4CF5F",
+		"parentId": "6b221d5bc9e6496c",
+		"id": "352bff9a74ca9ad2",
+		"kind": "CLIENT",
+		"name": "get /api",
+		"timestamp": 1556604172355737,
+		"duration": 1431,
+		"localEndpoint": {"serviceName": "frontend", "ipv4": "192.168.99.1", "port": 3306},
+		"remoteEndpoint": {"serviceName": "backend", "ipv4": "172.19.0.2", "port": 9000},
+		"annotations": [{"timestamp": 1556604172356000, "value": "wire send"}],
+		"tags": {"http.method": "GET", "http.path": "/api"}
+	}]`
+
+	var spans []zipkinSpan
+	require.NoError(t, json.Unmarshal([]byte(body), &spans))
+	require.Len(t, spans, 1)
+	assert.Equal(t, int64(1556604172355737), spans[0].startTime().UnixMicro())
+
+	events := spans[0].toEventData()
+	require.Len(t, events, 2)
+	assert.Equal(t, map[string]interface{}{
+		"trace.trace_id":  "5af7183fb1d4cf5f",
+		"trace.parent_id": "6b221d5bc9e6496c",
+		"trace.span_id":   "352bff9a74ca9ad2",
+		"name":            "get /api",
+		"service.name":    "frontend",
+		"duration_ms":     1.431,
+		"span.kind":       "client",
+		"net.host.ip":     "192.168.99.1",
+		"net.host.port":   int64(3306),
+		"net.peer.ip":     "172.19.0.2",
+		"net.peer.port":   int64(9000),
+		"peer.service":    "backend",
+		"http.method":     "GET",
+		"http.path":       "/api",
+	}, events[0])
+	assert.Equal(t, map[string]interface{}{
+		"trace.trace_id":                "5af7183fb1d4cf5f",
+		"trace.parent_id":               "352bff9a74ca9ad2",
+		"name":                          "wire send",
+		"service.name":                  "frontend",
+		"meta.annotation_type":          "span_event",
+		"meta.time_since_span_start_ms": 0.263,
+	}, events[1])
+}
+
+func TestUnmarshalZipkinProto(t *testing.T) {
+	var endpoint []byte
+	endpoint = protowire.AppendTag(endpoint, 1, protowire.BytesType)
+	endpoint = protowire.AppendString(endpoint, "frontend")
+	endpoint = protowire.AppendTag(endpoint, 2, protowire.BytesType)
+	endpoint = protowire.AppendBytes(endpoint, []byte{10, 0, 0, 1})
+
+	var tag []byte
+	tag = protowire.AppendTag(tag, 1, protowire.BytesType)
+	tag = protowire.AppendString(tag, "http.method")
+	tag = protowire.AppendTag(tag, 2, protowire.BytesType)
+	tag = protowire.AppendString(tag, "GET")
+
+	var span []byte
+	span = protowire.AppendTag(span, 1, protowire.BytesType)
+	span = protowire.AppendBytes(span, []byte{0x5a, 0xf7, 0x18, 0x3f, 0xb1, 0xd4, 0xcf, 0x5f})
+	span = protowire.AppendTag(span, 3, protowire.BytesType)
+	span = protowire.AppendBytes(span, []byte{0x35, 0x2b, 0xff, 0x9a, 0x74, 0xca, 0x9a, 0xd2})
+	span = protowire.AppendTag(span, 4, protowire.VarintType)
+	span = protowire.AppendVarint(span, 2)
+	span = protowire.AppendTag(span, 5, protowire.BytesType)
+	span = protowire.AppendString(span, "get /api")
+	span = protowire.AppendTag(span, 6, protowire.Fixed64Type)
+	span = protowire.AppendFixed64(span, 1556604172355737)
+	span = protowire.AppendTag(span, 7, protowire.VarintType)
+	span = protowire.AppendVarint(span, 1431)
+	span = protowire.AppendTag(span, 8, protowire.BytesType)
+	span = protowire.AppendBytes(span, endpoint)
+	span = protowire.AppendTag(span, 11, protowire.BytesType)
+	span = protowire.AppendBytes(span, tag)
+	span = protowire.AppendTag(span, 12, protowire.VarintType)
+	span = protowire.AppendVarint(span, 1)
+
+	var list []byte
+	list = protowire.AppendTag(list, 1, protowire.BytesType)
+	list = protowire.AppendBytes(list, span)
+
+	spans, err := unmarshalZipkinProto(list)
+	require.NoError(t, err)
+	assert.Equal(t, []zipkinSpan{{
+		TraceID:       "5af7183fb1d4cf5f",
+		ID:            "352bff9a74ca9ad2",
+		Kind:          "SERVER",
+		Name:          "get /api",
+		Timestamp:     1556604172355737,
+		Duration:      1431,
+		LocalEndpoint: &zipkinEndpoint{ServiceName: "frontend", IPv4: "10.0.0.1"},
+		Tags:          map[string]string{"http.method": "GET"},
+		Debug:         true,
+	}}, spans)
+
+	_, err = unmarshalZipkinProto(list[:len(list)-3])
+	assert.Error(t, err)
+}
+
+func TestPostZipkinUnsupportedContentType(t *testing.T) {
+	router := &Router{
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+
+	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader("<spans/>"))
+	req.Header.Set("Content-Type", "application/xml")
+	rr := httptest.NewRecorder()
+	router.postZipkin(rr, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
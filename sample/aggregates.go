@@ -0,0 +1,287 @@
+package sample
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+// aggregatedTrace remembers the values of the computed fields of a trace, so
+// that each is only calculated once per decision, however many rules and
+// spans it's checked against.
+type aggregatedTrace struct {
+	FieldsExtractor
+	computed map[config.ComputedField]any
+}
+
+func (t *aggregatedTrace) unwrap() FieldsExtractor {
+	return t.FieldsExtractor
+}
+
+// withAggregates wraps a trace to remember its computed fields, unless it
+// already does.
+func withAggregates(trace FieldsExtractor) FieldsExtractor {
+	if _, ok := trace.(*aggregatedTrace); ok {
+		return trace
+	}
+	return &aggregatedTrace{FieldsExtractor: trace}
+}
+
+// computedValue returns the value of a computed field for a trace. It returns
+// false if the trace has no value for the field, or the field isn't one we
+// know.
+func computedValue(trace FieldsExtractor, f config.ComputedField) (any, bool) {
+	at, ok := trace.(*aggregatedTrace)
+	if !ok {
+		return computeField(trace, f)
+	}
+	if value, ok := at.computed[f]; ok {
+		return value, true
+	}
+	value, ok := computeField(at.FieldsExtractor, f)
+	if ok {
+		if at.computed == nil {
+			at.computed = make(map[config.ComputedField]any)
+		}
+		at.computed[f] = value
+	}
+	return value, ok
+}
+
+func computeField(trace FieldsExtractor, f config.ComputedField) (any, bool) {
+	switch f {
+	case config.NUM_DESCENDANTS:
+		return int64(trace.DescendantCount()), true
+	case config.SPAN_COUNT:
+		var count int64
+		for _, span := range trace.AllFields() {
+			// span events and links are annotations of the span they belong to
+			if _, ok := span.Fields()["meta.annotation_type"]; !ok {
+				count++
+			}
+		}
+		return count, true
+	case config.DURATION_MS:
+		if root := trace.RootFields(); root != nil {
+			if d, ok := asFloat(root.Fields()["duration_ms"]); ok {
+				return d, true
+			}
+		}
+		var longest float64
+		for _, span := range trace.AllFields() {
+			if d, ok := asFloat(span.Fields()["duration_ms"]); ok && d > longest {
+				longest = d
+			}
+		}
+		return longest, true
+	case config.ERROR_COUNT:
+		var count int64
+		for _, span := range trace.AllFields() {
+			if config.TryConvertToBool(span.Fields()["error"]) {
+				count++
+			}
+		}
+		return count, true
+	case config.SERVICE_COUNT:
+		services := make(map[string]struct{})
+		for _, span := range trace.AllFields() {
+			if service, ok := span.Fields()["service.name"].(string); ok {
+				services[service] = struct{}{}
+			}
+		}
+		return int64(len(services)), true
+	case config.ROOT_HTTP_STATUS_CODE:
+		root := trace.RootFields()
+		if root == nil {
+			return nil, false
+		}
+		for _, field := range f.SourceFields() {
+			if code, ok := asFloat(root.Fields()[field]); ok {
+				return int64(code), true
+			}
+		}
+		return nil, false
+	case config.ANY_ERROR:
+		for _, span := range trace.AllFields() {
+			if config.TryConvertToBool(span.Fields()["error"]) {
+				return true, true
+			}
+		}
+		return false, true
+	case config.MAX_CHILD_DURATION_MS:
+		root := trace.RootFields()
+		var longest float64
+		var found bool
+		for _, span := range trace.AllFields() {
+			if root != nil && span == root {
+				continue
+			}
+			if d, ok := asFloat(span.Fields()["duration_ms"]); ok && (!found || d > longest) {
+				longest, found = d, true
+			}
+		}
+		return longest, found
+	case config.LEAF_SERVICE_COUNT:
+		spans := spanTree(trace)
+		services := make(map[string]struct{})
+		for _, span := range spans.spans {
+			if spans.children[span.id] > 0 {
+				continue
+			}
+			if service, ok := span.fields["service.name"].(string); ok {
+				services[service] = struct{}{}
+			}
+		}
+		return int64(len(services)), true
+	case config.ERROR_CHAIN:
+		spans := spanTree(trace)
+		type link struct {
+			depth   int
+			service string
+		}
+		var chain []link
+		for _, span := range spans.spans {
+			service, ok := span.fields["service.name"].(string)
+			if ok && config.TryConvertToBool(span.fields["error"]) {
+				chain = append(chain, link{spans.depth(span.id), service})
+			}
+		}
+		if len(chain) == 0 {
+			return nil, false
+		}
+		sort.Slice(chain, func(i, j int) bool {
+			if chain[i].depth != chain[j].depth {
+				return chain[i].depth < chain[j].depth
+			}
+			return chain[i].service < chain[j].service
+		})
+		services := make([]string, 0, len(chain))
+		seen := make(map[string]struct{})
+		for _, l := range chain {
+			if _, ok := seen[l.service]; !ok {
+				seen[l.service] = struct{}{}
+				services = append(services, l.service)
+			}
+		}
+		return strings.Join(services, ">"), true
+	}
+	return nil, false
+}
+
+// IDFieldsTrace wraps a trace to tell the computed fields that follow its
+// shape which fields hold its spans' IDs. Without it, they're read from
+// config.SpanIDField and config.ParentIDField, which is where the collector
+// records them for decisions.
+type IDFieldsTrace struct {
+	FieldsExtractor
+	SpanIDFields   []string
+	ParentIDFields []string
+}
+
+// NewIDFieldsTrace wraps a trace whose spans keep their IDs in the given
+// fields, the first of which that a span has is used.
+func NewIDFieldsTrace(trace FieldsExtractor, spanIDFields, parentIDFields []string) *IDFieldsTrace {
+	return &IDFieldsTrace{FieldsExtractor: trace, SpanIDFields: spanIDFields, ParentIDFields: parentIDFields}
+}
+
+func (t *IDFieldsTrace) unwrap() FieldsExtractor {
+	return t.FieldsExtractor
+}
+
+// treeSpan is a span of a trace, without its span events and links.
+type treeSpan struct {
+	id     string
+	parent string
+	fields map[string]interface{}
+}
+
+// traceTree is the shape of a trace, as far as its spans' IDs tell it.
+type traceTree struct {
+	spans    []treeSpan
+	parents  map[string]string
+	children map[string]int
+	// depths remembers the depths found so far
+	depths map[string]int
+}
+
+func spanTree(trace FieldsExtractor) traceTree {
+	spanIDFields, parentIDFields := []string{config.SpanIDField}, []string{config.ParentIDField}
+	if t, ok := findWrapped[*IDFieldsTrace](trace); ok {
+		spanIDFields, parentIDFields = t.SpanIDFields, t.ParentIDFields
+	}
+
+	tree := traceTree{parents: make(map[string]string), children: make(map[string]int), depths: make(map[string]int)}
+	for _, span := range trace.AllFields() {
+		fields := span.Fields()
+		if _, ok := fields["meta.annotation_type"]; ok {
+			continue
+		}
+		id := firstString(fields, spanIDFields)
+		parent := firstString(fields, parentIDFields)
+		tree.spans = append(tree.spans, treeSpan{id: id, parent: parent, fields: fields})
+		if id != "" {
+			tree.parents[id] = parent
+		}
+		if parent != "" {
+			tree.children[parent]++
+		}
+	}
+	return tree
+}
+
+// depth returns how many of a span's ancestors are in the trace. The depth
+// of each span passed on the way up is remembered, so that finding the depth
+// of every span in a deep trace doesn't walk the same ancestors again.
+func (t traceTree) depth(id string) int {
+	var path []string
+	depth, known := t.depths[id]
+	// a trace with a cycle can't be deeper than it has spans
+	for !known && len(path) < len(t.spans) {
+		parent := t.parents[id]
+		if _, ok := t.parents[parent]; parent == "" || !ok {
+			break
+		}
+		path = append(path, id)
+		id = parent
+		depth, known = t.depths[id]
+	}
+	// depth is now that of the last span reached, which is 0 if it wasn't
+	// already known, since its parent isn't in the trace
+	t.depths[id] = depth
+	for i := len(path) - 1; i >= 0; i-- {
+		depth++
+		t.depths[path[i]] = depth
+	}
+	return depth
+}
+
+// firstString returns the first non-empty string in the named fields.
+func firstString(fields map[string]interface{}, names []string) string {
+	for _, name := range names {
+		if s, ok := fields[name].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func asFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,49 @@
+//go:build all || !race
+
+package sample
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/honeycombio/refinery/internal/allocbudget"
+	"github.com/honeycombio/refinery/types"
+)
+
+// keyAllocsPerSpan is the most allocations building a sampler key may take for
+// each span in the trace. Every value is formatted and collected per field
+// before being sorted, so this is mostly those strings.
+const keyAllocsPerSpan = 6
+
+const allocTestSpans = 100
+
+func allocTestTrace(spans int) *types.Trace {
+	trace := &types.Trace{}
+	for i := 0; i < spans; i++ {
+		trace.AddSpan(&types.Span{
+			Event: types.Event{
+				Data: map[string]interface{}{
+					"http.status_code": 200 + i%3,
+					"http.route":       fmt.Sprintf("/route/%d", i%5),
+					"service.name":     "frontend",
+					"error":            i%10 == 0,
+				},
+			},
+		})
+	}
+	return trace
+}
+
+func TestKeyAllocsPerSpan(t *testing.T) {
+	key := newTraceKey([]string{"http.status_code", "http.route", "service.name", "error"}, true)
+	trace := allocTestTrace(allocTestSpans)
+
+	allocbudget.Check(t, "building a sampler key", keyAllocsPerSpan, allocTestSpans, func() { key.build(trace) })
+}
+
+func BenchmarkKeyBuild(b *testing.B) {
+	key := newTraceKey([]string{"http.status_code", "http.route", "service.name", "error"}, true)
+	trace := allocTestTrace(allocTestSpans)
+
+	allocbudget.Benchmark(b, func() { key.build(trace) })
+}
@@ -0,0 +1,277 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+// BudgetSampler divides a throughput goal between the values of a key field,
+// such as service.name. Every key is first given up to its minimum, then
+// what's left of the goal is shared in proportion to how much each key sends,
+// up to each key's maximum. Keys without a configured budget have no minimum
+// or maximum. The goal and budgets are for the cluster, so each node works to
+// its share of them.
+type BudgetSampler struct {
+	Config  *config.BudgetSamplerConfig
+	Logger  logger.Logger
+	Metrics metrics.Metrics
+	// Name is the target the sampler is for, used in its report.
+	Name string
+
+	goalThroughputPerSec float64
+	interval             time.Duration
+	prefix               string
+
+	mut         sync.Mutex
+	clusterSize int
+	counts      map[string]int64
+	kept        map[string]int64
+	rates       map[string]uint
+	report      BudgetReport
+
+	done chan struct{}
+}
+
+// BudgetReport describes how a BudgetSampler divided its goal in the last
+// complete interval. The goal and budgets are this node's share of the
+// cluster's.
+type BudgetReport struct {
+	Target               string               `json:"target"`
+	GoalThroughputPerSec float64              `json:"goal_throughput_per_sec"`
+	ClusterSize          int                  `json:"cluster_size"`
+	Keys                 map[string]KeyReport `json:"keys"`
+	Updated              time.Time            `json:"updated"`
+}
+
+// KeyReport is one key's part of a BudgetReport. Rates are in events per
+// second.
+type KeyReport struct {
+	MinPerSec    float64 `json:"min_per_sec"`
+	MaxPerSec    float64 `json:"max_per_sec,omitempty"`
+	SeenPerSec   float64 `json:"seen_per_sec"`
+	BudgetPerSec float64 `json:"budget_per_sec"`
+	KeptPerSec   float64 `json:"kept_per_sec"`
+	SampleRate   uint    `json:"sample_rate"`
+}
+
+func (d *BudgetSampler) Start() error {
+	d.Logger.Debug().Logf("Starting BudgetSampler")
+	defer func() { d.Logger.Debug().Logf("Finished starting BudgetSampler") }()
+	if d.Config.GoalThroughputPerSec < 1 {
+		d.Logger.Debug().Logf("configured goal throughput for budget sampler was %d; forcing to 100", d.Config.GoalThroughputPerSec)
+		d.Config.GoalThroughputPerSec = 100
+	}
+	d.goalThroughputPerSec = float64(d.Config.GoalThroughputPerSec)
+	if d.Config.AdjustmentInterval == 0 {
+		d.Config.AdjustmentInterval = config.Duration(15 * time.Second)
+	}
+	d.interval = time.Duration(d.Config.AdjustmentInterval)
+	d.prefix = "budget_"
+
+	if d.clusterSize == 0 {
+		d.clusterSize = 1
+	}
+	d.counts = make(map[string]int64)
+	d.kept = make(map[string]int64)
+	d.rates = make(map[string]uint)
+	d.report = BudgetReport{Target: d.Name, GoalThroughputPerSec: d.goalThroughputPerSec / float64(d.clusterSize), ClusterSize: d.clusterSize, Keys: map[string]KeyReport{}}
+	d.done = make(chan struct{})
+
+	d.Metrics.Register(d.prefix+"num_dropped", "counter")
+	d.Metrics.Register(d.prefix+"num_kept", "counter")
+	d.Metrics.Register(d.prefix+"sample_rate", "histogram")
+	d.Metrics.Register(d.prefix+"keys", "gauge")
+
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case now := <-ticker.C:
+				d.adjust(now)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops adjusting the budgets; the sampler is being replaced.
+func (d *BudgetSampler) Stop() {
+	close(d.done)
+}
+
+// SetClusterSize sets how many nodes share the goal.
+func (d *BudgetSampler) SetClusterSize(size int) {
+	if size < 1 {
+		return
+	}
+	d.mut.Lock()
+	d.clusterSize = size
+	d.mut.Unlock()
+}
+
+// adjust recalculates each key's budget and sample rate from what was seen
+// in the interval that just ended, and starts counting a new one.
+func (d *BudgetSampler) adjust(now time.Time) {
+	d.mut.Lock()
+	counts, kept := d.counts, d.kept
+	d.counts = make(map[string]int64)
+	d.kept = make(map[string]int64)
+	size := float64(d.clusterSize)
+	d.mut.Unlock()
+
+	seconds := d.interval.Seconds()
+	seen := make(map[string]float64, len(counts))
+	for key, n := range counts {
+		seen[key] = float64(n) / seconds
+	}
+	budgets := d.allocate(seen, size)
+
+	rates := make(map[string]uint, len(seen))
+	report := BudgetReport{
+		Target:               d.Name,
+		GoalThroughputPerSec: d.goalThroughputPerSec / size,
+		ClusterSize:          int(size),
+		Keys:                 make(map[string]KeyReport, len(seen)),
+		Updated:              now,
+	}
+	for key, perSec := range seen {
+		// a key with no budget left still sends about one event an interval
+		budget := math.Max(budgets[key], 1/seconds)
+		rate := uint(math.Ceil(perSec / budget))
+		if rate < 1 {
+			rate = 1
+		}
+		rates[key] = rate
+
+		limits := d.Config.Budgets[key]
+		report.Keys[key] = KeyReport{
+			MinPerSec:    float64(limits.MinPerSec) / size,
+			MaxPerSec:    float64(limits.MaxPerSec) / size,
+			SeenPerSec:   perSec,
+			BudgetPerSec: budgets[key],
+			KeptPerSec:   float64(kept[key]) / seconds,
+			SampleRate:   rate,
+		}
+	}
+	d.Metrics.Gauge(d.prefix+"keys", len(seen))
+
+	d.mut.Lock()
+	d.rates = rates
+	d.report = report
+	d.mut.Unlock()
+}
+
+// allocate divides this node's share of the goal between keys, given how many
+// events per second each sent to it, when the cluster has size nodes. Each
+// key's minimum and maximum are shared the same way. Minimums are met first
+// even if together they exceed the goal. No key is given more than it sent.
+func (d *BudgetSampler) allocate(seen map[string]float64, size float64) map[string]float64 {
+	budgets := make(map[string]float64, len(seen))
+	ceilings := make(map[string]float64, len(seen))
+	remaining := d.goalThroughputPerSec / size
+	for key, perSec := range seen {
+		limits := d.Config.Budgets[key]
+		ceiling := perSec
+		if limits.MaxPerSec > 0 {
+			ceiling = math.Min(ceiling, float64(limits.MaxPerSec)/size)
+		}
+		ceilings[key] = ceiling
+		budgets[key] = math.Min(ceiling, float64(limits.MinPerSec)/size)
+		remaining -= budgets[key]
+	}
+
+	// Share out what's left in proportion to what each key sent. A key that
+	// reaches its ceiling drops out and its share goes round again; every
+	// round either uses up the remainder or fills at least one key, so this
+	// ends.
+	for remaining > 1e-9 {
+		var demand float64
+		for key, budget := range budgets {
+			if budget < ceilings[key] {
+				demand += seen[key]
+			}
+		}
+		if demand == 0 {
+			break
+		}
+		var given float64
+		for key, budget := range budgets {
+			if budget >= ceilings[key] {
+				continue
+			}
+			share := math.Min(remaining*seen[key]/demand, ceilings[key]-budget)
+			budgets[key] += share
+			given += share
+		}
+		remaining -= given
+	}
+	return budgets
+}
+
+// Report returns how the goal was divided in the last complete interval.
+func (d *BudgetSampler) Report() BudgetReport {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.report
+}
+
+func (d *BudgetSampler) key(trace FieldsExtractor) string {
+	if root := trace.RootFields(); root != nil {
+		if val, ok := root.Fields()[d.Config.KeyField]; ok {
+			return fmt.Sprintf("%v", val)
+		}
+	}
+	for _, span := range trace.AllFields() {
+		if val, ok := span.Fields()[d.Config.KeyField]; ok {
+			return fmt.Sprintf("%v", val)
+		}
+	}
+	return ""
+}
+
+func (d *BudgetSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
+	key = d.key(trace)
+	count := int64(trace.DescendantCount())
+
+	d.mut.Lock()
+	// keys that haven't been seen for a whole interval are kept until they
+	// have been
+	rate, ok := d.rates[key]
+	if !ok {
+		rate = 1
+	}
+	shouldKeep := keepWithRate(trace, rate)
+	d.counts[key] += count
+	if shouldKeep {
+		d.kept[key] += count
+	}
+	d.mut.Unlock()
+
+	d.Logger.Debug().WithFields(map[string]interface{}{
+		"sample_key":  key,
+		"sample_rate": rate,
+		"sample_keep": shouldKeep,
+		"trace_id":    trace.ID(),
+		"span_count":  count,
+	}).Logf("got sample rate and decision")
+	if shouldKeep {
+		d.Metrics.Increment(d.prefix + "num_kept")
+	} else {
+		d.Metrics.Increment(d.prefix + "num_dropped")
+	}
+	d.Metrics.Histogram(d.prefix+"sample_rate", float64(rate))
+	return rate, shouldKeep, "budget", key
+}
+
+func (d *BudgetSampler) GetKeyFields() []string {
+	return d.Config.GetSamplingFields()
+}
@@ -0,0 +1,167 @@
+package sample
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBudgetTestSampler(goal int, budgets map[string]config.KeyBudget) *BudgetSampler {
+	return &BudgetSampler{
+		Config: &config.BudgetSamplerConfig{
+			GoalThroughputPerSec: goal,
+			// long enough that the sampler never adjusts on its own
+			AdjustmentInterval: config.Duration(time.Hour),
+			KeyField:           "service.name",
+			Budgets:            budgets,
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Name:    "test",
+	}
+}
+
+func TestBudgetAllocate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		goal    int
+		budgets map[string]config.KeyBudget
+		seen    map[string]float64
+		want    map[string]float64
+	}{
+		{
+			name: "under the goal",
+			goal: 100,
+			seen: map[string]float64{"a": 10, "b": 20},
+			want: map[string]float64{"a": 10, "b": 20},
+		},
+		{
+			name: "proportional",
+			goal: 100,
+			seen: map[string]float64{"a": 100, "b": 300},
+			want: map[string]float64{"a": 25, "b": 75},
+		},
+		{
+			name:    "minimum first",
+			goal:    100,
+			budgets: map[string]config.KeyBudget{"a": {MinPerSec: 50}},
+			seen:    map[string]float64{"a": 100, "b": 900},
+			// the other 50 is shared 100:900
+			want: map[string]float64{"a": 55, "b": 45},
+		},
+		{
+			name:    "maximum returns the rest",
+			goal:    100,
+			budgets: map[string]config.KeyBudget{"b": {MaxPerSec: 10}},
+			seen:    map[string]float64{"a": 200, "b": 200},
+			want:    map[string]float64{"a": 90, "b": 10},
+		},
+		{
+			name:    "minimums beyond the goal",
+			goal:    10,
+			budgets: map[string]config.KeyBudget{"a": {MinPerSec: 20}, "b": {MinPerSec: 20}},
+			seen:    map[string]float64{"a": 100, "b": 5, "c": 100},
+			want:    map[string]float64{"a": 20, "b": 5, "c": 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sampler := newBudgetTestSampler(tc.goal, tc.budgets)
+			require.NoError(t, sampler.Start())
+			defer sampler.Stop()
+			got := sampler.allocate(tc.seen, 1)
+			require.Len(t, got, len(tc.want))
+			for key, want := range tc.want {
+				assert.InDelta(t, want, got[key], 0.001, key)
+			}
+		})
+	}
+}
+
+func budgetTestTrace(service string) *types.Trace {
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{
+		Event: types.Event{Data: map[string]interface{}{"service.name": service}},
+	})
+	return trace
+}
+
+func TestBudgetSampler(t *testing.T) {
+	sampler := newBudgetTestSampler(1, map[string]config.KeyBudget{"checkout": {MinPerSec: 1}})
+	require.NoError(t, sampler.Start())
+	defer sampler.Stop()
+
+	// until a key has been seen for an interval, everything is kept
+	for i := 0; i < 3600*10; i++ {
+		rate, keep, reason, key := sampler.GetSampleRate(budgetTestTrace("checkout"))
+		require.Equal(t, uint(1), rate)
+		require.True(t, keep)
+		require.Equal(t, "budget", reason)
+		require.Equal(t, "checkout", key)
+	}
+	for i := 0; i < 3600*10; i++ {
+		sampler.GetSampleRate(budgetTestTrace("search"))
+	}
+
+	sampler.adjust(time.Now())
+
+	// checkout's minimum uses the whole goal
+	rate, _, _, _ := sampler.GetSampleRate(budgetTestTrace("checkout"))
+	assert.Equal(t, uint(10), rate)
+	rate, _, _, _ = sampler.GetSampleRate(budgetTestTrace("search"))
+	assert.Equal(t, uint(36000), rate)
+
+	report := sampler.Report()
+	assert.Equal(t, "test", report.Target)
+	require.Contains(t, report.Keys, "checkout")
+	assert.Equal(t, KeyReport{
+		MinPerSec:    1,
+		SeenPerSec:   10,
+		BudgetPerSec: 1,
+		KeptPerSec:   10,
+		SampleRate:   10,
+	}, report.Keys["checkout"])
+}
+
+func TestBudgetClusterShare(t *testing.T) {
+	sampler := newBudgetTestSampler(100, map[string]config.KeyBudget{"a": {MinPerSec: 40, MaxPerSec: 60}})
+	require.NoError(t, sampler.Start())
+	defer sampler.Stop()
+
+	// each of 4 nodes works to a quarter of the goal and of each budget
+	sampler.SetClusterSize(4)
+	got := sampler.allocate(map[string]float64{"a": 100, "b": 100}, 4)
+	assert.InDelta(t, 15, got["a"], 0.001)
+	assert.InDelta(t, 10, got["b"], 0.001)
+
+	sampler.GetSampleRate(budgetTestTrace("a"))
+	sampler.adjust(time.Now())
+	report := sampler.Report()
+	assert.Equal(t, 25.0, report.GoalThroughputPerSec)
+	assert.Equal(t, 4, report.ClusterSize)
+	assert.Equal(t, 10.0, report.Keys["a"].MinPerSec)
+}
+
+func TestBudgetReports(t *testing.T) {
+	factory := &SamplerFactory{
+		Config: &config.MockConfig{
+			GetSamplerTypeVal: &config.BudgetSamplerConfig{GoalThroughputPerSec: 10, KeyField: "service.name"},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, factory.Start())
+	factory.GetSamplerImplementationForKey("b")
+	factory.GetSamplerImplementationForKey("a")
+
+	reports := factory.BudgetReports()
+	require.Len(t, reports, 2)
+	assert.Equal(t, "a", reports[0].Target)
+	assert.Equal(t, "b", reports[1].Target)
+}
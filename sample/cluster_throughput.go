@@ -0,0 +1,243 @@
+package sample
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+// ClusterThroughputSampler aims for a number of events per second across the
+// whole cluster. Each node adds the events it sees for each key to counters
+// shared by every node, and sets its sample rates from the cluster's counts
+// for the last complete interval. Adding or removing nodes doesn't change
+// how much is sent. Keys that the cluster didn't see in that interval are
+// sampled from their counts so far in the current one.
+type ClusterThroughputSampler struct {
+	Config  *config.ClusterThroughputSamplerConfig
+	Logger  logger.Logger
+	Metrics metrics.Metrics
+	Counter clustercount.Counter
+	// Name identifies this sampler's counts; the samplers for a target on
+	// every node must share it.
+	Name string
+
+	goalThroughputPerSec int
+	interval             time.Duration
+	prefix               string
+
+	key       *traceKey
+	keyFields []string
+
+	mut     sync.Mutex
+	pending map[int64]map[string]int64
+	rates   map[string]uint
+	// share is how many events a key may send in an interval, as of the
+	// last complete one
+	share float64
+	// current holds the cluster's counts so far in currentWindow
+	current       map[string]int64
+	currentWindow int64
+
+	done chan struct{}
+}
+
+func (d *ClusterThroughputSampler) Start() error {
+	d.Logger.Debug().Logf("Starting ClusterThroughputSampler")
+	defer func() { d.Logger.Debug().Logf("Finished starting ClusterThroughputSampler") }()
+	if d.Config.GoalThroughputPerSec < 1 {
+		d.Logger.Debug().Logf("configured goal throughput for cluster throughput sampler was %d; forcing to 100", d.Config.GoalThroughputPerSec)
+		d.Config.GoalThroughputPerSec = 100
+	}
+	d.goalThroughputPerSec = d.Config.GoalThroughputPerSec
+	if d.Config.AdjustmentInterval == 0 {
+		d.Config.AdjustmentInterval = config.Duration(15 * time.Second)
+	}
+	d.interval = time.Duration(d.Config.AdjustmentInterval)
+	d.key = newTraceKey(d.Config.FieldList, d.Config.UseTraceLength)
+	d.keyFields = d.Config.GetSamplingFields()
+	d.prefix = "clusterthroughput_"
+
+	d.pending = make(map[int64]map[string]int64)
+	d.rates = make(map[string]uint)
+	d.share = float64(d.goalThroughputPerSec) * d.interval.Seconds()
+	d.done = make(chan struct{})
+
+	d.Metrics.Register(d.prefix+"num_dropped", "counter")
+	d.Metrics.Register(d.prefix+"num_kept", "counter")
+	d.Metrics.Register(d.prefix+"sample_rate", "histogram")
+	d.Metrics.Register(d.prefix+"cluster_events", "gauge")
+	d.Metrics.Register(d.prefix+"keys", "gauge")
+	d.Metrics.Register(d.prefix+"sync_errors", "counter")
+
+	go d.run()
+	return nil
+}
+
+// Stop stops sharing counts; the sampler is being replaced.
+func (d *ClusterThroughputSampler) Stop() {
+	close(d.done)
+}
+
+// run shares this node's counts several times per interval, so that each
+// interval's counts are complete soon after it ends.
+func (d *ClusterThroughputSampler) run() {
+	ticker := time.NewTicker(d.interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-ticker.C:
+			d.update(context.Background(), now)
+		}
+	}
+}
+
+// update adds the counts since the last update to the cluster's, and
+// recalculates the sample rates from the cluster's counts for the last
+// complete interval.
+func (d *ClusterThroughputSampler) update(ctx context.Context, now time.Time) {
+	d.mut.Lock()
+	pending := d.pending
+	d.pending = make(map[int64]map[string]int64)
+	d.mut.Unlock()
+
+	for window, counts := range pending {
+		// keep each window long enough for every node to read it
+		if err := d.Counter.Add(ctx, d.Name, window, counts, 3*d.interval); err != nil {
+			d.Logger.Error().WithField("sampler", d.Name).Logf("failed to share cluster throughput counts: %s", err)
+			d.Metrics.Increment(d.prefix + "sync_errors")
+		}
+	}
+
+	window := clustercount.Window(now, d.interval)
+	totals, err := d.Counter.Totals(ctx, d.Name, window-1)
+	if err != nil {
+		d.Logger.Error().WithField("sampler", d.Name).Logf("failed to read cluster throughput counts: %s", err)
+		d.Metrics.Increment(d.prefix + "sync_errors")
+		return
+	}
+	rates, share := d.calculateRates(totals)
+	current, err := d.Counter.Totals(ctx, d.Name, window)
+	if err != nil {
+		d.Logger.Error().WithField("sampler", d.Name).Logf("failed to read cluster throughput counts: %s", err)
+		d.Metrics.Increment(d.prefix + "sync_errors")
+		current = nil
+	}
+
+	d.mut.Lock()
+	d.rates = rates
+	d.share = share
+	d.current = current
+	d.currentWindow = window
+	d.mut.Unlock()
+}
+
+// calculateRates divides the cluster's goal for an interval between the keys
+// and sets each key's sample rate so that it sends no more than its share.
+// Keys that need less than an equal share keep everything, and what they
+// leave is divided between the rest. It also returns the share of the keys
+// that are sampled, which is what a new key gets.
+func (d *ClusterThroughputSampler) calculateRates(totals map[string]int64) (map[string]uint, float64) {
+	rates := make(map[string]uint, len(totals))
+	keys := make([]string, 0, len(totals))
+	var events int64
+	for key, n := range totals {
+		keys = append(keys, key)
+		events += n
+	}
+	d.Metrics.Gauge(d.prefix+"cluster_events", events)
+	d.Metrics.Gauge(d.prefix+"keys", len(totals))
+
+	goal := float64(d.goalThroughputPerSec) * d.interval.Seconds()
+	if len(keys) == 0 {
+		return rates, goal
+	}
+	// visit the quietest keys first, so that what they don't use is left
+	// for the busier ones
+	sort.Slice(keys, func(i, j int) bool { return totals[keys[i]] < totals[keys[j]] })
+	share := goal
+	for i, key := range keys {
+		share = goal / float64(len(keys)-i)
+		n := float64(totals[key])
+		if n <= share {
+			rates[key] = 1
+			goal -= n
+			continue
+		}
+		rates[key] = uint(math.Ceil(n / share))
+		goal -= share
+	}
+	return rates, share
+}
+
+// newKeyRate is the sample rate of a key that the cluster didn't see in the
+// last complete interval, from the events counted so far in this one: it
+// may send the same share as the busiest keys, in proportion to how much of
+// the interval has passed. Called with the lock held.
+func (d *ClusterThroughputSampler) newKeyRate(key string, window int64, now time.Time) uint {
+	var count int64
+	if window == d.currentWindow {
+		count += d.current[key]
+	}
+	count += d.pending[window][key]
+
+	// early in an interval the counts say little, so assume that at least a
+	// quarter of it has passed
+	elapsed := now.Sub(time.Unix(0, window*int64(d.interval)))
+	if elapsed < d.interval/4 {
+		elapsed = d.interval / 4
+	}
+	allowed := d.share * elapsed.Seconds() / d.interval.Seconds()
+	if float64(count) <= allowed || allowed <= 0 {
+		return 1
+	}
+	return uint(math.Ceil(float64(count) / allowed))
+}
+
+func (d *ClusterThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
+	key = d.key.build(trace)
+	count := int64(trace.DescendantCount())
+	now := time.Now()
+	window := clustercount.Window(now, d.interval)
+
+	d.mut.Lock()
+	counts := d.pending[window]
+	if counts == nil {
+		counts = make(map[string]int64)
+		d.pending[window] = counts
+	}
+	counts[key] += count
+	rate, ok := d.rates[key]
+	if !ok {
+		rate = d.newKeyRate(key, window, now)
+	}
+	d.mut.Unlock()
+
+	shouldKeep := keepWithRate(trace, rate)
+	d.Logger.Debug().WithFields(map[string]interface{}{
+		"sample_key":  key,
+		"sample_rate": rate,
+		"sample_keep": shouldKeep,
+		"trace_id":    trace.ID(),
+		"span_count":  count,
+	}).Logf("got sample rate and decision")
+	if shouldKeep {
+		d.Metrics.Increment(d.prefix + "num_kept")
+	} else {
+		d.Metrics.Increment(d.prefix + "num_dropped")
+	}
+	d.Metrics.Histogram(d.prefix+"sample_rate", float64(rate))
+	return rate, shouldKeep, "clusterthroughput", key
+}
+
+func (d *ClusterThroughputSampler) GetKeyFields() []string {
+	return d.keyFields
+}
@@ -0,0 +1,147 @@
+package sample
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClusterThroughputTestSampler(counter clustercount.Counter, goal int, interval time.Duration) *ClusterThroughputSampler {
+	metrics := &metrics.MockMetrics{}
+	metrics.Start()
+	return &ClusterThroughputSampler{
+		Config: &config.ClusterThroughputSamplerConfig{
+			GoalThroughputPerSec: goal,
+			AdjustmentInterval:   config.Duration(interval),
+			FieldList:            []string{"service.name"},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: metrics,
+		Counter: counter,
+		Name:    "test",
+	}
+}
+
+func clusterThroughputTestTrace(service string, spans int) *types.Trace {
+	trace := &types.Trace{}
+	for i := 0; i < spans; i++ {
+		trace.AddSpan(&types.Span{
+			Event: types.Event{
+				Data: map[string]interface{}{"service.name": service},
+			},
+		})
+	}
+	return trace
+}
+
+func TestClusterThroughputSharesCounts(t *testing.T) {
+	// the interval is long enough that the test stays in one window
+	const interval = 1000 * time.Hour
+	counter := &clustercount.LocalCounter{}
+	nodes := []*ClusterThroughputSampler{
+		newClusterThroughputTestSampler(counter, 1, interval),
+		newClusterThroughputTestSampler(counter, 1, interval),
+	}
+	for _, node := range nodes {
+		require.NoError(t, node.Start())
+	}
+
+	rate, keep, reason, key := nodes[0].GetSampleRate(clusterThroughputTestTrace("api", 5))
+	assert.Equal(t, uint(1), rate, "new keys within their share are kept")
+	assert.True(t, keep)
+	assert.Equal(t, "clusterthroughput", reason)
+	assert.Equal(t, "api•,", key)
+	nodes[1].GetSampleRate(clusterThroughputTestTrace("api", 5))
+	nodes[1].GetSampleRate(clusterThroughputTestTrace("web", 2))
+
+	// read the window as though it were complete
+	next := time.Now().Add(interval)
+	for _, node := range nodes {
+		node.update(context.Background(), next)
+	}
+	totals, err := counter.Totals(context.Background(), "test", clustercount.Window(time.Now(), interval))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"api•,": 10, "web•,": 2}, totals)
+
+	// the node that updated first saw only its own counts; once it updates
+	// again both nodes agree
+	nodes[0].update(context.Background(), next)
+	assert.Equal(t, nodes[0].rates, nodes[1].rates)
+	assert.Len(t, nodes[1].rates, 2)
+}
+
+func TestClusterThroughputRates(t *testing.T) {
+	sampler := newClusterThroughputTestSampler(&clustercount.LocalCounter{}, 10, 10*time.Second)
+	require.NoError(t, sampler.Start())
+
+	// 10 events per second for 10 seconds is 100 events; the quiet key only
+	// needs 10, which leaves 90 for the busy one
+	rates, share := sampler.calculateRates(map[string]int64{"busy": 1000, "quiet": 10})
+	assert.Equal(t, map[string]uint{"busy": 12, "quiet": 1}, rates)
+	assert.Equal(t, 90.0, share)
+
+	// busy keys split what the quiet ones leave evenly
+	rates, share = sampler.calculateRates(map[string]int64{"a": 400, "b": 200, "c": 4})
+	assert.Equal(t, map[string]uint{"a": 9, "b": 5, "c": 1}, rates)
+	assert.Equal(t, 48.0, share)
+
+	rates, share = sampler.calculateRates(map[string]int64{})
+	assert.Empty(t, rates)
+	assert.Equal(t, 100.0, share)
+}
+
+func TestClusterThroughputNewKeys(t *testing.T) {
+	const interval = 1000 * time.Hour
+	sampler := newClusterThroughputTestSampler(&clustercount.LocalCounter{}, 1, interval)
+	require.NoError(t, sampler.Start())
+	defer sampler.Stop()
+
+	// the busy key's share is 100 events per interval
+	sampler.rates = map[string]uint{"busy•,": 10}
+	sampler.share = 100
+
+	// a new key that has already sent far more than its share this interval
+	// is sampled right away, rather than kept until the next one
+	now := time.Now()
+	window := clustercount.Window(now, interval)
+	sampler.pending[window] = map[string]int64{"new•,": 10_000}
+	rate, _, _, _ := sampler.GetSampleRate(clusterThroughputTestTrace("new", 1))
+	assert.Greater(t, rate, uint(1))
+
+	rate, _, _, _ = sampler.GetSampleRate(clusterThroughputTestTrace("other", 1))
+	assert.Equal(t, uint(1), rate)
+}
+
+// countingCounter counts how often the cluster's counts are read.
+type countingCounter struct {
+	clustercount.LocalCounter
+	reads atomic.Int64
+}
+
+func (c *countingCounter) Totals(ctx context.Context, name string, window int64) (map[string]int64, error) {
+	c.reads.Add(1)
+	return c.LocalCounter.Totals(ctx, name, window)
+}
+
+func TestClusterThroughputStop(t *testing.T) {
+	counter := &countingCounter{}
+	sampler := newClusterThroughputTestSampler(counter, 1, 4*time.Millisecond)
+	require.NoError(t, sampler.Start())
+	assert.Eventually(t, func() bool { return counter.reads.Load() > 0 }, time.Second, time.Millisecond)
+
+	sampler.Stop()
+	time.Sleep(5 * time.Millisecond)
+	reads := counter.reads.Load()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, reads, counter.reads.Load(), "a stopped sampler stops updating")
+}
@@ -0,0 +1,145 @@
+package sample
+
+import (
+	"fmt"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+var _ PassingSampler = (*CompositeSampler)(nil)
+
+// CompositeSampler tries each of its steps in order, and the first step
+// that doesn't pass decides what happens to the trace. A step passes if its
+// conditions don't all match the trace, or if its sampler passes, as a
+// rules-based sampler does when none of its rules match. If every step
+// passes, the trace is kept.
+type CompositeSampler struct {
+	Config  *config.CompositeSamplerConfig
+	Logger  logger.Logger
+	Metrics metrics.Metrics
+
+	steps     []compositeStep
+	keyFields []string
+	prefix    string
+	// keyMeter meters the keys of the steps' samplers for the memory budget
+	keyMeter *keyMeter
+}
+
+type compositeStep struct {
+	name       string
+	conditions *config.RulesBasedSamplerRule
+	sampler    Sampler
+}
+
+func (s *CompositeSampler) Start() error {
+	s.Logger.Debug().Logf("Starting CompositeSampler")
+	defer func() { s.Logger.Debug().Logf("Finished starting CompositeSampler") }()
+	s.prefix = "composite_"
+
+	s.Metrics.Register(s.prefix+"num_dropped", "counter")
+	s.Metrics.Register(s.prefix+"num_kept", "counter")
+	s.Metrics.Register(s.prefix+"num_passed", "counter")
+
+	s.keyFields = s.Config.GetSamplingFields()
+	s.steps = make([]compositeStep, 0, len(s.Config.Steps))
+	for i, stepConfig := range s.Config.Steps {
+		step := compositeStep{name: stepConfig.StepName(i)}
+		if stepConfig.Sampler == nil {
+			return fmt.Errorf("composite sampler step %s has no sampler", step.name)
+		}
+		for _, cond := range stepConfig.Conditions {
+			if err := cond.Init(); err != nil {
+				return fmt.Errorf("composite sampler step %s has an invalid condition: %w", step.name, err)
+			}
+		}
+		if len(stepConfig.Conditions) > 0 {
+			step.conditions = &config.RulesBasedSamplerRule{Name: step.name, Conditions: stepConfig.Conditions}
+		}
+
+		if stepConfig.Sampler.RulesBasedSampler != nil {
+			step.sampler = &RulesBasedSampler{Config: stepConfig.Sampler.RulesBasedSampler, Logger: s.Logger, Metrics: s.Metrics, keyMeter: s.keyMeter}
+		} else {
+			step.sampler = newDownstreamSampler(&stepConfig.Sampler.RulesBasedDownstreamSampler, s.Logger, s.Metrics, s.keyMeter)
+		}
+		if step.sampler == nil {
+			return fmt.Errorf("composite sampler step %s has no sampler", step.name)
+		}
+		if err := step.sampler.Start(); err != nil {
+			return fmt.Errorf("composite sampler step %s: %w", step.name, err)
+		}
+		s.steps = append(s.steps, step)
+	}
+	return nil
+}
+
+func (s *CompositeSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
+	rate, keep, reason, key, pass := s.GetSampleRateOrPass(trace)
+	if pass {
+		return 1, true, "composite/no step decided", ""
+	}
+	return rate, keep, reason, key
+}
+
+// GetSampleRateOrPass passes if every step passes, so that composite
+// samplers can be nested.
+func (s *CompositeSampler) GetSampleRateOrPass(trace FieldsExtractor) (rate uint, keep bool, reason string, key string, pass bool) {
+	// computed fields are the same for every step, so only work them out once
+	trace = withAggregates(trace)
+
+	for _, step := range s.steps {
+		if step.conditions != nil && !ruleMatchesTrace(trace, step.conditions, false) {
+			continue
+		}
+		if passer, ok := step.sampler.(PassingSampler); ok {
+			rate, keep, reason, key, pass = passer.GetSampleRateOrPass(trace)
+			if pass {
+				continue
+			}
+		} else {
+			rate, keep, reason, key = step.sampler.GetSampleRate(trace)
+		}
+
+		if keep {
+			s.Metrics.Increment(s.prefix + "num_kept")
+		} else {
+			s.Metrics.Increment(s.prefix + "num_dropped")
+		}
+		s.Logger.Debug().WithFields(map[string]interface{}{
+			"trace_id": trace.ID(),
+			"step":     step.name,
+			"rate":     rate,
+			"keep":     keep,
+		}).Logf("got sample rate and decision")
+		return rate, keep, "composite/" + step.name + ":" + reason, key, false
+	}
+
+	s.Metrics.Increment(s.prefix + "num_passed")
+	return 0, false, "", "", true
+}
+
+// Stop stops the samplers of its steps.
+func (s *CompositeSampler) Stop() {
+	for _, step := range s.steps {
+		StopSampler(step.sampler)
+	}
+}
+
+// ReportKeys reports the keys of the samplers of its steps.
+func (s *CompositeSampler) ReportKeys() []SamplerKeysReport {
+	var reports []SamplerKeysReport
+	for _, step := range s.steps {
+		if reporter, ok := step.sampler.(KeyReporter); ok {
+			for _, report := range reporter.ReportKeys() {
+				report.Sampler = "composite/" + step.name + ":" + report.Sampler
+				reports = append(reports, report)
+			}
+		}
+	}
+	return reports
+}
+
+func (s *CompositeSampler) GetKeyFields() []string {
+	return s.keyFields
+}
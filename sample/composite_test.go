@@ -0,0 +1,141 @@
+package sample
+
+import (
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compositeTestTrace(fields map[string]interface{}) *types.Trace {
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{Event: types.Event{Data: fields}})
+	return trace
+}
+
+func TestCompositeSampler(t *testing.T) {
+	sampler := &CompositeSampler{
+		Config: &config.CompositeSamplerConfig{
+			Steps: []*config.CompositeSamplerStep{
+				{
+					Name: "rules",
+					Sampler: &config.CompositeStepSampler{
+						RulesBasedSampler: &config.RulesBasedSamplerConfig{
+							Rules: []*config.RulesBasedSamplerRule{
+								{
+									Name: "health",
+									Drop: true,
+									Conditions: []*config.RulesBasedSamplerCondition{
+										{Field: "http.route", Operator: config.EQ, Value: "/health"},
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					Name: "checkout",
+					Conditions: []*config.RulesBasedSamplerCondition{
+						{Field: "service.name", Operator: config.EQ, Value: "checkout"},
+					},
+					Sampler: &config.CompositeStepSampler{
+						RulesBasedDownstreamSampler: config.RulesBasedDownstreamSampler{
+							DeterministicSampler: &config.DeterministicSamplerConfig{SampleRate: 1},
+						},
+					},
+				},
+				{
+					Sampler: &config.CompositeStepSampler{
+						RulesBasedDownstreamSampler: config.RulesBasedDownstreamSampler{
+							DynamicSampler: &config.DynamicSamplerConfig{SampleRate: 1, FieldList: []string{"http.method"}},
+						},
+					},
+				},
+			},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, sampler.Start())
+	assert.ElementsMatch(t, []string{"http.route", "service.name", "http.method"}, sampler.GetKeyFields())
+
+	// the rules step decides when one of its rules matches
+	rate, keep, reason, _ := sampler.GetSampleRate(compositeTestTrace(map[string]interface{}{
+		"http.route": "/health", "service.name": "checkout",
+	}))
+	assert.False(t, keep)
+	assert.Equal(t, "composite/rules:rules/trace/health", reason)
+	assert.Equal(t, uint(0), rate)
+
+	// otherwise it passes to the next step whose conditions match
+	rate, keep, reason, _ = sampler.GetSampleRate(compositeTestTrace(map[string]interface{}{
+		"http.route": "/cart", "service.name": "checkout",
+	}))
+	assert.True(t, keep)
+	assert.Equal(t, "composite/checkout:deterministic/always", reason)
+	assert.Equal(t, uint(1), rate)
+
+	// an unnamed step is named by its position
+	_, keep, reason, key := sampler.GetSampleRate(compositeTestTrace(map[string]interface{}{
+		"http.route": "/cart", "service.name": "search", "http.method": "GET",
+	}))
+	assert.True(t, keep)
+	assert.Equal(t, "composite/2:dynamic", reason)
+	assert.Equal(t, "GET•,", key)
+}
+
+func TestCompositeSamplerAllPass(t *testing.T) {
+	inner := &config.CompositeSamplerConfig{
+		Steps: []*config.CompositeSamplerStep{
+			{
+				Name: "inner",
+				Conditions: []*config.RulesBasedSamplerCondition{
+					{Field: "service.name", Operator: config.EQ, Value: "checkout"},
+				},
+				Sampler: &config.CompositeStepSampler{
+					RulesBasedDownstreamSampler: config.RulesBasedDownstreamSampler{
+						DeterministicSampler: &config.DeterministicSamplerConfig{SampleRate: 1},
+					},
+				},
+			},
+		},
+	}
+	sampler := &CompositeSampler{Config: inner, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, sampler.Start())
+
+	_, _, _, _, pass := sampler.GetSampleRateOrPass(compositeTestTrace(map[string]interface{}{"service.name": "search"}))
+	assert.True(t, pass)
+
+	// if every step passes, the trace is kept
+	rate, keep, reason, _ := sampler.GetSampleRate(compositeTestTrace(map[string]interface{}{"service.name": "search"}))
+	assert.True(t, keep)
+	assert.Equal(t, uint(1), rate)
+	assert.Equal(t, "composite/no step decided", reason)
+}
+
+func TestCompositeSamplerInvalid(t *testing.T) {
+	for name, steps := range map[string][]*config.CompositeSamplerStep{
+		"no sampler":    {{Name: "empty"}},
+		"empty sampler": {{Name: "empty", Sampler: &config.CompositeStepSampler{}}},
+		"bad condition": {{
+			Conditions: []*config.RulesBasedSamplerCondition{{Field: "a", Operator: "bogus"}},
+			Sampler: &config.CompositeStepSampler{
+				RulesBasedDownstreamSampler: config.RulesBasedDownstreamSampler{
+					DeterministicSampler: &config.DeterministicSamplerConfig{SampleRate: 1},
+				},
+			},
+		}},
+	} {
+		sampler := &CompositeSampler{
+			Config:  &config.CompositeSamplerConfig{Steps: steps},
+			Logger:  &logger.NullLogger{},
+			Metrics: &metrics.NullMetrics{},
+		}
+		assert.Error(t, sampler.Start(), name)
+	}
+}
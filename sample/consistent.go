@@ -0,0 +1,123 @@
+package sample
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// The fields that the th and rv values of the ot entry of a span's
+// tracestate are copied into, so that they survive the span's translation
+// into an event. They're only set if consistent sampling is enabled.
+const (
+	OTelThresholdField  = "meta.refinery.ot.th"
+	OTelRandomnessField = "meta.refinery.ot.rv"
+)
+
+// maxThreshold is the number of possible values of the 56-bit randomness
+// and rejection thresholds of OpenTelemetry consistent probability sampling.
+const maxThreshold = uint64(1) << 56
+
+// RateThreshold returns the rejection threshold for a sample rate: a trace
+// whose randomness is at least the threshold is kept, which happens with a
+// probability of 1/rate.
+func RateThreshold(rate uint) uint64 {
+	if rate <= 1 {
+		return 0
+	}
+	return maxThreshold - maxThreshold/uint64(rate)
+}
+
+// ThresholdRate returns the sample rate, rounded to the nearest whole
+// number, of a rejection threshold.
+func ThresholdRate(threshold uint64) uint {
+	if threshold >= maxThreshold {
+		return math.MaxUint32
+	}
+	return uint(math.Round(float64(maxThreshold) / float64(maxThreshold-threshold)))
+}
+
+// ParseThreshold parses a th value: up to 14 hex digits, with trailing
+// zeros left out.
+func ParseThreshold(th string) (uint64, bool) {
+	if th == "" || len(th) > 14 {
+		return 0, false
+	}
+	t, err := strconv.ParseUint(th, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return t << (4 * (14 - len(th))), true
+}
+
+// FormatThreshold formats a threshold as a th value.
+func FormatThreshold(threshold uint64) string {
+	if threshold == 0 {
+		return "0"
+	}
+	return strings.TrimRight(strconv.FormatUint(threshold|maxThreshold, 16)[1:], "0")
+}
+
+// parseRandomness parses an rv value, which is exactly 14 hex digits.
+func parseRandomness(rv string) (uint64, bool) {
+	if len(rv) != 14 {
+		return 0, false
+	}
+	r, err := strconv.ParseUint(rv, 16, 64)
+	return r, err == nil
+}
+
+// traceRandomness returns the randomness of a trace ID: its last 56 bits if
+// it's hex, as the W3C trace context requires, or else a hash of it.
+func traceRandomness(traceID string) uint64 {
+	if len(traceID) >= 14 {
+		if r, err := strconv.ParseUint(traceID[len(traceID)-14:], 16, 64); err == nil {
+			return r
+		}
+	}
+	sum := sha1.Sum([]byte(traceID + shardingSalt))
+	return binary.BigEndian.Uint64(sum[:8]) % maxThreshold
+}
+
+// ConsistentTrace wraps a trace so that samplers decide about it consistently
+// with OpenTelemetry head samplers, by comparing its randomness with the
+// threshold for their sample rate.
+type ConsistentTrace struct {
+	FieldsExtractor
+	Randomness uint64
+}
+
+// NewConsistentTrace wraps a trace, using the rv value from its spans as its
+// randomness if there is one, and its trace ID if not.
+func NewConsistentTrace(trace FieldsExtractor) *ConsistentTrace {
+	ct := &ConsistentTrace{FieldsExtractor: trace, Randomness: traceRandomness(trace.ID())}
+	for _, span := range trace.AllFields() {
+		if rv, ok := span.Fields()[OTelRandomnessField].(string); ok {
+			if r, ok := parseRandomness(rv); ok {
+				ct.Randomness = r
+				break
+			}
+		}
+	}
+	return ct
+}
+
+func (t *ConsistentTrace) unwrap() FieldsExtractor {
+	return t.FieldsExtractor
+}
+
+// keepWithRate decides whether to keep a trace with a probability of
+// 1/rate. The decision is consistent if the trace is wrapped by a
+// ConsistentTrace, and random otherwise.
+func keepWithRate(trace FieldsExtractor, rate uint) bool {
+	if rate < 1 {
+		return false
+	}
+	if ct, ok := findWrapped[*ConsistentTrace](trace); ok {
+		return ct.Randomness >= RateThreshold(rate)
+	}
+	return rand.Intn(int(rate)) == 0
+}
@@ -0,0 +1,87 @@
+package sample
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/types"
+)
+
+func TestThresholds(t *testing.T) {
+	tests := []struct {
+		rate uint
+		th   string
+	}{
+		{1, "0"},
+		{2, "8"},
+		{4, "c"},
+		{10, "e6666666666667"},
+		{16, "f"},
+		{256, "ff"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.rate), func(t *testing.T) {
+			threshold := RateThreshold(tt.rate)
+			assert.Equal(t, tt.th, FormatThreshold(threshold))
+			parsed, ok := ParseThreshold(tt.th)
+			require.True(t, ok)
+			assert.Equal(t, threshold, parsed)
+			assert.Equal(t, tt.rate, ThresholdRate(parsed))
+		})
+	}
+
+	for _, th := range []string{"", "g", "123456789abcdef"} {
+		_, ok := ParseThreshold(th)
+		assert.False(t, ok, th)
+	}
+}
+
+func TestConsistentTraceRandomness(t *testing.T) {
+	trace := &types.Trace{TraceID: "0af7651916cd43dd8448eb211c80319c"}
+	assert.Equal(t, uint64(0x48eb211c80319c), NewConsistentTrace(trace).Randomness)
+
+	// an explicit rv wins over the trace ID
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{
+		OTelRandomnessField: "00000000000001",
+	}}})
+	assert.Equal(t, uint64(1), NewConsistentTrace(trace).Randomness)
+
+	// trace IDs that aren't hex are hashed
+	other := NewConsistentTrace(&types.Trace{TraceID: "not-a-hex-trace-id"})
+	assert.Less(t, other.Randomness, maxThreshold)
+	assert.Equal(t, other.Randomness, NewConsistentTrace(&types.Trace{TraceID: "not-a-hex-trace-id"}).Randomness)
+}
+
+func TestKeepWithRateConsistent(t *testing.T) {
+	// a trace kept at a rate is kept at every lower rate
+	for i := 0; i < 1000; i++ {
+		trace := NewConsistentTrace(&types.Trace{TraceID: fmt.Sprintf("%032x", i*7919*104729)})
+		keptAt := 0
+		for _, rate := range []uint{1, 2, 4, 10, 100} {
+			if keepWithRate(trace, rate) {
+				keptAt++
+			} else {
+				break
+			}
+		}
+		for _, rate := range []uint{1, 2, 4, 10, 100}[keptAt:] {
+			assert.False(t, keepWithRate(trace, rate))
+		}
+		assert.Equal(t, keepWithRate(trace, 10), keepWithRate(NewDryRunTrace(trace), 10))
+	}
+
+	ds := &DeterministicSampler{
+		Config: &config.DeterministicSamplerConfig{SampleRate: 4},
+		Logger: &logger.NullLogger{},
+	}
+	ds.Start()
+	_, keep, _, _ := ds.GetSampleRate(NewConsistentTrace(&types.Trace{TraceID: "000000000000000000c0000000000000"}))
+	assert.True(t, keep)
+	_, keep, _, _ = ds.GetSampleRate(NewConsistentTrace(&types.Trace{TraceID: "000000000000000000bfffffffffffff"}))
+	assert.False(t, keep)
+}
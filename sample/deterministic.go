@@ -3,6 +3,7 @@ package sample
 import (
 	"crypto/sha1"
 	"encoding/binary"
+	"fmt"
 	"math"
 
 	"github.com/honeycombio/refinery/config"
@@ -45,12 +46,21 @@ func (d *DeterministicSampler) GetSampleRate(trace FieldsExtractor) (rate uint,
 	if d.sampleRate <= 1 {
 		return 1, true, "deterministic/always", ""
 	}
-	// hash the trace ID and sharding salt, then take the first 4 bytes which is a
-	// uint32
+	// hash the trace ID (or the hash field's value) and sharding salt, then take
+	// the first 4 bytes which is a uint32
 	// This will give us a random number that is deterministic for a given trace ID and salt
-	sum := sha1.Sum([]byte(trace.ID() + shardingSalt))
+	hashed, ok := d.hashFieldValue(trace)
+	if !ok {
+		hashed = trace.ID()
+	}
+	sum := sha1.Sum([]byte(hashed + shardingSalt))
 	v := binary.BigEndian.Uint32(sum[:4])
 	shouldKeep := v <= d.upperBound
+	// with consistent sampling, the trace's randomness decides instead, so
+	// that the decision agrees with any OpenTelemetry head sampler
+	if ct, isConsistent := findWrapped[*ConsistentTrace](trace); isConsistent && !ok {
+		shouldKeep = ct.Randomness >= RateThreshold(uint(d.sampleRate))
+	}
 	if shouldKeep {
 		d.Metrics.Increment(d.prefix + "num_kept")
 	} else {
@@ -60,6 +70,26 @@ func (d *DeterministicSampler) GetSampleRate(trace FieldsExtractor) (rate uint,
 	return uint(d.sampleRate), shouldKeep, "deterministic/chance", ""
 }
 
+// hashFieldValue returns the value of the hash field that the trace is
+// sampled by, from the root span if it has one, or else the first span that
+// does. It returns false if there's no hash field or no span has it.
+func (d *DeterministicSampler) hashFieldValue(trace FieldsExtractor) (string, bool) {
+	if d.Config.HashField == "" {
+		return "", false
+	}
+	if root := trace.RootFields(); root != nil {
+		if val, ok := root.Fields()[d.Config.HashField]; ok {
+			return fmt.Sprint(val), true
+		}
+	}
+	for _, span := range trace.AllFields() {
+		if val, ok := span.Fields()[d.Config.HashField]; ok {
+			return fmt.Sprint(val), true
+		}
+	}
+	return "", false
+}
+
 func (d *DeterministicSampler) GetKeyFields() []string {
 	return d.Config.GetSamplingFields()
 }
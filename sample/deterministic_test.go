@@ -58,3 +58,33 @@ func TestGetSampleRate(t *testing.T) {
 	}
 
 }
+
+// TestGetSampleRateWithHashField verifies that traces with the same value of
+// the hash field get the same response, whatever their trace IDs
+func TestGetSampleRateWithHashField(t *testing.T) {
+	ds := &DeterministicSampler{
+		Config: &config.DeterministicSamplerConfig{
+			SampleRate: 10,
+			HashField:  "customer.id",
+		},
+		Logger: &logger.NullLogger{},
+	}
+	ds.Start()
+	assert.Equal(t, []string{"customer.id"}, ds.GetKeyFields())
+
+	withCustomer := func(traceID string, customer string) *types.Trace {
+		trace := &types.Trace{TraceID: traceID}
+		trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"customer.id": customer}}})
+		return trace
+	}
+	for _, traceID := range []string{"abc123", "ghi789", "zyx987", "wvu654"} {
+		_, keep, _, _ := ds.GetSampleRate(withCustomer(traceID, "def456"))
+		assert.True(t, keep, traceID)
+		_, keep, _, _ = ds.GetSampleRate(withCustomer(traceID, "abc123"))
+		assert.False(t, keep, traceID)
+	}
+
+	// traces without the field are sampled by their trace ID
+	_, keep, _, _ := ds.GetSampleRate(&types.Trace{TraceID: "def456"})
+	assert.True(t, keep)
+}
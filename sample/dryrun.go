@@ -0,0 +1,35 @@
+package sample
+
+// DryRunTrace wraps a trace to record what the first dry run rule that
+// matches it would have decided.
+type DryRunTrace struct {
+	FieldsExtractor
+	// Matched is true if a dry run rule matched the trace, and then Rate,
+	// Keep and Reason are the decision it would have made.
+	Matched bool
+	Rate    uint
+	Keep    bool
+	Reason  string
+}
+
+// NewDryRunTrace wraps a trace before it's given to a sampler.
+func NewDryRunTrace(trace FieldsExtractor) *DryRunTrace {
+	return &DryRunTrace{FieldsExtractor: trace}
+}
+
+func (t *DryRunTrace) unwrap() FieldsExtractor {
+	return t.FieldsExtractor
+}
+
+// recordDryRun records a dry run decision on the trace, if it's wrapped by a
+// DryRunTrace and no earlier dry run rule has matched it.
+func recordDryRun(trace FieldsExtractor, rate uint, keep bool, reason string) {
+	dt, ok := findWrapped[*DryRunTrace](trace)
+	if !ok || dt.Matched {
+		return
+	}
+	dt.Matched = true
+	dt.Rate = rate
+	dt.Keep = keep
+	dt.Reason = reason
+}
@@ -1,7 +1,6 @@
 package sample
 
 import (
-	"math/rand"
 	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -22,10 +21,16 @@ type DynamicSampler struct {
 	prefix         string
 	lastMetrics    map[string]int64
 
+	keys *keyStats
+	// keyMeter meters the keys for the memory budget
+	keyMeter *keyMeter
+
 	key       *traceKey
 	keyFields []string
 
 	dynsampler dynsampler.Sampler
+	// goal scales the rates of the dynsampler when its goal is adjusted
+	goal *goalScale
 }
 
 func (d *DynamicSampler) Start() error {
@@ -41,7 +46,11 @@ func (d *DynamicSampler) Start() error {
 	if d.maxKeys == 0 {
 		d.maxKeys = 500
 	}
+	d.keys = newKeyStats(d.maxKeys, d.keyMeter)
 	d.prefix = "dynamic_"
+	if d.Config.DropHighCardinalityFields {
+		limitKeyCardinality(d.key, d.maxKeys, time.Duration(d.clearFrequency), d.prefix, d.Logger, d.Metrics)
+	}
 	d.keyFields = d.Config.GetSamplingFields()
 
 	// spin up the actual dynamic sampler
@@ -51,6 +60,7 @@ func (d *DynamicSampler) Start() error {
 		MaxKeys:                d.maxKeys,
 	}
 	d.dynsampler.Start()
+	d.goal = newGoalScale(int(d.sampleRate))
 
 	// Register statistics this package will produce
 	d.lastMetrics = d.dynsampler.GetMetrics(d.prefix)
@@ -65,13 +75,15 @@ func (d *DynamicSampler) Start() error {
 }
 
 func (d *DynamicSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
-	key = d.key.build(trace)
+	key = d.keys.admit(d.key.build(trace))
 	count := int(trace.DescendantCount())
 	rate = uint(d.dynsampler.GetSampleRateMulti(key, count))
 	if rate < 1 { // protect against dynsampler being broken even though it shouldn't be
 		rate = 1
 	}
-	shouldKeep := rand.Intn(int(rate)) == 0
+	rate = d.goal.apply(rate)
+	d.keys.record(key, count, rate)
+	shouldKeep := keepWithRate(trace, rate)
 	d.Logger.Debug().WithFields(map[string]interface{}{
 		"sample_key":  key,
 		"sample_rate": rate,
@@ -97,6 +109,22 @@ func (d *DynamicSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep b
 	return rate, shouldKeep, "dynamic", key
 }
 
+// ReportKeys reports the keys seen recently, and their rates.
+func (d *DynamicSampler) ReportKeys() []SamplerKeysReport {
+	return []SamplerKeysReport{{Sampler: "dynamic", Keys: d.keys.report()}}
+}
+
+// GoalSampleRate returns the goal sample rate, including any adjustment.
+func (d *DynamicSampler) GoalSampleRate() int {
+	return d.goal.get()
+}
+
+// SetGoalSampleRate adjusts the goal sample rate until the sampler is
+// recreated.
+func (d *DynamicSampler) SetGoalSampleRate(goal int) {
+	d.goal.set(goal)
+}
+
 func (d *DynamicSampler) GetKeyFields() []string {
-	return d.key.fields
+	return d.keyFields
 }
@@ -1,7 +1,6 @@
 package sample
 
 import (
-	"math/rand"
 	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -26,10 +25,16 @@ type EMADynamicSampler struct {
 	prefix              string
 	lastMetrics         map[string]int64
 
+	keys *keyStats
+	// keyMeter meters the keys for the memory budget
+	keyMeter *keyMeter
+
 	key       *traceKey
 	keyFields []string
 
 	dynsampler dynsampler.Sampler
+	// goal scales the rates of the dynsampler when its goal is adjusted
+	goal *goalScale
 }
 
 func (d *EMADynamicSampler) Start() error {
@@ -46,7 +51,11 @@ func (d *EMADynamicSampler) Start() error {
 	if d.maxKeys == 0 {
 		d.maxKeys = 500
 	}
+	d.keys = newKeyStats(d.maxKeys, d.keyMeter)
 	d.prefix = "emadynamic_"
+	if d.Config.DropHighCardinalityFields {
+		limitKeyCardinality(d.key, d.maxKeys, time.Duration(d.adjustmentInterval), d.prefix, d.Logger, d.Metrics)
+	}
 
 	d.keyFields = d.Config.GetSamplingFields()
 
@@ -61,6 +70,7 @@ func (d *EMADynamicSampler) Start() error {
 		MaxKeys:                    d.maxKeys,
 	}
 	d.dynsampler.Start()
+	d.goal = newGoalScale(d.goalSampleRate)
 
 	// Register statistics this package will produce
 	d.lastMetrics = d.dynsampler.GetMetrics(d.prefix)
@@ -74,13 +84,15 @@ func (d *EMADynamicSampler) Start() error {
 }
 
 func (d *EMADynamicSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
-	key = d.key.build(trace)
+	key = d.keys.admit(d.key.build(trace))
 	count := int(trace.DescendantCount())
 	rate = uint(d.dynsampler.GetSampleRateMulti(key, count))
 	if rate < 1 { // protect against dynsampler being broken even though it shouldn't be
 		rate = 1
 	}
-	shouldKeep := rand.Intn(int(rate)) == 0
+	rate = d.goal.apply(rate)
+	d.keys.record(key, count, rate)
+	shouldKeep := keepWithRate(trace, rate)
 	d.Logger.Debug().WithFields(map[string]interface{}{
 		"sample_key":  key,
 		"sample_rate": rate,
@@ -106,6 +118,22 @@ func (d *EMADynamicSampler) GetSampleRate(trace FieldsExtractor) (rate uint, kee
 	return rate, shouldKeep, "emadynamic", key
 }
 
+// ReportKeys reports the keys seen recently, and their rates.
+func (d *EMADynamicSampler) ReportKeys() []SamplerKeysReport {
+	return []SamplerKeysReport{{Sampler: "emadynamic", Keys: d.keys.report()}}
+}
+
+// GoalSampleRate returns the goal sample rate, including any adjustment.
+func (d *EMADynamicSampler) GoalSampleRate() int {
+	return d.goal.get()
+}
+
+// SetGoalSampleRate adjusts the goal sample rate until the sampler is
+// recreated.
+func (d *EMADynamicSampler) SetGoalSampleRate(goal int) {
+	d.goal.set(goal)
+}
+
 func (d *EMADynamicSampler) GetKeyFields() []string {
 	return d.keyFields
 }
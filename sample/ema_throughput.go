@@ -1,7 +1,6 @@
 package sample
 
 import (
-	"math/rand"
 	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -29,6 +28,10 @@ type EMAThroughputSampler struct {
 	prefix               string
 	lastMetrics          map[string]int64
 
+	keys *keyStats
+	// keyMeter meters the keys for the memory budget
+	keyMeter *keyMeter
+
 	key       *traceKey
 	keyFields []string
 
@@ -54,7 +57,11 @@ func (d *EMAThroughputSampler) Start() error {
 	if d.maxKeys == 0 {
 		d.maxKeys = 500
 	}
+	d.keys = newKeyStats(d.maxKeys, d.keyMeter)
 	d.prefix = "emathroughput_"
+	if d.Config.DropHighCardinalityFields {
+		limitKeyCardinality(d.key, d.maxKeys, time.Duration(d.adjustmentInterval), d.prefix, d.Logger, d.Metrics)
+	}
 
 	d.keyFields = d.Config.GetSamplingFields()
 
@@ -91,13 +98,14 @@ func (d *EMAThroughputSampler) SetClusterSize(size int) {
 }
 
 func (d *EMAThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
-	key = d.key.build(trace)
+	key = d.keys.admit(d.key.build(trace))
 	count := int(trace.DescendantCount())
 	rate = uint(d.dynsampler.GetSampleRateMulti(key, count))
 	if rate < 1 { // protect against dynsampler being broken even though it shouldn't be
 		rate = 1
 	}
-	shouldKeep := rand.Intn(int(rate)) == 0
+	d.keys.record(key, count, rate)
+	shouldKeep := keepWithRate(trace, rate)
 	d.Logger.Debug().WithFields(map[string]interface{}{
 		"sample_key":  key,
 		"sample_rate": rate,
@@ -123,6 +131,11 @@ func (d *EMAThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate uint,
 	return rate, shouldKeep, "emathroughput", key
 }
 
+// ReportKeys reports the keys seen recently, and their rates.
+func (d *EMAThroughputSampler) ReportKeys() []SamplerKeysReport {
+	return []SamplerKeysReport{{Sampler: "emathroughput", Keys: d.keys.report()}}
+}
+
 func (d *EMAThroughputSampler) GetKeyFields() []string {
 	return d.keyFields
 }
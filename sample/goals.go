@@ -0,0 +1,225 @@
+package sample
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// goalBuckets is how many parts the window of achieved sample rates is
+	// measured in, and how often per window the goals are checked.
+	goalBuckets = 10
+	// minGoalTraces is how many traces a target needs in a window before
+	// its achieved sample rate is compared with its goal.
+	minGoalTraces = 100
+	// maxGoalAdjustment is the most that one adjustment changes a goal by.
+	maxGoalAdjustment = 2.0
+)
+
+// GoalAdjuster is a sampler whose goal sample rate can be adjusted while it
+// runs.
+type GoalAdjuster interface {
+	GoalSampleRate() int
+	SetGoalSampleRate(goal int)
+}
+
+// goalScale scales the rates that a dynamic sampler chooses, which adjusts
+// its goal without restarting it and losing what it has learned about its
+// keys.
+type goalScale struct {
+	goal  int
+	scale atomic.Uint64
+}
+
+func newGoalScale(goal int) *goalScale {
+	g := &goalScale{goal: max(goal, 1)}
+	g.scale.Store(math.Float64bits(1))
+	return g
+}
+
+func (g *goalScale) apply(rate uint) uint {
+	scale := math.Float64frombits(g.scale.Load())
+	if scale == 1 {
+		return rate
+	}
+	return max(uint(math.Round(float64(rate)*scale)), 1)
+}
+
+func (g *goalScale) get() int {
+	return int(math.Round(float64(g.goal) * math.Float64frombits(g.scale.Load())))
+}
+
+func (g *goalScale) set(goal int) {
+	g.scale.Store(math.Float64bits(float64(max(goal, 1)) / float64(g.goal)))
+}
+
+// goalTracker counts the traces decided and kept for each target over a
+// sliding window.
+type goalTracker struct {
+	mut     sync.Mutex
+	buckets [goalBuckets]map[string]*goalCounts
+	current int
+}
+
+type goalCounts struct {
+	traces int64
+	kept   int64
+}
+
+func newGoalTracker() *goalTracker {
+	t := &goalTracker{}
+	for i := range t.buckets {
+		t.buckets[i] = make(map[string]*goalCounts)
+	}
+	return t
+}
+
+func (t *goalTracker) record(target string, keep bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	counts, ok := t.buckets[t.current][target]
+	if !ok {
+		counts = &goalCounts{}
+		t.buckets[t.current][target] = counts
+	}
+	counts.traces++
+	if keep {
+		counts.kept++
+	}
+}
+
+// rotate returns the counts over the whole window, and starts a new bucket
+// in place of the oldest.
+func (t *goalTracker) rotate() map[string]goalCounts {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	totals := make(map[string]goalCounts)
+	for _, bucket := range t.buckets {
+		for target, c := range bucket {
+			total := totals[target]
+			total.traces += c.traces
+			total.kept += c.kept
+			totals[target] = total
+		}
+	}
+	t.current = (t.current + 1) % goalBuckets
+	t.buckets[t.current] = make(map[string]*goalCounts)
+	return totals
+}
+
+// reset forgets a target's counts, so that it's measured afresh after its
+// goal is adjusted.
+func (t *goalTracker) reset(target string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for _, bucket := range t.buckets {
+		delete(bucket, target)
+	}
+}
+
+// RecordDecision counts a trace decided for a target, so that the sample
+// rate it achieves can be compared with its goal.
+func (s *SamplerFactory) RecordDecision(target string, keep bool) {
+	if s.goals == nil || len(s.Config.GetSamplingGoalsConfig().Targets) == 0 {
+		return
+	}
+	s.goals.record(target, keep)
+}
+
+// trackGoals checks the goals 10 times per window until the factory is
+// stopped.
+func (s *SamplerFactory) trackGoals() {
+	for {
+		interval := time.Duration(s.Config.GetSamplingGoalsConfig().Window) / goalBuckets
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.checkGoals()
+		}
+	}
+}
+
+// checkGoals compares the sample rate that each target achieved over the
+// window with its goal, reporting the targets that are off, and adjusting
+// their dynamic samplers if that's enabled.
+func (s *SamplerFactory) checkGoals() {
+	cfg := s.Config.GetSamplingGoalsConfig()
+	totals := s.goals.rotate()
+
+	targets := make([]string, 0, len(cfg.Targets))
+	for target := range cfg.Targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	var off int
+	var maxDrift float64
+	for _, target := range targets {
+		goal := cfg.Targets[target]
+		counts := totals[target]
+		if goal < 1 || counts.traces < minGoalTraces {
+			continue
+		}
+		// with nothing kept, the rate is at least the number of traces
+		achieved := float64(counts.traces) / float64(max(counts.kept, 1))
+		drift := 100 * (achieved - float64(goal)) / float64(goal)
+		maxDrift = max(maxDrift, math.Abs(drift))
+		if math.Abs(drift) <= float64(cfg.Tolerance) {
+			continue
+		}
+		off++
+		s.Logger.Warn().WithFields(map[string]interface{}{
+			"target":               target,
+			"goal_sample_rate":     goal,
+			"achieved_sample_rate": achieved,
+			"drift_percent":        drift,
+			"traces":               counts.traces,
+		}).Logf("achieved sample rate is off its goal")
+
+		if cfg.AutoAdjust {
+			s.adjustGoal(target, float64(goal)/achieved, cfg.MinGoalSampleRate, cfg.MaxGoalSampleRate)
+		}
+	}
+	s.Metrics.Gauge("sampling_goal_max_drift", maxDrift)
+	s.Metrics.Gauge("sampling_goal_targets_off", off)
+}
+
+// adjustGoal multiplies the goal of a target's dynamic sampler by a factor,
+// keeping it within bounds.
+func (s *SamplerFactory) adjustGoal(target string, factor float64, minGoal int, maxGoal int) {
+	s.goalMut.Lock()
+	adjuster, ok := s.goalAdjusters[target]
+	s.goalMut.Unlock()
+	if !ok {
+		return
+	}
+
+	factor = min(max(factor, 1/maxGoalAdjustment), maxGoalAdjustment)
+	current := adjuster.GoalSampleRate()
+	next := int(math.Round(float64(current) * factor))
+	if maxGoal >= 1 {
+		next = min(next, maxGoal)
+	}
+	next = max(next, minGoal, 1)
+	if next == current {
+		return
+	}
+	adjuster.SetGoalSampleRate(next)
+	s.goals.reset(target)
+	s.Metrics.Increment("sampling_goal_adjustments")
+	s.Logger.Info().WithFields(map[string]interface{}{
+		"target":       target,
+		"old_goal":     current,
+		"new_goal":     next,
+		"adjust_ratio": factor,
+	}).Logf("adjusted dynamic sampler goal sample rate")
+}
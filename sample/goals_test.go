@@ -0,0 +1,90 @@
+package sample
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+func TestGoalScale(t *testing.T) {
+	g := newGoalScale(10)
+	assert.Equal(t, 10, g.get())
+	assert.Equal(t, uint(7), g.apply(7))
+
+	g.set(20)
+	assert.Equal(t, 20, g.get())
+	assert.Equal(t, uint(14), g.apply(7))
+
+	g.set(1)
+	assert.Equal(t, 1, g.get())
+	assert.Equal(t, uint(1), g.apply(3))
+}
+
+func TestGoalTrackerWindow(t *testing.T) {
+	tracker := newGoalTracker()
+	tracker.record("a", true)
+	tracker.record("a", false)
+	assert.Equal(t, goalCounts{traces: 2, kept: 1}, tracker.rotate()["a"])
+
+	// counts stay in the window until their bucket comes round again
+	for i := 0; i < goalBuckets-1; i++ {
+		assert.Equal(t, int64(2), tracker.rotate()["a"].traces)
+	}
+	assert.Equal(t, int64(0), tracker.rotate()["a"].traces)
+
+	tracker.record("a", true)
+	tracker.reset("a")
+	assert.NotContains(t, tracker.rotate(), "a")
+}
+
+func TestCheckGoals(t *testing.T) {
+	cfg := &config.MockConfig{
+		GetSamplerTypeVal: &config.DynamicSamplerConfig{SampleRate: 10, FieldList: []string{"path"}},
+		SamplingGoals: config.SamplingGoalsConfig{
+			Targets:           map[string]int{"production": 50, "staging": 10},
+			Window:            config.Duration(time.Minute),
+			Tolerance:         10,
+			AutoAdjust:        true,
+			MinGoalSampleRate: 1,
+			MaxGoalSampleRate: 30,
+		},
+	}
+	m := &metrics.MockMetrics{}
+	m.Start()
+	factory := &SamplerFactory{Config: cfg, Logger: &logger.NullLogger{}, Metrics: m}
+	require.NoError(t, factory.Start())
+	defer factory.Stop()
+
+	production := factory.GetSamplerImplementationForKey("production").(*DynamicSampler)
+	staging := factory.GetSamplerImplementationForKey("staging").(*DynamicSampler)
+
+	// production keeps 1 in 10 against a goal of 50, staging is on target
+	for i := 0; i < 200; i++ {
+		factory.RecordDecision("production", i%10 == 0)
+		factory.RecordDecision("staging", i%10 == 0)
+		factory.RecordDecision("untracked", true)
+	}
+	factory.checkGoals()
+
+	assert.Equal(t, 80.0, m.GaugeRecords["sampling_goal_max_drift"])
+	assert.Equal(t, 1.0, m.GaugeRecords["sampling_goal_targets_off"])
+	assert.Equal(t, 1, m.CounterIncrements["sampling_goal_adjustments"])
+	// the adjustment is at most a factor of 2
+	assert.Equal(t, 20, production.GoalSampleRate())
+	assert.Equal(t, 10, staging.GoalSampleRate())
+
+	// the adjusted target is measured afresh, and adjustments stay in bounds
+	factory.checkGoals()
+	assert.Equal(t, 20, production.GoalSampleRate())
+	for i := 0; i < 200; i++ {
+		factory.RecordDecision("production", i%10 == 0)
+	}
+	factory.checkGoals()
+	assert.Equal(t, 30, production.GoalSampleRate())
+}
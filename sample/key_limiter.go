@@ -0,0 +1,143 @@
+package sample
+
+import (
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+// keyLimiter protects a sampler from a key field with too many values, such
+// as a user ID, which would give it more keys than it can track. It counts
+// the distinct keys in each interval, and if there are more than maxKeys, it
+// drops the field with the most distinct values from the key. Dropped fields
+// stay dropped until the sampler is recreated, as it is when the rules are
+// reloaded. The last remaining field is never dropped.
+type keyLimiter struct {
+	maxKeys  int
+	interval time.Duration
+	now      func() time.Time
+	// onDrop is called when a field is dropped, with the number of values
+	// it had; onLimit is called once an interval if the limit is exceeded
+	// but no field can be dropped.
+	onDrop  func(field string, values int)
+	onLimit func(keys int)
+
+	mut     sync.Mutex
+	start   time.Time
+	keys    map[string]struct{}
+	values  map[string]map[string]struct{}
+	limited bool
+	// dropped is replaced rather than changed, so that it can be used
+	// without holding the lock.
+	dropped map[string]bool
+}
+
+func newKeyLimiter(maxKeys int, interval time.Duration) *keyLimiter {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	l := &keyLimiter{
+		maxKeys:  maxKeys,
+		interval: interval,
+		now:      time.Now,
+		onDrop:   func(string, int) {},
+		onLimit:  func(int) {},
+		dropped:  map[string]bool{},
+	}
+	l.reset(l.now())
+	return l
+}
+
+func (l *keyLimiter) reset(now time.Time) {
+	l.start = now
+	l.keys = make(map[string]struct{})
+	l.values = make(map[string]map[string]struct{})
+	l.limited = false
+}
+
+// observe records the key made from the parts of each field, and returns
+// the fields that are dropped from keys.
+func (l *keyLimiter) observe(fields []string, parts []string) map[string]bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := l.now()
+	if now.Sub(l.start) >= l.interval {
+		l.reset(now)
+	}
+
+	var key string
+	var kept int
+	for i, field := range fields {
+		if l.dropped[field] {
+			continue
+		}
+		kept++
+		key += parts[i] + ","
+		values, ok := l.values[field]
+		if !ok {
+			values = make(map[string]struct{})
+			l.values[field] = values
+		}
+		// no field needs to be counted past the limit
+		if len(values) <= l.maxKeys {
+			values[parts[i]] = struct{}{}
+		}
+	}
+	if _, ok := l.keys[key]; ok || l.limited {
+		return l.dropped
+	}
+	l.keys[key] = struct{}{}
+	if len(l.keys) <= l.maxKeys {
+		return l.dropped
+	}
+
+	if kept <= 1 {
+		l.limited = true
+		l.onLimit(len(l.keys))
+		return l.dropped
+	}
+
+	var worst string
+	for _, field := range fields {
+		if !l.dropped[field] && len(l.values[field]) > len(l.values[worst]) {
+			worst = field
+		}
+	}
+	dropped := make(map[string]bool, len(l.dropped)+1)
+	for field := range l.dropped {
+		dropped[field] = true
+	}
+	dropped[worst] = true
+	l.dropped = dropped
+	l.onDrop(worst, len(l.values[worst]))
+	// count the keys again without the field
+	l.reset(now)
+	return l.dropped
+}
+
+// limitKeyCardinality makes a sampler's keys drop fields with too many
+// values, logging and counting when that happens.
+func limitKeyCardinality(key *traceKey, maxKeys int, interval time.Duration, prefix string, lgr logger.Logger, m metrics.Metrics) {
+	m.Register(prefix+"key_fields_dropped", "counter")
+	m.Register(prefix+"key_limit_reached", "counter")
+
+	key.limiter = newKeyLimiter(maxKeys, interval)
+	key.limiter.onDrop = func(field string, values int) {
+		m.Increment(prefix + "key_fields_dropped")
+		lgr.Warn().WithFields(map[string]interface{}{
+			"field":    field,
+			"values":   values,
+			"max_keys": maxKeys,
+		}).Logf("dropping field with too many values from sampler key")
+	}
+	key.limiter.onLimit = func(keys int) {
+		m.Increment(prefix + "key_limit_reached")
+		lgr.Warn().WithFields(map[string]interface{}{
+			"keys":     keys,
+			"max_keys": maxKeys,
+		}).Logf("sampler has too many keys, but no field can be dropped")
+	}
+}
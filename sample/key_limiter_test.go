@@ -0,0 +1,79 @@
+package sample
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyLimiter(t *testing.T) {
+	now := time.Now()
+	l := newKeyLimiter(3, time.Minute)
+	l.now = func() time.Time { return now }
+	l.reset(now)
+	var dropped []string
+	l.onDrop = func(field string, values int) { dropped = append(dropped, field) }
+	var limited int
+	l.onLimit = func(keys int) { limited++ }
+
+	fields := []string{"route", "status", "user"}
+	observe := func(route, status, user string) map[string]bool {
+		return l.observe(fields, []string{route, status, user})
+	}
+
+	// keys within the limit are left alone
+	observe("/a", "200", "u1")
+	observe("/a", "200", "u2")
+	observe("/a", "500", "u3")
+	assert.Empty(t, observe("/a", "200", "u1"))
+
+	// the field with the most values is dropped when the limit is passed
+	assert.Equal(t, map[string]bool{"user": true}, observe("/b", "200", "u4"))
+	assert.Equal(t, []string{"user"}, dropped)
+
+	// a new interval starts the count again, but fields stay dropped
+	now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		observe(fmt.Sprintf("/%d", i), "200", "u")
+	}
+	assert.Equal(t, []string{"user", "route"}, dropped)
+
+	// the last field is never dropped
+	for i := 0; i < 5; i++ {
+		observe("/", fmt.Sprint(i), "u")
+	}
+	assert.Equal(t, []string{"user", "route"}, dropped)
+	assert.Equal(t, 1, limited)
+}
+
+func TestDynamicSamplerDropsHighCardinalityFields(t *testing.T) {
+	sampler := &DynamicSampler{
+		Config: &config.DynamicSamplerConfig{
+			SampleRate:                1,
+			FieldList:                 []string{"http.method", "user.id"},
+			MaxKeys:                   10,
+			DropHighCardinalityFields: true,
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, sampler.Start())
+
+	var key string
+	for i := 0; i < 20; i++ {
+		trace := &types.Trace{}
+		trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{
+			"http.method": "GET",
+			"user.id":     fmt.Sprintf("user-%d", i),
+		}}})
+		_, _, _, key = sampler.GetSampleRate(trace)
+	}
+	assert.Equal(t, "GET•,", key)
+}
@@ -0,0 +1,337 @@
+package sample
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/refinery/internal/membudget"
+)
+
+// keyStatsInterval is how long the throughput of each key is measured over.
+const keyStatsInterval = 30 * time.Second
+
+// SamplerKeysReport lists the keys that a sampler has seen recently.
+type SamplerKeysReport struct {
+	Target string `json:"target"`
+	// Sampler names the sampler within the target's config, such as
+	// "dynamic", or "rules/<rule name>:dynamic" for a rule's sampler.
+	Sampler string           `json:"sampler"`
+	Keys    []SamplerKeyStat `json:"keys"`
+}
+
+// SamplerKeyStat is one key's part of a SamplerKeysReport. Throughput is
+// measured over the last complete interval of 30 seconds, or since the
+// sampler started if there hasn't been one yet.
+type SamplerKeyStat struct {
+	Key          string  `json:"key"`
+	TracesPerSec float64 `json:"traces_per_sec"`
+	EventsPerSec float64 `json:"events_per_sec"`
+	// SampleRate is the rate most recently given to the key.
+	SampleRate uint `json:"sample_rate"`
+}
+
+// KeyReporter is a sampler that can report the keys it has seen.
+type KeyReporter interface {
+	ReportKeys() []SamplerKeysReport
+}
+
+// overBudgetKey is the key that samplers give traces with a new key while
+// the keys they track are over their part of the memory budget.
+const overBudgetKey = "sampler_keys_over_budget"
+
+// keyMeter estimates the memory used by the keys of one target's samplers
+// as their keyStats start and stop tracking them, for the memory budget.
+// A nil keyMeter meters nothing and is never full.
+type keyMeter struct {
+	bytes atomic.Int64
+	// full is shared by the meters of a factory's samplers, and is set while
+	// their keys are over their allowance
+	full *atomic.Bool
+}
+
+func (m *keyMeter) add(n int64) {
+	if m != nil {
+		m.bytes.Add(n)
+	}
+}
+
+func (m *keyMeter) isFull() bool {
+	return m != nil && m.full != nil && m.full.Load()
+}
+
+// keyStats tracks the throughput and latest sample rate of each key that a
+// sampler sees. Like the samplers, it only tracks up to maxKeys keys in an
+// interval.
+type keyStats struct {
+	maxKeys int
+	now     func() time.Time
+	meter   *keyMeter
+
+	mut          sync.Mutex
+	start        time.Time
+	current      map[string]*keyCounts
+	last         map[string]*keyCounts
+	lastDuration time.Duration
+	// currentBytes and lastBytes are what the keys of current and last add
+	// to the meter
+	currentBytes int64
+	lastBytes    int64
+}
+
+type keyCounts struct {
+	traces int64
+	events int64
+	rate   uint
+}
+
+func newKeyStats(maxKeys int, meter *keyMeter) *keyStats {
+	k := &keyStats{maxKeys: maxKeys, now: time.Now, meter: meter}
+	k.start = k.now()
+	k.current = make(map[string]*keyCounts)
+	return k
+}
+
+// admit returns the key that a sampler should use for a trace: its own key,
+// unless that's a key the sampler isn't tracking and the keys are over
+// budget, in which case new keys share overBudgetKey until they aren't.
+func (k *keyStats) admit(key string) string {
+	if !k.meter.isFull() {
+		return key
+	}
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if _, ok := k.current[key]; ok {
+		return key
+	}
+	if _, ok := k.last[key]; ok {
+		return key
+	}
+	return overBudgetKey
+}
+
+// record counts a trace with the given number of events for a key, and the
+// rate it was given.
+func (k *keyStats) record(key string, events int, rate uint) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	k.rotate(k.now())
+
+	counts, ok := k.current[key]
+	if !ok {
+		if k.maxKeys > 0 && len(k.current) >= k.maxKeys {
+			return
+		}
+		counts = &keyCounts{}
+		k.current[key] = counts
+		size := int64(len(key)) + samplerKeyBytes
+		k.currentBytes += size
+		k.meter.add(size)
+	}
+	counts.traces++
+	counts.events += int64(events)
+	counts.rate = rate
+}
+
+// rotate starts a new interval if the current one is over. If no trace was
+// recorded for a whole interval, the last interval is empty.
+func (k *keyStats) rotate(now time.Time) {
+	elapsed := now.Sub(k.start)
+	if elapsed < keyStatsInterval {
+		return
+	}
+	freed := k.lastBytes
+	if elapsed < 2*keyStatsInterval {
+		k.last, k.lastDuration = k.current, elapsed
+		k.lastBytes = k.currentBytes
+	} else {
+		k.last, k.lastDuration = map[string]*keyCounts{}, keyStatsInterval
+		k.lastBytes = 0
+		freed += k.currentBytes
+	}
+	k.meter.add(-freed)
+	k.current = make(map[string]*keyCounts, len(k.last))
+	k.currentBytes = 0
+	k.start = now
+}
+
+// report returns the stats for each key, in no particular order.
+func (k *keyStats) report() []SamplerKeyStat {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	now := k.now()
+	k.rotate(now)
+
+	counts, seconds := k.last, k.lastDuration.Seconds()
+	if counts == nil {
+		counts, seconds = k.current, now.Sub(k.start).Seconds()
+	}
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	stats := make([]SamplerKeyStat, 0, len(counts))
+	for key, c := range counts {
+		rate := c.rate
+		if latest, ok := k.current[key]; ok {
+			rate = latest.rate
+		}
+		stats = append(stats, SamplerKeyStat{
+			Key:          key,
+			TracesPerSec: float64(c.traces) / seconds,
+			EventsPerSec: float64(c.events) / seconds,
+			SampleRate:   rate,
+		})
+	}
+	return stats
+}
+
+// reportedTopKeys is how many of the busiest keys of each sampler are logged
+// by the periodic report.
+const reportedTopKeys = 10
+
+// SamplerKeys returns the reports of the current sampler for a target, or
+// false if the target has no sampler that reports its keys.
+func (s *SamplerFactory) SamplerKeys(target string) ([]SamplerKeysReport, bool) {
+	s.keysMut.Lock()
+	reporter, ok := s.keyReporters[target]
+	s.keysMut.Unlock()
+	if !ok {
+		return nil, false
+	}
+	reports := reporter.ReportKeys()
+	for i := range reports {
+		reports[i].Target = target
+	}
+	return reports, true
+}
+
+// samplerKeyBytes estimates the memory used by each key a sampler tracks,
+// apart from the key itself, across the sampler's maps and its key stats.
+const samplerKeyBytes = 200
+
+// keyBudgetInterval is how often the samplers' keys are checked against
+// their part of the memory budget.
+const keyBudgetInterval = 5 * time.Second
+
+// keysSize estimates the memory used by the keys of all current samplers,
+// for the memory budget.
+func (s *SamplerFactory) keysSize() int64 {
+	s.keysMut.Lock()
+	defer s.keysMut.Unlock()
+	var size int64
+	for _, meter := range s.keyMeters {
+		size += meter.bytes.Load()
+	}
+	return size
+}
+
+// newKeyMeter returns the meter for the keys of a new sampler for a target.
+// Only the current sampler of each target is counted by keysSize.
+func (s *SamplerFactory) newKeyMeter(target string) *keyMeter {
+	meter := &keyMeter{full: &s.keysFull}
+	s.keysMut.Lock()
+	defer s.keysMut.Unlock()
+	if s.keyMeters == nil {
+		s.keyMeters = make(map[string]*keyMeter)
+	}
+	s.keyMeters[target] = meter
+	return meter
+}
+
+// fitKeyBudget stops samplers from tracking new keys while their keys are
+// over their allowance from the memory budget, until the factory is stopped.
+func (s *SamplerFactory) fitKeyBudget() {
+	ticker := time.NewTicker(keyBudgetInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkKeyBudget()
+		}
+	}
+}
+
+func (s *SamplerFactory) checkKeyBudget() {
+	allocation, ok := s.Budget.Allocation(membudget.SamplerKeys)
+	full := ok && allocation.Over() > 0
+	if full && !s.keysFull.Load() {
+		s.Logger.Warn().WithFields(map[string]interface{}{
+			"used":      allocation.Used,
+			"allowance": allocation.Allowance,
+		}).Logf("sampler keys are over their memory budget; new keys will share one sample rate")
+	}
+	s.keysFull.Store(full)
+	if full {
+		s.Metrics.Gauge("sampler_keys_over_budget", 1)
+	} else {
+		s.Metrics.Gauge("sampler_keys_over_budget", 0)
+	}
+}
+
+// reportKeysEvery reports the keys of every sampler at each interval until
+// the factory is stopped.
+func (s *SamplerFactory) reportKeysEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.reportKeys()
+		}
+	}
+}
+
+// reportKeys sends metrics about the keys of all samplers, and logs the
+// busiest keys of each.
+func (s *SamplerFactory) reportKeys() {
+	s.keysMut.Lock()
+	targets := make([]string, 0, len(s.keyReporters))
+	for target := range s.keyReporters {
+		targets = append(targets, target)
+	}
+	s.keysMut.Unlock()
+	sort.Strings(targets)
+
+	var keys int
+	var maxEventsPerSec float64
+	var maxRate uint
+	for _, target := range targets {
+		reports, _ := s.SamplerKeys(target)
+		for _, report := range reports {
+			keys += len(report.Keys)
+			for _, k := range report.Keys {
+				maxEventsPerSec = max(maxEventsPerSec, k.EventsPerSec)
+				maxRate = max(maxRate, k.SampleRate)
+			}
+
+			SortKeysByThroughput(report.Keys)
+			top := report.Keys[:min(len(report.Keys), reportedTopKeys)]
+			s.Logger.Info().WithFields(map[string]interface{}{
+				"target":   report.Target,
+				"sampler":  report.Sampler,
+				"num_keys": len(report.Keys),
+				"top_keys": top,
+			}).Logf("sampler keys")
+		}
+	}
+	s.Metrics.Gauge("sampler_keys", keys)
+	s.Metrics.Gauge("sampler_key_max_events_per_sec", maxEventsPerSec)
+	s.Metrics.Gauge("sampler_key_max_sample_rate", maxRate)
+}
+
+// SortKeysByThroughput sorts keys from the busiest to the quietest, and by
+// key when their throughput is the same.
+func SortKeysByThroughput(keys []SamplerKeyStat) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].EventsPerSec != keys[j].EventsPerSec {
+			return keys[i].EventsPerSec > keys[j].EventsPerSec
+		}
+		return keys[i].Key < keys[j].Key
+	})
+}
@@ -0,0 +1,127 @@
+package sample
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/membudget"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStats(t *testing.T) {
+	now := time.Now()
+	meter := &keyMeter{}
+	k := newKeyStats(2, meter)
+	k.now = func() time.Time { return now }
+	k.start = now
+
+	k.record("a", 3, 10)
+	k.record("a", 1, 20)
+	k.record("b", 2, 5)
+	// keys past the limit aren't tracked
+	k.record("c", 1, 1)
+
+	assert.Equal(t, int64(2*(1+samplerKeyBytes)), meter.bytes.Load())
+
+	// until an interval has passed, throughput is measured since the start
+	now = now.Add(10 * time.Second)
+	stats := k.report()
+	SortKeysByThroughput(stats)
+	assert.Equal(t, []SamplerKeyStat{
+		{Key: "a", TracesPerSec: 0.2, EventsPerSec: 0.4, SampleRate: 20},
+		{Key: "b", TracesPerSec: 0.1, EventsPerSec: 0.2, SampleRate: 5},
+	}, stats)
+
+	// after that, it's measured over the last complete interval, with the
+	// latest rate
+	now = now.Add(20 * time.Second)
+	k.record("b", 1, 8)
+	stats = k.report()
+	SortKeysByThroughput(stats)
+	assert.Equal(t, []SamplerKeyStat{
+		{Key: "a", TracesPerSec: 2.0 / 30, EventsPerSec: 4.0 / 30, SampleRate: 20},
+		{Key: "b", TracesPerSec: 1.0 / 30, EventsPerSec: 2.0 / 30, SampleRate: 8},
+	}, stats)
+
+	// keys that haven't been seen for a whole interval are forgotten
+	now = now.Add(time.Minute)
+	assert.Empty(t, k.report())
+	assert.Equal(t, int64(0), meter.bytes.Load())
+}
+
+func TestSamplerFactoryKeys(t *testing.T) {
+	conf := &config.MockConfig{
+		GetSamplerTypeVal: &config.RulesBasedSamplerConfig{
+			Rules: []*config.RulesBasedSamplerRule{{
+				Name: "dynamic",
+				Sampler: &config.RulesBasedDownstreamSampler{
+					DynamicSampler: &config.DynamicSamplerConfig{SampleRate: 1, FieldList: []string{"http.method"}},
+				},
+			}},
+		},
+	}
+	factory := &SamplerFactory{Config: conf, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, factory.Start())
+	defer factory.Stop()
+
+	_, ok := factory.SamplerKeys("production")
+	assert.False(t, ok)
+
+	sampler := factory.GetSamplerImplementationForKey("production")
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"http.method": "GET"}}})
+	sampler.GetSampleRate(trace)
+
+	reports, ok := factory.SamplerKeys("production")
+	require.True(t, ok)
+	require.Len(t, reports, 1)
+	assert.Equal(t, "production", reports[0].Target)
+	assert.Equal(t, "rules/dynamic:dynamic", reports[0].Sampler)
+	require.Len(t, reports[0].Keys, 1)
+	assert.Equal(t, "GET•,", reports[0].Keys[0].Key)
+	assert.Equal(t, uint(1), reports[0].Keys[0].SampleRate)
+}
+
+func TestSamplerKeysBudget(t *testing.T) {
+	conf := &config.MockConfig{
+		GetSamplerTypeVal: &config.DynamicSamplerConfig{SampleRate: 1, FieldList: []string{"http.method"}},
+		MemoryBudget: config.MemoryBudgetConfig{
+			Enabled:          true,
+			Total:            300,
+			SamplerKeysShare: 10,
+		},
+	}
+	budget := &membudget.Budget{Config: conf, Metrics: &metrics.NullMetrics{}}
+	factory := &SamplerFactory{Config: conf, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}, Budget: budget}
+	require.NoError(t, factory.Start())
+	defer factory.Stop()
+
+	sampler := factory.GetSamplerImplementationForKey("production")
+	sampleKey := func(method string) string {
+		trace := &types.Trace{}
+		trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"http.method": method}}})
+		_, _, _, key := sampler.GetSampleRate(trace)
+		return key
+	}
+	assert.Equal(t, "GET•,", sampleKey("GET"))
+	assert.Equal(t, "POST•,", sampleKey("POST"))
+	// the size is kept as keys are tracked
+	assert.Equal(t, int64(len("GET•,")+len("POST•,")+2*samplerKeyBytes), factory.keysSize())
+
+	// over budget, keys already tracked are kept, but new keys share one
+	factory.checkKeyBudget()
+	assert.Equal(t, "GET•,", sampleKey("GET"))
+	assert.Equal(t, overBudgetKey, sampleKey("PUT"))
+
+	// a new sampler for the target replaces the old one's keys
+	conf.MemoryBudget.Total = 10000
+	sampler = factory.GetSamplerImplementationForKey("production")
+	assert.Equal(t, int64(0), factory.keysSize())
+	factory.checkKeyBudget()
+	assert.Equal(t, "PUT•,", sampleKey("PUT"))
+}
@@ -0,0 +1,199 @@
+package sample
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+// LatencySampler keeps more of the slowest traces of each key. It tracks the
+// recent distribution of trace durations for each key, and samples each
+// trace at the rate of the highest tier whose percentile its duration
+// reaches, or at the base rate if it reaches none. Until a key has seen
+// enough traces to know its distribution, its traces are sampled at the rate
+// of the highest tier. Keys beyond MaxKeys share one distribution.
+type LatencySampler struct {
+	Config  *config.LatencySamplerConfig
+	Logger  logger.Logger
+	Metrics metrics.Metrics
+
+	tiers          []config.LatencyTier
+	percentiles    []float64
+	baseSampleRate uint
+	interval       time.Duration
+	minTraces      float64
+	maxKeys        int
+	prefix         string
+
+	key       *traceKey
+	keyFields []string
+
+	mut        sync.Mutex
+	sketches   map[string]*latencySketch
+	thresholds map[string][]float64
+	// overflow is the distribution of the keys beyond maxKeys
+	overflow           *latencySketch
+	overflowThresholds []float64
+
+	done chan struct{}
+}
+
+func (d *LatencySampler) Start() error {
+	d.Logger.Debug().Logf("Starting LatencySampler")
+	defer func() { d.Logger.Debug().Logf("Finished starting LatencySampler") }()
+
+	// the highest percentile is checked first
+	d.tiers = append([]config.LatencyTier{}, d.Config.Tiers...)
+	sort.Slice(d.tiers, func(i, j int) bool { return d.tiers[i].AbovePercentile > d.tiers[j].AbovePercentile })
+	d.percentiles = make([]float64, len(d.tiers))
+	for i := range d.tiers {
+		if d.tiers[i].SampleRate < 1 {
+			d.tiers[i].SampleRate = 1
+		}
+		d.percentiles[i] = d.tiers[i].AbovePercentile
+	}
+	if d.Config.BaseSampleRate < 1 {
+		d.Config.BaseSampleRate = 100
+	}
+	d.baseSampleRate = uint(d.Config.BaseSampleRate)
+	if d.Config.AdjustmentInterval == 0 {
+		d.Config.AdjustmentInterval = config.Duration(15 * time.Second)
+	}
+	d.interval = time.Duration(d.Config.AdjustmentInterval)
+	if d.Config.MinTraces < 1 {
+		d.Config.MinTraces = 100
+	}
+	d.minTraces = float64(d.Config.MinTraces)
+	d.maxKeys = d.Config.MaxKeys
+	if d.maxKeys == 0 {
+		d.maxKeys = 500
+	}
+	d.prefix = "latency_"
+
+	d.key = newTraceKey(d.Config.FieldList, false)
+	d.keyFields = d.Config.GetSamplingFields()
+
+	d.sketches = make(map[string]*latencySketch)
+	d.thresholds = make(map[string][]float64)
+	d.overflow = newLatencySketch()
+	d.done = make(chan struct{})
+
+	d.Metrics.Register(d.prefix+"num_dropped", "counter")
+	d.Metrics.Register(d.prefix+"num_kept", "counter")
+	d.Metrics.Register(d.prefix+"sample_rate", "histogram")
+	d.Metrics.Register(d.prefix+"keys", "gauge")
+	d.Metrics.Register(d.prefix+"overflow_traces", "counter")
+
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+				d.adjust()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops adjusting the distributions; the sampler is being replaced.
+func (d *LatencySampler) Stop() {
+	close(d.done)
+}
+
+// adjust recalculates the durations at each tier's percentile for every key
+// that has seen enough traces, then halves the weight of what has been seen
+// so far so that the distributions follow changes in latency.
+func (d *LatencySampler) adjust() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for key, sketch := range d.sketches {
+		if sketch.total >= d.minTraces {
+			d.thresholds[key] = sketch.quantiles(d.percentiles)
+		}
+		sketch.decay(0.5)
+		// a key that has stopped sending is forgotten
+		if sketch.total < 1 {
+			delete(d.sketches, key)
+			delete(d.thresholds, key)
+		}
+	}
+	if d.overflow.total >= d.minTraces {
+		d.overflowThresholds = d.overflow.quantiles(d.percentiles)
+	}
+	d.overflow.decay(0.5)
+	d.Metrics.Gauge(d.prefix+"keys", len(d.sketches))
+}
+
+// rateFor returns the sample rate of a trace of the given duration, given the
+// durations at each tier's percentile for its key.
+func (d *LatencySampler) rateFor(durationMs float64, thresholds []float64) uint {
+	if thresholds == nil {
+		return uint(d.tiers[0].SampleRate)
+	}
+	for i, tier := range d.tiers {
+		if durationMs >= thresholds[i] {
+			return uint(tier.SampleRate)
+		}
+	}
+	return d.baseSampleRate
+}
+
+func (d *LatencySampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
+	key = d.key.build(trace)
+	value, _ := computedValue(trace, config.DURATION_MS)
+	durationMs, _ := value.(float64)
+
+	d.mut.Lock()
+	sketch, ok := d.sketches[key]
+	var thresholds []float64
+	switch {
+	case ok:
+		thresholds = d.thresholds[key]
+	case len(d.sketches) < d.maxKeys:
+		sketch = newLatencySketch()
+		d.sketches[key] = sketch
+	default:
+		sketch = d.overflow
+		thresholds = d.overflowThresholds
+	}
+	sketch.add(durationMs)
+	d.mut.Unlock()
+	if !ok && sketch == d.overflow {
+		d.Metrics.Increment(d.prefix + "overflow_traces")
+	}
+
+	if len(d.tiers) == 0 {
+		rate = d.baseSampleRate
+	} else {
+		rate = d.rateFor(durationMs, thresholds)
+	}
+
+	shouldKeep := keepWithRate(trace, rate)
+	d.Logger.Debug().WithFields(map[string]interface{}{
+		"sample_key":  key,
+		"sample_rate": rate,
+		"sample_keep": shouldKeep,
+		"trace_id":    trace.ID(),
+		"duration_ms": durationMs,
+	}).Logf("got sample rate and decision")
+	if shouldKeep {
+		d.Metrics.Increment(d.prefix + "num_kept")
+	} else {
+		d.Metrics.Increment(d.prefix + "num_dropped")
+	}
+	d.Metrics.Histogram(d.prefix+"sample_rate", float64(rate))
+	return rate, shouldKeep, "latency", key
+}
+
+func (d *LatencySampler) GetKeyFields() []string {
+	return d.keyFields
+}
@@ -0,0 +1,91 @@
+package sample
+
+import (
+	"math"
+	"sort"
+)
+
+// latencySketchAccuracy is the relative error of the values a latencySketch
+// returns for quantiles.
+const latencySketchAccuracy = 0.01
+
+// latencySketchMin is the smallest duration, in ms, that a latencySketch
+// tells apart from zero.
+const latencySketchMin = 0.001
+
+var latencySketchGamma = (1 + latencySketchAccuracy) / (1 - latencySketchAccuracy)
+
+// latencySketch estimates quantiles of durations in the manner of DDSketch:
+// each duration is counted in a bucket whose bounds grow geometrically, so
+// any quantile is known to within latencySketchAccuracy of its true value,
+// using a few hundred buckets for any realistic range of durations. Counts
+// are floats so that old observations can be decayed.
+type latencySketch struct {
+	buckets map[int]float64
+	zeros   float64
+	total   float64
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{buckets: make(map[int]float64)}
+}
+
+func (s *latencySketch) add(ms float64) {
+	s.total++
+	if ms < latencySketchMin {
+		s.zeros++
+		return
+	}
+	s.buckets[int(math.Ceil(math.Log(ms)/math.Log(latencySketchGamma)))]++
+}
+
+// decay multiplies every count by factor, forgetting buckets that fall
+// below a useful size.
+func (s *latencySketch) decay(factor float64) {
+	s.zeros *= factor
+	s.total = s.zeros
+	for i, n := range s.buckets {
+		n *= factor
+		if n < 0.01 {
+			delete(s.buckets, i)
+			continue
+		}
+		s.buckets[i] = n
+		s.total += n
+	}
+}
+
+// quantiles returns the durations at each of the given percentiles, in
+// the same order.
+func (s *latencySketch) quantiles(percentiles []float64) []float64 {
+	indexes := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	values := make([]float64, len(percentiles))
+	for p, percentile := range percentiles {
+		rank := percentile / 100 * s.total
+		seen := s.zeros
+		if rank <= seen || len(indexes) == 0 {
+			continue
+		}
+		// if rounding leaves the rank beyond the last bucket, use the last
+		values[p] = s.bucketValue(indexes[len(indexes)-1])
+		for _, i := range indexes {
+			seen += s.buckets[i]
+			if seen >= rank {
+				values[p] = s.bucketValue(i)
+				break
+			}
+		}
+	}
+	return values
+}
+
+// bucketValue is the value within a bucket's bounds that is within
+// latencySketchAccuracy of all of them.
+func (s *latencySketch) bucketValue(i int) float64 {
+	return 2 * math.Pow(latencySketchGamma, float64(i)) / (latencySketchGamma + 1)
+}
@@ -0,0 +1,161 @@
+package sample
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencySketchQuantiles(t *testing.T) {
+	s := newLatencySketch()
+	// 1ms to 1000ms, evenly, in a random order
+	for _, i := range rand.Perm(1000) {
+		s.add(float64(i + 1))
+	}
+	q := s.quantiles([]float64{50, 90, 99})
+	assert.InEpsilon(t, 500.0, q[0], 0.02)
+	assert.InEpsilon(t, 900.0, q[1], 0.02)
+	assert.InEpsilon(t, 990.0, q[2], 0.02)
+
+	// decaying keeps the shape but reduces the weight
+	s.decay(0.5)
+	assert.InDelta(t, 500.0, s.total, 1)
+	assert.Equal(t, q, s.quantiles([]float64{50, 90, 99}))
+
+	// zeros count towards the ranks
+	z := newLatencySketch()
+	for i := 0; i < 10; i++ {
+		z.add(0)
+	}
+	z.add(100)
+	assert.Equal(t, []float64{0, 0}, z.quantiles([]float64{50, 90}))
+	assert.InEpsilon(t, 100.0, z.quantiles([]float64{100})[0], 0.02)
+
+	assert.Equal(t, []float64{0}, newLatencySketch().quantiles([]float64{50}))
+}
+
+func latencyTestTrace(service string, durationMs float64) *types.Trace {
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{
+		Event: types.Event{
+			Data: map[string]interface{}{"service.name": service, "duration_ms": durationMs},
+		},
+	})
+	return trace
+}
+
+func TestLatencySampler(t *testing.T) {
+	sampler := &LatencySampler{
+		Config: &config.LatencySamplerConfig{
+			Tiers: []config.LatencyTier{
+				{AbovePercentile: 50, SampleRate: 10},
+				{AbovePercentile: 99, SampleRate: 1},
+			},
+			BaseSampleRate: 100,
+			MinTraces:      100,
+			FieldList:      []string{"service.name"},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, sampler.Start())
+	defer sampler.Stop()
+
+	// keys without enough traces use the highest tier
+	rate, keep, reason, key := sampler.GetSampleRate(latencyTestTrace("api", 1))
+	assert.Equal(t, uint(1), rate)
+	assert.True(t, keep)
+	assert.Equal(t, "latency", reason)
+	assert.Equal(t, "api•,", key)
+
+	for i := 1; i <= 1000; i++ {
+		sampler.GetSampleRate(latencyTestTrace("api", float64(i)))
+		// a much slower service has its own percentiles
+		sampler.GetSampleRate(latencyTestTrace("batch", float64(i*1000)))
+	}
+	sampler.adjust()
+
+	for _, tc := range []struct {
+		service  string
+		duration float64
+		rate     uint
+	}{
+		{"api", 10, 100},
+		{"api", 600, 10},
+		{"api", 2000, 1},
+		{"batch", 2000, 100},
+		{"batch", 600000, 10},
+		{"batch", 2000000, 1},
+	} {
+		rate, _, _, _ := sampler.GetSampleRate(latencyTestTrace(tc.service, tc.duration))
+		assert.Equal(t, tc.rate, rate, "%s at %vms", tc.service, tc.duration)
+	}
+
+	// keys that stop sending are forgotten
+	for i := 0; i < 20; i++ {
+		sampler.adjust()
+	}
+	assert.Empty(t, sampler.sketches)
+	assert.Empty(t, sampler.thresholds)
+}
+
+func TestLatencySamplerOverflow(t *testing.T) {
+	sampler := &LatencySampler{
+		Config: &config.LatencySamplerConfig{
+			Tiers:          []config.LatencyTier{{AbovePercentile: 90, SampleRate: 1}},
+			BaseSampleRate: 100,
+			MinTraces:      100,
+			MaxKeys:        1,
+			FieldList:      []string{"service.name"},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, sampler.Start())
+	defer sampler.Stop()
+
+	// the first key is tracked on its own, and the others share a
+	// distribution
+	for i := 1; i <= 1000; i++ {
+		sampler.GetSampleRate(latencyTestTrace("api", float64(i)))
+		sampler.GetSampleRate(latencyTestTrace(fmt.Sprintf("svc%d", i%10), float64(i)))
+	}
+	sampler.adjust()
+	assert.Len(t, sampler.sketches, 1)
+
+	rate, _, _, _ := sampler.GetSampleRate(latencyTestTrace("svc1", 10))
+	assert.Equal(t, uint(100), rate)
+	rate, _, _, _ = sampler.GetSampleRate(latencyTestTrace("new", 990))
+	assert.Equal(t, uint(1), rate)
+}
+
+func TestLatencySamplerInRules(t *testing.T) {
+	cfg := &config.RulesBasedSamplerConfig{
+		Rules: []*config.RulesBasedSamplerRule{
+			{
+				Name: "latency",
+				Sampler: &config.RulesBasedDownstreamSampler{
+					LatencySampler: &config.LatencySamplerConfig{
+						Tiers: []config.LatencyTier{{AbovePercentile: 99, SampleRate: 1}},
+					},
+				},
+			},
+		},
+	}
+	assert.Contains(t, cfg.GetSamplingFields(), "duration_ms")
+
+	sampler := &RulesBasedSampler{Config: cfg, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, sampler.Start())
+	defer sampler.Stop()
+	rate, keep, _, _ := sampler.GetSampleRate(latencyTestTrace("api", 5))
+	assert.Equal(t, uint(1), rate)
+	assert.True(t, keep)
+}
@@ -19,6 +19,8 @@ type RulesBasedSampler struct {
 	samplers  map[string]Sampler
 	prefix    string
 	keyFields []string
+	// keyMeter meters the keys of the rules' samplers for the memory budget
+	keyMeter *keyMeter
 }
 
 const RootPrefix = "root."
@@ -31,6 +33,7 @@ func (s *RulesBasedSampler) Start() error {
 	s.Metrics.Register(s.prefix+"num_dropped", "counter")
 	s.Metrics.Register(s.prefix+"num_dropped_by_drop_rule", "counter")
 	s.Metrics.Register(s.prefix+"num_kept", "counter")
+	s.Metrics.Register(s.prefix+"num_dry_run_matched", "counter")
 	s.Metrics.Register(s.prefix+"sample_rate", "histogram")
 
 	s.samplers = make(map[string]Sampler)
@@ -48,20 +51,8 @@ func (s *RulesBasedSampler) Start() error {
 		}
 		// Check if any rule has a downstream sampler and create it
 		if rule.Sampler != nil {
-			var sampler Sampler
-			if rule.Sampler.DynamicSampler != nil {
-				sampler = &DynamicSampler{Config: rule.Sampler.DynamicSampler, Logger: s.Logger, Metrics: s.Metrics}
-			} else if rule.Sampler.EMADynamicSampler != nil {
-				sampler = &EMADynamicSampler{Config: rule.Sampler.EMADynamicSampler, Logger: s.Logger, Metrics: s.Metrics}
-			} else if rule.Sampler.TotalThroughputSampler != nil {
-				sampler = &TotalThroughputSampler{Config: rule.Sampler.TotalThroughputSampler, Logger: s.Logger, Metrics: s.Metrics}
-			} else if rule.Sampler.EMAThroughputSampler != nil {
-				sampler = &EMAThroughputSampler{Config: rule.Sampler.EMAThroughputSampler, Logger: s.Logger, Metrics: s.Metrics}
-			} else if rule.Sampler.WindowedThroughputSampler != nil {
-				sampler = &WindowedThroughputSampler{Config: rule.Sampler.WindowedThroughputSampler, Logger: s.Logger, Metrics: s.Metrics}
-			} else if rule.Sampler.DeterministicSampler != nil {
-				sampler = &DeterministicSampler{Config: rule.Sampler.DeterministicSampler, Logger: s.Logger, Metrics: s.Metrics}
-			} else {
+			sampler := newDownstreamSampler(rule.Sampler, s.Logger, s.Metrics, s.keyMeter)
+			if sampler == nil {
 				s.Logger.Debug().WithFields(map[string]interface{}{
 					"rule_name": rule.Name,
 				}).Logf("invalid or missing downstream sampler")
@@ -81,29 +72,57 @@ func (s *RulesBasedSampler) Start() error {
 	return nil
 }
 
+// Stop stops the rules' downstream samplers.
+func (s *RulesBasedSampler) Stop() {
+	for _, sampler := range s.samplers {
+		StopSampler(sampler)
+	}
+}
+
+// newDownstreamSampler creates the sampler configured for a rule, or returns
+// nil if there is none.
+func newDownstreamSampler(c *config.RulesBasedDownstreamSampler, lgr logger.Logger, m metrics.Metrics, meter *keyMeter) Sampler {
+	switch {
+	case c.DynamicSampler != nil:
+		return &DynamicSampler{Config: c.DynamicSampler, Logger: lgr, Metrics: m, keyMeter: meter}
+	case c.EMADynamicSampler != nil:
+		return &EMADynamicSampler{Config: c.EMADynamicSampler, Logger: lgr, Metrics: m, keyMeter: meter}
+	case c.TotalThroughputSampler != nil:
+		return &TotalThroughputSampler{Config: c.TotalThroughputSampler, Logger: lgr, Metrics: m, keyMeter: meter}
+	case c.EMAThroughputSampler != nil:
+		return &EMAThroughputSampler{Config: c.EMAThroughputSampler, Logger: lgr, Metrics: m, keyMeter: meter}
+	case c.WindowedThroughputSampler != nil:
+		return &WindowedThroughputSampler{Config: c.WindowedThroughputSampler, Logger: lgr, Metrics: m, keyMeter: meter}
+	case c.LatencySampler != nil:
+		return &LatencySampler{Config: c.LatencySampler, Logger: lgr, Metrics: m}
+	case c.DeterministicSampler != nil:
+		return &DeterministicSampler{Config: c.DeterministicSampler, Logger: lgr, Metrics: m}
+	default:
+		return nil
+	}
+}
+
 func (s *RulesBasedSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
+	rate, keep, reason, key, pass := s.GetSampleRateOrPass(trace)
+	if pass {
+		return 1, true, "no rule matched", ""
+	}
+	return rate, keep, reason, key
+}
+
+// GetSampleRateOrPass passes if none of the rules match the trace.
+func (s *RulesBasedSampler) GetSampleRateOrPass(trace FieldsExtractor) (rate uint, keep bool, reason string, key string, pass bool) {
 	logger := s.Logger.Debug().WithFields(map[string]interface{}{
 		"trace_id": trace.ID(),
 	})
 
-	for _, rule := range s.Config.Rules {
-		var matched bool
-		var reason string
-
-		switch rule.Scope {
-		case "span":
-			matched = ruleMatchesSpanInTrace(trace, rule, s.Config.CheckNestedFields)
-			reason = "rules/span/"
-		case "trace", "":
-			matched = ruleMatchesTrace(trace, rule, s.Config.CheckNestedFields)
-			reason = "rules/trace/"
-		default:
-			logger.WithFields(map[string]interface{}{
-				"rule_name": rule.Name,
-				"scope":     rule.Scope,
-			}).Logf("invalid scope %s given for rule: %s", rule.Scope, rule.Name)
-			matched = true
-			reason = "rules/invalid scope/"
+	// computed fields are the same for every rule, so only work them out once
+	trace = withAggregates(trace)
+
+	for i, rule := range s.Config.Rules {
+		matched, reason := ruleMatches(trace, rule, s.Config.CheckNestedFields, logger)
+		if matched && s.Config.WeightedChoice && rule.Weight > 0 && !rule.DryRun {
+			rule, reason = chooseWeightedRule(trace, rule, reason, s.Config.Rules[i+1:], s.Config.CheckNestedFields, logger)
 		}
 
 		if matched {
@@ -119,17 +138,29 @@ func (s *RulesBasedSampler) GetSampleRate(trace FieldsExtractor) (rate uint, kee
 					logger.WithFields(map[string]interface{}{
 						"rule_name": rule.Name,
 					}).Logf("could not find downstream sampler for rule: %s", rule.Name)
-					return 1, true, reason + "bad_rule:" + rule.Name, ""
+					return 1, true, reason + "bad_rule:" + rule.Name, "", false
 				}
 				rate, keep, samplerReason, key = sampler.GetSampleRate(trace)
 				reason += rule.Name + ":" + samplerReason
 			} else {
 				rate = uint(rule.SampleRate)
-				keep = !rule.Drop && rule.SampleRate > 0 && rand.Intn(rule.SampleRate) == 0
+				keep = !rule.Drop && rule.SampleRate > 0 && keepWithRate(trace, uint(rule.SampleRate))
 				reason += rule.Name
 				s.Metrics.Histogram(s.prefix+"sample_rate", float64(rate))
 			}
 
+			if rule.DryRun {
+				// a dry run rule only records what it would have done
+				s.Metrics.Increment(s.prefix + "num_dry_run_matched")
+				logger.WithFields(map[string]interface{}{
+					"rate":      rate,
+					"keep":      keep,
+					"drop_rule": rule.Drop,
+				}).Logf("dry run rule matched")
+				recordDryRun(trace, rate, keep, reason)
+				continue
+			}
+
 			if keep {
 				s.Metrics.Increment(s.prefix + "num_kept")
 			} else {
@@ -144,11 +175,78 @@ func (s *RulesBasedSampler) GetSampleRate(trace FieldsExtractor) (rate uint, kee
 				"keep":      keep,
 				"drop_rule": rule.Drop,
 			}).Logf("got sample rate and decision")
-			return rate, keep, reason, key
+			return rate, keep, reason, key, false
 		}
 	}
 
-	return 1, true, "no rule matched", ""
+	return 0, false, "", "", true
+}
+
+// ruleMatches reports whether a rule matches a trace, and the start of the
+// reason for the decision that the rule makes.
+func ruleMatches(trace FieldsExtractor, rule *config.RulesBasedSamplerRule, checkNestedFields bool, lgr logger.Entry) (bool, string) {
+	switch rule.Scope {
+	case "span":
+		return ruleMatchesSpanInTrace(trace, rule, checkNestedFields), "rules/span/"
+	case "trace", "":
+		return ruleMatchesTrace(trace, rule, checkNestedFields), "rules/trace/"
+	default:
+		lgr.WithFields(map[string]interface{}{
+			"rule_name": rule.Name,
+			"scope":     rule.Scope,
+		}).Logf("invalid scope %s given for rule: %s", rule.Scope, rule.Name)
+		return true, "rules/invalid scope/"
+	}
+}
+
+// chooseWeightedRule chooses at random between the first rule that matched
+// a trace and the later rules with a weight that match it too, in
+// proportion to their weights.
+func chooseWeightedRule(
+	trace FieldsExtractor,
+	first *config.RulesBasedSamplerRule,
+	firstReason string,
+	rest []*config.RulesBasedSamplerRule,
+	checkNestedFields bool,
+	lgr logger.Entry) (*config.RulesBasedSamplerRule, string) {
+	type candidate struct {
+		rule   *config.RulesBasedSamplerRule
+		reason string
+	}
+	candidates := []candidate{{first, firstReason}}
+	total := first.Weight
+	for _, rule := range rest {
+		if rule.Weight <= 0 || rule.DryRun {
+			continue
+		}
+		if matched, reason := ruleMatches(trace, rule, checkNestedFields, lgr); matched {
+			candidates = append(candidates, candidate{rule, reason})
+			total += rule.Weight
+		}
+	}
+
+	n := rand.Intn(total)
+	for _, c := range candidates {
+		if n < c.rule.Weight {
+			return c.rule, c.reason
+		}
+		n -= c.rule.Weight
+	}
+	return first, firstReason
+}
+
+// ReportKeys reports the keys of the samplers of its rules.
+func (s *RulesBasedSampler) ReportKeys() []SamplerKeysReport {
+	var reports []SamplerKeysReport
+	for _, rule := range s.Config.Rules {
+		if reporter, ok := s.samplers[rule.String()].(KeyReporter); ok {
+			for _, report := range reporter.ReportKeys() {
+				report.Sampler = "rules/" + rule.Name + ":" + report.Sampler
+				reports = append(reports, report)
+			}
+		}
+	}
+	return reports
 }
 
 func (s *RulesBasedSampler) GetKeyFields() []string {
@@ -274,9 +372,8 @@ func extractValueFromSpan(
 	// Note that this is the equivalent of checking the root span's descendant count, so
 	// we don't need to check the other spans.
 	if f, ok := condition.GetComputedField(); ok {
-		switch f {
-		case config.NUM_DESCENDANTS:
-			return int64(trace.DescendantCount()), true, true
+		if value, ok := computedValue(trace, f); ok {
+			return value, true, true
 		}
 	}
 
@@ -302,7 +399,7 @@ func extractValueFromSpan(
 			checkedOnlyRoot = false
 		}
 
-		value, exists = span.Fields()[field]
+		value, exists = scopedFieldValue(span.Fields(), field)
 		if exists {
 			return value, exists, checkedOnlyRoot
 		}
@@ -321,6 +418,54 @@ func extractValueFromSpan(
 	return nil, false, false
 }
 
+// scopedFieldValue looks up a field in a span's fields. A field that names an
+// OTLP attribute scope, such as "resource.service.name", is found in the
+// field that the attribute of that scope was recorded in, or else under its
+// full name; spans whose scoped attributes weren't recorded, such as those
+// that didn't arrive by OTLP, fall back to its unscoped name.
+func scopedFieldValue(fields map[string]interface{}, field string) (interface{}, bool) {
+	scope, name, ok := config.ParseScopedField(field)
+	if !ok {
+		value, exists := fields[field]
+		return value, exists
+	}
+	if value, exists := fields[config.ScopedAttributeField(scope, name)]; exists {
+		return value, true
+	}
+	if value, exists := fields[field]; exists {
+		return value, true
+	}
+	if _, recorded := fields[config.ScopedAttributesMarker]; recorded {
+		return nil, false
+	}
+	value, exists := fields[name]
+	return value, exists
+}
+
+// EventMatchesConditions returns true if the fields of a single event match
+// all of the conditions, which must already be initialized. Only the event
+// itself is checked, so conditions on the root span or on computed fields
+// don't match.
+func EventMatchesConditions(fields map[string]interface{}, conditions []*config.RulesBasedSamplerCondition) bool {
+	for _, condition := range conditions {
+		var value interface{}
+		var exists bool
+		for _, field := range condition.Fields {
+			if value, exists = scopedFieldValue(fields, field); exists {
+				break
+			}
+		}
+		if condition.Matches != nil {
+			if !condition.Matches(value, exists) {
+				return false
+			}
+		} else if !conditionMatchesValue(condition, value, exists) {
+			return false
+		}
+	}
+	return true
+}
+
 // This only gets called when we're using one of the basic operators, and
 // there is no datatype specified (meaning that the Matches function has not
 // been set). In this case, we need to do some type conversion and comparison
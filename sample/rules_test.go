@@ -2,6 +2,7 @@ package sample
 
 import (
 	"fmt"
+	"strconv"
 	"testing"
 
 	"github.com/honeycombio/refinery/config"
@@ -2862,3 +2863,323 @@ func TestRulesRootSpanContext(t *testing.T) {
 		})
 	}
 }
+
+func TestRulesWithTraceAggregates(t *testing.T) {
+	span := func(data map[string]interface{}) *types.Span {
+		return &types.Span{Event: types.Event{Data: data}}
+	}
+	trace := &types.Trace{}
+	root := span(map[string]interface{}{"duration_ms": 6000.0, "service.name": "frontend"})
+	trace.AddSpan(root)
+	trace.RootSpan = root
+	trace.AddSpan(span(map[string]interface{}{"trace.parent_id": "root", "duration_ms": 7000.0, "service.name": "api", "error": true}))
+	trace.AddSpan(span(map[string]interface{}{"trace.parent_id": "root", "service.name": "api", "error": "true"}))
+	trace.AddSpan(span(map[string]interface{}{"trace.parent_id": "root", "service.name": "db", "error": false}))
+	trace.AddSpan(span(map[string]interface{}{"trace.parent_id": "root", "meta.annotation_type": "span_event", "error": true}))
+
+	tests := []struct {
+		field   config.ComputedField
+		op      string
+		value   interface{}
+		matches bool
+	}{
+		{config.SPAN_COUNT, config.EQ, 4, true},
+		{config.SPAN_COUNT, config.GT, 4, false},
+		{config.DURATION_MS, config.GT, 5000, true},
+		{config.DURATION_MS, config.GT, 6500, false},
+		{config.ERROR_COUNT, config.EQ, 3, true},
+		{config.SERVICE_COUNT, config.EQ, 3, true},
+		{config.SERVICE_COUNT, config.LT, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s %v", tt.field, tt.op, tt.value), func(t *testing.T) {
+			rules := &config.RulesBasedSamplerConfig{
+				Rules: []*config.RulesBasedSamplerRule{{
+					Name: "aggregate",
+					Drop: true,
+					Conditions: []*config.RulesBasedSamplerCondition{{
+						Field:    string(tt.field),
+						Operator: tt.op,
+						Value:    tt.value,
+						Datatype: "float",
+					}},
+				}},
+			}
+			require.NoError(t, rules.Rules[0].Conditions[0].Init())
+			sampler := &RulesBasedSampler{Config: rules, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+			_, keep, reason, _ := sampler.GetSampleRate(trace)
+			assert.Equal(t, tt.matches, !keep, reason)
+		})
+	}
+
+	// without a root span, the longest span is used for the duration
+	noRoot := &types.Trace{}
+	noRoot.AddSpan(span(map[string]interface{}{"trace.parent_id": "root", "duration_ms": int64(7000)}))
+	noRoot.AddSpan(span(map[string]interface{}{"trace.parent_id": "root", "duration_ms": 10.0}))
+	value, ok := computedValue(noRoot, config.DURATION_MS)
+	assert.True(t, ok)
+	assert.Equal(t, 7000.0, value)
+}
+
+func TestTraceShapeAggregates(t *testing.T) {
+	span := func(data map[string]interface{}) *types.Span {
+		return &types.Span{Event: types.Event{Data: data}}
+	}
+	trace := &types.Trace{}
+	root := span(map[string]interface{}{"trace.span_id": "a", "duration_ms": 900.0, "service.name": "frontend", "http.response.status_code": int64(500)})
+	trace.AddSpan(root)
+	trace.RootSpan = root
+	trace.AddSpan(span(map[string]interface{}{"trace.span_id": "b", "trace.parent_id": "a", "duration_ms": 400.0, "service.name": "api", "error": true}))
+	trace.AddSpan(span(map[string]interface{}{"trace.span_id": "c", "trace.parent_id": "b", "duration_ms": 300.0, "service.name": "db", "error": true}))
+	trace.AddSpan(span(map[string]interface{}{"trace.span_id": "d", "trace.parent_id": "a", "duration_ms": 20.0, "service.name": "cache"}))
+	trace.AddSpan(span(map[string]interface{}{"trace.parent_id": "d", "meta.annotation_type": "span_event", "error": true}))
+	trace.AddSpan(span(map[string]interface{}{"trace.span_id": "e", "trace.parent_id": "a", "service.name": "frontend", "error": "true"}))
+
+	tests := []struct {
+		field config.ComputedField
+		want  interface{}
+	}{
+		{config.ROOT_HTTP_STATUS_CODE, int64(500)},
+		{config.ANY_ERROR, true},
+		{config.MAX_CHILD_DURATION_MS, 400.0},
+		{config.LEAF_SERVICE_COUNT, int64(3)},
+		{config.ERROR_CHAIN, "api>frontend>db"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.field), func(t *testing.T) {
+			value, ok := computedValue(trace, tt.field)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+
+	// spans may keep their IDs in other fields
+	renamed := &types.Trace{}
+	renamed.AddSpan(span(map[string]interface{}{"span.id": "a", "service.name": "frontend"}))
+	renamed.AddSpan(span(map[string]interface{}{"span.id": "b", "parent.id": "a", "service.name": "api", "error": true}))
+	renamed.AddSpan(span(map[string]interface{}{"span.id": "c", "parent.id": "b", "service.name": "db", "error": true}))
+	value, ok := computedValue(NewIDFieldsTrace(renamed, []string{"span.id"}, []string{"parent.id"}), config.ERROR_CHAIN)
+	assert.True(t, ok)
+	assert.Equal(t, "api>db", value)
+
+	// the depth of each span in a deep trace is found without walking up
+	// from every span
+	deep := &types.Trace{}
+	for i := 0; i < 2000; i++ {
+		deep.AddSpan(span(map[string]interface{}{
+			"trace.span_id":   strconv.Itoa(i),
+			"trace.parent_id": strconv.Itoa(i - 1),
+			"service.name":    fmt.Sprintf("svc%d", 1999-i),
+			"error":           true,
+		}))
+	}
+	tree := spanTree(deep)
+	for _, span := range tree.spans {
+		tree.depth(span.id)
+	}
+	assert.Equal(t, 1999, tree.depth("1999"))
+	assert.Equal(t, 0, tree.depth("0"))
+	assert.Len(t, tree.depths, 2000)
+
+	// a trace without a root span or errors has no status code or chain
+	partial := &types.Trace{}
+	partial.AddSpan(span(map[string]interface{}{"trace.span_id": "b", "trace.parent_id": "a", "service.name": "api"}))
+	_, ok = computedValue(partial, config.ROOT_HTTP_STATUS_CODE)
+	assert.False(t, ok)
+	_, ok = computedValue(partial, config.ERROR_CHAIN)
+	assert.False(t, ok)
+	value, ok = computedValue(partial, config.ANY_ERROR)
+	assert.True(t, ok)
+	assert.Equal(t, false, value)
+
+	// the computed fields can be matched by rules
+	rules := &config.RulesBasedSamplerConfig{
+		Rules: []*config.RulesBasedSamplerRule{{
+			Name: "server errors",
+			Drop: true,
+			Conditions: []*config.RulesBasedSamplerCondition{{
+				Field:    string(config.ROOT_HTTP_STATUS_CODE),
+				Operator: config.GTE,
+				Value:    500,
+				Datatype: "int",
+			}, {
+				Field:    string(config.ERROR_CHAIN),
+				Operator: config.Contains,
+				Value:    ">db",
+			}},
+		}},
+	}
+	for _, c := range rules.Rules[0].Conditions {
+		require.NoError(t, c.Init())
+	}
+	sampler := &RulesBasedSampler{Config: rules, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	_, keep, reason, _ := sampler.GetSampleRate(trace)
+	assert.False(t, keep, reason)
+}
+
+func TestRulesSamplingFieldsIncludeAggregateSources(t *testing.T) {
+	rules := &config.RulesBasedSamplerConfig{
+		Rules: []*config.RulesBasedSamplerRule{{
+			Conditions: []*config.RulesBasedSamplerCondition{
+				{Field: string(config.DURATION_MS), Operator: config.GT, Value: 5000},
+				{Field: string(config.SERVICE_COUNT), Operator: config.GT, Value: 2},
+			},
+		}},
+	}
+	assert.Subset(t, rules.GetSamplingFields(), []string{"duration_ms", "service.name"})
+
+	dynamic := &config.DynamicSamplerConfig{FieldList: []string{"http.route", string(config.ROOT_HTTP_STATUS_CODE)}}
+	assert.Subset(t, dynamic.GetSamplingFields(), []string{"http.route", "http.status_code", "http.response.status_code"})
+}
+
+func TestRulesDryRun(t *testing.T) {
+	sampler := &RulesBasedSampler{
+		Config: &config.RulesBasedSamplerConfig{
+			Rules: []*config.RulesBasedSamplerRule{
+				{
+					Name:   "new drop rule",
+					Drop:   true,
+					DryRun: true,
+					Conditions: []*config.RulesBasedSamplerCondition{
+						{Field: "http.route", Operator: config.EQ, Value: "/health"},
+					},
+				},
+				{
+					Name:   "another dry run",
+					DryRun: true,
+				},
+				{
+					Name:       "keep everything",
+					SampleRate: 1,
+				},
+			},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, sampler.Start())
+
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"http.route": "/health"}}})
+
+	// the dry run rules are recorded, but the enforcing rule decides
+	dt := NewDryRunTrace(trace)
+	rate, keep, reason, _ := sampler.GetSampleRate(dt)
+	assert.True(t, keep)
+	assert.Equal(t, uint(1), rate)
+	assert.Equal(t, "rules/trace/keep everything", reason)
+	assert.True(t, dt.Matched)
+	assert.False(t, dt.Keep)
+	assert.Equal(t, uint(0), dt.Rate)
+	assert.Equal(t, "rules/trace/new drop rule", dt.Reason)
+
+	// a trace that isn't wrapped is sampled just the same
+	_, keep, reason, _ = sampler.GetSampleRate(trace)
+	assert.True(t, keep)
+	assert.Equal(t, "rules/trace/keep everything", reason)
+}
+
+func TestRulesWithScopedFields(t *testing.T) {
+	span := func(data map[string]interface{}) *types.Span {
+		return &types.Span{Event: types.Event{Data: data}}
+	}
+	tests := []struct {
+		name    string
+		field   string
+		data    map[string]interface{}
+		matches bool
+	}{
+		{"recorded resource attribute", "resource.service.name", map[string]interface{}{
+			"service.name": "peer", "meta.refinery.resource.service.name": "api", config.ScopedAttributesMarker: true,
+		}, true},
+		{"missing span attribute does not fall back", "span.service.name", map[string]interface{}{
+			"service.name": "api", "meta.refinery.resource.service.name": "api", config.ScopedAttributesMarker: true,
+		}, false},
+		{"root span", "root.resource.service.name", map[string]interface{}{
+			"meta.refinery.resource.service.name": "api", config.ScopedAttributesMarker: true,
+		}, true},
+		{"full name", "span.service.name", map[string]interface{}{
+			"span.service.name": "api", config.ScopedAttributesMarker: true,
+		}, true},
+		{"unrecorded falls back", "resource.service.name", map[string]interface{}{
+			"service.name": "api",
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &config.RulesBasedSamplerConfig{
+				Rules: []*config.RulesBasedSamplerRule{{
+					Name: "scoped",
+					Drop: true,
+					Conditions: []*config.RulesBasedSamplerCondition{{
+						Field:    tt.field,
+						Operator: config.EQ,
+						Value:    "api",
+					}},
+				}},
+			}
+			require.NoError(t, rules.Rules[0].Conditions[0].Init())
+			trace := &types.Trace{}
+			root := span(tt.data)
+			trace.AddSpan(root)
+			trace.RootSpan = root
+			sampler := &RulesBasedSampler{Config: rules, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+			_, keep, reason, _ := sampler.GetSampleRate(trace)
+			assert.Equal(t, tt.matches, !keep, reason)
+		})
+	}
+}
+
+func TestRulesWeightedChoice(t *testing.T) {
+	rules := &config.RulesBasedSamplerConfig{
+		WeightedChoice: true,
+		Rules: []*config.RulesBasedSamplerRule{{
+			Name:       "keep errors",
+			SampleRate: 1,
+			Conditions: []*config.RulesBasedSamplerCondition{{Field: "error", Operator: config.Exists}},
+		}, {
+			Name:       "aggressive",
+			SampleRate: 10,
+			Weight:     20,
+		}, {
+			Name:   "would drop",
+			Drop:   true,
+			DryRun: true,
+			Weight: 100,
+		}, {
+			Name:       "unweighted",
+			SampleRate: 5,
+		}, {
+			Name:       "current",
+			SampleRate: 1,
+			Weight:     80,
+		}},
+	}
+	sampler := &RulesBasedSampler{Config: rules, Logger: &logger.NullLogger{}, Metrics: &metrics.NullMetrics{}}
+	require.NoError(t, sampler.Start())
+
+	trace := &types.Trace{}
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"http.route": "/"}}})
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		rate, _, reason, _ := sampler.GetSampleRate(trace)
+		counts[reason]++
+		if reason == "rules/trace/aggressive" {
+			assert.Equal(t, uint(10), rate)
+		}
+	}
+	assert.Len(t, counts, 2)
+	assert.InDelta(t, 200, counts["rules/trace/aggressive"], 60)
+	assert.InDelta(t, 800, counts["rules/trace/current"], 60)
+
+	// an unweighted rule that matches first decides as usual
+	errored := &types.Trace{}
+	errored.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"error": true}}})
+	_, _, reason, _ := sampler.GetSampleRate(errored)
+	assert.Equal(t, "rules/trace/keep errors", reason)
+
+	// without a weighted choice, the first matching rule decides
+	rules.WeightedChoice = false
+	_, _, reason, _ = sampler.GetSampleRate(trace)
+	assert.Equal(t, "rules/trace/aggressive", reason)
+}
@@ -2,9 +2,14 @@ package sample
 
 import (
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/clustercount"
+	"github.com/honeycombio/refinery/internal/membudget"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/types"
@@ -19,23 +24,89 @@ type FieldsExtractor interface {
 	DescendantCount() uint32
 }
 
+// traceWrapper is a trace that wraps another to tell samplers more about it.
+type traceWrapper interface {
+	unwrap() FieldsExtractor
+}
+
+// findWrapped returns the wrapper of type T around a trace, if there is one.
+func findWrapped[T FieldsExtractor](trace FieldsExtractor) (T, bool) {
+	for {
+		if t, ok := trace.(T); ok {
+			return t, true
+		}
+		w, ok := trace.(traceWrapper)
+		if !ok {
+			var none T
+			return none, false
+		}
+		trace = w.unwrap()
+	}
+}
+
 type Sampler interface {
 	GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string)
 	Start() error
 	GetKeyFields() []string
 }
 
+// PassingSampler is a sampler that can decline to decide about a trace, so
+// that a CompositeSampler passes it on to its next step.
+type PassingSampler interface {
+	Sampler
+	GetSampleRateOrPass(trace FieldsExtractor) (rate uint, keep bool, reason string, key string, pass bool)
+}
+
+// Stopper is a sampler with background work, which must be stopped when the
+// sampler is replaced.
+type Stopper interface {
+	Stop()
+}
+
+// StopSampler stops a sampler's background work, if it has any.
+func StopSampler(sampler Sampler) {
+	if stopper, ok := sampler.(Stopper); ok {
+		stopper.Stop()
+	}
+}
+
 type ClusterSizer interface {
 	SetClusterSize(size int)
 }
 
 // SamplerFactory is used to create new samplers with common (injected) resources
 type SamplerFactory struct {
-	Config    config.Config   `inject:""`
-	Logger    logger.Logger   `inject:""`
-	Metrics   metrics.Metrics `inject:"genericMetrics"`
+	Config  config.Config   `inject:""`
+	Logger  logger.Logger   `inject:""`
+	Metrics metrics.Metrics `inject:"genericMetrics"`
+	// ClusterCounter holds the counts that samplers share across the cluster
+	ClusterCounter clustercount.Counter `inject:""`
+	// Budget meters the memory used by the samplers' keys
+	Budget    *membudget.Budget `inject:""`
 	peerCount int
 	samplers  []Sampler
+
+	// budgets holds the current budget sampler for each target, for
+	// reporting
+	budgetMut sync.Mutex
+	budgets   map[string]*BudgetSampler
+
+	// keyReporters holds the current sampler for each target that can
+	// report its keys
+	keysMut      sync.Mutex
+	keyReporters map[string]KeyReporter
+	done         chan struct{}
+	// keyMeters holds the meter of the current sampler for each target, for
+	// the memory budget, and keysFull is set while their keys are over it
+	keyMeters map[string]*keyMeter
+	keysFull  atomic.Bool
+
+	// goals tracks the sample rates that targets achieve, and
+	// goalAdjusters holds the current sampler of each target whose goal
+	// can be adjusted to meet them
+	goals         *goalTracker
+	goalMut       sync.Mutex
+	goalAdjusters map[string]GoalAdjuster
 }
 
 func (s *SamplerFactory) updatePeerCounts() {
@@ -50,12 +121,52 @@ func (s *SamplerFactory) updatePeerCounts() {
 func (s *SamplerFactory) Start() error {
 	s.peerCount = 1
 	// TODO: register updatePeerCounts to be called whenever the peer count changes
+
+	s.done = make(chan struct{})
+	if interval := s.Config.GetSamplerKeyReportInterval(); interval > 0 {
+		s.Metrics.Register("sampler_keys", "gauge")
+		s.Metrics.Register("sampler_key_max_events_per_sec", "gauge")
+		s.Metrics.Register("sampler_key_max_sample_rate", "gauge")
+		go s.reportKeysEvery(interval)
+	}
+
+	s.goals = newGoalTracker()
+	s.Metrics.Register("sampling_goal_max_drift", "gauge")
+	s.Metrics.Register("sampling_goal_targets_off", "gauge")
+	s.Metrics.Register("sampling_goal_adjustments", "counter")
+	go s.trackGoals()
+
+	s.Budget.Register(membudget.SamplerKeys, s.keysSize)
+	s.Metrics.Register("sampler_keys_over_budget", "gauge")
+	go s.fitKeyBudget()
 	return nil
 }
 
-// GetSamplerImplementationForKey returns the sampler implementation for the given
-// samplerKey (dataset for legacy keys, environment otherwise), or nil if it is not defined
-func (s *SamplerFactory) GetSamplerImplementationForKey(samplerKey string) Sampler {
+func (s *SamplerFactory) Stop() error {
+	if s.done != nil {
+		close(s.done)
+	}
+	return nil
+}
+
+// NewDetachedSampler returns a new, started sampler for samplerKey that the
+// factory doesn't keep track of, for one-off decisions such as previews. It
+// hasn't seen any traffic, so dynamic samplers decide as they would on
+// startup, and its metrics are discarded. The caller must stop it with
+// StopSampler.
+func (s *SamplerFactory) NewDetachedSampler(samplerKey string) Sampler {
+	sampler := s.newSampler(samplerKey, &metrics.NullMetrics{}, nil)
+	if sampler != nil {
+		if sizer, ok := sampler.(ClusterSizer); ok {
+			sizer.SetClusterSize(s.peerCount)
+		}
+	}
+	return sampler
+}
+
+// newSampler makes and starts the sampler for samplerKey, or returns nil if
+// there isn't one.
+func (s *SamplerFactory) newSampler(samplerKey string, m metrics.Metrics, meter *keyMeter) Sampler {
 	c, _, err := s.Config.GetSamplerConfigForDestName(samplerKey)
 	if err != nil {
 		return nil
@@ -65,40 +176,96 @@ func (s *SamplerFactory) GetSamplerImplementationForKey(samplerKey string) Sampl
 
 	switch c := c.(type) {
 	case *config.DeterministicSamplerConfig:
-		sampler = &DeterministicSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &DeterministicSampler{Config: c, Logger: s.Logger, Metrics: m}
 	case *config.DynamicSamplerConfig:
-		sampler = &DynamicSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &DynamicSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
 	case *config.EMADynamicSamplerConfig:
-		sampler = &EMADynamicSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &EMADynamicSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
 	case *config.RulesBasedSamplerConfig:
-		sampler = &RulesBasedSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &RulesBasedSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
 	case *config.TotalThroughputSamplerConfig:
-		sampler = &TotalThroughputSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &TotalThroughputSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
 	case *config.EMAThroughputSamplerConfig:
-		sampler = &EMAThroughputSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &EMAThroughputSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
 	case *config.WindowedThroughputSamplerConfig:
-		sampler = &WindowedThroughputSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &WindowedThroughputSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
+	case *config.ClusterThroughputSamplerConfig:
+		sampler = &ClusterThroughputSampler{Config: c, Logger: s.Logger, Metrics: m, Counter: s.ClusterCounter, Name: samplerKey}
+	case *config.BudgetSamplerConfig:
+		sampler = &BudgetSampler{Config: c, Logger: s.Logger, Metrics: m, Name: samplerKey}
+	case *config.LatencySamplerConfig:
+		sampler = &LatencySampler{Config: c, Logger: s.Logger, Metrics: m}
+	case *config.CompositeSamplerConfig:
+		sampler = &CompositeSampler{Config: c, Logger: s.Logger, Metrics: m, keyMeter: meter}
 	case *config.MockSamplerConfig:
-		sampler = &MockSampler{Config: c, Logger: s.Logger, Metrics: s.Metrics}
+		sampler = &MockSampler{Config: c, Logger: s.Logger, Metrics: m}
 	default:
 		s.Logger.Error().Logf("unknown sampler type %T. Exiting.", c)
 		os.Exit(1)
 	}
 
-	err = sampler.Start()
-	if err != nil {
+	if err := sampler.Start(); err != nil {
 		s.Logger.Debug().WithField("dataset", samplerKey).Logf("failed to start sampler")
 		return nil
 	}
 
 	s.Logger.Debug().WithField("dataset", samplerKey).Logf("created implementation for sampler type %T", c)
+	return sampler
+}
+
+// GetSamplerImplementationForKey returns the sampler implementation for the given
+// samplerKey (dataset for legacy keys, environment otherwise), or nil if it is not defined
+func (s *SamplerFactory) GetSamplerImplementationForKey(samplerKey string) Sampler {
+	sampler := s.newSampler(samplerKey, s.Metrics, s.newKeyMeter(samplerKey))
+	if sampler == nil {
+		return nil
+	}
+
 	// call this every time we add a sampler
 	s.samplers = append(s.samplers, sampler)
 	s.updatePeerCounts()
 
+	if budget, ok := sampler.(*BudgetSampler); ok {
+		s.budgetMut.Lock()
+		if s.budgets == nil {
+			s.budgets = make(map[string]*BudgetSampler)
+		}
+		s.budgets[samplerKey] = budget
+		s.budgetMut.Unlock()
+	}
+	if reporter, ok := sampler.(KeyReporter); ok {
+		s.keysMut.Lock()
+		if s.keyReporters == nil {
+			s.keyReporters = make(map[string]KeyReporter)
+		}
+		s.keyReporters[samplerKey] = reporter
+		s.keysMut.Unlock()
+	}
+	if adjuster, ok := sampler.(GoalAdjuster); ok {
+		s.goalMut.Lock()
+		if s.goalAdjusters == nil {
+			s.goalAdjusters = make(map[string]GoalAdjuster)
+		}
+		s.goalAdjusters[samplerKey] = adjuster
+		s.goalMut.Unlock()
+	}
+
 	return sampler
 }
 
+// BudgetReports returns the report of the current budget sampler of each
+// target that has one, in order of target.
+func (s *SamplerFactory) BudgetReports() []BudgetReport {
+	s.budgetMut.Lock()
+	defer s.budgetMut.Unlock()
+	reports := make([]BudgetReport, 0, len(s.budgets))
+	for _, budget := range s.budgets {
+		reports = append(reports, budget.Report())
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Target < reports[j].Target })
+	return reports
+}
+
 func getMetricType(name string) string {
 	if strings.HasSuffix(name, "_count") {
 		return "counter"
@@ -7,6 +7,7 @@ import (
 
 	"github.com/facebookgo/inject"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/clustercount"
 	"github.com/honeycombio/refinery/internal/peer"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
@@ -75,6 +76,7 @@ func TestDependencyInjection(t *testing.T) {
 	var g inject.Graph
 	err := g.Provide(
 		&inject.Object{Value: &SamplerFactory{}},
+		&inject.Object{Value: &clustercount.LocalCounter{}},
 
 		&inject.Object{Value: &config.MockConfig{}},
 		&inject.Object{Value: &logger.NullLogger{}},
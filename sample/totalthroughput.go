@@ -1,7 +1,6 @@
 package sample
 
 import (
-	"math/rand"
 	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -24,6 +23,10 @@ type TotalThroughputSampler struct {
 	prefix               string
 	lastMetrics          map[string]int64
 
+	keys *keyStats
+	// keyMeter meters the keys for the memory budget
+	keyMeter *keyMeter
+
 	key       *traceKey
 	keyFields []string
 
@@ -51,7 +54,11 @@ func (d *TotalThroughputSampler) Start() error {
 	if d.maxKeys == 0 {
 		d.maxKeys = 500
 	}
+	d.keys = newKeyStats(d.maxKeys, d.keyMeter)
 	d.prefix = "totalthroughput_"
+	if d.Config.DropHighCardinalityFields {
+		limitKeyCardinality(d.key, d.maxKeys, time.Duration(d.clearFrequency), d.prefix, d.Logger, d.Metrics)
+	}
 
 	d.keyFields = d.Config.GetSamplingFields()
 
@@ -83,13 +90,14 @@ func (d *TotalThroughputSampler) SetClusterSize(size int) {
 }
 
 func (d *TotalThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
-	key = d.key.build(trace)
+	key = d.keys.admit(d.key.build(trace))
 	count := int(trace.DescendantCount())
 	rate = uint(d.dynsampler.GetSampleRateMulti(key, count))
 	if rate < 1 { // protect against dynsampler being broken even though it shouldn't be
 		rate = 1
 	}
-	shouldKeep := rand.Intn(int(rate)) == 0
+	d.keys.record(key, count, rate)
+	shouldKeep := keepWithRate(trace, rate)
 	d.Logger.Debug().WithFields(map[string]interface{}{
 		"sample_key":  key,
 		"sample_rate": rate,
@@ -115,6 +123,11 @@ func (d *TotalThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate uint
 	return rate, shouldKeep, "totalthroughput", key
 }
 
+// ReportKeys reports the keys seen recently, and their rates.
+func (d *TotalThroughputSampler) ReportKeys() []SamplerKeysReport {
+	return []SamplerKeysReport{{Sampler: "totalthroughput", Keys: d.keys.report()}}
+}
+
 func (d *TotalThroughputSampler) GetKeyFields() []string {
 	return d.keyFields
 }
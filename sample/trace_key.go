@@ -4,11 +4,16 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/honeycombio/refinery/config"
 )
 
 type traceKey struct {
 	fields         []string
 	useTraceLength bool
+	// limiter, if set, drops fields with too many values from the key
+	limiter *keyLimiter
 }
 
 func newTraceKey(fields []string, useTraceLength bool) *traceKey {
@@ -29,6 +34,12 @@ func (d *traceKey) build(trace FieldsExtractor) string {
 	// for each field, for each span, get the value of that field
 	spans := trace.AllFields()
 	for _, field := range d.fields {
+		if strings.HasPrefix(field, config.ComputedFieldPrefix) {
+			if val, ok := computedValue(trace, config.ComputedField(field)); ok {
+				fieldCollector[field] = append(fieldCollector[field], fmt.Sprintf("%v", val))
+			}
+			continue
+		}
 		for _, span := range spans {
 			if val, ok := span.Fields()[field]; ok {
 				fieldCollector[field] = append(fieldCollector[field], fmt.Sprintf("%v", val))
@@ -37,19 +48,30 @@ func (d *traceKey) build(trace FieldsExtractor) string {
 	}
 	// ok, now we have a map of fields to a list of all values for that field.
 
-	var key string
-	for _, field := range d.fields {
+	parts := make([]string, len(d.fields))
+	for i, field := range d.fields {
 		// sort and collapse list
 		sort.Strings(fieldCollector[field])
 		var prevStr string
 		for _, str := range fieldCollector[field] {
 			if str != prevStr {
-				key += str + "•"
+				parts[i] += str + "•"
 			}
 			prevStr = str
 		}
+	}
+
+	var dropped map[string]bool
+	if d.limiter != nil {
+		dropped = d.limiter.observe(d.fields, parts)
+	}
+	var key string
+	for i, field := range d.fields {
+		if dropped[field] {
+			continue
+		}
 		// get ready for the next element
-		key += ","
+		key += parts[i] + ","
 	}
 
 	if d.useTraceLength {
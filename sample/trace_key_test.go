@@ -161,3 +161,15 @@ func TestKeyGeneration(t *testing.T) {
 
 	assert.Equal(t, expected, generator.build(trace))
 }
+
+func TestKeyGenerationWithComputedFields(t *testing.T) {
+	generator := newTraceKey([]string{"?.ROOT_HTTP_STATUS_CODE", "?.ANY_ERROR"}, false)
+
+	trace := &types.Trace{}
+	root := &types.Span{Event: types.Event{Data: map[string]interface{}{"http.status_code": int64(503)}}}
+	trace.AddSpan(root)
+	trace.RootSpan = root
+	trace.AddSpan(&types.Span{Event: types.Event{Data: map[string]interface{}{"error": true}}})
+
+	assert.Equal(t, "true•,503•,", generator.build(trace))
+}
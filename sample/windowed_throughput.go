@@ -1,7 +1,6 @@
 package sample
 
 import (
-	"math/rand"
 	"time"
 
 	dynsampler "github.com/honeycombio/dynsampler-go"
@@ -25,6 +24,10 @@ type WindowedThroughputSampler struct {
 	prefix               string
 	lastMetrics          map[string]int64
 
+	keys *keyStats
+	// keyMeter meters the keys for the memory budget
+	keyMeter *keyMeter
+
 	key       *traceKey
 	keyFields []string
 
@@ -46,7 +49,11 @@ func (d *WindowedThroughputSampler) Start() error {
 	if d.maxKeys == 0 {
 		d.maxKeys = 500
 	}
+	d.keys = newKeyStats(d.maxKeys, d.keyMeter)
 	d.prefix = "windowedthroughput_"
+	if d.Config.DropHighCardinalityFields {
+		limitKeyCardinality(d.key, d.maxKeys, time.Duration(d.lookbackfrequency), d.prefix, d.Logger, d.Metrics)
+	}
 
 	d.keyFields = d.Config.GetSamplingFields()
 
@@ -79,13 +86,14 @@ func (d *WindowedThroughputSampler) SetClusterSize(size int) {
 }
 
 func (d *WindowedThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate uint, keep bool, reason string, key string) {
-	key = d.key.build(trace)
+	key = d.keys.admit(d.key.build(trace))
 	count := int(trace.DescendantCount())
 	rate = uint(d.dynsampler.GetSampleRateMulti(key, count))
 	if rate < 1 { // protect against dynsampler being broken even though it shouldn't be
 		rate = 1
 	}
-	shouldKeep := rand.Intn(int(rate)) == 0
+	d.keys.record(key, count, rate)
+	shouldKeep := keepWithRate(trace, rate)
 	d.Logger.Debug().WithFields(map[string]interface{}{
 		"sample_key":  key,
 		"sample_rate": rate,
@@ -111,6 +119,11 @@ func (d *WindowedThroughputSampler) GetSampleRate(trace FieldsExtractor) (rate u
 	return rate, shouldKeep, "Windowedthroughput", key
 }
 
+// ReportKeys reports the keys seen recently, and their rates.
+func (d *WindowedThroughputSampler) ReportKeys() []SamplerKeysReport {
+	return []SamplerKeysReport{{Sampler: "windowedthroughput", Keys: d.keys.report()}}
+}
+
 func (d *WindowedThroughputSampler) GetKeyFields() []string {
 	return d.keyFields
 }
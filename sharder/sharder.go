@@ -24,9 +24,13 @@ type Sharder interface {
 	WhichShard(string) Shard
 }
 
+// DefaultType is the sharder that Refineries use; it is not yet exposed in
+// the config.
+const DefaultType = "deterministic"
+
 func GetSharderImplementation(c config.Config) Sharder {
 	var sharder Sharder
-	sharderType := "deterministic" // this is not yet exposed in the config
+	sharderType := DefaultType
 	switch sharderType {
 	case "single":
 		sharder = &SingleServerSharder{}
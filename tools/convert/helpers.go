@@ -318,9 +318,9 @@ func schemaType(typ string) string {
 		return "boolean"
 	case "duration":
 		return "string"
-	case "hostport", "url":
+	case "hostport", "url", "urlOrBlank":
 		return "string"
-	case "stringarray":
+	case "stringarray", "floatarray":
 		return "array"
 	case "map":
 		return "object"
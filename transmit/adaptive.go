@@ -0,0 +1,413 @@
+package transmit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/metrics"
+)
+
+const (
+	gaugeAdaptiveBatchSize      = "adaptive_batch_size"
+	gaugeAdaptiveConcurrency    = "adaptive_concurrency"
+	counterAdaptiveThrottled    = "adaptive_throttled"
+	counterAdaptiveSplitBatches = "adaptive_split_batches"
+)
+
+const (
+	// adaptiveReportInterval is how often the adaptive transport's state is
+	// reported as metrics.
+	adaptiveReportInterval = 10 * time.Second
+	// adaptiveMaxPause is the longest that a Retry-After header can pause
+	// sending for.
+	adaptiveMaxPause = 30 * time.Second
+	// adaptiveSlowdown is how much the batch size and concurrency shrink
+	// when a batch takes longer than the target latency to send.
+	adaptiveSlowdown = 0.9
+)
+
+// AdaptiveTransport sits between libhoney and the upstream transport, and
+// adapts the size of the batches sent upstream, and how many are sent at
+// once, to how upstream responds. Batches larger than the current batch
+// size, or than the most bytes a batch may hold, are split and sent as
+// several requests, whose responses are merged back into one for libhoney.
+//
+// Concurrency is cut in half when upstream throttles or fails, and shrinks a
+// little when it's slower than the target latency; it grows by one for every
+// window of fast responses. The batch size is cut in half by 413s, shrinks
+// with slow responses, and grows while full batches are sent quickly.
+//
+// Since requests have to be split before they're compressed, libhoney's
+// compression must be turned off, and the compression done by the
+// transport that this one wraps.
+type AdaptiveTransport struct {
+	Metrics metrics.Metrics `inject:"upstreamMetrics"`
+
+	base         http.RoundTripper
+	cfg          config.AdaptiveBatchingConfig
+	maxBatchSize int
+
+	mut  sync.Mutex
+	cond *sync.Cond
+	// batchSize and concurrency are fractional, so that they can grow by
+	// less than one at a time
+	batchSize   float64
+	concurrency float64
+	inFlight    int
+	pausedUntil time.Time
+
+	// these count what's happened since the last report
+	throttled    atomic.Int64
+	splitBatches atomic.Int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// batchEventStatus is the status of one event in the response to a batch.
+type batchEventStatus struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewAdaptiveTransport returns an AdaptiveTransport that sends through base.
+// maxBatchSize is the most events libhoney puts in a batch, which is also
+// the largest that the batch size grows to.
+func NewAdaptiveTransport(base http.RoundTripper, cfg config.AdaptiveBatchingConfig, maxBatchSize int) *AdaptiveTransport {
+	cfg.MinBatchSize = max(cfg.MinBatchSize, 1)
+	cfg.MinConcurrency = max(cfg.MinConcurrency, 1)
+	cfg.MaxConcurrency = max(cfg.MaxConcurrency, cfg.MinConcurrency)
+	maxBatchSize = max(maxBatchSize, cfg.MinBatchSize)
+	t := &AdaptiveTransport{
+		base:         base,
+		cfg:          cfg,
+		maxBatchSize: maxBatchSize,
+		// sending starts out as it would without adapting
+		batchSize:   float64(maxBatchSize),
+		concurrency: float64(cfg.MaxConcurrency),
+		done:        make(chan struct{}),
+	}
+	t.cond = sync.NewCond(&t.mut)
+	return t
+}
+
+func (t *AdaptiveTransport) Start() error {
+	t.Metrics.Register(gaugeAdaptiveBatchSize, "gauge")
+	t.Metrics.Register(gaugeAdaptiveConcurrency, "gauge")
+	t.Metrics.Register(counterAdaptiveThrottled, "counter")
+	t.Metrics.Register(counterAdaptiveSplitBatches, "counter")
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(adaptiveReportInterval)
+		defer ticker.Stop()
+		for {
+			t.report()
+			select {
+			case <-ticker.C:
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *AdaptiveTransport) Stop() error {
+	close(t.done)
+	t.wg.Wait()
+	return nil
+}
+
+func (t *AdaptiveTransport) report() {
+	batchSize, concurrency := t.limits()
+	t.Metrics.Gauge(gaugeAdaptiveBatchSize, batchSize)
+	t.Metrics.Gauge(gaugeAdaptiveConcurrency, concurrency)
+	t.Metrics.Count(counterAdaptiveThrottled, t.throttled.Swap(0))
+	t.Metrics.Count(counterAdaptiveSplitBatches, t.splitBatches.Swap(0))
+}
+
+// limits returns the current batch size and concurrency.
+func (t *AdaptiveTransport) limits() (int, int) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return int(t.batchSize), int(t.concurrency)
+}
+
+func (t *AdaptiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// only batches of events are adapted
+	if req.Body == nil || req.Body == http.NoBody || !strings.Contains(req.URL.Path, "/1/batch/") {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	isMsgpack := req.Header.Get("Content-Type") == "application/msgpack"
+	var events [][]byte
+	if req.Header.Get("Content-Encoding") == "" {
+		events, err = decodeBatchEvents(body, isMsgpack)
+	}
+	if events == nil || err != nil {
+		// a batch that can't be split is sent as it is
+		return t.send(withRequestBody(req, body), 0)
+	}
+
+	chunks := t.splitBatch(events)
+	if len(chunks) == 1 {
+		return t.send(withRequestBody(req, body), len(events))
+	}
+	t.splitBatches.Add(1)
+
+	statuses := make([][]batchEventStatus, len(chunks))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk [][]byte) {
+			defer wg.Done()
+			statuses[i] = t.sendChunk(req, chunk, isMsgpack)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	// libhoney matches the merged statuses to its events in order
+	merged := make([]batchEventStatus, 0, len(events))
+	for _, s := range statuses {
+		merged = append(merged, s...)
+	}
+	respBody, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// splitBatch splits a batch's events into chunks that fit in the current
+// batch size and the most bytes a batch may hold.
+func (t *AdaptiveTransport) splitBatch(events [][]byte) [][][]byte {
+	batchSize, _ := t.limits()
+	maxBytes := int(t.cfg.MaxBatchBytes)
+	var chunks [][][]byte
+	var chunk [][]byte
+	var size int
+	for _, ev := range events {
+		full := len(chunk) >= batchSize || (maxBytes > 0 && size+len(ev) > maxBytes)
+		if len(chunk) > 0 && full {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, ev)
+		size += len(ev)
+	}
+	return append(chunks, chunk)
+}
+
+// sendChunk sends part of a batch, and returns the status of each of its
+// events.
+func (t *AdaptiveTransport) sendChunk(req *http.Request, chunk [][]byte, isMsgpack bool) []batchEventStatus {
+	failed := func(status int, err string) []batchEventStatus {
+		statuses := make([]batchEventStatus, len(chunk))
+		for i := range statuses {
+			statuses[i] = batchEventStatus{Status: status, Error: err}
+		}
+		return statuses
+	}
+
+	resp, err := t.send(withRequestBody(req, encodeBatchEvents(chunk, isMsgpack)), len(chunk))
+	if err != nil {
+		return failed(0, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return failed(resp.StatusCode, fmt.Sprintf("got unexpected HTTP status %d: %s", resp.StatusCode, http.StatusText(resp.StatusCode)))
+	}
+
+	var responses []transmission.Response
+	if resp.Header.Get("Content-Type") == "application/msgpack" {
+		err = msgpack.NewDecoder(resp.Body).Decode(&responses)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&responses)
+	}
+	if err != nil || len(responses) != len(chunk) {
+		return failed(0, "got OK HTTP response, but couldn't read response body")
+	}
+	statuses := make([]batchEventStatus, len(responses))
+	for i, r := range responses {
+		statuses[i].Status = r.StatusCode
+		if r.Err != nil {
+			statuses[i].Error = r.Err.Error()
+		}
+	}
+	return statuses
+}
+
+// send sends a request of a batch of events once there's room for it, and
+// adapts to the response.
+func (t *AdaptiveTransport) send(req *http.Request, events int) (*http.Response, error) {
+	t.acquire()
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	var status int
+	var retryAfter string
+	if resp != nil {
+		status = resp.StatusCode
+		retryAfter = resp.Header.Get("Retry-After")
+	}
+	t.release(status, retryAfter, err, time.Since(start), events)
+	return resp, err
+}
+
+// acquire waits until sending isn't paused and fewer requests are in flight
+// than the current concurrency.
+func (t *AdaptiveTransport) acquire() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for {
+		if wait := time.Until(t.pausedUntil); wait > 0 {
+			t.mut.Unlock()
+			time.Sleep(wait)
+			t.mut.Lock()
+			continue
+		}
+		if t.inFlight < int(t.concurrency) {
+			break
+		}
+		t.cond.Wait()
+	}
+	t.inFlight++
+}
+
+// release records that a request is done, and adapts the batch size and
+// concurrency to its response.
+func (t *AdaptiveTransport) release(status int, retryAfter string, err error, latency time.Duration, events int) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.inFlight--
+	defer t.cond.Broadcast()
+
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		t.concurrency /= 2
+		t.throttled.Add(1)
+		if pause, ok := parseRetryAfter(retryAfter); ok {
+			t.pausedUntil = time.Now().Add(min(pause, adaptiveMaxPause))
+		}
+	case err != nil || status >= 500:
+		t.concurrency /= 2
+	case status == http.StatusRequestEntityTooLarge:
+		t.batchSize /= 2
+	case status >= 400:
+		// other client errors say nothing about upstream's capacity
+	case latency > time.Duration(t.cfg.TargetLatency) && t.cfg.TargetLatency > 0:
+		t.concurrency *= adaptiveSlowdown
+		t.batchSize *= adaptiveSlowdown
+	default:
+		t.concurrency += 1 / t.concurrency
+		// batches only need to grow if they're being filled
+		if events >= int(t.batchSize) {
+			t.batchSize += max(1, float64(t.maxBatchSize)/20)
+		}
+	}
+	t.concurrency = min(max(t.concurrency, float64(t.cfg.MinConcurrency)), float64(t.cfg.MaxConcurrency))
+	t.batchSize = min(max(t.batchSize, float64(t.cfg.MinBatchSize)), float64(t.maxBatchSize))
+}
+
+// parseRetryAfter parses a Retry-After header, which holds either a number
+// of seconds or a date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, seconds > 0
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		return time.Until(when), time.Until(when) > 0
+	}
+	return 0, false
+}
+
+// decodeBatchEvents splits the body of a batch request into the encoded
+// events it holds.
+func decodeBatchEvents(body []byte, isMsgpack bool) ([][]byte, error) {
+	if !isMsgpack {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(body, &raws); err != nil {
+			return nil, err
+		}
+		events := make([][]byte, len(raws))
+		for i, raw := range raws {
+			events[i] = raw
+		}
+		return events, nil
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(body))
+	n, err := dec.DecodeArrayLen()
+	if err != nil || n < 0 {
+		return nil, err
+	}
+	events := make([][]byte, n)
+	for i := range events {
+		raw, err := dec.DecodeRaw()
+		if err != nil {
+			return nil, err
+		}
+		events[i] = raw
+	}
+	return events, nil
+}
+
+// encodeBatchEvents joins encoded events into the body of a batch request.
+func encodeBatchEvents(events [][]byte, isMsgpack bool) []byte {
+	var buf bytes.Buffer
+	if !isMsgpack {
+		buf.WriteByte('[')
+		buf.Write(bytes.Join(events, []byte{','}))
+		buf.WriteByte(']')
+		return buf.Bytes()
+	}
+	msgpack.NewEncoder(&buf).EncodeArrayLen(len(events))
+	for _, ev := range events {
+		buf.Write(ev)
+	}
+	return buf.Bytes()
+}
+
+// withRequestBody returns a copy of a request with a new body, since a
+// RoundTripper must not modify the request it was given.
+func withRequestBody(req *http.Request, body []byte) *http.Request {
+	newReq := req.Clone(req.Context())
+	newReq.Body = io.NopCloser(bytes.NewReader(body))
+	newReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	newReq.ContentLength = int64(len(body))
+	return newReq
+}
@@ -0,0 +1,150 @@
+package transmit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/honeycombio/refinery/config"
+)
+
+func newTestAdaptiveTransport(base http.RoundTripper) *AdaptiveTransport {
+	return NewAdaptiveTransport(base, config.AdaptiveBatchingConfig{
+		Enabled:        true,
+		MinBatchSize:   2,
+		MaxBatchBytes:  config.MemorySize(1 << 20),
+		TargetLatency:  config.Duration(time.Second),
+		MinConcurrency: 1,
+		MaxConcurrency: 8,
+	}, 10)
+}
+
+func msgpackBatch(t *testing.T, n int) []byte {
+	events := make([]map[string]interface{}, n)
+	for i := range events {
+		events[i] = map[string]interface{}{"data": map[string]interface{}{"index": i}}
+	}
+	body, err := msgpack.Marshal(events)
+	require.NoError(t, err)
+	return body
+}
+
+func TestAdaptiveTransportSplitsBatches(t *testing.T) {
+	var mut sync.Mutex
+	var indexes []int
+	transport := newTestAdaptiveTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var batch []struct {
+			Data struct {
+				Index int `msgpack:"index"`
+			} `msgpack:"data"`
+		}
+		require.NoError(t, msgpack.NewDecoder(req.Body).Decode(&batch))
+		mut.Lock()
+		for _, ev := range batch {
+			indexes = append(indexes, ev.Data.Index)
+		}
+		mut.Unlock()
+		// the chunk holding the last event is throttled
+		if batch[len(batch)-1].Data.Index == 4 {
+			return &http.Response{StatusCode: http.StatusTooManyRequests, Body: http.NoBody, Header: http.Header{}}, nil
+		}
+		statuses := strings.TrimSuffix(strings.Repeat(`{"status":202},`, len(batch)), ",")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("[" + statuses + "]")), Header: http.Header{}}, nil
+	}))
+	transport.batchSize = 2
+
+	req, err := http.NewRequest("POST", "http://localhost/1/batch/test", bytes.NewReader(msgpackBatch(t, 5)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/msgpack")
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.ElementsMatch(t, []int{0, 1, 2, 3, 4}, indexes)
+	var responses []transmission.Response
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&responses))
+	require.Len(t, responses, 5)
+	for _, r := range responses[:4] {
+		assert.Equal(t, http.StatusAccepted, r.StatusCode)
+		assert.NoError(t, r.Err)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, responses[4].StatusCode)
+	assert.Error(t, responses[4].Err)
+	assert.EqualValues(t, 1, transport.splitBatches.Load())
+	assert.EqualValues(t, 1, transport.throttled.Load())
+}
+
+func TestAdaptiveTransportSplitsLargePayloads(t *testing.T) {
+	transport := newTestAdaptiveTransport(nil)
+	transport.cfg.MaxBatchBytes = 10
+	chunks := transport.splitBatch([][]byte{make([]byte, 6), make([]byte, 6), make([]byte, 20), make([]byte, 1)})
+	require.Len(t, chunks, 4)
+	// an event larger than the limit is sent on its own
+	assert.Len(t, chunks[2][0], 20)
+	assert.Len(t, chunks[3][0], 1)
+}
+
+func TestAdaptiveTransportAdapts(t *testing.T) {
+	transport := newTestAdaptiveTransport(nil)
+	limits := transport.limits
+
+	// throttling halves concurrency, and Retry-After pauses sending
+	transport.acquire()
+	transport.release(http.StatusTooManyRequests, "2", nil, time.Millisecond, 10)
+	batchSize, concurrency := limits()
+	assert.Equal(t, 10, batchSize)
+	assert.Equal(t, 4, concurrency)
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), transport.pausedUntil, 100*time.Millisecond)
+	transport.pausedUntil = time.Time{}
+
+	// payloads that are too large halve the batch size
+	transport.acquire()
+	transport.release(http.StatusRequestEntityTooLarge, "", nil, time.Millisecond, 10)
+	batchSize, _ = limits()
+	assert.Equal(t, 5, batchSize)
+
+	// slow responses shrink both, but not below their minimums
+	for i := 0; i < 50; i++ {
+		transport.acquire()
+		transport.release(http.StatusOK, "", nil, 2*time.Second, 5)
+	}
+	batchSize, concurrency = limits()
+	assert.Equal(t, 2, batchSize)
+	assert.Equal(t, 1, concurrency)
+
+	// fast responses to full batches grow both again, up to their maximums
+	for i := 0; i < 200; i++ {
+		transport.acquire()
+		batchSize, _ = limits()
+		transport.release(http.StatusOK, "", nil, time.Millisecond, batchSize)
+	}
+	batchSize, concurrency = limits()
+	assert.Equal(t, 10, batchSize)
+	assert.Equal(t, 8, concurrency)
+	assert.Zero(t, transport.inFlight)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	d, ok := parseRetryAfter("3")
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+
+	d, ok = parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Minute), float64(d), float64(2*time.Second))
+
+	_, ok = parseRetryAfter("")
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
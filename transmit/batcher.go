@@ -0,0 +1,133 @@
+package transmit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/internal/supervisor"
+)
+
+// keyedItem is an item waiting to be added to the batch for its key.
+type keyedItem[T any] struct {
+	key  string
+	item T
+}
+
+// batcher collects queued items into a batch for each key, and sends a
+// batch from a background goroutine when it's full, when the batch timeout
+// passes, and when asked to flush.
+type batcher[T any] struct {
+	size    int
+	timeout time.Duration
+	send    func(key string, batch []T)
+
+	queue chan keyedItem[T]
+	flush chan chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newBatcher[T any](queueSize int, size int, timeout time.Duration, send func(key string, batch []T)) *batcher[T] {
+	return &batcher[T]{
+		size:    size,
+		timeout: timeout,
+		send:    send,
+		queue:   make(chan keyedItem[T], queueSize),
+		flush:   make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start starts sending batches, under the supervisor.
+func (b *batcher[T]) start(s *supervisor.Supervisor, subsystem string) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		_ = s.Wrap(subsystem, func() error {
+			b.run()
+			return nil
+		})()
+	}()
+}
+
+// stop sends everything that's queued, and stops.
+func (b *batcher[T]) stop() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+// add queues an item, waiting for room in the queue.
+func (b *batcher[T]) add(key string, item T) {
+	select {
+	case b.queue <- keyedItem[T]{key: key, item: item}:
+	case <-b.done:
+	}
+}
+
+// tryAdd queues an item if there's room in the queue, and returns false if
+// there isn't.
+func (b *batcher[T]) tryAdd(key string, item T) bool {
+	select {
+	case b.queue <- keyedItem[T]{key: key, item: item}:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushAndWait sends everything that's queued, and waits until it's sent.
+func (b *batcher[T]) flushAndWait() {
+	flushed := make(chan struct{})
+	select {
+	case b.flush <- flushed:
+		<-flushed
+	case <-b.done:
+	}
+}
+
+func (b *batcher[T]) run() {
+	batches := make(map[string][]T)
+	sendAll := func() {
+		for key, batch := range batches {
+			b.send(key, batch)
+			delete(batches, key)
+		}
+	}
+	add := func(ki keyedItem[T]) {
+		batches[ki.key] = append(batches[ki.key], ki.item)
+		if len(batches[ki.key]) >= b.size {
+			b.send(ki.key, batches[ki.key])
+			delete(batches, ki.key)
+		}
+	}
+	// drain adds the items that are already queued
+	drain := func() {
+		for {
+			select {
+			case ki := <-b.queue:
+				add(ki)
+			default:
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(b.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case ki := <-b.queue:
+			add(ki)
+		case <-ticker.C:
+			sendAll()
+		case flushed := <-b.flush:
+			drain()
+			sendAll()
+			close(flushed)
+		case <-b.done:
+			drain()
+			sendAll()
+			return
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package transmit
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// errBatchTooLarge is returned when a batch is larger than the whole disk
+// queue.
+var errBatchTooLarge = errors.New("batch is larger than the upstream queue")
+
+// queuedEvent is the part of an event that's written to the disk queue. The
+// event's context isn't kept.
+type queuedEvent struct {
+	APIHost     string
+	APIKey      string
+	Dataset     string
+	Environment string
+	SampleRate  uint
+	Timestamp   time.Time
+	Data        map[string]interface{}
+}
+
+// newQueuedEvent returns the part of an event that's written to disk.
+func newQueuedEvent(ev *types.Event) queuedEvent {
+	return queuedEvent{
+		APIHost:     ev.APIHost,
+		APIKey:      ev.APIKey,
+		Dataset:     ev.Dataset,
+		Environment: ev.Environment,
+		SampleRate:  ev.SampleRate,
+		Timestamp:   ev.Timestamp,
+		Data:        ev.Data,
+	}
+}
+
+// event returns the event that was written to disk, with a new context.
+func (qe queuedEvent) event() *types.Event {
+	return &types.Event{
+		Context:     context.Background(),
+		APIHost:     qe.APIHost,
+		APIKey:      qe.APIKey,
+		Dataset:     qe.Dataset,
+		Environment: qe.Environment,
+		SampleRate:  qe.SampleRate,
+		Timestamp:   qe.Timestamp,
+		Data:        qe.Data,
+	}
+}
+
+func init() {
+	// nested values in event data are decoded from JSON or msgpack as these
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// queueBatch is a file holding a batch of events.
+type queueBatch struct {
+	path   string
+	seq    uint64
+	size   int64
+	events int
+}
+
+// diskQueue writes batches of events to files in a directory, and reads
+// them back oldest first. The batches left in the directory by an earlier
+// process are kept, so events survive a restart. When the disk space used
+// would go over its limit, the oldest batches are removed. It's safe for
+// concurrent use.
+type diskQueue struct {
+	mut      sync.Mutex
+	dir      string
+	maxBytes int64
+	used     int64
+	seq      uint64
+	// batches are oldest first
+	batches []queueBatch
+}
+
+// diskQueueDir returns the directory the upstream queue is kept in, which
+// is a directory in the system's temporary directory if none is configured.
+func diskQueueDir(dir string) string {
+	if dir == "" {
+		return filepath.Join(os.TempDir(), "refinery-upstream-queue")
+	}
+	return dir
+}
+
+// newDiskQueue opens a disk queue in a directory, picking up any batches
+// left in it by an earlier process.
+func newDiskQueue(dir string, maxBytes int64) (*diskQueue, error) {
+	dir = diskQueueDir(dir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	q := &diskQueue{dir: dir, maxBytes: maxBytes}
+
+	// partly written batches are never renamed, and can't be read
+	partial, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range partial {
+		os.Remove(path)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.batch"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		var b queueBatch
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d-%d.batch", &b.seq, &b.events); err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		b.path = path
+		b.size = info.Size()
+		q.batches = append(q.batches, b)
+		q.used += b.size
+		q.seq = max(q.seq, b.seq)
+	}
+	sort.Slice(q.batches, func(i, j int) bool { return q.batches[i].seq < q.batches[j].seq })
+	return q, nil
+}
+
+// push writes a batch of events to a new file, removing the oldest batches
+// if there isn't room for it. It returns the number of events removed.
+func (q *diskQueue) push(events []queuedEvent) (int, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(events); err != nil {
+		return 0, err
+	}
+	size := int64(buf.Len())
+	if size > q.maxBytes {
+		return 0, errBatchTooLarge
+	}
+
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	var evicted int
+	for len(q.batches) > 0 && q.used+size > q.maxBytes {
+		evicted += q.batches[0].events
+		q.removeOldest()
+	}
+
+	q.seq++
+	b := queueBatch{seq: q.seq, size: size, events: len(events)}
+	b.path = filepath.Join(q.dir, fmt.Sprintf("%020d-%d.batch", b.seq, b.events))
+	// the batch is written under another name first, so that a crash can't
+	// leave a partial batch to be read back
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		os.Remove(tmp)
+		return evicted, err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		os.Remove(tmp)
+		return evicted, err
+	}
+	q.batches = append(q.batches, b)
+	q.used += size
+	return evicted, nil
+}
+
+// pop reads back the oldest batch and removes its file. It returns nil if
+// the queue is empty. A batch that can't be read is removed anyway.
+func (q *diskQueue) pop() ([]queuedEvent, error) {
+	q.mut.Lock()
+	if len(q.batches) == 0 {
+		q.mut.Unlock()
+		return nil, nil
+	}
+	path := q.batches[0].path
+	data, err := os.ReadFile(path)
+	q.removeOldest()
+	q.mut.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []queuedEvent
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&events); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return events, nil
+}
+
+// removeOldest removes the oldest batch; the caller must hold the lock.
+func (q *diskQueue) removeOldest() {
+	os.Remove(q.batches[0].path)
+	q.used -= q.batches[0].size
+	q.batches = q.batches[1:]
+}
+
+// len returns the number of batches and events in the queue.
+func (q *diskQueue) len() (batches int, events int) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	for _, b := range q.batches {
+		events += b.events
+	}
+	return len(q.batches), events
+}
+
+// size returns the disk space used by the queue.
+func (q *diskQueue) size() int64 {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return q.used
+}
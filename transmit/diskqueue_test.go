@@ -0,0 +1,95 @@
+package transmit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queuedEvents(n int, dataset string) []queuedEvent {
+	events := make([]queuedEvent, n)
+	for i := range events {
+		events[i] = queuedEvent{
+			APIKey:  "key",
+			Dataset: dataset,
+			Data:    map[string]interface{}{"i": int64(i), "nested": map[string]interface{}{"a": "b"}},
+		}
+	}
+	return events
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 1<<20)
+	require.NoError(t, err)
+
+	for _, dataset := range []string{"first", "second"} {
+		evicted, err := q.push(queuedEvents(3, dataset))
+		require.NoError(t, err)
+		assert.Zero(t, evicted)
+	}
+	batches, events := q.len()
+	assert.Equal(t, 2, batches)
+	assert.Equal(t, 6, events)
+
+	// the batches are still there after a restart, along with no partial ones
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000003-3.batch.tmp"), []byte("partial"), 0o600))
+	q, err = newDiskQueue(dir, 1<<20)
+	require.NoError(t, err)
+	batches, _ = q.len()
+	assert.Equal(t, 2, batches)
+
+	popped, err := q.pop()
+	require.NoError(t, err)
+	require.Len(t, popped, 3)
+	assert.Equal(t, "first", popped[0].Dataset)
+	assert.Equal(t, map[string]interface{}{"a": "b"}, popped[2].Data["nested"])
+	assert.Equal(t, int64(2), popped[2].Data["i"])
+
+	popped, err = q.pop()
+	require.NoError(t, err)
+	assert.Equal(t, "second", popped[0].Dataset)
+
+	popped, err = q.pop()
+	require.NoError(t, err)
+	assert.Nil(t, popped)
+	assert.Zero(t, q.size())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDiskQueueEvictsOldest(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 1<<20)
+	require.NoError(t, err)
+	_, err = q.push(queuedEvents(10, "sized"))
+	require.NoError(t, err)
+	batchSize := q.size()
+
+	// room for three batches
+	q, err = newDiskQueue(t.TempDir(), 3*batchSize+batchSize/2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		evicted, err := q.push(queuedEvents(10, fmt.Sprint(i)))
+		require.NoError(t, err)
+		if i < 3 {
+			assert.Zero(t, evicted)
+		} else {
+			assert.Equal(t, 10, evicted)
+		}
+	}
+	batches, events := q.len()
+	assert.Equal(t, 3, batches)
+	assert.Equal(t, 30, events)
+	popped, err := q.pop()
+	require.NoError(t, err)
+	assert.Equal(t, "2", popped[0].Dataset)
+
+	_, err = q.push(queuedEvents(100, "huge"))
+	assert.ErrorIs(t, err, errBatchTooLarge)
+}
@@ -0,0 +1,205 @@
+package transmit
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/supervisor"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/sample"
+	"github.com/honeycombio/refinery/types"
+)
+
+var _ Transmission = &FanoutTransmission{}
+
+// FanoutTransmission hands every kept event to the Primary transmission,
+// and copies the events that match each extra destination's conditions to
+// that destination. Each destination is sent to by a transmission of its
+// own, with its own libhoney client and disk queue, so one that's slow or
+// down doesn't hold up the others.
+type FanoutTransmission struct {
+	Config     config.Config          `inject:""`
+	Logger     logger.Logger          `inject:""`
+	Metrics    metrics.Metrics        `inject:"genericMetrics"`
+	Version    string                 `inject:"version"`
+	Health     health.Recorder        `inject:""`
+	Supervisor *supervisor.Supervisor `inject:""`
+	Transport  *http.Transport        `inject:"upstreamTransport"`
+	// Primary sends every kept event on as usual
+	Primary Transmission `inject:"primaryTransmission"`
+
+	destinations []*destination
+}
+
+// destination is an extra upstream that matching events are copied to.
+type destination struct {
+	name       string
+	cfg        config.DestinationConfig
+	conditions []*config.RulesBasedSamplerCondition
+	tx         *DefaultTransmission
+	// adaptive is nil unless adaptive batching is enabled
+	adaptive *AdaptiveTransport
+}
+
+func (f *FanoutTransmission) Start() error {
+	targets := f.Config.GetDestinationsConfig().Targets
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dest, err := f.newDestination(name, targets[name])
+		if err != nil {
+			f.stopDestinations()
+			return err
+		}
+		f.destinations = append(f.destinations, dest)
+		f.Logger.Info().WithString("destination", name).Logf("copying kept events to extra destination")
+	}
+	return nil
+}
+
+func (f *FanoutTransmission) newDestination(name string, cfg config.DestinationConfig) (*destination, error) {
+	// the conditions are copied, since initializing them changes them
+	conditions := make([]*config.RulesBasedSamplerCondition, 0, len(cfg.Conditions))
+	for _, c := range cfg.Conditions {
+		condition := *c
+		if err := condition.Init(); err != nil {
+			return nil, fmt.Errorf("invalid condition for destination %s: %w", name, err)
+		}
+		conditions = append(conditions, &condition)
+	}
+
+	destMetrics := metrics.NewMetricsPrefixer("libhoney_destination_" + name)
+	destMetrics.Metrics = f.Metrics
+	dest := &destination{name: name, cfg: cfg, conditions: conditions}
+
+	// libhoney only knows zstd, so for snappy we turn its compression off and
+	// compress in the transport instead
+	var base http.RoundTripper = f.Transport
+	if f.Transport == nil {
+		base = http.DefaultTransport
+	}
+	roundTripper := base
+	compression := f.Config.GetUpstreamCompression()
+	if compression == "snappy" {
+		roundTripper = NewSnappyTransport(base)
+	}
+	// each destination adapts to how it responds on its own
+	adaptive := f.Config.GetAdaptiveBatchingConfig()
+	maxConcurrentBatches := uint(libhoney.DefaultMaxConcurrentBatches)
+	if adaptive.Enabled {
+		if compression != "snappy" && compression != "none" {
+			roundTripper = NewZstdTransport(base)
+		}
+		dest.adaptive = NewAdaptiveTransport(roundTripper, adaptive, int(f.Config.GetMaxBatchSize()))
+		dest.adaptive.Metrics = destMetrics
+		dest.adaptive.Start()
+		roundTripper = dest.adaptive
+		maxConcurrentBatches = uint(adaptive.MaxConcurrency)
+	}
+
+	client, err := libhoney.NewClient(libhoney.ClientConfig{
+		Transmission: &transmission.Honeycomb{
+			MaxBatchSize:         f.Config.GetMaxBatchSize(),
+			BatchTimeout:         f.Config.GetBatchTimeout(),
+			MaxConcurrentBatches: maxConcurrentBatches,
+			PendingWorkCapacity:  uint(f.Config.GetUpstreamBufferSize()),
+			UserAgentAddition:    "refinery/" + f.Version,
+			Transport:            roundTripper,
+			// a destination that can't keep up fails its sends, which are
+			// queued on disk, rather than holding up the primary
+			BlockOnSend:           false,
+			DisableCompression:    compression == "snappy" || compression == "none" || adaptive.Enabled,
+			EnableMsgpackEncoding: true,
+			Metrics:               destMetrics,
+		},
+	})
+	if err != nil {
+		dest.stop()
+		return nil, fmt.Errorf("creating client for destination %s: %w", name, err)
+	}
+
+	tx := NewDefaultTransmission(client, destMetrics, "destination_"+name)
+	tx.Config = f.Config
+	tx.Logger = f.Logger
+	tx.Version = f.Version
+	tx.Health = f.Health
+	tx.Supervisor = f.Supervisor
+	tx.QueueSubdirectory = filepath.Join("destinations", name)
+	if err := tx.Start(); err != nil {
+		client.Close()
+		dest.stop()
+		return nil, fmt.Errorf("starting destination %s: %w", name, err)
+	}
+	dest.tx = tx
+	return dest, nil
+}
+
+// stop stops sending to the destination.
+func (d *destination) stop() {
+	if d.tx != nil {
+		d.tx.Stop()
+		d.tx.LibhClient.Close()
+	}
+	if d.adaptive != nil {
+		d.adaptive.Stop()
+	}
+}
+
+func (f *FanoutTransmission) Stop() error {
+	f.stopDestinations()
+	return nil
+}
+
+func (f *FanoutTransmission) stopDestinations() {
+	for _, dest := range f.destinations {
+		dest.stop()
+	}
+	f.destinations = nil
+}
+
+func (f *FanoutTransmission) EnqueueEvent(ev *types.Event) {
+	f.copyToDestinations(ev)
+	f.Primary.EnqueueEvent(ev)
+}
+
+func (f *FanoutTransmission) EnqueueSpan(sp *types.Span) {
+	f.copyToDestinations(&sp.Event)
+	f.Primary.EnqueueSpan(sp)
+}
+
+// Flush flushes the primary transmission and every destination.
+func (f *FanoutTransmission) Flush() {
+	f.Primary.Flush()
+	for _, dest := range f.destinations {
+		dest.tx.Flush()
+	}
+}
+
+// copyToDestinations sends a copy of an event to each destination whose
+// conditions it matches, with the destination's dataset and API key.
+func (f *FanoutTransmission) copyToDestinations(ev *types.Event) {
+	for _, dest := range f.destinations {
+		if !sample.EventMatchesConditions(ev.Data, dest.conditions) {
+			continue
+		}
+		copied := *ev
+		if dest.cfg.APIHost != "" {
+			copied.APIHost = dest.cfg.APIHost
+		}
+		copied.APIKey = dest.cfg.APIKeyFor(ev.Dataset, ev.APIKey)
+		copied.Dataset = dest.cfg.DatasetFor(ev.Dataset)
+		dest.tx.EnqueueEvent(&copied)
+	}
+}
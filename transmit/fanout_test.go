@@ -0,0 +1,120 @@
+package transmit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+// batchAPI records the events sent to a fake Honeycomb batch API, by the
+// API key and dataset they were sent with.
+type batchAPI struct {
+	mut    sync.Mutex
+	events map[string][]map[string]interface{}
+}
+
+func (a *batchAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var batch []struct {
+		Data map[string]interface{} `msgpack:"data"`
+	}
+	if err := msgpack.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("X-Honeycomb-Team") + "/" + strings.TrimPrefix(r.URL.Path, "/1/batch/")
+	a.mut.Lock()
+	for _, ev := range batch {
+		a.events[key] = append(a.events[key], ev.Data)
+	}
+	a.mut.Unlock()
+	w.Write([]byte("[" + strings.TrimSuffix(strings.Repeat(`{"status":202},`, len(batch)), ",") + "]"))
+}
+
+func (a *batchAPI) sent(key string) []map[string]interface{} {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	return a.events[key]
+}
+
+func TestFanoutTransmission(t *testing.T) {
+	api := &batchAPI{events: make(map[string][]map[string]interface{})}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	primary := &MockTransmission{}
+	require.NoError(t, primary.Start())
+	f := &FanoutTransmission{
+		Config: &config.MockConfig{
+			GetMaxBatchSizeVal:        100,
+			GetBatchTimeoutVal:        10 * time.Millisecond,
+			GetUpstreamBufferSizeVal:  100,
+			GetUpstreamCompressionVal: "none",
+			Destinations: config.DestinationsConfig{Targets: map[string]config.DestinationConfig{
+				"all": {
+					APIHost:  server.URL,
+					APIKey:   "all-key",
+					Datasets: map[string]string{"checkout": "copied-checkout"},
+				},
+				"security": {
+					APIHost: server.URL,
+					APIKeys: map[string]string{"checkout": "security-key"},
+					Conditions: []*config.RulesBasedSamplerCondition{
+						{Field: "security.relevant", Operator: config.EQ, Value: true},
+					},
+				},
+			}},
+		},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+		Primary: primary,
+	}
+	require.NoError(t, f.Start())
+	defer f.Stop()
+	// starting the destinations sets libhoney's user agent, which other
+	// tests expect to set themselves
+	t.Cleanup(func() {
+		once = sync.Once{}
+		libhoney.UserAgentAddition = ""
+	})
+
+	for i, dataset := range []string{"checkout", "checkout", "billing"} {
+		f.EnqueueSpan(&types.Span{Event: types.Event{
+			Context: context.Background(),
+			APIHost: "http://primary",
+			APIKey:  "original-key",
+			Dataset: dataset,
+			Data:    map[string]interface{}{"index": i, "security.relevant": i != 1},
+		}})
+	}
+
+	// the primary gets everything, unchanged
+	primary.Mux.RLock()
+	require.Len(t, primary.Events, 3)
+	assert.Equal(t, "checkout", primary.Events[0].Dataset)
+	assert.Equal(t, "original-key", primary.Events[0].APIKey)
+	primary.Mux.RUnlock()
+	f.Flush()
+
+	assert.Eventually(t, func() bool {
+		return len(api.sent("all-key/copied-checkout")) == 2 &&
+			len(api.sent("all-key/billing")) == 1 &&
+			len(api.sent("security-key/checkout")) == 1 &&
+			len(api.sent("original-key/billing")) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 0, api.sent("security-key/checkout")[0]["index"])
+	assert.EqualValues(t, 2, api.sent("original-key/billing")[0]["index"])
+}
@@ -0,0 +1,209 @@
+package transmit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/supervisor"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+const (
+	counterKafkaSent       = "kafka_output_sent"
+	counterKafkaSendErrors = "kafka_output_send_errors"
+	counterKafkaDropped    = "kafka_output_dropped"
+)
+
+// kafkaSendTimeout is how long a request to the Kafka REST Proxy can take.
+const kafkaSendTimeout = 10 * time.Second
+
+var _ Transmission = &KafkaTransmission{}
+
+// KafkaTransmission produces kept events to Kafka topics, through a Kafka
+// REST Proxy. Events are queued and produced in batches by a background
+// goroutine; when the queue is full, events are dropped from the Kafka
+// output rather than holding up the collector. In "alongside" mode, every
+// event is also handed to the Upstream transmission.
+type KafkaTransmission struct {
+	Config     config.Config          `inject:""`
+	Logger     logger.Logger          `inject:""`
+	Metrics    metrics.Metrics        `inject:"genericMetrics"`
+	Supervisor *supervisor.Supervisor `inject:""`
+	// Upstream sends events to the upstream API, whether that's the
+	// Honeycomb events API or OTLP
+	Upstream Transmission `inject:"apiTransmission"`
+	Client   *http.Client
+
+	alongside bool
+	// batches are keyed by topic
+	batches *batcher[kafkaMessage]
+}
+
+// kafkaMessage is an encoded event, waiting to be produced.
+type kafkaMessage struct {
+	key   string
+	value []byte
+}
+
+// kafkaProduceRecord is a record in a v2 binary produce request to the
+// Kafka REST Proxy; keys and values are base64 encoded, which encoding/json
+// does for byte slices.
+type kafkaProduceRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// kafkaProduceResponse is the REST Proxy's response to a produce request,
+// with an offset for each record in the request.
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (k *KafkaTransmission) Start() error {
+	cfg := k.Config.GetKafkaOutputConfig()
+	if len(cfg.RESTURLs) == 0 {
+		return fmt.Errorf("KafkaOutput.RESTURLs must be set when KafkaOutput.Mode is %q", cfg.Mode)
+	}
+	if k.Client == nil {
+		k.Client = &http.Client{Timeout: kafkaSendTimeout}
+	}
+	k.alongside = cfg.Mode == "alongside"
+
+	k.Metrics.Register(counterKafkaSent, "counter")
+	k.Metrics.Register(counterKafkaSendErrors, "counter")
+	k.Metrics.Register(counterKafkaDropped, "counter")
+
+	k.batches = newBatcher(cfg.QueueSize, cfg.BatchSize, time.Duration(cfg.BatchTimeout), k.send)
+	k.batches.start(k.Supervisor, "kafka_output")
+	return nil
+}
+
+func (k *KafkaTransmission) Stop() error {
+	if k.batches != nil {
+		k.batches.stop()
+	}
+	return nil
+}
+
+func (k *KafkaTransmission) EnqueueEvent(ev *types.Event) {
+	if k.alongside {
+		k.Upstream.EnqueueEvent(ev)
+	}
+	k.enqueue(ev, "")
+}
+
+func (k *KafkaTransmission) EnqueueSpan(sp *types.Span) {
+	if k.alongside {
+		k.Upstream.EnqueueSpan(sp)
+	}
+	k.enqueue(&sp.Event, sp.TraceID)
+}
+
+// Flush produces all of the queued events, and waits until they're sent.
+func (k *KafkaTransmission) Flush() {
+	if k.alongside {
+		k.Upstream.Flush()
+	}
+	if k.batches != nil {
+		k.batches.flushAndWait()
+	}
+}
+
+func (k *KafkaTransmission) enqueue(ev *types.Event, key string) {
+	cfg := k.Config.GetKafkaOutputConfig()
+	value, err := encodeKafkaEvent(ev, cfg.Encoding)
+	if err != nil {
+		k.Logger.Error().WithString("dataset", ev.Dataset).WithString("error", err.Error()).Logf("failed to encode event for Kafka")
+		k.Metrics.Increment(counterKafkaDropped)
+		return
+	}
+	if !k.batches.tryAdd(cfg.TopicFor(ev.Dataset), kafkaMessage{key: key, value: value}) {
+		k.Metrics.Increment(counterKafkaDropped)
+	}
+}
+
+// send produces a batch of messages to a topic, through the first REST Proxy
+// that accepts it.
+func (k *KafkaTransmission) send(topic string, batch []kafkaMessage) {
+	records := make([]kafkaProduceRecord, len(batch))
+	for i, msg := range batch {
+		records[i].Value = msg.value
+		if msg.key != "" {
+			records[i].Key = []byte(msg.key)
+		}
+	}
+	body, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		k.Logger.Error().WithString("topic", topic).WithString("error", err.Error()).Logf("failed to encode Kafka produce request")
+		k.Metrics.Count(counterKafkaSendErrors, len(batch))
+		return
+	}
+
+	var failed int
+	for _, restURL := range k.Config.GetKafkaOutputConfig().RESTURLs {
+		failed, err = k.produce(restURL, topic, body)
+		if err == nil {
+			break
+		}
+		k.Logger.Warn().WithString("url", restURL).WithString("topic", topic).WithString("error", err.Error()).Logf("failed to produce events to Kafka")
+	}
+	if err != nil {
+		failed = len(batch)
+		k.Logger.Error().WithString("topic", topic).WithField("events", len(batch)).Logf("no Kafka REST Proxy accepted the events; dropping them")
+	}
+	k.Metrics.Count(counterKafkaSent, len(batch)-failed)
+	k.Metrics.Count(counterKafkaSendErrors, failed)
+}
+
+// produce sends a produce request to a REST Proxy; it returns the number of
+// records that Kafka didn't accept.
+func (k *KafkaTransmission) produce(restURL string, topic string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaSendTimeout)
+	defer cancel()
+	target := strings.TrimSuffix(restURL, "/") + "/topics/" + url.PathEscape(topic)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(io.Discard, resp.Body)
+		return 0, fmt.Errorf("kafka REST proxy returned status %d", resp.StatusCode)
+	}
+
+	var produced kafkaProduceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		// the records were accepted, even if we can't tell which failed
+		return 0, nil
+	}
+	var failed int
+	for _, offset := range produced.Offsets {
+		if offset.ErrorCode != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		k.Logger.Error().WithString("topic", topic).WithField("events", failed).Logf("Kafka rejected some events")
+	}
+	return failed, nil
+}
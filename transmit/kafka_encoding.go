@@ -0,0 +1,46 @@
+package transmit
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// kafkaEvent is how an event is encoded in a Kafka message as JSON or
+// msgpack.
+type kafkaEvent struct {
+	Time        time.Time              `json:"time" msgpack:"time"`
+	Dataset     string                 `json:"dataset" msgpack:"dataset"`
+	Environment string                 `json:"environment,omitempty" msgpack:"environment,omitempty"`
+	SampleRate  uint                   `json:"samplerate" msgpack:"samplerate"`
+	Data        map[string]interface{} `json:"data" msgpack:"data"`
+}
+
+// encodeKafkaEvent encodes an event as the value of a Kafka message.
+func encodeKafkaEvent(ev *types.Event, encoding string) ([]byte, error) {
+	switch encoding {
+	case "json", "":
+		return json.Marshal(newKafkaEvent(ev))
+	case "msgpack":
+		return msgpack.Marshal(newKafkaEvent(ev))
+	case "otlp":
+		return proto.Marshal(otlpRequestForEvents([]*types.Event{ev}))
+	default:
+		return nil, fmt.Errorf("unknown Kafka encoding %q", encoding)
+	}
+}
+
+func newKafkaEvent(ev *types.Event) kafkaEvent {
+	return kafkaEvent{
+		Time:        ev.Timestamp,
+		Dataset:     ev.Dataset,
+		Environment: ev.Environment,
+		SampleRate:  ev.SampleRate,
+		Data:        ev.Data,
+	}
+}
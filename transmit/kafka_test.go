@@ -0,0 +1,170 @@
+package transmit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+// kafkaProxy records the produce requests sent to a fake Kafka REST Proxy.
+type kafkaProxy struct {
+	mut     sync.Mutex
+	records map[string][]kafkaProduceRecord
+}
+
+func (p *kafkaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Records []kafkaProduceRecord `json:"records"`
+	}
+	if r.Header.Get("Content-Type") != "application/vnd.kafka.binary.v2+json" || json.NewDecoder(r.Body).Decode(&body) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.mut.Lock()
+	p.records[r.URL.Path] = append(p.records[r.URL.Path], body.Records...)
+	p.mut.Unlock()
+	w.Write([]byte(`{"offsets":[{"partition":0,"offset":1}]}`))
+}
+
+func (p *kafkaProxy) topic(path string) []kafkaProduceRecord {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.records[path]
+}
+
+func newTestKafkaTransmission(t *testing.T, cfg config.KafkaOutputConfig) (*KafkaTransmission, *MockTransmission) {
+	upstream := &MockTransmission{}
+	require.NoError(t, upstream.Start())
+	k := &KafkaTransmission{
+		Config:   &config.MockConfig{KafkaOutput: cfg},
+		Logger:   &logger.NullLogger{},
+		Metrics:  &metrics.NullMetrics{},
+		Upstream: upstream,
+	}
+	require.NoError(t, k.Start())
+	t.Cleanup(func() { k.Stop() })
+	return k, upstream
+}
+
+func TestKafkaTransmission(t *testing.T) {
+	proxy := &kafkaProxy{records: make(map[string][]kafkaProduceRecord)}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	k, upstream := newTestKafkaTransmission(t, config.KafkaOutputConfig{
+		Mode:          "alongside",
+		RESTURLs:      []string{down.URL, server.URL + "/"},
+		Topic:         "events",
+		DatasetTopics: map[string]string{"checkout": "checkout-events"},
+		Encoding:      "json",
+		BatchSize:     100,
+		BatchTimeout:  config.Duration(time.Hour),
+		QueueSize:     100,
+	})
+
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	k.EnqueueSpan(&types.Span{TraceID: "trace1", Event: types.Event{
+		Dataset: "checkout", SampleRate: 2, Timestamp: ts, Data: map[string]interface{}{"a": "b"},
+	}})
+	k.EnqueueEvent(&types.Event{Dataset: "frontend", Timestamp: ts, Data: map[string]interface{}{"c": 1}})
+	// alongside mode sends everything upstream too
+	upstream.Mux.RLock()
+	assert.Len(t, upstream.Events, 2)
+	upstream.Mux.RUnlock()
+	k.Flush()
+
+	checkout := proxy.topic("/topics/checkout-events")
+	require.Len(t, checkout, 1)
+	assert.Equal(t, []byte("trace1"), checkout[0].Key)
+	var ev kafkaEvent
+	require.NoError(t, json.Unmarshal(checkout[0].Value, &ev))
+	assert.Equal(t, kafkaEvent{Time: ts, Dataset: "checkout", SampleRate: 2, Data: map[string]interface{}{"a": "b"}}, ev)
+
+	frontend := proxy.topic("/topics/events")
+	require.Len(t, frontend, 1)
+	assert.Nil(t, frontend[0].Key)
+}
+
+func TestKafkaTransmissionInstead(t *testing.T) {
+	proxy := &kafkaProxy{records: make(map[string][]kafkaProduceRecord)}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	k, upstream := newTestKafkaTransmission(t, config.KafkaOutputConfig{
+		Mode:         "instead",
+		RESTURLs:     []string{server.URL},
+		Topic:        "events",
+		Encoding:     "msgpack",
+		BatchSize:    2,
+		BatchTimeout: config.Duration(time.Hour),
+		QueueSize:    100,
+	})
+	for i := 0; i < 2; i++ {
+		k.EnqueueEvent(&types.Event{Dataset: "d", Data: map[string]interface{}{"i": i}})
+	}
+	// a full batch is sent without a flush
+	require.Eventually(t, func() bool { return len(proxy.topic("/topics/events")) == 2 }, time.Second, 10*time.Millisecond)
+	var ev kafkaEvent
+	require.NoError(t, msgpack.Unmarshal(proxy.topic("/topics/events")[1].Value, &ev))
+	assert.EqualValues(t, 1, ev.Data["i"])
+	upstream.Mux.RLock()
+	assert.Empty(t, upstream.Events)
+	upstream.Mux.RUnlock()
+}
+
+func TestKafkaOTLPEncoding(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	value, err := encodeKafkaEvent(&types.Event{
+		Dataset:   "checkout",
+		Timestamp: ts,
+		Data: map[string]interface{}{
+			"trace.trace_id":  "0102030405060708090a0b0c0d0e0f10",
+			"trace.span_id":   "0102030405060708",
+			"trace.parent_id": "not-hex",
+			"name":            "GET /cart",
+			"duration_ms":     float64(2.5),
+			"http.status":     int64(200),
+			"tags":            []interface{}{"a", "b"},
+		},
+	}, "otlp")
+	require.NoError(t, err)
+
+	var req collectortrace.ExportTraceServiceRequest
+	require.NoError(t, proto.Unmarshal(value, &req))
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "checkout", rs.Resource.Attributes[0].Value.GetStringValue())
+	span := rs.ScopeSpans[0].Spans[0]
+	assert.Equal(t, "GET /cart", span.Name)
+	assert.Len(t, span.TraceId, 16)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, span.SpanId)
+	assert.Empty(t, span.ParentSpanId)
+	assert.Equal(t, uint64(ts.UnixNano()), span.StartTimeUnixNano)
+	assert.Equal(t, uint64(2500*time.Microsecond), span.EndTimeUnixNano-span.StartTimeUnixNano)
+
+	attrs := make(map[string]string)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value.String()
+	}
+	assert.Len(t, attrs, 3)
+	assert.Contains(t, attrs["trace.parent_id"], "not-hex")
+	assert.Contains(t, attrs["http.status"], "200")
+	assert.Contains(t, attrs["tags"], `[\"a\",\"b\"]`)
+}
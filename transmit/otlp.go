@@ -0,0 +1,232 @@
+package transmit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/supervisor"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+const (
+	counterOTLPSent       = "otlp_upstream_sent"
+	counterOTLPSendErrors = "otlp_upstream_send_errors"
+)
+
+var _ Transmission = &OTLPTransmission{}
+
+// OTLPTransmission sends kept spans upstream as OTLP, over gRPC or HTTP,
+// instead of to the Honeycomb events API. Spans are queued and sent in
+// batches by a background goroutine, one batch for each API key and
+// dataset, since those are sent as headers.
+type OTLPTransmission struct {
+	Config     config.Config          `inject:""`
+	Logger     logger.Logger          `inject:""`
+	Metrics    metrics.Metrics        `inject:"genericMetrics"`
+	Supervisor *supervisor.Supervisor `inject:""`
+	Client     *http.Client
+
+	cfg      config.OTLPUpstreamConfig
+	endpoint *url.URL
+	conn     *grpc.ClientConn
+	traces   collectortrace.TraceServiceClient
+	batches  *batcher[*types.Event]
+}
+
+func (o *OTLPTransmission) Start() error {
+	o.cfg = o.Config.GetOTLPUpstreamConfig()
+	endpoint := o.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = o.Config.GetHoneycombAPI()
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid OTLPUpstream.Endpoint %q", endpoint)
+	}
+	o.endpoint = u
+
+	switch o.cfg.Protocol {
+	case "grpc", "":
+		if err := o.dial(); err != nil {
+			return err
+		}
+	case "http":
+		if o.Client == nil {
+			o.Client = &http.Client{Timeout: time.Duration(o.cfg.Timeout)}
+		}
+	default:
+		return fmt.Errorf("unknown OTLPUpstream.Protocol %q", o.cfg.Protocol)
+	}
+
+	o.Metrics.Register(counterOTLPSent, "counter")
+	o.Metrics.Register(counterOTLPSendErrors, "counter")
+
+	o.batches = newBatcher(o.cfg.QueueSize, o.cfg.BatchSize, time.Duration(o.cfg.BatchTimeout), o.send)
+	o.batches.start(o.Supervisor, "otlp_upstream")
+	return nil
+}
+
+// dial sets up the gRPC connection to the endpoint; an http endpoint is
+// connected to without TLS.
+func (o *OTLPTransmission) dial() error {
+	target := o.endpoint.Host
+	creds := credentials.NewTLS(&tls.Config{})
+	defaultPort := "443"
+	if o.endpoint.Scheme == "http" {
+		creds = insecure.NewCredentials()
+		defaultPort = "80"
+	}
+	if o.endpoint.Port() == "" {
+		target = net.JoinHostPort(o.endpoint.Hostname(), defaultPort)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if o.cfg.Compression == "gzip" {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(grpcgzip.Name)))
+	}
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return fmt.Errorf("connecting to OTLP upstream %s: %w", target, err)
+	}
+	o.conn = conn
+	o.traces = collectortrace.NewTraceServiceClient(conn)
+	return nil
+}
+
+func (o *OTLPTransmission) Stop() error {
+	if o.batches != nil {
+		o.batches.stop()
+	}
+	if o.conn != nil {
+		return o.conn.Close()
+	}
+	return nil
+}
+
+func (o *OTLPTransmission) EnqueueEvent(ev *types.Event) {
+	o.batches.add(ev.APIKey+"\x00"+ev.Dataset, ev)
+}
+
+func (o *OTLPTransmission) EnqueueSpan(sp *types.Span) {
+	o.EnqueueEvent(&sp.Event)
+}
+
+// Flush sends all of the queued spans, and waits until they're sent.
+func (o *OTLPTransmission) Flush() {
+	if o.batches != nil {
+		o.batches.flushAndWait()
+	}
+}
+
+// send sends a batch of events with the same API key and dataset.
+func (o *OTLPTransmission) send(key string, batch []*types.Event) {
+	apiKey, dataset, _ := strings.Cut(key, "\x00")
+	headers := make(map[string]string, len(o.cfg.Headers)+2)
+	if apiKey != "" {
+		headers["x-honeycomb-team"] = apiKey
+	}
+	if dataset != "" {
+		headers["x-honeycomb-dataset"] = dataset
+	}
+	for k, v := range o.cfg.Headers {
+		headers[strings.ToLower(k)] = v
+	}
+
+	req := otlpRequestForEvents(batch)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.cfg.Timeout))
+	defer cancel()
+	var rejected int64
+	var err error
+	if o.traces != nil {
+		rejected, err = o.sendGRPC(ctx, req, headers)
+	} else {
+		rejected, err = o.sendHTTP(ctx, req, headers)
+	}
+	if err != nil {
+		o.Logger.Error().WithString("dataset", dataset).WithField("events", len(batch)).WithString("error", err.Error()).Logf("failed to send spans to OTLP upstream")
+		o.Metrics.Count(counterOTLPSendErrors, len(batch))
+		return
+	}
+	if rejected > 0 {
+		o.Logger.Error().WithString("dataset", dataset).WithField("events", rejected).Logf("OTLP upstream rejected some spans")
+	}
+	o.Metrics.Count(counterOTLPSent, len(batch)-int(rejected))
+	o.Metrics.Count(counterOTLPSendErrors, rejected)
+}
+
+// sendGRPC sends a request over gRPC, and returns the number of spans that
+// were rejected.
+func (o *OTLPTransmission) sendGRPC(ctx context.Context, req *collectortrace.ExportTraceServiceRequest, headers map[string]string) (int64, error) {
+	ctx = metadata.NewOutgoingContext(ctx, metadata.New(headers))
+	resp, err := o.traces.Export(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetPartialSuccess().GetRejectedSpans(), nil
+}
+
+// sendHTTP sends a request over HTTP as protobuf, and returns the number of
+// spans that were rejected.
+func (o *OTLPTransmission) sendHTTP(ctx context.Context, req *collectortrace.ExportTraceServiceRequest, headers map[string]string) (int64, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	if o.cfg.Compression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return 0, err
+		}
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+		body = buf.Bytes()
+		headers["content-encoding"] = "gzip"
+	}
+
+	target := strings.TrimSuffix(o.endpoint.String(), "/") + "/v1/traces"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := o.Client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("OTLP upstream returned status %d", resp.StatusCode)
+	}
+	var exported collectortrace.ExportTraceServiceResponse
+	if err := proto.Unmarshal(respBody, &exported); err != nil {
+		// the spans were accepted, even if we can't tell which failed
+		return 0, nil
+	}
+	return exported.GetPartialSuccess().GetRejectedSpans(), nil
+}
@@ -0,0 +1,393 @@
+package transmit
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"github.com/honeycombio/refinery/types"
+)
+
+// otlpSampleRateField is the attribute that OTLP receivers such as
+// Honeycomb read a span's sample rate from.
+const otlpSampleRateField = "SampleRate"
+
+var otlpSpanKinds = map[string]tracev1.Span_SpanKind{
+	"client":   tracev1.Span_SPAN_KIND_CLIENT,
+	"server":   tracev1.Span_SPAN_KIND_SERVER,
+	"producer": tracev1.Span_SPAN_KIND_PRODUCER,
+	"consumer": tracev1.Span_SPAN_KIND_CONSUMER,
+	"internal": tracev1.Span_SPAN_KIND_INTERNAL,
+}
+
+// otlpBuilder rebuilds the resources, scopes and spans of OTLP spans that
+// were translated into events.
+type otlpBuilder struct {
+	resourceSpans []*tracev1.ResourceSpans
+	// resources and scopes are keyed by their attributes
+	resources map[string]*tracev1.ResourceSpans
+	scopes    map[string]*tracev1.ScopeSpans
+	// spans are keyed by trace and span ID, for their events and links
+	spans map[string]*tracev1.Span
+}
+
+// otlpRequestForEvents turns events back into OTLP spans. Spans that
+// arrived as OTLP get back the resource and scope they arrived with. Span
+// events and links are added to their span if it's one of the events, and
+// sent as spans of their own otherwise.
+func otlpRequestForEvents(events []*types.Event) *collectortrace.ExportTraceServiceRequest {
+	b := &otlpBuilder{
+		resources: make(map[string]*tracev1.ResourceSpans),
+		scopes:    make(map[string]*tracev1.ScopeSpans),
+		spans:     make(map[string]*tracev1.Span),
+	}
+	var annotations []*types.Event
+	for _, ev := range events {
+		switch ev.Data["meta.annotation_type"] {
+		case "span_event", "link":
+			annotations = append(annotations, ev)
+		default:
+			b.addSpan(ev)
+		}
+	}
+	for _, ev := range annotations {
+		b.addAnnotation(ev)
+	}
+	return &collectortrace.ExportTraceServiceRequest{ResourceSpans: b.resourceSpans}
+}
+
+func (b *otlpBuilder) addSpan(ev *types.Event) {
+	res, scope, fields := splitOTLPFields(ev)
+	span := &tracev1.Span{}
+	setOTLPTimes(span, ev.Timestamp, fields)
+	// statusSet is true if the span's status code was recorded
+	var statusSet bool
+	for k, v := range fields {
+		switch k {
+		case "trace.trace_id":
+			if id, ok := decodeOTLPTraceID(v); ok {
+				span.TraceId = id
+				continue
+			}
+		case "trace.span_id":
+			if id, ok := decodeOTLPID(v, 8); ok {
+				span.SpanId = id
+				continue
+			}
+		case "trace.parent_id":
+			if id, ok := decodeOTLPID(v, 8); ok {
+				span.ParentSpanId = id
+				continue
+			}
+		case "name":
+			if name, ok := v.(string); ok {
+				span.Name = name
+				continue
+			}
+		case "span.kind":
+			if kind, ok := otlpSpanKinds[fmt.Sprint(v)]; ok || v == "unspecified" {
+				span.Kind = kind
+				continue
+			}
+		case "type":
+			// a copy of the span kind
+			if v == fields["span.kind"] {
+				continue
+			}
+		case "status_code":
+			if code, ok := asFloat(v); ok {
+				if span.Status == nil {
+					span.Status = &tracev1.Status{}
+				}
+				span.Status.Code = tracev1.Status_StatusCode(code)
+				statusSet = true
+				continue
+			}
+		case "status_message":
+			if msg, ok := v.(string); ok {
+				if span.Status == nil {
+					span.Status = &tracev1.Status{}
+				}
+				span.Status.Message = msg
+				continue
+			}
+		case "duration_ms":
+			if _, ok := asFloat(v); ok {
+				continue
+			}
+		case "span.num_links", "span.num_events", "meta.signal_type", "meta.invalid_duration":
+			// these are derived from the span itself
+			continue
+		}
+		span.Attributes = append(span.Attributes, &common.KeyValue{Key: k, Value: otlpValue(v)})
+	}
+	// error is derived from the status, unless the event has no status
+	if statusSet {
+		span.Attributes = removeAttribute(span.Attributes, "error")
+	} else if fields["error"] == true {
+		span.Status = &tracev1.Status{Code: tracev1.Status_STATUS_CODE_ERROR}
+		span.Attributes = removeAttribute(span.Attributes, "error")
+	}
+	sortAttributes(span.Attributes)
+
+	ss := b.scopeSpans(res, scope)
+	ss.Spans = append(ss.Spans, span)
+	if span.TraceId != nil && span.SpanId != nil {
+		b.spans[string(span.TraceId)+string(span.SpanId)] = span
+	}
+}
+
+// addAnnotation adds a span event or link to its span, or adds it as a span
+// of its own if its span isn't being sent with it.
+func (b *otlpBuilder) addAnnotation(ev *types.Event) {
+	traceID, _ := decodeOTLPTraceID(ev.Data["trace.trace_id"])
+	parentID, _ := decodeOTLPID(ev.Data["trace.parent_id"], 8)
+	span := b.spans[string(traceID)+string(parentID)]
+	if traceID == nil || parentID == nil || span == nil {
+		b.addSpan(ev)
+		return
+	}
+
+	_, _, fields := splitOTLPFields(ev)
+	var attrs []*common.KeyValue
+	for k, v := range fields {
+		switch k {
+		case "trace.trace_id", "trace.parent_id", "parent_name", "meta.annotation_type", "meta.signal_type", "error", otlpSampleRateField:
+			// these come from the span
+			continue
+		}
+		attrs = append(attrs, &common.KeyValue{Key: k, Value: otlpValue(v)})
+	}
+
+	if ev.Data["meta.annotation_type"] == "link" {
+		link := &tracev1.Span_Link{}
+		link.TraceId, _ = decodeOTLPTraceID(fields["trace.link.trace_id"])
+		link.SpanId, _ = decodeOTLPID(fields["trace.link.span_id"], 8)
+		attrs = removeAttribute(attrs, "trace.link.trace_id")
+		link.Attributes = sortAttributes(removeAttribute(attrs, "trace.link.span_id"))
+		span.Links = append(span.Links, link)
+		return
+	}
+	name, _ := fields["name"].(string)
+	span.Events = append(span.Events, &tracev1.Span_Event{
+		TimeUnixNano: uint64(ev.Timestamp.UnixNano()),
+		Name:         name,
+		Attributes:   sortAttributes(removeAttribute(attrs, "name")),
+	})
+}
+
+// scopeSpans returns the scope spans for a resource and scope, adding them
+// if they're new.
+func (b *otlpBuilder) scopeSpans(res []*common.KeyValue, scope *common.InstrumentationScope) *tracev1.ScopeSpans {
+	resKey := attributesKey(res)
+	rs, ok := b.resources[resKey]
+	if !ok {
+		rs = &tracev1.ResourceSpans{Resource: &resource.Resource{Attributes: res}}
+		b.resources[resKey] = rs
+		b.resourceSpans = append(b.resourceSpans, rs)
+	}
+
+	scopeKey := resKey
+	if scope != nil {
+		scopeKey += "\x00" + scope.Name + "\x00" + scope.Version + "\x00" + attributesKey(scope.Attributes)
+	}
+	ss, ok := b.scopes[scopeKey]
+	if !ok {
+		ss = &tracev1.ScopeSpans{Scope: scope}
+		b.scopes[scopeKey] = ss
+		rs.ScopeSpans = append(rs.ScopeSpans, ss)
+	}
+	return ss
+}
+
+// splitOTLPFields splits an event's fields into the attributes of its
+// resource, its scope, and the rest of its fields. An event whose resource
+// wasn't recorded gets one with the service name of its service.name field,
+// or its dataset.
+func splitOTLPFields(ev *types.Event) ([]*common.KeyValue, *common.InstrumentationScope, map[string]interface{}) {
+	fields := make(map[string]interface{}, len(ev.Data)+1)
+	for k, v := range ev.Data {
+		fields[k] = v
+	}
+	resourceNames, hasResource := recordedFieldNames(fields, types.OTLPResourceFieldsField)
+	scopeNames, hasScope := recordedFieldNames(fields, types.OTLPScopeFieldsField)
+
+	// the sample rate that Refinery decided on replaces the span's own
+	if ev.SampleRate > 1 {
+		delete(fields, "sampleRate")
+		fields[otlpSampleRateField] = int64(ev.SampleRate)
+	}
+
+	var res []*common.KeyValue
+	if !hasResource {
+		serviceName, ok := fields["service.name"].(string)
+		if !ok {
+			serviceName = ev.Dataset
+		}
+		delete(fields, "service.name")
+		resourceNames = nil
+		res = append(res, &common.KeyValue{Key: "service.name", Value: otlpValue(serviceName)})
+	}
+	res = append(res, takeAttributes(fields, resourceNames)...)
+	sortAttributes(res)
+
+	var scope *common.InstrumentationScope
+	if hasScope {
+		scope = &common.InstrumentationScope{}
+		scope.Name, _ = fields["library.name"].(string)
+		scope.Version, _ = fields["library.version"].(string)
+		delete(fields, "library.name")
+		delete(fields, "library.version")
+		delete(fields, "telemetry.instrumentation_library")
+		scope.Attributes = sortAttributes(takeAttributes(fields, scopeNames))
+	}
+	return res, scope, fields
+}
+
+// recordedFieldNames removes the field holding the names of a resource's or
+// scope's fields, and returns the names.
+func recordedFieldNames(fields map[string]interface{}, field string) ([]string, bool) {
+	v, ok := fields[field]
+	if !ok {
+		return nil, false
+	}
+	delete(fields, field)
+	var names []string
+	s, _ := v.(string)
+	if err := json.Unmarshal([]byte(s), &names); err != nil {
+		return nil, false
+	}
+	return names, true
+}
+
+// takeAttributes removes the named fields, and returns them as attributes.
+func takeAttributes(fields map[string]interface{}, names []string) []*common.KeyValue {
+	var attrs []*common.KeyValue
+	for _, name := range names {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		delete(fields, name)
+		attrs = append(attrs, &common.KeyValue{Key: name, Value: otlpValue(v)})
+	}
+	return attrs
+}
+
+func setOTLPTimes(span *tracev1.Span, start time.Time, fields map[string]interface{}) {
+	span.StartTimeUnixNano = uint64(start.UnixNano())
+	span.EndTimeUnixNano = span.StartTimeUnixNano
+	if ms, ok := asFloat(fields["duration_ms"]); ok && ms > 0 {
+		span.EndTimeUnixNano += uint64(ms * float64(time.Millisecond))
+	}
+}
+
+func removeAttribute(attrs []*common.KeyValue, key string) []*common.KeyValue {
+	for i, kv := range attrs {
+		if kv.Key == key {
+			return append(attrs[:i], attrs[i+1:]...)
+		}
+	}
+	return attrs
+}
+
+func sortAttributes(attrs []*common.KeyValue) []*common.KeyValue {
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+// attributesKey returns a key that's the same for equal sets of sorted
+// attributes.
+func attributesKey(attrs []*common.KeyValue) string {
+	var key []byte
+	for _, kv := range attrs {
+		key = append(key, kv.Key...)
+		key = append(key, 0)
+		key = append(key, kv.Value.String()...)
+		key = append(key, 0)
+	}
+	return string(key)
+}
+
+// decodeOTLPTraceID decodes a hex trace ID, padding the 64-bit IDs that
+// Refinery shortens 128-bit IDs with leading zeros to.
+func decodeOTLPTraceID(v any) ([]byte, bool) {
+	if id, ok := decodeOTLPID(v, 16); ok {
+		return id, true
+	}
+	id, ok := decodeOTLPID(v, 8)
+	if !ok {
+		return nil, false
+	}
+	return append(make([]byte, 8, 16), id...), true
+}
+
+// decodeOTLPID decodes a hex trace or span ID of the given length in bytes.
+func decodeOTLPID(v any, size int) ([]byte, bool) {
+	s, ok := v.(string)
+	if !ok || len(s) != 2*size {
+		return nil, false
+	}
+	id, err := hex.DecodeString(s)
+	return id, err == nil
+}
+
+// otlpValue converts a field's value to an OTLP attribute value; values
+// without an OTLP equivalent are encoded as JSON strings.
+func otlpValue(v any) *common.AnyValue {
+	switch val := v.(type) {
+	case string:
+		return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: val}}
+	case bool:
+		return &common.AnyValue{Value: &common.AnyValue_BoolValue{BoolValue: val}}
+	case int:
+		return &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: int64(val)}}
+	case int64:
+		return &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: val}}
+	case int32:
+		return &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: int64(val)}}
+	case uint64:
+		return &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: int64(val)}}
+	case uint32:
+		return &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: int64(val)}}
+	case float64:
+		return &common.AnyValue{Value: &common.AnyValue_DoubleValue{DoubleValue: val}}
+	case float32:
+		return &common.AnyValue{Value: &common.AnyValue_DoubleValue{DoubleValue: float64(val)}}
+	case []byte:
+		return &common.AnyValue{Value: &common.AnyValue_BytesValue{BytesValue: val}}
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded = []byte(fmt.Sprint(v))
+	}
+	return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: string(encoded)}}
+}
+
+// asFloat returns a numeric field's value as a float64.
+func asFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,259 @@
+package transmit
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	huskyotlp "github.com/honeycombio/husky/otlp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/logger"
+	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
+)
+
+func otlpString(s string) *common.AnyValue {
+	return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: s}}
+}
+
+// otlpNames is the attribute the router records the names of a resource's
+// or scope's attributes in.
+func otlpNames(key string, names ...string) *common.KeyValue {
+	encoded, _ := json.Marshal(names)
+	return &common.KeyValue{Key: key, Value: otlpString(string(encoded))}
+}
+
+// otlpTestEvents translates a request into events, the way the router does
+// when OTLP structure is being preserved.
+func otlpTestEvents(t *testing.T) []*types.Event {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	req := &collectortrace.ExportTraceServiceRequest{
+		ResourceSpans: []*tracev1.ResourceSpans{{
+			Resource: &resource.Resource{Attributes: []*common.KeyValue{
+				{Key: "service.name", Value: otlpString("checkout")},
+				{Key: "host.name", Value: otlpString("web-1")},
+				otlpNames(types.OTLPResourceFieldsField, "service.name", "host.name"),
+			}},
+			ScopeSpans: []*tracev1.ScopeSpans{{
+				Scope: &common.InstrumentationScope{
+					Name:    "net/http",
+					Version: "1.2.3",
+					Attributes: []*common.KeyValue{
+						{Key: "scope.flavor", Value: otlpString("vanilla")},
+						otlpNames(types.OTLPScopeFieldsField, "scope.flavor"),
+					},
+				},
+				Spans: []*tracev1.Span{{
+					TraceId:           []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+					SpanId:            []byte{1, 2, 3, 4, 5, 6, 7, 8},
+					Name:              "GET /cart",
+					Kind:              tracev1.Span_SPAN_KIND_SERVER,
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					EndTimeUnixNano:   uint64(start.Add(5 * time.Millisecond).UnixNano()),
+					Attributes:        []*common.KeyValue{{Key: "http.route", Value: otlpString("/cart")}},
+					Status:            &tracev1.Status{Code: tracev1.Status_STATUS_CODE_ERROR, Message: "boom"},
+					Events: []*tracev1.Span_Event{{
+						TimeUnixNano: uint64(start.Add(time.Millisecond).UnixNano()),
+						Name:         "exception",
+						Attributes:   []*common.KeyValue{{Key: "exception.message", Value: otlpString("boom")}},
+					}},
+					Links: []*tracev1.Span_Link{{
+						TraceId: []byte{9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9},
+						SpanId:  []byte{9, 9, 9, 9, 9, 9, 9, 9},
+					}},
+				}},
+			}},
+		}},
+	}
+	ri := huskyotlp.RequestInfo{ApiKey: "abc123DEF456ghi789jklm", Dataset: "ds", ContentType: "application/protobuf"}
+	result, err := huskyotlp.TranslateTraceRequest(context.Background(), req, ri)
+	require.NoError(t, err)
+
+	var events []*types.Event
+	for _, batch := range result.Batches {
+		for _, ev := range batch.Events {
+			events = append(events, &types.Event{
+				Dataset:    batch.Dataset,
+				APIKey:     ri.ApiKey,
+				Timestamp:  ev.Timestamp,
+				SampleRate: 10,
+				Data:       ev.Attributes,
+			})
+		}
+	}
+	require.Len(t, events, 3)
+	return events
+}
+
+func otlpAttributes(attrs []*common.KeyValue) map[string]*common.AnyValue {
+	m := make(map[string]*common.AnyValue, len(attrs))
+	for _, kv := range attrs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func checkOTLPTestRequest(t *testing.T, req *collectortrace.ExportTraceServiceRequest) {
+	require.Len(t, req.ResourceSpans, 1)
+	rs := req.ResourceSpans[0]
+	res := otlpAttributes(rs.Resource.Attributes)
+	assert.Len(t, res, 2)
+	assert.Equal(t, "checkout", res["service.name"].GetStringValue())
+	assert.Equal(t, "web-1", res["host.name"].GetStringValue())
+
+	require.Len(t, rs.ScopeSpans, 1)
+	scope := rs.ScopeSpans[0].Scope
+	require.NotNil(t, scope)
+	assert.Equal(t, "net/http", scope.Name)
+	assert.Equal(t, "1.2.3", scope.Version)
+	require.Len(t, scope.Attributes, 1)
+	assert.Equal(t, "vanilla", scope.Attributes[0].Value.GetStringValue())
+
+	require.Len(t, rs.ScopeSpans[0].Spans, 1)
+	span := rs.ScopeSpans[0].Spans[0]
+	assert.Equal(t, "GET /cart", span.Name)
+	assert.Equal(t, tracev1.Span_SPAN_KIND_SERVER, span.Kind)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, span.SpanId)
+	assert.Len(t, span.TraceId, 16)
+	assert.Equal(t, uint64(5*time.Millisecond), span.EndTimeUnixNano-span.StartTimeUnixNano)
+	assert.Equal(t, tracev1.Status_STATUS_CODE_ERROR, span.Status.Code)
+	assert.Equal(t, "boom", span.Status.Message)
+
+	attrs := otlpAttributes(span.Attributes)
+	assert.Equal(t, "/cart", attrs["http.route"].GetStringValue())
+	assert.Equal(t, int64(10), attrs["SampleRate"].GetIntValue())
+	assert.NotContains(t, attrs, "service.name")
+	assert.NotContains(t, attrs, "library.name")
+	assert.NotContains(t, attrs, types.OTLPResourceFieldsField)
+
+	require.Len(t, span.Events, 1)
+	assert.Equal(t, "exception", span.Events[0].Name)
+	assert.Equal(t, "boom", otlpAttributes(span.Events[0].Attributes)["exception.message"].GetStringValue())
+	require.Len(t, span.Links, 1)
+	assert.Equal(t, []byte{9, 9, 9, 9, 9, 9, 9, 9}, span.Links[0].SpanId)
+}
+
+func TestOTLPRequestForEvents(t *testing.T) {
+	checkOTLPTestRequest(t, otlpRequestForEvents(otlpTestEvents(t)))
+}
+
+func newTestOTLPTransmission(t *testing.T, cfg config.OTLPUpstreamConfig) *OTLPTransmission {
+	cfg.Enabled = true
+	cfg.Timeout = config.Duration(5 * time.Second)
+	cfg.BatchSize = 100
+	cfg.BatchTimeout = config.Duration(time.Hour)
+	cfg.QueueSize = 100
+	o := &OTLPTransmission{
+		Config:  &config.MockConfig{OTLPUpstream: cfg},
+		Logger:  &logger.NullLogger{},
+		Metrics: &metrics.NullMetrics{},
+	}
+	require.NoError(t, o.Start())
+	t.Cleanup(func() { o.Stop() })
+	return o
+}
+
+func TestOTLPTransmissionHTTP(t *testing.T) {
+	var mut sync.Mutex
+	var received []*collectortrace.ExportTraceServiceRequest
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		req := &collectortrace.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		mut.Lock()
+		received = append(received, req)
+		headers = append(headers, r.Header)
+		mut.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	o := newTestOTLPTransmission(t, config.OTLPUpstreamConfig{
+		Endpoint:    server.URL,
+		Protocol:    "http",
+		Compression: "gzip",
+		Headers:     map[string]string{"X-Extra": "yes"},
+	})
+	for _, ev := range otlpTestEvents(t) {
+		o.EnqueueEvent(ev)
+	}
+	o.Flush()
+
+	mut.Lock()
+	defer mut.Unlock()
+	require.Len(t, received, 1)
+	checkOTLPTestRequest(t, received[0])
+	assert.Equal(t, "abc123DEF456ghi789jklm", headers[0].Get("x-honeycomb-team"))
+	assert.Equal(t, "checkout", headers[0].Get("x-honeycomb-dataset"))
+	assert.Equal(t, "yes", headers[0].Get("x-extra"))
+}
+
+// traceServer records the requests sent to a fake OTLP gRPC receiver.
+type traceServer struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mut      sync.Mutex
+	received []*collectortrace.ExportTraceServiceRequest
+	metadata []metadata.MD
+}
+
+func (s *traceServer) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.received = append(s.received, req)
+	s.metadata = append(s.metadata, md)
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func TestOTLPTransmissionGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	receiver := &traceServer{}
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, receiver)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	o := newTestOTLPTransmission(t, config.OTLPUpstreamConfig{
+		Endpoint:    "http://" + lis.Addr().String(),
+		Protocol:    "grpc",
+		Compression: "gzip",
+	})
+	for _, ev := range otlpTestEvents(t) {
+		o.EnqueueEvent(ev)
+	}
+	o.Flush()
+
+	receiver.mut.Lock()
+	defer receiver.mut.Unlock()
+	require.Len(t, receiver.received, 1)
+	checkOTLPTestRequest(t, receiver.received[0])
+	assert.Equal(t, []string{"abc123DEF456ghi789jklm"}, receiver.metadata[0].Get("x-honeycomb-team"))
+	assert.Equal(t, []string{"checkout"}, receiver.metadata[0].Get("x-honeycomb-dataset"))
+}
@@ -0,0 +1,55 @@
+package transmit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// SnappyFramedEncoding is the Content-Encoding of request bodies compressed
+// with snappy stream framing.
+const SnappyFramedEncoding = "x-snappy-framed"
+
+// snappyTransport compresses the bodies of outgoing requests with snappy
+// stream framing before handing them to the wrapped transport. Requests that
+// are already encoded are passed through untouched.
+type snappyTransport struct {
+	base http.RoundTripper
+}
+
+// NewSnappyTransport returns a RoundTripper that compresses request bodies
+// with snappy stream framing. It's meant for libhoney clients with their own
+// compression disabled, since libhoney only knows how to use zstd.
+func NewSnappyTransport(base http.RoundTripper) http.RoundTripper {
+	return &snappyTransport{base: base}
+}
+
+func (t *snappyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	buf := &bytes.Buffer{}
+	w := s2.NewWriter(buf, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+	_, err := io.Copy(w, req.Body)
+	req.Body.Close()
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a RoundTripper must not modify the request it was given
+	compressed := buf.Bytes()
+	newReq := req.Clone(req.Context())
+	newReq.Body = io.NopCloser(bytes.NewReader(compressed))
+	newReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	newReq.ContentLength = int64(len(compressed))
+	newReq.Header.Set("Content-Encoding", SnappyFramedEncoding)
+	return t.base.RoundTrip(newReq)
+}
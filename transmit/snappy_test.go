@@ -0,0 +1,53 @@
+package transmit
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSnappyTransport(t *testing.T) {
+	payload := strings.Repeat(`{"trace.trace_id":"abc123","name":"span"}`, 100)
+
+	var gotEncoding string
+	var gotBody []byte
+	transport := NewSnappyTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		gotEncoding = req.Header.Get("Content-Encoding")
+		body, err := io.ReadAll(s2.NewReader(req.Body))
+		require.NoError(t, err)
+		gotBody = body
+		assert.Less(t, req.ContentLength, int64(len(payload)))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	req, err := http.NewRequest("POST", "http://localhost/1/batch/test", strings.NewReader(payload))
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, SnappyFramedEncoding, gotEncoding)
+	assert.Equal(t, payload, string(gotBody))
+	assert.Empty(t, req.Header.Get("Content-Encoding"), "the original request must not be modified")
+
+	// bodies that are already encoded are left alone
+	req, err = http.NewRequest("POST", "http://localhost/1/batch/test", strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "zstd")
+	transport = NewSnappyTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		gotEncoding = req.Header.Get("Content-Encoding")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+	_, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", gotEncoding)
+}
@@ -2,13 +2,20 @@ package transmit
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	libhoney "github.com/honeycombio/libhoney-go"
 	"github.com/honeycombio/libhoney-go/transmission"
 
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/apikeys"
+	"github.com/honeycombio/refinery/internal/health"
+	"github.com/honeycombio/refinery/internal/supervisor"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
 	"github.com/honeycombio/refinery/types"
@@ -28,6 +35,45 @@ const (
 	counterResponseErrors = "response_errors"
 	updownQueuedItems     = "queued_items"
 	histogramQueueTime    = "queue_time"
+
+	// gaugeResponseErrorFraction is the fraction of sends that failed in
+	// the last health interval
+	gaugeResponseErrorFraction = "response_error_fraction"
+
+	// the disk queue's metrics count events, apart from the gauges of the
+	// batches it holds and the disk space they use
+	counterDiskQueueWritten = "disk_queue_written"
+	counterDiskQueueEvicted = "disk_queue_evicted"
+	counterDiskQueueRetried = "disk_queue_retried"
+	counterDiskQueueDropped = "disk_queue_dropped"
+	gaugeDiskQueueBatches   = "disk_queue_batches"
+	gaugeDiskQueueEvents    = "disk_queue_events"
+	gaugeDiskQueueBytes     = "disk_queue_bytes"
+)
+
+// Failed events are written to the disk queue in batches of up to
+// diskQueueBatchSize events, at least every diskQueueFlushInterval. Each
+// retry sends up to diskQueueMaxRetryBatches batches, one after another.
+const (
+	diskQueueBatchSize       = 1000
+	diskQueueFlushInterval   = time.Second
+	diskQueueMaxRetryBatches = 10
+)
+
+// metadataQueuedEvent is the metadata key that holds an event to be queued
+// on disk if its send fails.
+const metadataQueuedEvent = "queued_event"
+
+// metadataRetryBatch is the metadata key that holds the retryBatch of an
+// event that was read back from the disk queue.
+const metadataRetryBatch = "retry_batch"
+
+// healthInterval is how often the share of failed sends is reported to
+// Health. A transmission is degraded while at least healthDegradedFraction of
+// the sends in an interval fail.
+const (
+	healthInterval         = 10 * time.Second
+	healthDegradedFraction = 0.5
 )
 
 type DefaultTransmission struct {
@@ -36,12 +82,36 @@ type DefaultTransmission struct {
 	Metrics    metrics.Metrics // constructed, not injected
 	Version    string          `inject:"version"`
 	LibhClient *libhoney.Client
+	// KeyQuarantine is told which keys upstream accepts and rejects
+	KeyQuarantine *apikeys.Quarantine `inject:""`
+	Health        health.Recorder     `inject:""`
+	// Supervisor restarts the response handler if it panics
+	Supervisor *supervisor.Supervisor `inject:""`
 
 	// Type is peer or upstream, and used only for naming metrics
 	Name string
+	// QueueSubdirectory is the subdirectory of the upstream queue's
+	// directory that this transmission queues failed sends in, so that
+	// transmissions to different destinations don't share a queue
+	QueueSubdirectory string
 
 	builder          *libhoney.Builder
 	responseCanceler context.CancelFunc
+
+	// responses and failures count the sends since the last health report
+	responses atomic.Int64
+	failures  atomic.Int64
+	// responsesWG waits for the response handler to stop
+	responsesWG sync.WaitGroup
+
+	// queue holds the events whose sends failed until they can be sent
+	// again; it's nil unless the upstream queue is enabled
+	queue *diskQueue
+	// pending are failed events that haven't been written to the queue yet
+	pendingMut    sync.Mutex
+	pending       []queuedEvent
+	queueCanceler context.CancelFunc
+	queueWG       sync.WaitGroup
 }
 
 var once sync.Once
@@ -69,10 +139,20 @@ func (d *DefaultTransmission) Start() error {
 	d.Metrics.Register(counterResponseErrors, "counter")
 	d.Metrics.Register(updownQueuedItems, "updown")
 	d.Metrics.Register(histogramQueueTime, "histogram")
+	d.Metrics.Register(gaugeResponseErrorFraction, "gauge")
+
+	if err := d.startQueue(); err != nil {
+		return err
+	}
 
 	processCtx, canceler := context.WithCancel(context.Background())
 	d.responseCanceler = canceler
-	go d.processResponses(processCtx, d.LibhClient.TxResponses())
+	responses := d.LibhClient.TxResponses()
+	d.goSupervised(&d.responsesWG, d.Name+"_transmission_responses", func() { d.processResponses(processCtx, responses) })
+	if d.Health != nil {
+		d.Health.Register(d.healthSource(), 5*healthInterval)
+		go d.reportHealth(processCtx)
+	}
 
 	// listen for config reloads
 	d.Config.RegisterReloadCallback(d.reloadTransmissionBuilder)
@@ -87,6 +167,12 @@ func (d *DefaultTransmission) reloadTransmissionBuilder() {
 }
 
 func (d *DefaultTransmission) EnqueueEvent(ev *types.Event) {
+	d.enqueue(ev, nil)
+}
+
+// enqueue hands an event to libhoney. If the event is being sent again from
+// the disk queue, retry is the batch it was read in.
+func (d *DefaultTransmission) enqueue(ev *types.Event, retry *retryBatch) {
 	d.Logger.Debug().
 		WithField("request_id", ev.Context.Value(types.RequestIDContextKey{})).
 		WithString("api_host", ev.APIHost).
@@ -104,6 +190,7 @@ func (d *DefaultTransmission) EnqueueEvent(ev *types.Event) {
 		"dataset":     ev.Dataset,
 		"environment": ev.Environment,
 		"enqueued_at": time.Now().UnixMicro(),
+		"api_key":     ev.APIKey,
 	}
 
 	for _, k := range d.Config.GetAdditionalErrorFields() {
@@ -111,6 +198,13 @@ func (d *DefaultTransmission) EnqueueEvent(ev *types.Event) {
 			metadata[k] = v
 		}
 	}
+	// the event is kept so that it can be queued on disk if its send fails
+	if d.queue != nil {
+		metadata[metadataQueuedEvent] = newQueuedEvent(ev)
+	}
+	if retry != nil {
+		metadata[metadataRetryBatch] = retry
+	}
 	libhEv.Metadata = metadata
 
 	for k, v := range ev.Data {
@@ -127,6 +221,10 @@ func (d *DefaultTransmission) EnqueueEvent(ev *types.Event) {
 			WithString("api_host", ev.APIHost).
 			WithString("environment", ev.Environment).
 			Logf("failed to enqueue event")
+		// there won't be a response to wait for
+		if retry != nil {
+			retry.responded(false)
+		}
 	}
 	d.Metrics.Up(updownQueuedItems)
 }
@@ -141,15 +239,42 @@ func (d *DefaultTransmission) Flush() {
 }
 
 func (d *DefaultTransmission) Stop() error {
-	// signal processResponses to stop
-	if d.responseCanceler != nil {
-		d.responseCanceler()
+	// stop sending queued events again before the final flush
+	if d.queueCanceler != nil {
+		d.queueCanceler()
+		d.queueWG.Wait()
+	}
+	if d.Health != nil {
+		d.Health.Unregister(d.healthSource())
 	}
 	// purge the queue of any in-flight events
 	d.LibhClient.Flush()
+	// signal processResponses to stop once it has handled the responses to
+	// the flushed events
+	if d.responseCanceler != nil {
+		d.responseCanceler()
+		d.responsesWG.Wait()
+	}
+	// anything that failed is written to disk, to be sent after a restart
+	if d.queue != nil {
+		d.flushPending()
+	}
 	return nil
 }
 
+// goSupervised runs fn under the supervisor in a new goroutine, which wg
+// waits for.
+func (d *DefaultTransmission) goSupervised(wg *sync.WaitGroup, subsystem string, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = d.Supervisor.Wrap(subsystem, func() error {
+			fn()
+			return nil
+		})()
+	}()
+}
+
 func (d *DefaultTransmission) processResponses(
 	ctx context.Context,
 	responses chan transmission.Response,
@@ -157,44 +282,315 @@ func (d *DefaultTransmission) processResponses(
 	for {
 		select {
 		case r := <-responses:
-			var enqueuedAt, dequeuedAt int64
-			if r.Err != nil || r.StatusCode > 202 {
-				var apiHost, dataset, environment string
-				if metadata, ok := r.Metadata.(map[string]any); ok {
-					apiHost = metadata["api_host"].(string)
-					dataset = metadata["dataset"].(string)
-					environment = metadata["environment"].(string)
-					enqueuedAt = metadata["enqueued_at"].(int64)
-					dequeuedAt = time.Now().UnixMicro()
-				}
-				log := d.Logger.Error().WithFields(map[string]interface{}{
-					"status_code":    r.StatusCode,
-					"api_host":       apiHost,
-					"dataset":        dataset,
-					"environment":    environment,
-					"roundtrip_usec": dequeuedAt - enqueuedAt,
-				})
-				for _, k := range d.Config.GetAdditionalErrorFields() {
-					if v, ok := r.Metadata.(map[string]any)[k]; ok {
-						log = log.WithField(k, v)
-					}
-				}
-				if r.Err != nil {
-					log = log.WithField("error", r.Err.Error())
+			d.handleResponse(r)
+		case <-ctx.Done():
+			// handle the responses that are already waiting
+			for {
+				select {
+				case r := <-responses:
+					d.handleResponse(r)
+				default:
+					return
 				}
-				log.Logf("error when sending event")
-				d.Metrics.Increment(counterResponseErrors)
-			} else {
-				if metadata, ok := r.Metadata.(map[string]any); ok {
-					enqueuedAt = metadata["enqueued_at"].(int64)
-					dequeuedAt = time.Now().UnixMicro()
+			}
+		}
+	}
+}
+
+func (d *DefaultTransmission) handleResponse(r transmission.Response) {
+	var enqueuedAt, dequeuedAt int64
+	var queued bool
+	d.recordKeyResponse(r)
+	d.responses.Add(1)
+	if r.Err != nil || r.StatusCode > 202 {
+		d.failures.Add(1)
+		var apiHost, dataset, environment string
+		if metadata, ok := r.Metadata.(map[string]any); ok {
+			apiHost = metadata["api_host"].(string)
+			dataset = metadata["dataset"].(string)
+			environment = metadata["environment"].(string)
+			enqueuedAt = metadata["enqueued_at"].(int64)
+			dequeuedAt = time.Now().UnixMicro()
+		}
+		log := d.Logger.Error().WithFields(map[string]interface{}{
+			"status_code":    r.StatusCode,
+			"api_host":       apiHost,
+			"dataset":        dataset,
+			"environment":    environment,
+			"roundtrip_usec": dequeuedAt - enqueuedAt,
+		})
+		for _, k := range d.Config.GetAdditionalErrorFields() {
+			if v, ok := r.Metadata.(map[string]any)[k]; ok {
+				if k == "api_key" {
+					// the raw key is only in the metadata for the quarantine
+					akc := d.Config.GetAccessKeyConfig()
+					v = apikeys.NewRedactor(akc.KeyRedaction, akc.KeyRedactionSalt).Redact(v.(string))
 				}
-				d.Metrics.Increment(counterResponse20x)
+				log = log.WithField(k, v)
 			}
-			d.Metrics.Down(updownQueuedItems)
-			d.Metrics.Histogram(histogramQueueTime, dequeuedAt-enqueuedAt)
+		}
+		if r.Err != nil {
+			log = log.WithField("error", r.Err.Error())
+		}
+		if queued = d.queueFailed(r); queued {
+			log = log.WithField("queued", true)
+		}
+		log.Logf("error when sending event")
+		d.Metrics.Increment(counterResponseErrors)
+	} else {
+		if metadata, ok := r.Metadata.(map[string]any); ok {
+			enqueuedAt = metadata["enqueued_at"].(int64)
+			dequeuedAt = time.Now().UnixMicro()
+		}
+		d.Metrics.Increment(counterResponse20x)
+	}
+	d.Metrics.Down(updownQueuedItems)
+	d.Metrics.Histogram(histogramQueueTime, dequeuedAt-enqueuedAt)
+	if metadata, ok := r.Metadata.(map[string]any); ok {
+		if retry, ok := metadata[metadataRetryBatch].(*retryBatch); ok {
+			retry.responded(queued)
+		}
+	}
+}
+
+// recordKeyResponse tells the key quarantine whether upstream accepted or
+// rejected the key that the event was sent with.
+func (d *DefaultTransmission) recordKeyResponse(r transmission.Response) {
+	if d.KeyQuarantine == nil {
+		return
+	}
+	metadata, ok := r.Metadata.(map[string]any)
+	if !ok {
+		return
+	}
+	apiKey, _ := metadata["api_key"].(string)
+	switch {
+	case apiKey == "":
+	case r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusForbidden:
+		d.KeyQuarantine.RecordRejection(apiKey)
+	case r.Err == nil && r.StatusCode >= 200 && r.StatusCode <= 202:
+		d.KeyQuarantine.RecordSuccess(apiKey)
+	}
+}
+
+func (d *DefaultTransmission) healthSource() string {
+	return d.Name + "_transmission"
+}
+
+// reportHealth periodically reports the transmission as degraded if many of
+// its sends are failing. Failed sends never make it unready, since no other
+// Refinery could send them either.
+func (d *DefaultTransmission) reportHealth(ctx context.Context) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		d.reportHealthOnce()
+		select {
+		case <-ticker.C:
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+func (d *DefaultTransmission) reportHealthOnce() {
+	responses := d.responses.Swap(0)
+	failures := d.failures.Swap(0)
+	var fraction float64
+	if responses > 0 {
+		fraction = float64(failures) / float64(responses)
+	}
+	d.Metrics.Gauge(gaugeResponseErrorFraction, fraction)
+	if fraction >= healthDegradedFraction {
+		d.Health.Report(d.healthSource(), health.StatusDegraded,
+			fmt.Sprintf("%d of %d sends failed in the last %s", failures, responses, healthInterval))
+		return
+	}
+	d.Health.Ready(d.healthSource(), true)
+}
+
+// startQueue opens the disk queue, if the upstream queue is enabled, and
+// starts sending the batches in it.
+func (d *DefaultTransmission) startQueue() error {
+	cfg := d.Config.GetUpstreamQueueConfig()
+	if !cfg.Enabled {
+		return nil
+	}
+	queue, err := newDiskQueue(filepath.Join(diskQueueDir(cfg.Directory), d.QueueSubdirectory), int64(cfg.MaxSize))
+	if err != nil {
+		return fmt.Errorf("opening upstream queue: %w", err)
+	}
+	d.queue = queue
+
+	d.Metrics.Register(counterDiskQueueWritten, "counter")
+	d.Metrics.Register(counterDiskQueueEvicted, "counter")
+	d.Metrics.Register(counterDiskQueueRetried, "counter")
+	d.Metrics.Register(counterDiskQueueDropped, "counter")
+	d.Metrics.Register(gaugeDiskQueueBatches, "gauge")
+	d.Metrics.Register(gaugeDiskQueueEvents, "gauge")
+	d.Metrics.Register(gaugeDiskQueueBytes, "gauge")
+	d.recordQueueSize()
+
+	batches, events := queue.len()
+	if batches > 0 {
+		d.Logger.Info().WithField("batches", batches).WithField("events", events).Logf("found queued events to send upstream")
+	}
+
+	ctx, canceler := context.WithCancel(context.Background())
+	d.queueCanceler = canceler
+	d.goSupervised(&d.queueWG, d.Name+"_transmission_queue", func() { d.runQueue(ctx, time.Duration(cfg.RetryInterval)) })
+	return nil
+}
+
+// queueFailed holds on to the event of a failed send, to be written to the
+// disk queue, if the upstream queue is enabled and the send might succeed
+// later. It returns true if the event was queued.
+func (d *DefaultTransmission) queueFailed(r transmission.Response) bool {
+	if d.queue == nil {
+		return false
+	}
+	// other client errors will fail again
+	if r.Err == nil && r.StatusCode != http.StatusTooManyRequests && r.StatusCode < 500 {
+		return false
+	}
+	metadata, ok := r.Metadata.(map[string]any)
+	if !ok {
+		return false
+	}
+	qe, ok := metadata[metadataQueuedEvent].(queuedEvent)
+	if !ok {
+		return false
+	}
+
+	d.pendingMut.Lock()
+	d.pending = append(d.pending, qe)
+	var batch []queuedEvent
+	if len(d.pending) >= diskQueueBatchSize {
+		batch = d.pending
+		d.pending = nil
+	}
+	d.pendingMut.Unlock()
+	if batch != nil {
+		d.writeBatch(batch)
+	}
+	return true
+}
+
+// flushPending writes the failed events that are waiting to the disk queue.
+func (d *DefaultTransmission) flushPending() {
+	d.pendingMut.Lock()
+	batch := d.pending
+	d.pending = nil
+	d.pendingMut.Unlock()
+	if len(batch) > 0 {
+		d.writeBatch(batch)
+	}
+}
+
+func (d *DefaultTransmission) writeBatch(batch []queuedEvent) {
+	evicted, err := d.queue.push(batch)
+	if evicted > 0 {
+		d.Logger.Warn().WithField("events", evicted).Logf("upstream queue is full; dropped its oldest events")
+		d.Metrics.Count(counterDiskQueueEvicted, evicted)
+	}
+	if err != nil {
+		d.Logger.Error().WithField("events", len(batch)).WithString("error", err.Error()).Logf("failed to write events to upstream queue")
+		d.Metrics.Count(counterDiskQueueDropped, len(batch))
+	} else {
+		d.Metrics.Count(counterDiskQueueWritten, len(batch))
+	}
+	d.recordQueueSize()
+}
+
+func (d *DefaultTransmission) recordQueueSize() {
+	batches, events := d.queue.len()
+	d.Metrics.Gauge(gaugeDiskQueueBatches, batches)
+	d.Metrics.Gauge(gaugeDiskQueueEvents, events)
+	d.Metrics.Gauge(gaugeDiskQueueBytes, d.queue.size())
+}
+
+// runQueue writes failed events to disk as they build up, and sends the
+// queued batches again every retry interval.
+func (d *DefaultTransmission) runQueue(ctx context.Context, retryInterval time.Duration) {
+	flushTicker := time.NewTicker(diskQueueFlushInterval)
+	defer flushTicker.Stop()
+	retryTicker := time.NewTicker(retryInterval)
+	defer retryTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushTicker.C:
+			d.flushPending()
+		case <-retryTicker.C:
+			d.retryQueued(ctx, retryInterval)
+		}
+	}
+}
+
+// retryQueued sends the oldest queued batches again, one at a time. Before
+// each batch after the first, it waits for the responses to the one before,
+// for up to timeout; if any of them failed and were queued again, upstream
+// hasn't recovered, and the rest of the queue waits for the next retry.
+func (d *DefaultTransmission) retryQueued(ctx context.Context, timeout time.Duration) {
+	defer d.recordQueueSize()
+	for i := 0; i < diskQueueMaxRetryBatches; i++ {
+		events, err := d.queue.pop()
+		if err != nil {
+			d.Logger.Error().WithString("error", err.Error()).Logf("failed to read events from upstream queue")
+			continue
+		}
+		if len(events) == 0 {
+			return
+		}
+		retry := newRetryBatch(len(events))
+		for _, qe := range events {
+			d.enqueue(qe.event(), retry)
+		}
+		d.Metrics.Count(counterDiskQueueRetried, len(events))
+		if !retry.wait(ctx, timeout) {
+			return
+		}
+	}
+}
+
+// retryBatch tracks the responses to a batch of events that's being sent
+// again from the disk queue.
+type retryBatch struct {
+	remaining atomic.Int64
+	requeued  atomic.Bool
+	done      chan struct{}
+}
+
+func newRetryBatch(events int) *retryBatch {
+	b := &retryBatch{done: make(chan struct{})}
+	b.remaining.Store(int64(events))
+	return b
+}
+
+// responded records the response to one of the batch's events, and whether
+// the event was queued again.
+func (b *retryBatch) responded(requeued bool) {
+	if requeued {
+		b.requeued.Store(true)
+	}
+	if b.remaining.Add(-1) == 0 {
+		close(b.done)
+	}
+}
+
+// wait waits for the responses to all of the batch's events, and returns
+// true if none of them were queued again. It returns false if they don't all
+// arrive within timeout, or ctx is done first.
+func (b *retryBatch) wait(ctx context.Context, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-b.done:
+		return !b.requeued.Load()
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,15 +1,24 @@
 package transmit
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/facebookgo/inject"
 	"github.com/honeycombio/refinery/config"
+	"github.com/honeycombio/refinery/internal/health"
 	"github.com/honeycombio/refinery/logger"
 	"github.com/honeycombio/refinery/metrics"
+	"github.com/honeycombio/refinery/types"
 
 	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDefaultTransmissionUpdatesUserAgentAdditionAfterStart(t *testing.T) {
@@ -37,6 +46,8 @@ func TestDependencyInjection(t *testing.T) {
 		&inject.Object{Value: &metrics.NullMetrics{}, Name: "genericMetrics"},
 		&inject.Object{Value: &metrics.NullMetrics{}, Name: "metrics"},
 		&inject.Object{Value: "test", Name: "version"},
+		&inject.Object{Value: clockwork.NewFakeClock()},
+		&inject.Object{Value: &health.Health{}},
 	)
 	if err != nil {
 		t.Error(err)
@@ -45,3 +56,126 @@ func TestDependencyInjection(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func newQueuedTransmission(t *testing.T, dir string) (*DefaultTransmission, *transmission.MockSender) {
+	sender := &transmission.MockSender{}
+	client, err := libhoney.NewClient(libhoney.ClientConfig{APIKey: "key", Transmission: sender})
+	require.NoError(t, err)
+	d := &DefaultTransmission{
+		Config: &config.MockConfig{UpstreamQueue: config.UpstreamQueueConfig{
+			Enabled:       true,
+			Directory:     dir,
+			MaxSize:       1 << 20,
+			RetryInterval: config.Duration(time.Hour),
+		}},
+		Logger:     &logger.NullLogger{},
+		Metrics:    &metrics.NullMetrics{},
+		LibhClient: client,
+		Name:       "upstream",
+	}
+	require.NoError(t, d.Start())
+	return d, sender
+}
+
+func TestFailedSendsAreQueuedOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	d, sender := newQueuedTransmission(t, dir)
+
+	for _, dataset := range []string{"unreachable", "rejected", "sent"} {
+		d.EnqueueEvent(&types.Event{
+			Context: context.Background(),
+			APIHost: "http://api",
+			APIKey:  "key",
+			Dataset: dataset,
+			Data:    map[string]interface{}{"dataset": dataset},
+		})
+	}
+	events := sender.Events()
+	require.Len(t, events, 3)
+	// only failures that might succeed later are queued
+	sender.SendResponse(transmission.Response{Err: errors.New("connection refused"), Metadata: events[0].Metadata})
+	sender.SendResponse(transmission.Response{StatusCode: http.StatusBadRequest, Metadata: events[1].Metadata})
+	sender.SendResponse(transmission.Response{StatusCode: http.StatusAccepted, Metadata: events[2].Metadata})
+	require.NoError(t, d.Stop())
+
+	// the queue is sent again after a restart
+	d, sender = newQueuedTransmission(t, dir)
+	defer d.Stop()
+	batches, queued := d.queue.len()
+	assert.Equal(t, 1, batches)
+	assert.Equal(t, 1, queued)
+
+	retried := make(chan struct{})
+	go func() {
+		d.retryQueued(context.Background(), time.Minute)
+		close(retried)
+	}()
+	require.Eventually(t, func() bool { return len(sender.Events()) == 1 }, time.Second, 10*time.Millisecond)
+	events = sender.Events()
+	assert.Equal(t, "unreachable", events[0].Dataset)
+	assert.Equal(t, "key", events[0].APIKey)
+	assert.Equal(t, "http://api", events[0].APIHost)
+	assert.Equal(t, "unreachable", events[0].Data["dataset"])
+	sender.SendResponse(transmission.Response{StatusCode: http.StatusAccepted, Metadata: events[0].Metadata})
+	<-retried
+	batches, _ = d.queue.len()
+	assert.Zero(t, batches)
+}
+
+func TestRetryWaitsForEachBatch(t *testing.T) {
+	d, sender := newQueuedTransmission(t, t.TempDir())
+	defer d.Stop()
+	for _, dataset := range []string{"first", "second", "third"} {
+		_, err := d.queue.push([]queuedEvent{{APIHost: "http://api", APIKey: "key", Dataset: dataset, Data: map[string]interface{}{"dataset": dataset}}})
+		require.NoError(t, err)
+	}
+
+	retried := make(chan struct{})
+	go func() {
+		d.retryQueued(context.Background(), time.Minute)
+		close(retried)
+	}()
+
+	// the second batch isn't sent until the first one's responses are in
+	require.Eventually(t, func() bool { return len(sender.Events()) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, sender.Events(), 1)
+	sender.SendResponse(transmission.Response{StatusCode: http.StatusAccepted, Metadata: sender.Events()[0].Metadata})
+
+	// when a batch fails again, the rest wait for the next retry
+	require.Eventually(t, func() bool { return len(sender.Events()) == 2 }, time.Second, 10*time.Millisecond)
+	second := sender.Events()[1]
+	assert.Equal(t, "second", second.Dataset)
+	sender.SendResponse(transmission.Response{StatusCode: http.StatusServiceUnavailable, Metadata: second.Metadata})
+	select {
+	case <-retried:
+	case <-time.After(time.Second):
+		t.Fatal("retry didn't stop after a batch failed again")
+	}
+	assert.Len(t, sender.Events(), 2)
+	batches, _ := d.queue.len()
+	assert.Equal(t, 1, batches)
+}
+
+func TestErrorLogsRedactAPIKey(t *testing.T) {
+	log := &logger.MockLogger{}
+	d := &DefaultTransmission{
+		Config:  &config.MockConfig{AdditionalErrorFields: []string{"api_key"}},
+		Logger:  log,
+		Metrics: &metrics.NullMetrics{},
+	}
+	d.handleResponse(transmission.Response{
+		StatusCode: http.StatusBadRequest,
+		Metadata: map[string]any{
+			"api_host":    "http://api",
+			"dataset":     "dataset",
+			"environment": "",
+			"enqueued_at": time.Now().UnixMicro(),
+			"api_key":     "secret0123456789abcdef",
+		},
+	})
+
+	require.Len(t, log.Events, 1)
+	assert.NotEqual(t, "secret0123456789abcdef", log.Events[0].Fields["api_key"])
+	assert.Contains(t, log.Events[0].Fields["api_key"], "hmac:")
+}
@@ -0,0 +1,50 @@
+package transmit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdEncoder is shared, since EncodeAll is safe to use concurrently.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// zstdTransport compresses the bodies of outgoing requests with zstd before
+// handing them to the wrapped transport. Requests that are already encoded
+// are passed through untouched.
+type zstdTransport struct {
+	base http.RoundTripper
+}
+
+// NewZstdTransport returns a RoundTripper that compresses request bodies with
+// zstd, as libhoney does itself. It's meant for libhoney clients with their
+// own compression disabled, so that their requests can be changed before
+// they're compressed.
+func NewZstdTransport(base http.RoundTripper) http.RoundTripper {
+	return &zstdTransport{base: base}
+}
+
+func (t *zstdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// a RoundTripper must not modify the request it was given
+	compressed := zstdEncoder.EncodeAll(body, nil)
+	newReq := req.Clone(req.Context())
+	newReq.Body = io.NopCloser(bytes.NewReader(compressed))
+	newReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	newReq.ContentLength = int64(len(compressed))
+	newReq.Header.Set("Content-Encoding", "zstd")
+	return t.base.RoundTrip(newReq)
+}
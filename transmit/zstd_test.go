@@ -0,0 +1,37 @@
+package transmit
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZstdTransport(t *testing.T) {
+	payload := strings.Repeat(`{"trace.trace_id":"abc123","name":"span"}`, 100)
+
+	var gotEncoding string
+	var gotBody []byte
+	transport := NewZstdTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		gotEncoding = req.Header.Get("Content-Encoding")
+		dec, err := zstd.NewReader(req.Body)
+		require.NoError(t, err)
+		defer dec.Close()
+		gotBody, err = io.ReadAll(dec)
+		require.NoError(t, err)
+		assert.Less(t, req.ContentLength, int64(len(payload)))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	req, err := http.NewRequest("POST", "http://localhost/1/batch/test", strings.NewReader(payload))
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", gotEncoding)
+	assert.Equal(t, payload, string(gotBody))
+	assert.Empty(t, req.Header.Get("Content-Encoding"), "the original request must not be modified")
+}
@@ -80,6 +80,24 @@ type Trace struct {
 	// spans is the list of spans in this trace
 	spans []*Span
 
+	// SpilledSpans and SpilledSize count the spans taken out of memory by
+	// TakeSpans and not yet put back, so that the trace's limits still see
+	// them.
+	SpilledSpans int
+	SpilledSize  int
+
+	// LimitReached is set once the trace has reached its span count or size
+	// limit, and LimitedSpans counts the spans removed from it since.
+	LimitReached bool
+	LimitedSpans int
+	// LimitSummary stands in for the spans removed from the trace, when they
+	// are summarized rather than discarded.
+	LimitSummary *Span
+
+	// seenSpans is a Bloom filter of the spans added to the trace, for
+	// finding duplicates; it's only made if they're being looked for.
+	seenSpans []uint64
+
 	// totalImpact is the sum of the trace's cacheImpact; if this value is 0
 	// it is recalculated during CacheImpact(), otherwise this value is
 	// returned. We reset it to 0 when adding spans so it gets recalculated.
@@ -115,6 +133,141 @@ func (t *Trace) AddSpan(sp *Span) {
 	t.totalImpact = 0
 }
 
+// spanFilterHashes is the number of bits set in the filter for each span.
+const spanFilterHashes = 4
+
+// SeenSpan reports whether a span with the given hash may have been added to
+// the trace before, and records that it has been, in a Bloom filter of size
+// bits. A span that hasn't been seen is occasionally reported as seen, more
+// often as the filter fills. The size of the filter is fixed by the first
+// call.
+func (t *Trace) SeenSpan(hash uint64, bits int) bool {
+	if t.seenSpans == nil {
+		t.seenSpans = make([]uint64, max(1, (bits+63)/64))
+	}
+	m := uint64(len(t.seenSpans) * 64)
+	// the bits are chosen by double hashing the two halves of the hash
+	h1, h2 := hash&0xffffffff, hash>>32|1
+	seen := true
+	for i := uint64(0); i < spanFilterHashes; i++ {
+		bit := (h1 + i*h2) % m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if t.seenSpans[word]&mask == 0 {
+			seen = false
+			t.seenSpans[word] |= mask
+		}
+	}
+	return seen
+}
+
+// TakeSpans removes the spans from this trace and returns them, so that they
+// can be kept somewhere other than memory for a while.
+func (t *Trace) TakeSpans() []*Span {
+	spans := t.spans
+	t.SpilledSpans += len(spans)
+	t.SpilledSize += t.DataSize
+	t.spans = nil
+	t.RootSpan = nil
+	t.DataSize = 0
+	t.totalImpact = 0
+	return spans
+}
+
+// RestoreSpans puts back spans taken by TakeSpans, ahead of any spans that
+// were added since. Unlike AddSpan, it keeps their arrival times.
+func (t *Trace) RestoreSpans(spans []*Span) {
+	for _, sp := range spans {
+		t.DataSize += sp.DataSize
+		t.SpilledSize -= sp.DataSize
+		if sp.IsRoot && t.RootSpan == nil {
+			t.RootSpan = sp
+		}
+	}
+	t.SpilledSpans = max(t.SpilledSpans-len(spans), 0)
+	t.SpilledSize = max(t.SpilledSize, 0)
+	t.spans = append(spans, t.spans...)
+	t.totalImpact = 0
+}
+
+// HasSpan reports whether sp is one of the trace's spans in memory. Spans
+// are usually looked for soon after they're added, so the newest are
+// checked first.
+func (t *Trace) HasSpan(sp *Span) bool {
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i] == sp {
+			return true
+		}
+	}
+	return false
+}
+
+// SummarizeSpan reduces the Data of one of the trace's spans to the given
+// fields, once its full body has been stored elsewhere with the span's
+// BodyID.
+func (t *Trace) SummarizeSpan(sp *Span, fields []string) {
+	summary := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if v, ok := sp.Data[field]; ok {
+			summary[field] = v
+		}
+	}
+	sp.Data = summary
+	size := sp.GetDataSize()
+	t.DataSize -= sp.DataSize - size
+	sp.DataSize = size
+	t.totalImpact = 0
+}
+
+// RestoreBodies replaces the trace's summarized spans with their full
+// bodies, by BodyID. Summaries whose body isn't given are left as they are,
+// and bodies whose summary is no longer in the trace are ignored.
+func (t *Trace) RestoreBodies(bodies map[uint64]*Span) {
+	if len(bodies) == 0 {
+		return
+	}
+	for i, sp := range t.spans {
+		if sp.BodyID == 0 {
+			continue
+		}
+		body, ok := bodies[sp.BodyID]
+		if !ok {
+			continue
+		}
+		body.BodyID = 0
+		t.DataSize += body.DataSize - sp.DataSize
+		if t.RootSpan == sp {
+			t.RootSpan = body
+		}
+		t.spans[i] = body
+	}
+	t.totalImpact = 0
+}
+
+// TrimSpans removes the oldest spans other than the root span until the
+// trace has no more than maxSpans spans and a DataSize of no more than
+// maxBytes, and returns them. A limit of 0 is no limit. Spilled spans count
+// towards the limits, but only spans in memory are removed.
+func (t *Trace) TrimSpans(maxSpans, maxBytes int) []*Span {
+	var trimmed []*Span
+	remaining := len(t.spans) + t.SpilledSpans
+	kept := make([]*Span, 0, len(t.spans))
+	for _, sp := range t.spans {
+		over := (maxSpans > 0 && remaining > maxSpans) || (maxBytes > 0 && t.DataSize+t.SpilledSize > maxBytes)
+		if over && !sp.IsRoot {
+			trimmed = append(trimmed, sp)
+			t.DataSize -= sp.DataSize
+			remaining--
+			continue
+		}
+		kept = append(kept, sp)
+	}
+	if len(trimmed) > 0 {
+		t.spans = kept
+		t.totalImpact = 0
+	}
+	return trimmed
+}
+
 // CacheImpact calculates an abstract value for something we're calling cache impact, which is
 // the sum of the CacheImpact of all of the spans in a trace. We use it to order traces
 // so we can eject the ones that having the most impact on the cache size, but balancing that
@@ -240,6 +393,12 @@ type Span struct {
 	DataSize    int
 	ArrivalTime time.Time
 	IsRoot      bool
+
+	// BodyID is set when the span's Data holds only the fields needed to
+	// decide its trace, while its full body is kept on disk; it identifies
+	// the body, so that it can take the summary's place when the trace is
+	// sent.
+	BodyID uint64
 }
 
 // GetDataSize computes the size of the Data element of the Span.
@@ -291,6 +450,15 @@ func (sp *Span) Type() SpanType {
 	}
 }
 
+// The resource and instrumentation scope of an OTLP span are flattened into
+// its fields when it's translated into an event. So that they can be rebuilt
+// when the span is sent on as OTLP, the names of the fields that came from
+// them are recorded, as a JSON array, in these fields.
+const (
+	OTLPResourceFieldsField = "meta.refinery.otlp.resource_fields"
+	OTLPScopeFieldsField    = "meta.refinery.otlp.scope_fields"
+)
+
 // cacheImpactFactor controls how much more we weigh older spans compared to newer ones;
 // setting this to 1 means they're not weighted by duration
 const cacheImpactFactor = 4
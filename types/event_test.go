@@ -65,6 +65,98 @@ func TestSpan_AnnotationType(t *testing.T) {
 	}
 }
 
+func TestTrace_TrimSpans(t *testing.T) {
+	tr := &Trace{}
+	for _, id := range []string{"a", "root", "b", "c", "d"} {
+		tr.AddSpan(&Span{ID: id, IsRoot: id == "root", Event: Event{Data: map[string]any{"k": "v"}}})
+	}
+	spanSize := tr.DataSize / 5
+
+	trimmed := tr.TrimSpans(3, 0)
+	if len(trimmed) != 2 || trimmed[0].ID != "a" || trimmed[1].ID != "b" {
+		t.Errorf("TrimSpans(3, 0) trimmed %v, want the oldest non-root spans a and b", trimmed)
+	}
+	if got := tr.DescendantCount(); got != 3 {
+		t.Errorf("DescendantCount() = %d, want 3", got)
+	}
+	if tr.DataSize != 3*spanSize {
+		t.Errorf("DataSize = %d, want %d", tr.DataSize, 3*spanSize)
+	}
+
+	// the root span is never trimmed, even if the trace is still too big
+	trimmed = tr.TrimSpans(0, 1)
+	if len(trimmed) != 2 {
+		t.Errorf("TrimSpans(0, 1) trimmed %d spans, want 2", len(trimmed))
+	}
+	if spans := tr.GetSpans(); len(spans) != 1 || spans[0].ID != "root" {
+		t.Errorf("GetSpans() = %v, want only the root span", spans)
+	}
+
+	if trimmed := tr.TrimSpans(0, 0); len(trimmed) != 0 {
+		t.Errorf("TrimSpans(0, 0) trimmed %d spans, want none", len(trimmed))
+	}
+}
+
+func TestTrace_SeenSpan(t *testing.T) {
+	tr := &Trace{}
+	// hashes that differ only in their high bits still set different bits
+	hashes := []uint64{1, 2, 1 << 40, 12345678901234567}
+	for _, h := range hashes {
+		if tr.SeenSpan(h, 1024) {
+			t.Errorf("SeenSpan(%d) = true for a new span", h)
+		}
+	}
+	for _, h := range hashes {
+		if !tr.SeenSpan(h, 1024) {
+			t.Errorf("SeenSpan(%d) = false for a span already seen", h)
+		}
+	}
+	if got := len(tr.seenSpans); got != 16 {
+		t.Errorf("filter has %d words, want 16", got)
+	}
+
+	// the size is fixed by the first call
+	tr.SeenSpan(99, 64)
+	if got := len(tr.seenSpans); got != 16 {
+		t.Errorf("filter has %d words after a smaller size, want 16", got)
+	}
+}
+
+func TestTrace_SummarizeSpan(t *testing.T) {
+	tr := &Trace{}
+	root := &Span{IsRoot: true, Event: Event{Data: map[string]interface{}{"name": "root", "body": "xxxxxxxxxx"}}}
+	tr.RootSpan = root
+	tr.AddSpan(root)
+	full := tr.DataSize
+
+	// the summary keeps only the given fields, and the trace shrinks
+	body := &Span{IsRoot: true, BodyID: 7, Event: Event{Data: root.Data}}
+	body.DataSize = body.GetDataSize()
+	root.BodyID = 7
+	tr.SummarizeSpan(root, []string{"name", "missing"})
+	if len(root.Data) != 1 || root.Data["name"] != "root" {
+		t.Errorf("summary data = %v, want only the name", root.Data)
+	}
+	if tr.DataSize != root.DataSize || tr.DataSize >= full {
+		t.Errorf("DataSize = %d after summarizing, want %d and less than %d", tr.DataSize, root.DataSize, full)
+	}
+
+	// a body without a summary is ignored, and the summary is replaced
+	tr.RestoreBodies(map[uint64]*Span{7: body, 8: {BodyID: 8}})
+	if spans := tr.GetSpans(); len(spans) != 1 || spans[0] != body {
+		t.Errorf("spans = %v, want only the body", spans)
+	}
+	if tr.RootSpan != body {
+		t.Errorf("RootSpan is not the body")
+	}
+	if body.BodyID != 0 {
+		t.Errorf("BodyID = %d for a restored body, want 0", body.BodyID)
+	}
+	if tr.DataSize != full {
+		t.Errorf("DataSize = %d after restoring, want %d", tr.DataSize, full)
+	}
+}
+
 // These benchmarks were just to verify that the size calculation is acceptable
 // even on big spans. The P99 for normal (20-field) spans shows that it will take ~1
 // microsecond (on an m1 laptop) but a 1000-field span (extremely rare!) will take
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// IDGenerator makes the IDs of spans that Refinery creates itself, such as
+// the summary spans that stand in for reduced spans. Embedders can provide
+// their own to guarantee that these IDs never collide with the ones their
+// tenants' instrumentation generates.
+type IDGenerator interface {
+	// NewTraceID returns the ID for a new trace.
+	NewTraceID() string
+	// NewSpanID returns the ID for a new span in the given trace, under the
+	// given parent. The name tells apart spans that share a parent.
+	NewSpanID(traceID, parentID, name string) string
+}
+
+// RandomIDGenerator makes random W3C trace context IDs: 16 bytes for a trace
+// and 8 for a span, as lowercase hex.
+type RandomIDGenerator struct{}
+
+func (RandomIDGenerator) NewTraceID() string {
+	return randomHexID(16)
+}
+
+func (RandomIDGenerator) NewSpanID(traceID, parentID, name string) string {
+	return randomHexID(8)
+}
+
+// DerivedIDGenerator makes span IDs that are derived from the trace, parent
+// and name of the span, so that a span made twice for the same spans, for
+// example by two Refineries, gets the same ID. Trace IDs are random. IDs are
+// in W3C trace context format.
+type DerivedIDGenerator struct{}
+
+func (DerivedIDGenerator) NewTraceID() string {
+	return randomHexID(16)
+}
+
+func (DerivedIDGenerator) NewSpanID(traceID, parentID, name string) string {
+	h := sha256.New()
+	// the separators keep ("ab", "c") and ("a", "bc") apart
+	for _, s := range []string{"refinery", traceID, parentID, name} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	sum := h.Sum(nil)[:8]
+	// an all-zero span ID is invalid
+	if isZeroID(sum) {
+		sum[7] = 1
+	}
+	return hex.EncodeToString(sum)
+}
+
+func randomHexID(n int) string {
+	b := make([]byte, n)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			// crypto/rand only fails if the OS can't provide randomness, and
+			// there's nothing sensible to do about that
+			panic(err)
+		}
+		// an all-zero ID is invalid
+		if !isZeroID(b) {
+			return hex.EncodeToString(b)
+		}
+	}
+}
+
+func isZeroID(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package types
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	w3cTraceID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	w3cSpanID  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+func TestRandomIDGenerator(t *testing.T) {
+	var ids RandomIDGenerator
+	assert.Regexp(t, w3cTraceID, ids.NewTraceID())
+	assert.Regexp(t, w3cSpanID, ids.NewSpanID("trace", "parent", "name"))
+	assert.NotEqual(t, ids.NewSpanID("trace", "parent", "name"), ids.NewSpanID("trace", "parent", "name"))
+}
+
+func TestDerivedIDGenerator(t *testing.T) {
+	var ids DerivedIDGenerator
+	assert.Regexp(t, w3cTraceID, ids.NewTraceID())
+
+	id := ids.NewSpanID("trace", "parent", "name")
+	assert.Regexp(t, w3cSpanID, id)
+	assert.Equal(t, id, ids.NewSpanID("trace", "parent", "name"), "the same inputs give the same ID")
+	assert.NotEqual(t, id, ids.NewSpanID("trace", "parent", "other"))
+	assert.NotEqual(t, id, ids.NewSpanID("trace", "other", "name"))
+	assert.NotEqual(t, id, ids.NewSpanID("other", "parent", "name"))
+	assert.NotEqual(t, ids.NewSpanID("ab", "c", ""), ids.NewSpanID("a", "bc", ""))
+}